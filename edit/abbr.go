@@ -0,0 +1,36 @@
+package edit
+
+// Expansion of abbreviations, the entries of $abbr, when a space is typed
+// after one.
+
+import "strings"
+
+// commandStarts are what a command follows, other than the start of the line.
+const commandStarts = "|;\n({"
+
+// expandAbbr expands the abbreviation right before the dot, if there is one.
+func (ed *Editor) expandAbbr() {
+	if line, dot, ok := expandAbbr(ed.line, ed.dot, ed.ev.Abbreviations()); ok {
+		ed.line, ed.dot = line, dot
+	}
+}
+
+// expandAbbr replaces the word right before dot in line with its expansion in
+// abbrs, when it is in command position: at the start of the line, or after a
+// pipe, a semicolon, a newline or an opening parenthesis or brace. It returns
+// the new line and dot, and whether it has expanded anything.
+func expandAbbr(line string, dot int, abbrs map[string]string) (string, int, bool) {
+	if len(abbrs) == 0 {
+		return line, dot, false
+	}
+	start := strings.LastIndexAny(line[:dot], " \t"+commandStarts) + 1
+	expansion, ok := abbrs[line[start:dot]]
+	if !ok {
+		return line, dot, false
+	}
+	before := strings.TrimRight(line[:start], " \t")
+	if before != "" && !strings.ContainsRune(commandStarts, rune(before[len(before)-1])) {
+		return line, dot, false
+	}
+	return line[:start] + expansion + line[dot:], start + len(expansion), true
+}
@@ -0,0 +1,31 @@
+package edit
+
+import "testing"
+
+var abbrs = map[string]string{"gco": "git checkout", "l": "ls -l"}
+
+var expandAbbrTests = []struct {
+	line    string
+	dot     int
+	newLine string
+	newDot  int
+	ok      bool
+}{
+	{"gco", 3, "git checkout", 12, true},
+	{"echo a | gco", 12, "echo a | git checkout", 21, true},
+	{"put (l", 6, "put (ls -l", 10, true},
+	{"l x", 1, "ls -l x", 5, true},
+	{"echo gco", 8, "echo gco", 8, false},
+	{"gcox", 4, "gcox", 4, false},
+	{"", 0, "", 0, false},
+}
+
+func TestExpandAbbr(t *testing.T) {
+	for _, tt := range expandAbbrTests {
+		line, dot, ok := expandAbbr(tt.line, tt.dot, abbrs)
+		if line != tt.newLine || dot != tt.newDot || ok != tt.ok {
+			t.Errorf("expandAbbr(%q, %d) => (%q, %d, %v), want (%q, %d, %v)",
+				tt.line, tt.dot, line, dot, ok, tt.newLine, tt.newDot, tt.ok)
+		}
+	}
+}
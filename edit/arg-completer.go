@@ -0,0 +1,158 @@
+package edit
+
+// Completion of the arguments of commands. A completer takes the words of the
+// command being completed, from its name to the word being completed, and
+// returns candidates for the last word. Those in $arg-completer come first;
+// the editor has its own for some common commands.
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type argCompleter func(words []string) ([]string, error)
+
+// argCompleters are the completers of the editor, keyed by command name.
+var argCompleters = map[string]argCompleter{
+	"git":  completeGit,
+	"ssh":  completeSSH,
+	"sftp": completeSSH,
+}
+
+// completeArg returns the candidates for the last of words from the completer
+// of the command, which is the first word. An alias is completed like its
+// target, with the words it expands to. It returns no candidates if there is
+// no completer.
+func (ed *Editor) completeArg(words []string) ([]string, error) {
+	if expanded := ed.ev.Compiler.ExpandAlias(words[0]); expanded != nil {
+		words = append(expanded, words[1:]...)
+	}
+	if complete, ok := ed.ev.ArgCompleter(words[0]); ok {
+		return complete(words)
+	}
+	if complete, ok := argCompleters[words[0]]; ok {
+		return complete(words)
+	}
+	return nil, nil
+}
+
+// gitRefCommands are the git subcommands that take branches, tags and other
+// refs.
+var gitRefCommands = map[string]bool{
+	"branch": true, "checkout": true, "cherry-pick": true, "diff": true,
+	"log": true, "merge": true, "push": true, "rebase": true, "reset": true,
+	"show": true, "switch": true, "tag": true,
+}
+
+// gitCommands are offered when git can't list its commands.
+var gitCommands = []string{
+	"add", "bisect", "branch", "checkout", "cherry-pick", "clone", "commit",
+	"diff", "fetch", "grep", "init", "log", "merge", "mv", "pull", "push",
+	"rebase", "reset", "restore", "rm", "show", "stash", "status", "switch",
+	"tag",
+}
+
+// completeGit completes subcommands of git, including aliases, and the refs
+// of the repository for the subcommands that take them. Both are found by
+// running git.
+func completeGit(words []string) ([]string, error) {
+	switch {
+	case len(words) == 2:
+		out, err := exec.Command("git", "--list-cmds=main,others,alias,nohelpers").Output()
+		if err != nil {
+			return gitCommands, nil
+		}
+		return strings.Fields(string(out)), nil
+	case gitRefCommands[words[1]] && !strings.HasPrefix(words[len(words)-1], "-"):
+		out, err := exec.Command("git", "for-each-ref", "--format=%(refname:short)",
+			"refs/heads", "refs/remotes", "refs/tags").Output()
+		if err != nil {
+			// Not in a repository.
+			return nil, nil
+		}
+		return strings.Fields(string(out)), nil
+	}
+	return nil, nil
+}
+
+// completeSSH completes the hosts of ~/.ssh/config and ~/.ssh/known_hosts,
+// after the user@ of the word being completed if there is one.
+func completeSSH(words []string) ([]string, error) {
+	word := words[len(words)-1]
+	if strings.HasPrefix(word, "-") {
+		return nil, nil
+	}
+	user := word[:strings.IndexByte(word, '@')+1]
+	dir := filepath.Join(os.Getenv("HOME"), ".ssh")
+	var hosts []string
+	if f, err := os.Open(filepath.Join(dir, "config")); err == nil {
+		hosts = append(hosts, sshConfigHosts(f)...)
+		f.Close()
+	}
+	if f, err := os.Open(filepath.Join(dir, "known_hosts")); err == nil {
+		hosts = append(hosts, knownHosts(f)...)
+		f.Close()
+	}
+	sort.Strings(hosts)
+	var cands []string
+	for i, h := range hosts {
+		if i == 0 || h != hosts[i-1] {
+			cands = append(cands, user+h)
+		}
+	}
+	return cands, nil
+}
+
+// sshConfigHosts returns the hosts of the Host lines of an ssh config, leaving
+// out patterns.
+func sshConfigHosts(r io.Reader) []string {
+	var hosts []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.FieldsFunc(scanner.Text(), func(r rune) bool {
+			return r == ' ' || r == '\t' || r == '='
+		})
+		if len(fields) < 2 || !strings.EqualFold(fields[0], "host") {
+			continue
+		}
+		for _, h := range fields[1:] {
+			if !strings.ContainsAny(h, "*?!") {
+				hosts = append(hosts, h)
+			}
+		}
+	}
+	return hosts
+}
+
+// knownHosts returns the hosts of a known_hosts file, leaving out hashed
+// ones, which can't be known, and the ports of those with one.
+func knownHosts(r io.Reader) []string {
+	var hosts []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 && strings.HasPrefix(fields[0], "@") {
+			// A marker, like @cert-authority.
+			fields = fields[1:]
+		}
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], "|") {
+			continue
+		}
+		for _, h := range strings.Split(fields[0], ",") {
+			if strings.HasPrefix(h, "[") {
+				if i := strings.Index(h, "]"); i > 0 {
+					h = h[1:i]
+				}
+			}
+			if h != "" && !strings.ContainsAny(h, "*?!") {
+				hosts = append(hosts, h)
+			}
+		}
+	}
+	return hosts
+}
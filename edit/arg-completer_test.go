@@ -0,0 +1,75 @@
+package edit
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/xiaq/elvish/eval"
+	"github.com/xiaq/elvish/parse"
+)
+
+var sshHostsTests = []struct {
+	parse func(string) []string
+	text  string
+	want  []string
+}{
+	{sshConfig, "Host a b\n  HostName a.example.com\nhost=c *.d !e\n", []string{"a", "b", "c"}},
+	{sshConfig, "Match host a\n# Host x\n", nil},
+	{knownHostsIn, "a,10.0.0.1 ssh-rsa AAA\n[b]:2222 ssh-ed25519 AAA\n", []string{"a", "10.0.0.1", "b"}},
+	{knownHostsIn, "|1|x|y ssh-rsa AAA\n# c ssh-rsa AAA\n@revoked d ssh-rsa AAA\n", []string{"d"}},
+}
+
+func sshConfig(s string) []string    { return sshConfigHosts(strings.NewReader(s)) }
+func knownHostsIn(s string) []string { return knownHosts(strings.NewReader(s)) }
+
+func TestSSHHosts(t *testing.T) {
+	for _, tt := range sshHostsTests {
+		if out := tt.parse(tt.text); !reflect.DeepEqual(out, tt.want) {
+			t.Errorf("hosts of %q => %q, want %q", tt.text, out, tt.want)
+		}
+	}
+}
+
+func TestAliasCompletion(t *testing.T) {
+	ev := eval.NewEvaluator()
+	ed := &Editor{ev: ev}
+	if err := ev.EvalText("<alias test>", "arg-completer[mk] = {|@words| put $@words }"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ev.Compiler.SetAlias("m", []string{"mk", "-j4"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ev.Compiler.SetAlias("mm", []string{"m"}); err != nil {
+		t.Fatal(err)
+	}
+	words, err := ed.completeArg([]string{"mm", "a", ""})
+	if want := []string{"mk", "-j4", "a", ""}; err != nil || !reflect.DeepEqual(words, want) {
+		t.Errorf("completing an alias => (%q, %v), want %q", words, err, want)
+	}
+}
+
+var commandHighlightTests = []struct {
+	text string
+	want parse.ItemType
+}{
+	{"m", ItemValidCommand},
+	{"echo", ItemValidCommand},
+	{"no-such-command-x", ItemInvalidCommand},
+	{"bad", ItemInvalidCommand},
+	{"x=1", ItemValidCommand},
+}
+
+func TestHighlightAliases(t *testing.T) {
+	ev := eval.NewEvaluator()
+	ev.Compiler.SetAlias("m", []string{"echo", "-n"})
+	ev.Compiler.SetAlias("bad", []string{"no-such-command-x"})
+	for _, tt := range commandHighlightTests {
+		items := Highlight("<highlight test>", tt.text, ev)
+		if item := <-items; item.Typ != tt.want {
+			t.Errorf("command %q highlighted as %v, want %v", tt.text, item.Typ, tt.want)
+		}
+		for range items {
+		}
+	}
+}
@@ -1,40 +1,138 @@
 package edit
 
+// Styles of what the editor draws. Each element, like the prompt, a kind of
+// token or the selected completion candidate, has a style named after it,
+// which is an SGR sequence without the leading \033[ and trailing m. Styles
+// are changed from elvish with $edit:styles, e.g.
+//
+// edit:styles[command] = "1;32"
+// edit:styles[completion-selected] = "30;46"
+//
+// Elements not in $edit:styles keep their default styles.
+
 import (
+	"fmt"
+
+	"github.com/xiaq/elvish/eval"
 	"github.com/xiaq/elvish/parse"
 )
 
-var (
-	attrForPrompt            = ""
-	attrForRprompt           = "7"
-	attrForCompleted         = ";4"
-	attrForMode              = "1;7;33"
-	attrForTip               = ""
-	attrForCurrentCompletion = ";7"
-	attrForCompletedHistory  = "4"
-	attrForSelectedFile      = ";7"
-)
+// defaultStyles are the styles of all elements, by name.
+var defaultStyles = map[string]string{
+	"prompt":               "",
+	"rprompt":              "7",
+	"comment":              "36",
+	"string":               "33",
+	"redir":                "32",
+	"pipe":                 "32",
+	"syntax-error":         "31",
+	"bracket":              "34;1",
+	"ampersand":            "1",
+	"variable":             "35",
+	"command":              "32",
+	"invalid-command":      "31",
+	"invalid-variable":     "31",
+	"error":                "4",
+	"completed":            "4",
+	"completion-selected":  "7",
+	"completion-match":     "1",
+	"mode":                 "1;7;33",
+	"tip":                  "",
+	"suggestion":           "2",
+	"history-completed":    "4",
+	"history-search-match": "1;4",
+	"file-selected":        "7",
+	"location-selected":    "7",
+	"history-arg-selected": "7",
+}
+
+// styleForType maps the types of tokens to the names of their styles.
+var styleForType = map[parse.ItemType]string{
+	parse.ItemSpace:             "comment", // only applies to comments
+	parse.ItemSingleQuoted:      "string",
+	parse.ItemDoubleQuoted:      "string",
+	parse.ItemRawQuoted:         "string",
+	parse.ItemHeredoc:           "string",
+	parse.ItemRedirLeader:       "redir",
+	parse.ItemStatusRedirLeader: "redir",
+	parse.ItemPipe:              "pipe",
+	parse.ItemError:             "syntax-error",
+	parse.ItemQuestionLParen:    "bracket",
+	parse.ItemLessLParen:        "bracket",
+	parse.ItemGreaterLParen:     "bracket",
+	parse.ItemLParen:            "bracket",
+	parse.ItemRParen:            "bracket",
+	parse.ItemLBracket:          "bracket",
+	parse.ItemRBracket:          "bracket",
+	parse.ItemLBrace:            "bracket",
+	parse.ItemRBrace:            "bracket",
+	parse.ItemAmpersand:         "ampersand",
+	parse.ItemDollar:            "variable",
+
+	ItemValidCommand:    "command",
+	ItemInvalidCommand:  "invalid-command",
+	ItemValidVariable:   "variable",
+	ItemInvalidVariable: "invalid-variable",
+}
+
+// styles are the styles changed from their defaults, by name.
+type styles map[string]string
+
+// of returns the style named name.
+func (s styles) of(name string) string {
+	if style, ok := s[name]; ok {
+		return style
+	}
+	return defaultStyles[name]
+}
+
+// ofType returns the style of tokens of type typ.
+func (s styles) ofType(typ parse.ItemType) string {
+	if name, ok := styleForType[typ]; ok {
+		return s.of(name)
+	}
+	return ""
+}
+
+// joinStyles combines two styles, the latter taking precedence.
+func joinStyles(a, b string) string {
+	switch {
+	case a == "":
+		return b
+	case b == "":
+		return a
+	}
+	return a + ";" + b
+}
+
+// setStyles sets $edit:styles to v, which must be a table mapping names of
+// elements to styles.
+func (ed *Editor) setStyles(v eval.Value) error {
+	t, ok := v.(*eval.Table)
+	if !ok {
+		return fmt.Errorf("styles must be a table, got %s", v.Repr())
+	}
+	s := make(styles)
+	for k, v := range t.Dict {
+		name, style := k.String(), v.String()
+		if _, ok := defaultStyles[name]; !ok {
+			return fmt.Errorf("no element named %s", name)
+		}
+		if !isSGR(style) {
+			return fmt.Errorf("bad style %s for %s", v.Repr(), name)
+		}
+		s[name] = style
+	}
+	ed.styleTable, ed.styles = t, s
+	return nil
+}
 
-var attrForType = map[parse.ItemType]string{
-	parse.ItemSpace:             "36", // only applies to comments
-	parse.ItemSingleQuoted:      "33",
-	parse.ItemDoubleQuoted:      "33",
-	parse.ItemRedirLeader:       "32",
-	parse.ItemStatusRedirLeader: "32",
-	parse.ItemPipe:              "32",
-	parse.ItemError:             "31",
-	parse.ItemQuestionLParen:    "34;1",
-	parse.ItemLParen:            "34;1",
-	parse.ItemRParen:            "34;1",
-	parse.ItemLBracket:          "34;1",
-	parse.ItemRBracket:          "34;1",
-	parse.ItemLBrace:            "34;1",
-	parse.ItemRBrace:            "34;1",
-	parse.ItemAmpersand:         "1",
-	parse.ItemDollar:            "35",
-
-	ItemValidCommand:    "32",
-	ItemInvalidCommand:  "31",
-	ItemValidVariable:   "35",
-	ItemInvalidVariable: "31",
+// isSGR returns whether s is made of SGR parameters, like "1;33".
+func isSGR(s string) bool {
+	for _, r := range s {
+		if r != ';' && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
 }
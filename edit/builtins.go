@@ -2,17 +2,17 @@ package edit
 
 import (
 	"fmt"
-	"strings"
 	"unicode"
 	"unicode/utf8"
 
+	"github.com/xiaq/elvish/parse"
 	"github.com/xiaq/elvish/util"
 )
 
 // Line editor builtins.
-// These are not exposed to the user in anyway yet. Ideally, they should
-// reside in a dedicated namespace and callable by users, e.g.
-// le:kill-line-right.
+// These are not callable by users yet, but they can be bound to keys with
+// le:bind. Ideally, they should reside in a dedicated namespace and callable
+// by users, e.g. le:kill-line-right.
 
 type editorAction int
 
@@ -31,32 +31,44 @@ type leBuiltin func(ed *Editor, k Key) *leReturn
 
 var leBuiltins = map[string]leBuiltin{
 	// Command and insert mode
-	"start-insert":    startInsert,
-	"start-command":   startCommand,
-	"kill-line-left":  killLineLeft,
-	"kill-line-right": killLineRight,
-	"kill-word-left":  killWordLeft,
-	"kill-rune-left":  killRuneLeft,
-	"kill-rune-right": killRuneRight,
-	"move-dot-left":   moveDotLeft,
-	"move-dot-right":  moveDotRight,
-	"move-dot-up":     moveDotUp,
-	"move-dot-down":   moveDotDown,
-	"insert-key":      insertKey,
-	"return-line":     returnLine,
-	"return-eof":      returnEORight,
-	"default-command": defaultCommand,
-	"default-insert":  defaultInsert,
+	"start-insert":        startInsert,
+	"start-command":       startCommand,
+	"start-insert-right":  startInsertRight,
+	"start-insert-at-sol": startInsertAtSOL,
+	"start-insert-at-eol": startInsertAtEOL,
+	"kill-rune-left":      killRuneLeft,
+	"kill-rune-right":     killRuneRight,
+	"move-dot-left":       moveDotLeft,
+	"move-dot-right":      moveDotRight,
+	"move-dot-left-word":  moveDotLeftWord,
+	"move-dot-right-word": moveDotRightWord,
+	"move-dot-sol":        moveDotSOL,
+	"move-dot-eol":        moveDotEOL,
+	"move-dot-up":         moveDotUp,
+	"move-dot-down":       moveDotDown,
+	"insert-key":          insertKey,
+	"yank":                yank,
+	"yank-right":          yankRight,
+	"yank-pop":            yankPop,
+	"return-line":         returnLine,
+	"return-eof":          returnEORight,
+	"default-command":     defaultCommand,
+	"default-insert":      defaultInsert,
+
+	"preview-expansion": previewExpansion,
 
 	// Completion mode
-	"start-completion":   startCompletion,
-	"cancel-completion":  cancelCompletion,
-	"select-cand-up":     selectCandUp,
-	"select-cand-down":   selectCandDown,
-	"select-cand-left":   selectCandLeft,
-	"select-cand-right":  selectCandRight,
-	"cycle-cand-right":   cycleCandRight,
-	"default-completion": defaultCompletion,
+	"start-completion":      startCompletion,
+	"cancel-completion":     cancelCompletion,
+	"select-cand-up":        selectCandUp,
+	"select-cand-down":      selectCandDown,
+	"select-cand-left":      selectCandLeft,
+	"select-cand-right":     selectCandRight,
+	"cycle-cand-right":      cycleCandRight,
+	"cycle-cand-left":       cycleCandLeft,
+	"select-cand-page-up":   selectCandPageUp,
+	"select-cand-page-down": selectCandPageDown,
+	"default-completion":    defaultCompletion,
 
 	// Navigation mode
 	"start-navigation":   startNavigation,
@@ -71,6 +83,42 @@ var leBuiltins = map[string]leBuiltin{
 	"select-history-prev": selectHistoryPrev,
 	"select-history-next": selectHistoryNext,
 	"default-history":     defaultHistory,
+
+	// History search mode
+	"start-history-search":   startHistorySearch,
+	"history-search-older":   historySearchOlder,
+	"history-search-delete":  historySearchDelete,
+	"cancel-history-search":  cancelHistorySearch,
+	"default-history-search": defaultHistorySearch,
+
+	// Location mode
+	"start-location":       startLocation,
+	"select-location-prev": selectLocationPrev,
+	"select-location-next": selectLocationNext,
+	"location-delete":      locationDelete,
+	"accept-location":      acceptLocation,
+	"cancel-location":      cancelLocation,
+	"default-location":     defaultLocation,
+
+	// History argument mode
+	"start-history-arg":        startHistoryArg,
+	"history-arg-older":        historyArgOlder,
+	"history-arg-newer":        historyArgNewer,
+	"select-history-arg-left":  selectHistoryArgLeft,
+	"select-history-arg-right": selectHistoryArgRight,
+	"accept-history-arg":       acceptHistoryArg,
+	"cancel-history-arg":       cancelHistoryArg,
+	"default-history-arg":      defaultHistoryArg,
+}
+
+// Builtins on text objects are generated here rather than along with the text
+// objects, so that they are available when keyBindings is checked.
+func init() {
+	for name, obj := range textObjects {
+		leBuiltins["kill-"+name] = textObjectBuiltin(obj, true, false)
+		leBuiltins["change-"+name] = textObjectBuiltin(obj, true, true)
+		leBuiltins["copy-"+name] = textObjectBuiltin(obj, false, false)
+	}
 }
 
 func startInsert(ed *Editor, k Key) *leReturn {
@@ -88,35 +136,29 @@ func startCommand(ed *Editor, k Key) *leReturn {
 	return nil
 }
 
-func killLineLeft(ed *Editor, k Key) *leReturn {
-	sol := util.FindLastSOL(ed.line[:ed.dot])
-	ed.line = ed.line[:sol] + ed.line[ed.dot:]
-	ed.dot = sol
+// startInsertRight starts insert mode after the rune under dot, like the a
+// command of vi.
+func startInsertRight(ed *Editor, k Key) *leReturn {
+	moveDotRight(ed, k)
+	ed.mode = modeInsert
 	return nil
 }
 
-func killLineRight(ed *Editor, k Key) *leReturn {
-	eol := util.FindFirstEOL(ed.line[ed.dot:]) + ed.dot
-	ed.line = ed.line[:ed.dot] + ed.line[eol:]
+func startInsertAtSOL(ed *Editor, k Key) *leReturn {
+	moveDotSOL(ed, k)
+	ed.mode = modeInsert
 	return nil
 }
 
-// NOTE(xiaq): A word is now defined as a series of non-whitespace chars.
-func killWordLeft(ed *Editor, k Key) *leReturn {
-	if ed.dot == 0 {
-		return nil
-	}
-	space := strings.LastIndexFunc(
-		strings.TrimRightFunc(ed.line[:ed.dot], unicode.IsSpace),
-		unicode.IsSpace) + 1
-	ed.line = ed.line[:space] + ed.line[ed.dot:]
-	ed.dot = space
+func startInsertAtEOL(ed *Editor, k Key) *leReturn {
+	moveDotEOL(ed, k)
+	ed.mode = modeInsert
 	return nil
 }
 
 func killRuneLeft(ed *Editor, k Key) *leReturn {
 	if ed.dot > 0 {
-		_, w := utf8.DecodeLastRuneInString(ed.line[:ed.dot])
+		w := lastGraphemeLen(ed.line[:ed.dot])
 		ed.line = ed.line[:ed.dot-w] + ed.line[ed.dot:]
 		ed.dot -= w
 	} else {
@@ -127,7 +169,7 @@ func killRuneLeft(ed *Editor, k Key) *leReturn {
 
 func killRuneRight(ed *Editor, k Key) *leReturn {
 	if ed.dot < len(ed.line) {
-		_, w := utf8.DecodeRuneInString(ed.line[ed.dot:])
+		w := graphemeLen(ed.line[ed.dot:])
 		ed.line = ed.line[:ed.dot] + ed.line[ed.dot+w:]
 	} else {
 		ed.beep()
@@ -136,14 +178,38 @@ func killRuneRight(ed *Editor, k Key) *leReturn {
 }
 
 func moveDotLeft(ed *Editor, k Key) *leReturn {
-	_, w := utf8.DecodeLastRuneInString(ed.line[:ed.dot])
-	ed.dot -= w
+	ed.dot -= lastGraphemeLen(ed.line[:ed.dot])
 	return nil
 }
 
 func moveDotRight(ed *Editor, k Key) *leReturn {
-	_, w := utf8.DecodeRuneInString(ed.line[ed.dot:])
-	ed.dot += w
+	if ed.acceptSuggestion() {
+		return nil
+	}
+	ed.dot += graphemeLen(ed.line[ed.dot:])
+	return nil
+}
+
+func moveDotLeftWord(ed *Editor, k Key) *leReturn {
+	ed.dot, _, _ = wordLeft(ed.line, ed.dot)
+	return nil
+}
+
+func moveDotRightWord(ed *Editor, k Key) *leReturn {
+	_, ed.dot, _ = wordRight(ed.line, ed.dot)
+	return nil
+}
+
+func moveDotSOL(ed *Editor, k Key) *leReturn {
+	ed.dot = util.FindLastSOL(ed.line[:ed.dot])
+	return nil
+}
+
+func moveDotEOL(ed *Editor, k Key) *leReturn {
+	if ed.acceptSuggestion() {
+		return nil
+	}
+	ed.dot += util.FindFirstEOL(ed.line[ed.dot:])
 	return nil
 }
 
@@ -191,6 +257,24 @@ func returnEORight(ed *Editor, k Key) *leReturn {
 	return nil
 }
 
+// previewExpansion shows the current line with all words expanded as a tip,
+// without executing anything.
+func previewExpansion(ed *Editor, k Key) *leReturn {
+	name := "<expansion preview>"
+	n, err := parse.Parse(name, ed.line)
+	if err != nil {
+		ed.pushTip(err.Error())
+		return nil
+	}
+	s, err := ed.ev.Expand(name, ed.line, n)
+	if err != nil {
+		ed.pushTip(err.Error())
+		return nil
+	}
+	ed.pushTip(s)
+	return nil
+}
+
 func selectCandUp(ed *Editor, k Key) *leReturn {
 	ed.completion.prev(false)
 	return nil
@@ -220,6 +304,46 @@ func cycleCandRight(ed *Editor, k Key) *leReturn {
 	return nil
 }
 
+func cycleCandLeft(ed *Editor, k Key) *leReturn {
+	ed.completion.prev(true)
+	return nil
+}
+
+// selectCandPage moves the selection n pages down in its column, where a page
+// is the number of lines shown in the listing.
+func selectCandPage(ed *Editor, n int) {
+	c := ed.completion
+	lines, page := ed.completionLines, ed.completionPageLines
+	if lines == 0 || page == 0 {
+		return
+	}
+	cur := c.current
+	if cur < 0 {
+		cur = 0
+	}
+	row := cur%lines + n*page
+	switch {
+	case row < 0:
+		row = 0
+	case row >= lines:
+		row = lines - 1
+	}
+	c.current = cur/lines*lines + row
+	if c.current >= len(c.candidates) {
+		c.current = len(c.candidates) - 1
+	}
+}
+
+func selectCandPageUp(ed *Editor, k Key) *leReturn {
+	selectCandPage(ed, -1)
+	return nil
+}
+
+func selectCandPageDown(ed *Editor, k Key) *leReturn {
+	selectCandPage(ed, 1)
+	return nil
+}
+
 func cancelCompletion(ed *Editor, k Key) *leReturn {
 	ed.completion = nil
 	ed.mode = modeInsert
@@ -227,6 +351,9 @@ func cancelCompletion(ed *Editor, k Key) *leReturn {
 }
 
 func defaultInsert(ed *Editor, k Key) *leReturn {
+	if k == (Key{' ', 0}) {
+		ed.expandAbbr()
+	}
 	if k.Mod == 0 && k.Rune > 0 && unicode.IsGraphic(k.Rune) {
 		return insertKey(ed, k)
 	}
@@ -3,6 +3,9 @@ package edit
 import (
 	"fmt"
 	"io/ioutil"
+	"sort"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/xiaq/elvish/parse"
 )
@@ -56,77 +59,167 @@ func (c *completion) next(cycle bool) {
 	}
 }
 
-func findCandidates(p string, all []string) (cands []*candidate) {
-	// Prefix match
+// findCandidates returns the candidates among all that match p with match.
+// The parts of a candidate that match are the parts that are not completed.
+func findCandidates(match matcher, p string, all []string) (cands []*candidate) {
 	for _, s := range all {
-		if len(s) >= len(p) && s[:len(p)] == p {
-			cand := newCandidate()
-			cand.push(tokenPart{p, false})
-			cand.push(tokenPart{s[len(p):], true})
-			cands = append(cands, cand)
+		regions, ok := match(p, s)
+		if !ok {
+			continue
 		}
+		cand := newCandidate()
+		i := 0
+		for _, r := range regions {
+			if r[0] > i {
+				cand.push(tokenPart{s[i:r[0]], true})
+			}
+			if r[1] > r[0] {
+				cand.push(tokenPart{s[r[0]:r[1]], false})
+			}
+			i = r[1]
+		}
+		if i < len(s) {
+			cand.push(tokenPart{s[i:], true})
+		}
+		cands = append(cands, cand)
 	}
 	return
 }
 
-func fileNames(dir string) (names []string, err error) {
-	infos, e := ioutil.ReadDir(".")
+// commonPrefix returns the longest common prefix of the texts of candidates.
+func commonPrefix(cands []*candidate) string {
+	if len(cands) == 0 {
+		return ""
+	}
+	prefix := cands[0].text
+	for _, c := range cands[1:] {
+		i := 0
+		for i < len(prefix) && i < len(c.text) && prefix[i] == c.text[i] {
+			i++
+		}
+		prefix = prefix[:i]
+	}
+	// Don't cut a multi-byte rune in half
+	for len(prefix) > 0 && !utf8.ValidString(prefix) {
+		prefix = prefix[:len(prefix)-1]
+	}
+	return prefix
+}
+
+// fileNames returns the names of files in the directory part of pattern,
+// prefixed with the directory part. Names of directories have a trailing
+// slash.
+func fileNames(pattern string) (names []string, err error) {
+	dir := pattern[:strings.LastIndex(pattern, "/")+1]
+	readDir := dir
+	if readDir == "" {
+		readDir = "."
+	}
+	infos, e := ioutil.ReadDir(readDir)
 	if e != nil {
 		err = e
 		return
 	}
 	for _, info := range infos {
-		names = append(names, info.Name())
+		name := dir + info.Name()
+		if info.IsDir() {
+			name += "/"
+		}
+		names = append(names, name)
 	}
 	return
 }
 
-func startCompletion(ed *Editor, k Key) *leReturn {
+// findCompletion finds the completion of the text before the dot, along with
+// the pattern being completed. When nothing can be completed, it returns a
+// tip explaining why.
+func (ed *Editor) findCompletion() (*completion, string, string) {
 	c := &completion{}
 	ctx, err := parse.Complete("<completion>", ed.line[:ed.dot])
 	if err != nil {
-		ed.pushTip("parser error")
-		return nil
+		return nil, "", "parser error"
 	}
 	pctx := ctx.EvalPlain()
 	if pctx == nil {
-		ed.pushTip("context not plain")
-		return nil
+		return nil, "", "context not plain"
 	}
 	switch pctx.Typ {
 	case parse.CommandContext:
 		// BUG(xiaq): When completing, CommandContext is not supported
-		ed.pushTip("command context not yet supported :(")
-	case parse.ArgContext:
-		// BUG(xiaq): When completing, ArgContext is treated like RedirFilenameContext
-		fallthrough
-	case parse.RedirFilenameContext:
-		// BUG(xiaq): When completing, only the case of ctx.ThisFactor.Typ == StringFactor is supported
+		return nil, "", "command context not yet supported :("
+	case parse.ArgContext, parse.RedirFilenameContext:
+		// BUG(xiaq): When completing, only the case of
+		// ctx.ThisFactor.Typ == StringFactor is supported
 		if pctx.ThisFactor.Typ != parse.StringFactor {
-			ed.pushTip("only StringFactor is supported :(")
-			return nil
+			return nil, "", "only StringFactor is supported :("
 		}
 		pattern := pctx.PrevFactors + pctx.ThisFactor.Node.(*parse.StringNode).Text
-		names, err := fileNames(".")
-		if err != nil {
-			ed.pushTip(err.Error())
-			return nil
+		match := ed.matcher("")
+		if pctx.Typ == parse.ArgContext {
+			// Arguments the command has a completer for are completed by it,
+			// falling back to file names when it has no candidates.
+			match = ed.matcher(pctx.CommandTerm)
+			words := append([]string{pctx.CommandTerm}, pctx.PrevTerms...)
+			names, err := ed.completeArg(append(words, pattern))
+			if err != nil {
+				return nil, "", err.Error()
+			}
+			c.candidates = findCandidates(match, pattern, names)
+		}
+		if len(c.candidates) == 0 {
+			var names []string
+			if strings.HasPrefix(pattern, "~") && !strings.ContainsRune(pattern, '/') {
+				// Complete named directories
+				for name := range ed.ev.NamedDirs() {
+					names = append(names, "~"+name+"/")
+				}
+				sort.Strings(names)
+			} else {
+				names, err = fileNames(pattern)
+				if err != nil {
+					return nil, "", err.Error()
+				}
+			}
+			c.candidates = findCandidates(match, pattern, names)
 		}
 		c.start = int(ctx.PrevFactors.Pos)
 		c.end = ed.dot
 		// BUG(xiaq) When completing, completion.typ is always ItemBare
 		c.typ = parse.ItemBare
-		c.candidates = findCandidates(pattern, names)
-		if len(c.candidates) > 0 {
-			// XXX assumes filename candidate
-			for _, c := range c.candidates {
-				c.attr = defaultLsColor.determineAttr(c.text)
-			}
-			ed.completion = c
-			ed.mode = modeCompletion
-		} else {
-			ed.pushTip(fmt.Sprintf("No completion for %s", pattern))
+		if len(c.candidates) == 0 {
+			return nil, "", fmt.Sprintf("No completion for %s", pattern)
 		}
+		return c, pattern, ""
+	}
+	return nil, "", ""
+}
+
+func startCompletion(ed *Editor, k Key) *leReturn {
+	c, pattern, tip := ed.findCompletion()
+	if c == nil {
+		if tip != "" {
+			ed.pushTip(tip)
+		}
+		return nil
+	}
+	if len(c.candidates) == 1 {
+		// A unique candidate is accepted right away
+		ed.completion = c
+		ed.replaceCompletion(c.candidates[0].text)
+		ed.completion = nil
+		return nil
+	}
+	// XXX assumes filename candidate
+	for _, c := range c.candidates {
+		c.attr = defaultLsColor.determineAttr(c.text)
+	}
+	// Insert the common prefix of all candidates if it extends the pattern,
+	// and show the menu with no candidate selected
+	ed.completion = c
+	if prefix := commonPrefix(c.candidates); len(prefix) > len(pattern) && strings.HasPrefix(prefix, pattern) {
+		ed.replaceCompletion(prefix)
 	}
+	c.current = -1
+	ed.mode = modeCompletion
 	return nil
 }
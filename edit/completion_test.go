@@ -0,0 +1,47 @@
+package edit
+
+import "testing"
+
+var commonPrefixTests = []struct {
+	texts []string
+	want  string
+}{
+	{[]string{}, ""},
+	{[]string{"foo"}, "foo"},
+	{[]string{"foobar", "foobaz", "foo"}, "foo"},
+	{[]string{"abc", "xyz"}, ""},
+	{[]string{"a你", "a好"}, "a"},
+}
+
+func TestCommonPrefix(t *testing.T) {
+	for _, tt := range commonPrefixTests {
+		var cands []*candidate
+		for _, text := range tt.texts {
+			cands = append(cands, &candidate{text: text})
+		}
+		if out := commonPrefix(cands); out != tt.want {
+			t.Errorf("commonPrefix(%q) => %q, want %q", tt.texts, out, tt.want)
+		}
+	}
+}
+
+var findPageTests = []struct {
+	height, selected, max int
+	low, high             int
+}{
+	{10, 3, 4, 0, 4},
+	{10, 4, 4, 4, 8},
+	{10, 9, 4, 8, 10},
+	{10, -1, 4, 0, 4},
+	{3, 2, 4, 0, 3},
+}
+
+func TestFindPage(t *testing.T) {
+	for _, tt := range findPageTests {
+		low, high := findPage(tt.height, tt.selected, tt.max)
+		if low != tt.low || high != tt.high {
+			t.Errorf("findPage(%d, %d, %d) => (%d, %d), want (%d, %d)",
+				tt.height, tt.selected, tt.max, low, high, tt.low, tt.high)
+		}
+	}
+}
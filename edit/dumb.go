@@ -0,0 +1,85 @@
+package edit
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Line reading on dumb terminals.
+
+// readLinePlain reads a line on a dumb terminal, like that of the shell mode
+// of Emacs, which echoes and edits the line itself. No raw mode, colors or
+// cursor addressing are used. A line ending in a tab asks for completion:
+// the candidates are listed one per line, and the prompt is written again.
+func (ed *Editor) readLinePlain(prompt func() string) LineRead {
+	for {
+		ed.writeNotifications()
+		ed.file.WriteString(stripSGR(prompt()))
+		ed.promptDrawn()
+		line, err := readPlainLine(ed.file)
+		if err == io.EOF && line == "" {
+			return LineRead{EOF: true}
+		} else if err != nil && err != io.EOF {
+			return LineRead{Err: err}
+		}
+		if strings.HasSuffix(line, "\t") {
+			ed.listCompletion(ed.file, strings.TrimRight(line, "\t"))
+			continue
+		}
+		if line != "" {
+			ed.appendHistory(line)
+		}
+		return LineRead{Line: line}
+	}
+}
+
+// writeNotifications writes the messages sent with Notify so far. Messages
+// sent while a line is being read wait for the next line, so as not to be
+// mixed with the line that the terminal echoes.
+func (ed *Editor) writeNotifications() {
+	for {
+		select {
+		case text := <-ed.notifications:
+			ed.file.WriteString(stripSGR(strings.TrimSuffix(text, "\n")) + "\n")
+		default:
+			return
+		}
+	}
+}
+
+// readPlainLine reads up to a newline, one byte at a time so that nothing
+// after the line is consumed. The newline and a preceding carriage return are
+// dropped.
+func readPlainLine(r io.Reader) (string, error) {
+	var buf []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n > 0 {
+			if b[0] == '\n' {
+				return strings.TrimSuffix(string(buf), "\r"), nil
+			}
+			buf = append(buf, b[0])
+		}
+		if err != nil {
+			return string(buf), err
+		}
+	}
+}
+
+// listCompletion writes the completion candidates of line to w, one per line,
+// or a tip if there are none.
+func (ed *Editor) listCompletion(w io.Writer, line string) {
+	ed.line, ed.dot = line, len(line)
+	c, _, tip := ed.findCompletion()
+	if c == nil {
+		if tip != "" {
+			fmt.Fprintln(w, tip)
+		}
+		return
+	}
+	for _, cand := range c.candidates {
+		fmt.Fprintln(w, line[:c.start]+cand.text)
+	}
+}
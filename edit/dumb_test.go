@@ -0,0 +1,28 @@
+package edit
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+var readPlainLineTests = []struct {
+	in   string
+	want string
+	err  error
+}{
+	{"echo\nmore", "echo", nil},
+	{"echo\r\n", "echo", nil},
+	{"ls a\t\n", "ls a\t", nil},
+	{"partial", "partial", io.EOF},
+	{"", "", io.EOF},
+}
+
+func TestReadPlainLine(t *testing.T) {
+	for _, tt := range readPlainLineTests {
+		out, err := readPlainLine(strings.NewReader(tt.in))
+		if out != tt.want || err != tt.err {
+			t.Errorf("readPlainLine(%q) => (%q, %v), want (%q, %v)", tt.in, out, err, tt.want, tt.err)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package edit
+
+import (
+	"fmt"
+
+	"github.com/xiaq/elvish/eval"
+)
+
+// Editing modes.
+
+// editingMode is a complete set of key bindings, selected with the
+// le:editing-mode builtin. Modes of the editor not in bindings keep the
+// bindings from keyBindings. sequences are key sequences written as
+// space-separated keys, bound after bindings.
+type editingMode struct {
+	bindings  map[bufferMode]map[Key]string
+	sequences map[bufferMode]map[string]string
+}
+
+var editingModes = map[string]*editingMode{
+	"default": {},
+	"emacs":   {bindings: map[bufferMode]map[Key]string{modeInsert: emacsInsertBindings}},
+	"vi": {
+		bindings: map[bufferMode]map[Key]string{
+			modeInsert:  viInsertBindings,
+			modeCommand: viCommandBindings,
+		},
+		sequences: map[bufferMode]map[string]string{
+			modeCommand: viCommandSequences(),
+		},
+	},
+}
+
+var emacsInsertBindings = map[Key]string{
+	Key{'A', Ctrl}:      "move-dot-sol",
+	Key{'E', Ctrl}:      "move-dot-eol",
+	Key{'B', Ctrl}:      "move-dot-left",
+	Key{'F', Ctrl}:      "move-dot-right",
+	Key{'b', Alt}:       "move-dot-left-word",
+	Key{'f', Alt}:       "move-dot-right-word",
+	Key{'P', Ctrl}:      "move-dot-up",
+	Key{'N', Ctrl}:      "move-dot-down",
+	Key{Left, 0}:        "move-dot-left",
+	Key{Right, 0}:       "move-dot-right",
+	Key{Up, 0}:          "move-dot-up",
+	Key{Down, 0}:        "move-dot-down",
+	Key{Home, 0}:        "move-dot-sol",
+	Key{End, 0}:         "move-dot-eol",
+	Key{'H', Ctrl}:      "kill-rune-left",
+	Key{Backspace, 0}:   "kill-rune-left",
+	Key{Delete, 0}:      "kill-rune-right",
+	Key{'K', Ctrl}:      "kill-line-right",
+	Key{'U', Ctrl}:      "kill-line-left",
+	Key{'W', Ctrl}:      "kill-word-left",
+	Key{Backspace, Alt}: "kill-word-left",
+	Key{'d', Alt}:       "kill-word-right",
+	Key{'Y', Ctrl}:      "yank",
+	Key{'y', Alt}:       "yank-pop",
+	Key{Enter, Alt}:     "insert-key",
+	Key{Enter, 0}:       "return-line",
+	Key{'D', Ctrl}:      "return-eof",
+	Key{Tab, 0}:         "start-completion",
+	Key{PageUp, 0}:      "start-history",
+	Key{'R', Ctrl}:      "start-history-search",
+	Key{'n', Alt}:       "start-navigation",
+	Key{'l', Alt}:       "start-location",
+	Key{'.', Alt}:       "start-history-arg",
+	Key{'e', Alt}:       "preview-expansion",
+	DefaultBinding:      "default-insert",
+}
+
+var viInsertBindings = map[Key]string{
+	Key{'[', Ctrl}:    "start-command",
+	Key{'U', Ctrl}:    "kill-line-left",
+	Key{'W', Ctrl}:    "kill-word-left",
+	Key{Backspace, 0}: "kill-rune-left",
+	Key{Delete, 0}:    "kill-rune-right",
+	Key{Left, 0}:      "move-dot-left",
+	Key{Right, 0}:     "move-dot-right",
+	Key{Up, 0}:        "move-dot-up",
+	Key{Down, 0}:      "move-dot-down",
+	Key{Enter, Alt}:   "insert-key",
+	Key{Enter, 0}:     "return-line",
+	Key{'D', Ctrl}:    "return-eof",
+	Key{Tab, 0}:       "start-completion",
+	Key{PageUp, 0}:    "start-history",
+	Key{'R', Ctrl}:    "start-history-search",
+	Key{'N', Ctrl}:    "start-navigation",
+	Key{'L', Ctrl}:    "start-location",
+	Key{'.', Alt}:     "start-history-arg",
+	DefaultBinding:    "default-insert",
+}
+
+var viCommandBindings = map[Key]string{
+	Key{'i', 0}:    "start-insert",
+	Key{'a', 0}:    "start-insert-right",
+	Key{'I', 0}:    "start-insert-at-sol",
+	Key{'A', 0}:    "start-insert-at-eol",
+	Key{'h', 0}:    "move-dot-left",
+	Key{'l', 0}:    "move-dot-right",
+	Key{'k', 0}:    "move-dot-up",
+	Key{'j', 0}:    "move-dot-down",
+	Key{Left, 0}:   "move-dot-left",
+	Key{Right, 0}:  "move-dot-right",
+	Key{Up, 0}:     "move-dot-up",
+	Key{Down, 0}:   "move-dot-down",
+	Key{'b', 0}:    "move-dot-left-word",
+	Key{'w', 0}:    "move-dot-right-word",
+	Key{'0', 0}:    "move-dot-sol",
+	Key{'^', 0}:    "move-dot-sol",
+	Key{'$', 0}:    "move-dot-eol",
+	Key{'x', 0}:    "kill-rune-right",
+	Key{'X', 0}:    "kill-rune-left",
+	Key{'D', 0}:    "kill-line-right",
+	Key{'C', 0}:    "change-line-right",
+	Key{'p', 0}:    "yank-right",
+	Key{'P', 0}:    "yank",
+	Key{Enter, 0}:  "return-line",
+	Key{'D', Ctrl}: "return-eof",
+	DefaultBinding: "default-command",
+}
+
+// viCommandSequences makes the key sequences of vi command mode, which apply
+// the operators d (kill), c (change) and y (copy) to motions and text
+// objects, e.g. "d w", "c i w" and "y a (". Doubling an operator applies it
+// to the whole line.
+func viCommandSequences() map[string]string {
+	operators := map[string]string{"d": "kill", "c": "change", "y": "copy"}
+	objects := map[string]string{
+		"0": "line-left", "^": "line-left", "$": "line-right",
+		"b": "word-left", "w": "word-right",
+		"i w": "inner-word", "a w": "a-word",
+		`i "`: "inner-dquote", `a "`: "a-dquote",
+		"i `": "inner-bquote", "a `": "a-bquote",
+		"i (": "inner-paren", "a (": "a-paren",
+		"i )": "inner-paren", "a )": "a-paren",
+		"i [": "inner-bracket", "a [": "a-bracket",
+		"i ]": "inner-bracket", "a ]": "a-bracket",
+		"i {": "inner-brace", "a {": "a-brace",
+		"i }": "inner-brace", "a }": "a-brace",
+	}
+	sequences := make(map[string]string)
+	for opKey, op := range operators {
+		sequences[opKey+" "+opKey] = op + "-line"
+		for objKeys, obj := range objects {
+			sequences[opKey+" "+objKeys] = op + "-" + obj
+		}
+	}
+	return sequences
+}
+
+// editingModeFn implements the le:editing-mode builtin, which replaces all key
+// bindings with those of an editing mode, e.g.
+//
+// le:editing-mode vi
+//
+// The editing modes are default, emacs and vi. Since keys bound with le:bind
+// are also replaced, le:editing-mode should come first in the rc file.
+func (ed *Editor) editingModeFn(ev *eval.Evaluator, args []eval.Value) string {
+	if len(args) != 1 {
+		return "args error"
+	}
+	em, ok := editingModes[args[0].String()]
+	if !ok {
+		return fmt.Sprintf("no such editing mode: %s", args[0].String())
+	}
+	ed.keymaps = newKeymaps(em)
+	return ""
+}
+
+// ResetKeys restores the default key bindings, undoing le:bind and
+// le:editing-mode.
+func (ed *Editor) ResetKeys() {
+	ed.keymaps = newKeymaps(nil)
+}
@@ -0,0 +1,142 @@
+package edit
+
+// The editor API, the state and actions of the editor exposed to elvish code
+// in the edit: namespace:
+//
+// $edit:current-command     the line being edited
+// $edit:dot                 the position of the dot, in bytes
+// $edit:selected-completion the selected completion candidate, read-only
+// $edit:completion-matcher  the matchers of completion, see matcher.go
+// $edit:styles              the styles of what is drawn, see attr.go
+//
+// edit:insert text          inserts text at the dot
+// edit:replace text         replaces the line with text, with the dot at the end
+// edit:redraw               redraws the editor
+// edit:call builtin         calls an editor builtin, like one bound to a key
+//
+// They are useful in closures bound to keys with le:bind, e.g.
+//
+// le:bind insert Ctrl-T { edit:insert (date) }
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/xiaq/elvish/eval"
+)
+
+var errNotReading = errors.New("the editor is not reading a line")
+
+func (ed *Editor) addAPI() {
+	ed.ev.AddVariable("edit:current-command", func() eval.Value {
+		return eval.NewString(ed.line)
+	}, func(v eval.Value) error {
+		ed.line = v.String()
+		if ed.dot > len(ed.line) {
+			ed.dot = len(ed.line)
+		}
+		return nil
+	})
+	ed.ev.AddVariable("edit:dot", func() eval.Value {
+		return eval.NewString(strconv.Itoa(ed.dot))
+	}, func(v eval.Value) error {
+		dot, err := strconv.Atoi(v.String())
+		if err != nil || dot < 0 || dot > len(ed.line) {
+			return fmt.Errorf("bad dot %s for a line of %d bytes", v.Repr(), len(ed.line))
+		}
+		if dot < len(ed.line) && !utf8.RuneStart(ed.line[dot]) {
+			return fmt.Errorf("dot %d is in the middle of a character", dot)
+		}
+		ed.dot = dot
+		return nil
+	})
+	ed.ev.AddVariable("edit:selected-completion", func() eval.Value {
+		c := ed.completion
+		if c == nil || c.current < 0 || c.current >= len(c.candidates) {
+			return eval.NewString("")
+		}
+		return eval.NewString(c.candidates[c.current].text)
+	}, nil)
+	ed.matcherTable = eval.NewTable()
+	ed.ev.AddVariable("edit:completion-matcher", func() eval.Value {
+		return ed.matcherTable
+	}, ed.setCompletionMatchers)
+	ed.styleTable = eval.NewTable()
+	ed.ev.AddVariable("edit:styles", func() eval.Value {
+		return ed.styleTable
+	}, ed.setStyles)
+
+	eval.AddBuiltinFunc("edit:insert", ed.insertFn)
+	eval.AddBuiltinFunc("edit:replace", ed.replaceFn)
+	eval.AddBuiltinFunc("edit:redraw", ed.redrawFn)
+	eval.AddBuiltinFunc("edit:call", ed.callFn)
+}
+
+func (ed *Editor) insertFn(ev *eval.Evaluator, args []eval.Value) string {
+	if len(args) != 1 {
+		return "args error"
+	}
+	text := args[0].String()
+	ed.line = ed.line[:ed.dot] + text + ed.line[ed.dot:]
+	ed.dot += len(text)
+	return ""
+}
+
+func (ed *Editor) replaceFn(ev *eval.Evaluator, args []eval.Value) string {
+	if len(args) != 1 {
+		return "args error"
+	}
+	ed.line = args[0].String()
+	ed.dot = len(ed.line)
+	return ""
+}
+
+func (ed *Editor) redrawFn(ev *eval.Evaluator, args []eval.Value) string {
+	if len(args) != 0 {
+		return "args error"
+	}
+	if !ed.reading {
+		return errNotReading.Error()
+	}
+	if err := ed.refresh(); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// callFn implements edit:call. When the builtin ends ReadLine, like
+// return-line, ReadLine returns after the closure calling it does.
+func (ed *Editor) callFn(ev *eval.Evaluator, args []eval.Value) string {
+	if len(args) != 1 {
+		return "args error"
+	}
+	name := args[0].String()
+	fn := leBuiltins[name]
+	if fn == nil {
+		return fmt.Sprintf("no editor builtin named %s", name)
+	}
+	if !ed.reading {
+		return errNotReading.Error()
+	}
+	if ret := fn(ed, ed.key); ret != nil && ret.action == exitReadLine {
+		ed.bindingReturn = ret
+	}
+	ed.lastFn = name
+	return ""
+}
+
+// callBinding calls a closure bound to a key. It returns the return of a
+// builtin called with edit:call that ends ReadLine, if there is one. Errors
+// are shown as tips.
+func (ed *Editor) callBinding(c *eval.Closure) *leReturn {
+	ed.lastFn = ""
+	ed.bindingReturn = nil
+	if msg := ed.ev.CallClosure(c, nil); msg != "" {
+		ed.pushTip(msg)
+	}
+	ret := ed.bindingReturn
+	ed.bindingReturn = nil
+	return ret
+}
@@ -0,0 +1,48 @@
+package edit
+
+import (
+	"testing"
+
+	"github.com/xiaq/elvish/eval"
+	"github.com/xiaq/elvish/parse"
+)
+
+func TestEditorAPI(t *testing.T) {
+	ev := eval.NewEvaluator()
+	ed := &Editor{ev: ev, keymaps: newKeymaps(nil), reading: true}
+	eval.AddBuiltinFunc("le:bind", ed.bindFn)
+	ed.addAPI()
+	ed.line, ed.dot = "echo", 4
+	text := `edit:insert " a"
+edit:dot = 0
+edit:insert "# "
+le:bind insert Ctrl-T { edit:replace $edit:current-command" x"; edit:call return-line }`
+	if err := ev.EvalText("<editor api test>", text); err != nil {
+		t.Fatal(err)
+	}
+	if ed.line != "# echo a" || ed.dot != 2 {
+		t.Errorf("after %q, line %q, dot %d", text, ed.line, ed.dot)
+	}
+	ev.EvalText("<editor api test>", "edit:dot = 100; edit:completion-matcher[git] = fuzzy; edit:completion-matcher[ls] = no-such")
+	if ed.matcherNames["git"] != "fuzzy" || ed.matcherNames["ls"] != "" {
+		t.Errorf("after setting matchers, matcher names %v, want git only", ed.matcherNames)
+	}
+	ev.EvalText("<editor api test>", "edit:styles[command] = \"1;32\"; edit:styles[no-such] = 1; edit:styles[error] = red")
+	if ed.styles.of("command") != "1;32" || ed.styles.of("error") != defaultStyles["error"] || len(ed.styles) != 1 {
+		t.Errorf("after setting styles, styles %v, want command only", ed.styles)
+	}
+	if ed.styles.ofType(ItemValidCommand) != "1;32" || ed.styles.ofType(parse.ItemPipe) != "32" {
+		t.Errorf("styles of tokens not taken from styles %v", ed.styles)
+	}
+	if ed.dot != 2 {
+		t.Errorf("assigning a dot past the line => dot %d, want 2 kept", ed.dot)
+	}
+	node := ed.keymaps[modeInsert][Key{'T', Ctrl}]
+	if node == nil || node.closure == nil {
+		t.Fatalf("Ctrl-T not bound to a closure: %v", node)
+	}
+	ret := ed.callBinding(node.closure)
+	if ret == nil || ret.action != exitReadLine || ret.readLineReturn.Line != "# echo a x" {
+		t.Errorf("calling binding => %+v, want return of line %q", ret, "# echo a x")
+	}
+}
@@ -2,8 +2,8 @@
 package edit
 
 import (
-	"fmt"
 	"os"
+	"regexp"
 	"strings"
 	"syscall"
 	"time"
@@ -11,10 +11,12 @@ import (
 	"github.com/xiaq/elvish/edit/tty"
 	"github.com/xiaq/elvish/eval"
 	"github.com/xiaq/elvish/parse"
+	"github.com/xiaq/elvish/util"
 )
 
 const (
-	CPRWaitTimeout = 10 * time.Millisecond
+	CPRWaitTimeout    = 10 * time.Millisecond
+	notificationsSize = 32
 )
 
 var LackEOL = "\033[7m\u23ce\033[m\n"
@@ -27,20 +29,35 @@ const (
 	modeCompletion
 	modeNavigation
 	modeHistory
+	modeHistorySearch
+	modeLocation
+	modeHistoryArg
 )
 
 type editorState struct {
 	// States used during ReadLine. Reset at the beginning of ReadLine.
-	savedTermios          *tty.Termios
 	tokens                []parse.Item
+	diagnostics           []eval.Diagnostic
 	prompt, rprompt, line string
 	dot                   int
 	tips                  []string
 	mode                  bufferMode
 	completion            *completion
 	completionLines       int
+	completionPageLines   int
 	navigation            *navigation
 	history               historyState
+	historySearch         historySearchState
+	location              *location
+	historyArg            *historyArg
+	pendingKeys           []Key  // Keys of an incomplete key sequence
+	pendingKeymap         keymap // Keymap for the rest of the key sequence
+	lastFn                string // Editor builtin called for the last key
+	yank                  yankState
+	suggestion            string // Rest of the history entry suggested
+	key                   Key    // Key being handled
+	// What a closure bound to the key returns, set by edit:call.
+	bindingReturn *leReturn
 }
 
 type historyState struct {
@@ -51,11 +68,38 @@ type historyState struct {
 // Editor keeps the status of the line editor.
 type Editor struct {
 	file      *os.File
+	term      tty.Terminal
 	writer    *writer
 	reader    *Reader
 	ev        *eval.Evaluator
 	sigs      <-chan os.Signal
 	histories []string
+	keymaps   map[bufferMode]keymap
+	killRing  []string
+	// Finds visited directories for the location mode.
+	dirMatcher func(pattern string) []string
+	// Index of histories for autosuggestion.
+	historyIndex *historyIndex
+	// $edit:completion-matcher, and the names of the matchers in it.
+	matcherTable *eval.Table
+	matcherNames map[string]string
+	// $edit:styles, and the styles in it.
+	styleTable *eval.Table
+	styles     styles
+	// Whether the terminal is dumb, in which case lines are read with
+	// readLinePlain.
+	dumb bool
+	// Whether ReadLine is reading a line with the full editor.
+	reading bool
+	// Messages to show above the prompt, sent with Notify.
+	notifications chan string
+	// Requests for redrawing, sent with Redraw.
+	redraws chan struct{}
+	// Called with what has been drawn after each refresh; set by Harness.
+	afterRefresh func(*buffer)
+	// Called once when the prompt has next been drawn; added with
+	// OnNextPrompt.
+	onNextPrompt []func()
 	editorState
 }
 
@@ -67,8 +111,75 @@ type LineRead struct {
 	Err  error
 }
 
+// appendHistory adds a line read to the history, if the history policy keeps
+// it.
 func (ed *Editor) appendHistory(line string) {
+	policy := ed.ev.HistoryPolicy()
+	last := ""
+	if n := len(ed.histories); n > 0 {
+		last = ed.histories[n-1]
+	}
+	if !policy.Keeps(line, last) {
+		return
+	}
+	ed.historyIndex.add(line, len(ed.histories))
 	ed.histories = append(ed.histories, line)
+	if policy.MaxSize > 0 {
+		ed.PruneHistory(policy.MaxSize)
+	}
+}
+
+// LoadHistory adds history entries from elsewhere, like elvishd, before those
+// read by the editor so far.
+func (ed *Editor) LoadHistory(lines []string) {
+	ed.histories = append(append([]string(nil), lines...), ed.histories...)
+	ed.historyIndex = newHistoryIndex(ed.histories)
+}
+
+// AddHistory adds history entries from elsewhere, like other sessions
+// sharing the history, after those read by the editor so far.
+func (ed *Editor) AddHistory(lines []string) {
+	for _, line := range lines {
+		ed.historyIndex.add(line, len(ed.histories))
+		ed.histories = append(ed.histories, line)
+	}
+}
+
+// DelHistory deletes the history entries matching pattern, and returns how
+// many there were.
+func (ed *Editor) DelHistory(pattern *regexp.Regexp) int {
+	var kept []string
+	for _, line := range ed.histories {
+		if !pattern.MatchString(line) {
+			kept = append(kept, line)
+		}
+	}
+	n := len(ed.histories) - len(kept)
+	if n > 0 {
+		ed.histories = kept
+		ed.historyIndex = newHistoryIndex(kept)
+	}
+	return n
+}
+
+// PruneHistory deletes all but the newest max history entries, and returns
+// how many were deleted.
+func (ed *Editor) PruneHistory(max int) int {
+	n := len(ed.histories) - max
+	if n <= 0 {
+		return 0
+	}
+	ed.histories = ed.histories[n:]
+	ed.historyIndex.prune(n)
+	// Pruning an entry for each line read once the history is full would
+	// take time in the size of the history if the index were rebuilt each
+	// time, so it is only rebuilt when the pruned entries it still holds
+	// outnumber the rest.
+	if ed.historyIndex.pruned > len(ed.histories) {
+		ed.histories = append([]string(nil), ed.histories...)
+		ed.historyIndex = newHistoryIndex(ed.histories)
+	}
+	return n
 }
 
 func (ed *Editor) prevHistory() bool {
@@ -92,13 +203,70 @@ func (ed *Editor) nextHistory() bool {
 }
 
 // NewEditor creates an Editor.
+// It also adds the le:bind and le:editing-mode builtins for rebinding keys of
+// the Editor.
 func NewEditor(file *os.File, ev *eval.Evaluator, sigs <-chan os.Signal) *Editor {
-	return &Editor{
-		file:   file,
-		writer: newWriter(file),
-		reader: NewReader(file),
-		ev:     ev,
-		sigs:   sigs,
+	ed := newEditor(file, tty.NewTerminal(file), ev, sigs)
+	ed.dumb = util.IsDumbTerm()
+	// The reader puts the terminal into non-blocking mode, which is not
+	// needed on a dumb terminal.
+	if !ed.dumb {
+		ed.reader = NewReader(file)
+	}
+	return ed
+}
+
+// newEditor creates an Editor drawing on file and term, without a reader.
+func newEditor(file *os.File, term tty.Terminal, ev *eval.Evaluator, sigs <-chan os.Signal) *Editor {
+	ed := &Editor{
+		file:    file,
+		term:    term,
+		writer:  newWriter(file, term),
+		ev:      ev,
+		sigs:    sigs,
+		keymaps: newKeymaps(nil),
+
+		historyIndex: newHistoryIndex(nil),
+
+		notifications: make(chan string, notificationsSize),
+		redraws:       make(chan struct{}, 1),
+	}
+	eval.AddBuiltinFunc("le:bind", ed.bindFn)
+	eval.AddBuiltinFunc("le:editing-mode", ed.editingModeFn)
+	ed.addAPI()
+	return ed
+}
+
+// Notify shows a message above the prompt. It is safe to call Notify from
+// another goroutine; messages sent when no line is being read are shown when
+// the next line is read.
+func (ed *Editor) Notify(text string) {
+	ed.notifications <- text
+}
+
+// Redraw redraws the editor, calling the prompt functions again, if it is
+// reading a line. It is safe to call Redraw from another goroutine, e.g. when
+// a prompt rendered in the background has changed.
+func (ed *Editor) Redraw() {
+	select {
+	case ed.redraws <- struct{}{}:
+	default:
+		// A redraw is pending already.
+	}
+}
+
+// OnNextPrompt makes f be called once, from the goroutine reading lines,
+// when the prompt has next been drawn.
+func (ed *Editor) OnNextPrompt(f func()) {
+	ed.onNextPrompt = append(ed.onNextPrompt, f)
+}
+
+// promptDrawn calls the functions added with OnNextPrompt.
+func (ed *Editor) promptDrawn() {
+	fs := ed.onNextPrompt
+	ed.onNextPrompt = nil
+	for _, f := range fs {
+		f()
 	}
 }
 
@@ -110,18 +278,25 @@ func (ed *Editor) pushTip(more string) {
 }
 
 func (ed *Editor) refresh() error {
-	// Re-lex the line, unless we are in modeCompletion
+	// Re-lex and check the line, unless we are in modeCompletion
 	if ed.mode != modeCompletion {
 		ed.tokens = nil
 		hl := Highlight("<interactive code>", ed.line, ed.ev)
 		for token := range hl {
 			ed.tokens = append(ed.tokens, token)
 		}
+		ed.diagnostics = ed.ev.Check("<interactive code>", ed.line)
 	}
-	return ed.writer.refresh(&ed.editorState, ed.histories)
+	ed.suggestion = ed.suggest()
+	err := ed.writer.refresh(&ed.editorState, ed.histories, ed.styles)
+	if ed.afterRefresh != nil {
+		ed.afterRefresh(ed.writer.oldBuf)
+	}
+	return err
 }
 
-// TODO Allow modifiable keybindings.
+// keyBindings are the default key bindings, from which the keymaps of an
+// Editor are created.
 var keyBindings = map[bufferMode]map[Key]string{
 	modeCommand: map[Key]string{
 		Key{'i', 0}:    "start-insert",
@@ -146,17 +321,24 @@ var keyBindings = map[bufferMode]map[Key]string{
 		Key{'D', Ctrl}:    "return-eof",
 		Key{Tab, 0}:       "start-completion",
 		Key{PageUp, 0}:    "start-history",
+		Key{'R', Ctrl}:    "start-history-search",
 		Key{'N', Ctrl}:    "start-navigation",
+		Key{'L', Ctrl}:    "start-location",
+		Key{'.', Alt}:     "start-history-arg",
+		Key{'e', Alt}:     "preview-expansion",
 		DefaultBinding:    "default-insert",
 	},
 	modeCompletion: map[Key]string{
-		Key{'[', Ctrl}: "cancel-completion",
-		Key{Up, 0}:     "select-cand-up",
-		Key{Down, 0}:   "select-cand-down",
-		Key{Left, 0}:   "select-cand-left",
-		Key{Right, 0}:  "select-cand-right",
-		Key{Tab, 0}:    "cycle-cand-right",
-		DefaultBinding: "default-completion",
+		Key{'[', Ctrl}:   "cancel-completion",
+		Key{Up, 0}:       "select-cand-up",
+		Key{Down, 0}:     "select-cand-down",
+		Key{Left, 0}:     "select-cand-left",
+		Key{Right, 0}:    "select-cand-right",
+		Key{Tab, 0}:      "cycle-cand-right",
+		Key{Tab, Shift}:  "cycle-cand-left",
+		Key{PageUp, 0}:   "select-cand-page-up",
+		Key{PageDown, 0}: "select-cand-page-down",
+		DefaultBinding:   "default-completion",
 	},
 	modeNavigation: map[Key]string{
 		Key{Up, 0}:     "select-nav-up",
@@ -171,6 +353,33 @@ var keyBindings = map[bufferMode]map[Key]string{
 		Key{PageDown, 0}: "select-history-next",
 		DefaultBinding:   "default-history",
 	},
+	modeHistorySearch: map[Key]string{
+		Key{'R', Ctrl}:    "history-search-older",
+		Key{Backspace, 0}: "history-search-delete",
+		Key{'[', Ctrl}:    "cancel-history-search",
+		Key{'G', Ctrl}:    "cancel-history-search",
+		DefaultBinding:    "default-history-search",
+	},
+	modeLocation: map[Key]string{
+		Key{Up, 0}:        "select-location-prev",
+		Key{Down, 0}:      "select-location-next",
+		Key{Backspace, 0}: "location-delete",
+		Key{Enter, 0}:     "accept-location",
+		Key{'[', Ctrl}:    "cancel-location",
+		Key{'G', Ctrl}:    "cancel-location",
+		DefaultBinding:    "default-location",
+	},
+	modeHistoryArg: map[Key]string{
+		Key{'.', Alt}:  "history-arg-older",
+		Key{Up, 0}:     "history-arg-older",
+		Key{Down, 0}:   "history-arg-newer",
+		Key{Left, 0}:   "select-history-arg-left",
+		Key{Right, 0}:  "select-history-arg-right",
+		Key{Enter, 0}:  "accept-history-arg",
+		Key{'[', Ctrl}: "cancel-history-arg",
+		Key{'G', Ctrl}: "cancel-history-arg",
+		DefaultBinding: "default-history-arg",
+	},
 }
 
 func init() {
@@ -181,70 +390,69 @@ func init() {
 			}
 		}
 	}
+	for modeName, em := range editingModes {
+		for _, kb := range em.bindings {
+			for _, name := range kb {
+				if leBuiltins[name] == nil {
+					panic("bad bindings of editing mode " + modeName + ": no editor builtin named " + name)
+				}
+			}
+		}
+		for _, sb := range em.sequences {
+			for _, name := range sb {
+				if leBuiltins[name] == nil {
+					panic("bad key sequences of editing mode " + modeName + ": no editor builtin named " + name)
+				}
+			}
+		}
+	}
 }
 
 // acceptCompletion accepts currently selected completion candidate.
 func (ed *Editor) acceptCompletion() {
 	c := ed.completion
 	if 0 <= c.current && c.current < len(c.candidates) {
-		accepted := c.candidates[c.current].text
-		ed.line = ed.line[:c.start] + accepted + ed.line[c.end:]
-		ed.dot += len(accepted) - (c.end - c.start)
+		ed.replaceCompletion(c.candidates[c.current].text)
 	}
 	ed.completion = nil
 	ed.mode = modeInsert
 }
 
+// replaceCompletion replaces the text being completed with text.
+func (ed *Editor) replaceCompletion(text string) {
+	c := ed.completion
+	ed.line = ed.line[:c.start] + text + ed.line[c.end:]
+	ed.dot += len(text) - (c.end - c.start)
+	c.end = c.start + len(text)
+}
+
 // acceptHistory accepts currently history.
 func (ed *Editor) acceptHistory() {
 	ed.line = ed.histories[ed.history.current]
 	ed.dot = len(ed.line)
 }
 
-func SetupTerminal(file *os.File) (*tty.Termios, error) {
-	fd := int(file.Fd())
-	term, err := tty.NewTermiosFromFd(fd)
-	if err != nil {
-		return nil, fmt.Errorf("can't get terminal attribute: %s", err)
-	}
-
-	savedTermios := term.Copy()
-
-	term.SetIcanon(false)
-	term.SetEcho(false)
-	term.SetMin(1)
-	term.SetTime(0)
-
-	err = term.ApplyToFd(fd)
-	if err != nil {
-		return nil, fmt.Errorf("can't set up terminal attribute: %s", err)
-	}
-
-	// Set autowrap off
-	file.WriteString("\033[?7l")
-
-	err = tty.FlushInput(fd)
-	if err != nil {
-		return nil, fmt.Errorf("can't flush input: %s", err)
+// insertPaste inserts text pasted in bracketed paste mode at the dot, in
+// insert mode. The text is inserted literally instead of being processed key
+// by key, so that a script of several lines is pasted as is instead of being
+// run line by line.
+func (ed *Editor) insertPaste(text string) {
+	switch ed.mode {
+	case modeCompletion:
+		ed.acceptCompletion()
+	case modeHistory:
+		ed.acceptHistory()
 	}
-
-	return savedTermios, nil
-}
-
-func CleanupTerminal(file *os.File, savedTermios *tty.Termios) error {
-	// Set autowrap on
-	file.WriteString("\033[?7h")
-	fd := int(file.Fd())
-	return savedTermios.ApplyToFd(fd)
+	ed.mode = modeInsert
+	ed.line = ed.line[:ed.dot] + text + ed.line[ed.dot:]
+	ed.dot += len(text)
 }
 
 // startsReadLine prepares the terminal for the editor.
 func (ed *Editor) startReadLine() error {
-	savedTermios, err := SetupTerminal(ed.file)
-	if err != nil {
+	if err := ed.term.Setup(); err != nil {
 		return err
 	}
-	ed.savedTermios = savedTermios
 
 	// Query cursor location
 	ed.file.WriteString("\033[6n")
@@ -287,6 +495,7 @@ func (ed *Editor) finishReadLine(lr *LineRead) {
 	}
 
 	ed.reader.Stop()
+	ed.reading = false
 
 	ed.mode = modeInsert
 	ed.tips = nil
@@ -298,19 +507,19 @@ func (ed *Editor) finishReadLine(lr *LineRead) {
 	ed.refresh() // XXX(xiaq): Ignore possible error
 	ed.file.WriteString("\n")
 
-	err := CleanupTerminal(ed.file, ed.savedTermios)
-
-	if err != nil {
+	if err := ed.term.Restore(); err != nil {
 		// BUG(xiaq): Error in Editor.finishReadLine may override earlier error
-		*lr = LineRead{Err: fmt.Errorf("can't restore terminal attribute: %s", err)}
+		*lr = LineRead{Err: err}
 	}
-	ed.savedTermios = nil
 }
 
 // ReadLine reads a line interactively.
 // TODO(xiaq): ReadLine currently just ignores all signals.
 func (ed *Editor) ReadLine(prompt, rprompt func() string) (lr LineRead) {
 	ed.editorState = editorState{}
+	if ed.dumb {
+		return ed.readLinePlain(prompt)
+	}
 	ed.writer.oldBuf.cells = nil
 	ones := ed.reader.Chan()
 
@@ -318,6 +527,7 @@ func (ed *Editor) ReadLine(prompt, rprompt func() string) (lr LineRead) {
 	if err != nil {
 		return LineRead{Err: err}
 	}
+	ed.reading = true
 	defer ed.finishReadLine(&lr)
 
 MainLoop:
@@ -328,6 +538,7 @@ MainLoop:
 		if err != nil {
 			return LineRead{Err: err}
 		}
+		ed.promptDrawn()
 
 		ed.tips = nil
 
@@ -342,6 +553,12 @@ MainLoop:
 			case syscall.SIGWINCH:
 				continue MainLoop
 			}
+		case text := <-ed.notifications:
+			err := ed.writer.writeAbove(text)
+			if err != nil {
+				return LineRead{Err: err}
+			}
+		case <-ed.redraws:
 		case or := <-ones:
 			// Alert about error
 			err := or.Err
@@ -355,19 +572,47 @@ MainLoop:
 				continue
 			}
 
+			if or.Paste != "" {
+				ed.insertPaste(or.Paste)
+				continue
+			}
+
 			k := or.Key
 		lookupKey:
-			keyBinding, ok := keyBindings[ed.mode]
-			if !ok {
-				ed.pushTip("No binding for current mode")
-				continue
+			km := ed.pendingKeymap
+			if km == nil {
+				var ok bool
+				km, ok = ed.keymaps[ed.mode]
+				if !ok {
+					ed.pushTip("No binding for current mode")
+					continue
+				}
 			}
 
-			name, bound := keyBinding[k]
-			if !bound {
-				name = keyBinding[DefaultBinding]
+			node, bound := km[k]
+			switch {
+			case bound && node.next != nil:
+				// Start or continue a key sequence
+				ed.pendingKeys = append(ed.pendingKeys, k)
+				ed.pendingKeymap = node.next
+				continue
+			case bound:
+			case ed.pendingKeymap != nil:
+				ed.pushTip("No binding for " + keysString(append(ed.pendingKeys, k)))
+				ed.pendingKeys, ed.pendingKeymap = nil, nil
+				continue
+			default:
+				node = km[DefaultBinding]
+			}
+			ed.pendingKeys, ed.pendingKeymap = nil, nil
+			ed.key = k
+			var ret *leReturn
+			if node.closure != nil {
+				ret = ed.callBinding(node.closure)
+			} else {
+				ret = leBuiltins[node.fn](ed, k)
+				ed.lastFn = node.fn
 			}
-			ret := leBuiltins[name](ed, k)
 			if ret == nil {
 				continue
 			}
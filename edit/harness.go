@@ -0,0 +1,275 @@
+package edit
+
+// A headless harness for testing the editor, e.g.
+//
+//	h, _ := edit.NewHarness(ev, 24, 80)
+//	defer h.Close()
+//	h.Start(func() string { return "> " }, func() string { return "" })
+//	h.FeedText("ech")
+//	h.Feed(edit.Key{edit.Tab, 0})
+//	if err := h.Expect("echo"); err != nil { ... }
+//	h.Feed(edit.Key{edit.Enter, 0})
+//	lr, _ := h.Wait()
+//
+// Keys go through the reader as the bytes a terminal would send, so that key
+// parsing is tested too, and what is drawn is taken from the writer before it
+// becomes escape sequences.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/xiaq/elvish/eval"
+)
+
+// HarnessTimeout is how long a Harness waits for the Editor before giving up.
+var HarnessTimeout = 2 * time.Second
+
+var errHarnessTimeout = errors.New("timed out waiting for the editor")
+
+// Screen is what an Editor has drawn: its lines without styles or trailing
+// spaces, and where the cursor is, counting from 0.
+type Screen struct {
+	Lines     []string
+	Line, Col int
+}
+
+func (s Screen) String() string {
+	return strings.Join(s.Lines, "\n")
+}
+
+// Contains returns whether a line of the Screen contains text.
+func (s Screen) Contains(text string) bool {
+	for _, line := range s.Lines {
+		if strings.Contains(line, text) {
+			return true
+		}
+	}
+	return false
+}
+
+// Harness runs an Editor on a fake terminal with a fixed size, writing keys
+// to it like a terminal would and keeping what it draws, so that features of
+// the editor like completion, prompts and key bindings can be tested without
+// a real terminal.
+type Harness struct {
+	Editor *Editor
+	keys   *os.File // Where the keys read by Editor are written.
+	out    *os.File // Where Editor writes escape sequences, which are discarded.
+
+	mutex   sync.Mutex
+	screen  Screen
+	changed chan struct{} // Closed and replaced when screen changes.
+	lines   chan LineRead
+}
+
+// harnessTerminal is a tty.Terminal of a fixed size, which needs no setup.
+type harnessTerminal struct {
+	rows, cols int
+}
+
+func (t *harnessTerminal) Setup() error           { return nil }
+func (t *harnessTerminal) Restore() error         { return nil }
+func (t *harnessTerminal) Size() (rows, cols int) { return t.rows, t.cols }
+
+// NewHarness creates a Harness with a new Editor for ev, on a fake terminal
+// with the given numbers of rows and columns.
+func NewHarness(ev *eval.Evaluator, rows, cols int) (*Harness, error) {
+	// The reader needs a pipe that is not managed by the runtime poller, like
+	// a terminal, so that it can be stopped while waiting for keys.
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		return nil, err
+	}
+	r, w := os.NewFile(uintptr(fds[0]), "keys"), os.NewFile(uintptr(fds[1]), "keys")
+	out, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		r.Close()
+		w.Close()
+		return nil, err
+	}
+	h := &Harness{keys: w, out: out, changed: make(chan struct{})}
+	h.Editor = newEditor(out, &harnessTerminal{rows, cols}, ev, nil)
+	h.Editor.reader = NewReader(r)
+	h.Editor.afterRefresh = h.update
+	return h, nil
+}
+
+// update keeps what has been drawn in buf. It is called by the Editor.
+func (h *Harness) update(buf *buffer) {
+	screen := Screen{Line: buf.dot.line, Col: buf.dot.col}
+	for _, line := range buf.cells {
+		runes := make([]rune, len(line))
+		for i, c := range line {
+			runes[i] = c.rune
+		}
+		screen.Lines = append(screen.Lines, strings.TrimRight(string(runes), " "))
+	}
+	h.mutex.Lock()
+	h.screen = screen
+	close(h.changed)
+	h.changed = make(chan struct{})
+	h.mutex.Unlock()
+}
+
+// Start starts reading a line with the given prompt and rprompt in the
+// background, and waits for the Editor to draw it; keys fed before that would
+// be discarded. The result is returned by Wait.
+func (h *Harness) Start(prompt, rprompt func() string) error {
+	h.mutex.Lock()
+	changed := h.changed
+	h.mutex.Unlock()
+	h.lines = make(chan LineRead, 1)
+	go func() {
+		h.lines <- h.Editor.ReadLine(prompt, rprompt)
+	}()
+	select {
+	case <-changed:
+		return nil
+	case <-time.After(HarnessTimeout):
+		return errHarnessTimeout
+	}
+}
+
+// Wait waits for the line started with Start to be read.
+func (h *Harness) Wait() (LineRead, error) {
+	select {
+	case lr := <-h.lines:
+		return lr, nil
+	case <-time.After(HarnessTimeout):
+		return LineRead{}, errHarnessTimeout
+	}
+}
+
+// FeedText writes text to the Editor as is, like typing it. Escape sequences
+// in it are read like those from a terminal.
+func (h *Harness) FeedText(text string) error {
+	_, err := h.keys.WriteString(text)
+	return err
+}
+
+// Feed writes keys to the Editor as the sequences a terminal would send for
+// them. After a sequence that could be the start of a longer one, like that
+// of Ctrl-[, it waits for the reader to give up waiting for the rest.
+func (h *Harness) Feed(keys ...Key) error {
+	for _, k := range keys {
+		seq, err := keySequence(k)
+		if err != nil {
+			return err
+		}
+		if err := h.FeedText(seq); err != nil {
+			return err
+		}
+		switch seq {
+		case "\033", "\033[", "\033O":
+			time.Sleep(3 * EscTimeout)
+		}
+	}
+	return nil
+}
+
+// Screen returns what the Editor has drawn last.
+func (h *Harness) Screen() Screen {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.screen
+}
+
+// WaitFor waits until what the Editor has drawn satisfies cond, and returns
+// it. If that does not happen within HarnessTimeout, it returns what has been
+// drawn last with an error.
+func (h *Harness) WaitFor(cond func(Screen) bool) (Screen, error) {
+	timeout := time.After(HarnessTimeout)
+	for {
+		h.mutex.Lock()
+		screen, changed := h.screen, h.changed
+		h.mutex.Unlock()
+		if cond(screen) {
+			return screen, nil
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			return screen, errHarnessTimeout
+		}
+	}
+}
+
+// Expect waits until a line drawn by the Editor contains text.
+func (h *Harness) Expect(text string) error {
+	screen, err := h.WaitFor(func(s Screen) bool { return s.Contains(text) })
+	if err != nil {
+		return fmt.Errorf("%q not drawn; screen is:\n%s", text, screen)
+	}
+	return nil
+}
+
+// Close stops the Editor and releases the fake terminal. The line being read,
+// if any, must have been waited for.
+func (h *Harness) Close() {
+	h.Editor.reader.Quit()
+	h.keys.Close()
+	h.out.Close()
+}
+
+// keyNums are the numbers of the function keys sent as \e[n~.
+var keyNums = map[rune]int{
+	Insert: 2, Delete: 3, PageUp: 5, PageDown: 6,
+	F5: 15, F6: 17, F7: 18, F8: 19, F9: 20, F10: 21, F11: 23, F12: 24,
+}
+
+// keyLasts are the last runes of the function keys sent as \e[x.
+var keyLasts = map[rune]byte{
+	Up: 'A', Down: 'B', Right: 'C', Left: 'D', Home: 'H', End: 'F',
+}
+
+// keySequence returns what a terminal sends for k, the reverse of what the
+// reader does.
+func keySequence(k Key) (string, error) {
+	// The modifier parameter of xterm, e.g. 5 for Ctrl.
+	mod := 1
+	if k.Mod&Shift != 0 {
+		mod++
+	}
+	if k.Mod&Alt != 0 {
+		mod += 2
+	}
+	if k.Mod&Ctrl != 0 {
+		mod += 4
+	}
+	if n, ok := keyNums[k.Rune]; ok {
+		if mod == 1 {
+			return fmt.Sprintf("\033[%d~", n), nil
+		}
+		return fmt.Sprintf("\033[%d;%d~", n, mod), nil
+	}
+	if last, ok := keyLasts[k.Rune]; ok {
+		if mod == 1 {
+			return "\033[" + string(last), nil
+		}
+		return fmt.Sprintf("\033[1;%d%c", mod, last), nil
+	}
+	if F1 >= k.Rune && k.Rune >= F4 && k.Mod == 0 {
+		return "\033O" + string(rune('P'+F1-k.Rune)), nil
+	}
+	switch {
+	case k.Rune < 0:
+	case k == Key{Tab, Shift}:
+		return "\033[Z", nil
+	case k == Key{'[', Ctrl}:
+		return "\033", nil
+	// Ctrl-I and Ctrl-J are read as Tab and Enter.
+	case k.Mod == Ctrl && 'A' <= k.Rune && k.Rune <= '\\' && k.Rune != 'I' && k.Rune != 'J':
+		return string(k.Rune - 0x40), nil
+	case k.Mod == Alt:
+		return "\033" + string(k.Rune), nil
+	case k.Mod == 0:
+		return string(k.Rune), nil
+	}
+	return "", fmt.Errorf("no key sequence for %s", k)
+}
@@ -0,0 +1,191 @@
+package edit
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xiaq/elvish/eval"
+)
+
+func TestHarness(t *testing.T) {
+	ev := eval.NewEvaluator()
+	h, err := NewHarness(ev, 24, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := ev.EvalText("<harness test>", "le:bind insert Ctrl-T { edit:insert \" x\" }"); err != nil {
+		t.Fatal(err)
+	}
+	prompt := func() string { return "~> " }
+	rprompt := func() string { return "R" }
+	if err := h.Start(prompt, rprompt); err != nil {
+		t.Fatal(err)
+	}
+	h.FeedText("echo a")
+	h.Feed(Key{Left, 0}, Key{'T', Ctrl})
+	if err := h.Expect("~> echo  xa"); err != nil {
+		t.Error(err)
+	}
+	if s := h.Screen(); s.Line != 0 || s.Col != 10 {
+		t.Errorf("cursor at (%d, %d), want (0, 10)", s.Line, s.Col)
+	}
+	h.Feed(Key{'[', Ctrl}, Key{'D', 0}, Key{'i', 0}, Key{Enter, 0})
+	lr, err := h.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lr.Line != "echo  x" {
+		t.Errorf("line read is %q, want %q", lr.Line, "echo  x")
+	}
+}
+
+func TestRedraw(t *testing.T) {
+	ev := eval.NewEvaluator()
+	h, err := NewHarness(ev, 24, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	var mutex sync.Mutex
+	p := "old>"
+	prompt := func() string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return p
+	}
+	if err := h.Start(prompt, func() string { return "" }); err != nil {
+		t.Fatal(err)
+	}
+	mutex.Lock()
+	p = "new>"
+	mutex.Unlock()
+	// Redraws requested while one is pending are merged.
+	h.Editor.Redraw()
+	h.Editor.Redraw()
+	if err := h.Expect("new>"); err != nil {
+		t.Error(err)
+	}
+	h.Feed(Key{Enter, 0})
+	h.Wait()
+}
+
+func TestOnNextPrompt(t *testing.T) {
+	ev := eval.NewEvaluator()
+	h, err := NewHarness(ev, 24, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	screens := make(chan Screen, 2)
+	h.Editor.OnNextPrompt(func() { screens <- h.Screen() })
+	if err := h.Start(func() string { return "p>" }, func() string { return "" }); err != nil {
+		t.Fatal(err)
+	}
+	h.FeedText("a")
+	if err := h.Expect("p>a"); err != nil {
+		t.Error(err)
+	}
+	h.Feed(Key{Enter, 0})
+	h.Wait()
+	close(screens)
+	var drawn []string
+	for s := range screens {
+		drawn = append(drawn, s.String())
+	}
+	if len(drawn) != 1 || drawn[0] != "p>" {
+		t.Errorf("OnNextPrompt function called with %q drawn, want once with %q", drawn, "p>")
+	}
+}
+
+func TestBracketedPaste(t *testing.T) {
+	ev := eval.NewEvaluator()
+	h, err := NewHarness(ev, 24, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.Start(func() string { return "p>" }, func() string { return "" }); err != nil {
+		t.Fatal(err)
+	}
+	// The pasted text is inserted at the dot as is, instead of the Enter
+	// in it returning the line. Long lines are wrapped.
+	h.FeedText("()")
+	h.Feed(Key{Left, 0})
+	h.FeedText("\033[200~echo a\r\necho " + strings.Repeat("b", 20) + "\033[201~")
+	want := []string{"p>(echo a", "  echo bbbbbbbbbbbbb", "  bbbbbbb)"}
+	screen, err := h.WaitFor(func(s Screen) bool { return reflect.DeepEqual(s.Lines, want) })
+	if err != nil {
+		t.Errorf("screen is %q, want %q", screen.Lines, want)
+	}
+	// The dot moves between lines.
+	h.Feed(Key{Up, 0})
+	screen, err = h.WaitFor(func(s Screen) bool { return s.Line == 0 })
+	if err != nil || screen.Col != 9 {
+		t.Errorf("after Up, cursor at (%d, %d), want (0, 9)", screen.Line, screen.Col)
+	}
+	h.Feed(Key{Enter, 0})
+	lr, err := h.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "(echo a\necho " + strings.Repeat("b", 20) + ")"; lr.Line != want {
+		t.Errorf("line read is %q, want %q", lr.Line, want)
+	}
+}
+
+func TestBracketedPasteTimeout(t *testing.T) {
+	defer func(d time.Duration) { PasteTimeout = d }(PasteTimeout)
+	PasteTimeout = 10 * time.Millisecond
+	ev := eval.NewEvaluator()
+	h, err := NewHarness(ev, 24, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.Start(func() string { return "p>" }, func() string { return "" }); err != nil {
+		t.Fatal(err)
+	}
+	// Without the end of the paste, what has been pasted is taken after
+	// PasteTimeout, and keys work again.
+	h.FeedText("\033[200~a\rb")
+	if err := h.Expect("b"); err != nil {
+		t.Error(err)
+	}
+	h.Feed(Key{Enter, 0})
+	lr, err := h.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lr.Line != "a\nb" {
+		t.Errorf("line read is %q, want %q", lr.Line, "a\nb")
+	}
+}
+
+var keySequenceTests = []struct {
+	key  Key
+	want string
+}{
+	{Key{'a', 0}, "a"},
+	{Key{'U', Ctrl}, "\x15"},
+	{Key{'.', Alt}, "\033."},
+	{Key{Tab, Shift}, "\033[Z"},
+	{Key{Up, 0}, "\033[A"},
+	{Key{Up, Ctrl}, "\033[1;5A"},
+	{Key{PageDown, Shift}, "\033[6;2~"},
+	{Key{F2, 0}, "\033OQ"},
+}
+
+func TestKeySequence(t *testing.T) {
+	for _, tt := range keySequenceTests {
+		if seq, err := keySequence(tt.key); seq != tt.want || err != nil {
+			t.Errorf("keySequence(%s) => (%q, %v), want %q", tt.key, seq, err, tt.want)
+		}
+	}
+	if _, err := keySequence(Key{'I', Ctrl}); err == nil {
+		t.Errorf("keySequence(Ctrl-I) => no error, want error")
+	}
+}
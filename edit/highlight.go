@@ -51,10 +51,8 @@ func (hl *Highlighter) command(token parse.Item) {
 		token = <-hl.lexer.Chan()
 	}
 	if token.Typ == parse.ItemBare {
-		// Check validity of command
-		// XXX Disabled until Compiler implements it
-		if true {
-			// if _, _, err := hl.ev.ResolveCommand(token.Val); err == nil {
+		// Check validity of command, that of its target for an alias
+		if _, err := hl.ev.ResolveCommand(token.Val); err == nil {
 			token.Typ = ItemValidCommand
 		} else {
 			token.Typ = ItemInvalidCommand
@@ -77,7 +75,8 @@ Loop:
 			hl.items <- token
 			hl.variable(<-tokens)
 		case parse.ItemSemicolon, parse.ItemPipe, parse.ItemEndOfLine,
-			parse.ItemLParen, parse.ItemQuestionLParen:
+			parse.ItemLParen, parse.ItemQuestionLParen,
+			parse.ItemLessLParen, parse.ItemGreaterLParen:
 			hl.items <- token
 			hl.command(<-tokens)
 		case parse.ItemLBrace:
@@ -115,7 +114,13 @@ Loop:
 }
 
 func Highlight(name, input string, ev *eval.Evaluator) chan parse.Item {
-	hl := &Highlighter{parse.Lex(name, input), ev, make(chan parse.Item)}
+	return HighlightEmbedded(name, input, 0, len(input), ev)
+}
+
+// HighlightEmbedded is like Highlight, for the snippet input[start:end]. The
+// positions of items are offsets in input.
+func HighlightEmbedded(name, input string, start, end int, ev *eval.Evaluator) chan parse.Item {
+	hl := &Highlighter{parse.LexEmbedded(name, input, start, end), ev, make(chan parse.Item)}
 	go hl.run()
 	return hl.items
 }
@@ -0,0 +1,147 @@
+package edit
+
+import "github.com/xiaq/elvish/parse"
+
+// History argument mode, for inserting an argument of a previous command.
+
+// historyArg is the state of the history argument mode. args are the words
+// of the history entry history, and the one at current is previewed in the
+// line at [start, end).
+type historyArg struct {
+	history    int
+	args       []string
+	current    int
+	start, end int
+}
+
+// historyArgs splits a command line into its words, keeping their source
+// text so that they can be inserted as is. Pipes and semicolons separate
+// words but are not words themselves.
+func historyArgs(line string) []string {
+	var args []string
+	start := -1
+	for item := range parse.Lex("<history>", line).Chan() {
+		switch item.Typ {
+		case parse.ItemSpace, parse.ItemEndOfLine, parse.ItemPipe,
+			parse.ItemSemicolon, parse.ItemEOF, parse.ItemError:
+			if start != -1 {
+				args = append(args, line[start:item.Pos])
+				start = -1
+			}
+		default:
+			if start == -1 {
+				start = int(item.Pos)
+			}
+		}
+		if item.Typ == parse.ItemEOF || item.Typ == parse.ItemError {
+			break
+		}
+	}
+	return args
+}
+
+// findHistoryArgs finds the newest history entry not newer than from that
+// has any words, returning its index and words.
+func (ed *Editor) findHistoryArgs(from int) (int, []string) {
+	for i := from; i >= 0; i-- {
+		if args := historyArgs(ed.histories[i]); len(args) > 0 {
+			return i, args
+		}
+	}
+	return -1, nil
+}
+
+// previewHistoryArg replaces the previewed word in the line with the word
+// now selected.
+func (ed *Editor) previewHistoryArg() {
+	ha := ed.historyArg
+	arg := ha.args[ha.current]
+	ed.line = ed.line[:ha.start] + arg + ed.line[ha.end:]
+	ha.end = ha.start + len(arg)
+	ed.dot = ha.end
+}
+
+// startHistoryArg previews the last word of the last command at the dot.
+func startHistoryArg(ed *Editor, k Key) *leReturn {
+	i, args := ed.findHistoryArgs(len(ed.histories) - 1)
+	if i == -1 {
+		ed.pushTip("no history with arguments")
+		return nil
+	}
+	ed.historyArg = &historyArg{i, args, len(args) - 1, ed.dot, ed.dot}
+	ed.previewHistoryArg()
+	ed.mode = modeHistoryArg
+	return nil
+}
+
+// historyArgOlder previews the last word of the next older command.
+func historyArgOlder(ed *Editor, k Key) *leReturn {
+	ha := ed.historyArg
+	i, args := ed.findHistoryArgs(ha.history - 1)
+	if i == -1 {
+		ed.beep()
+		return nil
+	}
+	ha.history, ha.args, ha.current = i, args, len(args)-1
+	ed.previewHistoryArg()
+	return nil
+}
+
+// historyArgNewer previews the last word of the next newer command.
+func historyArgNewer(ed *Editor, k Key) *leReturn {
+	ha := ed.historyArg
+	for i := ha.history + 1; i < len(ed.histories); i++ {
+		if args := historyArgs(ed.histories[i]); len(args) > 0 {
+			ha.history, ha.args, ha.current = i, args, len(args)-1
+			ed.previewHistoryArg()
+			return nil
+		}
+	}
+	ed.beep()
+	return nil
+}
+
+func selectHistoryArgLeft(ed *Editor, k Key) *leReturn {
+	ha := ed.historyArg
+	if ha.current == 0 {
+		ed.beep()
+		return nil
+	}
+	ha.current--
+	ed.previewHistoryArg()
+	return nil
+}
+
+func selectHistoryArgRight(ed *Editor, k Key) *leReturn {
+	ha := ed.historyArg
+	if ha.current == len(ha.args)-1 {
+		ed.beep()
+		return nil
+	}
+	ha.current++
+	ed.previewHistoryArg()
+	return nil
+}
+
+func acceptHistoryArg(ed *Editor, k Key) *leReturn {
+	ed.historyArg = nil
+	ed.mode = modeInsert
+	return nil
+}
+
+// cancelHistoryArg removes the previewed word.
+func cancelHistoryArg(ed *Editor, k Key) *leReturn {
+	ha := ed.historyArg
+	ed.line = ed.line[:ha.start] + ed.line[ha.end:]
+	ed.dot = ha.start
+	ed.historyArg = nil
+	ed.mode = modeInsert
+	return nil
+}
+
+// defaultHistoryArg accepts the previewed word, and reprocesses the key in
+// insert mode.
+func defaultHistoryArg(ed *Editor, k Key) *leReturn {
+	acceptHistoryArg(ed, k)
+	return &leReturn{action: reprocessKey}
+}
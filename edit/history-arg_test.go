@@ -0,0 +1,41 @@
+package edit
+
+import (
+	"reflect"
+	"testing"
+)
+
+var historyArgsTests = []struct {
+	line   string
+	wanted []string
+}{
+	{"", nil},
+	{"ls -l /tmp", []string{"ls", "-l", "/tmp"}},
+	{"echo `a b`|wc -l; put $x[0]", []string{"echo", "`a b`", "wc", "-l", "put", "$x[0]"}},
+}
+
+func TestHistoryArgs(t *testing.T) {
+	for _, tt := range historyArgsTests {
+		if out := historyArgs(tt.line); !reflect.DeepEqual(out, tt.wanted) {
+			t.Errorf("historyArgs(%q) => %q, want %q", tt.line, out, tt.wanted)
+		}
+	}
+}
+
+func TestHistoryArg(t *testing.T) {
+	ed := &Editor{histories: []string{"cp a b", "", "vim c"}}
+	ed.line, ed.dot = "ls ", 3
+	startHistoryArg(ed, Key{'.', Alt})
+	if ed.line != "ls c" || ed.mode != modeHistoryArg {
+		t.Errorf("starting => line %q, mode %d, want %q in history argument mode", ed.line, ed.mode, "ls c")
+	}
+	historyArgOlder(ed, Key{'.', Alt})
+	selectHistoryArgLeft(ed, Key{Left, 0})
+	if ed.line != "ls a" || ed.dot != 4 {
+		t.Errorf("selecting => line %q, dot %d, want %q, 4", ed.line, ed.dot, "ls a")
+	}
+	cancelHistoryArg(ed, Key{'G', Ctrl})
+	if ed.line != "ls " || ed.dot != 3 || ed.mode != modeInsert {
+		t.Errorf("cancelling => line %q, dot %d, mode %d", ed.line, ed.dot, ed.mode)
+	}
+}
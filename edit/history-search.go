@@ -0,0 +1,102 @@
+package edit
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Incremental history search.
+
+// historySearchState is the state of the history search mode. current is the
+// index of the matching history entry, or -1 if nothing matched yet, and
+// [match, matchEnd) is where the query occurred in it. When the search is
+// failing, the last match is kept.
+type historySearchState struct {
+	query           string
+	current         int
+	match, matchEnd int
+	failing         bool
+}
+
+// searchHistory finds the newest history entry not newer than from which
+// contains query. It returns the index of the entry and of the match in it.
+func (ed *Editor) searchHistory(from int, query string) (int, int, bool) {
+	for i := from; i >= 0; i-- {
+		if j := strings.Index(ed.histories[i], query); j != -1 {
+			return i, j, true
+		}
+	}
+	return -1, -1, false
+}
+
+// updateHistorySearch searches for the query from the history entry from,
+// updating the match. If nothing matches, the last match is kept and the
+// search is marked failing.
+func (ed *Editor) updateHistorySearch(from int) {
+	hs := &ed.historySearch
+	if i, j, ok := ed.searchHistory(from, hs.query); ok {
+		hs.current, hs.match, hs.matchEnd, hs.failing = i, j, j+len(hs.query), false
+	} else {
+		hs.failing = true
+	}
+}
+
+func startHistorySearch(ed *Editor, k Key) *leReturn {
+	ed.mode = modeHistorySearch
+	ed.historySearch = historySearchState{current: -1}
+	return nil
+}
+
+// historySearchOlder cycles to the next older entry matching the query.
+func historySearchOlder(ed *Editor, k Key) *leReturn {
+	hs := &ed.historySearch
+	from := len(ed.histories) - 1
+	if hs.current != -1 {
+		from = hs.current - 1
+	}
+	ed.updateHistorySearch(from)
+	return nil
+}
+
+// historySearchDelete deletes the last rune of the query and searches again
+// from the newest entry.
+func historySearchDelete(ed *Editor, k Key) *leReturn {
+	hs := &ed.historySearch
+	if hs.query == "" {
+		ed.beep()
+		return nil
+	}
+	_, w := utf8.DecodeLastRuneInString(hs.query)
+	hs.query = hs.query[:len(hs.query)-w]
+	hs.current = -1
+	ed.updateHistorySearch(len(ed.histories) - 1)
+	return nil
+}
+
+func cancelHistorySearch(ed *Editor, k Key) *leReturn {
+	ed.mode = modeInsert
+	return nil
+}
+
+// defaultHistorySearch adds printable keys to the query, keeping the match if
+// it still matches. Other keys accept the matching entry and are reprocessed
+// in insert mode.
+func defaultHistorySearch(ed *Editor, k Key) *leReturn {
+	hs := &ed.historySearch
+	if k.Mod == 0 && k.Rune > 0 && unicode.IsGraphic(k.Rune) {
+		hs.query += string(k.Rune)
+		from := len(ed.histories) - 1
+		if hs.current != -1 {
+			from = hs.current
+		}
+		ed.updateHistorySearch(from)
+		return nil
+	}
+	if hs.current != -1 {
+		ed.line = ed.histories[hs.current]
+		ed.dot = hs.matchEnd
+	}
+	ed.mode = modeInsert
+	return &leReturn{action: reprocessKey}
+}
@@ -0,0 +1,28 @@
+package edit
+
+import "testing"
+
+func TestHistorySearch(t *testing.T) {
+	ed := &Editor{histories: []string{"echo foo", "ls", "echo bar"}}
+	startHistorySearch(ed, ZeroKey)
+	for _, r := range "echo" {
+		defaultHistorySearch(ed, Key{r, 0})
+	}
+	if hs := ed.historySearch; hs.current != 2 || hs.failing {
+		t.Errorf("searching echo => %+v, want match of entry 2", hs)
+	}
+	historySearchOlder(ed, Key{'R', Ctrl})
+	if hs := ed.historySearch; hs.current != 0 || hs.failing {
+		t.Errorf("searching older => %+v, want match of entry 0", hs)
+	}
+	historySearchOlder(ed, Key{'R', Ctrl})
+	if hs := ed.historySearch; hs.current != 0 || !hs.failing {
+		t.Errorf("searching older again => %+v, want failing match of entry 0", hs)
+	}
+	if ret := defaultHistorySearch(ed, Key{Enter, 0}); ret == nil || ret.action != reprocessKey {
+		t.Errorf("Enter in history search mode => %v, want reprocessKey", ret)
+	}
+	if ed.line != "echo foo" || ed.dot != 4 || ed.mode != modeInsert {
+		t.Errorf("accepting search => line %q, dot %d, mode %d", ed.line, ed.dot, ed.mode)
+	}
+}
@@ -1,5 +1,13 @@
 package edit
 
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
 type Mod byte
 
 const (
@@ -82,3 +90,77 @@ var FunctionKeyNames = [...]string{
 	"Up", "Down", "Right", "Left",
 	"Home", "Insert", "Delete", "End", "PageUp", "PageDown",
 }
+
+var (
+	keyNamesReverse      = make(map[string]rune)
+	modifierNames        = map[string]Mod{"Ctrl": Ctrl, "Alt": Alt, "Shift": Shift}
+	errEmptyKey          = errors.New("empty key")
+	errBadKeyForModifier = errors.New("modifier must be followed by a key")
+)
+
+func init() {
+	for r, name := range KeyNames {
+		keyNamesReverse[name] = r
+	}
+	for i, name := range FunctionKeyNames[1:] {
+		keyNamesReverse[name] = -rune(i + 1)
+	}
+}
+
+// parseKey parses a key in the format produced by Key.String, like "a",
+// "Ctrl-W", "Alt-e" or "PageUp". The key after Ctrl is case-insensitive, and
+// "Default" stands for DefaultBinding.
+func parseKey(s string) (Key, error) {
+	if s == "" {
+		return ZeroKey, errEmptyKey
+	}
+	if s == "Default" {
+		return DefaultBinding, nil
+	}
+	var k Key
+	for {
+		i := strings.IndexRune(s, '-')
+		if i <= 0 {
+			break
+		}
+		mod, ok := modifierNames[s[:i]]
+		if !ok {
+			break
+		}
+		if i == len(s)-1 {
+			return ZeroKey, errBadKeyForModifier
+		}
+		k.Mod |= mod
+		s = s[i+1:]
+	}
+	if r, ok := keyNamesReverse[s]; ok {
+		k.Rune = r
+		return k, nil
+	}
+	r, size := utf8.DecodeRuneInString(s)
+	if size != len(s) {
+		return ZeroKey, fmt.Errorf("bad key: %q", s)
+	}
+	if k.Mod&Ctrl != 0 {
+		r = unicode.ToUpper(r)
+	}
+	k.Rune = r
+	return k, nil
+}
+
+// parseKeys parses a key sequence of keys separated by spaces, like
+// "Ctrl-X Ctrl-E".
+func parseKeys(s string) ([]Key, error) {
+	var keys []Key
+	for _, f := range strings.Fields(s) {
+		k, err := parseKey(f)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil, errEmptyKey
+	}
+	return keys, nil
+}
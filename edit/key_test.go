@@ -0,0 +1,47 @@
+package edit
+
+import "testing"
+
+var parseKeyTests = []struct {
+	in     string
+	wanted Key
+}{
+	{"a", Key{'a', 0}},
+	{"Ctrl-w", Key{'W', Ctrl}},
+	{"Alt-Ctrl-X", Key{'X', Alt | Ctrl}},
+	{"PageUp", Key{PageUp, 0}},
+	{"Shift-Tab", Key{Tab, Shift}},
+	{"-", Key{'-', 0}},
+	{"Default", DefaultBinding},
+}
+
+func TestParseKey(t *testing.T) {
+	for _, tt := range parseKeyTests {
+		k, err := parseKey(tt.in)
+		if k != tt.wanted || err != nil {
+			t.Errorf("parseKey(%q) => (%v, %v), want (%v, nil)", tt.in, k, err, tt.wanted)
+		}
+		if tt.wanted != DefaultBinding && tt.wanted.Mod&Ctrl == 0 && k.String() != tt.in {
+			t.Errorf("parseKey(%q).String() => %q", tt.in, k.String())
+		}
+	}
+	for _, in := range []string{"", "Ctrl-", "ab"} {
+		if _, err := parseKey(in); err == nil {
+			t.Errorf("parseKey(%q) => no error, want error", in)
+		}
+	}
+}
+
+func TestKeymapBind(t *testing.T) {
+	km := make(keymap)
+	x, e := Key{'X', Ctrl}, Key{'E', Ctrl}
+	if err := km.bind([]Key{x, e}, "preview-expansion"); err != nil {
+		t.Errorf("bind => %v", err)
+	}
+	if km[x].next[e].fn != "preview-expansion" {
+		t.Errorf("key sequence not bound")
+	}
+	if err := km.bind([]Key{x}, "kill-line-left"); err == nil {
+		t.Errorf("binding prefix of key sequence => no error, want error")
+	}
+}
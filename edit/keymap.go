@@ -0,0 +1,151 @@
+package edit
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/xiaq/elvish/eval"
+)
+
+// keymap maps keys to the names of editor builtins, or to closures. A key can
+// also start a key sequence, in which case the following keys are looked up
+// in another keymap.
+type keymap map[Key]*keyNode
+
+// keyNode is what a key maps to in a keymap. Exactly one of fn, closure and
+// next is non-zero.
+type keyNode struct {
+	fn      string
+	closure *eval.Closure
+	next    keymap
+}
+
+var modeNames = map[string]bufferMode{
+	"insert":         modeInsert,
+	"command":        modeCommand,
+	"completion":     modeCompletion,
+	"navigation":     modeNavigation,
+	"history":        modeHistory,
+	"history-search": modeHistorySearch,
+	"location":       modeLocation,
+	"history-arg":    modeHistoryArg,
+}
+
+var (
+	errBindArgs     = errors.New("usage: le:bind mode key... builtin-or-closure")
+	errBindDefault  = errors.New("Default can only be bound alone")
+	errBindConflict = errors.New("key sequence conflicts with an existing binding")
+)
+
+// newKeymaps creates the keymaps of all modes from the default keyBindings,
+// with the bindings of modes covered by em replaced by those of em. em may be
+// nil.
+func newKeymaps(em *editingMode) map[bufferMode]keymap {
+	keymaps := make(map[bufferMode]keymap)
+	for mode, kb := range keyBindings {
+		if em != nil && em.bindings[mode] != nil {
+			kb = em.bindings[mode]
+		}
+		km := make(keymap)
+		for k, name := range kb {
+			km[k] = &keyNode{fn: name}
+		}
+		keymaps[mode] = km
+	}
+	if em != nil {
+		for mode, sb := range em.sequences {
+			for seq, name := range sb {
+				keys, err := parseKeys(seq)
+				if err == nil {
+					err = keymaps[mode].bind(keys, name)
+				}
+				if err != nil {
+					panic("bad key sequence " + seq + ": " + err.Error())
+				}
+			}
+		}
+	}
+	return keymaps
+}
+
+// bind binds a key sequence to an editor builtin. A key sequence replaces
+// bindings of all its prefixes; binding a proper prefix of an existing key
+// sequence is an error.
+func (km keymap) bind(keys []Key, fn string) error {
+	return km.bindNode(keys, &keyNode{fn: fn})
+}
+
+// bindNode is like bind, but binds the key sequence to leaf, which binds it
+// to a builtin or a closure.
+func (km keymap) bindNode(keys []Key, leaf *keyNode) error {
+	for i, k := range keys {
+		node := km[k]
+		if i == len(keys)-1 {
+			if node != nil && node.next != nil {
+				return errBindConflict
+			}
+			km[k] = leaf
+			return nil
+		}
+		if node == nil || node.next == nil {
+			node = &keyNode{next: make(keymap)}
+			km[k] = node
+		}
+		km = node.next
+	}
+	return nil
+}
+
+// bindFn implements the le:bind builtin, which binds a key sequence in a mode
+// to an editor builtin or a closure, e.g.
+//
+// le:bind insert Ctrl-X Ctrl-E preview-expansion
+// le:bind insert Ctrl-T { edit:insert (date) }
+//
+// Keys are written like "a", "Ctrl-W", "Alt-e" or "PageUp"; the special key
+// Default is used when no other key matches.
+func (ed *Editor) bindFn(ev *eval.Evaluator, args []eval.Value) string {
+	if len(args) < 3 {
+		return errBindArgs.Error()
+	}
+	mode, ok := modeNames[args[0].String()]
+	if !ok {
+		return fmt.Sprintf("no such mode: %s", args[0].String())
+	}
+	leaf := &keyNode{}
+	if c, ok := args[len(args)-1].(*eval.Closure); ok {
+		leaf.closure = c
+	} else {
+		leaf.fn = args[len(args)-1].String()
+		if leBuiltins[leaf.fn] == nil {
+			return fmt.Sprintf("no editor builtin named %s", leaf.fn)
+		}
+	}
+	var keys []Key
+	for _, a := range args[1 : len(args)-1] {
+		k, err := parseKey(a.String())
+		if err != nil {
+			return err.Error()
+		}
+		keys = append(keys, k)
+	}
+	for _, k := range keys {
+		if k == DefaultBinding && len(keys) > 1 {
+			return errBindDefault.Error()
+		}
+	}
+	if err := ed.keymaps[mode].bindNode(keys, leaf); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// keysString renders a key sequence for tips.
+func keysString(keys []Key) string {
+	s := make([]string, len(keys))
+	for i, k := range keys {
+		s[i] = k.String()
+	}
+	return strings.Join(s, " ")
+}
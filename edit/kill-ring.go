@@ -0,0 +1,87 @@
+package edit
+
+// Kill ring.
+
+const killRingSize = 60
+
+// appendingKills are the editor builtins whose kills are joined, when done
+// consecutively, into one entry of the kill ring as in Emacs.
+var appendingKills = map[string]bool{
+	"kill-line-left":  true,
+	"kill-line-right": true,
+	"kill-word-left":  true,
+	"kill-word-right": true,
+}
+
+// yankState keeps track of the last yanked text, so that yank-pop can
+// replace it.
+type yankState struct {
+	start int // Start of the yanked text; it ends at dot
+	index int // Index of the yanked text in the kill ring
+}
+
+// kill saves killed text to the kill ring. If the last editor builtin also
+// killed text, killed is joined with the last entry instead, before it if
+// prepend is true.
+func (ed *Editor) kill(killed string, prepend bool) {
+	n := len(ed.killRing)
+	if n > 0 && appendingKills[ed.lastFn] {
+		if prepend {
+			ed.killRing[n-1] = killed + ed.killRing[n-1]
+		} else {
+			ed.killRing[n-1] += killed
+		}
+		return
+	}
+	if n == killRingSize {
+		ed.killRing = ed.killRing[1:]
+	}
+	ed.killRing = append(ed.killRing, killed)
+}
+
+// yankAt inserts the killRing entry at index at dot.
+func (ed *Editor) yankAt(index int) {
+	text := ed.killRing[index]
+	ed.line = ed.line[:ed.dot] + text + ed.line[ed.dot:]
+	ed.yank = yankState{ed.dot, index}
+	ed.dot += len(text)
+}
+
+// yank inserts the last killed text at dot.
+func yank(ed *Editor, k Key) *leReturn {
+	if len(ed.killRing) == 0 {
+		ed.pushTip("kill ring empty")
+		return nil
+	}
+	ed.yankAt(len(ed.killRing) - 1)
+	return nil
+}
+
+// yankRight inserts the last killed text after the rune under dot, like the
+// p command of vi.
+func yankRight(ed *Editor, k Key) *leReturn {
+	if len(ed.killRing) == 0 {
+		ed.pushTip("kill ring empty")
+		return nil
+	}
+	ed.dot += graphemeLen(ed.line[ed.dot:])
+	ed.yankAt(len(ed.killRing) - 1)
+	return nil
+}
+
+// yankPop replaces the text just yanked with the previous entry of the kill
+// ring.
+func yankPop(ed *Editor, k Key) *leReturn {
+	switch ed.lastFn {
+	case "yank", "yank-right", "yank-pop":
+	default:
+		ed.pushTip("previous command was not a yank")
+		return nil
+	}
+	n := len(ed.killRing)
+	index := (ed.yank.index + n - 1) % n
+	ed.line = ed.line[:ed.yank.start] + ed.line[ed.dot:]
+	ed.dot = ed.yank.start
+	ed.yankAt(index)
+	return nil
+}
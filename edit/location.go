@@ -0,0 +1,101 @@
+package edit
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// Location mode, for jumping to previously visited directories.
+
+// location is the state of the location mode. candidates are the directories
+// matching query, the best match first.
+type location struct {
+	query      string
+	candidates []string
+	current    int
+}
+
+// SetDirMatcher sets the function used by the location mode to find visited
+// directories matching a pattern, the best match first.
+func (ed *Editor) SetDirMatcher(f func(pattern string) []string) {
+	ed.dirMatcher = f
+}
+
+func (ed *Editor) updateLocation() {
+	loc := ed.location
+	loc.candidates = ed.dirMatcher(loc.query)
+	loc.current = 0
+}
+
+func startLocation(ed *Editor, k Key) *leReturn {
+	if ed.dirMatcher == nil {
+		ed.pushTip("directory history not available")
+		return nil
+	}
+	ed.location = &location{}
+	ed.updateLocation()
+	ed.mode = modeLocation
+	return nil
+}
+
+func selectLocationPrev(ed *Editor, k Key) *leReturn {
+	if ed.location.current > 0 {
+		ed.location.current--
+	}
+	return nil
+}
+
+func selectLocationNext(ed *Editor, k Key) *leReturn {
+	if ed.location.current < len(ed.location.candidates)-1 {
+		ed.location.current++
+	}
+	return nil
+}
+
+func locationDelete(ed *Editor, k Key) *leReturn {
+	loc := ed.location
+	if loc.query == "" {
+		ed.beep()
+		return nil
+	}
+	_, w := utf8.DecodeLastRuneInString(loc.query)
+	loc.query = loc.query[:len(loc.query)-w]
+	ed.updateLocation()
+	return nil
+}
+
+func cancelLocation(ed *Editor, k Key) *leReturn {
+	ed.location = nil
+	ed.mode = modeInsert
+	return nil
+}
+
+// acceptLocation changes to the selected directory. If the line is empty, it
+// is returned, so that the prompt is updated.
+func acceptLocation(ed *Editor, k Key) *leReturn {
+	loc := ed.location
+	ed.location = nil
+	ed.mode = modeInsert
+	if len(loc.candidates) == 0 {
+		return nil
+	}
+	if err := ed.ev.Chdir(loc.candidates[loc.current]); err != nil {
+		ed.pushTip(err.Error())
+		return nil
+	}
+	if ed.line == "" {
+		return &leReturn{action: exitReadLine}
+	}
+	return nil
+}
+
+// defaultLocation adds printable keys to the query.
+func defaultLocation(ed *Editor, k Key) *leReturn {
+	if k.Mod == 0 && k.Rune > 0 && unicode.IsGraphic(k.Rune) {
+		ed.location.query += string(k.Rune)
+		ed.updateLocation()
+		return nil
+	}
+	ed.beep()
+	return nil
+}
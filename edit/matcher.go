@@ -0,0 +1,107 @@
+package edit
+
+// Matchers of completion candidates. A matcher decides whether a candidate
+// matches the pattern being completed, and which parts of it do, so that
+// they can be highlighted in the completion menu:
+//
+// prefix     the candidate starts with the pattern
+// substring  the candidate contains the pattern
+// fuzzy      the candidate contains the runes of the pattern in order, case
+//            insensitively unless the pattern has an upper case letter
+//
+// The matcher used for the arguments of a command is the entry of the command
+// in $edit:completion-matcher, and the one for other completions the entry of
+// "", e.g.
+//
+// edit:completion-matcher = [&""=substring &git=fuzzy]
+//
+// Without an entry, prefix is used.
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/xiaq/elvish/eval"
+)
+
+// matcher returns the byte ranges of s that match pattern, and whether s
+// matches.
+type matcher func(pattern, s string) ([][2]int, bool)
+
+var matchers = map[string]matcher{
+	"prefix":    matchPrefix,
+	"substring": matchSubstring,
+	"fuzzy":     matchFuzzy,
+}
+
+func matchPrefix(pattern, s string) ([][2]int, bool) {
+	if !strings.HasPrefix(s, pattern) {
+		return nil, false
+	}
+	return [][2]int{{0, len(pattern)}}, true
+}
+
+func matchSubstring(pattern, s string) ([][2]int, bool) {
+	i := strings.Index(s, pattern)
+	if i == -1 {
+		return nil, false
+	}
+	return [][2]int{{i, i + len(pattern)}}, true
+}
+
+func matchFuzzy(pattern, s string) ([][2]int, bool) {
+	fold := strings.IndexFunc(pattern, unicode.IsUpper) == -1
+	var regions [][2]int
+	i := 0
+	for _, r := range pattern {
+		for {
+			if i == len(s) {
+				return nil, false
+			}
+			r2, n := utf8.DecodeRuneInString(s[i:])
+			if r2 == r || fold && unicode.ToLower(r2) == r {
+				if len(regions) > 0 && regions[len(regions)-1][1] == i {
+					regions[len(regions)-1][1] = i + n
+				} else {
+					regions = append(regions, [2]int{i, i + n})
+				}
+				i += n
+				break
+			}
+			i += n
+		}
+	}
+	return regions, true
+}
+
+// setCompletionMatchers sets $edit:completion-matcher, whose entries must
+// name matchers.
+func (ed *Editor) setCompletionMatchers(v eval.Value) error {
+	t, ok := v.(*eval.Table)
+	if !ok {
+		return fmt.Errorf("completion matchers must be a table, got %s", v.Repr())
+	}
+	names := make(map[string]string)
+	for k, v := range t.Dict {
+		if matchers[v.String()] == nil {
+			return fmt.Errorf("no matcher named %s", v.String())
+		}
+		names[k.String()] = v.String()
+	}
+	ed.matcherTable, ed.matcherNames = t, names
+	return nil
+}
+
+// matcher returns the matcher for completing the arguments of command, or ""
+// for other completions.
+func (ed *Editor) matcher(command string) matcher {
+	if name, ok := ed.matcherNames[command]; ok {
+		return matchers[name]
+	}
+	if name, ok := ed.matcherNames[""]; ok {
+		return matchers[name]
+	}
+	return matchPrefix
+}
@@ -0,0 +1,46 @@
+package edit
+
+import (
+	"reflect"
+	"testing"
+)
+
+var matcherTests = []struct {
+	matcher string
+	pattern string
+	s       string
+	regions [][2]int
+	ok      bool
+}{
+	{"prefix", "fo", "foo", [][2]int{{0, 2}}, true},
+	{"prefix", "oo", "foo", nil, false},
+	{"substring", "oo", "foo", [][2]int{{1, 3}}, true},
+	{"substring", "of", "foo", nil, false},
+	{"fuzzy", "fb", "foo-bar", [][2]int{{0, 1}, {4, 5}}, true},
+	{"fuzzy", "oob", "foo-bar", [][2]int{{1, 3}, {4, 5}}, true},
+	{"fuzzy", "fb", "Foo-Bar", [][2]int{{0, 1}, {4, 5}}, true},
+	{"fuzzy", "Fb", "foo-bar", nil, false},
+	{"fuzzy", "bf", "foo-bar", nil, false},
+	{"fuzzy", "", "foo", nil, true},
+}
+
+func TestMatchers(t *testing.T) {
+	for _, tt := range matcherTests {
+		regions, ok := matchers[tt.matcher](tt.pattern, tt.s)
+		if !reflect.DeepEqual(regions, tt.regions) || ok != tt.ok {
+			t.Errorf("%s(%q, %q) => (%v, %v), want (%v, %v)",
+				tt.matcher, tt.pattern, tt.s, regions, ok, tt.regions, tt.ok)
+		}
+	}
+}
+
+func TestFindCandidates(t *testing.T) {
+	cands := findCandidates(matchFuzzy, "fb", []string{"foo-bar", "baz"})
+	if len(cands) != 1 {
+		t.Fatalf("findCandidates => %d candidates, want 1", len(cands))
+	}
+	want := []tokenPart{{"f", false}, {"oo-", true}, {"b", false}, {"ar", true}}
+	if c := cands[0]; c.text != "foo-bar" || !reflect.DeepEqual(c.parts, want) {
+		t.Errorf("findCandidates => %q with parts %v, want parts %v", c.text, c.parts, want)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/xiaq/elvish/util"
@@ -32,6 +33,11 @@ const (
 	RuneTimeout rune = -1
 )
 
+// PasteTimeout is how long the text pasted in bracketed paste mode may pause
+// before what has been pasted so far is taken, in case the terminal never
+// sends the end of the paste.
+var PasteTimeout = time.Second
+
 var (
 	ErrTimeout = errors.New("timed out")
 	BadCPR     = errors.New("bad CPR")
@@ -53,7 +59,9 @@ func (bes *BadEscSeq) Error() string {
 type OneRead struct {
 	Key Key
 	CPR pos
-	Err error
+	// Paste is the text pasted in bracketed paste mode, when not empty.
+	Paste string
+	Err   error
 }
 
 // Reader converts a stream of runes into a stream of Keys
@@ -154,7 +162,7 @@ var g3Seq = map[rune]rune{
 	'H': Home, 'F': End,
 }
 
-func (rd *Reader) readOne(r rune) (k Key, cpr pos, err error) {
+func (rd *Reader) readOne(r rune) (k Key, cpr pos, paste string, err error) {
 	defer util.Recover(&err)
 
 	rd.currentSeq = ""
@@ -173,7 +181,7 @@ func (rd *Reader) readOne(r rune) (k Key, cpr pos, err error) {
 		//defer func() { rd.timed.Timeout = -1 }()
 		r2 := rd.readRune(EscTimeout)
 		if r2 == RuneTimeout {
-			return Key{'[', Ctrl}, InvalidPos, nil
+			return Key{'[', Ctrl}, InvalidPos, "", nil
 		}
 		switch r2 {
 		case '[':
@@ -186,7 +194,7 @@ func (rd *Reader) readOne(r rune) (k Key, cpr pos, err error) {
 				r = rd.readRune(timeout)
 				// Timeout can only happen at first readRune.
 				if r == RuneTimeout {
-					return Key{'[', Alt}, InvalidPos, nil
+					return Key{'[', Alt}, InvalidPos, "", nil
 				}
 				seq += string(r)
 				// After first rune read we turn off the timeout
@@ -210,24 +218,26 @@ func (rd *Reader) readOne(r rune) (k Key, cpr pos, err error) {
 				if len(nums) != 2 {
 					rd.badEscSeq("bad cpr")
 				}
-				return ZeroKey, pos{nums[0], nums[1]}, nil
+				return ZeroKey, pos{nums[0], nums[1]}, "", nil
+			} else if r == '~' && len(nums) == 1 && nums[0] == 200 {
+				return ZeroKey, InvalidPos, rd.readPaste(), nil
 			} else {
 				k, err := parseCSI(nums, r, seq)
-				return k, InvalidPos, err
+				return k, InvalidPos, "", err
 			}
 		case 'O':
 			// G3 style function key sequence: read one rune.
 			r = rd.readRune(EscTimeout)
 			if r == RuneTimeout {
-				return Key{r2, Alt}, InvalidPos, nil
+				return Key{r2, Alt}, InvalidPos, "", nil
 			}
 			r, ok := g3Seq[r]
 			if ok {
-				return Key{r, 0}, InvalidPos, nil
+				return Key{r, 0}, InvalidPos, "", nil
 			}
 			rd.badEscSeq("")
 		}
-		return Key{r2, Alt}, InvalidPos, nil
+		return Key{r2, Alt}, InvalidPos, "", nil
 	default:
 		// Sane Ctrl- sequences that agree with the keyboard...
 		if 0x1 <= r && r <= 0x1d {
@@ -236,7 +246,34 @@ func (rd *Reader) readOne(r rune) (k Key, cpr pos, err error) {
 			k = Key{r, 0}
 		}
 	}
-	return k, InvalidPos, nil
+	return k, InvalidPos, "", nil
+}
+
+// pasteEnd ends the text pasted in bracketed paste mode, which starts with
+// \e[200~.
+const pasteEnd = "\x1b[201~"
+
+// readPaste reads the text pasted in bracketed paste mode, after \e[200~ has
+// been read, until \e[201~ or a pause of PasteTimeout, so that the reader
+// can still be stopped if the end never comes. The text is taken literally,
+// with line endings turned into \n.
+func (rd *Reader) readPaste() string {
+	var buf []rune
+	for {
+		r := rd.readRune(PasteTimeout)
+		if r == RuneTimeout {
+			return pastedText(buf)
+		}
+		buf = append(buf, r)
+		if n := len(buf) - len(pasteEnd); n >= 0 && string(buf[n:]) == pasteEnd {
+			return pastedText(buf[:n])
+		}
+	}
+}
+
+func pastedText(buf []rune) string {
+	text := strings.Replace(string(buf), "\r\n", "\n", -1)
+	return strings.Replace(text, "\r", "\n", -1)
 }
 
 func (rd *Reader) stop() (quit bool) {
@@ -262,8 +299,8 @@ func (rd *Reader) run() {
 	for {
 		select {
 		case r := <-runes:
-			k, c, e := rd.readOne(r)
-			rd.ones <- OneRead{k, c, e}
+			k, c, p, e := rd.readOne(r)
+			rd.ones <- OneRead{k, c, p, e}
 		case ctrl := <-rd.ctrl:
 			rd.ctrlAck <- true
 			switch ctrl {
@@ -0,0 +1,152 @@
+package edit
+
+// Autosuggestion. In insert mode, when the dot is at the end of the line, the
+// rest of the most recent history entry starting with the line is shown dim
+// after the dot. Moving the dot right or to the end of the line accepts it.
+//
+// Entries are found with a historyIndex, a radix tree of the history in which
+// each node knows the most recent entry under it, so that finding the
+// suggestion takes time in the length of the line, not of the history.
+
+type historyIndex struct {
+	root historyNode
+	// pruned is the number of entries pruned from the start of the history
+	// since the index was built. Indices in the nodes count them, and the
+	// nodes of pruned entries are left in place until the index is rebuilt.
+	pruned int
+}
+
+type historyNode struct {
+	// label is the text from the parent node to this one. Labels of the
+	// children of a node start with different bytes.
+	label    string
+	children []*historyNode
+	// latest is the index of the most recent entry in the subtree, and end
+	// that of the most recent entry ending at this node, or -1 if there is
+	// none.
+	latest, end int
+}
+
+func newHistoryIndex(entries []string) *historyIndex {
+	hi := &historyIndex{root: historyNode{latest: -1, end: -1}}
+	for i, e := range entries {
+		hi.add(e, i)
+	}
+	return hi
+}
+
+// add adds entry, which is at index i of the history. Entries must be added
+// in the order of their indices.
+func (hi *historyIndex) add(entry string, i int) {
+	i += hi.pruned
+	n := &hi.root
+	for {
+		n.latest = i
+		if entry == "" {
+			n.end = i
+			return
+		}
+		child := n.child(entry[0])
+		if child == nil {
+			n.children = append(n.children, &historyNode{label: entry, latest: i, end: i})
+			return
+		}
+		common := commonPrefixLen(child.label, entry)
+		if common < len(child.label) {
+			// Split child at the end of the common prefix.
+			rest := *child
+			rest.label = child.label[common:]
+			*child = historyNode{label: child.label[:common], children: []*historyNode{&rest}, latest: rest.latest, end: -1}
+		}
+		n, entry = child, entry[common:]
+	}
+}
+
+// prune records that the oldest n entries have been pruned from the history.
+func (hi *historyIndex) prune(n int) {
+	hi.pruned += n
+}
+
+// latest returns the index of the most recent entry that starts with prefix
+// and is longer, or -1 if there is none.
+func (hi *historyIndex) latest(prefix string) int {
+	// When the most recent entry under a node has been pruned, so have all
+	// the others.
+	if i := hi.latestIndexed(prefix); i >= hi.pruned {
+		return i - hi.pruned
+	}
+	return -1
+}
+
+// latestIndexed is like latest, but counts pruned entries.
+func (hi *historyIndex) latestIndexed(prefix string) int {
+	n := &hi.root
+	for prefix != "" {
+		child := n.child(prefix[0])
+		if child == nil {
+			return -1
+		}
+		if len(prefix) < len(child.label) {
+			if child.label[:len(prefix)] != prefix {
+				return -1
+			}
+			// All entries under child are longer than prefix.
+			return child.latest
+		}
+		if prefix[:len(child.label)] != child.label {
+			return -1
+		}
+		n, prefix = child, prefix[len(child.label):]
+	}
+	// Entries equal to prefix end at n; only those under its children are
+	// longer.
+	latest := -1
+	for _, c := range n.children {
+		if c.latest > latest {
+			latest = c.latest
+		}
+	}
+	return latest
+}
+
+func (n *historyNode) child(b byte) *historyNode {
+	for _, c := range n.children {
+		if c.label[0] == b {
+			return c
+		}
+	}
+	return nil
+}
+
+func commonPrefixLen(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// suggest returns the rest of the history entry suggested after the line, or
+// "" if there is none.
+func (ed *Editor) suggest() string {
+	if ed.mode != modeInsert || ed.line == "" || ed.dot != len(ed.line) {
+		return ""
+	}
+	i := ed.historyIndex.latest(ed.line)
+	if i == -1 {
+		return ""
+	}
+	return ed.histories[i][len(ed.line):]
+}
+
+// acceptSuggestion appends the suggestion to the line, if there is one, and
+// returns whether there was.
+func (ed *Editor) acceptSuggestion() bool {
+	if ed.suggestion == "" || ed.mode != modeInsert || ed.dot != len(ed.line) {
+		return false
+	}
+	ed.line += ed.suggestion
+	ed.dot = len(ed.line)
+	ed.suggestion = ""
+	return true
+}
@@ -0,0 +1,108 @@
+package edit
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/xiaq/elvish/eval"
+)
+
+var suggestionHistories = []string{"echo foo", "ls", "echo bar", "echo", "ls -l", "echo foo"}
+
+var historyIndexTests = []struct {
+	prefix string
+	want   int
+}{
+	{"", 5},
+	{"e", 5},
+	{"echo ", 5},
+	{"echo b", 2},
+	{"echo", 5},
+	{"echo foo", -1},
+	{"ls", 4},
+	{"ls -l", -1},
+	{"x", -1},
+	{"echo x", -1},
+}
+
+func TestHistoryIndex(t *testing.T) {
+	hi := newHistoryIndex(suggestionHistories)
+	for _, tt := range historyIndexTests {
+		if i := hi.latest(tt.prefix); i != tt.want {
+			t.Errorf("latest(%q) => %d, want %d", tt.prefix, i, tt.want)
+		}
+	}
+}
+
+func TestSuggestion(t *testing.T) {
+	ed := &Editor{}
+	ed.LoadHistory(suggestionHistories)
+	ed.line, ed.dot = "echo b", 6
+	if ed.suggestion = ed.suggest(); ed.suggestion != "ar" {
+		t.Errorf("suggestion after %q => %q, want %q", ed.line, ed.suggestion, "ar")
+	}
+	moveDotRight(ed, Key{Right, 0})
+	if ed.line != "echo bar" || ed.dot != 8 {
+		t.Errorf("accepting suggestion => line %q, dot %d", ed.line, ed.dot)
+	}
+	ed.line, ed.dot = "echo b", 5
+	if s := ed.suggest(); s != "" {
+		t.Errorf("suggestion with dot inside line => %q, want none", s)
+	}
+}
+
+func TestHistoryPolicy(t *testing.T) {
+	ev := eval.NewEvaluator()
+	ed := &Editor{ev: ev}
+	ed.LoadHistory(suggestionHistories)
+	o := ev.Options()
+	o.Set("history-ignore-space", eval.NewString("true"))
+	o.Set("history-ignore-dups", eval.NewString("true"))
+	o.Set("history-max-size", eval.NewString("4"))
+	for _, line := range []string{"echo foo", " echo secret", "echo baz"} {
+		ed.appendHistory(line)
+	}
+	wanted := []string{"echo", "ls -l", "echo foo", "echo baz"}
+	if !reflect.DeepEqual(ed.histories, wanted) {
+		t.Errorf("after appending, histories %v, want %v", ed.histories, wanted)
+	}
+	if n := ed.DelHistory(regexp.MustCompile("^echo ")); n != 2 {
+		t.Errorf("DelHistory => %d, want 2", n)
+	}
+	ed.AddHistory([]string{"echo qux"})
+	ed.line, ed.dot, ed.mode = "echo", 4, modeInsert
+	if s := ed.suggest(); s != " qux" {
+		t.Errorf("suggestion after deleting and adding => %q, want %q", s, " qux")
+	}
+	if n := ed.PruneHistory(1); n != 2 || len(ed.histories) != 1 {
+		t.Errorf("PruneHistory(1) => %d, histories %v", n, ed.histories)
+	}
+}
+
+func TestPruneHistoryIncrementally(t *testing.T) {
+	ev := eval.NewEvaluator()
+	ed := &Editor{ev: ev, historyIndex: newHistoryIndex(nil)}
+	ev.Options().Set("history-max-size", eval.NewString("3"))
+	ed.mode = modeInsert
+	for _, line := range []string{"ls -l", "echo a", "echo b", "echo c"} {
+		ed.appendHistory(line)
+	}
+	hi := ed.historyIndex
+	ed.appendHistory("echo d")
+	if ed.historyIndex != hi {
+		t.Errorf("appending to a full history rebuilds the index")
+	}
+	wanted := []string{"echo b", "echo c", "echo d"}
+	if !reflect.DeepEqual(ed.histories, wanted) {
+		t.Errorf("after appending, histories %v, want %v", ed.histories, wanted)
+	}
+	for _, tt := range []struct{ line, want string }{
+		{"echo ", "d"}, {"ls", ""}, {"echo a", ""},
+	} {
+		ed.line, ed.dot = tt.line, len(tt.line)
+		if s := ed.suggest(); s != tt.want {
+			t.Errorf("suggestion after %q => %q, want %q", tt.line, s, tt.want)
+		}
+	}
+}
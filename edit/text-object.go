@@ -0,0 +1,220 @@
+package edit
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/xiaq/elvish/util"
+)
+
+// Text objects and the editor builtins operating on them.
+
+// textObject finds a region of the line relative to dot. ok is false if there
+// is no such region.
+type textObject func(line string, dot int) (start, end int, ok bool)
+
+// textObjects are the text objects known to the editor. For each text object
+// x, there are editor builtins kill-x, which deletes the region and saves it
+// to the kill ring, change-x, which also starts insert mode, and copy-x,
+// which only saves the region to the kill ring.
+var textObjects = map[string]textObject{
+	"line-left":  lineLeft,
+	"line-right": lineRight,
+	"line":       currentLine,
+	"word-left":  wordLeft,
+	"word-right": wordRight,
+	"inner-word": innerWord,
+	"a-word":     aWord,
+
+	"inner-dquote": innerQuoted('"'),
+	"a-dquote":     aQuoted('"'),
+	"inner-bquote": innerQuoted('`'),
+	"a-bquote":     aQuoted('`'),
+
+	"inner-paren":   innerPaired('(', ')'),
+	"a-paren":       aPaired('(', ')'),
+	"inner-bracket": innerPaired('[', ']'),
+	"a-bracket":     aPaired('[', ']'),
+	"inner-brace":   innerPaired('{', '}'),
+	"a-brace":       aPaired('{', '}'),
+}
+
+func lineLeft(line string, dot int) (int, int, bool) {
+	return util.FindLastSOL(line[:dot]), dot, true
+}
+
+func lineRight(line string, dot int) (int, int, bool) {
+	return dot, util.FindFirstEOL(line[dot:]) + dot, true
+}
+
+func currentLine(line string, dot int) (int, int, bool) {
+	return util.FindLastSOL(line[:dot]), util.FindFirstEOL(line[dot:]) + dot, true
+}
+
+// NOTE(xiaq): A word is now defined as a series of non-whitespace chars.
+
+// wordLeft is the region from the start of the word before dot to dot.
+func wordLeft(line string, dot int) (int, int, bool) {
+	start := strings.LastIndexFunc(
+		strings.TrimRightFunc(line[:dot], unicode.IsSpace),
+		unicode.IsSpace) + 1
+	return start, dot, true
+}
+
+// wordRight is the region from dot to the start of the next word.
+func wordRight(line string, dot int) (int, int, bool) {
+	rest := strings.TrimLeftFunc(
+		strings.TrimLeftFunc(line[dot:], isNotSpace), unicode.IsSpace)
+	return dot, len(line) - len(rest), true
+}
+
+func isNotSpace(r rune) bool {
+	return !unicode.IsSpace(r)
+}
+
+// innerWord is the word or the run of whitespace at dot.
+func innerWord(line string, dot int) (int, int, bool) {
+	if line == "" {
+		return 0, 0, false
+	}
+	if dot == len(line) {
+		_, w := utf8.DecodeLastRuneInString(line)
+		dot -= w
+	}
+	r, _ := utf8.DecodeRuneInString(line[dot:])
+	f := isNotSpace
+	if unicode.IsSpace(r) {
+		f = unicode.IsSpace
+	}
+	start := len(strings.TrimRightFunc(line[:dot], f))
+	end := len(line) - len(strings.TrimLeftFunc(line[dot:], f))
+	return start, end, true
+}
+
+// aWord is the word at dot with the whitespace following it, or the
+// whitespace preceding it if there is none following.
+func aWord(line string, dot int) (int, int, bool) {
+	start, end, ok := innerWord(line, dot)
+	if !ok {
+		return 0, 0, false
+	}
+	if r, _ := utf8.DecodeRuneInString(line[start:]); unicode.IsSpace(r) {
+		// On whitespace; include the word following it.
+		end = len(line) - len(strings.TrimLeftFunc(line[end:], isNotSpace))
+		return start, end, true
+	}
+	if spaceEnd := len(line) - len(strings.TrimLeftFunc(line[end:], unicode.IsSpace)); spaceEnd > end {
+		return start, spaceEnd, true
+	}
+	return len(strings.TrimRightFunc(line[:start], unicode.IsSpace)), end, true
+}
+
+// findQuoted finds the positions of a pair of quotes around dot. Quotes on a
+// line are paired from the start of the line.
+func findQuoted(line string, dot int, q byte) (open, close int, ok bool) {
+	sol := util.FindLastSOL(line[:dot])
+	eol := util.FindFirstEOL(line[dot:]) + dot
+	open = -1
+	for i := sol; i < eol; i++ {
+		if line[i] != q {
+			continue
+		}
+		if open == -1 {
+			open = i
+		} else {
+			if open <= dot && dot <= i {
+				return open, i, true
+			}
+			open = -1
+		}
+	}
+	return 0, 0, false
+}
+
+func innerQuoted(q byte) textObject {
+	return func(line string, dot int) (int, int, bool) {
+		open, close, ok := findQuoted(line, dot, q)
+		return open + 1, close, ok
+	}
+}
+
+func aQuoted(q byte) textObject {
+	return func(line string, dot int) (int, int, bool) {
+		open, close, ok := findQuoted(line, dot, q)
+		return open, close + 1, ok
+	}
+}
+
+// findPaired finds the positions of the innermost pair of brackets enclosing
+// dot. A bracket at dot is considered to enclose it.
+func findPaired(line string, dot int, o, c byte) (open, close int, ok bool) {
+	i := dot
+	if i == len(line) || line[i] == c {
+		i--
+	}
+	open = -1
+	for depth := 0; i >= 0 && open == -1; i-- {
+		switch line[i] {
+		case c:
+			depth++
+		case o:
+			if depth == 0 {
+				open = i
+			}
+			depth--
+		}
+	}
+	if open == -1 {
+		return 0, 0, false
+	}
+	depth := 0
+	for i := open + 1; i < len(line); i++ {
+		switch line[i] {
+		case o:
+			depth++
+		case c:
+			if depth == 0 {
+				return open, i, true
+			}
+			depth--
+		}
+	}
+	return 0, 0, false
+}
+
+func innerPaired(o, c byte) textObject {
+	return func(line string, dot int) (int, int, bool) {
+		open, close, ok := findPaired(line, dot, o, c)
+		return open + 1, close, ok
+	}
+}
+
+func aPaired(o, c byte) textObject {
+	return func(line string, dot int) (int, int, bool) {
+		open, close, ok := findPaired(line, dot, o, c)
+		return open, close + 1, ok
+	}
+}
+
+// textObjectBuiltin makes an editor builtin operating on a text object. The
+// region is saved to the kill ring and dot moves to its start; if del is
+// true, it is also deleted, and if insert is true, insert mode is started.
+func textObjectBuiltin(obj textObject, del, insert bool) leBuiltin {
+	return func(ed *Editor, k Key) *leReturn {
+		start, end, ok := obj(ed.line, ed.dot)
+		if !ok {
+			ed.beep()
+			return nil
+		}
+		ed.kill(ed.line[start:end], start < ed.dot)
+		if del {
+			ed.line = ed.line[:start] + ed.line[end:]
+		}
+		ed.dot = start
+		if insert {
+			ed.mode = modeInsert
+		}
+		return nil
+	}
+}
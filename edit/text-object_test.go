@@ -0,0 +1,53 @@
+package edit
+
+import "testing"
+
+var textObjectTests = []struct {
+	obj        string
+	line       string
+	dot        int
+	start, end int
+	ok         bool
+}{
+	{"line-left", "ab\ncd", 4, 3, 4, true},
+	{"line-right", "ab\ncd", 1, 1, 2, true},
+	{"word-left", "ls  foo", 7, 4, 7, true},
+	{"word-right", "ls  foo", 0, 0, 4, true},
+	{"inner-word", "ls foo bar", 4, 3, 6, true},
+	{"inner-word", "ls foo bar", 10, 7, 10, true},
+	{"a-word", "ls foo bar", 4, 3, 7, true},
+	{"a-word", "ls foo bar", 8, 6, 10, true},
+	{"inner-dquote", `echo "a b" "c"`, 7, 6, 9, true},
+	{"a-dquote", `echo "a b" "c"`, 12, 11, 14, true},
+	{"inner-dquote", `echo "a b" "c"`, 10, 0, 0, false},
+	{"inner-paren", "put (a (b) c)", 11, 5, 12, true},
+	{"a-paren", "put (a (b) c)", 8, 7, 10, true},
+	{"inner-brace", "each { put $a }", 6, 6, 14, true},
+	{"inner-bracket", "put [a b", 6, 0, 0, false},
+}
+
+func TestTextObjects(t *testing.T) {
+	for _, tt := range textObjectTests {
+		start, end, ok := textObjects[tt.obj](tt.line, tt.dot)
+		if ok != tt.ok || (ok && (start != tt.start || end != tt.end)) {
+			t.Errorf("%s(%q, %d) => (%d, %d, %v), want (%d, %d, %v)",
+				tt.obj, tt.line, tt.dot, start, end, ok, tt.start, tt.end, tt.ok)
+		}
+	}
+}
+
+func TestEditingModes(t *testing.T) {
+	for name, em := range editingModes {
+		keymaps := newKeymaps(em)
+		for mode := range keyBindings {
+			if keymaps[mode][DefaultBinding] == nil {
+				t.Errorf("editing mode %s has no default binding for mode %d", name, mode)
+			}
+		}
+	}
+	cmd := newKeymaps(editingModes["vi"])[modeCommand]
+	c, i, w := Key{'c', 0}, Key{'i', 0}, Key{'w', 0}
+	if node := cmd[c].next[i].next[w]; node == nil || node.fn != "change-inner-word" {
+		t.Errorf("c i w not bound to change-inner-word in vi mode")
+	}
+}
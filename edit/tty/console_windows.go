@@ -0,0 +1,144 @@
+package tty
+
+// The Windows console, which speaks VT sequences like a terminal once put
+// into virtual terminal mode.
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	enableLineInput                 = 0x2
+	enableEchoInput                 = 0x4
+	enableVirtualTerminalInput      = 0x200
+	enableVirtualTerminalProcessing = 0x4
+)
+
+var (
+	kernel32                       = syscall.NewLazyDLL("kernel32.dll")
+	procSetConsoleMode             = kernel32.NewProc("SetConsoleMode")
+	procFlushConsoleInputBuffer    = kernel32.NewProc("FlushConsoleInputBuffer")
+	procGetConsoleScreenBufferInfo = kernel32.NewProc("GetConsoleScreenBufferInfo")
+)
+
+func call(name string, proc *syscall.LazyProc, args ...uintptr) error {
+	r, _, e := proc.Call(args...)
+	if r == 0 {
+		return os.NewSyscallError(name, e)
+	}
+	return nil
+}
+
+// Termios holds the modes of the console, which take the place of terminal
+// attributes on Windows: that of the input handle fd, and that of the
+// standard output, where the editor writes.
+type Termios struct {
+	inMode, outMode uint32
+}
+
+func NewTermiosFromFd(fd int) (*Termios, error) {
+	term := new(Termios)
+	err := term.FromFd(fd)
+	if err != nil {
+		return nil, err
+	}
+	return term, nil
+}
+
+func stdout() syscall.Handle {
+	h, _ := syscall.GetStdHandle(syscall.STD_OUTPUT_HANDLE)
+	return h
+}
+
+func (term *Termios) FromFd(fd int) error {
+	if err := syscall.GetConsoleMode(syscall.Handle(fd), &term.inMode); err != nil {
+		return os.NewSyscallError("GetConsoleMode", err)
+	}
+	if err := syscall.GetConsoleMode(stdout(), &term.outMode); err != nil {
+		return os.NewSyscallError("GetConsoleMode", err)
+	}
+	return nil
+}
+
+func (term *Termios) ApplyToFd(fd int) error {
+	err := call("SetConsoleMode", procSetConsoleMode, uintptr(fd), uintptr(term.inMode))
+	if err != nil {
+		return err
+	}
+	return call("SetConsoleMode", procSetConsoleMode, uintptr(stdout()), uintptr(term.outMode))
+}
+
+func (term *Termios) Copy() *Termios {
+	v := *term
+	return &v
+}
+
+// SetTime does nothing, since reads from the console never time out.
+func (term *Termios) SetTime(v uint8) {
+}
+
+// SetMin does nothing, since reads from the console return as soon as there
+// is input when line input is off.
+func (term *Termios) SetMin(v uint8) {
+}
+
+func setFlag(flag *uint32, mask uint32, v bool) {
+	if v {
+		*flag |= mask
+	} else {
+		*flag &= ^mask
+	}
+}
+
+// SetIcanon turns line input on or off. With line input off, keys are
+// delivered as VT sequences and VT sequences written are interpreted, like
+// on a terminal.
+func (term *Termios) SetIcanon(v bool) {
+	setFlag(&term.inMode, enableLineInput, v)
+	setFlag(&term.inMode, enableVirtualTerminalInput, !v)
+	setFlag(&term.outMode, enableVirtualTerminalProcessing, !v)
+}
+
+func (term *Termios) SetEcho(v bool) {
+	setFlag(&term.inMode, enableEchoInput, v)
+}
+
+func FlushInput(fd int) error {
+	return call("FlushConsoleInputBuffer", procFlushConsoleInputBuffer, uintptr(fd))
+}
+
+type Winsize struct {
+	Row uint16
+	Col uint16
+}
+
+type coord struct {
+	x, y int16
+}
+
+type smallRect struct {
+	left, top, right, bottom int16
+}
+
+type consoleScreenBufferInfo struct {
+	size              coord
+	cursorPosition    coord
+	attributes        uint16
+	window            smallRect
+	maximumWindowSize coord
+}
+
+// GetWinsize returns the size of the visible window of the console. fd is
+// not used, since the size belongs to the screen buffer of the standard
+// output.
+func GetWinsize(fd int) Winsize {
+	var info consoleScreenBufferInfo
+	call("GetConsoleScreenBufferInfo", procGetConsoleScreenBufferInfo,
+		uintptr(stdout()), uintptr(unsafe.Pointer(&info)))
+	return Winsize{
+		Row: uint16(info.window.bottom - info.window.top + 1),
+		Col: uint16(info.window.right - info.window.left + 1),
+	}
+}
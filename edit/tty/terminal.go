@@ -0,0 +1,79 @@
+package tty
+
+import (
+	"fmt"
+	"os"
+)
+
+// Terminal is what the editor needs of the terminal it runs on. Keys and
+// positions are read, and the display is drawn, with VT sequences; a Terminal
+// only takes care of what can't be done with them.
+type Terminal interface {
+	// Setup puts the terminal into raw mode, where keys are delivered as they
+	// are pressed without being echoed, and turns off autowrap and turns on
+	// bracketed paste. Input not read yet is discarded.
+	Setup() error
+	// Restore undoes Setup.
+	Restore() error
+	// Size returns the numbers of rows and columns of the terminal.
+	Size() (rows, cols int)
+}
+
+// NewTerminal returns the Terminal of f. Its raw mode is set through Termios,
+// which holds the termios attributes of f on Unix, and the console modes of f
+// and the standard output on Windows. Only this package builds on Windows so
+// far; the editor also needs the sys package, which is Unix-only.
+func NewTerminal(f *os.File) Terminal {
+	return &fileTerminal{file: f}
+}
+
+type fileTerminal struct {
+	file  *os.File
+	saved *Termios
+}
+
+func (t *fileTerminal) Setup() error {
+	fd := int(t.file.Fd())
+	term, err := NewTermiosFromFd(fd)
+	if err != nil {
+		return fmt.Errorf("can't get terminal attribute: %s", err)
+	}
+	saved := term.Copy()
+
+	term.SetIcanon(false)
+	term.SetEcho(false)
+	term.SetMin(1)
+	term.SetTime(0)
+
+	if err := term.ApplyToFd(fd); err != nil {
+		return fmt.Errorf("can't set up terminal attribute: %s", err)
+	}
+	t.saved = saved
+
+	// Set autowrap off, and bracketed paste on
+	t.file.WriteString("\033[?7l\033[?2004h")
+
+	if err := FlushInput(fd); err != nil {
+		return fmt.Errorf("can't flush input: %s", err)
+	}
+	return nil
+}
+
+func (t *fileTerminal) Restore() error {
+	// Set autowrap on, and bracketed paste off
+	t.file.WriteString("\033[?7h\033[?2004l")
+	if t.saved == nil {
+		return nil
+	}
+	err := t.saved.ApplyToFd(int(t.file.Fd()))
+	t.saved = nil
+	if err != nil {
+		return fmt.Errorf("can't restore terminal attribute: %s", err)
+	}
+	return nil
+}
+
+func (t *fileTerminal) Size() (rows, cols int) {
+	ws := GetWinsize(int(t.file.Fd()))
+	return int(ws.Row), int(ws.Col)
+}
@@ -1,3 +1,5 @@
+// +build !windows
+
 // Package tty wraps tty ioctls.
 package tty
 
@@ -1,6 +1,8 @@
 // Created by cgo -godefs - DO NOT EDIT
 // cgo -godefs edit/tty/types.go
 
+// +build !windows
+
 package tty
 
 import (
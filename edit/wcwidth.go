@@ -1,8 +1,15 @@
 package edit
 
+// Widths of text on the terminal. Text is measured by grapheme clusters,
+// which are what the user perceives as characters: a base character with the
+// combining marks following it, a sequence of emoji joined by zero width
+// joiners, or a pair of regional indicators standing for a flag. The dot of
+// the editor is only ever moved to the boundaries between clusters.
+
 import (
 	"sort"
 	"strings"
+	"unicode/utf8"
 )
 
 // Taken from http://www.cl.cam.ac.uk/~mgk25/ucs/wcwidth.c (public domain)
@@ -84,6 +91,8 @@ func WcWidth(r rune) int {
 			(r >= 0xfe30 && r <= 0xfe6f) || /* CJK Compatibility Forms */
 			(r >= 0xff00 && r <= 0xff60) || /* Fullwidth Forms */
 			(r >= 0xffe0 && r <= 0xffe6) ||
+			(r >= 0x1f300 && r <= 0x1f64f) || /* Pictographs and emoticons */
+			(r >= 0x1f900 && r <= 0x1f9ff) || /* Supplemental pictographs */
 			(r >= 0x20000 && r <= 0x2fffd) ||
 			(r >= 0x30000 && r <= 0x3fffd)) {
 		return 2
@@ -91,34 +100,88 @@ func WcWidth(r rune) int {
 	return 1
 }
 
+// zwj is the zero width joiner, which joins the characters around it into one
+// grapheme cluster.
+const zwj = '\u200d'
+
+func isRegionalIndicator(r rune) bool {
+	return 0x1f1e6 <= r && r <= 0x1f1ff
+}
+
+// nextGrapheme returns the length in bytes and the width of the grapheme
+// cluster at the start of s. Characters joined to the previous one with a zero
+// width joiner don't add to the width.
+func nextGrapheme(s string) (n, width int) {
+	prev, n := utf8.DecodeRuneInString(s)
+	width = WcWidth(prev)
+	flag := isRegionalIndicator(prev)
+	for n < len(s) {
+		r, size := utf8.DecodeRuneInString(s[n:])
+		switch {
+		case prev == zwj:
+		case flag && isRegionalIndicator(r):
+			flag = false
+			width += WcWidth(r)
+		case r != 0 && WcWidth(r) == 0:
+		default:
+			return n, width
+		}
+		n += size
+		prev = r
+	}
+	return n, width
+}
+
+// graphemeLen returns the length in bytes of the grapheme cluster at the start
+// of s.
+func graphemeLen(s string) int {
+	n, _ := nextGrapheme(s)
+	return n
+}
+
+// lastGraphemeLen returns the length in bytes of the grapheme cluster at the
+// end of s.
+func lastGraphemeLen(s string) int {
+	last := 0
+	for i := 0; i < len(s); {
+		last, _ = nextGrapheme(s[i:])
+		i += last
+	}
+	return last
+}
+
 func WcWidths(s string) (w int) {
-	for _, r := range s {
-		w += WcWidth(r)
+	for s != "" {
+		n, w0 := nextGrapheme(s)
+		w += w0
+		s = s[n:]
 	}
 	return
 }
 
 func TrimWcWidth(s string, wmax int) string {
 	w := 0
-	for i, r := range s {
-		w += WcWidth(r)
+	for i := 0; i < len(s); {
+		n, w0 := nextGrapheme(s[i:])
+		w += w0
 		if w > wmax {
 			return s[:i]
 		}
+		i += n
 	}
 	return s
 }
 
 func ForceWcWidth(s string, width int) string {
 	w := 0
-	for i, r := range s {
-		w0 := WcWidth(r)
-		w += w0
-		if w > width {
-			w -= w0
+	for i := 0; i < len(s); {
+		n, w0 := nextGrapheme(s[i:])
+		if w+w0 > width {
 			s = s[:i]
 			break
 		}
+		w += w0
+		i += n
 	}
 	return s + strings.Repeat(" ", width-w)
 }
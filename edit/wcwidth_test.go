@@ -23,3 +23,44 @@ func TestWcwidth(t *testing.T) {
 		}
 	}
 }
+
+var graphemeTests = []struct {
+	in      string
+	n, last int // Lengths of the first and last grapheme clusters
+	width   int
+}{
+	{"ab", 1, 1, 2},
+	{"e\u0301x", 3, 1, 2},
+	{"xe\u0301", 1, 3, 2},
+	{"好a", 3, 1, 3},
+	{"\U0001F468\u200d\U0001F469!", 11, 1, 3},
+	{"\U0001F1EF\U0001F1F5\U0001F1EF", 8, 4, 3},
+}
+
+func TestGraphemes(t *testing.T) {
+	for _, tt := range graphemeTests {
+		if n := graphemeLen(tt.in); n != tt.n {
+			t.Errorf("graphemeLen(%q) => %d, want %d", tt.in, n, tt.n)
+		}
+		if last := lastGraphemeLen(tt.in); last != tt.last {
+			t.Errorf("lastGraphemeLen(%q) => %d, want %d", tt.in, last, tt.last)
+		}
+		if w := WcWidths(tt.in); w != tt.width {
+			t.Errorf("WcWidths(%q) => %d, want %d", tt.in, w, tt.width)
+		}
+	}
+}
+
+func TestTrimWcWidth(t *testing.T) {
+	if s := TrimWcWidth("ae\u0301好", 2); s != "ae\u0301" {
+		t.Errorf("TrimWcWidth cuts to %q", s)
+	}
+	if s := ForceWcWidth("好好", 3); s != "好 " {
+		t.Errorf("ForceWcWidth gives %q", s)
+	}
+	b := newBuffer(10)
+	b.writes("e\u0301\U0001F468\u200d\U0001F469", "")
+	if b.col != 3 {
+		t.Errorf("buffer is at column %d after a cluster of width 1 and one of width 2, want 3", b.col)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"unicode/utf8"
 
 	"github.com/xiaq/elvish/edit/tty"
+	"github.com/xiaq/elvish/eval"
 	"github.com/xiaq/elvish/util"
 )
 
@@ -121,14 +122,23 @@ func (b *buffer) write(r rune, attr string) {
 	if r == '\n' {
 		b.newline()
 		return
-	} else if !unicode.IsPrint(r) {
+	} else if !unicode.IsPrint(r) && r != zwj {
 		// BUG(xiaq): buffer.write drops unprintable runes silently
 		return
 	}
 	wd := WcWidth(r)
+	if last := b.lastCell(); last != nil && last.rune == zwj {
+		// Joined to the previous character.
+		wd = 0
+	}
 	c := cell{r, byte(wd), attr}
 
-	if b.col+wd > b.width {
+	if wd == 0 && len(b.cells) > 1 && len(b.cells[len(b.cells)-1]) == 0 {
+		// Keep a combining character with its base when the line has just
+		// been broken after the base.
+		n := len(b.cells) - 2
+		b.cells[n] = append(b.cells[n], c)
+	} else if b.col+wd > b.width {
 		b.newline()
 		b.appendCell(c)
 	} else {
@@ -139,12 +149,74 @@ func (b *buffer) write(r rune, attr string) {
 	}
 }
 
+// lastCell returns the cell written last, or nil if there is none.
+func (b *buffer) lastCell() *cell {
+	for i := len(b.cells) - 1; i >= 0; i-- {
+		if n := len(b.cells[i]); n > 0 {
+			return &b.cells[i][n-1]
+		}
+	}
+	return nil
+}
+
 func (b *buffer) writes(s string, attr string) {
 	for _, r := range s {
 		b.write(r, attr)
 	}
 }
 
+// writeStyled is like writes, but interprets SGR escape sequences in s, like
+// "\033[31m", which change the attribute of the following text. A sequence
+// without parameters, or with only a 0, restores attr.
+func (b *buffer) writeStyled(s string, attr string) {
+	cur := attr
+	for s != "" {
+		if params, n := parseSGR(s); n > 0 {
+			if params == "" || params == "0" {
+				cur = attr
+			} else {
+				cur = params
+			}
+			s = s[n:]
+			continue
+		}
+		r, n := utf8.DecodeRuneInString(s)
+		b.write(r, cur)
+		s = s[n:]
+	}
+}
+
+// parseSGR parses an SGR escape sequence at the start of s, returning its
+// parameters and length. The length is 0 if s does not start with one.
+func parseSGR(s string) (params string, n int) {
+	if !strings.HasPrefix(s, "\033[") {
+		return "", 0
+	}
+	for i := 2; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == 'm':
+			return s[2:i], i + 1
+		case c != ';' && (c < '0' || c > '9'):
+			return "", 0
+		}
+	}
+	return "", 0
+}
+
+// stripSGR removes all SGR escape sequences from s.
+func stripSGR(s string) string {
+	var buf bytes.Buffer
+	for s != "" {
+		if _, n := parseSGR(s); n > 0 {
+			s = s[n:]
+			continue
+		}
+		buf.WriteByte(s[0])
+		s = s[1:]
+	}
+	return buf.String()
+}
+
 func (b *buffer) writePadding(w int, attr string) {
 	b.writes(strings.Repeat(" ", w), attr)
 }
@@ -172,11 +244,12 @@ func (b *buffer) trimToLines(low, high int) {
 // updating the screen.
 type writer struct {
 	file   *os.File
+	term   tty.Terminal
 	oldBuf *buffer
 }
 
-func newWriter(f *os.File) *writer {
-	writer := &writer{file: f, oldBuf: newBuffer(0)}
+func newWriter(f *os.File, term tty.Terminal) *writer {
+	writer := &writer{file: f, term: term, oldBuf: newBuffer(0)}
 	return writer
 }
 
@@ -269,6 +342,22 @@ func (w *writer) commitBuffer(buf *buffer) error {
 	return nil
 }
 
+// writeAbove erases what the editor has drawn and writes text in its place.
+// The editor is drawn in full below the text on the next refresh.
+func (w *writer) writeAbove(text string) error {
+	bytesBuf := new(bytes.Buffer)
+	if pLine := w.oldBuf.dot.line; pLine > 0 {
+		fmt.Fprintf(bytesBuf, "\033[%dA", pLine)
+	}
+	bytesBuf.WriteString("\r\033[J")
+	text = strings.TrimSuffix(text, "\n")
+	bytesBuf.WriteString(strings.Replace(text, "\n", "\r\n", -1) + "\r\n")
+
+	_, err := w.file.Write(bytesBuf.Bytes())
+	w.oldBuf = &buffer{width: w.oldBuf.width}
+	return err
+}
+
 func lines(bufs ...*buffer) (l int) {
 	for _, buf := range bufs {
 		if buf != nil {
@@ -300,12 +389,29 @@ func findWindow(height, selected, max int) (low, high int) {
 	}
 }
 
+// findPage is like findWindow, but the window moves a page at a time. A
+// negative selected means the first page.
+func findPage(height, selected, max int) (low, high int) {
+	if max <= 0 {
+		return 0, 0
+	}
+	if selected < 0 {
+		selected = 0
+	}
+	low = selected / max * max
+	high = low + max
+	if high > height {
+		high = height
+	}
+	return
+}
+
 func trimToWindow(s []string, selected, max int) ([]string, int) {
 	low, high := findWindow(len(s), selected, max)
 	return s[low:high], low
 }
 
-func renderNavColumn(nc *navColumn, w, h int) *buffer {
+func renderNavColumn(nc *navColumn, w, h int, st styles) *buffer {
 	b := newBuffer(w)
 	low, high := findWindow(len(nc.names), nc.selected, h)
 	for i := low; i < high; i++ {
@@ -315,7 +421,7 @@ func renderNavColumn(nc *navColumn, w, h int) *buffer {
 		text := nc.names[i]
 		attr := nc.attrs[i]
 		if i == nc.selected {
-			attr += attrForSelectedFile
+			attr = joinStyles(attr, st.of("file-selected"))
 		}
 		if w >= navigationListingMinWidthForPadding {
 			padding := navigationListingColPadding
@@ -329,11 +435,21 @@ func renderNavColumn(nc *navColumn, w, h int) *buffer {
 	return b
 }
 
+// inError determines whether the byte at i is part of the code an error is
+// about. Warnings, which are about code not written yet, are not shown.
+func inError(diags []eval.Diagnostic, i int) bool {
+	for _, d := range diags {
+		if d.Severity == eval.SeverityError && d.Begin <= i && i < d.End {
+			return true
+		}
+	}
+	return false
+}
+
 // refresh redraws the line editor. The dot is passed as an index into text;
 // the corresponding position will be calculated.
-func (w *writer) refresh(bs *editorState, histories []string) error {
-	winsize := tty.GetWinsize(int(w.file.Fd()))
-	width, height := int(winsize.Col), int(winsize.Row)
+func (w *writer) refresh(bs *editorState, histories []string, st styles) error {
+	height, width := w.term.Size()
 
 	var bufLine, bufMode, bufTips, bufListing, buf *buffer
 	// bufLine
@@ -342,7 +458,7 @@ func (w *writer) refresh(bs *editorState, histories []string) error {
 
 	b.newlineWhenFull = true
 
-	b.writes(bs.prompt, attrForPrompt)
+	b.writeStyled(bs.prompt, st.of("prompt"))
 
 	if b.line() == 0 && b.col*2 < b.width {
 		b.indent = b.col
@@ -357,13 +473,25 @@ func (w *writer) refresh(bs *editorState, histories []string) error {
 	comp := bs.completion
 	var suppress = false
 
+	tokens := bs.tokens
+	hs := bs.historySearch
+	searching := bs.mode == modeHistorySearch && hs.current != -1
+	if searching {
+		// The matching history entry is shown instead of the line.
+		tokens = nil
+	}
+
 tokens:
-	for _, token := range bs.tokens {
+	for _, token := range tokens {
 		for _, r := range token.Val {
 			if suppress && i < comp.end {
 				// Silence the part that is being completed
 			} else {
-				b.write(r, attrForType[token.Typ])
+				attr := st.ofType(token.Typ)
+				if inError(bs.diagnostics, i) {
+					attr = joinStyles(attr, st.of("error"))
+				}
+				b.write(r, attr)
 			}
 			i += utf8.RuneLen(r)
 			if comp != nil && comp.current != -1 && i == comp.start {
@@ -371,9 +499,9 @@ tokens:
 				// to be suppressed. The cursor should be placed correctly
 				// (i.e. right after the candidate)
 				for _, part := range comp.candidates[comp.current].parts {
-					attr := attrForType[comp.typ]
+					attr := st.ofType(comp.typ)
 					if part.completed {
-						attr += attrForCompleted
+						attr = joinStyles(attr, st.of("completed"))
 					}
 					b.writes(part.text, attr)
 				}
@@ -388,20 +516,36 @@ tokens:
 		}
 	}
 
+	if searching {
+		// Put the matching history entry with the match highlighted, and
+		// position the cursor after the match
+		entry := histories[hs.current]
+		b.writes(entry[:hs.match], "")
+		b.writes(entry[hs.match:hs.matchEnd], st.of("history-search-match"))
+		b.dot = b.cursor()
+		b.writes(entry[hs.matchEnd:], "")
+	}
+
+	if bs.suggestion != "" {
+		// Put the suggestion after the cursor, which stays at the end of the
+		// line
+		b.writes(bs.suggestion, st.of("suggestion"))
+	}
+
 	if bs.mode == modeHistory {
 		// Put the rest of current history, position the cursor at the
 		// end of the line, and finish writing
 		h := bs.history
-		b.writes(histories[h.current][len(h.prefix):], attrForCompletedHistory)
+		b.writes(histories[h.current][len(h.prefix):], st.of("history-completed"))
 		b.dot = b.cursor()
 	}
 
 	// Write rprompt
-	padding := b.width - b.col - WcWidths(bs.rprompt)
+	padding := b.width - b.col - WcWidths(stripSGR(bs.rprompt))
 	if padding >= 1 {
 		b.newlineWhenFull = false
 		b.writePadding(padding, "")
-		b.writes(bs.rprompt, attrForRprompt)
+		b.writeStyled(bs.rprompt, st.of("rprompt"))
 	}
 
 	// bufMode
@@ -414,12 +558,28 @@ tokens:
 			text = "Command"
 		case modeCompletion:
 			text = fmt.Sprintf("Completing %s", bs.line[comp.start:comp.end])
+			if comp.current != -1 {
+				text += fmt.Sprintf(" (%d/%d)", comp.current+1, len(comp.candidates))
+			}
 		case modeNavigation:
 			text = "Navigating"
 		case modeHistory:
 			text = fmt.Sprintf("History #%d", bs.history.current)
+		case modeHistorySearch:
+			text = fmt.Sprintf("History search: %s", hs.query)
+			if hs.failing {
+				text += " (no match)"
+			}
+		case modeLocation:
+			text = fmt.Sprintf("Location: %s", bs.location.query)
+			if len(bs.location.candidates) == 0 {
+				text += " (no match)"
+			}
+		case modeHistoryArg:
+			ha := bs.historyArg
+			text = fmt.Sprintf("History #%d, argument %d/%d", ha.history, ha.current+1, len(ha.args))
 		}
-		b.writes(TrimWcWidth(text, width), attrForMode)
+		b.writes(TrimWcWidth(text, width), st.of("mode"))
 	}
 
 	// bufTips
@@ -427,7 +587,7 @@ tokens:
 	if len(bs.tips) > 0 {
 		b := newBuffer(width)
 		bufTips = b
-		b.writes(TrimWcWidth(strings.Join(bs.tips, ", "), width), attrForTip)
+		b.writes(TrimWcWidth(strings.Join(bs.tips, ", "), width), st.of("tip"))
 	}
 
 	hListing := 0
@@ -449,7 +609,9 @@ tokens:
 
 	// Render bufListing under the maximum height constraint
 	nav := bs.navigation
-	if hListing > 0 && comp != nil || nav != nil {
+	loc := bs.location
+	ha := bs.historyArg
+	if hListing > 0 && (comp != nil || loc != nil || ha != nil) || nav != nil {
 		b := newBuffer(width)
 		bufListing = b
 		// Completion listing
@@ -474,8 +636,9 @@ tokens:
 			lines := util.CeilDiv(len(cands), cols)
 			bs.completionLines = lines
 
-			// Determine the window to show.
-			low, high := findWindow(lines, comp.current%lines, hListing)
+			// Determine the page to show.
+			low, high := findPage(lines, comp.current%lines, hListing)
+			bs.completionPageLines = high - low
 			for i := low; i < high; i++ {
 				if i > low {
 					b.newline()
@@ -487,15 +650,57 @@ tokens:
 					}
 					attr := cands[k].attr
 					if k == comp.current {
-						attr += attrForCurrentCompletion
+						attr = joinStyles(attr, st.of("completion-selected"))
+					}
+					// Write the parts matching the pattern highlighted
+					w := 0
+					for _, part := range cands[k].parts {
+						text := TrimWcWidth(part.text, colWidth-w)
+						if part.completed {
+							b.writes(text, attr)
+						} else {
+							b.writes(text, joinStyles(attr, st.of("completion-match")))
+						}
+						w += WcWidths(text)
 					}
-					text := cands[k].text
-					b.writes(ForceWcWidth(text, colWidth), attr)
+					b.writePadding(colWidth-w, attr)
 					b.writePadding(margin, "")
 				}
 			}
 		}
 
+		// Location listing
+		if loc != nil {
+			low, high := findWindow(len(loc.candidates), loc.current, hListing)
+			for i := low; i < high; i++ {
+				if i > low {
+					b.newline()
+				}
+				attr := ""
+				if i == loc.current {
+					attr = st.of("location-selected")
+				}
+				b.writes(ForceWcWidth(loc.candidates[i], width), attr)
+			}
+		}
+
+		// History argument listing, the words of the command on one line
+		if ha != nil {
+			for i, arg := range ha.args {
+				if i > 0 {
+					b.writePadding(1, "")
+				}
+				attr := ""
+				if i == ha.current {
+					attr = st.of("history-arg-selected")
+				}
+				b.writes(arg, attr)
+			}
+			if len(b.cells) > hListing {
+				b.trimToLines(0, hListing)
+			}
+		}
+
 		// Navigation listing
 		if nav != nil {
 			margin := navigationListingColMargin
@@ -516,14 +721,14 @@ tokens:
 			wCurrent := w * ratioCurrent / 100
 			wPreview := w * ratioPreview / 100
 
-			b := renderNavColumn(nav.parent, wParent, hListing)
+			b := renderNavColumn(nav.parent, wParent, hListing, st)
 			bufListing = b
 
-			bCurrent := renderNavColumn(nav.current, wCurrent, hListing)
+			bCurrent := renderNavColumn(nav.current, wCurrent, hListing, st)
 			b.extendHorizontal(bCurrent, wParent, margin)
 
 			if wPreview > 0 {
-				bPreview := renderNavColumn(nav.dirPreview, wPreview, hListing)
+				bPreview := renderNavColumn(nav.dirPreview, wPreview, hListing, st)
 				b.extendHorizontal(bPreview, wParent+wCurrent+margin, margin)
 			}
 		}
@@ -28,8 +28,17 @@ func main() {
 		log.Fatalln("get socket name:", err)
 	}
 
-	// Listen to socket
+	// Listen to socket. A socket left behind by an elvishd that has died is
+	// removed; if another elvishd is alive, there is nothing to do.
 	listener, err := net.Listen("unix", laddr)
+	if err != nil {
+		if c, e := net.Dial("unix", laddr); e == nil {
+			c.Close()
+			log.Fatalln("another elvishd is running")
+		}
+		os.Remove(laddr)
+		listener, err = net.Listen("unix", laddr)
+	}
 	if err != nil {
 		log.Fatalln("listen to socket:", err)
 	}
@@ -0,0 +1,26 @@
+package eval
+
+// Abbreviations of the line editor.
+
+// Abbreviations returns the abbreviations the line editor expands, which are
+// the string entries of the dict part of the global $abbr. Unlike an alias, an
+// abbreviation is replaced in the line being edited as soon as it is typed,
+// so that what is run can be seen and changed; e.g. after abbr[gco] = `git
+// checkout`, typing gco and a space gives `git checkout `.
+func (ev *Evaluator) Abbreviations() map[string]string {
+	abbrs := make(map[string]string)
+	v, ok := ev.scope.lookup("abbr")
+	if !ok {
+		return abbrs
+	}
+	t, ok := v.Get().(*Table)
+	if !ok {
+		return abbrs
+	}
+	for k, v := range t.Dict {
+		if v, ok := v.(*String); ok {
+			abbrs[k.String()] = string(*v)
+		}
+	}
+	return abbrs
+}
@@ -0,0 +1,168 @@
+package eval
+
+// Aliases of commands, e.g.
+//
+// alias ll ls -l
+//
+// An alias is expanded when a form using it as its command is compiled: the
+// command is replaced with the words of the alias, and the arguments of the
+// form follow them. Like default redirections, aliases only apply to code
+// compiled after they are defined, so not to the rest of the chunk defining
+// them.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/xiaq/elvish/parse"
+)
+
+// SetAlias makes name an alias of words, which start with a command and may
+// go on with arguments. Empty words remove the alias. The change takes effect
+// from the next compilation.
+//
+// The alias may start with the command it is the alias of, as in `alias ls ls
+// -F`, which is then not expanded again. Other cycles of aliases are errors.
+func (cp *Compiler) SetAlias(name string, words []string) error {
+	if len(words) == 0 {
+		cp.cache = nil
+		delete(cp.aliases, name)
+		return nil
+	}
+	if name == "" || isPath(name) {
+		return fmt.Errorf("bad alias name %s", quote(name))
+	}
+	chain := []string{name}
+	for head := words[0]; head != chain[len(chain)-1]; {
+		for _, seen := range chain {
+			if head == seen {
+				return fmt.Errorf("alias would expand recursively: %s -> %s",
+					strings.Join(chain, " -> "), head)
+			}
+		}
+		next, ok := cp.aliases[head]
+		if !ok {
+			break
+		}
+		chain = append(chain, head)
+		head = next[0]
+	}
+
+	if cp.aliases == nil {
+		cp.aliases = make(map[string][]string)
+	}
+	cp.cache = nil
+	cp.aliases[name] = append([]string(nil), words...)
+	return nil
+}
+
+// Aliases returns the aliases defined, mapping their names to their words.
+func (cp *Compiler) Aliases() map[string][]string {
+	aliases := make(map[string][]string, len(cp.aliases))
+	for name, words := range cp.aliases {
+		aliases[name] = append([]string(nil), words...)
+	}
+	return aliases
+}
+
+// ExpandAlias returns the words a command expands to, after expanding the
+// aliases they start with in turn, or nil if it is not an alias. Completers
+// can use it to complete the arguments of an alias like those of its target.
+func (cp *Compiler) ExpandAlias(name string) []string {
+	words := []string{name}
+	seen := make(map[string]bool)
+	for {
+		head := words[0]
+		alias, ok := cp.aliases[head]
+		if !ok || seen[head] {
+			break
+		}
+		seen[head] = true
+		words = append(append([]string(nil), alias...), words[1:]...)
+	}
+	if len(seen) == 0 {
+		return nil
+	}
+	return words
+}
+
+// expandAliasForm returns fn with its command replaced by the words of the
+// alias it is, or fn itself if it is not an alias. The words are given the
+// position of the command, so that errors are reported where the alias is
+// used.
+func (cp *Compiler) expandAliasForm(fn *parse.FormNode) *parse.FormNode {
+	if len(cp.aliases) == 0 || len(fn.Command.Nodes) != 1 || fn.Command.Nodes[0].Typ != parse.StringFactor {
+		return fn
+	}
+	words := cp.ExpandAlias(fn.Command.Nodes[0].Node.(*parse.StringNode).Text)
+	if words == nil {
+		return fn
+	}
+	pos, end := fn.Command.Pos, fn.Command.Nodes[0].End
+	term := func(word string) *parse.TermNode {
+		sn := &parse.StringNode{Pos: pos, Quoted: quote(word), Text: word}
+		f := &parse.FactorNode{Pos: pos, Typ: parse.StringFactor, Node: sn, End: end}
+		return &parse.TermNode{Pos: pos, Nodes: []*parse.FactorNode{f}}
+	}
+	args := make([]*parse.TermNode, 0, len(words)-1+len(fn.Args.Nodes))
+	for _, word := range words[1:] {
+		args = append(args, term(word))
+	}
+	args = append(args, fn.Args.Nodes...)
+
+	expanded := *fn
+	expanded.Command = term(words[0])
+	expanded.Args = &parse.TermListNode{Pos: fn.Args.Pos, Nodes: args}
+	return &expanded
+}
+
+// aliasFn implements the alias builtin, which defines an alias, or lists the
+// aliases defined when called without arguments, e.g.
+//
+// alias ll ls -l
+// alias
+//
+// Each alias is listed as the command defining it.
+func aliasFn(ev *Evaluator, args []Value) string {
+	if len(args) == 1 {
+		return "args error"
+	}
+	if len(args) == 0 {
+		aliases := ev.Compiler.Aliases()
+		names := make([]string, 0, len(aliases))
+		for name := range aliases {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		out := ev.ports[1].f
+		for _, name := range names {
+			words := []string{"alias", quote(name)}
+			for _, w := range aliases[name] {
+				words = append(words, quote(w))
+			}
+			fmt.Fprintln(out, strings.Join(words, " "))
+		}
+		return ""
+	}
+	words := make([]string, len(args)-1)
+	for i, a := range args[1:] {
+		words[i] = a.String()
+	}
+	if err := ev.Compiler.SetAlias(args[0].String(), words); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// unaliasFn implements the unalias builtin, which removes aliases.
+func unaliasFn(ev *Evaluator, args []Value) string {
+	for _, a := range args {
+		name := a.String()
+		if _, ok := ev.Compiler.aliases[name]; !ok {
+			return fmt.Sprintf("no alias %s", quote(name))
+		}
+		ev.Compiler.SetAlias(name, nil)
+	}
+	return ""
+}
@@ -16,4 +16,5 @@ type formAnnotation struct {
 	builtinFunc    *builtinFunc
 	builtinSpecial *builtinSpecial
 	specialOp      strOp
+	xtrace         bool
 }
@@ -0,0 +1,104 @@
+package eval
+
+// Versions of the config API, i.e. the options, variables and hooks that rc
+// files use. A file can declare the version it was written for, e.g.
+//
+// shell:api-version 1
+//
+// after which, in the rest of the file, options and variables renamed in later
+// versions can still be used by their old names, and the hooks defined are
+// called the way that version called them. Code that declares no version
+// targets the current one, which is $buildinfo[api-version].
+
+import (
+	"strconv"
+
+	"github.com/xiaq/elvish/parse"
+)
+
+// currentAPIVersion is the version of the config API. It is bumped whenever an
+// option, a variable or the arguments of a hook change incompatibly, and the
+// change is then recorded below, so that rc files written for older versions
+// keep working.
+var currentAPIVersion = 1
+
+// apiRename records that an option or a variable was renamed in API version
+// since.
+type apiRename struct {
+	newName string
+	since   int
+}
+
+// optionRenames and varRenames map the old names of renamed options and
+// variables.
+var (
+	optionRenames = map[string]apiRename{}
+	varRenames    = map[string]apiRename{}
+)
+
+// hookShim turns the arguments a hook is called with in API version since into
+// the arguments of the version before.
+type hookShim struct {
+	since int
+	adapt func([]Value) []Value
+}
+
+// hookShims maps the names of hook variables, like exec-hook, to their shims,
+// oldest first. All hooks are called with the arguments from hookArgs, so
+// that a shim can be added for any of them.
+var hookShims = map[string][]hookShim{}
+
+// apiVersion returns the API version targeted by the code being compiled.
+func (cp *Compiler) apiVersion() int {
+	if cp.declaredAPIVersion == 0 {
+		return currentAPIVersion
+	}
+	return cp.declaredAPIVersion
+}
+
+// currentName returns the current name of an option or a variable, which may
+// be used by an old name in the code being compiled.
+func (cp *Compiler) currentName(renames map[string]apiRename, name string) string {
+	if r, ok := renames[name]; ok && cp.apiVersion() < r.since {
+		return r.newName
+	}
+	return name
+}
+
+// hookArgs adapts the arguments of a hook to the API version the closure
+// assigned to it was compiled for.
+func hookArgs(hook string, c *Closure, args []Value) []Value {
+	version := c.apiVersion
+	if version == 0 {
+		// Not compiled from elvish code.
+		version = currentAPIVersion
+	}
+	shims := hookShims[hook]
+	for i := len(shims) - 1; i >= 0; i-- {
+		if version < shims[i].since {
+			args = shims[i].adapt(args)
+		}
+	}
+	return args
+}
+
+// compileAPIVersion compiles a shell:api-version special form. Like
+// set-option, it takes effect when compiled; unlike it, the declaration lasts
+// until the end of the file or the chunk of interactive input.
+func compileAPIVersion(cp *Compiler, fn *parse.FormNode) strOp {
+	args := fn.Args.Nodes
+	if len(args) != 1 {
+		cp.errorf(fn, "shell:api-version form must be `shell:api-version version`")
+	}
+	version, err := strconv.Atoi(keyword(args[0]))
+	if err != nil || version < 1 {
+		cp.errorf(args[0], "bad API version")
+	}
+	if version > currentAPIVersion {
+		cp.errorf(args[0], "API version %d is newer than that of this elvish, %d", version, currentAPIVersion)
+	}
+	cp.declaredAPIVersion = version
+	return func(ev *Evaluator) string {
+		return ""
+	}
+}
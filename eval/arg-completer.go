@@ -0,0 +1,47 @@
+package eval
+
+// Completers of the arguments of commands, defined in elvish. They are the
+// closure entries of the dict part of the global $arg-completer, keyed by the
+// name of the command, e.g.
+//
+// arg-completer[make] = {|@words| put build test clean }
+//
+// A completer is called with the words of the command being completed, from
+// its name to the word being completed, which may be empty. It outputs
+// candidates for the last word, of which the editor offers those the word is a
+// prefix of.
+
+import "fmt"
+
+// ArgCompleter returns a function calling the completer in $arg-completer of
+// the arguments of the command name, if there is one.
+func (ev *Evaluator) ArgCompleter(name string) (func(words []string) ([]string, error), bool) {
+	v, ok := ev.scope.lookup("arg-completer")
+	if !ok {
+		return nil, false
+	}
+	t, ok := v.Get().(*Table)
+	if !ok {
+		return nil, false
+	}
+	e, _ := t.lookup(name)
+	c, ok := e.(*Closure)
+	if !ok || c.Op == nil {
+		return nil, false
+	}
+	return func(words []string) ([]string, error) {
+		args := make([]Value, len(words))
+		for i, w := range words {
+			args[i] = NewString(w)
+		}
+		values, msg := ev.captureClosure(c, hookArgs("arg-completer", c, args))
+		if msg != "" {
+			return nil, fmt.Errorf("completer of %s: %s", name, msg)
+		}
+		cands := make([]string, len(values))
+		for i, v := range values {
+			cands[i] = v.String()
+		}
+		return cands, nil
+	}, true
+}
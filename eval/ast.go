@@ -0,0 +1,531 @@
+package eval
+
+// Builtins to parse elvish code into tables, turn such tables back into code
+// and evaluate code, for macros, linters and code generators written in
+// elvish.
+//
+// Each node of a syntax tree is a table with the type of the node in &type
+// and its position, a byte offset in the code, in &pos. Factors also have the
+// position right after them in &end. The other fields depend on the type:
+//
+// chunk: &pipelines, a list of pipelines
+// pipeline: &forms, a list of forms
+// form: &command, a term; &args, a list of terms; &redirs, a list of
+// redirections; &status-redir, the name of the variable of a status
+// redirection, if there is one
+// term: &factors, a list of factors, joined together
+//
+// string: &text, the string; &source, how it is written in the code
+// variable, splice, option: &name
+// table: &list, a list of terms; &dict, a list of tables with &key and &value
+// terms
+// closure: &args, a list of terms; &chunk
+// list: &items, a list of terms
+// output-capture, status-capture, input-substitution, output-substitution:
+// &pipeline
+// interpolation, for a double-quoted string with $ in it: &factors
+//
+// filename-redir: &leader, how the redirection is written, like >>[2]; &fd;
+// &target, a term
+// fd-redir: &leader; &fd; &old-fd
+// close-redir: &leader; &fd
+// here-redir: &leader; &text, a term, for a here-string; &body, the source of
+// the body with the terminator line, for a here-document
+//
+// ast:unparse turns a tree back into code, ignoring the positions; &source of
+// strings and &leader of redirections may be left out, the latter for
+// filename-redir only, which is then written as >.
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/xiaq/elvish/parse"
+	"github.com/xiaq/elvish/util"
+)
+
+var factorTypeNames = map[parse.FactorType]string{
+	parse.StringFactor:             "string",
+	parse.VariableFactor:           "variable",
+	parse.SpliceFactor:             "splice",
+	parse.TableFactor:              "table",
+	parse.ClosureFactor:            "closure",
+	parse.ListFactor:               "list",
+	parse.OutputCaptureFactor:      "output-capture",
+	parse.StatusCaptureFactor:      "status-capture",
+	parse.InterpolationFactor:      "interpolation",
+	parse.InputSubstitutionFactor:  "input-substitution",
+	parse.OutputSubstitutionFactor: "output-substitution",
+	parse.OptionFactor:             "option",
+}
+
+func newASTNode(typ string, pos parse.Pos) *Table {
+	t := NewTable()
+	t.put(NewString("type"), NewString(typ))
+	t.put(NewString("pos"), NewString(strconv.Itoa(int(pos))))
+	return t
+}
+
+func putField(t *Table, name string, v Value) {
+	t.put(NewString(name), v)
+}
+
+func chunkValue(n *parse.ChunkNode) *Table {
+	t := newASTNode("chunk", n.Pos)
+	pipelines := NewTable()
+	for _, pn := range n.Nodes {
+		pipelines.append(pipelineValue(pn))
+	}
+	putField(t, "pipelines", pipelines)
+	return t
+}
+
+func pipelineValue(n *parse.PipelineNode) *Table {
+	t := newASTNode("pipeline", n.Pos)
+	forms := NewTable()
+	for _, fn := range n.Nodes {
+		forms.append(formValue(fn))
+	}
+	putField(t, "forms", forms)
+	return t
+}
+
+func formValue(n *parse.FormNode) *Table {
+	t := newASTNode("form", n.Pos)
+	putField(t, "command", termValue(n.Command))
+	putField(t, "args", termsValue(n.Args.Nodes))
+	redirs := NewTable()
+	for _, r := range n.Redirs {
+		redirs.append(redirValue(r))
+	}
+	putField(t, "redirs", redirs)
+	if n.StatusRedir != "" {
+		putField(t, "status-redir", NewString(n.StatusRedir))
+	}
+	return t
+}
+
+func termsValue(tns []*parse.TermNode) *Table {
+	terms := NewTable()
+	for _, tn := range tns {
+		terms.append(termValue(tn))
+	}
+	return terms
+}
+
+func termValue(n *parse.TermNode) *Table {
+	t := newASTNode("term", n.Pos)
+	putField(t, "factors", factorsValue(n.Nodes))
+	return t
+}
+
+func factorsValue(fns []*parse.FactorNode) *Table {
+	factors := NewTable()
+	for _, fn := range fns {
+		factors.append(factorValue(fn))
+	}
+	return factors
+}
+
+func factorValue(n *parse.FactorNode) *Table {
+	t := newASTNode(factorTypeNames[n.Typ], n.Pos)
+	putField(t, "end", NewString(strconv.Itoa(int(n.End))))
+	switch n.Typ {
+	case parse.StringFactor:
+		sn := n.Node.(*parse.StringNode)
+		putField(t, "text", NewString(sn.Text))
+		putField(t, "source", NewString(sn.Quoted))
+	case parse.VariableFactor, parse.SpliceFactor, parse.OptionFactor:
+		putField(t, "name", NewString(n.Node.(*parse.StringNode).Text))
+	case parse.TableFactor:
+		tn := n.Node.(*parse.TableNode)
+		putField(t, "list", termsValue(tn.List))
+		dict := NewTable()
+		for _, pair := range tn.Dict {
+			p := NewTable()
+			putField(p, "key", termValue(pair.Key))
+			putField(p, "value", termValue(pair.Value))
+			dict.append(p)
+		}
+		putField(t, "dict", dict)
+	case parse.ClosureFactor:
+		cn := n.Node.(*parse.ClosureNode)
+		var args []*parse.TermNode
+		if cn.ArgNames != nil {
+			args = cn.ArgNames.Nodes
+		}
+		putField(t, "args", termsValue(args))
+		putField(t, "chunk", chunkValue(cn.Chunk))
+	case parse.ListFactor:
+		putField(t, "items", termsValue(n.Node.(*parse.TermListNode).Nodes))
+	case parse.InterpolationFactor:
+		putField(t, "factors", factorsValue(n.Node.(*parse.TermNode).Nodes))
+	default:
+		putField(t, "pipeline", pipelineValue(n.Node.(*parse.PipelineNode)))
+	}
+	return t
+}
+
+func redirValue(r parse.Redir) *Table {
+	var t *Table
+	switch r := r.(type) {
+	case *parse.FilenameRedir:
+		t = newASTNode("filename-redir", r.Position())
+		putField(t, "target", termValue(r.Filename))
+	case *parse.FdRedir:
+		t = newASTNode("fd-redir", r.Position())
+		putField(t, "old-fd", NewString(strconv.Itoa(int(r.OldFd))))
+	case *parse.CloseRedir:
+		t = newASTNode("close-redir", r.Position())
+	case *parse.HereRedir:
+		t = newASTNode("here-redir", r.Position())
+		if r.Body != "" {
+			putField(t, "body", NewString(r.Body))
+		} else {
+			putField(t, "text", termValue(r.Text))
+		}
+	}
+	putField(t, "leader", NewString(r.Leader()))
+	putField(t, "fd", NewString(strconv.Itoa(int(r.Fd()))))
+	return t
+}
+
+// unparser turns syntax trees back into code. Errors are panicked and
+// recovered in unparse.
+type unparser struct {
+	buf bytes.Buffer
+	// Bodies of here-documents to write after the current line.
+	heredocs []string
+}
+
+func unparse(tree Value) (code string, err error) {
+	defer util.Recover(&err)
+	u := &unparser{}
+	t := u.node(tree, "chunk")
+	for i, pn := range u.list(t, "pipelines") {
+		if i > 0 {
+			u.newline()
+		}
+		u.pipeline(pn)
+	}
+	if u.buf.Len() > 0 {
+		u.newline()
+	}
+	return u.buf.String(), nil
+}
+
+func (u *unparser) errorf(format string, args ...interface{}) {
+	util.Panic(fmt.Errorf("bad syntax tree: "+format, args...))
+}
+
+func (u *unparser) newline() {
+	u.buf.WriteString("\n")
+	for _, body := range u.heredocs {
+		u.buf.WriteString(body)
+		if !strings.HasSuffix(body, "\n") {
+			u.buf.WriteString("\n")
+		}
+	}
+	u.heredocs = nil
+}
+
+// node checks that v is a node of one of the given types, and returns it.
+func (u *unparser) node(v Value, types ...string) *Table {
+	t, ok := v.(*Table)
+	if !ok {
+		u.errorf("node must be a table, got %s", v.Repr())
+	}
+	typ := u.str(t, "type")
+	for _, want := range types {
+		if typ == want {
+			return t
+		}
+	}
+	u.errorf("expect %s node, got %s", strings.Join(types, " or "), typ)
+	return nil
+}
+
+func (u *unparser) field(t *Table, name string) Value {
+	v, ok := t.lookup(name)
+	if !ok {
+		u.errorf("%s node has no &%s", u.str(t, "type"), name)
+	}
+	return v
+}
+
+func (u *unparser) str(t *Table, name string) string {
+	v, ok := t.lookup(name)
+	if !ok {
+		u.errorf("node has no &%s", name)
+	}
+	s, ok := v.(*String)
+	if !ok {
+		u.errorf("&%s must be a string, got %s", name, v.Repr())
+	}
+	return string(*s)
+}
+
+func (u *unparser) list(t *Table, name string) []Value {
+	v, ok := t.lookup(name)
+	if !ok {
+		return nil
+	}
+	l, ok := v.(*Table)
+	if !ok {
+		u.errorf("&%s must be a list, got %s", name, v.Repr())
+	}
+	return l.List
+}
+
+func (u *unparser) pipeline(v Value) {
+	t := u.node(v, "pipeline")
+	forms := u.list(t, "forms")
+	if len(forms) == 0 {
+		u.errorf("pipeline has no forms")
+	}
+	for i, fn := range forms {
+		if i > 0 {
+			u.buf.WriteString(" | ")
+		}
+		u.form(fn)
+	}
+}
+
+func (u *unparser) form(v Value) {
+	t := u.node(v, "form")
+	u.term(u.field(t, "command"))
+	for _, tn := range u.list(t, "args") {
+		u.buf.WriteString(" ")
+		u.term(tn)
+	}
+	for _, r := range u.list(t, "redirs") {
+		u.buf.WriteString(" ")
+		u.redir(r)
+	}
+	if _, ok := t.lookup("status-redir"); ok {
+		u.buf.WriteString(" ?>$" + u.str(t, "status-redir"))
+	}
+}
+
+func (u *unparser) redir(v Value) {
+	t := u.node(v, "filename-redir", "fd-redir", "close-redir", "here-redir")
+	if u.str(t, "type") == "filename-redir" {
+		if _, ok := t.lookup("leader"); !ok {
+			u.buf.WriteString(">")
+			u.term(u.field(t, "target"))
+			return
+		}
+	}
+	u.buf.WriteString(u.str(t, "leader"))
+	switch u.str(t, "type") {
+	case "filename-redir":
+		u.term(u.field(t, "target"))
+	case "here-redir":
+		if _, ok := t.lookup("body"); ok {
+			u.heredocs = append(u.heredocs, u.str(t, "body"))
+		} else {
+			u.term(u.field(t, "text"))
+		}
+	}
+}
+
+func (u *unparser) terms(vs []Value) {
+	for i, tn := range vs {
+		if i > 0 {
+			u.buf.WriteString(" ")
+		}
+		u.term(tn)
+	}
+}
+
+func (u *unparser) term(v Value) {
+	t := u.node(v, "term")
+	factors := u.list(t, "factors")
+	if len(factors) == 0 {
+		u.errorf("term has no factors")
+	}
+	for i, fn := range factors {
+		if i > 0 {
+			// A variable name would go on with the next factor, carets
+			// included, so the caret has to be after a space. The previous
+			// factor has been checked to be a table.
+			prev := factors[i-1].(*Table)
+			if typ := u.str(prev, "type"); typ == "variable" || typ == "splice" {
+				u.buf.WriteString(" ^")
+			}
+		}
+		u.factor(fn)
+	}
+}
+
+var captureOpeners = map[string]string{
+	"output-capture":      "(",
+	"status-capture":      "?(",
+	"input-substitution":  "<(",
+	"output-substitution": ">(",
+}
+
+func (u *unparser) factor(v Value) {
+	t, ok := v.(*Table)
+	if !ok {
+		u.errorf("node must be a table, got %s", v.Repr())
+	}
+	switch typ := u.str(t, "type"); typ {
+	case "string":
+		if _, ok := t.lookup("source"); ok {
+			u.buf.WriteString(u.str(t, "source"))
+		} else {
+			u.buf.WriteString(quote(u.str(t, "text")))
+		}
+	case "variable":
+		u.buf.WriteString("$" + u.str(t, "name"))
+	case "splice":
+		u.buf.WriteString("$@" + u.str(t, "name"))
+	case "option":
+		u.buf.WriteString("&" + u.str(t, "name"))
+	case "table":
+		u.buf.WriteString("[")
+		u.terms(u.list(t, "list"))
+		for i, p := range u.list(t, "dict") {
+			if i > 0 || len(u.list(t, "list")) > 0 {
+				u.buf.WriteString(" ")
+			}
+			pair, ok := p.(*Table)
+			if !ok {
+				u.errorf("pair must be a table, got %s", p.Repr())
+			}
+			u.buf.WriteString("&")
+			u.term(u.field(pair, "key"))
+			u.buf.WriteString(" ")
+			u.term(u.field(pair, "value"))
+		}
+		u.buf.WriteString("]")
+	case "closure":
+		u.buf.WriteString("{")
+		if args := u.list(t, "args"); len(args) > 0 {
+			u.buf.WriteString("|")
+			u.terms(args)
+			u.buf.WriteString("|")
+		}
+		for i, pn := range u.list(u.node(u.field(t, "chunk"), "chunk"), "pipelines") {
+			if i > 0 {
+				u.buf.WriteString(";")
+			}
+			u.buf.WriteString(" ")
+			u.pipeline(pn)
+		}
+		u.buf.WriteString(" }")
+	case "list":
+		u.buf.WriteString("{")
+		u.terms(u.list(t, "items"))
+		u.buf.WriteString("}")
+	case "output-capture", "status-capture", "input-substitution", "output-substitution":
+		u.buf.WriteString(captureOpeners[typ])
+		u.pipeline(u.field(t, "pipeline"))
+		u.buf.WriteString(")")
+	case "interpolation":
+		u.buf.WriteString(`"`)
+		for _, fn := range u.list(t, "factors") {
+			u.interpolated(fn)
+		}
+		u.buf.WriteString(`"`)
+	default:
+		u.errorf("expect factor node, got %s", typ)
+	}
+}
+
+// interpolated writes a factor of an interpolated string.
+func (u *unparser) interpolated(v Value) {
+	t := u.node(v, "string", "variable", "output-capture")
+	switch u.str(t, "type") {
+	case "string":
+		if _, ok := t.lookup("source"); ok {
+			u.buf.WriteString(u.str(t, "source"))
+		} else {
+			q := strconv.Quote(u.str(t, "text"))
+			u.buf.WriteString(strings.Replace(q[1:len(q)-1], "$", `\$`, -1))
+		}
+	case "variable":
+		u.buf.WriteString("${" + u.str(t, "name") + "}")
+	case "output-capture":
+		u.buf.WriteString("$(")
+		u.pipeline(u.field(t, "pipeline"))
+		u.buf.WriteString(")")
+	}
+}
+
+func init() {
+	// Needed to avoid initialization loop
+	builtinFuncs["ast:parse"] = builtinFunc{astParse, [2]StreamType{0, chanStream}}
+	builtinFuncs["ast:unparse"] = builtinFunc{astUnparse, [2]StreamType{0, chanStream}}
+	builtinFuncs["ast:eval"] = builtinFunc{astEval, [2]StreamType{}}
+}
+
+// astParse implements ast:parse, which parses code into a syntax tree, e.g.
+//
+// put (ast:parse 'echo $x')[pipelines][0][forms][0][args][0][factors][0][name]
+//
+// outputs x.
+func astParse(ev *Evaluator, args []Value) string {
+	if len(args) != 1 {
+		return "args error"
+	}
+	n, err := parse.Parse("<ast:parse>", args[0].String())
+	if err != nil {
+		return err.Error()
+	}
+	ev.ports[1].ch <- chunkValue(n)
+	return ""
+}
+
+// astUnparse implements ast:unparse, which turns a syntax tree back into code.
+func astUnparse(ev *Evaluator, args []Value) string {
+	if len(args) != 1 {
+		return "args error"
+	}
+	code, err := unparse(args[0])
+	if err != nil {
+		return err.Error()
+	}
+	ev.ports[1].ch <- NewString(code)
+	return ""
+}
+
+// astEval implements ast:eval, which evaluates code, or a syntax tree, in the
+// current scope, so that the variables it defines can be used by code
+// evaluated later. Options set by the code only last until its end.
+func astEval(ev *Evaluator, args []Value) string {
+	if len(args) != 1 {
+		return "args error"
+	}
+	code := args[0].String()
+	if _, ok := args[0].(*Table); ok {
+		var err error
+		code, err = unparse(args[0])
+		if err != nil {
+			return err.Error()
+		}
+	}
+	name := "<ast:eval>"
+	n, err := parse.Parse(name, code)
+	if err != nil {
+		return err.Error()
+	}
+	cp := *ev.Compiler
+	op, err := cp.Compile(name, code, n, ev.MakeCompilerScope())
+	if err != nil {
+		return err.Error()
+	}
+	newEv := ev.copy()
+	defer newEv.releasePorts()
+	// Like the body of a closure, the code may run in a form of a pipeline,
+	// so it leaves $status alone.
+	newEv.status = nil
+	newEv.statusCb = nil
+	if err := newEv.eval(name, code, op); err != nil {
+		return err.Error()
+	}
+	return ""
+}
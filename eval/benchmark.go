@@ -0,0 +1,158 @@
+package eval
+
+// The benchmark special form.
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/xiaq/elvish/parse"
+)
+
+// benchmarkMinTime is how long a closure is run for by default.
+const benchmarkMinTime = time.Second
+
+// benchmarkResult is the wall times of the runs of a closure.
+type benchmarkResult []time.Duration
+
+func (r benchmarkResult) mean() time.Duration {
+	var sum time.Duration
+	for _, d := range r {
+		sum += d
+	}
+	return sum / time.Duration(len(r))
+}
+
+func (r benchmarkResult) stddev() time.Duration {
+	mean := float64(r.mean())
+	var sum float64
+	for _, d := range r {
+		sum += (float64(d) - mean) * (float64(d) - mean)
+	}
+	return time.Duration(math.Sqrt(sum / float64(len(r))))
+}
+
+func (r benchmarkResult) minMax() (min, max time.Duration) {
+	min, max = r[0], r[0]
+	for _, d := range r[1:] {
+		if d < min {
+			min = d
+		}
+		if d > max {
+			max = d
+		}
+	}
+	return
+}
+
+// compileBenchmark compiles a benchmark special form, which calls closures
+// without arguments repeatedly and reports their wall times, as a table of
+// seconds for each closure, e.g.
+//
+// benchmark { ls > /dev/null } # [&runs 412 &mean 0.002427 &stddev ...]
+// benchmark -n 100 { put (range 1000) | count } { range 1000 | count }
+//
+// Each closure is run for at least a second, or the time given with
+// -min-time, and at least the number of times given with -n; with -n alone,
+// it is run exactly that many times. The report has the number of runs, and
+// the mean, standard deviation, minimum and maximum of the times. When there
+// are several closures, each report also has the mean relative to that of the
+// fastest closure.
+//
+// Like with time, the output of the closures is not touched, and the reports
+// are output as values if there is a channel to output to, and printed
+// otherwise. When a run of a closure fails, the form stops at once with its
+// exit value, which is that of the first failed form of its last pipeline.
+func compileBenchmark(cp *Compiler, fn *parse.FormNode) strOp {
+	args := fn.Args.Nodes
+	if len(args) == 0 {
+		cp.errorf(fn, "benchmark form must be `benchmark [-n runs] [-min-time duration] closure...`")
+	}
+	ops := make([]valuesOp, len(args))
+	for i, arg := range args {
+		ops[i] = cp.compileTerm(arg)
+	}
+	return func(ev *Evaluator) string {
+		runs, minTime, minTimeSet := 0, benchmarkMinTime, false
+		var closures []*Closure
+		for i := 0; i < len(args); i++ {
+			v := ev.asSingleValue(args[i], ops[i].f(ev), "argument of benchmark")
+			if c, ok := v.(*Closure); ok {
+				closures = append(closures, c)
+				continue
+			}
+			flag := v.String()
+			if len(closures) > 0 || (flag != "-n" && flag != "-min-time") {
+				ev.errorfNode(args[i], "benchmark argument must be a closure, got %s", v.Repr())
+			}
+			if i+1 == len(args) {
+				ev.errorfNode(args[i], "%s needs a value", flag)
+			}
+			i++
+			value := ev.asSingleValue(args[i], ops[i].f(ev), "argument of "+flag).String()
+			if flag == "-n" {
+				n, err := strconv.Atoi(value)
+				if err != nil || n <= 0 {
+					ev.errorfNode(args[i], "bad number of runs %q", value)
+				}
+				runs = n
+			} else {
+				d, err := parseDuration(value)
+				if err != nil {
+					ev.errorfNode(args[i], "%s", err)
+				}
+				minTime, minTimeSet = d, true
+			}
+		}
+		if runs > 0 && !minTimeSet {
+			minTime = 0
+		}
+		if len(closures) == 0 {
+			ev.errorfNode(fn, "benchmark needs a closure")
+		}
+
+		results := make([]benchmarkResult, len(closures))
+		for i, c := range closures {
+			start := time.Now()
+			for len(results[i]) < runs || time.Since(start) < minTime || len(results[i]) == 0 {
+				ev.checkCanceled()
+				runStart := time.Now()
+				if msg := failure(ev.callClosureStatus(c, nil)); msg != "" {
+					return msg
+				}
+				results[i] = append(results[i], time.Since(runStart))
+			}
+		}
+
+		fastest := results[0].mean()
+		for _, r := range results[1:] {
+			if mean := r.mean(); mean < fastest {
+				fastest = mean
+			}
+		}
+		for _, r := range results {
+			min, max := r.minMax()
+			report := NewTable()
+			report.put(NewString("runs"), NewString(strconv.Itoa(len(r))))
+			report.put(NewString("mean"), seconds(r.mean()))
+			report.put(NewString("stddev"), seconds(r.stddev()))
+			report.put(NewString("min"), seconds(min))
+			report.put(NewString("max"), seconds(max))
+			if len(results) > 1 {
+				relative := 1.0
+				if fastest > 0 {
+					relative = float64(r.mean()) / float64(fastest)
+				}
+				report.put(NewString("relative"), NewString(strconv.FormatFloat(relative, 'f', 2, 64)))
+			}
+			if out := ev.ports[1]; out != nil && out.ch != nil {
+				out.ch <- report
+			} else if out != nil && out.f != nil {
+				fmt.Fprintln(out.f, report.Repr())
+			}
+		}
+		return ""
+	}
+}
@@ -0,0 +1,48 @@
+package eval
+
+// Build information and feature detection.
+
+import (
+	"runtime"
+	"strconv"
+)
+
+// Build information, set with the -X flag of the linker, e.g.
+//
+// go build -ldflags "-X github.com/xiaq/elvish/eval.Version=0.1"
+//
+// The Makefile does this from git.
+var (
+	Version   = "unknown"
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+// buildInfo makes the value of $buildinfo, e.g.
+// [&version 0.1 &commit 1a2b3c &build-date 2015-01-01 &go-version go1.4
+// &api-version 1 &lang-version 1].
+func buildInfo() *Table {
+	t := NewTable()
+	t.put(NewString("version"), NewString(Version))
+	t.put(NewString("commit"), NewString(Commit))
+	t.put(NewString("build-date"), NewString(BuildDate))
+	t.put(NewString("go-version"), NewString(runtime.Version()))
+	t.put(NewString("api-version"), NewString(strconv.Itoa(currentAPIVersion)))
+	t.put(NewString("lang-version"), NewString(strconv.Itoa(currentLangVersion)))
+	return t
+}
+
+// SetFeature records whether an optional subsystem, like the line editor or
+// elvishd, is available, so that scripts can check $features[name].
+func (ev *Evaluator) SetFeature(name string, available bool) {
+	t, ok := ev.features.Get().(*Table)
+	if !ok {
+		t = NewTable()
+		ev.features.Set(t)
+	}
+	s := "false"
+	if available {
+		s = "true"
+	}
+	t.put(NewString(name), NewString(s))
+}
@@ -4,13 +4,22 @@ package eval
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
-	"os"
-	"os/user"
+	"io/ioutil"
+	"math"
+	"math/big"
 	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
 )
 
+// builtinFuncImpl is the implementation of a builtin function. It returns
+// the exit value of the builtin: "" on success, or an error message. Results
+// go to the output, never into the exit value; a predicate outputs true or
+// false and still succeeds.
 type builtinFuncImpl func(*Evaluator, []Value) string
 
 type builtinFunc struct {
@@ -19,17 +28,200 @@ type builtinFunc struct {
 }
 
 var builtinFuncs = map[string]builtinFunc{
-	"fn":        builtinFunc{fn, [2]StreamType{}},
-	"put":       builtinFunc{put, [2]StreamType{0, chanStream}},
-	"print":     builtinFunc{print, [2]StreamType{0, fdStream}},
-	"println":   builtinFunc{println, [2]StreamType{0, fdStream}},
-	"printchan": builtinFunc{printchan, [2]StreamType{chanStream, fdStream}},
-	"feedchan":  builtinFunc{feedchan, [2]StreamType{fdStream, chanStream}},
-	"cd":        builtinFunc{cd, [2]StreamType{}},
-	"+":         builtinFunc{plus, [2]StreamType{0, chanStream}},
-	"-":         builtinFunc{minus, [2]StreamType{0, chanStream}},
-	"*":         builtinFunc{times, [2]StreamType{0, chanStream}},
-	"/":         builtinFunc{divide, [2]StreamType{0, chanStream}},
+	"fn":            builtinFunc{fn, [2]StreamType{}},
+	"put":           builtinFunc{put, [2]StreamType{0, chanStream}},
+	"all":           builtinFunc{all, [2]StreamType{0, chanStream}},
+	"print":         builtinFunc{print, [2]StreamType{0, fdStream}},
+	"println":       builtinFunc{println, [2]StreamType{0, fdStream}},
+	"echo":          builtinFunc{echo, [2]StreamType{0, fdStream}},
+	"printf":        builtinFunc{printf, [2]StreamType{0, fdStream}},
+	"printchan":     builtinFunc{printchan, [2]StreamType{chanStream, fdStream}},
+	"feedchan":      builtinFunc{feedchan, [2]StreamType{fdStream, chanStream}},
+	"to-json":       builtinFunc{toJSON, [2]StreamType{chanStream, fdStream}},
+	"from-json":     builtinFunc{fromJSONFn, [2]StreamType{fdStream, chanStream}},
+	"read-line":     builtinFunc{readLine, [2]StreamType{fdStream, chanStream}},
+	"read-upto":     builtinFunc{readUptoFn, [2]StreamType{fdStream, chanStream}},
+	"slurp":         builtinFunc{slurp, [2]StreamType{fdStream, chanStream}},
+	"diff":          builtinFunc{diff, [2]StreamType{0, fdStream}},
+	"fopen":         builtinFunc{fopen, [2]StreamType{0, chanStream}},
+	"open":          builtinFunc{fopen, [2]StreamType{0, chanStream}},
+	"pipe":          builtinFunc{pipe, [2]StreamType{0, chanStream}},
+	"net:dial":      builtinFunc{netDial, [2]StreamType{0, chanStream}},
+	"net:listen":    builtinFunc{netListen, [2]StreamType{0, chanStream}},
+	"net:accept":    builtinFunc{netAccept, [2]StreamType{0, chanStream}},
+	"close":         builtinFunc{closeFn, [2]StreamType{}},
+	"sort":          builtinFunc{sortFn, [2]StreamType{chanStream, chanStream}},
+	"order":         builtinFunc{order, [2]StreamType{chanStream, chanStream}},
+	"sort-by":       builtinFunc{sortBy, [2]StreamType{chanStream, chanStream}},
+	"keys":          builtinFunc{keys, [2]StreamType{0, chanStream}},
+	"tee-var":       builtinFunc{teeVar, [2]StreamType{chanStream, chanStream}},
+	"tee-bytes":     builtinFunc{teeBytes, [2]StreamType{fdStream, fdStream}},
+	"only-bytes":    builtinFunc{onlyBytes, [2]StreamType{0, fdStream}},
+	"only-values":   builtinFunc{onlyValues, [2]StreamType{0, chanStream}},
+	"each":          builtinFunc{each, [2]StreamType{chanStream, 0}},
+	"peach":         builtinFunc{peach, [2]StreamType{chanStream, 0}},
+	"run-parallel":  builtinFunc{runParallel, [2]StreamType{0, chanStream}},
+	"map":           builtinFunc{mapFn, [2]StreamType{0, chanStream}},
+	"merge":         builtinFunc{merge, [2]StreamType{0, chanStream}},
+	"patch":         builtinFunc{patch, [2]StreamType{0, chanStream}},
+	"validate":      builtinFunc{validateFn, [2]StreamType{0, chanStream}},
+	"eq":            builtinFunc{eq, [2]StreamType{0, chanStream}},
+	"not-eq":        builtinFunc{notEq, [2]StreamType{0, chanStream}},
+	"is":            builtinFunc{is, [2]StreamType{0, chanStream}},
+	"cd":            builtinFunc{cd, [2]StreamType{}},
+	"pushd":         builtinFunc{pushd, [2]StreamType{}},
+	"popd":          builtinFunc{popd, [2]StreamType{}},
+	"dirs":          builtinFunc{dirs, [2]StreamType{0, chanStream}},
+	"default-redir": builtinFunc{defaultRedirFn, [2]StreamType{}},
+	"export":        builtinFunc{exportFn, [2]StreamType{0, chanStream}},
+	"unexport":      builtinFunc{unexportFn, [2]StreamType{}},
+	"alias":         builtinFunc{aliasFn, [2]StreamType{0, fdStream}},
+	"unalias":       builtinFunc{unaliasFn, [2]StreamType{}},
+	"exec":          builtinFunc{execFn, [2]StreamType{fdStream, fdStream}},
+	"spawn":         builtinFunc{spawn, [2]StreamType{fdStream, fdStream}},
+	"procs":         builtinFunc{procsFn, [2]StreamType{0, chanStream}},
+	"wait":          builtinFunc{waitFn, [2]StreamType{0, chanStream}},
+	"kill":          builtinFunc{killFn, [2]StreamType{}},
+	"proc:list":     builtinFunc{procList, [2]StreamType{0, chanStream}},
+	"sleep":         builtinFunc{sleep, [2]StreamType{}},
+	"exit":          builtinFunc{exit, [2]StreamType{}},
+	"at-exit":       builtinFunc{atExit, [2]StreamType{}},
+	"when":          builtinFunc{when, [2]StreamType{}},
+	"umask":         builtinFunc{umask, [2]StreamType{0, chanStream}},
+	"ulimit":        builtinFunc{ulimit, [2]StreamType{0, chanStream}},
+	"+":             builtinFunc{plus, [2]StreamType{0, chanStream}},
+	"-":             builtinFunc{minus, [2]StreamType{0, chanStream}},
+	"*":             builtinFunc{times, [2]StreamType{0, chanStream}},
+	"/":             builtinFunc{divide, [2]StreamType{0, chanStream}},
+	"<":             builtinFunc{lt, [2]StreamType{0, chanStream}},
+	"<=":            builtinFunc{le, [2]StreamType{0, chanStream}},
+	">":             builtinFunc{gt, [2]StreamType{0, chanStream}},
+	">=":            builtinFunc{ge, [2]StreamType{0, chanStream}},
+	"==":            builtinFunc{numEq, [2]StreamType{0, chanStream}},
+	"!=":            builtinFunc{numNotEq, [2]StreamType{0, chanStream}},
+	"range":         builtinFunc{rangeFn, [2]StreamType{0, chanStream}},
+	"rand":          builtinFunc{randFn, [2]StreamType{0, chanStream}},
+	"randint":       builtinFunc{randint, [2]StreamType{0, chanStream}},
+	"rand-seed":     builtinFunc{randSeed, [2]StreamType{}},
+	"uuid":          builtinFunc{uuid, [2]StreamType{0, chanStream}},
+	"take":          builtinFunc{take, [2]StreamType{chanStream, chanStream}},
+	"drop":          builtinFunc{drop, [2]StreamType{chanStream, chanStream}},
+	"one":           builtinFunc{one, [2]StreamType{chanStream, chanStream}},
+	"count":         builtinFunc{count, [2]StreamType{chanStream, chanStream}},
+	"first":         builtinFunc{first, [2]StreamType{chanStream, chanStream}},
+	"last":          builtinFunc{last, [2]StreamType{chanStream, chanStream}},
+	"num":           builtinFunc{num, [2]StreamType{0, chanStream}},
+	"exact-num":     builtinFunc{exactNum, [2]StreamType{0, chanStream}},
+	"to-string":     builtinFunc{toString, [2]StreamType{0, chanStream}},
+	"str:cat":       builtinFunc{strCat, [2]StreamType{0, chanStream}},
+	"str:repeat":    builtinFunc{strRepeat, [2]StreamType{0, chanStream}},
+	"str:split":     builtinFunc{strSplit, [2]StreamType{0, chanStream}},
+	"str:join":      builtinFunc{strJoin, [2]StreamType{0, chanStream}},
+	"str:trim":      builtinFunc{strTrim, [2]StreamType{0, chanStream}},
+	"str:replace":   builtinFunc{strReplace, [2]StreamType{0, chanStream}},
+	"str:contains":  builtinFunc{strContains, [2]StreamType{0, chanStream}},
+	"str:index":     builtinFunc{strIndex, [2]StreamType{0, chanStream}},
+	"str:to-upper":  builtinFunc{strToUpper, [2]StreamType{0, chanStream}},
+	"str:to-lower":  builtinFunc{strToLower, [2]StreamType{0, chanStream}},
+	"str:pad":       builtinFunc{strPad, [2]StreamType{0, chanStream}},
+	"re:match":      builtinFunc{reMatch, [2]StreamType{0, chanStream}},
+	"re:find-all":   builtinFunc{reFindAll, [2]StreamType{0, chanStream}},
+	"re:replace":    builtinFunc{reReplace, [2]StreamType{0, chanStream}},
+	"re:split":      builtinFunc{reSplit, [2]StreamType{0, chanStream}},
+
+	"path:dir":     builtinFunc{pathDir, [2]StreamType{0, chanStream}},
+	"path:base":    builtinFunc{pathBase, [2]StreamType{0, chanStream}},
+	"path:ext":     builtinFunc{pathExt, [2]StreamType{0, chanStream}},
+	"path:abs":     builtinFunc{pathAbs, [2]StreamType{0, chanStream}},
+	"path:clean":   builtinFunc{pathClean, [2]StreamType{0, chanStream}},
+	"path:join":    builtinFunc{pathJoin, [2]StreamType{0, chanStream}},
+	"fs:exists":    builtinFunc{fsExists, [2]StreamType{0, chanStream}},
+	"fs:is-dir":    builtinFunc{fsIsDir, [2]StreamType{0, chanStream}},
+	"fs:list":      builtinFunc{fsList, [2]StreamType{0, chanStream}},
+	"fs:temp-file": builtinFunc{fsTempFile, [2]StreamType{0, chanStream}},
+	"fs:mkdir":     builtinFunc{fsMkdir, [2]StreamType{}},
+	"fs:remove":    builtinFunc{fsRemove, [2]StreamType{}},
+
+	"math:floor": builtinFunc{mathFn(math.Floor), [2]StreamType{0, chanStream}},
+	"math:ceil":  builtinFunc{mathFn(math.Ceil), [2]StreamType{0, chanStream}},
+	"math:round": builtinFunc{mathFn(math.Round), [2]StreamType{0, chanStream}},
+	"math:sqrt":  builtinFunc{mathFn(math.Sqrt), [2]StreamType{0, chanStream}},
+	"math:abs":   builtinFunc{mathFn(math.Abs), [2]StreamType{0, chanStream}},
+	"math:pow":   builtinFunc{mathFn2(math.Pow), [2]StreamType{0, chanStream}},
+	"math:min":   builtinFunc{mathMin, [2]StreamType{0, chanStream}},
+	"math:max":   builtinFunc{mathMax, [2]StreamType{0, chanStream}},
+	"math:sin":   builtinFunc{mathFn(math.Sin), [2]StreamType{0, chanStream}},
+	"math:cos":   builtinFunc{mathFn(math.Cos), [2]StreamType{0, chanStream}},
+	"math:tan":   builtinFunc{mathFn(math.Tan), [2]StreamType{0, chanStream}},
+	"math:asin":  builtinFunc{mathFn(math.Asin), [2]StreamType{0, chanStream}},
+	"math:acos":  builtinFunc{mathFn(math.Acos), [2]StreamType{0, chanStream}},
+	"math:atan":  builtinFunc{mathFn(math.Atan), [2]StreamType{0, chanStream}},
+	"math:atan2": builtinFunc{mathFn2(math.Atan2), [2]StreamType{0, chanStream}},
+
+	"time:now":      builtinFunc{timeNow, [2]StreamType{0, chanStream}},
+	"time:parse":    builtinFunc{timeParse, [2]StreamType{0, chanStream}},
+	"time:format":   builtinFunc{timeFormat, [2]StreamType{0, chanStream}},
+	"time:in":       builtinFunc{timeIn, [2]StreamType{0, chanStream}},
+	"time:add":      builtinFunc{timeAdd, [2]StreamType{0, chanStream}},
+	"time:sub":      builtinFunc{timeSub, [2]StreamType{0, chanStream}},
+	"time:duration": builtinFunc{timeDuration, [2]StreamType{0, chanStream}},
+
+	"http:get":  builtinFunc{httpGetFn, [2]StreamType{0, chanStream}},
+	"http:post": builtinFunc{httpPostFn, [2]StreamType{fdStream, chanStream}},
+
+	"epm:install": builtinFunc{epmInstall, [2]StreamType{}},
+	"epm:upgrade": builtinFunc{epmUpgrade, [2]StreamType{}},
+	"epm:remove":  builtinFunc{epmRemove, [2]StreamType{}},
+	"epm:list":    builtinFunc{epmList, [2]StreamType{0, chanStream}},
+
+	"runtime:stats": builtinFunc{runtimeStats, [2]StreamType{0, chanStream}},
+	"runtime:mem":   builtinFunc{runtimeMem, [2]StreamType{0, chanStream}},
+	"runtime:pprof": builtinFunc{runtimePprof, [2]StreamType{}},
+
+	"shell:check-update":  builtinFunc{checkUpdate, [2]StreamType{0, chanStream}},
+	"shell:self-upgrade":  builtinFunc{selfUpgrade, [2]StreamType{0, fdStream}},
+	"shell:daemon-socket": builtinFunc{daemonSocket, [2]StreamType{0, chanStream}},
+	"shell:stats":         builtinFunc{stats, [2]StreamType{0, chanStream}},
+
+	"store:get": builtinFunc{storeGet, [2]StreamType{0, chanStream}},
+	"store:set": builtinFunc{storeSet, [2]StreamType{}},
+	"store:del": builtinFunc{storeDel, [2]StreamType{}},
+
+	"chan:make":     builtinFunc{chanMake, [2]StreamType{0, chanStream}},
+	"chan:send":     builtinFunc{chanSend, [2]StreamType{}},
+	"chan:recv":     builtinFunc{chanRecv, [2]StreamType{0, chanStream}},
+	"chan:recv-all": builtinFunc{chanRecvAll, [2]StreamType{0, chanStream}},
+	"chan:close":    builtinFunc{chanClose, [2]StreamType{}},
+
+	"sync:mutex":     builtinFunc{syncMutex, [2]StreamType{0, chanStream}},
+	"sync:with-lock": builtinFunc{syncWithLock, [2]StreamType{}},
+	"sync:once":      builtinFunc{syncOnce, [2]StreamType{0, chanStream}},
+	"sync:do":        builtinFunc{syncDo, [2]StreamType{}},
+
+	"history:del":   builtinFunc{historyDel, [2]StreamType{0, chanStream}},
+	"history:prune": builtinFunc{historyPrune, [2]StreamType{0, chanStream}},
+
+	"io:read-bytes":     builtinFunc{readBytes, [2]StreamType{fdStream, chanStream}},
+	"io:write-bytes":    builtinFunc{writeBytes, [2]StreamType{0, fdStream}},
+	"bytes:from-string": builtinFunc{bytesFromString, [2]StreamType{0, chanStream}},
+	"bytes:to-string":   builtinFunc{bytesToString, [2]StreamType{0, chanStream}},
+	"bytes:from-hex":    builtinFunc{bytesFromHex, [2]StreamType{0, chanStream}},
+	"bytes:to-hex":      builtinFunc{bytesToHex, [2]StreamType{0, chanStream}},
+	"bytes:from-base64": builtinFunc{bytesFromBase64, [2]StreamType{0, chanStream}},
+	"bytes:to-base64":   builtinFunc{bytesToBase64, [2]StreamType{0, chanStream}},
+	"bytes:len":         builtinFunc{bytesLen, [2]StreamType{0, chanStream}},
+	"bytes:slice":       builtinFunc{bytesSlice, [2]StreamType{0, chanStream}},
+	"bytes:compare":     builtinFunc{bytesCompare, [2]StreamType{0, chanStream}},
+}
+
+// AddBuiltinFunc adds or replaces a builtin function that doesn't use its
+// input and output, typically provided by another package like the line
+// editor. It must be called before any code using it is compiled. Use
+// RegisterBuiltin for builtins that output or have their arguments checked.
+func AddBuiltinFunc(name string, fn func(*Evaluator, []Value) string) {
+	modules.Lock()
+	defer modules.Unlock()
+	addBuiltin(name, Builtin{Fn: fn})
 }
 
 func fn(ev *Evaluator, args []Value) string {
@@ -41,7 +233,7 @@ func fn(ev *Evaluator, args []Value) string {
 	if !ok {
 		return "args error"
 	}
-	if n > 2 && len(closure.ArgNames) != 0 {
+	if n > 2 && (len(closure.ArgNames) != 0 || closure.RestArg != "") {
 		return "can't define arg names list twice"
 	}
 	// BUG(xiaq): the fn builtin now modifies the closure in place, making it
@@ -51,17 +243,29 @@ func fn(ev *Evaluator, args []Value) string {
 	//
 	// fn g a b $f // Changes arity of $f!
 	for i := 1; i < n-1; i++ {
-		closure.ArgNames = append(closure.ArgNames, args[i].String())
+		name := args[i].String()
+		if strings.HasPrefix(name, "@") {
+			if i != n-2 {
+				return "rest argument must come last"
+			}
+			closure.RestArg = name[1:]
+			break
+		}
+		closure.ArgNames = append(closure.ArgNames, name)
 	}
 	// TODO(xiaq): should fn warn about redefinition of functions?
-	ev.scope["fn-"+args[0].String()] = valuePtr(closure)
+	ev.scope.define("fn-"+args[0].String(), newVar(closure))
 	return ""
 }
 
+// put outputs its arguments as values, stopping early if the reader has gone
+// away.
 func put(ev *Evaluator, args []Value) string {
-	out := ev.ports[1].ch
+	out := ev.ports[1]
 	for _, a := range args {
-		out <- a
+		if !out.put(a) {
+			break
+		}
 	}
 	return ""
 }
@@ -79,6 +283,118 @@ func println(ev *Evaluator, args []Value) string {
 	return print(ev, args)
 }
 
+// echo writes the string forms of its arguments to the byte output, separated
+// by spaces and followed by a newline. Unlike put, which outputs values, it
+// always outputs bytes.
+func echo(ev *Evaluator, args []Value) string {
+	ss := make([]string, len(args))
+	for i, a := range args {
+		ss[i] = a.String()
+	}
+	fmt.Fprintln(ev.ports[1].f, strings.Join(ss, " "))
+	return ""
+}
+
+// formatValue formats a value for a verb of printf, given the verb with its
+// flags, width and precision, e.g. "%-10s". The verbs are s (the string
+// form), q (the representation), v (the string form of strings and the
+// representation of other values), d (an integer), f, e and g (floats), x
+// and X (hexadecimal integers, or the bytes of other values) and c (the rune
+// of an integer).
+func formatValue(spec string, v Value) (string, error) {
+	verb := spec[len(spec)-1]
+	switch verb {
+	case 's':
+		return fmt.Sprintf(spec, v.String()), nil
+	case 'q':
+		return fmt.Sprintf(spec[:len(spec)-1]+"s", v.Repr()), nil
+	case 'v':
+		if _, ok := v.(*String); ok {
+			return fmt.Sprintf(spec[:len(spec)-1]+"s", v.String()), nil
+		}
+		return fmt.Sprintf(spec[:len(spec)-1]+"s", v.Repr()), nil
+	case 'd', 'c', 'x', 'X':
+		i, err := strconv.ParseInt(v.String(), 0, 64)
+		if err != nil {
+			if verb == 'x' || verb == 'X' {
+				return fmt.Sprintf(spec, v.String()), nil
+			}
+			return "", fmt.Errorf("not an integer: %s", v.Repr())
+		}
+		return fmt.Sprintf(spec, i), nil
+	case 'f', 'e', 'g', 'E', 'G':
+		f, err := toFloat(v)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf(spec, f), nil
+	}
+	return "", fmt.Errorf("bad verb %%%c", verb)
+}
+
+// printfEscapes are the backslash escapes in formats of printf, like in C.
+var printfEscapes = map[byte]byte{
+	'n': '\n', 't': '\t', 'r': '\r', 'a': '\a', 'b': '\b', 'f': '\f',
+	'v': '\v', 'e': '\033', '\\': '\\', '"': '"', '\'': '\'',
+}
+
+// printf writes its arguments to the byte output as directed by the format,
+// e.g.
+//
+// printf "%-10s %5.2f %q\n" $name $price $tags
+//
+// See formatValue for the verbs. %% is a literal %. Backslash escapes like \n
+// are recognized as in C, which is handy for formats in backquotes. Unlike
+// print and echo, it doesn't add anything that is not in the format.
+func printf(ev *Evaluator, args []Value) string {
+	if len(args) == 0 {
+		return "args error"
+	}
+	format := args[0].String()
+	args = args[1:]
+	var buf bytes.Buffer
+	for i := 0; i < len(format); i++ {
+		if format[i] == '\\' && i+1 < len(format) {
+			if c, ok := printfEscapes[format[i+1]]; ok {
+				buf.WriteByte(c)
+				i++
+				continue
+			}
+		}
+		if format[i] != '%' {
+			buf.WriteByte(format[i])
+			continue
+		}
+		j := i + 1
+		for j < len(format) && strings.IndexByte("-+# 0123456789.", format[j]) != -1 {
+			j++
+		}
+		if j == len(format) {
+			return "format ends in the middle of a verb"
+		}
+		spec := format[i : j+1]
+		i = j
+		if spec == "%%" {
+			buf.WriteByte('%')
+			continue
+		}
+		if len(args) == 0 {
+			return fmt.Sprintf("missing argument for %s", spec)
+		}
+		s, err := formatValue(spec, args[0])
+		if err != nil {
+			return err.Error()
+		}
+		args = args[1:]
+		buf.WriteString(s)
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf("%d extra arguments", len(args))
+	}
+	ev.ports[1].f.Write(buf.Bytes())
+	return ""
+}
+
 func printchan(ev *Evaluator, args []Value) string {
 	if len(args) > 0 {
 		return "args error"
@@ -116,32 +432,205 @@ func feedchan(ev *Evaluator, args []Value) string {
 	}
 }
 
-func cd(ev *Evaluator, args []Value) string {
-	var dir string
+// readUpto reads from in up to and including delim, or until the end of
+// input. It reads one byte at a time, so that nothing after delim is consumed
+// and later commands can read the rest.
+func readUpto(in io.Reader, delim byte) (string, error) {
+	var buf bytes.Buffer
+	b := make([]byte, 1)
+	for {
+		_, err := in.Read(b)
+		if err == io.EOF {
+			if buf.Len() == 0 {
+				return "", io.EOF
+			}
+			return buf.String(), nil
+		} else if err != nil {
+			return "", err
+		}
+		buf.WriteByte(b[0])
+		if b[0] == delim {
+			return buf.String(), nil
+		}
+	}
+}
+
+// readLine outputs one line from the input, without the trailing newline. It
+// fails at the end of input.
+func readLine(ev *Evaluator, args []Value) string {
+	if len(args) > 0 {
+		return "args error"
+	}
+	out := ev.ports[1].ch
+	line, err := readUpto(ev.ports[0].f, '\n')
+	if err != nil {
+		return err.Error()
+	}
+	out <- NewString(strings.TrimSuffix(line, "\n"))
+	return ""
+}
+
+// readUptoFn outputs the input up to and including a delimiter, which must
+// be a single byte, e.g.
+//
+// read-upto ,
+//
+// It fails at the end of input.
+func readUptoFn(ev *Evaluator, args []Value) string {
+	if len(args) != 1 || len(args[0].String()) != 1 {
+		return "args error"
+	}
+	out := ev.ports[1].ch
+	s, err := readUpto(ev.ports[0].f, args[0].String()[0])
+	if err != nil {
+		return err.Error()
+	}
+	out <- NewString(s)
+	return ""
+}
+
+// slurp outputs all of the input as a single string.
+func slurp(ev *Evaluator, args []Value) string {
+	if len(args) > 0 {
+		return "args error"
+	}
+	out := ev.ports[1].ch
+	b, err := ioutil.ReadAll(ev.ports[0].f)
+	if err != nil {
+		return err.Error()
+	}
+	out <- NewString(string(b))
+	return ""
+}
+
+// each calls a closure on each value from the input channel sequentially.
+func each(ev *Evaluator, args []Value) string {
+	if len(args) != 1 {
+		return "args error"
+	}
+	f, ok := args[0].(*Closure)
+	if !ok {
+		return "args error"
+	}
+	in := ev.ports[0].ch
+
+	msg := ""
+	for v := range in {
+		if msg != "" {
+			// Keep draining the input so that upstream doesn't block.
+			continue
+		}
+		ev.checkCanceled()
+		msg = ev.callClosure(f, []Value{v})
+	}
+	return msg
+}
+
+// mapFn calls a closure on each of the remaining arguments, or on each
+// element of the list part if the only remaining argument is a table. With an
+// output capture it can construct a new list from an existing one:
+//
+// [(map {|x| put $x$x} $li)]
+func mapFn(ev *Evaluator, args []Value) string {
 	if len(args) == 0 {
-		user, err := user.Current()
-		if err == nil {
-			dir = user.HomeDir
+		return "args error"
+	}
+	f, ok := args[0].(*Closure)
+	if !ok {
+		return "args error"
+	}
+	values := args[1:]
+	if len(values) == 1 {
+		if t, ok := values[0].(*Table); ok {
+			values = t.List
+		}
+	}
+
+	for _, v := range values {
+		if msg := ev.callClosure(f, []Value{v}); msg != "" {
+			return msg
+		}
+	}
+	return ""
+}
+
+// peach calls a closure on each value from the input channel in parallel,
+// each call in its own goroutine and with its own copy of the Evaluator.
+func peach(ev *Evaluator, args []Value) string {
+	if len(args) != 1 {
+		return "args error"
+	}
+	f, ok := args[0].(*Closure)
+	if !ok {
+		return "args error"
+	}
+	in := ev.ports[0].ch
+
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		msg string
+	)
+	for v := range in {
+		if ev.canceled() {
+			// Let the calls started finish, then throw.
+			break
 		}
-	} else if len(args) == 1 {
-		dir = args[0].String()
-	} else {
+		wg.Add(1)
+		go func(v Value) {
+			defer wg.Done()
+			m := ev.callClosure(f, []Value{v})
+			if m != "" {
+				mu.Lock()
+				if msg == "" {
+					msg = m
+				}
+				mu.Unlock()
+			}
+		}(v)
+	}
+	wg.Wait()
+	ev.checkCanceled()
+	return msg
+}
+
+// defaultRedirFn sets the default redirections of a command, e.g.
+//
+// default-redir make `>>[2]/tmp/make.log`
+//
+// The redirections are applied to forms compiled afterwards.
+func defaultRedirFn(ev *Evaluator, args []Value) string {
+	if len(args) == 0 {
 		return "args error"
 	}
-	err := os.Chdir(dir)
+	specs := make([]string, len(args)-1)
+	for i, a := range args[1:] {
+		specs[i] = a.String()
+	}
+	err := ev.Compiler.SetDefaultRedirs(args[0].String(), strings.Join(specs, " "))
 	if err != nil {
 		return err.Error()
 	}
 	return ""
 }
 
+// toFloat converts a String to a float64. Other values, as well as strings
+// that are not numbers, NaN or infinities, are errors.
+func toFloat(v Value) (float64, error) {
+	s, ok := v.(*String)
+	if !ok {
+		return 0, fmt.Errorf("not a number: %s", v.Repr())
+	}
+	f, err := strconv.ParseFloat(string(*s), 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("not a number: %s", v.Repr())
+	}
+	return f, nil
+}
+
 func toFloats(args []Value) (nums []float64, err error) {
 	for _, a := range args {
-		a, ok := a.(*String)
-		if !ok {
-			return nil, fmt.Errorf("must be string")
-		}
-		f, err := strconv.ParseFloat(string(*a), 64)
+		f, err := toFloat(a)
 		if err != nil {
 			return nil, err
 		}
@@ -150,6 +639,69 @@ func toFloats(args []Value) (nums []float64, err error) {
 	return
 }
 
+// num outputs each argument converted to a number in its canonical form,
+// e.g. num 010 1e2 outputs 10 and 100. It fails on the first argument that is
+// not a number.
+func num(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	nums, err := toFloats(args)
+	if err != nil {
+		return err.Error()
+	}
+	for _, f := range nums {
+		out <- NewString(strconv.FormatFloat(f, 'g', -1, 64))
+	}
+	return ""
+}
+
+// exactNum is like num, but converts to exact rational numbers, written as
+// integers or fractions, e.g. exact-num 0.1 2/4 outputs 1/10 and 1/2.
+func exactNum(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	var rats []*big.Rat
+	for _, a := range args {
+		s, ok := a.(*String)
+		if !ok {
+			return fmt.Sprintf("not a number: %s", a.Repr())
+		}
+		r, ok := new(big.Rat).SetString(string(*s))
+		if !ok {
+			return fmt.Sprintf("not a number: %s", a.Repr())
+		}
+		rats = append(rats, r)
+	}
+	for _, r := range rats {
+		out <- NewString(r.RatString())
+	}
+	return ""
+}
+
+// toString outputs the string form of each argument. It fails on Bytes that
+// are not valid UTF-8 and on values without a meaningful string form.
+func toString(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	var strs []Value
+	for _, a := range args {
+		switch a := a.(type) {
+		case *String:
+			strs = append(strs, a)
+		case *Bytes:
+			if !utf8.Valid(*a) {
+				return "bytes are not valid UTF-8"
+			}
+			strs = append(strs, NewString(string(*a)))
+		case *Table:
+			strs = append(strs, NewString(a.Repr()))
+		default:
+			return fmt.Sprintf("cannot convert %s to string", a.Repr())
+		}
+	}
+	for _, s := range strs {
+		out <- s
+	}
+	return ""
+}
+
 func plus(ev *Evaluator, args []Value) string {
 	out := ev.ports[1].ch
 	nums, err := toFloats(args)
@@ -211,3 +763,56 @@ func divide(ev *Evaluator, args []Value) string {
 	out <- NewString(fmt.Sprintf("%g", prod))
 	return ""
 }
+
+// rangeArgs parses the arguments of range, which are [start] end [step].
+// start defaults to 0 and step defaults to 1.
+func rangeArgs(args []Value) (start, end, step float64, err error) {
+	nums, err := toFloats(args)
+	if err != nil {
+		return
+	}
+	start, step = 0, 1
+	switch len(nums) {
+	case 1:
+		end = nums[0]
+	case 2:
+		start, end = nums[0], nums[1]
+	case 3:
+		start, end, step = nums[0], nums[1], nums[2]
+	default:
+		err = fmt.Errorf("args error")
+		return
+	}
+	if step == 0 {
+		err = fmt.Errorf("step must not be zero")
+	}
+	return
+}
+
+// forRange calls f with each number from start to end (exclusive),
+// incremented by step, without building an intermediate list. It stops early
+// when f returns false. The numbers are never written with exponents, so
+// that large ones like 1000000 stay integers.
+func forRange(start, end, step float64, f func(Value) bool) {
+	for i := start; (step > 0 && i < end) || (step < 0 && i > end); i += step {
+		if !f(NewString(strconv.FormatFloat(i, 'f', -1, 64))) {
+			return
+		}
+	}
+}
+
+// rangeFn outputs the numbers of a range one at a time. When the output is
+// piped to a consumer that stops reading, like take, so does rangeFn, so
+// that range 1e9 | take 5 finishes at once.
+func rangeFn(ev *Evaluator, args []Value) string {
+	out := ev.ports[1]
+	start, end, step, err := rangeArgs(args)
+	if err != nil {
+		return err.Error()
+	}
+	forRange(start, end, step, func(v Value) bool {
+		return !ev.canceled() && out.put(v)
+	})
+	ev.checkCanceled()
+	return ""
+}
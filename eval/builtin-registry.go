@@ -0,0 +1,167 @@
+package eval
+
+// The registry of builtin functions, keyed by name. Programs embedding the
+// eval package can add native commands to it without changing the package,
+// e.g.
+//
+//	eval.RegisterBuiltin("greet", eval.Builtin{
+//		Fn: func(ev *eval.Evaluator, args []eval.Value) string {
+//			ev.Put(eval.NewString("hello " + args[0].String()))
+//			return ""
+//		},
+//		Args:   &eval.ArgSpec{Min: 1, Max: 1, Types: []string{"string"}},
+//		Output: eval.ValueOutput,
+//	})
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// OutputKind is what a builtin writes to its output.
+type OutputKind int
+
+// OutputKind constants.
+const (
+	// NoOutput is the kind of builtins that don't use their output.
+	NoOutput OutputKind = iota
+	// ValueOutput is the kind of builtins that output values with Put.
+	ValueOutput
+	// ByteOutput is the kind of builtins that write bytes to Stdout.
+	ByteOutput
+)
+
+// ArgSpec is what a builtin accepts as arguments. They are checked before the
+// builtin is called, and the builtin fails with a message saying what is
+// wrong if they don't match.
+type ArgSpec struct {
+	// Min and Max are the least and most numbers of arguments. Max is -1 for
+	// no limit.
+	Min, Max int
+	// Types are the names of the types of the leading arguments, like
+	// "string" or "closure". An empty name accepts any value.
+	Types []string
+}
+
+// Builtin is a builtin function implemented in Go.
+type Builtin struct {
+	// Fn implements the builtin. It returns "" on success, or an error
+	// message.
+	Fn func(*Evaluator, []Value) string
+	// Args, if not nil, is checked against the arguments before Fn is called.
+	Args *ArgSpec
+	// Output is what Fn writes to its output.
+	Output OutputKind
+}
+
+// RegisterBuiltin adds a builtin function. It must be called before any code
+// using it is compiled, typically from an init function. It is an error to
+// register a name that is already a builtin.
+func RegisterBuiltin(name string, b Builtin) error {
+	if name == "" || strings.ContainsAny(name, " \t\n") {
+		return fmt.Errorf("bad builtin name %q", name)
+	}
+	if b.Fn == nil {
+		return fmt.Errorf("builtin %s has no implementation", name)
+	}
+	if b.Args != nil {
+		for _, t := range b.Args.Types {
+			if _, ok := typenames[t]; t != "" && !ok {
+				return fmt.Errorf("builtin %s: unknown type %s", name, t)
+			}
+		}
+	}
+	modules.Lock()
+	defer modules.Unlock()
+	_, isFunc := builtinFuncs[name]
+	_, isSpecial := builtinSpecials[name]
+	if isFunc || isSpecial {
+		return fmt.Errorf("builtin %s already defined", name)
+	}
+	addBuiltin(name, b)
+	return nil
+}
+
+// addBuiltin adds or replaces a builtin function.
+func addBuiltin(name string, b Builtin) {
+	fn := b.Fn
+	if spec := b.Args; spec != nil {
+		fn = func(ev *Evaluator, args []Value) string {
+			if msg := spec.check(name, args); msg != "" {
+				return msg
+			}
+			return b.Fn(ev, args)
+		}
+	}
+	var out StreamType
+	switch b.Output {
+	case ValueOutput:
+		out = chanStream
+	case ByteOutput:
+		out = fdStream
+	}
+	builtinFuncs[name] = builtinFunc{fn, [2]StreamType{0, out}}
+	builtinsGeneration++
+}
+
+// lookupBuiltin looks up a builtin special or function in the registry.
+func lookupBuiltin(name string) (*builtinSpecial, *builtinFunc) {
+	modules.RLock()
+	defer modules.RUnlock()
+	if bi, ok := builtinSpecials[name]; ok {
+		return &bi, nil
+	}
+	if bi, ok := builtinFuncs[name]; ok {
+		return nil, &bi
+	}
+	return nil, nil
+}
+
+// getBuiltinsGeneration returns builtinsGeneration, reading it with the read
+// lock of the registry held.
+func getBuiltinsGeneration() int {
+	modules.RLock()
+	defer modules.RUnlock()
+	return builtinsGeneration
+}
+
+// check checks the arguments of the builtin name against the spec, and
+// returns what is wrong with them, or "" if nothing is.
+func (spec *ArgSpec) check(name string, args []Value) string {
+	n := len(args)
+	if n < spec.Min || (spec.Max >= 0 && n > spec.Max) {
+		var want string
+		switch {
+		case spec.Max < 0:
+			want = fmt.Sprintf("at least %d", spec.Min)
+		case spec.Min == spec.Max:
+			want = fmt.Sprintf("%d", spec.Min)
+		default:
+			want = fmt.Sprintf("%d to %d", spec.Min, spec.Max)
+		}
+		return fmt.Sprintf("%s takes %s arguments, got %d", name, want, n)
+	}
+	for i, t := range spec.Types {
+		if i >= n {
+			break
+		}
+		if t != "" && !assignable(typenames[t], args[i].Type()) {
+			return fmt.Sprintf("argument %d of %s must be a %s, got %s", i+1, name, t, args[i].Repr())
+		}
+	}
+	return ""
+}
+
+// Put outputs values from a builtin with ValueOutput.
+func (ev *Evaluator) Put(vs ...Value) {
+	out := ev.ports[1].ch
+	for _, v := range vs {
+		out <- v
+	}
+}
+
+// Stdout returns where a builtin with ByteOutput writes to.
+func (ev *Evaluator) Stdout() io.Writer {
+	return ev.ports[1].f
+}
@@ -14,13 +14,69 @@ type builtinSpecial struct {
 
 var builtinSpecials map[string]builtinSpecial
 
+// assignmentSpecial is the builtin special for assignment forms. It is not
+// looked up by name, but selected by the compiler when isAssignment is true.
+var assignmentSpecial builtinSpecial
+
 func init() {
 	// Needed to avoid initialization loop
 	builtinSpecials = map[string]builtinSpecial{
-		"var": builtinSpecial{compileVar, [2]StreamType{}},
-		"set": builtinSpecial{compileSet, [2]StreamType{}},
-		"del": builtinSpecial{compileDel, [2]StreamType{}},
+		"var":        builtinSpecial{compileVar, [2]StreamType{}},
+		"const":      builtinSpecial{compileConst, [2]StreamType{}},
+		"set":        builtinSpecial{compileSet, [2]StreamType{}},
+		"del":        builtinSpecial{compileDel, [2]StreamType{}},
+		"for":        builtinSpecial{compileFor, [2]StreamType{}},
+		"match":      builtinSpecial{compileMatch, [2]StreamType{}},
+		"case":       builtinSpecial{compileCase, [2]StreamType{}},
+		"set-option": builtinSpecial{compileSetOption, [2]StreamType{}},
+		"and":        builtinSpecial{compileAnd, [2]StreamType{0, chanStream}},
+		"or":         builtinSpecial{compileOr, [2]StreamType{0, chanStream}},
+		"not":        builtinSpecial{compileNot, [2]StreamType{0, chanStream}},
+		"coalesce":   builtinSpecial{compileCoalesce, [2]StreamType{0, chanStream}},
+		"time":       builtinSpecial{compileTime, [2]StreamType{}},
+		"benchmark":  builtinSpecial{compileBenchmark, [2]StreamType{}},
+
+		"shell:api-version":  builtinSpecial{compileAPIVersion, [2]StreamType{}},
+		"shell:lang-version": builtinSpecial{compileLangVersion, [2]StreamType{}},
+	}
+	assignmentSpecial = builtinSpecial{compileAssignment, [2]StreamType{}}
+}
+
+// AddBuiltinSpecial adds a builtin special form that doesn't use its input and
+// output, typically provided by another package. The form is compiled by
+// calling compile with the Compiler and the form node, and the function it
+// returns is called each time the form is evaluated, returning the exit value
+// of the form. It must be called before any code using it is compiled, e.g.
+//
+//	eval.AddBuiltinSpecial("twice",
+//		func(cp *eval.Compiler, fn *parse.FormNode) func(*eval.Evaluator) string {
+//			body := cp.CompileTerm(fn.Args.Nodes[0])
+//			return func(ev *eval.Evaluator) string {
+//				ev.CallClosure(body(ev)[0], nil)
+//				return ev.CallClosure(body(ev)[0], nil)
+//			}
+//		})
+func AddBuiltinSpecial(name string, compile func(*Compiler, *parse.FormNode) func(*Evaluator) string) {
+	modules.Lock()
+	defer modules.Unlock()
+	builtinSpecials[name] = builtinSpecial{
+		func(cp *Compiler, fn *parse.FormNode) strOp {
+			return compile(cp, fn)
+		},
+		[2]StreamType{},
 	}
+	builtinsGeneration++
+}
+
+// CompileTerm compiles a term in a form, typically an argument of a special
+// form added with AddBuiltinSpecial. The returned function evaluates the term.
+func (cp *Compiler) CompileTerm(tn *parse.TermNode) func(*Evaluator) []Value {
+	return cp.compileTerm(tn).f
+}
+
+// Errorf stops the compilation with an error at node n.
+func (cp *Compiler) Errorf(n parse.Node, format string, args ...interface{}) {
+	cp.errorf(n, format, args...)
 }
 
 type varSetForm struct {
@@ -42,20 +98,22 @@ func checkSetType(cp *Compiler, args *parse.TermListNode, f *varSetForm, vop val
 			// TODO Check type soundness at runtime
 			continue
 		}
-		if cp.tryResolveVar(name) != vop.ts[i] {
+		if !assignable(cp.tryResolveVar(name), vop.ts[i]) {
 			cp.errorf(f.values[i], "type mismatch")
 		}
 	}
 }
 
 // compileVarSet compiles a var or set special form. If v is true, a var special
-// form is being compiled.
+// form is being compiled, and if c is also true, a const special form, which
+// is a var special form declaring read-only variables that must be given
+// values.
 //
 // The arguments in the var/set special form must consist of zero or more
 // variable factors followed by `=` and then zero or more terms. The number of
 // values the terms evaluate to must be equal to the number of names, but
 // compileVarSet does not attempt to compile this.
-func compileVarSet(cp *Compiler, args *parse.TermListNode, v bool) strOp {
+func compileVarSet(cp *Compiler, args *parse.TermListNode, v, c bool) strOp {
 	f := &varSetForm{}
 	lastTyped := 0
 	for i, n := range args.Nodes {
@@ -96,6 +154,10 @@ func compileVarSet(cp *Compiler, args *parse.TermListNode, v bool) strOp {
 			if !v {
 				// For set, ensure that the variable can be resolved
 				cp.resolveVar(text, nf)
+				cp.checkWritable(text, nf)
+			} else if cp.hasVarOnThisScope(text) {
+				// Read-only variables can't be declared again either
+				cp.checkWritable(text, nf)
 			}
 			f.names = append(f.names, text)
 		} else {
@@ -106,22 +168,44 @@ func compileVarSet(cp *Compiler, args *parse.TermListNode, v bool) strOp {
 		if len(f.types) != len(f.names) {
 			cp.errorf(args, "Some variables lack type")
 		}
+		if c && f.values == nil {
+			cp.errorf(args, "const form lacks equal sign")
+		}
 		for i, name := range f.names {
-			cp.pushVar(name, f.types[i])
+			if c {
+				cp.pushVar(name, constType{f.types[i]})
+			} else {
+				cp.pushVar(name, f.types[i])
+			}
 		}
 		var vop valuesOp
 		if f.values != nil {
 			vop = cp.compileTerms(f.values)
 			checkSetType(cp, args, f, vop)
 		}
+		if c {
+			return func(ev *Evaluator) string {
+				values := vop.f(ev)
+				if len(values) != len(f.names) {
+					return "arity mismatch"
+				}
+				for i, name := range f.names {
+					ev.scope.define(name, newReadOnlyVar(name, values[i]))
+				}
+				return ""
+			}
+		}
 		return func(ev *Evaluator) string {
-			for i, name := range f.names {
-				ev.scope[name] = valuePtr(f.types[i].Default())
+			if vop.f == nil {
+				for i, name := range f.names {
+					ev.scope.define(name, newUnsetVar(f.types[i].Default()))
+				}
+				return ""
 			}
-			if vop.f != nil {
-				return doSet(ev, f.names, vop.f(ev))
+			for i, name := range f.names {
+				ev.scope.define(name, newVar(f.types[i].Default()))
 			}
-			return ""
+			return doSet(ev, f.names, vop.f(ev))
 		}
 	} else {
 		if f.values == nil {
@@ -136,11 +220,19 @@ func compileVarSet(cp *Compiler, args *parse.TermListNode, v bool) strOp {
 }
 
 func compileVar(cp *Compiler, fn *parse.FormNode) strOp {
-	return compileVarSet(cp, fn.Args, true)
+	return compileVarSet(cp, fn.Args, true, false)
+}
+
+// compileConst compiles a const special form, which declares read-only
+// variables like var, e.g.
+//
+// const $limit string = 100
+func compileConst(cp *Compiler, fn *parse.FormNode) strOp {
+	return compileVarSet(cp, fn.Args, true, true)
 }
 
 func compileSet(cp *Compiler, fn *parse.FormNode) strOp {
-	return compileVarSet(cp, fn.Args, false)
+	return compileVarSet(cp, fn.Args, false, false)
 }
 
 func doSet(ev *Evaluator, names []string, values []Value) string {
@@ -151,8 +243,10 @@ func doSet(ev *Evaluator, names []string, values []Value) string {
 	}
 
 	for i, name := range names {
-		// TODO Prevent overriding builtin variables e.g. $pid $env
-		*ev.scope[name] = values[i]
+		v := values[i]
+		if err := ev.scope.get(name).assign(func(Value) Value { return v }); err != nil {
+			return err.Error()
+		}
 	}
 
 	return ""
@@ -173,6 +267,7 @@ func compileDel(cp *Compiler, fn *parse.FormNode) strOp {
 		}
 		name := nf.Node.(*parse.StringNode).Text
 		cp.resolveVar(name, nf)
+		cp.checkWritable(name, nf)
 		if !cp.hasVarOnThisScope(name) {
 			cp.errorf(n, "can only delete variable on current scope")
 		}
@@ -181,8 +276,318 @@ func compileDel(cp *Compiler, fn *parse.FormNode) strOp {
 	}
 	return func(ev *Evaluator) string {
 		for _, name := range f.names {
-			delete(ev.scope, name)
+			ev.scope.remove(name)
+		}
+		return ""
+	}
+}
+
+// compileFor compiles a for special form, which is one of:
+//
+// for i in a b c { body }
+// for i from start to end [step step] { body }
+//
+// The body is called with $i set to each value. In the first form, the loop
+// variable may also be a destructuring pattern like {k v} or [&name n]. In
+// the second form $i counts from start to end (exclusive);
+// `for i in (range start end step)` is compiled the same way, so neither
+// builds an intermediate list. The loop stops at the first iteration whose
+// last pipeline fails, and its exit value is that of the for form.
+func compileFor(cp *Compiler, fn *parse.FormNode) strOp {
+	args := fn.Args.Nodes
+	if len(args) < 3 {
+		cp.errorf(fn, "for form must be `for var in values... body` or `for var from start to end [step step] body`")
+	}
+	var names []string
+	var p *pattern
+	if isPattern(args[0]) {
+		p = cp.compilePattern(args[0])
+		names = p.names
+	} else if name := keyword(args[0]); name != "" {
+		names = []string{name}
+	} else {
+		cp.errorf(args[0], "loop variable must be a string literal or pattern")
+	}
+
+	last := args[len(args)-1]
+	if len(last.Nodes) != 1 || last.Nodes[0].Typ != parse.ClosureFactor {
+		cp.errorf(last, "loop body must be a closure")
+	}
+	body := last.Nodes[0].Node.(*parse.ClosureNode)
+	if body.ArgNames != nil && len(body.ArgNames.Nodes) > 0 {
+		cp.errorf(last, "loop body must not take arguments")
+	}
+
+	var vop, rop valuesOp
+	middle := args[2 : len(args)-1]
+	switch keyword(args[1]) {
+	case "in":
+		if rargs := rangeCapture(cp, middle); rargs != nil {
+			rop = cp.compileTermList(rargs)
+		} else {
+			vop = cp.compileTerms(middle)
+		}
+	case "from":
+		if p != nil {
+			cp.errorf(args[0], "counted loop variable must not be a pattern")
+		}
+		if !(len(middle) == 3 && keyword(middle[1]) == "to") &&
+			!(len(middle) == 5 && keyword(middle[1]) == "to" && keyword(middle[3]) == "step") {
+			cp.errorf(args[1], "counted loop must be `from start to end [step step]`")
+		}
+		terms := []*parse.TermNode{middle[0], middle[2]}
+		if len(middle) == 5 {
+			terms = append(terms, middle[4])
+		}
+		rop = cp.compileTerms(terms)
+	default:
+		cp.errorf(args[1], "expect literal `in` or `from`")
+	}
+
+	restArg := ""
+	if p != nil {
+		restArg = p.rest
+	}
+	bop, _, _ := cp.compileClosureBody(body, names, restArg)
+
+	return func(ev *Evaluator) string {
+		c := bop.f(ev)[0].(*Closure)
+		msg := ""
+		call := func(v Value) bool {
+			args := []Value{v}
+			if p != nil {
+				vs, rest := ev.destructure(p, v)
+				args = append(append([]Value{}, vs...), rest...)
+			}
+			msg = failure(ev.callClosureStatus(c, args))
+			return msg == ""
 		}
+		if rop.f != nil {
+			start, end, step, err := rangeArgs(rop.f(ev))
+			if err != nil {
+				return err.Error()
+			}
+			forRange(start, end, step, call)
+		} else {
+			for _, v := range vop.f(ev) {
+				if !call(v) {
+					break
+				}
+			}
+		}
+		return msg
+	}
+}
+
+// keyword returns the text of a term if it is a single bare string, or ""
+// otherwise.
+func keyword(tn *parse.TermNode) string {
+	if len(tn.Nodes) != 1 || !isBareString(tn.Nodes[0]) {
 		return ""
 	}
+	return tn.Nodes[0].Node.(*parse.StringNode).Text
+}
+
+// rangeCapture returns the arguments of the range builtin if terms is exactly
+// an output capture of a single range form, or nil otherwise.
+func rangeCapture(cp *Compiler, terms []*parse.TermNode) *parse.TermListNode {
+	if len(terms) != 1 || len(terms[0].Nodes) != 1 ||
+		terms[0].Nodes[0].Typ != parse.OutputCaptureFactor {
+		return nil
+	}
+	pn := terms[0].Nodes[0].Node.(*parse.PipelineNode)
+	if len(pn.Nodes) != 1 {
+		return nil
+	}
+	fn := pn.Nodes[0]
+	if len(fn.Redirs) > 0 || keyword(fn.Command) != "range" ||
+		cp.tryResolveVar("fn-range") != nil {
+		return nil
+	}
+	return fn.Args
+}
+
+// isBareString determines whether a factor is an unquoted string literal.
+func isBareString(f *parse.FactorNode) bool {
+	if f.Typ != parse.StringFactor {
+		return false
+	}
+	sn := f.Node.(*parse.StringNode)
+	return sn.Quoted == sn.Text
+}
+
+// isLvalue determines whether a term can be the target of an assignment. It
+// is either a destructuring pattern, or consists of a bare string, the
+// variable name, followed by zero or more tables, the indices.
+func isLvalue(tn *parse.TermNode) bool {
+	if isPattern(tn) {
+		return true
+	}
+	if len(tn.Nodes) == 0 || !isBareString(tn.Nodes[0]) {
+		return false
+	}
+	for _, f := range tn.Nodes[1:] {
+		if f.Typ != parse.TableFactor {
+			return false
+		}
+	}
+	return true
+}
+
+// findEqualSign finds the index of the first bare `=` in the argument list of
+// a form, or -1 if there is none.
+func findEqualSign(fn *parse.FormNode) int {
+	for i, tn := range fn.Args.Nodes {
+		if len(tn.Nodes) == 1 && isBareString(tn.Nodes[0]) &&
+			tn.Nodes[0].Node.(*parse.StringNode).Text == "=" {
+			return i
+		}
+	}
+	return -1
+}
+
+// isAssignment determines whether a form is an assignment form, that is, one
+// or more lvalues followed by a bare `=` and zero or more terms:
+//
+// a b li[0] m[key] = foo (put bar) $x
+// {a b @rest} [&k1 x &k2 y] = $list $map
+//
+// With more than one lvalue, the head must also be a pattern or name a
+// declared variable, so that commands like test a = b are not taken for
+// assignments. A form with one lvalue, like a = foo, is always an assignment,
+// so that assigning to an undeclared variable is an error.
+func (cp *Compiler) isAssignment(fn *parse.FormNode) bool {
+	eq := findEqualSign(fn)
+	if eq == -1 || !isLvalue(fn.Command) {
+		return false
+	}
+	for _, tn := range fn.Args.Nodes[:eq] {
+		if !isLvalue(tn) {
+			return false
+		}
+	}
+	if eq > 0 && !isPattern(fn.Command) {
+		name := fn.Command.Nodes[0].Node.(*parse.StringNode).Text
+		return cp.tryResolveVar(cp.currentName(varRenames, name)) != nil
+	}
+	return true
+}
+
+type lvalue struct {
+	name    string
+	indices []valuesOp
+	pattern *pattern // Non-nil if the lvalue is a destructuring pattern.
+	node    *parse.TermNode
+}
+
+// compileAssignment compiles an assignment form. All variables must already
+// be declared with var; assigning to an undeclared variable is a compile
+// error. The number of values is checked against the number of lvalues at
+// runtime.
+func compileAssignment(cp *Compiler, fn *parse.FormNode) strOp {
+	eq := findEqualSign(fn)
+	terms := append([]*parse.TermNode{fn.Command}, fn.Args.Nodes[:eq]...)
+	values := fn.Args.Nodes[eq+1:]
+	vop := cp.compileTerms(values)
+
+	lvalues := make([]lvalue, len(terms))
+	for i, tn := range terms {
+		if isPattern(tn) {
+			p := cp.compilePattern(tn)
+			cp.resolvePattern(p)
+			if len(vop.ts) == len(terms) {
+				// Terms and values correspond to each other only if
+				// every term evaluates to exactly one value.
+				var vn *parse.TermNode
+				if len(values) == len(terms) {
+					vn = values[i]
+				}
+				cp.checkPattern(p, vop.ts[i], vn)
+			}
+			lvalues[i] = lvalue{pattern: p, node: tn}
+			continue
+		}
+		name := cp.currentName(varRenames, tn.Nodes[0].Node.(*parse.StringNode).Text)
+		t := cp.resolveVar(name, tn.Nodes[0])
+		cp.checkWritable(name, tn.Nodes[0])
+		lv := lvalue{name: name, node: tn}
+		if len(tn.Nodes) == 1 && len(vop.ts) == len(terms) {
+			// TODO Check type soundness at runtime
+			if _, ok := vop.ts[i].(AnyType); !ok && !assignable(t, vop.ts[i]) {
+				cp.errorf(tn, "type mismatch")
+			}
+		}
+		for _, f := range tn.Nodes[1:] {
+			table := f.Node.(*parse.TableNode)
+			if len(table.Dict) > 0 {
+				cp.errorf(f, "index must not contain key-value pairs")
+			}
+			lv.indices = append(lv.indices, cp.compileTerms(table.List))
+		}
+		lvalues[i] = lv
+	}
+
+	return func(ev *Evaluator) string {
+		values := vop.f(ev)
+		if len(values) != len(lvalues) {
+			return "arity mismatch"
+		}
+		for i, lv := range lvalues {
+			ev.assign(lv, values[i])
+		}
+		return ""
+	}
+}
+
+// assign assigns a value to an lvalue.
+//
+// Tables are values: assigning to an element never changes a table that may
+// also be held by another variable, a closure or another goroutine. Instead,
+// the tables on the path to the element are copied, and the copy of the
+// outermost one is put in the variable. The copies belong to the variable
+// until it is read, and are changed in place by the assignments to elements
+// until then, so that filling a table one element at a time does not copy it
+// each time.
+func (ev *Evaluator) assign(lv lvalue, v Value) {
+	if lv.pattern != nil {
+		ev.assignPattern(lv.pattern, v)
+		return
+	}
+	variable := ev.scope.get(lv.name)
+	var err error
+	if len(lv.indices) == 0 {
+		err = variable.assign(func(Value) Value { return v })
+	} else {
+		indices := make([]Value, len(lv.indices))
+		for i, op := range lv.indices {
+			indices[i] = ev.asSingleValue(lv.node, op.f(ev), "index")
+		}
+		err = variable.assignElement(func(container Value, own func(*Table) *Table) Value {
+			return ev.withElement(lv.node, container, indices, v, own)
+		})
+	}
+	if err != nil {
+		ev.errorfNode(lv.node, "%s", err)
+	}
+}
+
+// withElement returns container with the element at the path of indices set
+// to v. The tables on the path are replaced by what own returns for them.
+func (ev *Evaluator) withElement(n parse.Node, container Value, indices []Value, v Value, own func(*Table) *Table) Value {
+	t, ok := container.(*Table)
+	if !ok {
+		ev.errorfNode(n, "cannot index %s", container.Repr())
+	}
+	if len(indices) > 1 {
+		child, err := t.getIndex(indices[0])
+		if err != nil {
+			ev.errorfNode(n, "%s", err)
+		}
+		v = ev.withElement(n, child, indices[1:], v, own)
+	}
+	t = own(t)
+	if err := t.setIndex(indices[0], v); err != nil {
+		ev.errorfNode(n, "%s", err)
+	}
+	return t
 }
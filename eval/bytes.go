@@ -0,0 +1,267 @@
+package eval
+
+// Binary data.
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type BytesType struct {
+}
+
+func (bt BytesType) Default() Value {
+	return NewBytes(nil)
+}
+
+func (bt BytesType) Caret(t Type) Type {
+	return AnyType{}
+}
+
+// Bytes is a sequence of bytes. Unlike String, it is never assumed to be
+// UTF-8, so binary data survives being passed around.
+type Bytes []byte
+
+func (b *Bytes) Type() Type {
+	return BytesType{}
+}
+
+func NewBytes(b []byte) *Bytes {
+	bs := Bytes(b)
+	return &bs
+}
+
+// Repr shows the bytes in hexadecimal, e.g. <Bytes 68656c6c6f>.
+func (b *Bytes) Repr() string {
+	return "<Bytes " + hex.EncodeToString(*b) + ">"
+}
+
+// String returns the bytes as is, so that printing a Bytes writes the bytes.
+func (b *Bytes) String() string {
+	return string(*b)
+}
+
+func (b *Bytes) Eq(v Value) bool {
+	b2, ok := v.(*Bytes)
+	return ok && bytes.Equal(*b, *b2)
+}
+
+func (b *Bytes) Hash() uint32 {
+	return hashString(string(*b))
+}
+
+// Caret concatenates Bytes with Bytes or the bytes of Strings. Careting with
+// a single-element list indexes or slices it: $b[2] is the number of the byte
+// at index 2, and $b[1:3], $b[1:] and $b[:3] are slices.
+func (b *Bytes) Caret(ev *Evaluator, v Value) Value {
+	switch v := v.(type) {
+	case *Bytes:
+		return NewBytes(append(append([]byte(nil), *b...), *v...))
+	case *String:
+		return NewBytes(append(append([]byte(nil), *b...), *v...))
+	case *Table:
+		if len(v.List) != 1 || len(v.Dict) != 0 {
+			ev.errorf("subscription must be single-element list")
+		}
+		sub := v.List[0].String()
+		if i := strings.IndexRune(sub, ':'); i != -1 {
+			slice, err := b.slice(sub[:i], sub[i+1:])
+			if err != nil {
+				ev.errorf("%s", err)
+			}
+			return slice
+		}
+		i, err := strconv.Atoi(sub)
+		if err != nil || i < 0 || i >= len(*b) {
+			ev.errorf("index out of range: %s", v.List[0].Repr())
+		}
+		return NewString(strconv.Itoa(int((*b)[i])))
+	default:
+		ev.errorf("Bytes can only be careted with Bytes, String or Table")
+		return nil
+	}
+}
+
+// slice returns b[from:to]. Empty from and to mean the start and the end.
+func (b *Bytes) slice(from, to string) (*Bytes, error) {
+	i, j := 0, len(*b)
+	var err error
+	if from != "" {
+		if i, err = strconv.Atoi(from); err != nil {
+			return nil, fmt.Errorf("bad slice index: %s", from)
+		}
+	}
+	if to != "" {
+		if j, err = strconv.Atoi(to); err != nil {
+			return nil, fmt.Errorf("bad slice index: %s", to)
+		}
+	}
+	if i < 0 || j > len(*b) || i > j {
+		return nil, fmt.Errorf("slice out of range: %d:%d", i, j)
+	}
+	return NewBytes((*b)[i:j]), nil
+}
+
+// MarshalJSON serializes Bytes to a base64 string, like encoding/json does
+// for []byte.
+func (b *Bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]byte(*b))
+}
+
+// toBytes converts a Bytes or a String to a byte slice.
+func toBytes(v Value) ([]byte, bool) {
+	switch v := v.(type) {
+	case *Bytes:
+		return *v, true
+	case *String:
+		return []byte(*v), true
+	}
+	return nil, false
+}
+
+// readBytes reads n bytes from the input, or all of it if n is not given, and
+// outputs them as a Bytes. Fewer bytes are only output at the end of input.
+func readBytes(ev *Evaluator, args []Value) string {
+	in := ev.ports[0].f
+	out := ev.ports[1].ch
+	var data []byte
+	var err error
+	switch len(args) {
+	case 0:
+		data, err = ioutil.ReadAll(in)
+	case 1:
+		n, e := strconv.Atoi(args[0].String())
+		if e != nil || n < 0 {
+			return "byte count must be a non-negative integer"
+		}
+		data = make([]byte, n)
+		var m int
+		m, err = io.ReadFull(in, data)
+		data = data[:m]
+		if err == io.ErrUnexpectedEOF || (err == io.EOF && n > 0) {
+			err = nil
+		}
+	default:
+		return "args error"
+	}
+	if err != nil {
+		return err.Error()
+	}
+	out <- NewBytes(data)
+	return ""
+}
+
+// writeBytes writes Bytes or Strings to the output without any separator.
+func writeBytes(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].f
+	for _, a := range args {
+		b, ok := toBytes(a)
+		if !ok {
+			return "args error"
+		}
+		if _, err := out.Write(b); err != nil {
+			return err.Error()
+		}
+	}
+	return ""
+}
+
+// bytesConverter makes a builtin converting each argument with f, which
+// takes the argument as a byte slice.
+func bytesConverter(f func([]byte) (Value, error)) func(*Evaluator, []Value) string {
+	return func(ev *Evaluator, args []Value) string {
+		out := ev.ports[1].ch
+		for _, a := range args {
+			b, ok := toBytes(a)
+			if !ok {
+				return "args error"
+			}
+			v, err := f(b)
+			if err != nil {
+				return err.Error()
+			}
+			out <- v
+		}
+		return ""
+	}
+}
+
+var (
+	bytesFromString = bytesConverter(func(b []byte) (Value, error) {
+		return NewBytes(b), nil
+	})
+	bytesToString = bytesConverter(func(b []byte) (Value, error) {
+		if !utf8.Valid(b) {
+			return nil, errors.New("bytes are not valid UTF-8")
+		}
+		return NewString(string(b)), nil
+	})
+	bytesToHex = bytesConverter(func(b []byte) (Value, error) {
+		return NewString(hex.EncodeToString(b)), nil
+	})
+	bytesFromHex = bytesConverter(func(b []byte) (Value, error) {
+		data, err := hex.DecodeString(string(b))
+		return NewBytes(data), err
+	})
+	bytesToBase64 = bytesConverter(func(b []byte) (Value, error) {
+		return NewString(base64.StdEncoding.EncodeToString(b)), nil
+	})
+	bytesFromBase64 = bytesConverter(func(b []byte) (Value, error) {
+		data, err := base64.StdEncoding.DecodeString(string(b))
+		return NewBytes(data), err
+	})
+	bytesLen = bytesConverter(func(b []byte) (Value, error) {
+		return NewString(strconv.Itoa(len(b))), nil
+	})
+)
+
+// bytesCompare outputs -1, 0 or 1 when the first argument is less than,
+// equal to or greater than the second, comparing bytes.
+func bytesCompare(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	if len(args) != 2 {
+		return "args error"
+	}
+	a, ok1 := toBytes(args[0])
+	b, ok2 := toBytes(args[1])
+	if !ok1 || !ok2 {
+		return "args error"
+	}
+	out <- NewString(strconv.Itoa(bytes.Compare(a, b)))
+	return ""
+}
+
+// bytesSlice outputs a slice of bytes, e.g.
+//
+// bytes:slice $b 1 3
+//
+// The end may be omitted.
+func bytesSlice(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	if len(args) != 2 && len(args) != 3 {
+		return "args error"
+	}
+	b, ok := toBytes(args[0])
+	if !ok {
+		return "args error"
+	}
+	to := ""
+	if len(args) == 3 {
+		to = args[2].String()
+	}
+	slice, err := NewBytes(b).slice(args[1].String(), to)
+	if err != nil {
+		return err.Error()
+	}
+	out <- slice
+	return ""
+}
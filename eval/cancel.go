@@ -0,0 +1,140 @@
+package eval
+
+// Cancelling evaluation. Eval can be given a context with EvalContext, e.g.
+// one with a deadline:
+//
+//	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+//	defer cancel()
+//	err := ev.EvalContext(ctx, name, text, n)
+//
+// Once the context is done, forms are no longer started, external commands
+// being waited for are killed, and builtins that loop, like range and each,
+// stop. The evaluation then returns an error about the node that was
+// executing when the context was done.
+//
+// An evaluation is also stopped this way when it goes past a limit that an
+// enclosing closure can't be expected to recover from, like $options[max-depth].
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/xiaq/elvish/parse"
+	"github.com/xiaq/elvish/util"
+)
+
+// errCanceled is thrown where a cancellation is noticed. It is not printed,
+// since the error about where the evaluation was is returned at the top
+// level.
+var errCanceled = errors.New("evaluation canceled")
+
+// cancelState is shared by an Evaluator and its copies for an evaluation at
+// the top level.
+type cancelState struct {
+	ctx     context.Context
+	stopped int32 // Set when err is.
+	mutex   sync.Mutex
+	err     error // Why the evaluation was stopped, about where it was.
+}
+
+// EvalContext is like Eval, but stops evaluating when ctx is done.
+func (ev *Evaluator) EvalContext(ctx context.Context, name, text string, n *parse.ChunkNode) error {
+	return ev.withCancelState(ctx, func() error {
+		return ev.Eval(name, text, n)
+	})
+}
+
+// withCancelState calls f with a new cancelState for ctx, returning the
+// error the evaluation has been stopped with, if any, instead of that of f.
+func (ev *Evaluator) withCancelState(ctx context.Context, f func() error) error {
+	old := ev.cancel
+	cs := &cancelState{ctx: ctx}
+	ev.cancel = cs
+	defer func() { ev.cancel = old }()
+	err := f()
+	if serr := cs.error(); serr != nil {
+		return serr
+	}
+	return err
+}
+
+// canceled returns whether the evaluation has been canceled.
+func (ev *Evaluator) canceled() bool {
+	cs := ev.cancel
+	return cs != nil && (atomic.LoadInt32(&cs.stopped) != 0 || cs.ctx.Err() != nil)
+}
+
+// checkCanceled throws errCanceled if the evaluation has been canceled,
+// recording the node being evaluated if it is the first to notice.
+func (ev *Evaluator) checkCanceled() {
+	if !ev.canceled() {
+		return
+	}
+	ev.cancel.record(ev)
+	util.Panic(errCanceled)
+}
+
+// stop stops the evaluation with an error about the node being evaluated,
+// like a cancellation. Outside of evaluations at the top level, it throws the
+// error instead.
+func (ev *Evaluator) stop(format string, args ...interface{}) {
+	if ev.cancel == nil {
+		ev.errorf(format, args...)
+	}
+	ev.cancel.stop(ev.errorAtNode(format, args...))
+	util.Panic(errCanceled)
+}
+
+// errorAtNode returns the error about the node being evaluated that errorf
+// would throw.
+func (ev *Evaluator) errorAtNode(format string, args ...interface{}) (err error) {
+	defer util.Recover(&err)
+	ev.errorf(format, args...)
+	return nil
+}
+
+// record records the error about the node of ev being evaluated when ctx was
+// done.
+func (cs *cancelState) record(ev *Evaluator) {
+	msg := "evaluation canceled"
+	if cs.ctx.Err() == context.DeadlineExceeded {
+		msg = "evaluation timed out"
+	}
+	cs.stop(ev.errorAtNode("%s", msg))
+}
+
+// stop records why the evaluation has been stopped, unless that has been
+// recorded already.
+func (cs *cancelState) stop(err error) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	if cs.err == nil {
+		cs.err = err
+		atomic.StoreInt32(&cs.stopped, 1)
+	}
+}
+
+func (cs *cancelState) error() error {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	return cs.err
+}
+
+// killOnCancel kills the external command with the given pid if the
+// evaluation is canceled before exited is closed.
+func (ev *Evaluator) killOnCancel(pid int, exited <-chan struct{}) {
+	if ev.cancel == nil || ev.cancel.ctx.Done() == nil {
+		return
+	}
+	go func() {
+		select {
+		case <-exited:
+		case <-ev.cancel.ctx.Done():
+			ev.cancel.record(ev)
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}()
+}
@@ -0,0 +1,137 @@
+package eval
+
+// Checking code without evaluating it, for the editor and for tools like
+// linters.
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/xiaq/elvish/parse"
+	"github.com/xiaq/elvish/util"
+)
+
+// Severity is how serious a problem found by Check is.
+type Severity int
+
+// Severity constants.
+const (
+	// SeverityError is for code that can't be evaluated.
+	SeverityError Severity = iota
+	// SeverityWarning is for code that can't be evaluated as it is, but may
+	// become valid when more is written, like code with an open brace.
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	default:
+		return fmt.Sprintf("Severity(%d)", int(s))
+	}
+}
+
+// Diagnostic is a problem found by Check.
+type Diagnostic struct {
+	// Begin and End are the byte offsets of the code the problem is about,
+	// which is the token where it was found.
+	Begin, End int
+	Severity   Severity
+	Message    string
+}
+
+// Check parses and compiles text against scope, which maps the names of the
+// variables defined to their types, and returns the problems found, in the
+// order of their positions. Nothing is evaluated, and the state of the
+// Compiler, like options set at the top level, is left alone. The code is
+// only compiled if it is free of syntax errors.
+func (cp *Compiler) Check(name, text string, scope map[string]Type) []Diagnostic {
+	n, errs := parse.ParseTolerant(name, text)
+	var warnings []*util.ContextualError
+	if len(errs) == 0 {
+		scratch := cp.scratch()
+		_, err := scratch.CompileAll(name, text, n, scope)
+		switch err := err.(type) {
+		case nil:
+		case util.Errors:
+			errs = err
+		default:
+			errs = util.Errors{err}
+		}
+		warnings = scratch.Warnings()
+	}
+	diags := make([]Diagnostic, 0, len(errs)+len(warnings))
+	for _, err := range errs {
+		diags = append(diags, diagnose(name, text, err))
+	}
+	for _, w := range warnings {
+		diags = append(diags, Diagnostic{w.Pos, tokenEnd(name, text, w.Pos), SeverityWarning, w.Message()})
+	}
+	sort.SliceStable(diags, func(i, j int) bool { return diags[i].Begin < diags[j].Begin })
+	return diags
+}
+
+// scratch returns a copy of cp for checking code, with its own aliases and
+// default redirections, which compiling may change, and an empty cache.
+func (cp *Compiler) scratch() *Compiler {
+	scratch := &Compiler{options: cp.options}
+	if cp.aliases != nil {
+		scratch.aliases = make(map[string][]string, len(cp.aliases))
+		for name, words := range cp.aliases {
+			scratch.aliases[name] = words
+		}
+	}
+	if cp.defaultRedirs != nil {
+		scratch.defaultRedirs = make(map[string][]defaultRedir, len(cp.defaultRedirs))
+		for cmd, drs := range cp.defaultRedirs {
+			scratch.defaultRedirs[cmd] = drs
+		}
+	}
+	return scratch
+}
+
+// Check checks text against the variables and functions defined in ev, like
+// Compiler.Check.
+func (ev *Evaluator) Check(name, text string) []Diagnostic {
+	return ev.Compiler.Check(name, text, ev.MakeCompilerScope())
+}
+
+func diagnose(name, text string, err error) Diagnostic {
+	ce, ok := err.(*util.ContextualError)
+	if !ok {
+		return Diagnostic{0, len(text), SeverityError, err.Error()}
+	}
+	severity := SeverityError
+	if ce.Incomplete {
+		severity = SeverityWarning
+	}
+	return Diagnostic{ce.Pos, tokenEnd(name, text, ce.Pos), severity, ce.Message()}
+}
+
+// tokenEnd returns the end of the token at pos, which is cut at the end of the
+// line. A variable, like $x, counts as one token.
+func tokenEnd(name, text string, pos int) int {
+	if pos >= len(text) {
+		return len(text)
+	}
+	eol := pos + util.FindFirstEOL(text[pos:])
+	end := eol
+	var items []parse.Item
+	// Drain the lexer, so that it terminates.
+	for item := range parse.LexEmbedded(name, text, pos, eol).Chan() {
+		items = append(items, item)
+	}
+	if len(items) > 1 && items[0].Typ == parse.ItemDollar && items[1].Typ == parse.ItemBare {
+		items = items[1:]
+	}
+	if len(items) > 0 && items[0].Typ != parse.ItemError && items[0].Typ != parse.ItemEOF {
+		end = int(items[0].Pos) + len(items[0].Val)
+	}
+	if end > eol || end <= pos {
+		end = eol
+	}
+	return end
+}
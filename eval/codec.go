@@ -0,0 +1,169 @@
+package eval
+
+// Builtins encoding and compressing byte input to byte output, e.g.
+//
+// cat image.png | gzip:compress | base64:encode
+// put $blob | base64:decode | gzip:decompress > data
+//
+// The input is processed as it is read, so that large inputs are not
+// buffered. The encoders end their output with a newline, and the decoders
+// ignore whitespace in their input, so that encoded data can be kept in
+// strings and files like any other text. zstd is not supported, since there
+// is no implementation in the standard library.
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+func init() {
+	// Needed to avoid initialization loop
+	builtinFuncs["base64:encode"] = builtinFunc{base64Encode, [2]StreamType{fdStream, fdStream}}
+	builtinFuncs["base64:decode"] = builtinFunc{base64Decode, [2]StreamType{fdStream, fdStream}}
+	builtinFuncs["hex:encode"] = builtinFunc{hexEncode, [2]StreamType{fdStream, fdStream}}
+	builtinFuncs["hex:decode"] = builtinFunc{hexDecode, [2]StreamType{fdStream, fdStream}}
+	builtinFuncs["gzip:compress"] = builtinFunc{gzipCompress, [2]StreamType{fdStream, fdStream}}
+	builtinFuncs["gzip:decompress"] = builtinFunc{gzipDecompress, [2]StreamType{fdStream, fdStream}}
+}
+
+// encodeStream copies the input to an encoder writing to the output, made by
+// newEncoder, and ends the output with a newline if there was any input.
+func encodeStream(ev *Evaluator, newEncoder func(io.Writer) io.WriteCloser) string {
+	out := bufio.NewWriter(ev.ports[1].f)
+	enc := newEncoder(out)
+	n, err := io.Copy(enc, ev.ports[0].f)
+	if err == nil {
+		err = enc.Close()
+	}
+	if err == nil && n > 0 {
+		err = out.WriteByte('\n')
+	}
+	if err == nil {
+		err = out.Flush()
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// decodeStream copies the input, without whitespace, through a decoder made
+// by newDecoder to the output.
+func decodeStream(ev *Evaluator, newDecoder func(io.Reader) io.Reader) string {
+	in := &nonSpaceReader{bufio.NewReader(ev.ports[0].f)}
+	if _, err := io.Copy(ev.ports[1].f, newDecoder(in)); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// nonSpaceReader reads from r, skipping ASCII whitespace.
+type nonSpaceReader struct {
+	r io.Reader
+}
+
+func (r *nonSpaceReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.r.Read(p)
+		j := 0
+		for _, b := range p[:n] {
+			switch b {
+			case ' ', '\t', '\n', '\r':
+			default:
+				p[j] = b
+				j++
+			}
+		}
+		if j > 0 || err != nil {
+			return j, err
+		}
+	}
+}
+
+// nopCloser makes an io.Writer an io.WriteCloser whose Close does nothing.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+func base64Encode(ev *Evaluator, args []Value) string {
+	if len(args) > 0 {
+		return "args error"
+	}
+	return encodeStream(ev, func(w io.Writer) io.WriteCloser {
+		return base64.NewEncoder(base64.StdEncoding, w)
+	})
+}
+
+func base64Decode(ev *Evaluator, args []Value) string {
+	if len(args) > 0 {
+		return "args error"
+	}
+	return decodeStream(ev, func(r io.Reader) io.Reader {
+		return base64.NewDecoder(base64.StdEncoding, r)
+	})
+}
+
+func hexEncode(ev *Evaluator, args []Value) string {
+	if len(args) > 0 {
+		return "args error"
+	}
+	return encodeStream(ev, func(w io.Writer) io.WriteCloser {
+		return nopCloser{hex.NewEncoder(w)}
+	})
+}
+
+func hexDecode(ev *Evaluator, args []Value) string {
+	if len(args) > 0 {
+		return "args error"
+	}
+	return decodeStream(ev, hex.NewDecoder)
+}
+
+// gzipCompress implements gzip:compress, which takes an optional compression
+// level from 1 (fastest) to 9 (smallest), like gzip -1 to -9.
+func gzipCompress(ev *Evaluator, args []Value) string {
+	level := gzip.DefaultCompression
+	switch len(args) {
+	case 0:
+	case 1:
+		i, err := strconv.Atoi(args[0].String())
+		if err != nil || i < gzip.BestSpeed || i > gzip.BestCompression {
+			return fmt.Sprintf("bad compression level %s", args[0].Repr())
+		}
+		level = i
+	default:
+		return "args error"
+	}
+	out := ev.ports[1].f
+	w, _ := gzip.NewWriterLevel(out, level)
+	_, err := io.Copy(w, ev.ports[0].f)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func gzipDecompress(ev *Evaluator, args []Value) string {
+	if len(args) > 0 {
+		return "args error"
+	}
+	r, err := gzip.NewReader(bufio.NewReader(ev.ports[0].f))
+	if err != nil {
+		return err.Error()
+	}
+	defer r.Close()
+	if _, err := io.Copy(ev.ports[1].f, r); err != nil {
+		return err.Error()
+	}
+	return ""
+}
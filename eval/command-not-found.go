@@ -0,0 +1,37 @@
+package eval
+
+// The hook called when an external command is not found.
+
+// commandNotFound is called when the command of a form is not found in the
+// search paths. It calls $command-not-found-hook with the name of the command
+// and a table of the arguments, and searches for the command again, so that
+// the hook can suggest similar commands, or offer to install the command and
+// have it run, e.g.
+//
+//	command-not-found-hook = {|name args|
+//		echo $name: command not found, did you mean (similar $name)?
+//	}
+//
+// The hook is not called again for commands not found while it runs. It
+// returns the path of the command, or the error of the search when it is
+// still not found.
+func (ev *Evaluator) commandNotFound(name string, args []Value, err error) (string, error) {
+	if ev.notFound == nil {
+		return "", err
+	}
+	hook, ok := ev.notFound.Get().(*Closure)
+	if !ok || hook.Op == nil {
+		return "", err
+	}
+
+	argv := NewTable()
+	argv.append(args...)
+	newEv := ev.copy()
+	defer newEv.releasePorts()
+	newEv.notFound = nil
+	hookArgs := hookArgs("command-not-found-hook", hook, []Value{NewString(name), argv})
+	if msg := newEv.callClosure(hook, hookArgs); msg != "" {
+		ev.errorf("command-not-found hook: %s", msg)
+	}
+	return ev.search(name)
+}
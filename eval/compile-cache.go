@@ -0,0 +1,116 @@
+package eval
+
+// Caching of compiled chunks, so that evaluating the same text again, like
+// that of a prompt or of a command run in a loop, doesn't parse and compile it
+// again.
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/xiaq/elvish/parse"
+)
+
+// maxCompileCache is the number of chunks kept in the compile cache. When it
+// is full, the cache is emptied.
+const maxCompileCache = 256
+
+// builtinsGeneration is incremented whenever builtins are added, since that
+// changes how commands are resolved.
+var builtinsGeneration int
+
+// compileKey identifies a compilation. The result of compiling a chunk only
+// depends on its text, the names and types of the variables in scope, the
+// options at the start, and the builtins; the default redirections also
+// matter, but the cache is emptied when they change.
+type compileKey struct {
+	text       string
+	scope      string
+	options    shellOptions
+	generation int
+}
+
+// compiledChunk is a cached compilation. options are the top-level options
+// after the chunk, which may be changed by set-option.
+type compiledChunk struct {
+	op      Op
+	options shellOptions
+}
+
+// scopeShape returns a string determined by the names and types of the
+// variables in scope.
+func scopeShape(scope map[string]Type) string {
+	names := make([]string, 0, len(scope))
+	for name := range scope {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf := new(bytes.Buffer)
+	for _, name := range names {
+		fmt.Fprintf(buf, "%s %#v\n", name, scope[name])
+	}
+	return buf.String()
+}
+
+func (cp *Compiler) compileKey(text string, scope map[string]Type) compileKey {
+	return compileKey{text, scopeShape(scope), cp.options, getBuiltinsGeneration()}
+}
+
+// cached looks up a compilation in the cache. If found, the options it sets
+// are applied.
+func (cp *Compiler) cached(key compileKey) (Op, bool) {
+	c, ok := cp.cache[key]
+	if !ok {
+		return nil, false
+	}
+	cp.options = c.options
+	return c.op, true
+}
+
+func (cp *Compiler) addCache(key compileKey, op Op) {
+	if cp.cache == nil || len(cp.cache) >= maxCompileCache {
+		cp.cache = make(map[compileKey]compiledChunk)
+	}
+	cp.cache[key] = compiledChunk{op, cp.options}
+}
+
+// CompileCached is like Compile, but a chunk compiled before with the same
+// text in a scope of the same shape is not compiled again.
+func (cp *Compiler) CompileCached(name, text string, n *parse.ChunkNode, scope map[string]Type) (Op, error) {
+	key := cp.compileKey(text, scope)
+	if op, ok := cp.cached(key); ok {
+		// Warnings were shown when it was compiled.
+		cp.warnings = nil
+		return op, nil
+	}
+	op, err := cp.Compile(name, text, n, scope)
+	if err != nil {
+		return nil, err
+	}
+	cp.addCache(key, op)
+	return op, nil
+}
+
+// EvalText is like Eval, but parses text itself. Neither parsing nor
+// compiling is done again for text evaluated before in a scope of the same
+// shape.
+func (ev *Evaluator) EvalText(name, text string) error {
+	ev.pullShared()
+	scope := ev.MakeCompilerScope()
+	key := ev.Compiler.compileKey(text, scope)
+	op, ok := ev.Compiler.cached(key)
+	if !ok {
+		n, err := parse.Parse(name, text)
+		if err != nil {
+			return err
+		}
+		op, err = ev.Compiler.Compile(name, text, n, scope)
+		if err != nil {
+			return err
+		}
+		ev.Compiler.addCache(key, op)
+		ev.printWarnings()
+	}
+	return ev.evalOp(name, text, op)
+}
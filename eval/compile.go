@@ -3,6 +3,7 @@ package eval
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/xiaq/elvish/parse"
 	"github.com/xiaq/elvish/util"
@@ -10,14 +11,25 @@ import (
 
 // Compiler compiles an Elvish AST into an Op.
 type Compiler struct {
+	defaultRedirs map[string][]defaultRedir
+	aliases       map[string][]string
+	options       shellOptions // Options set at the top level.
+	cache         map[compileKey]compiledChunk
 	compilerEphemeral
 }
 
 // compilerEphemeral wraps the ephemeral parts of a Compiler.
 type compilerEphemeral struct {
-	name, text string
-	scopes     []map[string]Type
-	enclosed   map[string]Type
+	name, text  string
+	scopes      []map[string]Type
+	optionStack []shellOptions // Options of each scope
+	enclosed    map[string]Type
+	previewing  bool
+	collecting  bool        // Whether errors are collected in errors.
+	errors      util.Errors // Errors collected so far.
+	// API version declared with shell:api-version; 0 if none.
+	declaredAPIVersion int
+	warnings           []*util.ContextualError
 }
 
 func NewCompiler() *Compiler {
@@ -26,23 +38,44 @@ func NewCompiler() *Compiler {
 
 func (cp *Compiler) startCompile(name, text string, scope map[string]Type) {
 	cp.compilerEphemeral = compilerEphemeral{
-		name, text, []map[string]Type{scope}, make(map[string]Type),
+		name: name, text: text,
+		scopes: []map[string]Type{scope}, enclosed: make(map[string]Type),
+		optionStack: []shellOptions{cp.options},
 	}
 }
 
 func (cp *Compiler) Compile(name, text string, n *parse.ChunkNode, scope map[string]Type) (op Op, err error) {
 	cp.startCompile(name, text, scope)
 	defer util.Recover(&err)
-	return cp.compileChunk(n), nil
+	op = cp.compileChunk(n)
+	cp.options = cp.optionStack[0]
+	return op, nil
+}
+
+// CompileAll is like Compile, but does not stop at the first error. Instead,
+// all pipelines in the chunk are compiled, and the errors of those that fail
+// are returned together as a util.Errors.
+func (cp *Compiler) CompileAll(name, text string, n *parse.ChunkNode, scope map[string]Type) (op Op, err error) {
+	cp.startCompile(name, text, scope)
+	cp.collecting = true
+	defer util.Recover(&err)
+	op = cp.compileChunk(n)
+	if len(cp.errors) > 0 {
+		return nil, cp.errors
+	}
+	cp.options = cp.optionStack[0]
+	return op, nil
 }
 
 func (cp *Compiler) pushScope() {
 	cp.scopes = append(cp.scopes, make(map[string]Type))
+	cp.optionStack = append(cp.optionStack, *cp.opts())
 }
 
 func (cp *Compiler) popScope() {
 	cp.scopes[len(cp.scopes)-1] = nil
 	cp.scopes = cp.scopes[:len(cp.scopes)-1]
+	cp.optionStack = cp.optionStack[:len(cp.optionStack)-1]
 }
 
 func (cp *Compiler) pushVar(name string, t Type) {
@@ -65,20 +98,53 @@ func (cp *Compiler) errorf(n parse.Node, format string, args ...interface{}) {
 func (cp *Compiler) compileChunk(cn *parse.ChunkNode) Op {
 	ops := make([]valuesOp, len(cn.Nodes))
 	for i, pn := range cn.Nodes {
-		ops[i], _ = cp.compilePipeline(pn)
+		ops[i], _ = cp.compileChunkPipeline(pn)
 	}
 	return combineChunk(ops)
 }
 
 func (cp *Compiler) compileClosure(cn *parse.ClosureNode) (valuesOp, map[string]Type, [2]StreamType) {
+	var argNames []string
+	var restArg string
+	if cn.ArgNames != nil {
+		for i, tn := range cn.ArgNames.Nodes {
+			if len(tn.Nodes) != 1 || tn.Nodes[0].Typ != parse.StringFactor {
+				cp.errorf(tn, "argument name must be a string literal")
+			}
+			name := tn.Nodes[0].Node.(*parse.StringNode).Text
+			if strings.HasPrefix(name, "@") {
+				if i != len(cn.ArgNames.Nodes)-1 {
+					cp.errorf(tn, "rest argument must come last")
+				}
+				restArg = name[1:]
+				break
+			}
+			argNames = append(argNames, name)
+		}
+	}
+	return cp.compileClosureBody(cn, argNames, restArg)
+}
+
+// compileClosureBody compiles the chunk of a closure, with the given argument
+// names in its scope. The argument names in cn are ignored.
+func (cp *Compiler) compileClosureBody(cn *parse.ClosureNode, argNames []string, restArg string) (valuesOp, map[string]Type, [2]StreamType) {
 	ops := make([]valuesOp, len(cn.Chunk.Nodes))
 
+	outerEnclosed := cp.enclosed
+	cp.enclosed = make(map[string]Type)
 	cp.pushScope()
 
+	for _, name := range argNames {
+		cp.pushVar(name, AnyType{})
+	}
+	if restArg != "" {
+		cp.pushVar(restArg, TableType{})
+	}
+
 	bounds := [2]StreamType{}
 	for i, pn := range cn.Chunk.Nodes {
 		var b [2]StreamType
-		ops[i], b = cp.compilePipeline(pn)
+		ops[i], b = cp.compileChunkPipeline(pn)
 
 		var ok bool
 		bounds[0], ok = bounds[0].commonType(b[0])
@@ -92,10 +158,39 @@ func (cp *Compiler) compileClosure(cn *parse.ClosureNode) (valuesOp, map[string]
 	}
 
 	enclosed := cp.enclosed
-	cp.enclosed = make(map[string]Type)
+	cp.enclosed = outerEnclosed
 	cp.popScope()
+	// Variables enclosed by this closure that live outside the enclosing
+	// closure are enclosed by the latter too.
+	for name := range enclosed {
+		cp.tryResolveVar(name)
+	}
+
+	return combineClosure(argNames, restArg, ops, enclosed, bounds, cp.apiVersion()), enclosed, bounds
+}
 
-	return combineClosure(ops, enclosed, bounds), enclosed, bounds
+// compileChunkPipeline compiles a pipeline in a chunk. When collecting errors,
+// an error in the pipeline is recorded and the compiler state restored, so
+// that the compiling can go on with the next pipeline.
+func (cp *Compiler) compileChunkPipeline(pn *parse.PipelineNode) (op valuesOp, b [2]StreamType) {
+	if !cp.collecting {
+		op, b = cp.compilePipeline(pn)
+		return cp.withErrexit(pn, op), b
+	}
+	nscopes, enclosed := len(cp.scopes), cp.enclosed
+	err := func() (err error) {
+		defer util.Recover(&err)
+		op, b = cp.compilePipeline(pn)
+		return nil
+	}()
+	if err != nil {
+		cp.errors = append(cp.errors, err)
+		cp.scopes = cp.scopes[:nscopes]
+		cp.optionStack = cp.optionStack[:nscopes]
+		cp.enclosed = enclosed
+		return op, b
+	}
+	return cp.withErrexit(pn, op), b
 }
 
 func (cp *Compiler) compilePipeline(pn *parse.PipelineNode) (valuesOp, [2]StreamType) {
@@ -113,7 +208,11 @@ func (cp *Compiler) compilePipeline(pn *parse.PipelineNode) (valuesOp, [2]Stream
 		} else {
 			internal, ok := lastOutput.commonType(input)
 			if !ok {
-				cp.errorf(fn, "Form input type %v insatisfiable - previous form output is type %v", input, lastOutput)
+				if lastOutput == fdStream {
+					internal = fdToChanStream
+				} else {
+					internal = chanToFdStream
+				}
 			}
 			internals[i-1] = internal
 		}
@@ -135,6 +234,9 @@ func (cp *Compiler) tryResolveVar(name string) Type {
 	thisScope := len(cp.scopes) - 1
 	for i := thisScope; i >= 0; i-- {
 		if t := cp.scopes[i][name]; t != nil {
+			if ct, ok := t.(constType); ok {
+				t = ct.Type
+			}
 			if i < thisScope {
 				cp.enclosed[name] = t
 			}
@@ -144,21 +246,41 @@ func (cp *Compiler) tryResolveVar(name string) Type {
 	return nil
 }
 
+// constType marks the type of a read-only variable in the scopes of the
+// compiler. tryResolveVar sees through it.
+type constType struct {
+	Type
+}
+
+// checkWritable makes sure that the variable name, which has been resolved,
+// is not read-only.
+func (cp *Compiler) checkWritable(name string, n parse.Node) {
+	for i := len(cp.scopes) - 1; i >= 0; i-- {
+		if t, ok := cp.scopes[i][name]; ok {
+			if _, ok := t.(constType); ok {
+				cp.errorf(n, "variable $%s is read-only", name)
+			}
+			return
+		}
+	}
+}
+
 func (cp *Compiler) resolveCommand(name string, fa *formAnnotation) {
-	if ct, ok := cp.tryResolveVar("fn-" + name).(*ClosureType); ok {
+	special, fn := lookupBuiltin(name)
+	if ct, ok := cp.tryResolveVar("fn-" + name).(ClosureType); ok {
 		// Defined function
 		fa.commandType = commandDefinedFunction
 		fa.streamTypes = ct.Bounds
-	} else if bi, ok := builtinSpecials[name]; ok {
+	} else if special != nil && cp.inLangVersion(name) {
 		// Builtin special
 		fa.commandType = commandBuiltinSpecial
-		fa.streamTypes = bi.streamTypes
-		fa.builtinSpecial = &bi
-	} else if bi, ok := builtinFuncs[name]; ok {
+		fa.streamTypes = special.streamTypes
+		fa.builtinSpecial = special
+	} else if fn != nil && cp.inLangVersion(name) {
 		// Builtin func
 		fa.commandType = commandBuiltinFunction
-		fa.streamTypes = bi.streamTypes
-		fa.builtinFunc = &bi
+		fa.streamTypes = fn.streamTypes
+		fa.builtinFunc = fn
 	} else {
 		// External command
 		fa.commandType = commandExternal
@@ -167,23 +289,47 @@ func (cp *Compiler) resolveCommand(name string, fa *formAnnotation) {
 }
 
 func (cp *Compiler) compileForm(fn *parse.FormNode) (stateUpdatesOp, [2]StreamType) {
-	// TODO(xiaq): Allow more interesting terms to be used as commands
-	msg := "command must be a string or closure"
-	if len(fn.Command.Nodes) != 1 {
-		cp.errorf(fn.Command, msg)
+	if !cp.isAssignment(fn) {
+		if temps, rest := cp.compileTempAssignments(fn); temps != nil {
+			op, b := cp.compileForm(rest)
+			return withTempAssignments(temps, op), b
+		}
+		fn = cp.expandAliasForm(fn)
 	}
-	command := fn.Command.Nodes[0]
-	cmdOp, pbounds := cp.compileFactor(command)
 
-	annotation := &formAnnotation{}
-	switch command.Typ {
-	case parse.StringFactor:
-		cp.resolveCommand(command.Node.(*parse.StringNode).Text, annotation)
-	case parse.ClosureFactor:
-		annotation.commandType = commandClosure
-		annotation.streamTypes = *pbounds
-	default:
-		cp.errorf(fn.Command, msg)
+	annotation := &formAnnotation{xtrace: cp.opts().xtrace}
+	var cmdOp valuesOp
+	var cmdName string
+
+	if cp.isAssignment(fn) {
+		// An assignment form is a builtin special without a command name.
+		annotation.commandType = commandBuiltinSpecial
+		annotation.streamTypes = assignmentSpecial.streamTypes
+		annotation.builtinSpecial = &assignmentSpecial
+		cmdOp = makeString("=")
+	} else {
+		// TODO(xiaq): Allow more interesting terms to be used as commands
+		msg := "command must be a string or closure"
+		if len(fn.Command.Nodes) != 1 {
+			cp.errorf(fn.Command, "%s", msg)
+		}
+		command := fn.Command.Nodes[0]
+		var pbounds *[2]StreamType
+		cmdOp, pbounds = cp.compileFactor(command)
+
+		switch command.Typ {
+		case parse.StringFactor:
+			cmdName = command.Node.(*parse.StringNode).Text
+			cp.resolveCommand(cmdName, annotation)
+			if annotation.commandType != commandExternal {
+				cp.checkDeprecated(cmdName, command)
+			}
+		case parse.ClosureFactor:
+			annotation.commandType = commandClosure
+			annotation.streamTypes = *pbounds
+		default:
+			cp.errorf(fn.Command, "%s", msg)
+		}
 	}
 
 	var nports uintptr
@@ -206,11 +352,16 @@ func (cp *Compiler) compileForm(fn *parse.FormNode) (stateUpdatesOp, [2]StreamTy
 				if annotation.streamTypes[fd] == chanStream {
 					cp.errorf(rd, "filename redir on channel port")
 				}
+			case *parse.HereRedir:
+				if annotation.streamTypes[fd] == chanStream {
+					cp.errorf(rd, "here-document on channel port")
+				}
 			}
 			annotation.streamTypes[fd] = unusedStream
 		}
 		ports[fd] = cp.compileRedir(rd)
 	}
+	ports = cp.applyDefaultRedirs(cmdName, ports, annotation)
 
 	var tlist valuesOp
 	if annotation.commandType == commandBuiltinSpecial {
@@ -230,23 +381,56 @@ func (cp *Compiler) compileRedir(r parse.Redir) portOp {
 	case *parse.FdRedir:
 		oldFd := int(r.OldFd)
 		return func(ev *Evaluator) *port {
-			// Copied ports have shouldClose unmarked to avoid double close on
-			// channels
-			p := *ev.port(oldFd)
-			p.shouldClose = false
-			return &p
+			p := ev.port(oldFd)
+			p.retain()
+			return p
 		}
 	case *parse.FilenameRedir:
 		fnameOp := cp.compileTerm(r.Filename)
+		flag := r.Flag
+		noclobber := cp.noclobber(r)
 		return func(ev *Evaluator) *port {
-			fname := string(*ev.asSingleString(
-				r.Filename, fnameOp.f(ev), "filename"))
+			vs := fnameOp.f(ev)
+			if len(vs) == 1 {
+				if f, ok := vs[0].(*File); ok {
+					if f.isClosed() {
+						ev.errorfNode(r, "file %s closed", quote(f.name))
+					}
+					return newValueFilePort(f)
+				}
+			}
+			fname := string(*ev.asSingleString(r.Filename, vs, "filename"))
+			if writesFile(flag) {
+				ev.checkRestricted(r, fname, writingFiles)
+			}
 			// TODO haz hardcoded permbits now
-			f, e := os.OpenFile(fname, r.Flag, 0644)
+			open := os.OpenFile
+			if noclobber {
+				open = openNoclobber
+			}
+			f, e := open(fname, flag, 0644)
 			if e != nil {
 				ev.errorfNode(r, "failed to open file %q: %s", fname[0], e)
 			}
-			return &port{f: f, shouldClose: true}
+			return newFilePort(f)
+		}
+	case *parse.HereRedir:
+		textOp := cp.compileTerm(r.Text)
+		return func(ev *Evaluator) *port {
+			text := ev.asSingleValue(r.Text, textOp.f(ev), "here-document").String()
+			if r.Newline {
+				text += "\n"
+			}
+			pr, pw, err := os.Pipe()
+			if err != nil {
+				ev.errorfNode(r, "failed to create pipe: %s", err)
+			}
+			// The write fails when the command exits without reading it all.
+			go func() {
+				pw.WriteString(text)
+				pw.Close()
+			}()
+			return newFilePort(pr)
 		}
 	default:
 		panic("bad Redir type")
@@ -268,19 +452,68 @@ func (cp *Compiler) compileTermList(ln *parse.TermListNode) valuesOp {
 func (cp *Compiler) compileTerm(tn *parse.TermNode) valuesOp {
 	ops := make([]valuesOp, len(tn.Nodes))
 	for i, fn := range tn.Nodes {
+		if i == 0 && isBareString(fn) && strings.HasPrefix(fn.Node.(*parse.StringNode).Text, "~") {
+			ops[i] = compileTilde(fn.Node.(*parse.StringNode).Text, fn)
+			continue
+		}
 		ops[i], _ = cp.compileFactor(fn)
 	}
 	return combineTerm(ops)
 }
 
+// maybeVarName strips the trailing "?" of a variable name like $x?. Using an
+// undefined variable is a compile error, but such a variable is allowed to be
+// undefined and then evaluates to an empty string, or nothing when spliced;
+// the same goes for a variable that is unset when the nounset option is on.
+func maybeVarName(name string) (string, bool) {
+	if len(name) > 1 && strings.HasSuffix(name, "?") {
+		return name[:len(name)-1], true
+	}
+	return name, false
+}
+
 func (cp *Compiler) compileFactor(fn *parse.FactorNode) (valuesOp, *[2]StreamType) {
+	if cp.previewing {
+		// Captures involve executing commands and are never expanded when
+		// previewing.
+		switch fn.Typ {
+		case parse.OutputCaptureFactor:
+			return makeString("(...)"), nil
+		case parse.StatusCaptureFactor:
+			return makeString("?(...)"), nil
+		case parse.InputSubstitutionFactor:
+			return makeString("<(...)"), nil
+		case parse.OutputSubstitutionFactor:
+			return makeString(">(...)"), nil
+		}
+	}
 	switch fn.Typ {
 	case parse.StringFactor:
 		text := fn.Node.(*parse.StringNode).Text
 		return makeString(text), nil
+	case parse.OptionFactor:
+		return literalValue(NewOptionArg(fn.Node.(*parse.StringNode).Text)), nil
 	case parse.VariableFactor:
-		name := fn.Node.(*parse.StringNode).Text
-		return makeVar(cp, name, fn), nil
+		name, maybe := maybeVarName(fn.Node.(*parse.StringNode).Text)
+		name = cp.currentName(varRenames, name)
+		if maybe && cp.tryResolveVar(name) == nil {
+			return makeString(""), nil
+		}
+		if cp.previewing && cp.tryResolveVar(name) == nil {
+			// Leave undefined variables unexpanded when previewing
+			return makeString("$" + name), nil
+		}
+		return makeVar(cp, name, fn, maybe), nil
+	case parse.SpliceFactor:
+		name, maybe := maybeVarName(fn.Node.(*parse.StringNode).Text)
+		name = cp.currentName(varRenames, name)
+		if maybe && cp.tryResolveVar(name) == nil {
+			return literalValue(), nil
+		}
+		if cp.previewing && cp.tryResolveVar(name) == nil {
+			return makeString("$@" + name), nil
+		}
+		return makeSplice(cp, name, fn, maybe), nil
 	case parse.TableFactor:
 		table := fn.Node.(*parse.TableNode)
 		list := cp.compileTerms(table.List)
@@ -307,6 +540,16 @@ func (cp *Compiler) compileFactor(fn *parse.FactorNode) (valuesOp, *[2]StreamTyp
 	case parse.StatusCaptureFactor:
 		op, _ := cp.compilePipeline(fn.Node.(*parse.PipelineNode))
 		return op, nil
+	case parse.InputSubstitutionFactor, parse.OutputSubstitutionFactor:
+		op, _ := cp.compilePipeline(fn.Node.(*parse.PipelineNode))
+		return combineProcessSubstitution(op, fn.Typ == parse.OutputSubstitutionFactor), nil
+	case parse.InterpolationFactor:
+		tn := fn.Node.(*parse.TermNode)
+		ops := make([]valuesOp, len(tn.Nodes))
+		for i, f := range tn.Nodes {
+			ops[i], _ = cp.compileFactor(f)
+		}
+		return combineInterpolation(ops), nil
 	default:
 		panic(fmt.Sprintln("bad FactorNode type", fn.Typ))
 	}
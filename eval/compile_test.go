@@ -0,0 +1,169 @@
+package eval
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/xiaq/elvish/parse"
+)
+
+var constantTests = []struct {
+	text     string
+	constant bool
+}{
+	{"put a b c", true},
+	{"put a^b {c d}^e", true},
+	{`put "a b"`, true},
+	{"put a $pid c", false},
+	{"put ~", false},
+	{"put (put a)", false},
+}
+
+// TestConstantFolding checks that the argument list of a form made up of
+// literals is folded into one constant op.
+func TestConstantFolding(t *testing.T) {
+	for _, tt := range constantTests {
+		n, err := parse.Parse("<constant test>", tt.text)
+		if err != nil {
+			t.Fatalf("Parse(*, %q) => error %v", tt.text, err)
+		}
+		cp := &Compiler{}
+		cp.startCompile("<constant test>", tt.text, NewEvaluator().MakeCompilerScope())
+		op := cp.compileTermList(n.Nodes[0].Nodes[0].Args)
+		if op.constant != tt.constant {
+			t.Errorf("argument list of %q constant = %v, want %v", tt.text, op.constant, tt.constant)
+		}
+	}
+}
+
+func TestCompileCache(t *testing.T) {
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	evalText := func(text string) {
+		if err := ev.EvalText("<cache test>", text); err != nil {
+			t.Fatalf("EvalText(*, %q) => error %v", text, err)
+		}
+	}
+
+	evalText("set-option errexit on")
+	evalText("set-option errexit off")
+	evalText("set-option errexit on")
+	if len(ev.Compiler.cache) != 2 {
+		t.Errorf("cache has %d chunks, want 2", len(ev.Compiler.cache))
+	}
+	if !ev.Compiler.options.errexit {
+		t.Errorf("options set by a cached chunk not applied")
+	}
+
+	// A new variable changes the shape of the scope.
+	evalText("var $x string = a")
+	evalText("set-option errexit on")
+	if len(ev.Compiler.cache) != 4 {
+		t.Errorf("cache has %d chunks, want 4", len(ev.Compiler.cache))
+	}
+
+	if err := ev.Compiler.SetDefaultRedirs("cat", ">/dev/null"); err != nil {
+		t.Fatal(err)
+	}
+	if len(ev.Compiler.cache) != 0 {
+		t.Errorf("cache not emptied when default redirections change")
+	}
+}
+
+// benchmarkEval compiles text once, and runs it b.N times with the output
+// discarded.
+func benchmarkEval(b *testing.B, text string) {
+	n, err := parse.Parse("<benchmark>", text)
+	if err != nil {
+		b.Fatalf("Parse(*, %q) => error %v", text, err)
+	}
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	op, err := ev.Compiler.Compile("<benchmark>", text, n, ev.MakeCompilerScope())
+	if err != nil {
+		b.Fatalf("Compile(*, %q, *) => error %v", text, err)
+	}
+	ch := make(chan Value)
+	ev.ports[1] = &port{ch: ch}
+	go func() {
+		for range ch {
+		}
+	}()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ev.eval("<benchmark>", text, op)
+	}
+	b.StopTimer()
+	close(ch)
+}
+
+func BenchmarkLiteralWords(b *testing.B) {
+	benchmarkEval(b, "put a b c d e f g h i j k l m n o p")
+}
+
+func BenchmarkCompoundLiterals(b *testing.B) {
+	benchmarkEval(b, "put a^b^c {x y z}^-suffix \"quoted string\"")
+}
+
+func BenchmarkVariables(b *testing.B) {
+	benchmarkEval(b, "var $x string = a; put $x $x`b` $x`c`")
+}
+
+// BenchmarkEvalTextCached evaluates the same text with EvalText, which parses
+// and compiles it only once.
+func BenchmarkEvalTextCached(b *testing.B) {
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	text := "var $x string = a; for i from 0 to 3 { x = $x$i }"
+	for i := 0; i < b.N; i++ {
+		ev.EvalText("<benchmark>", text)
+	}
+}
+
+func BenchmarkForRange(b *testing.B) {
+	benchmarkEval(b, "for i from 0 to 100 { put $i`x` }")
+}
+
+var checkTests = []struct {
+	text  string
+	diags []Diagnostic
+}{
+	{"put $pid", []Diagnostic{}},
+	{"put $nosuch a", []Diagnostic{{4, 11, SeverityError, "undefined variable $nosuch"}}},
+	{"put a; put $x\nput $y", []Diagnostic{
+		{11, 13, SeverityError, "undefined variable $x"},
+		{18, 20, SeverityError, "undefined variable $y"}}},
+	{"put {", []Diagnostic{{5, 5, SeverityWarning, "unexpected eof in end of closure"}}},
+	{"set-option errexit on", []Diagnostic{}},
+}
+
+func TestCheck(t *testing.T) {
+	ev := NewEvaluator()
+	for _, tt := range checkTests {
+		diags := ev.Check("<check test>", tt.text)
+		if !reflect.DeepEqual(diags, tt.diags) {
+			t.Errorf("Check(*, %q) => %v, want %v", tt.text, diags, tt.diags)
+		}
+	}
+	if ev.Compiler.options.errexit {
+		t.Errorf("Check applied options set by the code checked")
+	}
+
+	// The Compiler used for checking shares no maps with the live one.
+	ev.Compiler.SetAlias("a", []string{"put", "a"})
+	ev.EvalText("<check test>", "put x")
+	cached := len(ev.Compiler.cache)
+	scratch := ev.Compiler.scratch()
+	scratch.SetAlias("b", []string{"put", "b"})
+	scratch.SetDefaultRedirs("put", "2>/dev/null")
+	if ev.Compiler.ExpandAlias("b") != nil || len(ev.Compiler.defaultRedirs) != 0 {
+		t.Errorf("changes to the scratch Compiler made to the live one")
+	}
+	if scratch.ExpandAlias("a") == nil {
+		t.Errorf("scratch Compiler lost the aliases")
+	}
+	ev.Check("<check test>", "a; put y")
+	if len(ev.Compiler.cache) != cached {
+		t.Errorf("Check changed the cache of the Compiler")
+	}
+}
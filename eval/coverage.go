@@ -0,0 +1,227 @@
+package eval
+
+// Coverage of elvish code. While coverage is on, the Evaluator records the
+// byte ranges of the forms that are run and how many times, so that the code
+// never run, like a branch no test takes, can be found from a listing of the
+// source:
+//
+//	     1  fn f {
+//	     0      put never
+//	     -  }
+//	     -  # Not code
+//
+// Each line of the listing starts with how many times the forms starting on
+// it have run at most, or - if no form starts on it.
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/xiaq/elvish/parse"
+)
+
+// CoverageRange is the byte range of a form that has run, and how many times.
+type CoverageRange struct {
+	// Name is the name of the code the form is in, like in error messages.
+	Name       string
+	Begin, End int
+	Count      int
+}
+
+type coverageSource struct {
+	name, text string
+}
+
+type coverage struct {
+	mutex  sync.Mutex
+	w      io.Writer
+	counts map[coverageSource]map[[2]int]int
+}
+
+// StartCoverage starts recording the forms of the code evaluated from now on
+// that run. The listing is written to w when StopCoverage is called, or when
+// Exit is.
+func (ev *Evaluator) StartCoverage(w io.Writer) {
+	ev.coverage = &coverage{w: w, counts: make(map[coverageSource]map[[2]int]int)}
+}
+
+// StopCoverage stops recording coverage and writes the listing, unless it has
+// been written already.
+func (ev *Evaluator) StopCoverage() {
+	c := ev.coverage
+	if c == nil {
+		return
+	}
+	ev.coverage = nil
+	c.mutex.Lock()
+	w := c.w
+	c.w = nil
+	c.mutex.Unlock()
+	if w != nil {
+		c.write(w)
+	}
+}
+
+// Coverage returns the ranges of the forms that have run since StartCoverage,
+// ordered by name and position.
+func (ev *Evaluator) Coverage() []CoverageRange {
+	c := ev.coverage
+	if c == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var ranges []CoverageRange
+	for src, counts := range c.counts {
+		for r, n := range counts {
+			ranges = append(ranges, CoverageRange{src.name, r[0], r[1], n})
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		a, b := ranges[i], ranges[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Begin != b.Begin {
+			return a.Begin < b.Begin
+		}
+		return a.End < b.End
+	})
+	return ranges
+}
+
+// record adds a run of the form fn in the code text named name.
+func (c *coverage) record(name, text string, fn *parse.FormNode) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	src := coverageSource{name, text}
+	counts, ok := c.counts[src]
+	if !ok {
+		counts = make(map[[2]int]int)
+		c.counts[src] = counts
+	}
+	counts[[2]int{int(fn.Pos), formEnd(fn)}]++
+}
+
+// write writes the listing of each source some of whose forms have run, in
+// the order of their names.
+func (c *coverage) write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	srcs := make([]coverageSource, 0, len(c.counts))
+	for src := range c.counts {
+		srcs = append(srcs, src)
+	}
+	sort.Slice(srcs, func(i, j int) bool { return srcs[i].name < srcs[j].name })
+	for _, src := range srcs {
+		fmt.Fprintf(w, "%s:\n", src.name)
+		writeListing(w, src.text, c.counts[src])
+	}
+}
+
+// writeListing writes the lines of text, each after the most times a form
+// starting on it has run according to counts.
+func writeListing(w io.Writer, text string, counts map[[2]int]int) {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	// Starts of lines, and the most runs of the forms on each, -1 for none.
+	starts := make([]int, len(lines))
+	most := make([]int, len(lines))
+	for i, pos := 0, 0; i < len(lines); i++ {
+		starts[i] = pos
+		pos += len(lines[i])
+		most[i] = -1
+	}
+	lineOf := func(pos int) int {
+		return sort.Search(len(starts), func(i int) bool { return starts[i] > pos }) - 1
+	}
+	// Forms that never ran don't have counts; find them in the source.
+	if chunk, err := parse.Parse("", text); err == nil {
+		for _, fn := range forms(chunk) {
+			if i := lineOf(int(fn.Pos)); most[i] < 0 {
+				most[i] = 0
+			}
+		}
+	}
+	for r, n := range counts {
+		if i := lineOf(r[0]); n > most[i] {
+			most[i] = n
+		}
+	}
+	for i, line := range lines {
+		mark := "-"
+		if most[i] >= 0 {
+			mark = fmt.Sprint(most[i])
+		}
+		fmt.Fprintf(w, "%6s  %s\n", mark, strings.TrimSuffix(line, "\n"))
+	}
+}
+
+var formNodeType = reflect.TypeOf((*parse.FormNode)(nil))
+
+// forms returns all the forms in the tree of n, including those of closures
+// and captures.
+func forms(n parse.Node) []*parse.FormNode {
+	var fns []*parse.FormNode
+	var walk func(v reflect.Value)
+	walk = func(v reflect.Value) {
+		switch v.Kind() {
+		case reflect.Ptr, reflect.Interface:
+			if v.IsNil() {
+				return
+			}
+			if v.Type() == formNodeType {
+				fns = append(fns, v.Interface().(*parse.FormNode))
+			}
+			walk(v.Elem())
+		case reflect.Slice:
+			for i := 0; i < v.Len(); i++ {
+				walk(v.Index(i))
+			}
+		case reflect.Struct:
+			for i := 0; i < v.NumField(); i++ {
+				if f := v.Field(i); f.CanInterface() {
+					walk(f)
+				}
+			}
+		}
+	}
+	walk(reflect.ValueOf(n))
+	return fns
+}
+
+// formEnd returns the position right after the last factor of fn.
+func formEnd(fn *parse.FormNode) int {
+	end := int(fn.Pos)
+	term := func(t *parse.TermNode) {
+		if t == nil {
+			return
+		}
+		for _, f := range t.Nodes {
+			if int(f.End) > end {
+				end = int(f.End)
+			}
+		}
+	}
+	term(fn.Command)
+	if fn.Args != nil {
+		for _, t := range fn.Args.Nodes {
+			term(t)
+		}
+	}
+	for _, r := range fn.Redirs {
+		switch r := r.(type) {
+		case *parse.FilenameRedir:
+			term(r.Filename)
+		case *parse.HereRedir:
+			term(r.Text)
+		}
+	}
+	return end
+}
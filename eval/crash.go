@@ -0,0 +1,115 @@
+package eval
+
+// Bug reports. A panic during evaluation that is not an error thrown with
+// util.Panic is a bug of elvish. Instead of letting it take down the session,
+// a report with what is needed to find the bug is written to a file, and the
+// panic becomes an error pointing to the file, e.g.
+//
+// internal error: runtime error: index out of range; a bug report has been
+// written to /tmp/elvish-crash-123456
+//
+// The report has the panic with its Go stack, the forms being evaluated with
+// their source, innermost last, and the code evaluated recently at the top
+// level.
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xiaq/elvish/util"
+)
+
+// CrashDumpDir is where bug reports are written. When it is empty, they are
+// written to the directory for temporary files.
+var CrashDumpDir = ""
+
+// crashHistorySize is the number of top-level chunks kept for bug reports.
+const crashHistorySize = 20
+
+// crashState keeps the code evaluated recently by an Evaluator and all its
+// copies at the top level.
+type crashState struct {
+	mutex   sync.Mutex
+	history []string
+}
+
+// record records text as evaluated at the top level.
+func (cs *crashState) record(text string) {
+	if cs == nil {
+		return
+	}
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	if len(cs.history) == crashHistorySize {
+		cs.history = append(cs.history[:0], cs.history[1:]...)
+	}
+	cs.history = append(cs.history, text)
+}
+
+func (cs *crashState) recent() []string {
+	if cs == nil {
+		return nil
+	}
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	return append([]string(nil), cs.history...)
+}
+
+// recoverCrash must be deferred. It lets errors thrown with util.Panic
+// through, but catches any other panic, writes a bug report for it and throws
+// an error pointing to the report instead.
+func (ev *Evaluator) recoverCrash() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if util.IsException(r) {
+		panic(r)
+	}
+	report := ev.crashReport(r, debug.Stack())
+	f, err := ioutil.TempFile(CrashDumpDir, "elvish-crash-")
+	if err == nil {
+		_, err = f.WriteString(report)
+		f.Close()
+	}
+	if err != nil {
+		util.Panic(fmt.Errorf("internal error: %v; failed to write a bug report: %s", r, err))
+	}
+	util.Panic(fmt.Errorf("internal error: %v; a bug report has been written to %s", r, f.Name()))
+}
+
+// crashReport returns the bug report for the panic r, with the Go stack.
+func (ev *Evaluator) crashReport(r interface{}, stack []byte) string {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "elvish %s (%s, %s/%s) panicked at %s:\n%v\n",
+		Version, runtime.Version(), runtime.GOOS, runtime.GOARCH,
+		time.Now().Format(time.RFC3339), r)
+
+	buf.WriteString("\nForms being evaluated:\n")
+	for _, c := range ev.callers {
+		writeExcerpt(buf, c.name, c.text, c.pos)
+	}
+	for _, n := range ev.nodes {
+		writeExcerpt(buf, ev.name, ev.text, int(n.Position()))
+	}
+
+	buf.WriteString("\nRecent code:\n")
+	for _, text := range ev.crash.recent() {
+		fmt.Fprintf(buf, "  %s\n", strings.Replace(text, "\n", "\n  ", -1))
+	}
+
+	fmt.Fprintf(buf, "\nGo stack:\n%s", stack)
+	return buf.String()
+}
+
+// writeExcerpt writes the position pos in text, with the line containing it.
+func writeExcerpt(buf *bytes.Buffer, name, text string, pos int) {
+	lineno, colno, line := util.FindContext(text, pos)
+	fmt.Fprintf(buf, "%s:%d:%d:\n  %s\n  %s^\n", name, lineno+1, colno+1, line, strings.Repeat(" ", colno))
+}
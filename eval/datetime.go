@@ -0,0 +1,407 @@
+package eval
+
+// The time: builtins, for working with dates and times.
+//
+// A time is represented as a table of its fields in its time zone, e.g.
+//
+// [&year 2024 &month 3 &day 1 &hour 12 &minute 30 &second 0 &nanosecond 0
+//  &weekday Friday &zone UTC &offset 0 &unix 1709296200]
+//
+// where &offset is in seconds east of UTC, and a &zone without an IANA name,
+// like that of a time parsed with an offset, is the offset, like +08:00.
+// Builtins taking a time use the fields from &year to &nanosecond and the
+// &zone, so that a time can be written as a table literal, with missing
+// fields defaulting to the start of the year and the local time zone.
+// Out-of-range fields are normalized, so [&year 2024 &month 13] is a time in
+// January 2025. A number is also a time, of seconds since the Unix epoch, in
+// the local time zone.
+//
+// Layouts of times, used by time:format and time:parse, are either strftime
+// layouts, which contain %, like %Y-%m-%d; Go layouts, like 2006-01-02; or
+// one of rfc3339, rfc3339nano, rfc1123 and kitchen. Literal text in strftime
+// layouts is kept as it is, even when it looks like elements of Go layouts,
+// like the 1 and the Monday of %Y week 1 Monday.
+//
+// Durations are numbers of seconds, or Go durations like 1h30m or -200ms.
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var namedLayouts = map[string]string{
+	"rfc3339":     time.RFC3339,
+	"rfc3339nano": time.RFC3339Nano,
+	"rfc1123":     time.RFC1123Z,
+	"kitchen":     time.Kitchen,
+}
+
+// strftimeDirectives maps the directives of strftime layouts to Go layouts,
+// and to regexps matching what they format to, used for parsing.
+var strftimeDirectives = map[byte]struct{ layout, pattern string }{
+	'Y': {"2006", `\d{4}`}, 'y': {"06", `\d{2}`}, 'm': {"01", `\d{2}`},
+	'd': {"02", `\d{2}`}, 'e': {"_2", ` ?\d{1,2}`}, 'j': {"002", `\d{3}`},
+	'H': {"15", `\d{2}`}, 'I': {"03", `\d{2}`}, 'M': {"04", `\d{2}`},
+	'S': {"05", `\d{2}`}, 'p': {"PM", `[AP]M`},
+	'b': {"Jan", `[A-Za-z]{3}`}, 'h': {"Jan", `[A-Za-z]{3}`},
+	'B': {"January", `[A-Za-z]+`}, 'a': {"Mon", `[A-Za-z]{3}`},
+	'A': {"Monday", `[A-Za-z]+`}, 'Z': {"MST", `[A-Za-z]{3,5}|[+-]\d{2,4}`},
+	'z': {"-0700", `[+-]\d{4}`},
+}
+
+// strftimeShorthands maps the directives of strftime layouts that stand for
+// literal text or other directives to what they stand for.
+var strftimeShorthands = map[byte]string{
+	'F': "%Y-%m-%d", 'T': "%H:%M:%S", 'D': "%m/%d/%y", 'R': "%H:%M",
+	'%': "%", 'n': "\n", 't': "\t",
+}
+
+// timeLayout is a layout of times. A strftime layout is kept as its parts,
+// so that its literal text is never taken for elements of Go layouts.
+type timeLayout struct {
+	// goLayout is the Go layout of a named or Go layout.
+	goLayout string
+	// The parts of a strftime layout, each either literal text or the Go
+	// layout of a directive, and the regexp matching the layout, with a
+	// group for each directive.
+	parts   []strftimePart
+	pattern *regexp.Regexp
+}
+
+type strftimePart struct {
+	literal  string
+	goLayout string
+}
+
+// parseTimeLayout parses a layout of times.
+func parseTimeLayout(layout string) (*timeLayout, error) {
+	if l, ok := namedLayouts[layout]; ok {
+		return &timeLayout{goLayout: l}, nil
+	}
+	if !strings.Contains(layout, "%") {
+		return &timeLayout{goLayout: layout}, nil
+	}
+	l := new(timeLayout)
+	pattern := new(bytes.Buffer)
+	pattern.WriteString("^")
+	var addParts func(layout string) error
+	addParts = func(layout string) error {
+		for i := 0; i < len(layout); i++ {
+			if layout[i] != '%' {
+				j := strings.IndexByte(layout[i:], '%')
+				if j == -1 {
+					j = len(layout) - i
+				}
+				l.parts = append(l.parts, strftimePart{literal: layout[i : i+j]})
+				pattern.WriteString(regexp.QuoteMeta(layout[i : i+j]))
+				i += j - 1
+				continue
+			}
+			i++
+			if i == len(layout) {
+				return fmt.Errorf("layout %q ends with %%", layout)
+			}
+			if s, ok := strftimeShorthands[layout[i]]; ok {
+				if strings.HasPrefix(s, "%") && len(s) > 1 {
+					if err := addParts(s); err != nil {
+						return err
+					}
+				} else {
+					l.parts = append(l.parts, strftimePart{literal: s})
+					pattern.WriteString(regexp.QuoteMeta(s))
+				}
+				continue
+			}
+			d, ok := strftimeDirectives[layout[i]]
+			if !ok {
+				return fmt.Errorf("unsupported directive %%%c in layout %q", layout[i], layout)
+			}
+			l.parts = append(l.parts, strftimePart{goLayout: d.layout})
+			pattern.WriteString("(" + d.pattern + ")")
+		}
+		return nil
+	}
+	if err := addParts(layout); err != nil {
+		return nil, err
+	}
+	pattern.WriteString("$")
+	l.pattern = regexp.MustCompile(pattern.String())
+	return l, nil
+}
+
+// format formats a time. The directives of a strftime layout are formatted
+// one by one, with the literal text between them written as it is.
+func (l *timeLayout) format(t time.Time) string {
+	if l.parts == nil {
+		return t.Format(l.goLayout)
+	}
+	buf := new(bytes.Buffer)
+	for _, p := range l.parts {
+		if p.goLayout == "" {
+			buf.WriteString(p.literal)
+		} else {
+			buf.WriteString(t.Format(p.goLayout))
+		}
+	}
+	return buf.String()
+}
+
+// parse parses a time, in loc if it has no time zone. The text of a strftime
+// layout is matched against its regexp, which checks the literal text; what
+// the directives matched is then parsed with their Go layouts alone, joined
+// with a NUL byte, which neither contains.
+func (l *timeLayout) parse(s string, loc *time.Location) (time.Time, error) {
+	if l.parts == nil {
+		return time.ParseInLocation(l.goLayout, s, loc)
+	}
+	m := l.pattern.FindStringSubmatch(s)
+	if m == nil {
+		return time.Time{}, fmt.Errorf("%q does not match the layout", s)
+	}
+	var layouts []string
+	for _, p := range l.parts {
+		if p.goLayout != "" {
+			layouts = append(layouts, p.goLayout)
+		}
+	}
+	return time.ParseInLocation(strings.Join(layouts, "\x00"), strings.Join(m[1:], "\x00"), loc)
+}
+
+// loadZone returns the time zone with an IANA name, like Asia/Shanghai, or
+// UTC or Local. An empty name is Local.
+func loadZone(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %s", name)
+	}
+	return loc, nil
+}
+
+// timeTable returns the table representing a time.
+func timeTable(t time.Time) *Table {
+	_, offset := t.Zone()
+	name := t.Location().String()
+	if name == "" {
+		name = t.Format("-07:00")
+	}
+	tab := NewTable()
+	for _, f := range []struct {
+		key   string
+		value int64
+	}{
+		{"year", int64(t.Year())}, {"month", int64(t.Month())},
+		{"day", int64(t.Day())}, {"hour", int64(t.Hour())},
+		{"minute", int64(t.Minute())}, {"second", int64(t.Second())},
+		{"nanosecond", int64(t.Nanosecond())},
+	} {
+		tab.put(NewString(f.key), NewString(strconv.FormatInt(f.value, 10)))
+	}
+	tab.put(NewString("weekday"), NewString(t.Weekday().String()))
+	tab.put(NewString("zone"), NewString(name))
+	tab.put(NewString("offset"), NewString(strconv.Itoa(offset)))
+	tab.put(NewString("unix"), NewString(strconv.FormatInt(t.Unix(), 10)))
+	return tab
+}
+
+// toTime converts a value representing a time to a time.Time.
+func toTime(v Value) (time.Time, error) {
+	tab, ok := v.(*Table)
+	if !ok {
+		f, err := toFloat(v)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("not a time: %s", v.Repr())
+		}
+		sec := math.Floor(f)
+		return time.Unix(int64(sec), int64((f-sec)*1e9)), nil
+	}
+	field := func(key string, def int) (int, error) {
+		v, ok := tab.lookup(key)
+		if !ok {
+			return def, nil
+		}
+		n, err := strconv.Atoi(v.String())
+		if err != nil {
+			return 0, fmt.Errorf("bad %s %s of time", key, v.Repr())
+		}
+		return n, nil
+	}
+	var fields [7]int
+	for i, key := range []string{"year", "month", "day", "hour", "minute", "second", "nanosecond"} {
+		def := 0
+		if key == "month" || key == "day" {
+			def = 1
+		}
+		n, err := field(key, def)
+		if err != nil {
+			return time.Time{}, err
+		}
+		fields[i] = n
+	}
+	loc := time.Local
+	if zone, ok := tab.lookup("zone"); ok {
+		var err error
+		loc, err = loadZone(zone.String())
+		if err != nil {
+			// A zone with only an offset has no IANA name.
+			offset, ok := tab.lookup("offset")
+			if !ok {
+				return time.Time{}, err
+			}
+			n, err2 := strconv.Atoi(offset.String())
+			if err2 != nil {
+				return time.Time{}, err
+			}
+			loc = time.FixedZone(zone.String(), n)
+		}
+	}
+	return time.Date(fields[0], time.Month(fields[1]), fields[2],
+		fields[3], fields[4], fields[5], fields[6], loc), nil
+}
+
+// timeNow outputs the current time, in the local time zone or the given one,
+// e.g.
+//
+// time:now; time:now Asia/Tokyo
+func timeNow(ev *Evaluator, args []Value) string {
+	if len(args) > 1 {
+		return "args error"
+	}
+	t := time.Now()
+	if len(args) == 1 {
+		loc, err := loadZone(args[0].String())
+		if err != nil {
+			return err.Error()
+		}
+		t = t.In(loc)
+	}
+	ev.ports[1].ch <- timeTable(t)
+	return ""
+}
+
+// timeParse parses a time in a layout, e.g.
+//
+// time:parse %Y-%m-%d 2024-03-01
+//
+// A time without a time zone is in the local one, or in the given one.
+func timeParse(ev *Evaluator, args []Value) string {
+	if len(args) != 2 && len(args) != 3 {
+		return "args error"
+	}
+	layout, err := parseTimeLayout(args[0].String())
+	if err != nil {
+		return err.Error()
+	}
+	loc := time.Local
+	if len(args) == 3 {
+		loc, err = loadZone(args[2].String())
+		if err != nil {
+			return err.Error()
+		}
+	}
+	t, err := layout.parse(args[1].String(), loc)
+	if err != nil {
+		return fmt.Sprintf("cannot parse %s as %s", args[1].Repr(), args[0].Repr())
+	}
+	ev.ports[1].ch <- timeTable(t)
+	return ""
+}
+
+// timeFormat outputs a time formatted in a layout, e.g.
+//
+// time:format "%H:%M" (time:now)
+func timeFormat(ev *Evaluator, args []Value) string {
+	if len(args) != 2 {
+		return "args error"
+	}
+	layout, err := parseTimeLayout(args[0].String())
+	if err != nil {
+		return err.Error()
+	}
+	t, err := toTime(args[1])
+	if err != nil {
+		return err.Error()
+	}
+	ev.ports[1].ch <- NewString(layout.format(t))
+	return ""
+}
+
+// timeIn outputs a time converted to a time zone, e.g.
+//
+// time:in (time:now) UTC
+func timeIn(ev *Evaluator, args []Value) string {
+	if len(args) != 2 {
+		return "args error"
+	}
+	t, err := toTime(args[0])
+	if err != nil {
+		return err.Error()
+	}
+	loc, err := loadZone(args[1].String())
+	if err != nil {
+		return err.Error()
+	}
+	ev.ports[1].ch <- timeTable(t.In(loc))
+	return ""
+}
+
+// timeAdd outputs a time plus a duration, e.g.
+//
+// time:add (time:now) 1h30m
+func timeAdd(ev *Evaluator, args []Value) string {
+	if len(args) != 2 {
+		return "args error"
+	}
+	t, err := toTime(args[0])
+	if err != nil {
+		return err.Error()
+	}
+	d, err := parseSignedDuration(args[1].String())
+	if err != nil {
+		return err.Error()
+	}
+	ev.ports[1].ch <- timeTable(t.Add(d))
+	return ""
+}
+
+// timeSub outputs the duration from the second time to the first, in seconds.
+func timeSub(ev *Evaluator, args []Value) string {
+	if len(args) != 2 {
+		return "args error"
+	}
+	t1, err := toTime(args[0])
+	if err != nil {
+		return err.Error()
+	}
+	t2, err := toTime(args[1])
+	if err != nil {
+		return err.Error()
+	}
+	ev.ports[1].ch <- durationSeconds(t1.Sub(t2))
+	return ""
+}
+
+// timeDuration outputs a duration in seconds, e.g. time:duration 1h30m
+// outputs 5400.
+func timeDuration(ev *Evaluator, args []Value) string {
+	if len(args) != 1 {
+		return "args error"
+	}
+	d, err := parseSignedDuration(args[0].String())
+	if err != nil {
+		return err.Error()
+	}
+	ev.ports[1].ch <- durationSeconds(d)
+	return ""
+}
+
+func durationSeconds(d time.Duration) Value {
+	return NewString(strconv.FormatFloat(d.Seconds(), 'f', -1, 64))
+}
@@ -0,0 +1,248 @@
+package eval
+
+// Hooks for debuggers. When an Evaluator has a Debugger, evaluation stops
+// before each form when stepping, or before the forms on the lines with
+// breakpoints when not, and the hook of the Debugger is called with where it
+// has stopped. Without a Debugger, the only cost is checking for one before
+// each form.
+//
+// A Debugger is set by the program embedding the Evaluator, which provides
+// the hook, e.g. a REPL on the terminal; elvish itself does not set one. Once
+// it is set, elvish code can control it with these builtins:
+//
+// debug:break                   stop before the next form
+// debug:set-breakpoint name line
+// debug:clear-breakpoint name line
+// debug:breakpoints             output the breakpoints as tables [&name &line]
+//
+// They fail when there is no Debugger.
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/xiaq/elvish/parse"
+	"github.com/xiaq/elvish/util"
+)
+
+func init() {
+	// Needed to avoid initialization loop
+	builtinFuncs["debug:break"] = builtinFunc{debugBreak, [2]StreamType{}}
+	builtinFuncs["debug:set-breakpoint"] = builtinFunc{debugSetBreakpoint, [2]StreamType{}}
+	builtinFuncs["debug:clear-breakpoint"] = builtinFunc{debugClearBreakpoint, [2]StreamType{}}
+	builtinFuncs["debug:breakpoints"] = builtinFunc{debugBreakpoints, [2]StreamType{0, chanStream}}
+}
+
+var errNoDebugger = errors.New("no debugger")
+
+// DebugAction is what a debugger hook tells the Evaluator to do when it
+// returns.
+type DebugAction int
+
+// DebugAction constants.
+const (
+	// DebugStep stops again before the next form.
+	DebugStep DebugAction = iota
+	// DebugContinue runs until a breakpoint.
+	DebugContinue
+)
+
+// Frame is where evaluation has stopped for a debugger.
+type Frame struct {
+	// Name and Text are the name and text of the code being evaluated, like
+	// in error messages.
+	Name, Text string
+	// Pos is the byte offset of the form about to be evaluated in Text.
+	Pos int
+	// Depth is the number of closure calls the form is in.
+	Depth int
+	// Scope maps the names of the variables visible to the form to their
+	// values at the time it stopped.
+	Scope map[string]Value
+}
+
+// Line returns the line number of the form, counted from 1.
+func (f *Frame) Line() int {
+	lineno, _, _ := util.FindContext(f.Text, f.Pos)
+	return lineno + 1
+}
+
+// Breakpoint is a line of some code to stop at.
+type Breakpoint struct {
+	Name string
+	Line int // Counted from 1.
+}
+
+// Debugger decides where evaluation stops, and calls a hook there.
+type Debugger struct {
+	// The hook is called in the goroutine evaluating the form, which waits
+	// for it. Calls from the forms of a pipeline are serialized, so the hook
+	// sees one stop at a time.
+	hook      func(*Frame) DebugAction
+	hookMutex sync.Mutex
+
+	mutex       sync.Mutex
+	stepping    bool
+	breakpoints map[Breakpoint]bool
+}
+
+// NewDebugger creates a Debugger that calls hook where evaluation stops. It
+// starts stepping, so evaluation stops before the first form.
+func NewDebugger(hook func(*Frame) DebugAction) *Debugger {
+	return &Debugger{hook: hook, stepping: true, breakpoints: make(map[Breakpoint]bool)}
+}
+
+// SetBreakpoint makes evaluation stop before the forms on a line of the code
+// with a name.
+func (d *Debugger) SetBreakpoint(name string, line int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.breakpoints[Breakpoint{name, line}] = true
+}
+
+// ClearBreakpoint removes a breakpoint set with SetBreakpoint.
+func (d *Debugger) ClearBreakpoint(name string, line int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.breakpoints, Breakpoint{name, line})
+}
+
+// Breakpoints returns the breakpoints set.
+func (d *Debugger) Breakpoints() []Breakpoint {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	bs := make([]Breakpoint, 0, len(d.breakpoints))
+	for b := range d.breakpoints {
+		bs = append(bs, b)
+	}
+	return bs
+}
+
+// Break makes evaluation stop before the next form, like DebugStep. It may be
+// called from any goroutine, e.g. when the user presses Ctrl-C.
+func (d *Debugger) Break() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.stepping = true
+}
+
+// shouldStop determines whether evaluation stops before the form at pos.
+func (d *Debugger) shouldStop(name, text string, pos int) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.stepping {
+		return true
+	}
+	if len(d.breakpoints) == 0 {
+		return false
+	}
+	lineno, _, _ := util.FindContext(text, pos)
+	return d.breakpoints[Breakpoint{name, lineno + 1}]
+}
+
+func (d *Debugger) stop(f *Frame) {
+	d.hookMutex.Lock()
+	action := d.hook(f)
+	d.hookMutex.Unlock()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.stepping = action == DebugStep
+}
+
+// SetDebugger sets the Debugger for the code evaluated from now on. A nil d
+// removes the Debugger.
+func (ev *Evaluator) SetDebugger(d *Debugger) {
+	ev.debugger = d
+}
+
+// debugStop stops for the debugger before the form n if it should.
+func (ev *Evaluator) debugStop(n parse.Node) {
+	d := ev.debugger
+	pos := int(n.Position())
+	if !d.shouldStop(ev.name, ev.text, pos) {
+		return
+	}
+	scope := make(map[string]Value)
+	for name, v := range ev.scope.all() {
+		scope[name] = v.Get()
+	}
+	d.stop(&Frame{ev.name, ev.text, pos, len(ev.callers), scope})
+}
+
+func debugBreak(ev *Evaluator, args []Value) string {
+	if len(args) != 0 {
+		return "args error"
+	}
+	if ev.debugger == nil {
+		return errNoDebugger.Error()
+	}
+	ev.debugger.Break()
+	return ""
+}
+
+// breakpointArgs parses the arguments of debug:set-breakpoint and
+// debug:clear-breakpoint.
+func breakpointArgs(args []Value) (name string, line int, msg string) {
+	if len(args) != 2 {
+		return "", 0, "args error"
+	}
+	line, err := strconv.Atoi(args[1].String())
+	if err != nil || line < 1 {
+		return "", 0, "bad line number " + args[1].Repr()
+	}
+	return args[0].String(), line, ""
+}
+
+func debugSetBreakpoint(ev *Evaluator, args []Value) string {
+	name, line, msg := breakpointArgs(args)
+	if msg != "" {
+		return msg
+	}
+	if ev.debugger == nil {
+		return errNoDebugger.Error()
+	}
+	ev.debugger.SetBreakpoint(name, line)
+	return ""
+}
+
+func debugClearBreakpoint(ev *Evaluator, args []Value) string {
+	name, line, msg := breakpointArgs(args)
+	if msg != "" {
+		return msg
+	}
+	if ev.debugger == nil {
+		return errNoDebugger.Error()
+	}
+	ev.debugger.ClearBreakpoint(name, line)
+	return ""
+}
+
+// debugBreakpoints outputs the breakpoints sorted by name and line.
+func debugBreakpoints(ev *Evaluator, args []Value) string {
+	if len(args) != 0 {
+		return "args error"
+	}
+	if ev.debugger == nil {
+		return errNoDebugger.Error()
+	}
+	bs := ev.debugger.Breakpoints()
+	sort.Slice(bs, func(i, j int) bool {
+		if bs[i].Name != bs[j].Name {
+			return bs[i].Name < bs[j].Name
+		}
+		return bs[i].Line < bs[j].Line
+	})
+	out := ev.ports[1]
+	for _, b := range bs {
+		t := NewTable()
+		t.put(NewString("name"), NewString(b.Name))
+		t.put(NewString("line"), NewString(strconv.Itoa(b.Line)))
+		if !out.put(t) {
+			break
+		}
+	}
+	return ""
+}
@@ -0,0 +1,111 @@
+package eval
+
+// Default redirections of commands.
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/xiaq/elvish/parse"
+)
+
+// defaultRedir is a redirection applied to all forms of a command, unless the
+// same fd is redirected explicitly in the form.
+type defaultRedir struct {
+	redir    parse.Redir
+	filename string // Only used when redir is a *parse.FilenameRedir
+}
+
+// SetDefaultRedirs sets the default redirections of the named command. spec
+// contains zero or more redirections written as in a form, e.g.
+// ">>[2]/tmp/make.log <[0=]". Filenames must be plain string literals. An
+// empty spec removes all default redirections of the command. The change takes
+// effect from the next compilation.
+func (cp *Compiler) SetDefaultRedirs(cmd, spec string) error {
+	name := fmt.Sprintf("<default redirections of %s>", cmd)
+	n, err := parse.Parse(name, "x "+spec)
+	if err != nil {
+		return err
+	}
+	if len(n.Nodes) != 1 || len(n.Nodes[0].Nodes) != 1 {
+		return fmt.Errorf("%s: must contain redirections only", name)
+	}
+	fn := n.Nodes[0].Nodes[0]
+	if len(fn.Args.Nodes) > 0 || fn.StatusRedir != "" {
+		return fmt.Errorf("%s: must contain redirections only", name)
+	}
+
+	var drs []defaultRedir
+	for _, rd := range fn.Redirs {
+		if _, ok := rd.(*parse.HereRedir); ok {
+			return fmt.Errorf("%s: here-documents cannot be default redirections", name)
+		}
+		dr := defaultRedir{redir: rd}
+		if rd, ok := rd.(*parse.FilenameRedir); ok {
+			var parts []string
+			for _, f := range rd.Filename.Nodes {
+				if f.Typ != parse.StringFactor {
+					return fmt.Errorf("%s: filename must be a string literal", name)
+				}
+				parts = append(parts, f.Node.(*parse.StringNode).Text)
+			}
+			dr.filename = strings.Join(parts, "")
+		}
+		drs = append(drs, dr)
+	}
+
+	if cp.defaultRedirs == nil {
+		cp.defaultRedirs = make(map[string][]defaultRedir)
+	}
+	cp.cache = nil
+	if len(drs) == 0 {
+		delete(cp.defaultRedirs, cmd)
+	} else {
+		cp.defaultRedirs[cmd] = drs
+	}
+	return nil
+}
+
+// applyDefaultRedirs adds the default redirections of the named command to
+// ports, skipping fds that are already redirected. Default redirections on
+// fds that are channel ports are ignored.
+func (cp *Compiler) applyDefaultRedirs(cmd string, ports []portOp, a *formAnnotation) []portOp {
+	for _, dr := range cp.defaultRedirs[cmd] {
+		fd := dr.redir.Fd()
+		if fd < uintptr(len(ports)) && ports[fd] != nil {
+			continue
+		}
+		if fd < 2 {
+			if a.streamTypes[fd] == chanStream {
+				continue
+			}
+			a.streamTypes[fd] = unusedStream
+		}
+		for uintptr(len(ports)) <= fd {
+			ports = append(ports, nil)
+		}
+		ports[fd] = cp.compileDefaultRedir(dr)
+	}
+	return ports
+}
+
+func (cp *Compiler) compileDefaultRedir(dr defaultRedir) portOp {
+	if r, ok := dr.redir.(*parse.FilenameRedir); ok {
+		fname, flag := dr.filename, r.Flag
+		return func(ev *Evaluator) *port {
+			if writesFile(flag) {
+				ev.checkRestricted(nil, fname, writingFiles)
+			}
+			// TODO haz hardcoded permbits now
+			f, e := os.OpenFile(fname, flag, 0644)
+			if e != nil {
+				ev.errorf("failed to open file %q for default redirection: %s", fname, e)
+			}
+			return newFilePort(f)
+		}
+	}
+	// FdRedir and CloseRedir can be compiled as usual, since they don't
+	// involve any term.
+	return cp.compileRedir(dr.redir)
+}
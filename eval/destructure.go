@@ -0,0 +1,171 @@
+package eval
+
+// Destructuring patterns.
+
+import (
+	"fmt"
+
+	"github.com/xiaq/elvish/parse"
+)
+
+// pattern is a destructuring pattern, which is either a list pattern like
+// {a b @rest} or a dict pattern like [&k1 a &k2 b].
+type pattern struct {
+	names []string   // Variables bound to list elements or dict values.
+	rest  string     // Variable bound to the remaining list elements.
+	keys  []valuesOp // Keys of a dict pattern; nil for list patterns.
+	node  parse.Node
+}
+
+// isPattern determines whether a term is a destructuring pattern.
+func isPattern(tn *parse.TermNode) bool {
+	if len(tn.Nodes) != 1 {
+		return false
+	}
+	switch f := tn.Nodes[0]; f.Typ {
+	case parse.ListFactor:
+		return true
+	case parse.TableFactor:
+		return len(f.Node.(*parse.TableNode).List) == 0
+	}
+	return false
+}
+
+// compilePattern compiles a term for which isPattern is true. The variables
+// in it are not resolved.
+func (cp *Compiler) compilePattern(tn *parse.TermNode) *pattern {
+	patternName := func(tn *parse.TermNode) string {
+		if len(tn.Nodes) != 1 || !isBareString(tn.Nodes[0]) {
+			cp.errorf(tn, "must be a variable name")
+		}
+		return tn.Nodes[0].Node.(*parse.StringNode).Text
+	}
+
+	p := &pattern{node: tn}
+	switch f := tn.Nodes[0]; f.Typ {
+	case parse.ListFactor:
+		elems := f.Node.(*parse.TermListNode).Nodes
+		for i, elem := range elems {
+			name := patternName(elem)
+			if name[0] == '@' {
+				if i != len(elems)-1 {
+					cp.errorf(elem, "rest variable must come last")
+				}
+				p.rest = name[1:]
+				break
+			}
+			p.names = append(p.names, name)
+		}
+	case parse.TableFactor:
+		for _, pair := range f.Node.(*parse.TableNode).Dict {
+			p.keys = append(p.keys, cp.compileTerm(pair.Key))
+			p.names = append(p.names, patternName(pair.Value))
+		}
+	}
+	return p
+}
+
+// resolvePattern resolves all variables in a pattern.
+func (cp *Compiler) resolvePattern(p *pattern) {
+	n := p.node.(*parse.TermNode).Nodes[0]
+	for _, name := range p.names {
+		cp.resolveVar(name, n)
+		cp.checkWritable(name, n)
+	}
+	if p.rest != "" {
+		t := cp.resolveVar(p.rest, n)
+		cp.checkWritable(p.rest, n)
+		if _, ok := t.(AnyType); !ok && !assignable(t, TableType{}) {
+			cp.errorf(p.node, "rest variable $%s must be a table", p.rest)
+		}
+	}
+}
+
+// checkPattern checks a pattern against the term it is to be matched against,
+// as far as it can be done at compile time.
+func (cp *Compiler) checkPattern(p *pattern, t Type, tn *parse.TermNode) {
+	if _, ok := t.(StringType); ok {
+		cp.errorf(tn, "cannot destructure a string")
+	}
+	if p.keys != nil || tn == nil {
+		return
+	}
+	if n := staticListLen(tn); n != -1 {
+		if (p.rest == "" && n != len(p.names)) || n < len(p.names) {
+			cp.errorf(tn, "pattern has %d elements, value has %d", len(p.names), n)
+		}
+	}
+}
+
+// staticListLen returns the length of the list part of a term if it is a table
+// literal whose length is known at compile time, or -1 otherwise.
+func staticListLen(tn *parse.TermNode) int {
+	if len(tn.Nodes) != 1 || tn.Nodes[0].Typ != parse.TableFactor {
+		return -1
+	}
+	for _, elem := range tn.Nodes[0].Node.(*parse.TableNode).List {
+		for _, f := range elem.Nodes {
+			if f.Typ != parse.StringFactor && f.Typ != parse.VariableFactor {
+				return -1
+			}
+		}
+	}
+	return len(tn.Nodes[0].Node.(*parse.TableNode).List)
+}
+
+// destructure matches a value against a pattern. It returns the values for
+// p.names and, for list patterns, the remaining elements for p.rest.
+func (ev *Evaluator) destructure(p *pattern, v Value) (vs []Value, rest []Value) {
+	vs, rest, msg := ev.matchPattern(p, v)
+	if msg != "" {
+		ev.errorfNode(p.node, "%s", msg)
+	}
+	return vs, rest
+}
+
+// matchPattern is like destructure, but returns a message describing why v
+// does not match p instead of stopping the evaluator.
+func (ev *Evaluator) matchPattern(p *pattern, v Value) (vs []Value, rest []Value, msg string) {
+	t, ok := v.(*Table)
+	if !ok {
+		return nil, nil, "cannot destructure " + v.Repr()
+	}
+	if p.keys != nil {
+		for _, op := range p.keys {
+			k := ev.asSingleValue(p.node, op.f(ev), "key")
+			key, ok := t.dictKey(k)
+			if !ok {
+				return nil, nil, "no such key: " + k.Repr()
+			}
+			vs = append(vs, t.Dict[key])
+		}
+		return vs, nil, ""
+	}
+	n := len(p.names)
+	if (p.rest == "" && len(t.List) != n) || len(t.List) < n {
+		return nil, nil, fmt.Sprintf("pattern has %d elements, value has %d", n, len(t.List))
+	}
+	return t.List[:n], t.List[n:], ""
+}
+
+// assignPattern destructures a value and assigns the parts to the variables of
+// the pattern.
+func (ev *Evaluator) assignPattern(p *pattern, v Value) {
+	vs, rest := ev.destructure(p, v)
+	for i, name := range p.names {
+		ev.setVar(name, vs[i])
+	}
+	if p.rest != "" {
+		t := NewTable()
+		t.append(rest...)
+		ev.setVar(p.rest, t)
+	}
+}
+
+// setVar assigns to the variable with a name, which the compiler has made sure
+// exists, as elvish code.
+func (ev *Evaluator) setVar(name string, v Value) {
+	if err := ev.scope.get(name).assign(func(Value) Value { return v }); err != nil {
+		ev.errorf("%s", err)
+	}
+}
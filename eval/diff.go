@@ -0,0 +1,186 @@
+package eval
+
+// The diff builtin.
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/xiaq/elvish/util"
+)
+
+// diffLine is one line of a diff. op is ' ' for a line common to both sides,
+// '-' for one only on the left side and '+' for one only on the right side.
+type diffLine struct {
+	op   byte
+	text string
+}
+
+var diffColors = map[byte]string{'-': "\033[31m", '+': "\033[32m"}
+
+// diffSeqs computes a line diff of two sequences from their longest common
+// subsequence.
+func diffSeqs(a, b []string) []diffLine {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and
+	// b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var lines []diffLine
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, diffLine{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, diffLine{'-', a[i]})
+			i++
+		default:
+			lines = append(lines, diffLine{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, diffLine{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, diffLine{'+', b[j]})
+	}
+	return lines
+}
+
+// splitLines splits a string into lines, ignoring a trailing newline.
+func splitLines(s string) []string {
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffValues computes a structural diff of two values. Strings are diffed
+// line by line. For tables, the list parts are diffed element by element, and
+// the dict parts key by key in the order of the keys; values of a common key
+// that are both tables are diffed recursively, indented under the key. Other
+// values are compared by their Repr.
+func diffValues(a, b Value) []diffLine {
+	switch a := a.(type) {
+	case *String:
+		if b, ok := b.(*String); ok {
+			return diffSeqs(splitLines(string(*a)), splitLines(string(*b)))
+		}
+	case *Table:
+		if b, ok := b.(*Table); ok {
+			return diffTables(a, b)
+		}
+	}
+	if a.Repr() == b.Repr() {
+		return []diffLine{{' ', a.Repr()}}
+	}
+	return []diffLine{{'-', a.Repr()}, {'+', b.Repr()}}
+}
+
+func diffTables(a, b *Table) []diffLine {
+	reprs := func(vs []Value) []string {
+		ss := make([]string, len(vs))
+		for i, v := range vs {
+			ss[i] = v.Repr()
+		}
+		return ss
+	}
+	lines := diffSeqs(reprs(a.List), reprs(b.List))
+
+	keys := make(map[string]Value)
+	for k := range a.Dict {
+		keys[k.String()] = k
+	}
+	for k := range b.Dict {
+		keys[k.String()] = k
+	}
+	names := make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		k := keys[name]
+		prefix := "&" + k.Repr() + " "
+		ka, inA := a.dictKey(k)
+		kb, inB := b.dictKey(k)
+		switch {
+		case !inB:
+			lines = append(lines, diffLine{'-', prefix + a.Dict[ka].Repr()})
+		case !inA:
+			lines = append(lines, diffLine{'+', prefix + b.Dict[kb].Repr()})
+		default:
+			va, vb := a.Dict[ka], b.Dict[kb]
+			ta, okA := va.(*Table)
+			tb, okB := vb.(*Table)
+			if okA && okB {
+				lines = append(lines, diffLine{' ', prefix + "["})
+				for _, l := range diffTables(ta, tb) {
+					lines = append(lines, diffLine{l.op, "  " + l.text})
+				}
+				lines = append(lines, diffLine{' ', "]"})
+			} else if va.Repr() == vb.Repr() {
+				lines = append(lines, diffLine{' ', prefix + va.Repr()})
+			} else {
+				lines = append(lines, diffLine{'-', prefix + va.Repr()}, diffLine{'+', prefix + vb.Repr()})
+			}
+		}
+	}
+	return lines
+}
+
+// isTerminal determines whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// writeDiff writes a diff, coloring removed and added lines if color is true.
+func writeDiff(w io.Writer, lines []diffLine, color bool) {
+	for _, l := range lines {
+		if c, ok := diffColors[l.op]; ok && color {
+			fmt.Fprintf(w, "%s%c%s\033[m\n", c, l.op, l.text)
+		} else {
+			fmt.Fprintf(w, "%c%s\n", l.op, l.text)
+		}
+	}
+}
+
+// diff writes a structural diff of two values, colored when the output is a
+// terminal, e.g.
+//
+// diff [a b &k v] [a c &k w]
+//
+// Like diff(1), it fails if the values differ.
+func diff(ev *Evaluator, args []Value) string {
+	if len(args) != 2 {
+		return "args error"
+	}
+	out := ev.ports[1].f
+	lines := diffValues(args[0], args[1])
+	writeDiff(out, lines, isTerminal(out) && !util.IsDumbTerm())
+	for _, l := range lines {
+		if l.op != ' ' {
+			return "values differ"
+		}
+	}
+	return ""
+}
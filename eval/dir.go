@@ -0,0 +1,219 @@
+package eval
+
+// Working directory and directory stack.
+
+import (
+	"errors"
+	"os"
+	"os/user"
+	"sync"
+)
+
+var (
+	errNoOldpwd      = errors.New("no previous directory")
+	errDirStackEmpty = errors.New("directory stack empty")
+)
+
+// dirState is the state of the working directory shared by an Evaluator and
+// all its copies.
+type dirState struct {
+	mutex  sync.Mutex
+	oldpwd string
+	stack  []string // Pushed directories; the top is the last element.
+	hook   func(dir string)
+	match  func(pattern string) []string
+	// Directories changed to since mutex was locked, for which hook is
+	// called by unlockDirs.
+	visited []string
+}
+
+// unlockDirs unlocks ev.dirs.mutex, and then calls the chdir hook with the
+// directories changed to while it was locked, so that a slow hook doesn't
+// hold up other uses of the working directory.
+func (ev *Evaluator) unlockDirs() {
+	hook, visited := ev.dirs.hook, ev.dirs.visited
+	ev.dirs.visited = nil
+	ev.dirs.mutex.Unlock()
+	if hook == nil {
+		return
+	}
+	for _, dir := range visited {
+		hook(dir)
+	}
+}
+
+// SetChdirHook sets a function to be called with the new working directory
+// whenever it is changed by cd, pushd or popd. It is called after the change
+// is complete, so it may use the working directory itself.
+func (ev *Evaluator) SetChdirHook(f func(dir string)) {
+	ev.dirs.mutex.Lock()
+	defer ev.dirs.mutex.Unlock()
+	ev.dirs.hook = f
+}
+
+// SetDirMatcher sets a function that finds previously visited directories
+// matching a pattern, the best match first. cd uses it when its argument is
+// not a directory.
+func (ev *Evaluator) SetDirMatcher(f func(pattern string) []string) {
+	ev.dirs.mutex.Lock()
+	defer ev.dirs.mutex.Unlock()
+	ev.dirs.match = f
+}
+
+// Chdir changes the working directory like cd does.
+func (ev *Evaluator) Chdir(dir string) error {
+	ev.dirs.mutex.Lock()
+	defer ev.unlockDirs()
+	return ev.chdir(dir)
+}
+
+// syncPwd updates $pwd from the working directory of the process, which may
+// have been changed without going through chdir.
+func (ev *Evaluator) syncPwd() {
+	if wd, err := os.Getwd(); err == nil {
+		ev.pwd.Set(NewString(wd))
+	}
+}
+
+// chdir changes the working directory, keeping $pwd, $env[PWD] and
+// $env[OLDPWD] up to date. A dir of "-" means the previous directory.
+// ev.dirs.mutex must be held.
+func (ev *Evaluator) chdir(dir string) error {
+	if dir == "-" {
+		if ev.dirs.oldpwd == "" {
+			return errNoOldpwd
+		}
+		dir = ev.dirs.oldpwd
+	}
+	old, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(dir); err != nil {
+		return err
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	ev.dirs.oldpwd = old
+	ev.pwd.Set(NewString(wd))
+	ev.env.set("OLDPWD", old)
+	ev.env.set("PWD", wd)
+	ev.dirs.visited = append(ev.dirs.visited, wd)
+	return nil
+}
+
+func cd(ev *Evaluator, args []Value) string {
+	var dir string
+	if len(args) == 0 {
+		user, err := user.Current()
+		if err == nil {
+			dir = user.HomeDir
+		}
+	} else if len(args) == 1 {
+		dir = args[0].String()
+	} else {
+		return "args error"
+	}
+	ev.dirs.mutex.Lock()
+	defer ev.unlockDirs()
+	if err := ev.chdir(dir); err != nil {
+		jumped := ev.jump(dir)
+		if jumped == "" {
+			return err.Error()
+		}
+		if err := ev.chdir(jumped); err != nil {
+			return err.Error()
+		}
+	}
+	return ""
+}
+
+// jump finds the best visited directory matching pattern other than the
+// working directory, or "" if there is none or pattern is an existing path.
+// ev.dirs.mutex must be held.
+func (ev *Evaluator) jump(pattern string) string {
+	if ev.dirs.match == nil || pattern == "-" {
+		return ""
+	}
+	if _, err := os.Stat(pattern); err == nil {
+		return ""
+	}
+	wd, _ := os.Getwd()
+	for _, dir := range ev.dirs.match(pattern) {
+		if dir != wd {
+			return dir
+		}
+	}
+	return ""
+}
+
+// pushd pushes the working directory onto the directory stack and changes to
+// the given directory. Without arguments, it swaps the working directory and
+// the top of the stack.
+func pushd(ev *Evaluator, args []Value) string {
+	ev.dirs.mutex.Lock()
+	defer ev.unlockDirs()
+
+	stack := ev.dirs.stack
+	var dir string
+	switch len(args) {
+	case 0:
+		if len(stack) == 0 {
+			return errDirStackEmpty.Error()
+		}
+		dir = stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+	case 1:
+		dir = args[0].String()
+	default:
+		return "args error"
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return err.Error()
+	}
+	if err := ev.chdir(dir); err != nil {
+		return err.Error()
+	}
+	ev.dirs.stack = append(stack, wd)
+	return ""
+}
+
+// popd pops a directory off the directory stack and changes to it.
+func popd(ev *Evaluator, args []Value) string {
+	if len(args) > 0 {
+		return "args error"
+	}
+	ev.dirs.mutex.Lock()
+	defer ev.unlockDirs()
+
+	stack := ev.dirs.stack
+	if len(stack) == 0 {
+		return errDirStackEmpty.Error()
+	}
+	if err := ev.chdir(stack[len(stack)-1]); err != nil {
+		return err.Error()
+	}
+	ev.dirs.stack = stack[:len(stack)-1]
+	return ""
+}
+
+// dirs outputs the working directory, followed by the directory stack from
+// the top.
+func dirs(ev *Evaluator, args []Value) string {
+	if len(args) > 0 {
+		return "args error"
+	}
+	ev.dirs.mutex.Lock()
+	defer ev.dirs.mutex.Unlock()
+
+	out := ev.ports[1].ch
+	ev.syncPwd()
+	out <- ev.pwd.Get()
+	for i := len(ev.dirs.stack) - 1; i >= 0; i-- {
+		out <- NewString(ev.dirs.stack[i])
+	}
+	return ""
+}
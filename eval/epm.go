@@ -0,0 +1,361 @@
+package eval
+
+// epm, the elvish package manager, installs libraries of elvish code from git
+// repositories, e.g.
+//
+// epm:install https://github.com/user/lib
+//
+// clones the repository into github.com/user/lib under the package directory,
+// ~/.elvish/lib by default. A package is named after its URL without the
+// scheme and the .git suffix; one installed from a local path, after the
+// last element of the path. The packages installed are recorded in
+// epm-manifest.json in the package directory, and output by epm:list as
+// tables like
+//
+// [&name github.com/user/lib &url https://github.com/user/lib
+//  &commit 0123abc... &installed 2024-03-01T12:30:00Z &dir /home/user/...]
+//
+// The init.elv of each installed package is evaluated when an interactive
+// shell starts, before the rc file, so that the rc file can use what the
+// packages define. Scripts don't load them, so that a script runs the same
+// whatever packages the user has installed. A package installed in a running
+// session can be loaded with epm:load, e.g.
+//
+// epm:load github.com/user/lib
+//
+// after which the chunks that follow can use its definitions.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PackageDir is where epm installs packages. When it is empty, packages are
+// installed in .elvish/lib under the home directory.
+var PackageDir = ""
+
+const epmManifestName = "epm-manifest.json"
+
+// epmMutex serializes the changes of the manifest by Evaluators of this
+// process.
+var epmMutex sync.Mutex
+
+type epmPackage struct {
+	Name      string `json:"name"`
+	URL       string `json:"url"`
+	Commit    string `json:"commit"`
+	Installed string `json:"installed"`
+}
+
+func packageDir() (string, error) {
+	if PackageDir != "" {
+		return PackageDir, nil
+	}
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(u.HomeDir, ".elvish", "lib"), nil
+}
+
+// packageName returns the name of the package installed from url, e.g.
+// github.com/user/lib for https://github.com/user/lib.git and
+// git@github.com:user/lib.
+func packageName(url string) (string, error) {
+	name := strings.TrimSuffix(strings.TrimRight(url, "/"), ".git")
+	if i := strings.Index(name, "://"); i != -1 {
+		name = name[i+3:]
+		if scheme := url[:i]; scheme == "file" {
+			name = filepath.Base(name)
+		}
+	} else if i := strings.Index(name, ":"); i != -1 && !strings.HasPrefix(name, "/") {
+		// An scp-like URL, like user@host:path.
+		name = name[:i] + "/" + name[i+1:]
+	} else {
+		name = filepath.Base(name)
+	}
+	if at := strings.LastIndex(name, "@"); at != -1 && at < strings.Index(name, "/") {
+		name = name[at+1:]
+	}
+	name = filepath.Clean(name)
+	if name == "." || name == ".." || strings.HasPrefix(name, "../") || filepath.IsAbs(name) {
+		return "", fmt.Errorf("cannot name a package after %s", url)
+	}
+	return name, nil
+}
+
+func readManifest(dir string) (map[string]*epmPackage, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, epmManifestName))
+	if os.IsNotExist(err) {
+		return make(map[string]*epmPackage), nil
+	} else if err != nil {
+		return nil, err
+	}
+	var list []*epmPackage
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("bad package manifest: %v", err)
+	}
+	pkgs := make(map[string]*epmPackage)
+	for _, p := range list {
+		pkgs[p.Name] = p
+	}
+	return pkgs, nil
+}
+
+// writeManifest writes the manifest through a temporary file, so that it is
+// never left half-written.
+func writeManifest(dir string, pkgs map[string]*epmPackage) error {
+	list := make([]*epmPackage, 0, len(pkgs))
+	for _, p := range pkgs {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".epm-manifest")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(dir, epmManifestName))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// git runs git in dir, returning its output without the trailing newline. An
+// error includes what git has printed.
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	text := strings.TrimSpace(string(out))
+	if err != nil {
+		if text == "" {
+			text = err.Error()
+		}
+		return "", fmt.Errorf("git %s: %s", args[0], text)
+	}
+	return text, nil
+}
+
+// withManifest calls f with the package directory and the manifest, and
+// writes the manifest back, so that packages changed before f fails are still
+// recorded. It is used by the builtins changing packages.
+func withManifest(f func(dir string, pkgs map[string]*epmPackage) error) string {
+	epmMutex.Lock()
+	defer epmMutex.Unlock()
+	dir, err := packageDir()
+	if err != nil {
+		return err.Error()
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err.Error()
+	}
+	pkgs, err := readManifest(dir)
+	if err != nil {
+		return err.Error()
+	}
+	ferr := f(dir, pkgs)
+	if err := writeManifest(dir, pkgs); err != nil {
+		return err.Error()
+	}
+	if ferr != nil {
+		return ferr.Error()
+	}
+	return ""
+}
+
+// epmInstall installs packages from git URLs.
+func epmInstall(ev *Evaluator, args []Value) string {
+	if len(args) == 0 {
+		return "args error"
+	}
+	return withManifest(func(dir string, pkgs map[string]*epmPackage) error {
+		for _, a := range args {
+			url := a.String()
+			name, err := packageName(url)
+			if err != nil {
+				return err
+			}
+			if pkgs[name] != nil {
+				return fmt.Errorf("package %s already installed", name)
+			}
+			pkgDir := filepath.Join(dir, name)
+			if err := os.MkdirAll(filepath.Dir(pkgDir), 0755); err != nil {
+				return err
+			}
+			if _, err := git(dir, "clone", "-q", "--", url, pkgDir); err != nil {
+				return err
+			}
+			commit, err := git(pkgDir, "rev-parse", "HEAD")
+			if err != nil {
+				return err
+			}
+			pkgs[name] = &epmPackage{name, url, commit, time.Now().UTC().Format(time.RFC3339)}
+		}
+		return nil
+	})
+}
+
+// epmUpgrade upgrades the named packages, or all of them, to the latest
+// commit of their repositories.
+func epmUpgrade(ev *Evaluator, args []Value) string {
+	return withManifest(func(dir string, pkgs map[string]*epmPackage) error {
+		names, err := packageNames(pkgs, args)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			pkgDir := filepath.Join(dir, name)
+			if _, err := git(pkgDir, "pull", "-q", "--ff-only"); err != nil {
+				return fmt.Errorf("cannot upgrade %s: %v", name, err)
+			}
+			commit, err := git(pkgDir, "rev-parse", "HEAD")
+			if err != nil {
+				return err
+			}
+			pkgs[name].Commit = commit
+		}
+		return nil
+	})
+}
+
+// epmRemove removes the named packages.
+func epmRemove(ev *Evaluator, args []Value) string {
+	if len(args) == 0 {
+		return "args error"
+	}
+	return withManifest(func(dir string, pkgs map[string]*epmPackage) error {
+		names, err := packageNames(pkgs, args)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+				return err
+			}
+			delete(pkgs, name)
+		}
+		return nil
+	})
+}
+
+// packageNames returns the names in args, which must be installed packages,
+// or the names of all packages if args is empty.
+func packageNames(pkgs map[string]*epmPackage, args []Value) ([]string, error) {
+	var names []string
+	if len(args) == 0 {
+		for name := range pkgs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names, nil
+	}
+	for _, a := range args {
+		if pkgs[a.String()] == nil {
+			return nil, fmt.Errorf("package %s not installed", a.String())
+		}
+		names = append(names, a.String())
+	}
+	return names, nil
+}
+
+// epmList outputs a table for each installed package.
+func epmList(ev *Evaluator, args []Value) string {
+	if len(args) != 0 {
+		return "args error"
+	}
+	dir, err := packageDir()
+	if err != nil {
+		return err.Error()
+	}
+	epmMutex.Lock()
+	pkgs, err := readManifest(dir)
+	epmMutex.Unlock()
+	if err != nil {
+		return err.Error()
+	}
+	names, _ := packageNames(pkgs, nil)
+	out := ev.ports[1].ch
+	for _, name := range names {
+		p := pkgs[name]
+		t := NewTable()
+		t.put(NewString("name"), NewString(p.Name))
+		t.put(NewString("url"), NewString(p.URL))
+		t.put(NewString("commit"), NewString(p.Commit))
+		t.put(NewString("installed"), NewString(p.Installed))
+		t.put(NewString("dir"), NewString(filepath.Join(dir, name)))
+		out <- t
+	}
+	return ""
+}
+
+func init() {
+	// Needed to avoid initialization loop
+	builtinFuncs["epm:load"] = builtinFunc{epmLoad, [2]StreamType{}}
+}
+
+// epmLoad evaluates the init.elv of the named packages.
+func epmLoad(ev *Evaluator, args []Value) string {
+	if len(args) == 0 {
+		return "args error"
+	}
+	dir, err := packageDir()
+	if err != nil {
+		return err.Error()
+	}
+	for _, a := range args {
+		name := a.String()
+		path := filepath.Join(dir, name, "init.elv")
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Sprintf("package %s not installed or has no init.elv", name)
+		}
+		if err := ev.Source(path); err != nil {
+			return err.Error()
+		}
+	}
+	return ""
+}
+
+// LoadPackages evaluates the init.elv of each installed package, skipping
+// packages without one. It returns the errors of the packages that fail to
+// load.
+func (ev *Evaluator) LoadPackages() []error {
+	dir, err := packageDir()
+	if err != nil {
+		return []error{err}
+	}
+	epmMutex.Lock()
+	pkgs, err := readManifest(dir)
+	epmMutex.Unlock()
+	if err != nil {
+		return []error{err}
+	}
+	names, _ := packageNames(pkgs, nil)
+	var errs []error
+	for _, name := range names {
+		err := ev.Source(filepath.Join(dir, name, "init.elv"))
+		if err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,56 @@
+package eval
+
+// The eq, not-eq and is builtins.
+
+// eq outputs whether its arguments are all equal, comparing lists and maps
+// deeply, e.g.
+//
+// eq [a &k [b]] [a &k [b]] # true
+func eq(ev *Evaluator, args []Value) string {
+	if len(args) < 2 {
+		return "args error"
+	}
+	result := true
+	for i := 1; i < len(args); i++ {
+		if !args[i-1].Eq(args[i]) {
+			result = false
+			break
+		}
+	}
+	ev.ports[1].ch <- boolValue(result)
+	return ""
+}
+
+// notEq outputs whether its two arguments are not equal.
+func notEq(ev *Evaluator, args []Value) string {
+	if len(args) != 2 {
+		return "args error"
+	}
+	ev.ports[1].ch <- boolValue(!args[0].Eq(args[1]))
+	return ""
+}
+
+// is outputs whether its arguments are all the same value, e.g. the same
+// table, rather than equal ones. Strings have no identity, so they are the
+// same when they are equal.
+func is(ev *Evaluator, args []Value) string {
+	if len(args) < 2 {
+		return "args error"
+	}
+	result := true
+	for i := 1; i < len(args); i++ {
+		if !same(args[i-1], args[i]) {
+			result = false
+			break
+		}
+	}
+	ev.ports[1].ch <- boolValue(result)
+	return ""
+}
+
+func same(a, b Value) bool {
+	if s, ok := a.(*String); ok {
+		return s.Eq(b)
+	}
+	return a == b
+}
@@ -3,10 +3,13 @@
 package eval
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 
 	"github.com/xiaq/elvish/parse"
@@ -19,12 +22,76 @@ import (
 type Evaluator struct {
 	Compiler    *Compiler
 	name, text  string
-	scope       map[string]*Value
+	scope       *varScope
 	env         *Env
 	searchPaths []string
 	ports       []*port
 	statusCb    func([]Value)
 	nodes       []parse.Node // A stack that keeps track of nodes being evaluated.
+	callers     []callFrame  // Where the closure being evaluated was called.
+	execHook    *Var         // The global $exec-hook.
+	notFound    *Var         // The global $command-not-found-hook.
+	status      *Var         // The global $status, also known as $?.
+	bodyStatus  []Value      // Exit values of the last pipeline of a closure body.
+	pwd         *Var         // The global $pwd.
+	dirs        *dirState
+	namedDirs   *Var // The global $named-dirs.
+	features    *Var // The global $features.
+	lastPid     *Var // The global $last-pid.
+	procs       *procTable
+	sessionLog  *sessionLog
+	relays      []*relay
+	lastOutput  *lastOutput
+	store       Store
+	history     HistoryStore
+	shared      *sharedState
+	rc          *rcState
+	exit        *exitState
+	usage       func() (*Usage, error)
+	debugger    *Debugger
+	profiler    *profiler
+	coverage    *coverage
+	tests       *testState
+	options     *Options
+	cancel      *cancelState
+	restricted  bool // See NewRestrictedEvaluator.
+	crash       *crashState
+}
+
+// callFrame records where a closure was called, for tracebacks.
+type callFrame struct {
+	name, text string
+	pos        int
+	callee     string
+}
+
+// thrownStatus is the exit value of a form that has thrown an error. It is
+// told apart by identity, not by its string form, which a command may also
+// fail with.
+var thrownStatus = NewString("error")
+
+// statusLine returns the line reporting the exit values of a pipeline, or ""
+// if there is nothing to report. Only failed forms are reported, numbered
+// when the pipeline has more than one form; forms that failed by throwing are
+// left out, since the error has been printed already. A builtin outputting
+// values always succeeds unless it throws or returns an error message, so a
+// pipeline of such builtins that does its job is never reported.
+func statusLine(vs []Value) string {
+	var failed []string
+	for i, v := range vs {
+		if statusOk([]Value{v}) || v == thrownStatus {
+			continue
+		}
+		if len(vs) > 1 {
+			failed = append(failed, fmt.Sprintf("#%d %s", i+1, v.Repr()))
+		} else {
+			failed = append(failed, v.Repr())
+		}
+	}
+	if len(failed) == 0 {
+		return ""
+	}
+	return "Status: " + strings.Join(failed, ", ")
 }
 
 func statusOk(vs []Value) bool {
@@ -46,60 +113,91 @@ func NewEvaluator() *Evaluator {
 	env := NewEnv()
 	env.fill()
 	pid := NewString(strconv.Itoa(syscall.Getpid()))
-	g := map[string]*Value{
-		"env": valuePtr(env), "pid": valuePtr(pid),
+	execHook := newVar(ClosureType{}.Default())
+	notFound := newVar(ClosureType{}.Default())
+	status := newVar(NewTable())
+	pwd := newVar(NewString(""))
+	namedDirs := newVar(NewTable())
+	features := newVar(NewTable())
+	lastPid := newVar(NewString(""))
+	options := newOptions()
+	g := map[string]*Var{
+		"env": newVar(env), "pid": newReadOnlyVar("pid", pid), "command-not-found-hook": notFound,
+		"exec-hook": execHook, "status": status, "?": status, "pwd": pwd,
+		"before-readline": newVar(NewTable()), "after-command": newVar(NewTable()),
+		"abbr": newVar(NewTable()), "arg-completer": newVar(NewTable()),
+		"named-dirs": namedDirs,
+		"prompt":     newVar(ClosureType{}.Default()),
+		"rprompt":    newVar(ClosureType{}.Default()),
+		"motd-hook":  newVar(ClosureType{}.Default()),
+		"buildinfo":  newVar(buildInfo()),
+		"features":   features,
+		"last-pid":   lastPid,
+		"options":    options.v,
 	}
+	defineHostVars(g)
+	lastOutput := &lastOutput{}
+	g["last-output"] = lastOutput.variable()
 	ev := &Evaluator{
 		Compiler: &Compiler{},
-		scope:    g, env: env,
+		scope:    newVarScope(g), env: env, execHook: execHook, status: status,
+		pwd: pwd, dirs: &dirState{}, namedDirs: namedDirs, features: features,
+		lastPid: lastPid, procs: newProcTable(), notFound: notFound, lastOutput: lastOutput,
+		shared:  &sharedState{synced: make(map[string]string)},
+		rc:      &rcState{},
+		exit:    &exitState{},
+		tests:   &testState{},
+		crash:   &crashState{},
+		options: options,
 		ports: []*port{
 			&port{f: os.Stdin}, &port{f: os.Stdout}, &port{f: os.Stderr}},
 		statusCb: func(vs []Value) {
-			if statusOk(vs) {
-				return
-			}
-			fmt.Print("Status: ")
-			for i, v := range vs {
-				if i > 0 {
-					fmt.Print(", ")
-				}
-				fmt.Print(v.Repr())
+			if line := statusLine(vs); line != "" {
+				fmt.Println(line)
 			}
-			fmt.Println()
 		},
 	}
-	path, ok := env.m["PATH"]
+	path, ok := env.get("PATH")
 	if ok {
-		ev.searchPaths = strings.Split(path, ":")
+		ev.searchPaths = filepath.SplitList(path)
 		// fmt.Printf("Search paths are %v\n", search_paths)
 	} else {
 		ev.searchPaths = []string{"/bin"}
 	}
+	// Optional subsystems are enabled by the program embedding the Evaluator.
+	ev.SetFeature("editor", false)
+	ev.SetFeature("daemon", false)
+	ev.defineOptions()
 
 	return ev
 }
 
-func (ev *Evaluator) copy(name string, moveShouldClose bool) *Evaluator {
+// copy returns a copy of ev for evaluating in another goroutine. The copy
+// holds its own references to the ports of ev, which must be released with
+// releasePorts when it is done.
+func (ev *Evaluator) copy() *Evaluator {
+	atomic.AddInt32(&liveCounts.evaluators, 1)
 	newEv := new(Evaluator)
 	*newEv = *ev
-	newEv.name = name
 	newEv.ports = make([]*port, len(ev.ports))
 	for i, p := range ev.ports {
-		newEv.ports[i] = &port{}
-		*newEv.ports[i] = *p
-	}
-	if moveShouldClose {
-		for _, port := range ev.ports {
-			port.shouldClose = false
-		}
-	} else {
-		for _, port := range newEv.ports {
-			port.shouldClose = false
-		}
+		p.retain()
+		newEv.ports[i] = p
 	}
+	newEv.nodes = append([]parse.Node(nil), ev.nodes...)
 	return newEv
 }
 
+// Go calls f in a new goroutine with a copy of ev, which is made before Go
+// returns, so that f can use it while ev goes on evaluating other code.
+func (ev *Evaluator) Go(f func(*Evaluator)) {
+	newEv := ev.copy()
+	go func() {
+		defer newEv.releasePorts()
+		f(newEv)
+	}()
+}
+
 func (ev *Evaluator) port(i int) *port {
 	if i >= len(ev.ports) {
 		return nil
@@ -118,8 +216,11 @@ func (ev *Evaluator) growPorts(n int) {
 
 func (ev *Evaluator) MakeCompilerScope() map[string]Type {
 	scope := make(map[string]Type)
-	for name, value := range ev.scope {
-		scope[name] = (*value).Type()
+	for name, v := range ev.scope.all() {
+		scope[name] = v.valueType()
+		if v.readOnly {
+			scope[name] = constType{scope[name]}
+		}
 	}
 	return scope
 }
@@ -127,10 +228,41 @@ func (ev *Evaluator) MakeCompilerScope() map[string]Type {
 // Eval evaluates a chunk node n. The name and text of it is used for
 // diagnostic messages.
 func (ev *Evaluator) Eval(name, text string, n *parse.ChunkNode) error {
-	op, err := ev.Compiler.Compile(name, text, n, ev.MakeCompilerScope())
+	ev.pullShared()
+	op, err := ev.Compiler.CompileCached(name, text, n, ev.MakeCompilerScope())
 	if err != nil {
 		return err
 	}
+	ev.printWarnings()
+	return ev.evalOp(name, text, op)
+}
+
+// printWarnings prints the warnings from the last compilation to port 2.
+func (ev *Evaluator) printWarnings() {
+	p := ev.port(2)
+	if p == nil || p.f == nil {
+		return
+	}
+	for _, w := range ev.Compiler.Warnings() {
+		fmt.Fprint(p.f, w.PprintWarning())
+	}
+}
+
+// evalOp evaluates the compiled chunk op at the top level.
+func (ev *Evaluator) evalOp(name, text string, op Op) error {
+	if ev.sessionLog != nil {
+		ev.sessionLog.mark(name, text)
+	}
+	ev.crash.record(text)
+	ev.syncPwd()
+	ev.startLastOutput()
+	defer ev.pushShared()
+	defer ev.drainRelays()
+	if ev.cancel == nil {
+		return ev.withCancelState(context.Background(), func() error {
+			return ev.eval(name, text, op)
+		})
+	}
 	return ev.eval(name, text, op)
 }
 
@@ -140,6 +272,7 @@ func (ev *Evaluator) eval(name, text string, op Op) (err error) {
 	}
 	defer util.Recover(&err)
 	defer ev.stopEval()
+	defer ev.recoverCrash()
 	ev.name = name
 	ev.text = text
 	op(ev)
@@ -161,8 +294,34 @@ func (ev *Evaluator) pop() {
 	ev.nodes = ev.nodes[:n]
 }
 
+// pushCaller records that the closure of fm is called from the form being
+// evaluated.
+func (ev *Evaluator) pushCaller(fm *form) {
+	n := fm.node
+	if n == nil {
+		if len(ev.nodes) == 0 {
+			return
+		}
+		n = ev.nodes[len(ev.nodes)-1]
+	}
+	callers := make([]callFrame, len(ev.callers), len(ev.callers)+1)
+	copy(callers, ev.callers)
+	ev.callers = append(callers, callFrame{ev.name, ev.text, int(n.Position()), fm.name})
+}
+
 func (ev *Evaluator) errorfNode(n parse.Node, format string, args ...interface{}) {
-	util.Panic(util.NewContextualError(ev.name, ev.text, int(n.Position()), format, args...))
+	util.Panic(ev.contextualError(n, format, args...))
+}
+
+// contextualError returns the error about n thrown by errorfNode, which has
+// the callers of the closure being evaluated for a traceback.
+func (ev *Evaluator) contextualError(n parse.Node, format string, args ...interface{}) *util.ContextualError {
+	e := util.NewContextualError(ev.name, ev.text, int(n.Position()), format, args...)
+	for _, c := range ev.callers {
+		e.Callers = append(e.Callers,
+			util.NewContextualError(c.name, c.text, c.pos, "calling %s", c.callee))
+	}
+	return e
 }
 
 // errorf stops the evaluator. Its panic is supposed to be caught by recover.
@@ -174,6 +333,13 @@ func (ev *Evaluator) errorf(format string, args ...interface{}) {
 	}
 }
 
+func (ev *Evaluator) asSingleValue(n parse.Node, vs []Value, what string) Value {
+	if len(vs) != 1 {
+		ev.errorfNode(n, "Expect exactly one value for %s, got %d", what, len(vs))
+	}
+	return vs[0]
+}
+
 func (ev *Evaluator) asSingleString(n parse.Node, vs []Value, what string) *String {
 	if len(vs) != 1 {
 		ev.errorfNode(n, "Expect exactly one word for %s, got %d", what, len(vs))
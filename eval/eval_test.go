@@ -1,9 +1,30 @@
 package eval
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
+
+	"github.com/xiaq/elvish/parse"
+	"github.com/xiaq/elvish/util"
 )
 
 func strsEqual(s1 []string, s2 []string) bool {
@@ -21,7 +42,2851 @@ func strsEqual(s1 []string, s2 []string) bool {
 func TestNewEvaluator(t *testing.T) {
 	ev := NewEvaluator()
 	pid := strconv.Itoa(syscall.Getpid())
-	if (*ev.scope["pid"]).String() != pid {
-		t.Errorf(`ev.scope["pid"] = %v, want %v`, ev.scope["pid"], pid)
+	if ev.scope.get("pid").Get().String() != pid {
+		t.Errorf(`ev.scope["pid"] = %v, want %v`, ev.scope.get("pid").Get(), pid)
+	}
+}
+
+// evalAndCollect evaluates text with a new Evaluator whose output port is a
+// channel, and returns the values written to it.
+func evalAndCollect(t *testing.T, text string) []Value {
+	vs, err := evalAndCollectErr(t, text)
+	if err != nil {
+		t.Errorf("Eval(*, %q, *) => error %v", text, err)
+	}
+	return vs
+}
+
+// evalAndCollectErr is like evalAndCollect, but returns the error from Eval.
+func evalAndCollectErr(t *testing.T, text string) ([]Value, error) {
+	name := "<eval test>"
+	n, err := parse.Parse(name, text)
+	if err != nil {
+		t.Fatalf("Parse(*, %q) => error %v", text, err)
+	}
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	ch := make(chan Value)
+	ev.ports[1] = &port{ch: ch}
+	var vs []Value
+	done := make(chan bool)
+	go func() {
+		for v := range ch {
+			vs = append(vs, v)
+		}
+		done <- true
+	}()
+	err = ev.Eval(name, text, n)
+	close(ch)
+	<-done
+	return vs, err
+}
+
+func reprs(vs []Value) []string {
+	ss := make([]string, len(vs))
+	for i, v := range vs {
+		ss[i] = v.Repr()
+	}
+	return ss
+}
+
+var evalTests = []struct {
+	text   string
+	wanted []string
+}{
+	// Assignment
+	{"var $a $b string; a b = (put x y); put $b $a", []string{"y", "x"}},
+	{"var $li table = [a b]; li[1] = c; put $li", []string{"[a c]"}},
+	{"var $m table = [&k v]; m[k] = w; put $m[k]", []string{"w"}},
+	// Commands whose second word is = are not assignments.
+	{"test a = b; put $status; test a = a; put $status", []string{"[`exited 1`]", "[``]"}},
+
+	// Compounding leaves the values of literals alone
+	{"put a b | each {|i| put x$i }", []string{"xa", "xb"}},
+	{"for i in a b { put x$i`y` }", []string{"xay", "xby"}},
+
+	// Here-documents and here-strings
+	{"var $x string = a; cat <<EOF | feedchan\n$x \"b\"\nEOF", []string{"`a \"b\"`"}},
+	{"cat <<-`EOF` | feedchan\n\t$x\n\tEOF", []string{"`$x`"}},
+	{"cat <<EOF | feedchan\nEOF", []string{}},
+	{"cat <<< `a b` | feedchan", []string{"`a b`"}},
+
+	// Process substitution
+	{"cat <(echo a) <(echo b) | feedchan", []string{"a", "b"}},
+	{"echo a > >(cat) | feedchan", []string{"a"}},
+
+	// Raw strings
+	{`put """a\"b"""`, []string{"`a\\\"b`"}},
+	{"put \"\"\"\n  a\n    b\n  \"\"\"", []string{`"a\n  b\n"`}},
+
+	// Comments and line continuation
+	{"put a b | # comment\n  each {|x| put x$x }", []string{"xa", "xb"}},
+	{"put a ^\n  b # comment\n", []string{"a", "b"}},
+
+	// Maybe-undefined variables
+	{"var $x string = a; put $x? x$nosuch? $@nosuch?", []string{"a", "x"}},
+	{`put "${nosuch?}b"`, []string{"b"}},
+
+	// Interpolation
+	{`var $name table = [a b]; put "$name has $(+ 1 (+ 1 1)) items, ${name}: \$x"`,
+		[]string{"`[a b] has 3 items, [a b]: $x`"}},
+	{`put "<$(echo "(a)" b)>" "$(put a b)-c"`, []string{"`<(a) b>`", "`a b-c`"}},
+	{`var $x string = a; put "cost $5, $ and $-" "$x$" "\$x $"`, []string{"`cost $5, $ and $-`", "`a$`", "`$x $`"}},
+	{"var $x string = a; cat <<EOF | feedchan\n$x costs $5\n$ \\$x\nEOF", []string{"`a costs $5`", "`$ $x`"}},
+
+	// JSON
+	{"put a [b [&k v] []] | to-json | from-json", []string{"a", "[b [&k v] []]"}},
+	{"fopen /dev/null | to-json; put $status", []string{"[`` `json: error calling MarshalJSON for type *eval.File: unserializable value`]"}},
+	{"sync:once | to-json; put $status", []string{"[`` `json: error calling MarshalJSON for type *eval.Once: unserializable value`]"}},
+	{"put (echo `{\"n\": 1.50, \"b\": [true, null]}` | from-json)[b]", []string{"[true ``]"}},
+
+	// Map
+	{"var $li table = [a b]; put [(map {|x| put $x$x} $li)]", []string{"[aa bb]"}},
+	{"put [(map {|x| put $x; put $x} a b)] [(printf `c\\nd\\n`)]", []string{"[a a b b]", "[c d]"}},
+
+	// String builtins
+	{"put (str:cat a [b c] d)", []string{"`a[b c]d`"}},
+	{"put (str:repeat ab 3) (str:repeat - 0)", []string{"ababab", "``"}},
+	{"str:split a,b,,c ,; str:split ab ``", []string{"[a b `` c]", "[a b]"}},
+	{"str:join [a b c] -; str:join (str:split a,b ,) ``", []string{"a-b-c", "ab"}},
+	{"str:trim \"  a b \"; str:trim /a/b/ /", []string{"`a b`", "a/b"}},
+	{"str:replace a.b.c . - ; str:replace a.b.c . - 1", []string{"a-b-c", "a-b.c"}},
+	{"str:contains abc bc; str:contains abc d", []string{"true", "false"}},
+	{"str:index 你好吗 吗; str:index abc d", []string{"2", "-1"}},
+	{"str:to-upper aBc; str:to-lower aBc", []string{"ABC", "abc"}},
+	{"str:pad ab 4 .; str:pad &left 42 5 0; str:pad abc 2", []string{"ab..", "00042", "abc"}},
+	{"to-string [a b] (bytes:from-hex 6869)", []string{"`[a b]`", "hi"}},
+	{"put (printf `%-3s|%5.2f|%q|%v|%x|%d%%` a 3.14159 b [c] hi 0x10)", []string{"`a  | 3.14|b|[c]|6869|16%`"}},
+
+	// Regexp builtins
+	{"re:match `^[0-9]+$` 42; re:match `^[0-9]+$` 4a", []string{"true", "false"}},
+	{"put (re:find-all `(?P<k>\\w)=(\\d)?` `a=1 b=`)[groups][k][text]", []string{"a", "b"}},
+	{"put (re:find-all `(.)=(\\d)?` `你=1 b=`)[groups][1][start]", []string{"2", "-1"}},
+	{"put (re:find-all `\\d` 1234 2)[start]", []string{"0", "1"}},
+	{"re:replace `(\\w)=` `$1:` `a=1 b=2`", []string{"`a:1 b:2`"}},
+	{"re:replace `[0-9]+` {|m| + $m[text] 1} `a1 b41`", []string{"`a2 b42`"}},
+	{"re:split `\\s*,\\s*` `a, b ,c`; re:split , a,b,c 2", []string{"[a b c]", "[a b,c]"}},
+
+	// Ordered tables and sorting builtins
+	{"put [&b 1 &a 2 &c 3]", []string{"[&b 1 &a 2 &c 3]"}},
+	{"var $t table = [&b 1 &a 2]; t[c] = 3; t[b] = 4; keys $t; put $t", []string{"b", "a", "c", "[&b 4 &a 2 &c 3]"}},
+	{"merge [&x 1 &y 2] [&z 3 &x 4]", []string{"[&x 4 &y 2 &z 3]"}},
+	{"put [&z 1 &a [&y 2 &b 3]] | to-json | from-json", []string{"[&z 1 &a [&y 2 &b 3]]"}},
+	{"put 10 9 b a 100 | order", []string{"9", "10", "100", "a", "b"}},
+	{"put 1 3 2 | order &reverse", []string{"3", "2", "1"}},
+	{"put b ax c bx | order {|a b| re:match `x.*:[^x]*$` (str:cat $a : $b)}", []string{"ax", "bx", "b", "c"}},
+	{"put [&n x &a 2] [&n y &a 1] | sort-by {|u| put $u[a]}", []string{"[&n y &a 1]", "[&n x &a 2]"}},
+	{"put a b | sort-by &reverse {|x| put $x}", []string{"b", "a"}},
+
+	// Tee into variables
+	{"var $mid table; put a b | tee-var mid | each {|x| put $x$x}; put $mid", []string{"aa", "bb", "[a b]"}},
+	{"var $mid bytes; print abc | tee-bytes mid | cat > /dev/null; put $mid", []string{"<Bytes 616263>"}},
+	{"var $s string; put a | tee-var s | each {|x| put $x}; put $status", []string{"a", "[`` `variable $s is not of type table` ``]"}},
+
+	// each and peach
+	{"put a b c | each {|x| put x$x}", []string{"xa", "xb", "xc"}},
+	{"range 4 | peach {|x| put $x} | sort", []string{"0", "1", "2", "3"}},
+	{"put a10 a9 | sort &version &locale; put a10 a9 | sort &version", []string{"a9", "a10", "a9", "a10"}},
+	{"put a10 a9 | sort `&version`; put $status", []string{"[`` `usage: sort [&locale] [&version]`]"}},
+	{"put a | each x; put $status", []string{"[`` `args error`]"}},
+	{"put a b | each {|x y| put $x}; put $status", []string{"[`` `arity mismatch`]"}},
+
+	// Path builtins
+	{"path:dir /a/b.c; path:base /a/b.c; path:ext /a/b.c", []string{"/a", "b.c", ".c"}},
+	{"path:clean /a/../b//c/; path:join a /b c", []string{"/b/c", "a/b/c"}},
+	{"fs:is-dir / /dev/null; fs:exists /dev/null /no/such/file", []string{"true", "false", "true", "false"}},
+
+	// Brace expansion
+	{"put file.{go,c} {a,b{c,d}}", []string{"file.go", "file.c", "a", "bc", "bd"}},
+	{"put {a,}x `{a,b}`", []string{"ax", "x", "`{a,b}`"}},
+
+	// Bytes
+	{"bytes:from-hex 00ff41", []string{"<Bytes 00ff41>"}},
+	{"bytes:to-hex (bytes:from-base64 AP9B)", []string{"00ff41"}},
+	{"bytes:slice (bytes:from-hex 00ff41) 1", []string{"<Bytes ff41>"}},
+	{"bytes:len (bytes:from-string héllo)", []string{"6"}},
+	{"bytes:compare (bytes:from-hex 00ff) (bytes:from-hex 01)", []string{"-1"}},
+	{"bytes:to-string (bytes:from-hex 6869)", []string{"hi"}},
+
+	// Numbers
+	{"num 010 1e2 -0.5", []string{"10", "100", "-0.5"}},
+	{"exact-num 0.1 2/4 5", []string{"1/10", "1/2", "5"}},
+	{"num 1 abc; put $status", []string{"[`not a number: abc`]"}},
+	{"< 1 2 10; < 1 10 2; <= 1 1 2; > 3 2 1; >= 2 2 3", []string{"true", "false", "true", "true", "false"}},
+	{"== 1 1.0 1e0; != 1 1.0", []string{"true", "false"}},
+	{"math:floor -1.5; math:ceil 1.2; math:round 2.5; math:abs -3", []string{"-2", "2", "3", "3"}},
+	{"math:pow 2 10; math:sqrt 16; math:min 3 1 2; math:max 3 1 2", []string{"1024", "4", "1", "3"}},
+	{"math:sin 0; math:atan2 0 1; math:sqrt -1", []string{"0", "0"}},
+
+	// Time builtins
+	{"time:format \"%Y-%m-%d %H:%M\" [&year 2024 &month 13 &day 1 &zone UTC]", []string{"`2025-01-01 00:00`"}},
+	{"var $t table; t = (time:parse rfc3339 2024-03-01T12:30:00+08:00); put $t[zone] $t[offset] $t[weekday]; time:format %T (time:in $t UTC)",
+		[]string{"+08:00", "28800", "Friday", "04:30:00"}},
+	{"time:format 2006-01-02T15:04 (time:add (time:parse %F 2024-02-28 UTC) 36h); put (time:parse %F 2024-03-01 UTC)[unix]",
+		[]string{"2024-02-29T12:00", "1709251200"}},
+	{"time:format \"%Y week 1 Monday %%d 05\" [&year 2026 &month 3 &day 4 &zone UTC]", []string{"`2026 week 1 Monday %d 05`"}},
+	{"var $t table; t = (time:parse \"%Y week 1 Monday %m-%d\" \"2026 week 1 Monday 03-04\" UTC); put $t[year] $t[month] $t[day] $t[weekday]",
+		[]string{"2026", "3", "4", "Wednesday"}},
+	{"time:parse \"%Y week 1 Monday\" \"2026 week 2 Monday\" UTC", []string{}},
+	{"time:sub [&year 2024 &day 2 &zone UTC] [&year 2024 &zone UTC]; time:duration 1h30m; time:duration -0.5", []string{"86400", "5400", "-0.5"}},
+
+	// merge and patch
+	{"merge [&a [&x 1]] [&a [&y 2]]", []string{"[&a [&y 2]]"}},
+	{"merge &deep [&a [l &x 1]] [&a [&x 2]]", []string{"[&a [l &x 2]]"}},
+	{"merge `&deep` [&a [&x 1]]; put $status", []string{"[`usage: merge [&deep] table...`]"}},
+	{"merge &shallow [&a 1]; put $status", []string{"[`unknown option &shallow`]"}},
+	{"patch [a b] [[&op add &path /1 &value x]]", []string{"[a x b]"}},
+	{"patch [&k [v]] [[&op add &path /k/- &value w]]", []string{"[&k [v w]]"}},
+	{"patch [a b c] [[&op remove &path /0] [&op replace &path /1 &value d]]", []string{"[b d]"}},
+
+	// Options of builtins are not strings
+	{"put &a; eq &a `&a`; eq &a &a", []string{"&a", "false", "true"}},
+	{"put a b | take `&exactly` 1; put $status", []string{"[`` `args error`]"}},
+
+	// Tilde expansion
+	{"named-dirs[src] = /usr/src; put ~src/linux a~", []string{"/usr/src/linux", "a~"}},
+	{"put `~`", []string{"~"}},
+
+	// Destructuring
+	{"var $a string; var $b table; {a @b} = [x y z]; put $a $b", []string{"x", "[y z]"}},
+	{"var $a $b string; [&k1 a &k2 b] = [&k1 x &k2 y]; put $b $a", []string{"y", "x"}},
+	{"for {k v} in [a 1] [b 2] { put $v$k }", []string{"1a", "2b"}},
+	{"for [&n n] in [&n x] [&n y] { put $n }", []string{"x", "y"}},
+
+	// Status
+	{"true | false >/dev/null; put $status", []string{"[`` `exited 1`]"}},
+	{"true >/dev/null; put $status", []string{"[``]"}},
+	{"false >/dev/null; put $?", []string{"[`exited 1`]"}},
+	{"false >/dev/null; put a | each {|x| put x | each {|y| }; put $status }", []string{"[`` ``]"}},
+	{"{ false >/dev/null; put $? }", []string{"[`exited 1`]"}},
+	{"{ put $status; false >/dev/null; { true >/dev/null; put $? }; put $status }", []string{"[]", "[``]", "[``]"}},
+	{"{ false >/dev/null }; put $status", []string{"[``]"}},
+	{"{ false >/dev/null; put a } | { num x; each {|x| put $x} }; put $status", []string{"a", "[`` ``]"}},
+	{"and { false >/dev/null | true >/dev/null } { true >/dev/null; false >/dev/null }", []string{"false"}},
+	{"spawn FOO=bar sh -c `test $FOO = bar` >/dev/null; put $status", []string{"[``]"}},
+	{"spawn -a foo sh -c `test $0 = foo` >/dev/null; put $status", []string{"[``]"}},
+
+	// Match
+	{"match foo { foo => { put lit }; _ => { put any } }", []string{"lit"}},
+	{"match bar { foo => { put lit }; _ => { put any } }", []string{"any"}},
+	{"match x { _ => { put any }; x => { put lit } }", []string{"any"}},
+	{"match [a] { type:string => { put s }; type:table => { put t } }", []string{"t"}},
+	{"match [a b c] { {x} => { put one }; {x @r} => { put $x $r } }", []string{"a", "[b c]"}},
+	{"match [&k v] { [&k x] => { put $x } }", []string{"v"}},
+	{"match a.go { glob:*.c => { put c }; glob:*.go => { put go } }", []string{"go"}},
+	{"match v1.2 { re:`^v(?P<major>[0-9]+)\\.` => { put $major } }", []string{"1"}},
+	{"match none { x => { put x } }", []string{}},
+
+	// Case
+	{"case a.go { *.c => { put c }; *.go *.h => { put go } }", []string{"go"}},
+	{"case abc { a?c => { put glob }; abc => { put lit } }", []string{"glob"}},
+	{"case `*` { `*` => { put lit }; * => { put any } }", []string{"lit"}},
+	{"case x { *.c => { put c } }", []string{}},
+	{"case (echo Linux) { *BSD => { put bsd }; Linux => { put linux } }", []string{"linux"}},
+
+	// Output capture
+	{"put (printf `a\\nb\\n`)", []string{"a", "b"}},
+	{"put (echo a `b c`)", []string{"`a b c`"}},
+
+	// $exec-hook
+	{"exec-hook = {|argv| }; put (echo a)", []string{"a"}},
+	{"exec-hook = {|argv| put [echo $argv[1]] }; put (cat x)", []string{"x"}},
+	{"exec-hook = {|argv| put [echo hooked] }; put (true)", []string{"hooked"}},
+	{"exec-hook = {|argv| put [] }; true; put $status", []string{"[`vetoed by exec hook`]"}},
+	{"exec-hook = {|argv| put x }; true; put $status", []string{"[`exec hook must output a table`]"}},
+
+	// and, or, not and coalesce
+	{"and true true; and true false; and", []string{"true", "false", "true"}},
+	{"or false true; or false false; or", []string{"true", "false", "false"}},
+	{"not false; not true; not x", []string{"true", "false", "false"}},
+	{"var $x string = a; and false { x = b }; or true { x = c }; put $x", []string{"false", "true", "a"}},
+	{"var $x string = a; and true { x = b }; put $x", []string{"true", "b"}},
+	{"and (put false) (range 1e9 | count)", []string{"false"}},
+	{"and { true >/dev/null } { false >/dev/null }", []string{"false"}},
+	{"or { false >/dev/null } { true >/dev/null }", []string{"true"}},
+	{"set-option strict on; not { false >/dev/null }", []string{"true"}},
+	{"var $e string = ``; coalesce $e `` b c", []string{"b"}},
+	{"coalesce `` ``", []string{}},
+
+	// Random numbers
+	{"randint 3 4", []string{"3"}},
+
+	// Equality
+	{"eq [a &k [b]] [a &k [b]]; eq [&k a &l b] [&l b &k a]; eq a a b", []string{"true", "true", "false"}},
+	{"eq [a b] [b a]; not-eq a b; not-eq [a] [a]", []string{"false", "true", "false"}},
+	{"var $t table = [a]; is $t $t; is $t [a]; is a a", []string{"true", "false", "true"}},
+	{"var $t table = [&[a] x &[&k [b]] y]; put $t[[a]] $t[[&k [b]]]", []string{"x", "y"}},
+	{"var $k table = [a]; var $t table; t[$k] = x; k[0] = b; put $t[[a]]", []string{"x"}},
+	{"var $t table = [&[a] x]; var $k table; k = (keys $t); k[0] = b; put $t[[a]] $k[0]", []string{"x", "b"}},
+
+	// Tables are values
+	{"var $a table = [x [y]]; var $b table = $a; b[0] = z; b[1][0] = w; put $a[0] $a[1][0] $b[0] $b[1][0]", []string{"x", "y", "z", "w"}},
+	{"var $a table = [x]; a[0] = y; var $b table = $a; a[0] = z; put $b[0] $a[0]", []string{"y", "z"}},
+	{"var $a table = [[x]]; a[0][0] = y; put $a | each {|t| a[0][0] = z; put $t[0][0] }", []string{"y"}},
+
+	// sleep, time and benchmark
+	{"sleep 1ms; sleep 0.001; put a", []string{"a"}},
+	{"keys (time { sleep 1ms })", []string{"wall", "user", "sys"}},
+	{"time { put a } | take 1", []string{"a"}},
+	{"keys (benchmark -n 2 { })", []string{"runs", "mean", "stddev", "min", "max"}},
+	{"benchmark -n 3 { } | each {|r| put $r[runs]}", []string{"3"}},
+	{"benchmark -n 2 { } { sleep 10ms } | each {|r| put $r[runs]}", []string{"2", "2"}},
+	{"benchmark -n 2 { sleep 10ms } { } | each {|r| put $r[relative]} | take 1 | not-eq (all) 1.00", []string{"true"}},
+	{"benchmark -min-time 10ms { put a } | take 1", []string{"a"}},
+	{"var $n string = 0; benchmark -n 5 { n = (+ $n 1); false }; put $status $n", []string{"[`exited 1`]", "1"}},
+	{"var $n string = 0; benchmark -n 5 { n = (+ $n 1); no-such-command-xyz }; put $status $n", []string{"[error]", "1"}},
+
+	// run-parallel
+	{"run-parallel { sleep 20ms; put a } { put b c } { }", []string{"a", "b", "c"}},
+	{"run-parallel { put a } { no-such-command-x } { put b }; put $status", []string{"a", "b", `["1 of 3 closures failed\n  closure 2: <eval test>:0:25 external command not found"]`}},
+	{"run-parallel a; put $status", []string{"[`run-parallel argument must be a closure, got a`]"}},
+
+	// Channels, mutexes and onces
+	{"var $c chan; c = (chan:make 2); chan:send $c a b; chan:recv $c 2", []string{"a", "b"}},
+	{"var $c chan; c = (chan:make); run-parallel { chan:send $c a b c; chan:close $c } { chan:recv-all $c }", []string{"a", "b", "c"}},
+	{"var $c chan; c = (chan:make 1); chan:send $c a; chan:close $c; chan:recv $c; chan:recv $c; put $status", []string{"a", "[`channel closed`]"}},
+	{"var $c chan; c = (chan:make 1); chan:close $c; chan:send $c a; put $status", []string{"[`channel closed`]"}},
+	{"var $m mutex; m = (sync:mutex); var $n string = 0; range 50 | peach {|x| sync:with-lock $m { n = (+ $n 1) } }; put $n", []string{"50"}},
+	{"var $o once; o = (sync:once); range 3 | peach {|x| sync:do $o { put once } }", []string{"once"}},
+	{"var $m mutex; m = (sync:mutex); eq $m $m; eq $m (sync:mutex)", []string{"true", "false"}},
+
+	// Temporary assignments
+	{"var $x string = a; x=b put $x; put $x", []string{"b", "a"}},
+	{"var $x string = a; x=(put b)c put $x; put $x", []string{"bc", "a"}},
+	{"put (ELVISH_T=foo sh -c `echo $ELVISH_T`) $env[ELVISH_T]", []string{"foo", "``"}},
+	{"ELVISH_T=foo put $env[ELVISH_T] | each {|x| put $x $env[ELVISH_T]}", []string{"foo", "``"}},
+	{"var $x string = a; x=b put $x | each {|y| put $y $x}", []string{"b", "a"}},
+	{"var $x string = a; put 1 | x=b each {|y| put $x}", []string{"b"}},
+	{"var $x string = a; var $f closure = {|y| put $x}; put 1 | x=b each $f", []string{"a"}},
+	{"var $x string = a; x=b var $y string = c; put $x $y", []string{"a", "c"}},
+	{"var $t table = [a]; t=[b] put $t[0]; put $t[0]", []string{"b", "a"}},
+	{"export ELVISH_T=1; put (sh -c `echo $ELVISH_T`); unexport ELVISH_T; put (sh -c `echo x$ELVISH_T`) $env[ELVISH_T]", []string{"1", "x", "1"}},
+	{"unexport &all; export ELVISH_T=2; export; put (ELVISH_U=3 sh -c `echo $ELVISH_T$ELVISH_U`)", []string{"[&ELVISH_T 2]", "23"}},
+	{"var $x string = a; { x=b nonexistent-command >/dev/null }; put $x", []string{"a"}},
+	{"put a=b", []string{"a=b"}},
+
+	// Range and for
+	{"put (range 3)", []string{"0", "1", "2"}},
+	{"put (range 1 10 4)", []string{"1", "5", "9"}},
+	{"put (range 999998 1000002)", []string{"999998", "999999", "1000000", "1000001"}},
+	{"range 1e21 1e21 | count; range 1e15 3e15 1e15", []string{"0", "1000000000000000", "2000000000000000"}},
+	{"range 1e9 | take 3", []string{"0", "1", "2"}},
+	{"range 1e9 | drop 2 | take 2", []string{"2", "3"}},
+	{"range 2 | take 5", []string{"0", "1"}},
+	{"range 4 | count", []string{"4"}},
+	{"put a | one", []string{"a"}},
+	{"put a b | one; put $status", []string{"[`` error]"}},
+	{"range 0 | one; put $status", []string{"[`` error]"}},
+	{"range 5 | take &exactly 2", []string{"0", "1"}},
+	{"range 1 | take &exactly 2; put $status", []string{"0", "[`` error]"}},
+	{"range 5 | take &exactly &all 2; put $status", []string{"[`` `unknown option &all`]"}},
+	{"put a | order &reverse &numeric; put $status", []string{"[`` `unknown option &numeric`]"}},
+	{"put a | sort &numeric; put $status", []string{"[`` `unknown option &numeric`]"}},
+	{"all [a b [c]]", []string{"a", "b", "[c]"}},
+	{"put a b | all", []string{"a", "b"}},
+	{"put a b c | take 1", []string{"a"}},
+	{"range 1e9 | first", []string{"0"}},
+	{"range 4 | last", []string{"3"}},
+	{"range 0 | first; put $status", []string{"[`` `empty input`]"}},
+
+	// only-bytes and only-values
+	{"put (echo a | only-bytes)", []string{"a"}},
+	{"put (range 3 | only-bytes)", []string{}},
+	{"range 2 | only-values", []string{"0", "1"}},
+	{"echo a | only-values", []string{}},
+	{"for i in a b c { put $i }", []string{"a", "b", "c"}},
+	{"for i in (range 0 10 5) { put $i }", []string{"0", "5"}},
+	{"for i in (range 999999 1000001) { put $i }", []string{"999999", "1000000"}},
+	{"for i from 3 to 0 step -1 { put $i }", []string{"3", "2", "1"}},
+	{"for i in a b c { put $i; false >/dev/null }; put $status", []string{"a", "[`exited 1`]"}},
+	{"for i from 0 to 3 { put $i; false >/dev/null }; put $status", []string{"0", "[`exited 1`]"}},
+	{"for i in a b { false >/dev/null; put $i }; put $status", []string{"a", "b", "[``]"}},
+	{"var $i string = x; for i from 0 to 1 { put $i }; put $i", []string{"0", "x"}},
+
+	// Scoping
+	{"var $x string = a; { var $x string = b }; put $x", []string{"a"}},
+	{"var $x string = a; { { set $x = b } }; put $x", []string{"b"}},
+	{"var $x string = a; { x = b }; put $x", []string{"b"}},
+
+	// Syntax trees
+	{"var $t table; t = (ast:parse `echo $x`); put $t[pipelines][0][forms][0][args][0][factors][0][name]", []string{"x"}},
+	{"var $t table; t = (ast:parse `take &exactly 1`); put $t[pipelines][0][forms][0][args][0][factors][0][type]; ast:unparse $t", []string{"option", `"take &exactly 1\n"`}},
+	{"var $t table; t = (ast:parse `put a$x ^b`); put $t[pipelines][0][forms][0][args][0][factors][2][end]", []string{"10"}},
+	{"ast:unparse (ast:parse `put a$x ^b [&k v] {|x| put $x; put y} | each {a,b}c >/dev/null ?>$s; foo`)",
+		[]string{`"put a$x ^b [&k v] {|x| put $x; put y } | each {a b}c >/dev/null ?>$s\nfoo\n"`}},
+	{"ast:unparse (ast:parse `echo \"a$x b$(put c)\" <<<``d```)", []string{`"echo \"a${x} b$(put c)\" <<<` + "`d`" + `\n"`}},
+	{"ast:unparse [&type chunk &pipelines [[&type pipeline &forms [[&type form &command [&type term &factors [[&type string &text `a b`]]]]]]]]", []string{`"` + "`a b`" + `\n"`}},
+	{"ast:unparse [&type chunk &pipelines [a]]; put $status", []string{"[`bad syntax tree: node must be a table, got a`]"}},
+	{"ast:parse `put {`; put $status", []string{"[`<ast:parse>:0:5 unexpected eof in end of closure`]"}},
+	{"ast:eval `var $x string = a; put $x`; ast:eval (ast:parse `put b`)", []string{"a", "b"}},
+	{"var $x string = a; ast:eval `x = b`; put $x", []string{"b"}},
+
+	// Options
+	{"put $options[path-cache] $options[strict]", []string{"false", "false"}},
+	{"options[path-cache] = true; put $options[path-cache]", []string{"true"}},
+	{"options = [&path-cache true]; put $options[xtrace] $options[path-cache]", []string{"false", "true"}},
+
+	// Default redirections
+	{"default-redir put `>/dev/null <[0=]`; put $status", []string{"[``]"}},
+	{"default-redir put ``; put $status", []string{"[``]"}},
+	{"default-redir put a; put $status", []string{"[`<default redirections of put>: must contain redirections only`]"}},
+	{"default-redir put `>$x`; put $status", []string{"[`<default redirections of put>: filename must be a string literal`]"}},
+	{"default-redir; put $status", []string{"[`args error`]"}},
+
+	// Host variables
+	{"put $args", []string{"[]"}},
+	{"eq $ppid $pid; put (not-eq $platform[os] ``)", []string{"false", "true"}},
+
+	// Build info and features
+	{"put $buildinfo[version] $features[daemon]", []string{"unknown", "false"}},
+	{"put $buildinfo[api-version]", []string{"1"}},
+
+	// Conversion between byte and value streams
+	{"printf `a\\nb\\n` | each {|l| put x$l}", []string{"xa", "xb"}},
+	{"put a b | cat", []string{"a", "b"}},
+	{"put a b | cat | each {|l| put x$l}", []string{"xa", "xb"}},
+
+	// Terminated records
+	{"printf `a\\nb` | from-lines", []string{"a", "b"}},
+	{"print \"a\\000b\\000\" | from-terminated \"\\000\" | each {|x| put x$x}", []string{"xa", "xb"}},
+	{"to-terminated , a b | from-terminated ,", []string{"a", "b"}},
+	{"put a b | to-lines | from-lines", []string{"a", "b"}},
+	{"to-terminated ab a; put $status", []string{"[`terminator must be a single byte, got ab`]"}},
+
+	// Encoding and compression
+	{"print hello | base64:encode | from-lines", []string{"aGVsbG8="}},
+	{"print \"aGVs\\nbG8=\\n\" | base64:decode | slurp", []string{"hello"}},
+	{"print hi | hex:encode | from-lines", []string{"6869"}},
+	{"print 6869 | hex:decode | slurp", []string{"hi"}},
+	{"print hello | gzip:compress 9 | gzip:decompress | slurp", []string{"hello"}},
+	{"print hello | gzip:compress | base64:encode | base64:decode | gzip:decompress | slurp", []string{"hello"}},
+	{"print a | gzip:compress fast; put $status", []string{"[`` `bad compression level fast`]"}},
+
+	// Checksums
+	{"print hello | hash:md5", []string{"5d41402abc4b2a76b9719d911017c592"}},
+	{"print hello | hash:sha1", []string{"aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"}},
+	{"print hello | hash:sha256", []string{"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"}},
+	{"hash:md5 /dev/null /dev/null | each {|t| put $t[md5]}", []string{"d41d8cd98f00b204e9800998ecf8427e", "d41d8cd98f00b204e9800998ecf8427e"}},
+	{"hash:sha1 /nonexistent; put $status", []string{"[`open /nonexistent: no such file or directory`]"}},
+
+	// Read-only variables
+	{"const $x string = a; put $x; { var $x string = b; put $x }", []string{"a", "b"}},
+	{"const $x table = []; put a | tee-var x | each {|v| }; put $status", []string{"[`` `variable $x is read-only` ``]"}},
+
+	// Debugger controls without a debugger
+	{"debug:break; put $status", []string{"[`no debugger`]"}},
+	{"debug:set-breakpoint a x; put $status", []string{"[`bad line number x`]"}},
+	{"debug:breakpoints; put $status", []string{"[`no debugger`]"}},
+}
+
+var compileErrorTests = []string{
+	"a = foo",
+	"{ var $x string }; set $x = foo",
+	"var $x string; x = [a]",
+	"for i from 0 { put $i }",
+	"match x { x { put x } }",
+	"match x { type:nosuchtype => { put x } }",
+	"var $a $b string; {a b} = [x y z]",
+	"var $a string; {a @b} = [x y]",
+	"for i in a b; put $i",
+	"put $nosuch",
+	"{ put $nosuch }",
+	"set $pid = 1",
+	"args = [a]",
+	"const $x string = a; { x = b }",
+	"const $x string = a; var $x string = b",
+	"const $x string = a; x=b put $x",
+	"var $t table = [a]; t=foo put $t[0]",
+	"const $x string = a; {x} = [b]",
+	"const $x string",
+}
+
+var statusLineTests = []struct {
+	statuses []string
+	want     string
+}{
+	{[]string{""}, ""},
+	{[]string{"", "", ""}, ""},
+	{[]string{"exited 1"}, "Status: `exited 1`"},
+	{[]string{"", "not a number: x"}, "Status: #2 `not a number: x`"},
+	{[]string{"<thrown>", ""}, ""},
+	{[]string{"error"}, "Status: error"},
+}
+
+func TestStatusLine(t *testing.T) {
+	for _, tt := range statusLineTests {
+		vs := make([]Value, len(tt.statuses))
+		for i, s := range tt.statuses {
+			if s == "<thrown>" {
+				vs[i] = thrownStatus
+			} else {
+				vs[i] = NewString(s)
+			}
+		}
+		if got := statusLine(vs); got != tt.want {
+			t.Errorf("statusLine(%q) => %q, want %q", tt.statuses, got, tt.want)
+		}
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	for _, text := range compileErrorTests {
+		n, err := parse.Parse("<compile error test>", text)
+		if err != nil {
+			t.Fatalf("Parse(*, %q) => error %v", text, err)
+		}
+		ev := NewEvaluator()
+		_, err = ev.Compiler.Compile("<compile error test>", text, n, ev.MakeCompilerScope())
+		if err == nil {
+			t.Errorf("Compile(*, %q, *) => no error, want error", text)
+		}
+	}
+}
+
+func TestCompileAll(t *testing.T) {
+	text := "println $a; println ok; { println $b; println $c }; var $d string = [a]"
+	n, err := parse.Parse("<compile all test>", text)
+	if err != nil {
+		t.Fatalf("Parse(*, %q) => error %v", text, err)
+	}
+	ev := NewEvaluator()
+	_, err = ev.Compiler.CompileAll("<compile all test>", text, n, ev.MakeCompilerScope())
+	if es, ok := err.(util.Errors); !ok || len(es) != 4 {
+		t.Errorf("CompileAll(*, %q, *) => error %v, want 4 errors", text, err)
+	}
+}
+
+var dirStackText = "cd /; pushd /proc; put $pwd; dirs; popd; put $pwd; " +
+	"cd -; put $pwd $env[OLDPWD]"
+
+var dirStackWanted = []string{"/proc", "/proc", "/", "/", "/proc", "/"}
+
+func TestDirStack(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	out := reprs(evalAndCollect(t, dirStackText))
+	if !reflect.DeepEqual(out, dirStackWanted) {
+		t.Errorf("Eval(*, %q, *) outputs %v, want %v", dirStackText, out, dirStackWanted)
+	}
+}
+
+func TestChdirHook(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	ev := NewEvaluator()
+	var visited []string
+	ev.SetChdirHook(func(dir string) {
+		// The hook is called after the directory state is unlocked, so it
+		// may use it.
+		ev.SetDirMatcher(nil)
+		visited = append(visited, dir)
+	})
+	if msg := cd(ev, []Value{NewString("/")}); msg != "" {
+		t.Fatalf("cd / => %q", msg)
+	}
+	if msg := pushd(ev, []Value{NewString("/proc")}); msg != "" {
+		t.Fatalf("pushd /proc => %q", msg)
+	}
+	if msg := popd(ev, nil); msg != "" {
+		t.Fatalf("popd => %q", msg)
+	}
+	if want := []string{"/", "/proc", "/"}; !reflect.DeepEqual(visited, want) {
+		t.Errorf("cd /; pushd /proc; popd visits %v, want %v", visited, want)
+	}
+}
+
+func TestCdJump(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	ev := NewEvaluator()
+	ev.SetDirMatcher(func(pattern string) []string {
+		if pattern == "no-such-dir-pr" {
+			return []string{"/", "/proc"}
+		}
+		return nil
+	})
+	os.Chdir("/")
+	if msg := cd(ev, []Value{NewString("no-such-dir-pr")}); msg != "" {
+		t.Errorf("cd no-such-dir-pr => %q, want success", msg)
+	}
+	if wd, _ := os.Getwd(); wd != "/proc" {
+		t.Errorf("cd no-such-dir-pr went to %q, want /proc", wd)
+	}
+	if msg := cd(ev, []Value{NewString("no-such-dir")}); msg == "" {
+		t.Errorf("cd no-such-dir => success, want failure")
+	}
+}
+
+func TestWait(t *testing.T) {
+	ev := NewEvaluator()
+	for _, cmd := range []string{"true", "false"} {
+		if msg := spawn(ev, []Value{NewString("-b"), NewString(cmd)}); msg != "" {
+			t.Fatalf("spawn -b %s => %q", cmd, msg)
+		}
+	}
+	ch := make(chan Value, 1)
+	ev.ports[1] = &port{ch: ch}
+	if msg := waitFn(ev, nil); msg != "" {
+		t.Errorf("wait => %q", msg)
+	}
+	// The statuses are in the order of the pids, which need not be the order
+	// the commands were spawned in.
+	statuses := reprs((<-ch).(*Table).List)
+	sort.Strings(statuses)
+	if want := []string{"``", "`exited 1`"}; !reflect.DeepEqual(statuses, want) {
+		t.Errorf("wait outputs statuses %v, want %v in any order", statuses, want)
+	}
+	if pids := ev.procs.pids(); len(pids) != 0 {
+		t.Errorf("after wait, pids = %v, want none", pids)
+	}
+}
+
+func TestKill(t *testing.T) {
+	ev := NewEvaluator()
+	if msg := spawn(ev, []Value{NewString("-b"), NewString("sleep"), NewString("10")}); msg != "" {
+		t.Fatalf("spawn -b sleep 10 => %q", msg)
+	}
+	ch := make(chan Value, 1)
+	ev.ports[1] = &port{ch: ch}
+	procsFn(ev, nil)
+	if msg := killFn(ev, []Value{NewString("-sigint"), <-ch}); msg != "" {
+		t.Errorf("kill -sigint $proc => %q", msg)
+	}
+	waitFn(ev, nil)
+	if out := (<-ch).Repr(); out != "[`signaled interrupt`]" {
+		t.Errorf("wait after kill outputs %s, want [`signaled interrupt`]", out)
+	}
+	for _, args := range [][]string{{"-NOSUCH", "1"}, {"-TERM"}, {"abc"}} {
+		var vs []Value
+		for _, a := range args {
+			vs = append(vs, NewString(a))
+		}
+		if msg := killFn(ev, vs); msg == "" {
+			t.Errorf("kill %v => success, want failure", args)
+		}
+	}
+}
+
+func TestRuntimeStats(t *testing.T) {
+	ev := NewEvaluator()
+	ch := make(chan Value, 1)
+	ev.ports[1] = &port{ch: ch}
+	for _, tt := range []struct {
+		name string
+		f    func(*Evaluator, []Value) string
+		keys []string
+	}{
+		{"runtime:stats", runtimeStats, []string{"goroutines", "evaluators", "ports", "jobs"}},
+		{"runtime:mem", runtimeMem, []string{"alloc", "total-alloc", "sys", "heap-objects", "num-gc"}},
+	} {
+		if msg := tt.f(ev, nil); msg != "" {
+			t.Fatalf("%s => %q", tt.name, msg)
+		}
+		table := (<-ch).(*Table)
+		for _, k := range tt.keys {
+			v, ok := table.lookup(k)
+			if !ok {
+				t.Errorf("%s outputs no &%s", tt.name, k)
+			} else if _, err := strconv.ParseUint(v.String(), 10, 64); err != nil {
+				t.Errorf("%s outputs &%s %s, want a count", tt.name, k, v.Repr())
+			}
+		}
+		if msg := tt.f(ev, []Value{NewString("x")}); msg != "args error" {
+			t.Errorf("%s x => %q, want args error", tt.name, msg)
+		}
+	}
+}
+
+func TestRuntimePprof(t *testing.T) {
+	ev := NewEvaluator()
+	if msg := runtimePprof(ev, []Value{NewString("127.0.0.1:0")}); msg != "" {
+		t.Fatalf("runtime:pprof 127.0.0.1:0 => %q", msg)
+	}
+	addr := pprofState.listener.Addr().String()
+	if msg := runtimePprof(ev, []Value{NewString("127.0.0.1:0")}); msg == "" {
+		t.Errorf("runtime:pprof while serving => success, want failure")
+	}
+	resp, err := http.Get("http://" + addr + "/debug/pprof/goroutine?debug=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "goroutine profile") {
+		t.Errorf("goroutine profile => %s %q", resp.Status, body)
+	}
+	req := httptest.NewRequest("GET", "/debug/pprof/", nil)
+	if _, pattern := http.DefaultServeMux.Handler(req); pattern != "" {
+		t.Errorf("http.DefaultServeMux has a handler for %s", pattern)
+	}
+	if msg := runtimePprof(ev, []Value{NewString("off")}); msg != "" {
+		t.Errorf("runtime:pprof off => %q", msg)
+	}
+	if msg := runtimePprof(ev, []Value{NewString("off")}); msg == "" {
+		t.Errorf("runtime:pprof off when not serving => success, want failure")
+	}
+}
+
+func TestClose(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	f := NewFile(w, "w")
+	if msg := closeFn(nil, []Value{f}); msg != "" {
+		t.Errorf("close $f => %q, want success", msg)
+	}
+	if msg := closeFn(nil, []Value{f}); msg != errAlreadyClosed.Error() {
+		t.Errorf("close $f again => %q, want %q", msg, errAlreadyClosed.Error())
+	}
+	if msg := closeFn(nil, []Value{NewString("x")}); msg == "" {
+		t.Errorf("close x => success, want failure")
+	}
+}
+
+func TestOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elvish-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := dir + "/a"
+	text := "echo hello > (open " + a + " w); echo world > (fopen " + a + " a); slurp < (open " + a + ")"
+	out := reprs(evalAndCollect(t, text))
+	if want := []string{"\"hello\\nworld\\n\""}; !reflect.DeepEqual(out, want) {
+		t.Errorf("Eval(*, %q, *) outputs %v, want %v", text, out, want)
+	}
+	if msg := fopen(NewEvaluator(), []Value{NewString(a), NewString("x")}); msg != "bad mode: x" {
+		t.Errorf("open with a bad mode => %q, want %q", msg, "bad mode: x")
+	}
+}
+
+func TestFilePortKeepsFile(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	// The File is only referenced by the port, like that of
+	// echo hello > (fopen x w).
+	p := newValueFilePort(NewFile(w, "w"))
+	for i := 0; i < 3; i++ {
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := p.f.Write([]byte("hello")); err != nil {
+		t.Errorf("writing to the port of a File => %v, want success", err)
+	}
+	p.release()
+}
+
+var optionTests = []struct {
+	text    string
+	wantErr bool
+}{
+	{"set-option errexit on; false >/dev/null; put x", true},
+	{"{ set-option errexit on; put x }; false >/dev/null", false},
+	{"set-option errexit on; false >/dev/null | true >/dev/null", false},
+	{"set-option errexit pipefail on; false >/dev/null | true >/dev/null", true},
+	{"set-option noclobber on; echo a >$file", true},
+	{"set-option noclobber on; echo a >|$file", false},
+	{"set-option noclobber on; echo a >>$file", false},
+	{"set-option noclobber on; echo a >/dev/null", false},
+	{"set-option noclobber on; echo a >$file`.new`; echo b >$file`.new`", true},
+	{"var $x string; put $x", false},
+	{"set-option nounset on; var $x string; put $x", true},
+	{"set-option nounset on; var $t table; put $@t", true},
+	{"set-option nounset on; var $x string; put $x? $x?$x?", false},
+	{"set-option nounset on; var $x string; x = a; put $x", false},
+	{"set-option nounset on; var $t table; t[k] = v; put $@t", false},
+	{"set-option strict on; false >/dev/null | true >/dev/null", true},
+	{"set-option strict on; or { false >/dev/null } { true >/dev/null }; not { false >/dev/null }", false},
+	{"set-option strict on; or { false >/dev/null } { true >/dev/null }; false >/dev/null", true},
+}
+
+func TestTempAssignmentTypes(t *testing.T) {
+	for _, text := range []string{
+		"var $t table = [a]; t=(put foo) put $t[0]",
+		"var $s string = a; s=(put [b]) put $s",
+	} {
+		if _, err := evalAndCollectErr(t, text); err == nil {
+			t.Errorf("Eval(*, %q, *) => no error, want type mismatch", text)
+		}
+	}
+}
+
+func TestShellOptions(t *testing.T) {
+	f, err := ioutil.TempFile("", "elvish-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	defer os.Remove(f.Name() + ".new")
+
+	for _, tt := range optionTests {
+		text := "var $file string = " + f.Name() + "; " + tt.text
+		_, err := evalAndCollectErr(t, text)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Eval(*, %q, *) => error %v, want error: %v", text, err, tt.wantErr)
+		}
+	}
+}
+
+func TestEval(t *testing.T) {
+	for _, tt := range evalTests {
+		out := reprs(evalAndCollect(t, tt.text))
+		if !reflect.DeepEqual(out, tt.wanted) {
+			t.Errorf("Eval(*, %q, *) outputs %v, want %v", tt.text, out, tt.wanted)
+		}
+	}
+}
+
+func list(ss ...string) *Table {
+	t := NewTable()
+	for _, s := range ss {
+		t.append(NewString(s))
+	}
+	return t
+}
+
+var diffTests = []struct {
+	a, b   Value
+	wanted []diffLine
+}{
+	{NewString("a\nb\nc\n"), NewString("a\nc\nd\n"),
+		[]diffLine{{' ', "a"}, {'-', "b"}, {' ', "c"}, {'+', "d"}}},
+	{list("a", "b"), list("a", "b"), []diffLine{{' ', "a"}, {' ', "b"}}},
+	{list("a", "b"), NewString("a"), []diffLine{{'-', "[a b]"}, {'+', "a"}}},
+	{&Table{Dict: map[Value]Value{
+		NewString("k"): NewString("v"), NewString("l"): list("x", "y"), NewString("m"): NewString("1")}},
+		&Table{Dict: map[Value]Value{
+			NewString("k"): NewString("w"), NewString("l"): list("x", "z"), NewString("n"): NewString("2")}},
+		[]diffLine{
+			{'-', "&k v"}, {'+', "&k w"},
+			{' ', "&l ["}, {' ', "  x"}, {'-', "  y"}, {'+', "  z"}, {' ', "]"},
+			{'-', "&m 1"}, {'+', "&n 2"}}},
+}
+
+func TestDiffValues(t *testing.T) {
+	for _, tt := range diffTests {
+		out := diffValues(tt.a, tt.b)
+		if !reflect.DeepEqual(out, tt.wanted) {
+			t.Errorf("diffValues(%s, %s) => %v, want %v", tt.a.Repr(), tt.b.Repr(), out, tt.wanted)
+		}
+	}
+}
+
+var promptTests = []struct {
+	text   string
+	wanted string
+}{
+	{"", "fallback"},
+	{`set $prompt = { put a "b>" }`, "ab>"},
+	{"set $prompt = {|x| put $x }", "fallback"},
+}
+
+func TestPromptFunc(t *testing.T) {
+	for _, tt := range promptTests {
+		ev := NewEvaluator()
+		n, err := parse.Parse("<prompt test>", tt.text)
+		if err != nil {
+			t.Fatalf("Parse(*, %q) => error %v", tt.text, err)
+		}
+		if err := ev.Eval("<prompt test>", tt.text, n); err != nil {
+			t.Fatalf("Eval(*, %q, *) => error %v", tt.text, err)
+		}
+		prompt := ev.PromptFunc("prompt", func() string { return "fallback" })
+		if s := prompt(); s != tt.wanted {
+			t.Errorf("after %q, prompt() => %q, want %q", tt.text, s, tt.wanted)
+		}
+	}
+}
+
+func TestAsyncPrompt(t *testing.T) {
+	ev := NewEvaluator()
+	if err := ev.EvalText("<prompt test>", "var $n string = 0; set $prompt = { sleep 50ms; n = (+ $n 1); put p$n }"); err != nil {
+		t.Fatal(err)
+	}
+	updated := make(chan string, 10)
+	p := ev.AsyncPromptFunc("prompt", func() string { return "fallback" })
+	p.OnUpdate(func() { updated <- p.Get() })
+	p.Refresh()
+	if s := p.Get(); s != "fallback" {
+		t.Errorf("while rendering for the first time, Get() => %q, want fallback", s)
+	}
+	if p.Wait(time.Now().Add(10 * time.Millisecond)) {
+		t.Errorf("Wait returned true before the rendering ended")
+	}
+	if s := <-updated; s != "p1" {
+		t.Errorf("after rendering, prompt updated to %q, want p1", s)
+	}
+
+	// A rendering canceled by a new one and one timing out leave no trace.
+	p.Refresh()
+	p.Refresh()
+	if !p.Wait(time.Now().Add(time.Second)) {
+		t.Fatalf("rendering did not end")
+	}
+	if s := p.Get(); s != "p2" {
+		t.Errorf("after refreshing twice, Get() => %q, want p2", s)
+	}
+	defer func(d time.Duration) { PromptTimeout = d }(PromptTimeout)
+	PromptTimeout = 10 * time.Millisecond
+	p.Refresh()
+	p.Wait(time.Now().Add(time.Second))
+	if s := p.Get(); s != "p2" {
+		t.Errorf("after a rendering timed out, Get() => %q, want p2 kept", s)
+	}
+
+	// A canceled rendering has ended when Cancel returns, without running on.
+	PromptTimeout = time.Second
+	p.Refresh()
+	p.Cancel()
+	time.Sleep(100 * time.Millisecond)
+	if v, _ := ev.scope.lookup("n"); v.Get().String() != "2" {
+		t.Errorf("after canceling a rendering, $n is %s, want 2 kept", v.Get().Repr())
+	}
+	if s := p.Get(); s != "p2" {
+		t.Errorf("after canceling a rendering, Get() => %q, want p2 kept", s)
+	}
+}
+
+var validateTests = []struct {
+	schema string
+	value  string
+	wanted []validationError
+}{
+	{"[&type string &minLength 2]", "a", []validationError{{"/", "a is shorter than 2"}}},
+	{"[&type [integer boolean]]", "true", nil},
+	{"[&type integer &maximum 10]", "[a]", []validationError{{"/", "expect integer, got [a]"}}},
+	{"[&type array &items [&enum [a b]]]", "[a c]", []validationError{{"/1", "c is not one of [a b]"}}},
+	{"[&required [name] &additionalProperties false &properties [&port [&type integer]]]",
+		"[&port x &host h]", []validationError{
+			{"/", "missing required key name"},
+			{"/", "unexpected key host"},
+			{"/port", "expect integer, got x"}}},
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range validateTests {
+		vs := evalAndCollect(t, "put "+tt.schema+" "+tt.value)
+		vd := &validator{}
+		if err := vd.validate(vs[0].(*Table), vs[1], ""); err != nil {
+			t.Errorf("validate(%s, %s) => error %v", tt.schema, tt.value, err)
+		}
+		if !reflect.DeepEqual(vd.errors, tt.wanted) {
+			t.Errorf("validate(%s, %s) => %v, want %v", tt.schema, tt.value, vd.errors, tt.wanted)
+		}
+	}
+}
+
+var sortTests = []struct {
+	locale, version bool
+	in, wanted      []string
+}{
+	{false, false, []string{"b", "B", "a", "file10", "file2"}, []string{"B", "a", "b", "file10", "file2"}},
+	{true, false, []string{"b", "B", "a", "_c"}, []string{"a", "B", "b", "_c"}},
+	{false, true, []string{"file10", "file2", "file02", "file1a"}, []string{"file1a", "file02", "file2", "file10"}},
+	{true, true, []string{"Img10.png", "img2.png", "IMG1.png"}, []string{"IMG1.png", "img2.png", "Img10.png"}},
+}
+
+func TestSortLess(t *testing.T) {
+	os.Setenv("LC_ALL", "en_US.UTF-8")
+	defer os.Unsetenv("LC_ALL")
+	for _, tt := range sortTests {
+		less := sortLess(tt.locale, tt.version)
+		out := append([]string(nil), tt.in...)
+		sort.SliceStable(out, func(i, j int) bool { return less(out[i], out[j]) })
+		if !reflect.DeepEqual(out, tt.wanted) {
+			t.Errorf("sorting %q with locale %v, version %v => %q, want %q", tt.in, tt.locale, tt.version, out, tt.wanted)
+		}
+	}
+}
+
+func TestReadUpto(t *testing.T) {
+	in := strings.NewReader("a,b\nc")
+	for _, want := range []string{"a,", "b\n", "c"} {
+		delim := byte('\n')
+		if want == "a," {
+			delim = ','
+		}
+		if s, err := readUpto(in, delim); s != want || err != nil {
+			t.Errorf("readUpto => (%q, %v), want (%q, nil)", s, err, want)
+		}
+	}
+	if _, err := readUpto(in, '\n'); err != io.EOF {
+		t.Errorf("readUpto at end of input => error %v, want EOF", err)
+	}
+}
+
+func TestRelayDrain(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	var buf bytes.Buffer
+	rl := newRelay(r, 1, &buf)
+	go rl.run()
+	ev := &Evaluator{relays: []*relay{rl}}
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	w.Write(data)
+	ev.drainRelays()
+	if buf.Len() != len(data) {
+		t.Errorf("after drainRelays, %d bytes relayed, want %d", buf.Len(), len(data))
+	}
+}
+
+var withExtsTests = []struct {
+	exe     string
+	pathext string
+	wanted  []string
+}{
+	{"git", "", []string{"git.com", "git.exe", "git.bat", "git.cmd"}},
+	{"git", ".EXE;;.Cmd", []string{"git.exe", "git.cmd"}},
+	{"git.EXE", ".EXE;.CMD", []string{"git.EXE"}},
+	{"a.b", ".EXE", []string{"a.b.exe"}},
+}
+
+func TestWithExts(t *testing.T) {
+	for _, tt := range withExtsTests {
+		if out := withExts(tt.exe, splitPathExt(tt.pathext)); !reflect.DeepEqual(out, tt.wanted) {
+			t.Errorf("withExts(%q) with PATHEXT %q => %q, want %q", tt.exe, tt.pathext, out, tt.wanted)
+		}
+	}
+	if out := withExts("git", []string{""}); !reflect.DeepEqual(out, []string{"git"}) {
+		t.Errorf("withExts(%q) without extensions => %q, want [git]", "git", out)
+	}
+}
+
+func TestFsBuiltins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elvish-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := dir + "/a"
+	text := "fs:mkdir &parents " + a + "/b; fs:is-dir " + a + "/b; " +
+		"fs:remove &recursive " + a + "; fs:exists " + a
+	out := reprs(evalAndCollect(t, text))
+	if want := []string{"true", "false"}; !reflect.DeepEqual(out, want) {
+		t.Errorf("Eval(*, %q, *) outputs %v, want %v", text, out, want)
+	}
+
+	ev := NewEvaluator()
+	ch := make(chan Value, 1)
+	ev.ports[1] = &port{ch: ch}
+	if msg := fsTempFile(ev, []Value{NewString(dir), NewString("t-*")}); msg != "" {
+		t.Fatalf("fs:temp-file => %q", msg)
+	}
+	f := (<-ch).(*File)
+	defer f.f.Close()
+	if !strings.HasPrefix(f.name, dir+"/t-") {
+		t.Errorf("fs:temp-file created %s, want a file under %s", f.name, dir)
+	}
+	if msg := fsMkdir(nil, []Value{NewString(dir)}); msg == "" {
+		t.Errorf("fs:mkdir of an existing directory => success, want failure")
+	}
+	// An unknown option is not taken for the name of a file.
+	if msg := fsRemove(nil, []Value{NewOptionArg("all"), NewString(f.name)}); msg != "unknown option &all" {
+		t.Errorf("fs:remove &all => %q, want unknown option", msg)
+	}
+	if _, err := os.Stat(f.name); err != nil {
+		t.Errorf("fs:remove &all removed %s", f.name)
+	}
+
+	l := dir + "/l"
+	if err := os.Mkdir(l, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(l+"/f", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(l+"/f", 0644)
+	text = "fs:list " + l + " | each {|f| put $f[name] $f[path] $f[size] $f[mode] }; " +
+		"fs:list " + l + "/f | each {|f| put $f[name] }"
+	out = reprs(evalAndCollect(t, text))
+	if want := []string{"f", l + "/f", "5", "-rw-r--r--", "f"}; !reflect.DeepEqual(out, want) {
+		t.Errorf("Eval(*, %q, *) outputs %v, want %v", text, out, want)
+	}
+}
+
+func TestProcList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elvish-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(root string) { procRoot = root }(procRoot)
+	procRoot = dir
+
+	writeProc := func(pid, stat, cmdline string) {
+		if err := os.Mkdir(dir+"/"+pid, 0755); err != nil {
+			t.Fatal(err)
+		}
+		ioutil.WriteFile(dir+"/"+pid+"/stat", []byte(stat), 0644)
+		ioutil.WriteFile(dir+"/"+pid+"/cmdline", []byte(cmdline), 0644)
+	}
+	rest := " 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 "
+	writeProc("20", "20 (a (b) c) S 1"+rest+"3 0 0\n", "vim\x00a b.txt\x00")
+	writeProc("3", "3 (kworker/0:1) I 2"+rest+"0 0 0\n", "")
+	os.Mkdir(dir+"/self", 0755)
+
+	text := "proc:list | each {|p| put $p[pid] $p[ppid] $p[name] $p[cmd] $p[rss] }"
+	out := reprs(evalAndCollect(t, text))
+	rss := strconv.Itoa(3 * os.Getpagesize())
+	want := []string{"3", "2", "kworker/0:1", "`[kworker/0:1]`", "0", "20", "1", "`a (b) c`", "`vim a b.txt`", rss}
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("Eval(*, %q, *) outputs %v, want %v", text, out, want)
+	}
+
+	procRoot = dir + "/none"
+	if msg := procList(nil, nil); msg != errNoProcFS.Error() {
+		t.Errorf("proc:list without /proc => %q, want %q", msg, errNoProcFS.Error())
+	}
+}
+
+func TestSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elvish-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := dir + "/sock"
+	text := "var $l listener; l = (net:listen unix " + sock + "); " +
+		"var $c $s file; c = (net:dial unix " + sock + "); s = (net:accept $l); " +
+		"echo hello > $c; read-line < $s; close $c $s $l; fs:exists " + sock
+	out := reprs(evalAndCollect(t, text))
+	if want := []string{"hello", "false"}; !reflect.DeepEqual(out, want) {
+		t.Errorf("Eval(*, %q, *) outputs %v, want %v", text, out, want)
+	}
+}
+
+func TestAddBuiltinSpecial(t *testing.T) {
+	AddBuiltinSpecial("test-twice", func(cp *Compiler, fn *parse.FormNode) func(*Evaluator) string {
+		if len(fn.Args.Nodes) != 1 {
+			cp.Errorf(fn, "test-twice form must be `test-twice { body }`")
+		}
+		body := cp.CompileTerm(fn.Args.Nodes[0])
+		return func(ev *Evaluator) string {
+			ev.CallClosure(body(ev)[0], nil)
+			return ev.CallClosure(body(ev)[0], nil)
+		}
+	})
+	defer delete(builtinSpecials, "test-twice")
+
+	text := "var $n string = 0; test-twice { n = (+ $n 1) }; put $n"
+	if got, want := reprs(evalAndCollect(t, text)), []string{"2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Eval(*, %q, *) outputs %v, want %v", text, got, want)
+	}
+	if _, err := evalAndCollectErr(t, "test-twice a b"); err == nil {
+		t.Errorf("test-twice with two arguments compiles")
+	}
+}
+
+func TestRegisterModule(t *testing.T) {
+	err := RegisterModule("test-mod", map[string]func(*Evaluator, []Value) string{
+		"hello": func(ev *Evaluator, args []Value) string {
+			ev.ports[1].ch <- NewString("hello " + args[0].String())
+			return ""
+		},
+	})
+	if err != nil {
+		t.Fatalf("RegisterModule(test-mod, *) => error %v", err)
+	}
+	defer func() {
+		delete(builtinFuncs, "test-mod:hello")
+		delete(modules.names, "test-mod")
+	}()
+
+	text := "test-mod:hello world"
+	if got, want := reprs(evalAndCollect(t, text)), []string{"`hello world`"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Eval(*, %q, *) outputs %v, want %v", text, got, want)
+	}
+	for _, name := range []string{"test-mod", "str", "a:b", ""} {
+		if RegisterModule(name, nil) == nil {
+			t.Errorf("RegisterModule(%q, nil) => no error", name)
+		}
+	}
+}
+
+// Modules may be loaded while code is compiled and commands are resolved in
+// the background.
+func TestRegisterModuleConcurrently(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			RegisterModule(fmt.Sprintf("test-concurrent-%d", i), map[string]func(*Evaluator, []Value) string{
+				"f": func(*Evaluator, []Value) string { return "" },
+			})
+		}
+	}()
+	ev := NewEvaluator()
+	for i := 0; i < 100; i++ {
+		ev.ResolveCommand("put")
+		if err := ev.EvalText("<concurrent test>", fmt.Sprintf("fn f%d { put %d }", i, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	modules.Lock()
+	for i := 0; i < 100; i++ {
+		delete(builtinFuncs, fmt.Sprintf("test-concurrent-%d:f", i))
+		delete(modules.names, fmt.Sprintf("test-concurrent-%d", i))
+	}
+	modules.Unlock()
+}
+
+type mapStore map[string]string
+
+func (s mapStore) Get(key string) (string, bool, error) {
+	v, ok := s[key]
+	return v, ok, nil
+}
+
+func (s mapStore) Set(key, value string) error {
+	s[key] = value
+	return nil
+}
+
+func (s mapStore) Del(key string) error {
+	delete(s, key)
+	return nil
+}
+
+func TestStore(t *testing.T) {
+	store := mapStore{}
+	text := "set-option errexit on; store:set a [x [&y z]]; store:set b c; store:del b; store:get a; store:get b default; store:get b"
+	n, err := parse.Parse("<store test>", text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	ev.SetStore(store)
+	ch := make(chan Value, 10)
+	ev.ports[1] = &port{ch: ch}
+	if err := ev.Eval("<store test>", text, n); err == nil {
+		t.Errorf("store:get of a nonexistent key without a default => no error")
+	}
+	close(ch)
+	var vs []Value
+	for v := range ch {
+		vs = append(vs, v)
+	}
+	if got, want := reprs(vs), []string{"[x [&y z]]", "default"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("store builtins output %v, want %v", got, want)
+	}
+	if got, want := store["a"], `["x",{"y":"z"}]`; got != want {
+		t.Errorf("store has %q, want %q", got, want)
+	}
+}
+
+type mapSharedStore map[string]string
+
+func (s mapSharedStore) SetShared(name, value string) error {
+	s[name] = value
+	return nil
+}
+
+func TestSharedVars(t *testing.T) {
+	store := mapSharedStore{}
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	ev.SetSharedStore(store)
+	ch := make(chan Value, 10)
+	ev.ports[1] = &port{ch: ch}
+	evalText := func(text string) {
+		if err := ev.EvalText("<shared test>", text); err != nil {
+			t.Fatalf("EvalText(*, %q) => error %v", text, err)
+		}
+	}
+
+	// A value set by another process creates the variable.
+	ev.UpdateShared("project", `"elvish"`)
+	evalText("put $shared:project")
+	if v := <-ch; v.String() != "elvish" {
+		t.Errorf("$shared:project = %q, want %q", v.String(), "elvish")
+	}
+	if len(store) != 0 {
+		t.Errorf("store has %v, want nothing published", store)
+	}
+
+	evalText("shared:project = shell; var $shared:new table = [a b]")
+	if got, want := store["project"], `"shell"`; got != want {
+		t.Errorf("store has project = %q, want %q", got, want)
+	}
+	if got, want := store["new"], `["a","b"]`; got != want {
+		t.Errorf("store has new = %q, want %q", got, want)
+	}
+
+	// The later write wins.
+	ev.UpdateShared("project", `"other"`)
+	evalText("put $shared:project")
+	if v := <-ch; v.String() != "other" {
+		t.Errorf("$shared:project = %q, want %q", v.String(), "other")
+	}
+
+	// A value of another type is dropped, and is not published back.
+	ev.UpdateShared("project", `["a"]`)
+	ev.UpdateShared("new", `"s"`)
+	evalText("put $shared:project $shared:new")
+	if v := <-ch; v.String() != "other" {
+		t.Errorf("after a table for a string, $shared:project = %q, want %q", v.String(), "other")
+	}
+	if v := <-ch; v.Repr() != "[a b]" {
+		t.Errorf("after a string for a table, $shared:new = %s, want [a b]", v.Repr())
+	}
+	if got, want := store["project"], `"shell"`; got != want {
+		t.Errorf("store has project = %q, want %q kept", got, want)
+	}
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestRand(t *testing.T) {
+	text := "rand-seed 42; randint 0 1000000; rand; rand-seed 42; randint 0 1000000; rand"
+	vs := reprs(evalAndCollect(t, text))
+	if len(vs) != 4 || vs[0] != vs[2] || vs[1] != vs[3] {
+		t.Errorf("Eval(*, %q, *) outputs %v, want the same numbers after the same seed", text, vs)
+	}
+	vs = reprs(evalAndCollect(t, "uuid; uuid"))
+	if len(vs) != 2 || vs[0] == vs[1] || !uuidPattern.MatchString(vs[0]) {
+		t.Errorf("uuid outputs %v, want two different version 4 UUIDs", vs)
+	}
+}
+
+func TestReload(t *testing.T) {
+	f, err := ioutil.TempFile("", "elvish-rc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("var $a string = x; var $b string = y; fn f { put f }")
+	f.Close()
+
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	ch := make(chan Value, 10)
+	ev.ports[1] = &port{ch: ch}
+	if err := ev.SourceRC(f.Name()); err != nil {
+		t.Fatalf("SourceRC => error %v", err)
+	}
+	if err := ev.EvalText("<reload test>", "b = changed"); err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(f.Name(), []byte("var $a string = x2; var $b string = y2; var $c string = z"), 0600)
+	if err := ev.EvalText("<reload test>", "shell:reload | feedchan; put $a $b"); err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+	var vs []Value
+	for v := range ch {
+		vs = append(vs, v)
+	}
+	wanted := []string{
+		"`added $c`",
+		"`conflict: kept $b, which has been changed since the rc files were loaded`",
+		"`removed fn f`",
+		"`updated $a`",
+		"x2", "changed",
+	}
+	if got := reprs(vs); !reflect.DeepEqual(got, wanted) {
+		t.Errorf("shell:reload outputs %v, want %v", got, wanted)
+	}
+	if _, ok := ev.scope.lookup("fn-f"); ok {
+		t.Errorf("fn f not removed")
+	}
+}
+
+func TestAPIVersion(t *testing.T) {
+	defer func(v int) {
+		currentAPIVersion = v
+		delete(optionRenames, "olderrexit")
+		delete(varRenames, "oldname")
+		delete(hookShims, "exec-hook")
+		delete(hookShims, "after-command")
+	}(currentAPIVersion)
+	currentAPIVersion = 2
+	optionRenames["olderrexit"] = apiRename{"errexit", 2}
+	varRenames["oldname"] = apiRename{"newname", 2}
+	hookShims["exec-hook"] = []hookShim{{2, func(args []Value) []Value {
+		return append(args, NewString("old"))
+	}}}
+
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	ch := make(chan Value, 10)
+	ev.ports[1] = &port{ch: ch}
+	if err := ev.EvalText("<api test>", "var $newname string = v; put $oldname"); err == nil {
+		t.Errorf("old variable name accepted without shell:api-version")
+	}
+	if err := ev.EvalText("<api test>", "set-option olderrexit on"); err == nil {
+		t.Errorf("old option name accepted without shell:api-version")
+	}
+	if err := ev.EvalText("<api test>", "shell:api-version 3"); err == nil {
+		t.Errorf("shell:api-version accepted a version newer than the current one")
+	}
+	text := "shell:api-version 1; set-option olderrexit on; var $newname string = v; oldname = w; put $oldname; fn h { }"
+	if err := ev.EvalText("<api test>", text); err != nil {
+		t.Fatalf("EvalText(%q) => error %v", text, err)
+	}
+	close(ch)
+	if v := <-ch; v.String() != "w" {
+		t.Errorf("$oldname = %s, want w", v.Repr())
+	}
+
+	h := ev.scope.get("fn-h").Get().(*Closure)
+	if got := hookArgs("exec-hook", h, []Value{NewString("argv")}); len(got) != 2 {
+		t.Errorf("hook compiled for API version 1 called with %v, want shimmed arguments", got)
+	}
+	if err := ev.EvalText("<api test>", "fn h { }"); err != nil {
+		t.Fatal(err)
+	}
+	h = ev.scope.get("fn-h").Get().(*Closure)
+	if got := hookArgs("exec-hook", h, []Value{NewString("argv")}); len(got) != 1 {
+		t.Errorf("hook compiled for the current API version called with %v, want unchanged arguments", got)
+	}
+
+	// Hooks in lists are shimmed too.
+	hookShims["after-command"] = []hookShim{{2, func(args []Value) []Value {
+		return append(args, NewString("old"))
+	}}}
+	ch = make(chan Value, 10)
+	ev.ports[1] = &port{ch: ch}
+	text = "shell:api-version 1; after-command = [{|c x| put $x }]"
+	if err := ev.EvalText("<api test>", text); err != nil {
+		t.Fatalf("EvalText(%q) => error %v", text, err)
+	}
+	ev.AfterCommand("true", 0)
+	close(ch)
+	if v := <-ch; v == nil || v.String() != "old" {
+		t.Errorf("after-command hook for API version 1 called without the shimmed argument")
+	}
+}
+
+func TestExitHooks(t *testing.T) {
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	ch := make(chan Value, 10)
+	ev.ports[1] = &port{ch: ch}
+	if err := ev.EvalText("<exit test>", "at-exit { put first }; at-exit { put second }"); err != nil {
+		t.Fatal(err)
+	}
+	ev.RunExitHooks()
+	ev.RunExitHooks()
+	close(ch)
+	var vs []Value
+	for v := range ch {
+		vs = append(vs, v)
+	}
+	if got, wanted := reprs(vs), []string{"second", "first"}; !reflect.DeepEqual(got, wanted) {
+		t.Errorf("at-exit hooks output %v, want %v", got, wanted)
+	}
+}
+
+var whenTests = []struct {
+	conds   string
+	wanted  []string
+	wantErr bool
+}{
+	{"&os=" + runtime.GOOS, []string{"yes"}, false},
+	{"&os=" + runtime.GOOS + " &arch=" + runtime.GOARCH, []string{"yes"}, false},
+	{"&os=nope," + runtime.GOOS, []string{"yes"}, false},
+	{"&os=nope", []string{}, false},
+	{"&os=" + runtime.GOOS + " &arch=nope", []string{}, false},
+	{"&nope=x", []string{}, true},
+	{"os=" + runtime.GOOS, []string{}, true},
+}
+
+func TestWhen(t *testing.T) {
+	for _, tt := range whenTests {
+		text := "set-option errexit on; when " + tt.conds + " { put yes }"
+		out, err := evalAndCollectErr(t, text)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Eval(*, %q, *) => error %v, want error: %v", text, err, tt.wantErr)
+		}
+		if got := reprs(out); !reflect.DeepEqual(got, tt.wanted) {
+			t.Errorf("Eval(*, %q, *) => %v, want %v", text, got, tt.wanted)
+		}
+	}
+}
+
+func TestUmask(t *testing.T) {
+	old := syscall.Umask(022)
+	defer syscall.Umask(old)
+	out, err := evalAndCollectErr(t, "umask 027; umask")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reprs(out); !reflect.DeepEqual(got, []string{"0027"}) {
+		t.Errorf("umask outputs %v, want [0027]", got)
+	}
+}
+
+func TestUlimit(t *testing.T) {
+	var lim syscall.Rlimit
+	syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim)
+	defer syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lim)
+	out, err := evalAndCollectErr(t, "set-option errexit on; ulimit nofile [&soft (ulimit nofile)[hard]]; put (ulimit nofile)[soft]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, wanted := reprs(out), []string{limitValue(lim.Max).Repr()}; !reflect.DeepEqual(got, wanted) {
+		t.Errorf("ulimit outputs %v, want %v", got, wanted)
+	}
+	if _, err := evalAndCollectErr(t, "set-option errexit on; ulimit nope"); err == nil {
+		t.Errorf("ulimit accepted an unknown resource")
+	}
+}
+
+func TestHookOutput(t *testing.T) {
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	if out, msg := ev.HookOutput("motd-hook"); out != "" || msg != "" {
+		t.Errorf("default $motd-hook outputs (%q, %q), want nothing", out, msg)
+	}
+	if err := ev.EvalText("<hook test>", "motd-hook = { echo hello; put world | printchan }"); err != nil {
+		t.Fatal(err)
+	}
+	if out, msg := ev.HookOutput("motd-hook"); out != "hello\nworld\n" || msg != "" {
+		t.Errorf("$motd-hook outputs (%q, %q), want (%q, %q)", out, msg, "hello\nworld\n", "")
+	}
+}
+
+func TestFrozenKeys(t *testing.T) {
+	// Changing a table used as a key leaves the key alone.
+	text := "set-option errexit on; var $t table = [&[a] x]; var $k table; k = (keys $t); k[0] = b; put $t[[a]] (keys $t) $k"
+	out, err := evalAndCollectErr(t, text)
+	if want := []string{"x", "[a]", "[b]"}; err != nil || !reflect.DeepEqual(reprs(out), want) {
+		t.Errorf("Eval(*, %q, *) => (%v, %v), want %v", text, reprs(out), err, want)
+	}
+}
+
+func TestElementAssignmentsInPlace(t *testing.T) {
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	if err := ev.EvalText("<in place test>", "var $t table = [&x 0]; t[a] = 1"); err != nil {
+		t.Fatal(err)
+	}
+	v := ev.scope.get("t")
+	owned := v.value.(*Table)
+	// Until $t is read, its table is changed in place.
+	if err := ev.EvalText("<in place test>", "t[b] = 2; t[d] = 4"); err != nil {
+		t.Fatal(err)
+	}
+	if v.value != owned || len(owned.Dict) != 4 {
+		t.Errorf("t[b] = 2; t[d] = 4 copies the table made by t[a] = 1")
+	}
+	ch := make(chan Value, 10)
+	ev.ports[1] = &port{f: ev.ports[1].f, ch: ch}
+	if err := ev.EvalText("<in place test>", "put $t; t[c] = 3"); err != nil {
+		t.Fatal(err)
+	}
+	if v.value == owned || len(owned.Dict) != 4 || (<-ch).(*Table) != owned {
+		t.Errorf("t[c] = 3 changes the table output by put $t")
+	}
+}
+
+func TestNewerVersion(t *testing.T) {
+	for _, tt := range []struct {
+		a, b  string
+		newer bool
+	}{
+		{"0.2", "0.1", true},
+		{"0.10", "0.9", true},
+		{"0.1", "0.1", false},
+		{"0.1.1", "0.1", true},
+		{"v0.2", "0.1-3-gabcdef", true},
+		{"0.1", "unknown", true},
+		{"0.1", "0.2", false},
+	} {
+		if newer := newerVersion(tt.a, tt.b); newer != tt.newer {
+			t.Errorf("newerVersion(%q, %q) => %v, want %v", tt.a, tt.b, newer, tt.newer)
+		}
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary := []byte("new elvish")
+	sum := sha256.Sum256(binary)
+	rel := release{Version: "99.0", Binaries: map[string]releaseBinary{}}
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/release", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(rel)
+	})
+	mux.HandleFunc("/elvish", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(binary)
+	})
+
+	defer func(u, k string) { UpdateURL, UpdateKey = u, k }(UpdateURL, UpdateKey)
+	UpdateURL, UpdateKey = server.URL+"/release", hex.EncodeToString(pub)
+
+	f, err := ioutil.TempFile("", "elvish-binary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("old elvish")
+	f.Close()
+
+	platform := runtime.GOOS + "-" + runtime.GOARCH
+	hexSum := hex.EncodeToString(sum[:])
+	signed := func(version, platform string) releaseBinary {
+		sig := ed25519.Sign(priv, releaseManifest(version, platform, hexSum))
+		return releaseBinary{server.URL + "/elvish", hexSum, hex.EncodeToString(sig)}
+	}
+	rel.Binaries[platform] = signed("99.0", platform)
+	UpdateKey = ""
+	if _, _, err := upgrade(f.Name()); err != errNoUpdateKey {
+		t.Errorf("upgrade without an update key => %v, want %v", err, errNoUpdateKey)
+	}
+	if data, _ := ioutil.ReadFile(f.Name()); string(data) != "old elvish" {
+		t.Errorf("binary after upgrade without an update key is %q, want %q", data, "old elvish")
+	}
+	UpdateKey = hex.EncodeToString(pub)
+
+	for _, b := range []releaseBinary{
+		{server.URL + "/elvish", hexSum, hex.EncodeToString(make([]byte, ed25519.SignatureSize))},
+		// A signature of the checksum alone.
+		{server.URL + "/elvish", hexSum, hex.EncodeToString(ed25519.Sign(priv, sum[:]))},
+		// The binary of an older release, or of another platform.
+		signed("98.0", platform),
+		signed("99.0", "plan9-mips"),
+	} {
+		rel.Binaries[platform] = b
+		if _, _, err := upgrade(f.Name()); err == nil {
+			t.Errorf("upgrade accepted a bad signature %s", b.Signature)
+		}
+	}
+	if data, _ := ioutil.ReadFile(f.Name()); string(data) != "old elvish" {
+		t.Errorf("binary after upgrade with bad signatures is %q, want %q", data, "old elvish")
+	}
+
+	// A release signed as older than the running version is not installed.
+	defer func(v string) { Version = v }(Version)
+	Version = "99.1"
+	if version, upgraded, err := upgrade(f.Name()); version != "99.0" || upgraded || err != nil {
+		t.Errorf("upgrade to an older version => (%q, %v, %v), want (%q, false, nil)", version, upgraded, err, "99.0")
+	}
+	Version = "98.0"
+
+	rel.Binaries[platform] = signed("99.0", platform)
+	if version, upgraded, err := upgrade(f.Name()); version != "99.0" || !upgraded || err != nil {
+		t.Errorf("upgrade => (%q, %v, %v), want (%q, true, nil)", version, upgraded, err, "99.0")
+	}
+	if data, _ := ioutil.ReadFile(f.Name()); string(data) != "new elvish" {
+		t.Errorf("binary after upgrade is %q, want %q", data, "new elvish")
+	}
+}
+
+func TestTablesAreValues(t *testing.T) {
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	if err := ev.EvalText("<table test>", "var $t table = [a &k a]"); err != nil {
+		t.Fatal(err)
+	}
+	held := ev.scope.get("t").Get().(*Table)
+	done := make(chan bool)
+	go func() {
+		// Read the table while it is being assigned to, which is a data race
+		// with go test -race unless assignments leave it alone.
+		for i := 0; i < 100; i++ {
+			held.Repr()
+		}
+		done <- true
+	}()
+	for i := 0; i < 100; i++ {
+		if err := ev.EvalText("<table test>", "t[0] = b; t[k] = b"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	if r := held.Repr(); r != "[a &k a]" {
+		t.Errorf("table held elsewhere changed to %s by assignments", r)
+	}
+}
+
+func TestSharedScope(t *testing.T) {
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	// Forms and closures run in parallel assign to and declare variables of
+	// the same scope, which is a data race with go test -race unless
+	// variables are boxed.
+	err := ev.EvalText("<shared scope test>", `var $t table; var $s string
+put a b c d e f g h | peach {|x| t[$x] = $x; s = $x }
+var $u string = u | each {|x| s = $x } | var $v string = v`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := NewTable()
+	for _, x := range "abcdefgh" {
+		want.put(NewString(string(x)), NewString(string(x)))
+	}
+	if v := ev.scope.get("t").Get(); !v.Eq(want) {
+		t.Errorf("assignments to elements in parallel left $t = %s, want %s", v.Repr(), want.Repr())
+	}
+	for _, name := range []string{"u", "v"} {
+		if _, ok := ev.scope.lookup(name); !ok {
+			t.Errorf("$%s declared in a pipeline is not visible after it", name)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	ev.SetUsageSource(func() (*Usage, error) {
+		return &Usage{
+			Commands: []CommandUsage{
+				{"git log | less", time.Second},
+				{"git status", 3 * time.Second},
+				{"ls", 0},
+			},
+			Dirs: []DirUsage{{"/tmp", 1}, {"/src", 5}},
+		}, nil
+	})
+	ch := make(chan Value, 1)
+	ev.ports[1] = &port{ch: ch}
+	if err := ev.EvalText("<stats test>", "shell:stats 2"); err != nil {
+		t.Fatal(err)
+	}
+	wanted := "[&lines 3 &average-duration 2.000000 &commands [[&name git &count 2] [&name less &count 1]] &dirs [[&path /src &visits 5] [&path /tmp &visits 1]]]"
+	if got := (<-ch).Repr(); got != wanted {
+		t.Errorf("shell:stats outputs %s, want %s", got, wanted)
+	}
+}
+
+// sliceHistory is a HistoryStore of lines in a slice.
+type sliceHistory struct {
+	lines []string
+}
+
+func (h *sliceHistory) Del(pattern *regexp.Regexp) (int, error) {
+	var kept []string
+	for _, line := range h.lines {
+		if !pattern.MatchString(line) {
+			kept = append(kept, line)
+		}
+	}
+	n := len(h.lines) - len(kept)
+	h.lines = kept
+	return n, nil
+}
+
+func (h *sliceHistory) Prune(max int) (int, error) {
+	if len(h.lines) <= max {
+		return 0, nil
+	}
+	n := len(h.lines) - max
+	h.lines = h.lines[n:]
+	return n, nil
+}
+
+func TestHistory(t *testing.T) {
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	h := &sliceHistory{[]string{"ls", "export TOKEN=abc", "echo", "curl -u me:TOKEN=def", "ls"}}
+	ev.SetHistoryStore(h)
+	ch := make(chan Value, 10)
+	ev.ports[1] = &port{ch: ch}
+	text := "history:del TOKEN=; history:prune 2; options[history-ignore-dups] = true; options[history-max-size] = 100"
+	if err := ev.EvalText("<history test>", text); err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+	var vs []Value
+	for v := range ch {
+		vs = append(vs, v)
+	}
+	if got, want := reprs(vs), []string{"2", "1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("history builtins output %v, want %v", got, want)
+	}
+	if want := []string{"echo", "ls"}; !reflect.DeepEqual(h.lines, want) {
+		t.Errorf("history has %v, want %v", h.lines, want)
+	}
+	if got, want := ev.HistoryPolicy(), (HistoryPolicy{IgnoreDups: true, MaxSize: 100}); got != want {
+		t.Errorf("history policy %+v, want %+v", got, want)
+	}
+	if err := ev.EvalText("<history test>", "set-option errexit on; history:del \"(\""); err == nil {
+		t.Errorf("history:del with a bad pattern => no error")
+	}
+}
+
+var historyKeepsTests = []struct {
+	policy     HistoryPolicy
+	line, last string
+	wanted     bool
+}{
+	{HistoryPolicy{}, "ls", "ls", true},
+	{HistoryPolicy{}, "", "ls", false},
+	{HistoryPolicy{IgnoreDups: true}, "ls", "ls", false},
+	{HistoryPolicy{IgnoreDups: true}, "ls", "ls -l", true},
+	{HistoryPolicy{IgnoreSpace: true}, " secret", "", false},
+	{HistoryPolicy{}, " secret", "", true},
+}
+
+func TestHistoryPolicyKeeps(t *testing.T) {
+	for _, tt := range historyKeepsTests {
+		if got := tt.policy.Keeps(tt.line, tt.last); got != tt.wanted {
+			t.Errorf("%+v.Keeps(%q, %q) => %v, want %v", tt.policy, tt.line, tt.last, got, tt.wanted)
+		}
+	}
+}
+
+func TestDebugger(t *testing.T) {
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	var stops []string
+	d := NewDebugger(func(f *Frame) DebugAction {
+		x := ""
+		if v, ok := f.Scope["x"]; ok {
+			x = v.String()
+		}
+		stops = append(stops, fmt.Sprintf("%d:%d:%s", f.Line(), f.Depth, x))
+		if len(stops) < 4 {
+			return DebugStep
+		}
+		return DebugContinue
+	})
+	d.SetBreakpoint("<debug test>", 5)
+	ev.SetDebugger(d)
+	err := ev.EvalText("<debug test>", `var $x string = a
+{ x = c }
+x = b
+x = d
+x = e`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wanted := []string{"1:0:", "2:0:a", "2:1:a", "3:0:c", "5:0:d"}
+	if !reflect.DeepEqual(stops, wanted) {
+		t.Errorf("debugger stopped at %v, want %v", stops, wanted)
+	}
+}
+
+func TestDebugControls(t *testing.T) {
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	var lines []int
+	d := NewDebugger(func(f *Frame) DebugAction {
+		lines = append(lines, f.Line())
+		return DebugContinue
+	})
+	ev.SetDebugger(d)
+	err := ev.EvalText("debug-test", `debug:set-breakpoint debug-test 6
+debug:set-breakpoint debug-test 7
+debug:clear-breakpoint debug-test 7
+debug:break
+var $x string = a
+x = b
+x = c`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A new Debugger is stepping, so it stops at line 1 first.
+	if wanted := []int{1, 5, 6}; !reflect.DeepEqual(lines, wanted) {
+		t.Errorf("debugger stopped at lines %v, want %v", lines, wanted)
+	}
+
+	ch := make(chan Value, 10)
+	ev.ports[1] = &port{f: ev.ports[1].f, ch: ch}
+	if err := ev.EvalText("debug-test", "debug:breakpoints"); err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+	var bs []string
+	for v := range ch {
+		bs = append(bs, v.Repr())
+	}
+	if wanted := []string{"[&name debug-test &line 6]"}; !reflect.DeepEqual(bs, wanted) {
+		t.Errorf("debug:breakpoints outputs %v, want %v", bs, wanted)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	var buf bytes.Buffer
+	ev.StartProfile(&buf)
+	if err := ev.EvalText("<profile test>", "var $x string\nfor i in a b c { x = $i }"); err != nil {
+		t.Fatal(err)
+	}
+	ev.StopProfile()
+	// Drop the times, which vary, and sort the lines.
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n")[1:] {
+		lines = append(lines, strings.Join(strings.Fields(line)[1:], " "))
+	}
+	sort.Strings(lines)
+	wanted := []string{
+		"1 <profile test>:1:1 var $x string",
+		"1 <profile test>:2:1 for i in a b c { x = $i }",
+		"3 <profile test>:2:18 for i in a b c { x = $i }",
+	}
+	if !reflect.DeepEqual(lines, wanted) {
+		t.Errorf("profile has %q, want %q", lines, wanted)
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	var buf bytes.Buffer
+	ev.StartCoverage(&buf)
+	text := "var $x string\nfn f {\n\tput never\n}\n# comment\nfor i in a b { x = $i }\n"
+	if err := ev.EvalText("<coverage test>", text); err != nil {
+		t.Fatal(err)
+	}
+	ranges := ev.Coverage()
+	wantedRanges := []CoverageRange{
+		{"<coverage test>", 0, 13, 1},
+		{"<coverage test>", 14, 33, 1},
+		{"<coverage test>", 44, 67, 1},
+		{"<coverage test>", 59, 65, 2},
+	}
+	if !reflect.DeepEqual(ranges, wantedRanges) {
+		t.Errorf("Coverage() => %v, want %v", ranges, wantedRanges)
+	}
+	ev.StopCoverage()
+	wanted := `<coverage test>:
+     1  var $x string
+     1  fn f {
+     0  	put never
+     -  }
+     -  # comment
+     2  for i in a b { x = $i }
+`
+	if buf.String() != wanted {
+		t.Errorf("coverage listing is\n%s\nwant\n%s", buf.String(), wanted)
+	}
+}
+
+func TestUnitTest(t *testing.T) {
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	ch := make(chan Value, 100)
+	ev.ports[1] = &port{ch: ch}
+	err := ev.EvalText("<unit test>", `test:group g {
+	test:case ok { test:assert-eq (str:pad a 2) "a " }
+	test:case bad { test:assert false; test:assert-eq a b msg }
+}
+test:case other { test:assert { false } }
+test:run g/ | feedchan; put $status
+test:run | feedchan`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+	// Keep the lines with positions and results, without colors.
+	sgr := regexp.MustCompile("\033\\[[0-9;]*m")
+	var lines []string
+	for v := range ch {
+		line := sgr.ReplaceAllString(v.String(), "")
+		if strings.HasPrefix(line, "---") || strings.HasPrefix(line, "PASS") ||
+			strings.HasPrefix(line, "FAIL") || strings.HasPrefix(line, "<unit test>") ||
+			strings.HasPrefix(line, "[") {
+			lines = append(lines, line)
+		}
+	}
+	wanted := []string{
+		"--- FAIL: g/bad",
+		"<unit test>:3:18: error: assertion failed",
+		"<unit test>:3:37: error: assertion failed: msg: got a, want b",
+		"FAIL: 1 of 2 tests failed",
+		"[`1 of 2 tests failed` ``]",
+		"--- FAIL: other",
+		"<unit test>:5:19: error: assertion failed",
+		"FAIL: 1 of 1 tests failed",
+	}
+	if !reflect.DeepEqual(lines, wanted) {
+		t.Errorf("test:run reports %q, want %q", lines, wanted)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elvish-dry-run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stderr, err := ioutil.TempFile(dir, "stderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stderr.Close()
+
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	ev.SetDryRun(true)
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+	ev.ports[1] = &port{f: null, ch: make(chan Value, 10)}
+	ev.ports[2] = &port{f: stderr}
+	touch, err := ev.search("touch")
+	if err != nil {
+		t.Skip("touch not found")
+	}
+	err = ev.EvalText("<dry run test>", "touch "+dir+"/a `b c`; spawn -a t X=1 touch "+dir+"/d; put (str:to-upper x)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := ioutil.ReadDir(dir); len(names) != 1 {
+		t.Errorf("commands run in dry-run mode")
+	}
+	out, _ := ioutil.ReadFile(stderr.Name())
+	wanted := "+ " + touch + " " + dir + "/a `b c`\n+ -a t X=1 " + touch + " " + dir + "/d\n"
+	if string(out) != wanted {
+		t.Errorf("dry-run mode prints %q, want %q", out, wanted)
+	}
+	if v := <-ev.ports[1].ch; v.String() != "X" {
+		t.Errorf("code evaluated in dry-run mode outputs %s, want X", v.Repr())
+	}
+}
+
+func TestXtrace(t *testing.T) {
+	stderr, err := ioutil.TempFile("", "elvish-xtrace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(stderr.Name())
+	defer stderr.Close()
+
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	ev.ports[1] = &port{ch: make(chan Value, 10)}
+	ev.ports[2] = &port{f: stderr}
+	err = ev.EvalText("<xtrace test>", "put x; set-option xtrace on; put (str:to-upper `a b`); { put [b] }")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := ioutil.ReadFile(stderr.Name())
+	wanted := "  + str:to-upper `a b`\n+ put `A B`\n+ <closure>\n  + put [b]\n"
+	if string(out) != wanted {
+		t.Errorf("xtrace prints %q, want %q", out, wanted)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	o := ev.Options()
+	if err := o.Define("test-option", StringOption, NewString("a")); err != nil {
+		t.Fatal(err)
+	}
+	if o.Define("test-option", StringOption, NewString("a")) == nil {
+		t.Errorf("defining an option twice doesn't fail")
+	}
+	var seen []string
+	o.Watch("test-option", func(v Value) { seen = append(seen, v.String()) })
+
+	if err := ev.EvalText("<options test>", "options[test-option] = b; options[test-option] = b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Set("test-option", NewString("c")); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(seen, []string{"b", "c"}) {
+		t.Errorf("watcher sees %v, want [b c]", seen)
+	}
+	if v, _ := o.Get("test-option"); v.String() != "c" {
+		t.Errorf("Get gives %s, want c", v.Repr())
+	}
+
+	before := o.v.Get()
+	for _, text := range []string{
+		"options[xtrace] = maybe",
+		"options[max-depth] = -1",
+		"options[test-option] = [a]",
+		"options[no-such-option] = a",
+		"options = [a]",
+	} {
+		ev.EvalText("<options test>", text)
+		if after := o.v.Get(); !after.Eq(before) {
+			t.Errorf("%s changes $options to %s", text, after.Repr())
+		}
+	}
+
+	// strict takes effect on the code compiled afterwards.
+	if err := ev.EvalText("<options test>", "options[strict] = true"); err != nil {
+		t.Fatal(err)
+	}
+	if ev.EvalText("<options test>", "false") == nil {
+		t.Errorf("failed command doesn't fail with $options[strict] on")
+	}
+	// Turning it off leaves alone what was on before.
+	ev = NewEvaluator()
+	ev.statusCb = nil
+	for _, text := range []string{"set-option errexit on", "options[strict] = true", "options[strict] = false"} {
+		if err := ev.EvalText("<options test>", text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !ev.Compiler.Option("errexit") || ev.Compiler.Option("pipefail") || ev.Compiler.Option("nounset") {
+		t.Errorf("after options[strict] is turned on and off, errexit pipefail nounset are %v %v %v, want true false false",
+			ev.Compiler.Option("errexit"), ev.Compiler.Option("pipefail"), ev.Compiler.Option("nounset"))
+	}
+}
+
+func TestAlias(t *testing.T) {
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devnull.Close()
+	ch := make(chan Value, 10)
+	ev.ports[1] = &port{f: devnull, ch: ch}
+	collect := func(text string) []string {
+		if err := ev.EvalText("<alias test>", text); err != nil {
+			t.Fatal(err)
+		}
+		var out []string
+		for len(ch) > 0 {
+			out = append(out, (<-ch).String())
+		}
+		return out
+	}
+
+	collect("alias ll put a; alias put put x; alias p ll")
+	for _, tt := range []struct {
+		text   string
+		wanted []string
+	}{
+		{"ll b", []string{"x", "a", "b"}},
+		{"put y", []string{"x", "y"}},
+		{"p c", []string{"x", "a", "c"}},
+		{"{ ll b }", []string{"x", "a", "b"}},
+	} {
+		if out := collect(tt.text); !reflect.DeepEqual(out, tt.wanted) {
+			t.Errorf("%s outputs %v, want %v", tt.text, out, tt.wanted)
+		}
+	}
+
+	if err := ev.Compiler.SetAlias("ll", []string{"p"}); err == nil {
+		t.Errorf("alias cycle not rejected")
+	}
+	collect("unalias put")
+	if out := collect("ll b"); !reflect.DeepEqual(out, []string{"a", "b"}) {
+		t.Errorf("after unalias, ll b outputs %v", out)
+	}
+}
+
+func TestCommandNotFoundHook(t *testing.T) {
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devnull.Close()
+	ch := make(chan Value, 10)
+	ev.ports[1] = &port{f: devnull, ch: ch}
+
+	for _, tt := range []struct {
+		text      string
+		wanted    []string
+		wantedErr string
+	}{
+		{"no-such-command-xyz", nil, "external command not found"},
+		{"command-not-found-hook = {|name args| put $name $args }; no-such-command-xyz a b",
+			[]string{"no-such-command-xyz", "[a b]"}, "external command not found"},
+		// The hook is not called for commands not found while it runs.
+		{"command-not-found-hook = {|name args| no-such-command-abc }; no-such-command-xyz",
+			nil, "external command not found"},
+	} {
+		err := ev.EvalText("<hook test>", tt.text)
+		if err == nil || !strings.Contains(err.Error(), tt.wantedErr) {
+			t.Errorf("EvalText(%q) => %v, want error containing %q", tt.text, err, tt.wantedErr)
+		}
+		var out []string
+		for len(ch) > 0 {
+			out = append(out, (<-ch).String())
+		}
+		if !reflect.DeepEqual(out, tt.wanted) {
+			t.Errorf("EvalText(%q) outputs %v, want %v", tt.text, out, tt.wanted)
+		}
+	}
+}
+
+func TestInteractiveHooks(t *testing.T) {
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	ch := make(chan Value, 10)
+	ev.ports[1] = &port{ch: ch}
+	if err := ev.EvalText("<hook test>", "before-readline = [{ put before }]; after-command = [{|c| put $c[src] $c[duration] } {|c| put $c[status] }]"); err != nil {
+		t.Fatal(err)
+	}
+	ev.BeforeReadline()
+	ev.AfterCommand("put x", 1500*time.Millisecond)
+	var out []string
+	for len(ch) > 0 {
+		out = append(out, (<-ch).Repr())
+	}
+	wanted := []string{"before", "`put x`", "1.5", "[``]"}
+	if !reflect.DeepEqual(out, wanted) {
+		t.Errorf("hooks output %v, want %v", out, wanted)
+	}
+}
+
+func TestRegisterBuiltin(t *testing.T) {
+	err := RegisterBuiltin("test-greet", Builtin{
+		Fn: func(ev *Evaluator, args []Value) string {
+			ev.Put(NewString("hello " + args[0].String()))
+			return ""
+		},
+		Args:   &ArgSpec{Min: 1, Max: 2, Types: []string{"string"}},
+		Output: ValueOutput,
+	})
+	if err != nil {
+		t.Fatalf("RegisterBuiltin(test-greet, *) => error %v", err)
+	}
+	defer delete(builtinFuncs, "test-greet")
+
+	for _, tt := range []struct {
+		text   string
+		wanted []string
+	}{
+		{"test-greet world", []string{"`hello world`"}},
+		{"test-greet; put $status", []string{"[`test-greet takes 1 to 2 arguments, got 0`]"}},
+		{"test-greet [a]; put $status", []string{"[`argument 1 of test-greet must be a string, got [a]`]"}},
+	} {
+		if got := reprs(evalAndCollect(t, tt.text)); !reflect.DeepEqual(got, tt.wanted) {
+			t.Errorf("Eval(*, %q, *) outputs %v, want %v", tt.text, got, tt.wanted)
+		}
+	}
+	noop := func(*Evaluator, []Value) string { return "" }
+	for _, name := range []string{"test-greet", "put", "var", "a b", ""} {
+		if RegisterBuiltin(name, Builtin{Fn: noop}) == nil {
+			t.Errorf("RegisterBuiltin(%q, *) => no error", name)
+		}
+	}
+	if RegisterBuiltin("test-bad", Builtin{Fn: noop, Args: &ArgSpec{Types: []string{"number"}}}) == nil {
+		t.Errorf("RegisterBuiltin with an unknown type => no error")
+	}
+}
+
+func TestRegisterGoFunc(t *testing.T) {
+	funcs := map[string]interface{}{
+		"test-go:repeat": strings.Repeat,
+		"test-go:sum": func(xs ...float64) float64 {
+			sum := 0.0
+			for _, x := range xs {
+				sum += x
+			}
+			return sum
+		},
+		"test-go:split": func(s string) ([]string, bool) {
+			return strings.Split(s, ","), strings.Contains(s, ",")
+		},
+		"test-go:fail": func(ev *Evaluator, v Value) (Value, error) {
+			return v, fmt.Errorf("failed with %s", v.Repr())
+		},
+	}
+	for name, f := range funcs {
+		if err := RegisterGoFunc(name, f); err != nil {
+			t.Fatalf("RegisterGoFunc(%q, *) => error %v", name, err)
+		}
+		defer delete(builtinFuncs, name)
+	}
+
+	for _, tt := range []struct {
+		text   string
+		wanted []string
+	}{
+		{"test-go:repeat ab 3", []string{"ababab"}},
+		{"test-go:sum 1 2.5; test-go:sum", []string{"3.5", "0"}},
+		{"test-go:split a,b", []string{"[a b]", "true"}},
+		{"test-go:repeat ab x; put $status", []string{"[`argument 2 of test-go:repeat: bad integer x`]"}},
+		{"test-go:fail [a]; put $status", []string{"[`failed with [a]`]"}},
+	} {
+		if got := reprs(evalAndCollect(t, tt.text)); !reflect.DeepEqual(got, tt.wanted) {
+			t.Errorf("Eval(*, %q, *) outputs %v, want %v", tt.text, got, tt.wanted)
+		}
+	}
+	for _, f := range []interface{}{"not a func", func(chan int) {}, func() map[string]int { return nil }} {
+		if RegisterGoFunc("test-go:bad", f) == nil {
+			t.Errorf("RegisterGoFunc(test-go:bad, %T) => no error", f)
+		}
+	}
+}
+
+func TestLangVersion(t *testing.T) {
+	defer func(v int) { currentLangVersion = v }(currentLangVersion)
+	currentLangVersion = 2
+	langChanges["all"] = langChange{since: 2}
+	deprecations["put"] = deprecation{since: 2, instead: "use all"}
+	defer delete(langChanges, "all")
+	defer delete(deprecations, "put")
+
+	for _, tt := range []struct {
+		text   string
+		wanted []Diagnostic
+	}{
+		{"put x", []Diagnostic{{0, 3, SeverityWarning, "put is deprecated; use all"}}},
+		{"shell:lang-version 1; put x", []Diagnostic{}},
+		{"{ shell:lang-version 1 }; put x", []Diagnostic{{26, 29, SeverityWarning, "put is deprecated; use all"}}},
+	} {
+		if got := NewEvaluator().Check("<lang test>", tt.text); !reflect.DeepEqual(got, tt.wanted) {
+			t.Errorf("Check(%q) => %v, want %v", tt.text, got, tt.wanted)
+		}
+	}
+
+	// all is not a builtin in version 1, and is looked up as an external
+	// command instead.
+	ev := NewEvaluator()
+	if err := ev.EvalText("<lang test>", "shell:lang-version 1; all"); err == nil {
+		t.Errorf("all ran as a builtin in language version 1")
+	}
+	if err := ev.Compiler.SetLangVersion(3); err == nil {
+		t.Errorf("SetLangVersion(3) => no error")
+	}
+}
+
+func TestEvalContext(t *testing.T) {
+	for _, tt := range []struct {
+		text    string
+		timeout bool
+		at      string // Where the evaluation is reported to have been.
+	}{
+		{"sleep 10", true, "sleep"},
+		{"var $x string = a; /bin/sleep 10", true, "/bin/sleep"},
+		{"var $x string = a; sleep 10", false, "sleep"},
+		{"range 1e12 | each {|x| }", true, ""},
+		{"var $m mutex; m = (sync:mutex); sync:with-lock $m { sync:with-lock $m { } }", true, "sync:with-lock $m { }"},
+	} {
+		n, err := parse.Parse("<cancel test>", tt.text)
+		if err != nil {
+			t.Fatalf("Parse(*, %q) => error %v", tt.text, err)
+		}
+		var (
+			ctx    context.Context
+			cancel context.CancelFunc
+			want   string
+		)
+		if tt.timeout {
+			ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+			want = "evaluation timed out"
+		} else {
+			ctx, cancel = context.WithCancel(context.Background())
+			time.AfterFunc(100*time.Millisecond, cancel)
+			want = "evaluation canceled"
+		}
+		start := time.Now()
+		err = NewEvaluator().EvalContext(ctx, "<cancel test>", tt.text, n)
+		cancel()
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("EvalContext(*, %q) takes %v after cancellation", tt.text, d)
+		}
+		ce, ok := err.(*util.ContextualError)
+		if !ok || !strings.HasSuffix(ce.Error(), want) {
+			t.Errorf("EvalContext(*, %q) => %v, want %s", tt.text, err, want)
+			continue
+		}
+		if tt.at != "" && ce.Pos != strings.Index(tt.text, tt.at) {
+			t.Errorf("EvalContext(*, %q) => error at %d, want %d", tt.text, ce.Pos, strings.Index(tt.text, tt.at))
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	if err := ev.EvalText("<limit test>", "options[max-depth] = 50; options[max-values] = 10"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		text string
+		want string
+		at   int
+	}{
+		// A closure calling itself through each.
+		{"put {|f| put $f | each $f } | each {|f| put $f | each $f }", "maximum call depth exceeded; see $options[max-depth]", 18},
+		{"put {|f| put $f $f | each $f } | each {|f| put $f $f | each $f }", "maximum call depth exceeded; see $options[max-depth]", 21},
+		{"put (range 10) | count", "", 0},
+		{"put (range 1e18) | count", "output capture exceeds $options[max-values]", 0},
+		{"put (yes) | count", "output capture exceeds $options[max-values]", 0},
+	} {
+		err := ev.EvalText("<limit test>", tt.text)
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("EvalText(*, %q) => %v, want no error", tt.text, err)
+			}
+			continue
+		}
+		ce, ok := err.(*util.ContextualError)
+		if !ok || !strings.HasSuffix(ce.Error(), tt.want) || ce.Pos != tt.at {
+			t.Errorf("EvalText(*, %q) => %v, want %s at %d", tt.text, err, tt.want, tt.at)
+		}
+	}
+}
+
+func TestArgCompleter(t *testing.T) {
+	ev := NewEvaluator()
+	if _, ok := ev.ArgCompleter("make"); ok {
+		t.Errorf("ArgCompleter(%q) found before one is defined", "make")
+	}
+	text := `arg-completer[make] = {|@words| put build test $words[1] }
+arg-completer[fail] = {|a| put $a }`
+	if err := ev.EvalText("<arg-completer test>", text); err != nil {
+		t.Fatal(err)
+	}
+	complete, ok := ev.ArgCompleter("make")
+	if !ok {
+		t.Fatalf("ArgCompleter(%q) not found", "make")
+	}
+	if cands, err := complete([]string{"make", "t"}); err != nil || !reflect.DeepEqual(cands, []string{"build", "test", "t"}) {
+		t.Errorf("completer of make => (%q, %v), want [build test t]", cands, err)
+	}
+	complete, _ = ev.ArgCompleter("fail")
+	if _, err := complete([]string{"fail", ""}); err == nil {
+		t.Errorf("completer of fail => no error, want one")
+	}
+}
+
+func TestLastOutput(t *testing.T) {
+	f, err := ioutil.TempFile("", "elvish-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	ev.ports[1] = &port{f: f}
+	for _, tt := range []struct {
+		text, want string
+	}{
+		{"echo before", ""},
+		{"options[last-output] = 8", ""},
+		{"echo hello", ""},
+		{"put a b", "hello\n"},
+		{"echo hello world", "a\nb\n"},
+		{"options[last-output] = 0", "hello wo"},
+		{"echo hello", ""},
+	} {
+		if err := ev.EvalText("<last output test>", tt.text); err != nil {
+			t.Fatal(err)
+		}
+		if out := ev.scope.get("last-output").Get().String(); out != tt.want {
+			t.Errorf("$last-output in %q => %q, want %q", tt.text, out, tt.want)
+		}
+	}
+	if ev.ports[1].f != f || len(ev.relays) != 0 {
+		t.Errorf("stdout still relayed after options[last-output] = 0")
+	}
+	// The output written through the pipe and directly is all there.
+	b, err := ioutil.ReadFile(f.Name())
+	if want := "before\nhello\na\nb\nhello world\nhello\n"; err != nil || string(b) != want {
+		t.Errorf("output is (%q, %v), want %q", b, err, want)
+	}
+}
+
+// waitRelays waits until the relays of ev have caught up, like drainRelays
+// but without giving up, so that a slow relay doesn't make tests flaky.
+func waitRelays(ev *Evaluator) {
+	for _, rl := range ev.relays {
+		for {
+			ok, progress := rl.caughtUp()
+			if ok {
+				break
+			}
+			<-progress
+		}
+	}
+}
+
+func TestSessionLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elvish-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out, err := os.Create(dir + "/out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	ev.ports[1] = &port{f: out}
+	ev.ports[2] = &port{f: out}
+	log := dir + "/session.log"
+	if err := ev.TeeSessionLog(log, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := ev.EvalText("<session log test>", "echo hello; echo oops >[1=2]"); err != nil {
+		t.Fatal(err)
+	}
+	waitRelays(ev)
+	// The output still goes where it went.
+	if b, err := ioutil.ReadFile(out.Name()); err != nil || string(b) != "hello\noops\n" {
+		t.Errorf("output is (%q, %v), want %q", b, err, "hello\noops\n")
+	}
+	b, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Drop the times, which vary.
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		lines = append(lines, line[len(sessionLogTimeFormat)+1:])
+	}
+	want := []string{"--- <session log test> echo hello; echo oops >[1=2]", "out hello", "err oops"}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("session log has %q, want %q", lines, want)
+	}
+
+	// Each line is over the maximum size, so it rotates the log.
+	ev = NewEvaluator()
+	ev.statusCb = nil
+	ev.ports[1] = &port{f: out}
+	if err := ev.TeeSessionLog(log, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := ev.EvalText("<session log test>", "echo a; echo b; echo c; echo d"); err != nil {
+		t.Fatal(err)
+	}
+	waitRelays(ev)
+	for _, name := range []string{log, log + ".1", log + ".2", log + ".3"} {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("after rotating, %s is missing", name)
+		}
+	}
+	if _, err := os.Stat(log + ".4"); err == nil {
+		t.Errorf("after rotating, more than %d backups are kept", sessionLogBackups)
+	}
+}
+
+func TestDefaultRedirs(t *testing.T) {
+	f, err := ioutil.TempFile("", "elvish-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	ch := make(chan Value, 10)
+	ev.ports[1] = &port{ch: ch}
+	// Default redirections apply to the forms compiled after they are set,
+	// and not to fds redirected explicitly.
+	for _, text := range []string{
+		"default-redir echo `>>" + f.Name() + "`",
+		"echo a; echo b >" + os.DevNull,
+		"default-redir echo ``",
+		"echo c | each {|l| put $l}",
+	} {
+		if err := ev.EvalText("<default redir test>", text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(ch)
+	var vs []Value
+	for v := range ch {
+		vs = append(vs, v)
+	}
+	if out := reprs(vs); !reflect.DeepEqual(out, []string{"c"}) {
+		t.Errorf("output is %v, want [c]", out)
+	}
+	if b, err := ioutil.ReadFile(f.Name()); err != nil || string(b) != "a\n" {
+		t.Errorf("redirected output is (%q, %v), want %q", b, err, "a\n")
+	}
+}
+
+// elvish -i evaluates a script and then a session with the same Evaluator.
+func TestScopeAfterError(t *testing.T) {
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	ch := make(chan Value, 10)
+	ev.ports[1] = &port{ch: ch}
+	if err := ev.EvalText("<script>", "var $x string = a; fn f { put $x }; put [a][5]; x = b"); err == nil {
+		t.Errorf("script with an error => no error")
+	}
+	// What the script has done before the error is kept.
+	if err := ev.EvalText("<session>", "f; put $x"); err != nil {
+		t.Errorf("session after the script => error %v", err)
+	}
+	close(ch)
+	var vs []Value
+	for v := range ch {
+		vs = append(vs, v)
+	}
+	if out := reprs(vs); !reflect.DeepEqual(out, []string{"a", "a"}) {
+		t.Errorf("session after the script outputs %v, want [a a]", out)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		if r.URL.Path != "/echo" {
+			http.NotFound(w, r)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.Header.Get("X-Test"), body)
+	}))
+	defer server.Close()
+	for _, tt := range []struct {
+		text   string
+		wanted []string
+	}{
+		{"put (http:get $url/echo [&X-Test a])[body]", []string{"`GET a `"}},
+		{"put (http:get $url/nothing)[status]", []string{"404"}},
+		{"put (http:post $url/echo [&X-Test b] data)[body]", []string{"`POST b data`"}},
+		{"put (put [&k v] | to-json | http:post $url/echo)[body]", []string{`"POST  {\"k\":\"v\"}\n"`}},
+		{"http:post $url/echo </dev/null; put $status", []string{"[`http:post needs a body argument or piped input`]"}},
+	} {
+		text := strings.Replace(tt.text, "$url", server.URL, -1)
+		if out := reprs(evalAndCollect(t, text)); !reflect.DeepEqual(out, tt.wanted) {
+			t.Errorf("Eval(*, %q, *) outputs %v, want %v", tt.text, out, tt.wanted)
+		}
+	}
+
+	defer func(c *http.Client) { httpClient = c }(httpClient)
+	httpClient = &http.Client{Timeout: 50 * time.Millisecond}
+	text := "http:get " + server.URL + "/slow; put $status"
+	if out := evalAndCollect(t, text); len(out) != 1 || !strings.Contains(out[0].Repr(), "Timeout") {
+		t.Errorf("Eval(*, %q, *) outputs %v, want a timeout", text, reprs(out))
+	}
+}
+
+func TestEpm(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elvish-epm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { PackageDir = d }(PackageDir)
+	PackageDir = dir + "/lib"
+
+	repo := dir + "/greet.git"
+	commit := func(text string) {
+		if err := ioutil.WriteFile(repo+"/init.elv", []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for _, args := range [][]string{{"add", "init.elv"}, {"-c", "user.name=t", "-c", "user.email=t@t", "commit", "-qm", text}} {
+			if _, err := git(repo, args...); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	os.Mkdir(repo, 0755)
+	if _, err := git(repo, "init", "-q"); err != nil {
+		t.Skip("cannot run git:", err)
+	}
+	commit("var $greeting string = hello\n")
+
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	ch := make(chan Value, 10)
+	ev.ports[1] = &port{ch: ch}
+	eval := func(text string) {
+		if err := ev.EvalText("<epm test>", text); err != nil {
+			t.Fatalf("%s => error %v", text, err)
+		}
+	}
+	eval("epm:install " + repo + "; epm:load greet")
+	eval("put $greeting")
+	if v := (<-ch).String(); v != "hello" {
+		t.Errorf("$greeting after epm:load => %q, want hello", v)
+	}
+	if msg := epmInstall(ev, []Value{NewString(repo)}); msg != "package greet already installed" {
+		t.Errorf("installing again => %q", msg)
+	}
+
+	commit("var $greeting string = hi\n")
+	eval("epm:upgrade; epm:load greet")
+	eval("put $greeting; epm:list")
+	if v := (<-ch).String(); v != "hi" {
+		t.Errorf("$greeting after epm:upgrade => %q, want hi", v)
+	}
+	head, _ := git(repo, "rev-parse", "HEAD")
+	pkg := (<-ch).(*Table)
+	for k, want := range map[string]string{"name": "greet", "url": repo, "commit": head, "dir": PackageDir + "/greet"} {
+		if v, _ := pkg.lookup(k); v == nil || v.String() != want {
+			t.Errorf("epm:list => &%s %v, want %s", k, v, want)
+		}
+	}
+
+	ev2 := NewEvaluator()
+	if errs := ev2.LoadPackages(); len(errs) != 0 {
+		t.Errorf("LoadPackages => %v", errs)
+	}
+	if v := ev2.scope.get("greeting"); v == nil || v.Get().String() != "hi" {
+		t.Errorf("$greeting after LoadPackages => %v, want hi", v)
+	}
+
+	eval("epm:remove greet; epm:list")
+	if len(ch) != 0 {
+		t.Errorf("epm:list after epm:remove => %v", (<-ch).Repr())
+	}
+	if _, err := os.Stat(PackageDir + "/greet"); !os.IsNotExist(err) {
+		t.Errorf("package directory not removed: %v", err)
+	}
+}
+
+func TestPackageName(t *testing.T) {
+	for url, want := range map[string]string{
+		"https://github.com/user/lib.git": "github.com/user/lib",
+		"ssh://git@example.com/a/b/":      "example.com/a/b",
+		"git@github.com:user/lib":         "github.com/user/lib",
+		"/src/lib.git":                    "lib",
+		"file:///src/lib":                 "lib",
+	} {
+		if name, err := packageName(url); name != want || err != nil {
+			t.Errorf("packageName(%q) => (%q, %v), want %q", url, name, err, want)
+		}
+	}
+	if _, err := packageName("https://../x"); err == nil {
+		t.Errorf("packageName accepted a URL escaping the package directory")
+	}
+}
+
+func TestRestricted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elvish-restricted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := NewRestrictedEvaluator()
+	ev.statusCb = nil
+	ev.ports[1] = &port{ch: make(chan Value, 10)}
+	for _, tt := range []struct {
+		text string
+		want string
+		at   int
+	}{
+		{"put (str:to-upper x)", "", 0},
+		{"true", "true: running external commands is not allowed in restricted mode", 0},
+		{"echo x > " + dir + "/a", dir + "/a: writing files is not allowed in restricted mode", 7},
+		{"fopen " + dir + "/a w", "fopen: writing files is not allowed in restricted mode", 0},
+		{"open " + dir + "/a a", "open: writing files is not allowed in restricted mode", 0},
+		{"fs:remove " + dir, "fs:remove: writing files is not allowed in restricted mode", 0},
+		{"net:dial tcp localhost:1", "net:dial: using the network is not allowed in restricted mode", 0},
+		{"exit 1", "exit: controlling the shell process is not allowed in restricted mode", 0},
+		{"at-exit { }", "at-exit: controlling the shell process is not allowed in restricted mode", 0},
+		{"cd " + dir, "cd: controlling the shell process is not allowed in restricted mode", 0},
+		{"pushd " + dir, "pushd: controlling the shell process is not allowed in restricted mode", 0},
+		{"popd", "popd: controlling the shell process is not allowed in restricted mode", 0},
+		{"put (dirs)", "", 0},
+		{"umask 0", "umask: controlling the shell process is not allowed in restricted mode", 0},
+		{"put (umask)", "", 0},
+		{"ulimit nofile 1", "ulimit: controlling the shell process is not allowed in restricted mode", 0},
+		{"put (ulimit nofile)", "", 0},
+		{"kill -INT 1", "kill: sending signals to processes is not allowed in restricted mode", 0},
+	} {
+		err := ev.EvalText("<restricted test>", tt.text)
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("EvalText(*, %q) => %v, want no error", tt.text, err)
+			}
+			continue
+		}
+		ce, ok := err.(*util.ContextualError)
+		if !ok || !strings.HasSuffix(ce.Error(), tt.want) || ce.Pos != tt.at {
+			t.Errorf("EvalText(*, %q) => %v, want %s at %d", tt.text, err, tt.want, tt.at)
+		}
+	}
+	if names, _ := ioutil.ReadDir(dir); len(names) != 0 {
+		t.Errorf("files written in restricted mode")
+	}
+	if now, _ := os.Getwd(); now != wd {
+		t.Errorf("working directory changed to %s in restricted mode", now)
+		os.Chdir(wd)
+	}
+}
+
+func TestCrashReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elvish-crash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { CrashDumpDir = d }(CrashDumpDir)
+	CrashDumpDir = dir
+
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	ev.ports[1] = &port{ch: make(chan Value, 10)}
+	if err := ev.EvalText("<crash test>", "put before-crash"); err != nil {
+		t.Fatal(err)
+	}
+	err = ev.eval("<crash test>", "crash", func(*Evaluator) {
+		var m map[string]int
+		m["x"] = 1
+	})
+	if err == nil || !strings.HasPrefix(err.Error(), "internal error: assignment to entry in nil map; a bug report has been written to "+dir) {
+		t.Fatalf("crashing => %v, want internal error with a bug report", err)
+	}
+	names, _ := ioutil.ReadDir(dir)
+	if len(names) != 1 {
+		t.Fatalf("%d bug reports written, want 1", len(names))
+	}
+	report, _ := ioutil.ReadFile(dir + "/" + names[0].Name())
+	for _, want := range []string{"assignment to entry in nil map", "put before-crash", "TestCrashReport"} {
+		if !strings.Contains(string(report), want) {
+			t.Errorf("bug report doesn't contain %q:\n%s", want, report)
+		}
+	}
+
+	if err := ev.eval("<crash test>", "fail", func(ev *Evaluator) { ev.errorf("failed") }); err == nil || err.Error() != "failed" {
+		t.Errorf("throwing an error => %v, want failed", err)
+	}
+
+	// A form crashing in its own goroutine of a pipeline.
+	n, err := parse.Parse("<crash test>", "crash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash := func(*Evaluator) <-chan *StateUpdate {
+		var m map[string]int
+		m["x"] = 1
+		return nil
+	}
+	op := combinePipeline(n.Nodes[0], []stateUpdatesOp{crash}, [2]StreamType{}, nil)
+	err = ev.eval("<crash test>", "crash", func(ev *Evaluator) { op.f(ev) })
+	if err == nil || !strings.HasPrefix(err.Error(), "internal error: assignment to entry in nil map; a bug report has been written to "+dir) {
+		t.Errorf("crashing in a pipeline => %v, want internal error with a bug report", err)
+	}
+	if names, _ := ioutil.ReadDir(dir); len(names) != 2 {
+		t.Errorf("%d bug reports written, want 2", len(names))
 	}
 }
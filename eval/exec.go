@@ -1,11 +1,16 @@
 package eval
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync/atomic"
 	"syscall"
 
+	"github.com/xiaq/elvish/parse"
 	"github.com/xiaq/elvish/util"
 )
 
@@ -15,15 +20,6 @@ const (
 	FdNil uintptr = ^uintptr(0)
 )
 
-// A port conveys data stream. It may be a Unix fd (wrapped by os.File), where
-// f is not nil, or a channel, where ch is not nil. When both are nil, the port
-// is closed and may not be used.
-type port struct {
-	f           *os.File
-	ch          chan Value
-	shouldClose bool
-}
-
 // StreamType represents what form of data stream a command expects on each
 // port.
 type StreamType byte
@@ -33,6 +29,10 @@ const (
 	unusedStream StreamType = iota
 	fdStream                // Corresponds to port.f.
 	chanStream              // Corresponds to port.ch.
+	// Only between the forms of a pipeline, where the output of one is
+	// converted for the input of the next; see stream-adapter.go.
+	fdToChanStream
+	chanToFdStream
 )
 
 func (typ StreamType) commonType(typ2 StreamType) (StreamType, bool) {
@@ -68,30 +68,28 @@ type Command struct {
 
 // form packs runtime states of a fully constructured form.
 type form struct {
-	name string  // Command name, used in error messages.
-	args []Value // Evaluated argument list
+	name string     // Command name, used in error messages.
+	node parse.Node // The form node; nil if the form is not from source.
+	args []Value    // Evaluated argument list
 	Command
 }
 
-// closePorts closes all ports in ev.ports that were marked shouldClose.
-func (ev *Evaluator) closePorts() {
-	for _, port := range ev.ports {
-		if !port.shouldClose {
-			continue
-		}
-		if port.f != nil {
-			port.f.Close()
-		}
-		if port.ch != nil {
-			close(port.ch)
-		}
-	}
-}
-
 // StateUpdate represents a change of state of a command.
 type StateUpdate struct {
 	Terminated bool
 	Msg        string
+	// Thrown is set when the form has thrown an error, which has been
+	// printed already.
+	Thrown bool
+	// Status holds the exit values of the last pipeline of a closure, when
+	// it has terminated.
+	Status []Value
+}
+
+// drainStateUpdates receives all state updates until the channel is closed.
+func drainStateUpdates(update <-chan *StateUpdate) {
+	for range update {
+	}
 }
 
 func isExecutable(path string) bool {
@@ -106,29 +104,132 @@ func isExecutable(path string) bool {
 		return false
 	}
 	fm := fi.Mode()
+	// Windows has no executable bits; the extension, checked by search,
+	// decides instead.
+	if runtime.GOOS == "windows" {
+		return !fm.IsDir()
+	}
 	return !fm.IsDir() && (fm&0111 != 0)
 }
 
+// defaultPathExt is used on Windows when $PATHEXT is not set.
+const defaultPathExt = ".COM;.EXE;.BAT;.CMD"
+
+// executableExts returns the extensions tried when searching for an
+// executable, which come from $PATHEXT on Windows. Elsewhere the name is
+// tried as is.
+func executableExts() []string {
+	if runtime.GOOS != "windows" {
+		return []string{""}
+	}
+	return splitPathExt(os.Getenv("PATHEXT"))
+}
+
+// splitPathExt splits a value of $PATHEXT like ".COM;.EXE" into extensions.
+func splitPathExt(pathext string) []string {
+	if pathext == "" {
+		pathext = defaultPathExt
+	}
+	var exts []string
+	for _, ext := range strings.Split(pathext, ";") {
+		if ext != "" {
+			exts = append(exts, strings.ToLower(ext))
+		}
+	}
+	return exts
+}
+
+// withExts returns the file names to try for exe. A name that already ends
+// in one of the extensions is only tried as is.
+func withExts(exe string, exts []string) []string {
+	ext := strings.ToLower(filepath.Ext(exe))
+	for _, e := range exts {
+		if e == "" || e == ext {
+			return []string{exe}
+		}
+	}
+	names := make([]string, len(exts))
+	for i, e := range exts {
+		names[i] = exe + e
+	}
+	return names
+}
+
 // Search for executable `exe`.
 func (ev *Evaluator) search(exe string) (string, error) {
-	for _, p := range []string{"/", "./", "../"} {
-		if strings.HasPrefix(exe, p) {
-			if isExecutable(exe) {
-				return exe, nil
+	exts := executableExts()
+	if isPath(exe) {
+		for _, name := range withExts(exe, exts) {
+			if isExecutable(name) {
+				return name, nil
 			}
-			return "", fmt.Errorf("external command not executable")
 		}
+		return "", fmt.Errorf("external command not executable")
+	}
+	if full, ok := ev.options.cachedPath(exe); ok {
+		return full, nil
 	}
 	for _, p := range ev.searchPaths {
-		full := p + "/" + exe
-		if isExecutable(full) {
-			return full, nil
+		for _, name := range withExts(exe, exts) {
+			full := filepath.Join(p, name)
+			if isExecutable(full) {
+				// Paths relative to the working directory can't be cached.
+				if filepath.IsAbs(full) {
+					ev.options.cachePath(exe, full)
+				}
+				return full, nil
+			}
 		}
 	}
 	return "", fmt.Errorf("external command not found")
 }
 
-// execCommand executes a command.
+// ResolveCommand returns what the command name resolves to after expanding
+// aliases, and an error if it is none of a defined function, a builtin and an
+// external command that can be found. Temporary assignments and namespaced
+// names are not checked, nor are externals when $command-not-found-hook is
+// set, since it may run any command.
+func (ev *Evaluator) ResolveCommand(name string) (string, error) {
+	if words := ev.Compiler.ExpandAlias(name); words != nil {
+		name = words[0]
+	}
+	if strings.ContainsAny(name, "=:") {
+		return name, nil
+	}
+	if _, ok := ev.scope.lookup("fn-" + name); ok {
+		return name, nil
+	}
+	if special, fn := lookupBuiltin(name); special != nil || fn != nil {
+		return name, nil
+	}
+	if ev.notFound != nil {
+		if hook, ok := ev.notFound.Get().(*Closure); ok && hook.Op != nil {
+			return name, nil
+		}
+	}
+	if _, err := ev.search(name); err != nil {
+		return name, err
+	}
+	return name, nil
+}
+
+// isPath determines whether exe is a path, either absolute or relative to
+// the working directory like ./a, as opposed to a name to search for.
+func isPath(exe string) bool {
+	if filepath.IsAbs(exe) {
+		return true
+	}
+	for _, p := range []string{"/", "./", "../"} {
+		if strings.HasPrefix(exe, p) ||
+			strings.HasPrefix(exe, filepath.FromSlash(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// execForm executes a form. Forms that run asynchronously hold their own
+// references to the ports of ev.
 func (ev *Evaluator) execForm(fm *form) <-chan *StateUpdate {
 	switch {
 	case fm.Func != nil:
@@ -146,51 +247,191 @@ func (ev *Evaluator) execForm(fm *form) <-chan *StateUpdate {
 
 func (ev *Evaluator) execClosure(fm *form) <-chan *StateUpdate {
 	update := make(chan *StateUpdate, 1)
-
-	locals := make(map[string]Value)
-	// TODO Support optional/rest argument
-	if len(fm.args) != len(fm.Closure.ArgNames) {
-		// TODO Check arity before exec'ing
-		update <- &StateUpdate{Terminated: true, Msg: "arity mismatch"}
+	newEv, msg := ev.closureEvaluator(fm)
+	if newEv == nil {
+		update <- &StateUpdate{Terminated: true, Msg: msg}
 		close(update)
 		return update
 	}
-	// Pass argument by populating locals.
-	for i, name := range fm.Closure.ArgNames {
-		locals[name] = fm.args[i]
-	}
-
-	// Make a subevaluator.
-	// BUG(xiaq): When evaluating closures, async access to globals, in and out can be problematic.
-	newEv := ev.copy(fmt.Sprintf("<closure %v>", fm.Closure), true)
-	newEv.scope = make(map[string]*Value)
-	for name, pvalue := range fm.Closure.Enclosed {
-		newEv.scope[name] = pvalue
-	}
-	newEv.statusCb = nil
 	go func() {
-		// TODO Support calling closure originated in another source.
-		err := newEv.eval(ev.name, ev.text, fm.Closure.Op)
+		err := newEv.eval(fm.Closure.srcName, fm.Closure.srcText, fm.Closure.Op)
 		if err != nil {
-			fmt.Print(err.(*util.ContextualError).Pprint())
+			printError(err)
 		}
-		// Ports are closed after executaion of closure is complete.
-		newEv.closePorts()
+		// Ports are released after executaion of closure is complete.
+		newEv.releasePorts()
 		// TODO Support returning value.
-		update <- &StateUpdate{Terminated: true}
+		update <- &StateUpdate{Terminated: true, Thrown: err != nil, Status: newEv.bodyStatus}
 		close(update)
 	}()
 	return update
 }
 
+// closureEvaluator makes the subevaluator that runs the closure of fm, with
+// the arguments in its scope. If they don't match the closure, it returns nil
+// and an exit value instead.
+func (ev *Evaluator) closureEvaluator(fm *form) (*Evaluator, string) {
+	// TODO Support optional argument
+	nargs := len(fm.Closure.ArgNames)
+	if len(fm.args) != nargs && (fm.Closure.RestArg == "" || len(fm.args) < nargs) {
+		// TODO Check arity before exec'ing
+		return nil, "arity mismatch"
+	}
+
+	// Make a subevaluator.
+	newEv := ev.copy()
+	newEv.bodyStatus = nil
+	newEv.scope = newVarScope(nil)
+	for name, v := range fm.Closure.Enclosed {
+		newEv.scope.define(name, v)
+	}
+	// The body has a $status of its own, also known as $?, which starts
+	// empty. It is only made when the body uses it.
+	newEv.status = nil
+	_, usesStatus := fm.Closure.Enclosed["status"]
+	_, usesQ := fm.Closure.Enclosed["?"]
+	if usesStatus || usesQ {
+		newEv.status = newVar(NewTable())
+		newEv.scope.define("status", newEv.status)
+		newEv.scope.define("?", newEv.status)
+	}
+	// Pass arguments by populating the scope.
+	for i, name := range fm.Closure.ArgNames {
+		newEv.scope.define(name, newVar(fm.args[i]))
+	}
+	if fm.Closure.RestArg != "" {
+		rest := NewTable()
+		rest.append(fm.args[nargs:]...)
+		newEv.scope.define(fm.Closure.RestArg, newVar(rest))
+	}
+	if max := int(atomic.LoadInt32(&ev.options.maxDepth)); max > 0 && len(ev.callers) >= max {
+		ev.stop("maximum call depth exceeded; see $options[max-depth]")
+	}
+	newEv.statusCb = nil
+	newEv.pushCaller(fm)
+	return newEv, ""
+}
+
+// runClosure calls a closure like callClosure, but returns the error it fails
+// with instead of printing it.
+func (ev *Evaluator) runClosure(c *Closure, args []Value) (err error) {
+	defer util.Recover(&err)
+	fm := &form{name: "<closure>", args: args}
+	fm.Closure = c
+	newEv, msg := ev.closureEvaluator(fm)
+	if newEv == nil {
+		return errors.New(msg)
+	}
+	defer newEv.releasePorts()
+	return newEv.eval(c.srcName, c.srcText, c.Op)
+}
+
+// callClosure calls a closure with the given arguments and waits for it to
+// terminate, returning its final status. The closure shares the ports of ev.
+func (ev *Evaluator) callClosure(c *Closure, args []Value) string {
+	msg, _ := ev.callClosureStatus(c, args)
+	return msg
+}
+
+// callClosureStatus calls a closure like callClosure, and also returns the
+// exit values of the last pipeline in it. When the closure has thrown an
+// error, the exit value is thrownStatus instead.
+func (ev *Evaluator) callClosureStatus(c *Closure, args []Value) (string, []Value) {
+	fm := &form{name: "<closure>", args: args}
+	fm.Closure = c
+	var msg string
+	var status []Value
+	for up := range ev.execClosure(fm) {
+		msg, status = up.Msg, up.Status
+		if up.Thrown {
+			status = []Value{thrownStatus}
+		}
+	}
+	return msg, status
+}
+
+// failure returns the exit value of a closure called with callClosureStatus,
+// which is that of the first failed form of its last pipeline, or "" if it
+// succeeded.
+func failure(msg string, status []Value) string {
+	if msg != "" {
+		return msg
+	}
+	for _, v := range status {
+		if !statusOk([]Value{v}) {
+			return v.String()
+		}
+	}
+	return ""
+}
+
+// CallClosure calls a closure value with arguments, returning its exit value.
+// It is an error if v is not a closure.
+func (ev *Evaluator) CallClosure(v Value, args []Value) string {
+	c, ok := v.(*Closure)
+	if !ok {
+		return fmt.Sprintf("not a closure: %s", v.Repr())
+	}
+	return ev.callClosure(c, args)
+}
+
+// captureClosure calls a closure like callClosure, but with the values it
+// outputs on the channel of port 1 collected and returned.
+func (ev *Evaluator) captureClosure(c *Closure, args []Value) ([]Value, string) {
+	newEv := ev.copy()
+	w, collected := newCollector(ev.maxValues())
+	newEv.setPort(1, w)
+	msg := func() string {
+		defer newEv.releasePorts()
+		return newEv.callClosure(c, args)
+	}()
+	values, ok := collected()
+	if !ok && msg == "" {
+		msg = errTooManyValues.Error()
+	}
+	return values, msg
+}
+
+// runBuiltin runs the implementation of a builtin. Since builtins are run in
+// their own goroutines, errors thrown with ev.errorf are caught and printed
+// here, in which case thrown is true and the status of the builtin is
+// "error".
+func (ev *Evaluator) runBuiltin(f func() string) (msg string, thrown bool) {
+	err := func() (err error) {
+		defer util.Recover(&err)
+		defer ev.recoverCrash()
+		msg = f()
+		return nil
+	}()
+	if err != nil {
+		printError(err)
+		return "error", true
+	}
+	return msg, false
+}
+
+// printError prints an error caught from the evaluation of elvish code.
+// Cancellation is not printed, but reported by EvalContext.
+func printError(err error) {
+	if err == errCanceled {
+		return
+	}
+	if ce, ok := err.(*util.ContextualError); ok {
+		fmt.Print(ce.Pprint())
+	} else {
+		fmt.Println(err)
+	}
+}
+
 // execBuiltinSpecial executes a builtin special form.
 func (ev *Evaluator) execBuiltinSpecial(fm *form) <-chan *StateUpdate {
 	update := make(chan *StateUpdate)
+	ev = ev.copy()
 	go func() {
-		msg := fm.Special(ev)
-		// Ports are closed after executaion of builtin is complete.
-		ev.closePorts()
-		update <- &StateUpdate{Terminated: true, Msg: msg}
+		msg, thrown := ev.runBuiltin(func() string { return fm.Special(ev) })
+		// Ports are released after executaion of builtin is complete.
+		ev.releasePorts()
+		update <- &StateUpdate{Terminated: true, Msg: msg, Thrown: thrown}
 		close(update)
 	}()
 	return update
@@ -200,11 +441,12 @@ func (ev *Evaluator) execBuiltinSpecial(fm *form) <-chan *StateUpdate {
 // XXX(xiaq): Duplicate with execBuiltinSpecial.
 func (ev *Evaluator) execBuiltinFunc(fm *form) <-chan *StateUpdate {
 	update := make(chan *StateUpdate)
+	ev = ev.copy()
 	go func() {
-		msg := fm.Func(ev, fm.args)
-		// Ports are closed after executaion of builtin is complete.
-		ev.closePorts()
-		update <- &StateUpdate{Terminated: true, Msg: msg}
+		msg, thrown := ev.runBuiltin(func() string { return fm.Func(ev, fm.args) })
+		// Ports are released after executaion of builtin is complete.
+		ev.releasePorts()
+		update <- &StateUpdate{Terminated: true, Msg: msg, Thrown: thrown}
 		close(update)
 	}()
 	return update
@@ -239,6 +481,8 @@ func printStatus(ws syscall.WaitStatus) string {
 }
 
 func waitStateUpdate(pid int, update chan<- *StateUpdate) {
+	atomic.AddInt32(&liveCounts.jobs, 1)
+	defer atomic.AddInt32(&liveCounts.jobs, -1)
 	for {
 		var ws syscall.WaitStatus
 		_, err := syscall.Wait4(pid, &ws, 0, nil)
@@ -257,38 +501,91 @@ func waitStateUpdate(pid int, update chan<- *StateUpdate) {
 
 // execExternal executes an external command.
 func (ev *Evaluator) execExternal(fm *form) <-chan *StateUpdate {
-	files := make([]uintptr, len(ev.ports))
-	for i, port := range ev.ports {
-		if port == nil || port.f == nil {
-			files[i] = FdNil
-		} else {
-			files[i] = port.f.Fd()
-		}
-	}
-
-	args := make([]string, len(fm.args)+1)
-	args[0] = fm.Path
+	argv := make([]string, len(fm.args)+1)
+	argv[0] = fm.Path
 	for i, a := range fm.args {
 		// NOTE Maybe we should enfore string arguments instead of coercing all
 		// args into string
-		args[i+1] = a.String()
+		argv[i+1] = a.String()
 	}
 
-	sys := syscall.SysProcAttr{}
-	attr := syscall.ProcAttr{Env: ev.env.Export(), Files: files[:], Sys: &sys}
-	pid, err := syscall.ForkExec(fm.Path, args, &attr)
-	// Ports are closed after fork-exec of external is complete.
-	ev.closePorts()
+	pid, err := ev.startExternal(&externalCmd{path: fm.Path, argv: argv})
 
 	update := make(chan *StateUpdate)
-	if err != nil {
+	if err == errDryRun {
+		go func() {
+			update <- &StateUpdate{Terminated: true}
+			close(update)
+		}()
+	} else if err != nil {
 		go func() {
 			update <- &StateUpdate{Terminated: true, Msg: err.Error()}
 			close(update)
 		}()
 	} else {
-		go waitStateUpdate(pid, update)
+		exited := make(chan struct{})
+		go func() {
+			waitStateUpdate(pid, update)
+			close(exited)
+		}()
+		ev.killOnCancel(pid, exited)
 	}
 
 	return update
 }
+
+// errVetoed is returned by runExecHook when $exec-hook vetoes a command.
+var errVetoed = errors.New("vetoed by exec hook")
+
+// runExecHook calls $exec-hook with the resolved argv of an external command
+// as a single table argument. If the hook outputs nothing, the command is run
+// unchanged. If it outputs a table, the elements of its list become the new
+// argv, and the command is searched again if argv[0] has been changed; an
+// empty table vetoes the command. Commands run by the hook itself are not
+// subject to the hook.
+func (ev *Evaluator) runExecHook(path string, args []string) (string, []string, error) {
+	if ev.execHook == nil {
+		return path, args, nil
+	}
+	hook, ok := ev.execHook.Get().(*Closure)
+	if !ok || hook.Op == nil {
+		return path, args, nil
+	}
+
+	argv := NewTable()
+	for _, a := range args {
+		argv.append(NewString(a))
+	}
+
+	newEv := ev.copy()
+	defer newEv.releasePorts()
+	newEv.execHook = nil
+	outs, msg := newEv.captureClosure(hook, hookArgs("exec-hook", hook, []Value{argv}))
+	if msg != "" {
+		return "", nil, fmt.Errorf("exec hook: %s", msg)
+	}
+
+	if len(outs) == 0 {
+		return path, args, nil
+	}
+	t, ok := outs[len(outs)-1].(*Table)
+	if !ok {
+		return "", nil, fmt.Errorf("exec hook must output a table")
+	}
+	if len(t.List) == 0 {
+		return "", nil, errVetoed
+	}
+	newArgs := make([]string, len(t.List))
+	for i, v := range t.List {
+		newArgs[i] = v.String()
+	}
+	if newArgs[0] != args[0] {
+		var err error
+		path, err = ev.search(newArgs[0])
+		if err != nil {
+			return "", nil, err
+		}
+		newArgs[0] = path
+	}
+	return path, newArgs, nil
+}
@@ -0,0 +1,80 @@
+package eval
+
+// The exit builtin and at-exit hooks, which rc files can use to clean up,
+// e.g. to flush history or restore the terminal, before elvish exits.
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+)
+
+type exitState struct {
+	mutex sync.Mutex
+	hooks []*Closure
+}
+
+// atExit registers a closure to be called without arguments before elvish
+// exits, e.g.
+//
+// at-exit { echo bye }
+//
+// Hooks are called in the reverse order they are registered in, like deferred
+// calls.
+func atExit(ev *Evaluator, args []Value) string {
+	if len(args) != 1 {
+		return "args error"
+	}
+	c, ok := args[0].(*Closure)
+	if !ok {
+		return fmt.Sprintf("at-exit argument must be a closure, got %s", args[0].Repr())
+	}
+	ev.exit.mutex.Lock()
+	defer ev.exit.mutex.Unlock()
+	ev.exit.hooks = append(ev.exit.hooks, c)
+	return ""
+}
+
+// RunExitHooks calls the at-exit hooks. Each hook is called at most once, so
+// that it is safe to call RunExitHooks again, e.g. when elvish is hung up
+// while exiting. The exit values of failed hooks are printed.
+func (ev *Evaluator) RunExitHooks() {
+	ev.exit.mutex.Lock()
+	hooks := ev.exit.hooks
+	ev.exit.hooks = nil
+	ev.exit.mutex.Unlock()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if msg := ev.callClosure(hooks[i], nil); msg != "" {
+			fmt.Fprintln(os.Stderr, "at-exit hook:", msg)
+		}
+	}
+}
+
+// Exit calls the at-exit hooks, writes the profile report if profiling and the
+// coverage listing if recording coverage, and exits the process with status.
+func (ev *Evaluator) Exit(status int) {
+	ev.RunExitHooks()
+	ev.StopProfile()
+	ev.StopCoverage()
+	os.Exit(status)
+}
+
+// exit exits elvish, with status 0 or the status given, after calling the
+// at-exit hooks.
+func exit(ev *Evaluator, args []Value) string {
+	status := 0
+	switch len(args) {
+	case 0:
+	case 1:
+		var err error
+		status, err = strconv.Atoi(args[0].String())
+		if err != nil || status < 0 || status > 255 {
+			return fmt.Sprintf("bad exit status %s", args[0].Repr())
+		}
+	default:
+		return "args error"
+	}
+	ev.Exit(status)
+	return ""
+}
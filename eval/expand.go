@@ -0,0 +1,65 @@
+package eval
+
+// Expansion preview.
+
+import (
+	"bytes"
+
+	"github.com/xiaq/elvish/parse"
+	"github.com/xiaq/elvish/util"
+)
+
+// compilePreview compiles a chunk into a strOp that evaluates the command and
+// arguments of every form and renders them, without executing any command.
+// Pipelines are separated by "; " and forms by " | ".
+func (cp *Compiler) compilePreview(name, text string, n *parse.ChunkNode, scope map[string]Type) (op strOp, err error) {
+	cp.startCompile(name, text, scope)
+	cp.previewing = true
+	defer util.Recover(&err)
+
+	var forms [][]valuesOp
+	for _, pn := range n.Nodes {
+		ops := make([]valuesOp, len(pn.Nodes))
+		for i, fn := range pn.Nodes {
+			ops[i] = combineTermList([]valuesOp{
+				cp.compileTerm(fn.Command), cp.compileTermList(fn.Args)})
+		}
+		forms = append(forms, ops)
+	}
+
+	return func(ev *Evaluator) string {
+		buf := new(bytes.Buffer)
+		for i, ops := range forms {
+			if i > 0 {
+				buf.WriteString("; ")
+			}
+			for j, op := range ops {
+				if j > 0 {
+					buf.WriteString(" | ")
+				}
+				for k, v := range op.f(ev) {
+					if k > 0 {
+						buf.WriteRune(' ')
+					}
+					buf.WriteString(v.Repr())
+				}
+			}
+		}
+		return buf.String()
+	}, nil
+}
+
+// Expand evaluates the words of all forms in the chunk node n and returns
+// them in their fully expanded form, without executing any command. Output and
+// status captures are left unexpanded, as are variables that cannot be
+// resolved. The name and text of it is used for diagnostic messages.
+func (ev *Evaluator) Expand(name, text string, n *parse.ChunkNode) (s string, err error) {
+	op, err := NewCompiler().compilePreview(name, text, n, ev.MakeCompilerScope())
+	if err != nil {
+		return "", err
+	}
+	err = ev.eval(name, text, func(ev *Evaluator) {
+		s = op(ev)
+	})
+	return s, err
+}
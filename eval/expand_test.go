@@ -0,0 +1,36 @@
+package eval
+
+import (
+	"fmt"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/xiaq/elvish/parse"
+)
+
+var expandTests = []struct {
+	in     string
+	wanted string
+}{
+	{"echo a `b c`", "echo a `b c`"},
+	{"echo $pid; rm -rf $nonexistent", "echo " + strconv.Itoa(syscall.Getpid()) + "; rm -rf `$nonexistent`"},
+	{"ls (pwd) | cat", "ls `(...)` | cat"},
+	{"echo a{b c}", "echo ab ac"},
+}
+
+func TestExpand(t *testing.T) {
+	ev := NewEvaluator()
+	for i, tt := range expandTests {
+		name := fmt.Sprintf("<test %d>", i)
+		n, err := parse.Parse(name, tt.in)
+		if err != nil {
+			t.Errorf("Parse(*, %q) => error %v", tt.in, err)
+			continue
+		}
+		out, err := ev.Expand(name, tt.in, n)
+		if out != tt.wanted || err != nil {
+			t.Errorf("Expand(*, %q, *) => (%q, %v), want (%q, nil)", tt.in, out, err, tt.wanted)
+		}
+	}
+}
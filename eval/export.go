@@ -0,0 +1,89 @@
+package eval
+
+// The export and unexport builtins, which decide which environment variables
+// external commands get. $env holds the variables inherited by the shell and
+// those set since, and all of them are passed on unless unexported; an
+// unexported variable is kept in $env, local to the shell, e.g.
+//
+// unexport AWS_SECRET_ACCESS_KEY # $env[AWS_SECRET_ACCESS_KEY] still works
+// unexport &all; export PATH HOME TERM LANG=C # pass on exactly these
+//
+// export name=value sets a variable and exports it. Without arguments, export
+// outputs a table of the variables external commands get.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+func exportFn(ev *Evaluator, args []Value) string {
+	e := ev.env
+	if len(args) == 0 {
+		ev.ports[1].ch <- e.exported()
+		return ""
+	}
+	e.fill()
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for _, a := range args {
+		name := a.String()
+		if i := strings.IndexByte(name, '='); i != -1 {
+			if i == 0 {
+				return fmt.Sprintf("bad environment variable %s", a.Repr())
+			}
+			name = name[:i]
+			e.m[name] = a.String()[i+1:]
+		} else if _, ok := e.m[name]; !ok {
+			return fmt.Sprintf("no environment variable %s", name)
+		}
+		delete(e.local, name)
+	}
+	return ""
+}
+
+// exported returns a table of the variables passed to external commands.
+func (e *Env) exported() *Table {
+	e.fill()
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	names := make([]string, 0, len(e.m))
+	for name := range e.m {
+		if !e.local[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	t := NewTable()
+	for _, name := range names {
+		t.put(NewString(name), NewString(e.m[name]))
+	}
+	return t
+}
+
+func unexportFn(ev *Evaluator, args []Value) string {
+	e := ev.env
+	e.fill()
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.local == nil {
+		e.local = make(map[string]bool)
+	}
+	all, args := optionArg(args, "all")
+	if err := checkOptionArgs(args); err != nil {
+		return err.Error()
+	}
+	if all {
+		for name := range e.m {
+			e.local[name] = true
+		}
+	}
+	for _, a := range args {
+		name := a.String()
+		if _, ok := e.m[name]; !ok {
+			return fmt.Sprintf("no environment variable %s", name)
+		}
+		e.local[name] = true
+	}
+	return ""
+}
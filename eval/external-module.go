@@ -0,0 +1,241 @@
+package eval
+
+// External modules, namespaces of builtin functions served by another
+// process, which can be written in any language.
+//
+// The shell talks to the process over its standard input and output, one
+// JSON object per line; values are serialized like with to-json and from-json.
+// When it starts, the process announces its functions:
+//
+// {"functions": ["query", "insert"]}
+//
+// A call of name:query a [b c] is then sent as
+//
+// {"id": 1, "call": "query", "args": ["a", ["b", "c"]]}
+//
+// and the process answers it with any number of values, followed by the exit
+// value, an empty or missing error meaning success:
+//
+// {"id": 1, "value": "result"}
+// {"id": 1, "done": true, "error": "something went wrong"}
+//
+// Calls may overlap; all messages of a call have its id. When the output of a
+// call is no longer read, the shell sends
+//
+// {"id": 1, "cancel": true}
+//
+// after which the process should finish the call soon; values it still sends
+// are discarded.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+var errModuleExited = errors.New("module exited")
+
+type moduleRequest struct {
+	ID     int     `json:"id"`
+	Call   string  `json:"call,omitempty"`
+	Args   []Value `json:"args,omitempty"`
+	Cancel bool    `json:"cancel,omitempty"`
+}
+
+type moduleResponse struct {
+	ID    int             `json:"id"`
+	Value json.RawMessage `json:"value"`
+	Done  bool            `json:"done"`
+	Error string          `json:"error"`
+}
+
+// externalModule is a running module process.
+type externalModule struct {
+	name  string
+	cmd   *exec.Cmd
+	mutex sync.Mutex // Protects the fields below.
+	enc   *json.Encoder
+	calls map[int]chan moduleResponse
+	next  int
+	err   error // Why the module can no longer be called.
+}
+
+// LoadExternalModule starts the command argv as an external module, and
+// registers the functions it serves in namespace name like RegisterModule.
+func LoadExternalModule(name string, argv []string) error {
+	if len(argv) == 0 {
+		return errors.New("no command for module")
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	m := &externalModule{name: name, cmd: cmd, enc: json.NewEncoder(stdin),
+		calls: make(map[int]chan moduleResponse)}
+
+	dec := json.NewDecoder(stdout)
+	var hello struct {
+		Functions []string `json:"functions"`
+	}
+	if err := dec.Decode(&hello); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("module %s: bad announcement: %v", name, err)
+	}
+	fns := make(map[string]func(*Evaluator, []Value) string)
+	for _, fname := range hello.Functions {
+		fname := fname
+		fns[fname] = func(ev *Evaluator, args []Value) string {
+			return m.call(ev, fname, args)
+		}
+	}
+	if err := RegisterModule(name, fns); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	go m.serve(dec)
+	return nil
+}
+
+// serve dispatches the messages from the module to the calls they belong to.
+// When the module exits, all pending calls fail.
+func (m *externalModule) serve(dec *json.Decoder) {
+	for {
+		var r moduleResponse
+		if err := dec.Decode(&r); err != nil {
+			if err == io.EOF {
+				err = errModuleExited
+			}
+			m.fail(err)
+			break
+		}
+		m.mutex.Lock()
+		ch := m.calls[r.ID]
+		if r.Done {
+			delete(m.calls, r.ID)
+		}
+		m.mutex.Unlock()
+		if ch != nil {
+			ch <- r
+			if r.Done {
+				close(ch)
+			}
+		}
+	}
+	m.cmd.Wait()
+}
+
+func (m *externalModule) fail(err error) {
+	m.mutex.Lock()
+	m.err = err
+	calls := m.calls
+	m.calls = nil
+	m.mutex.Unlock()
+	for id, ch := range calls {
+		ch <- moduleResponse{ID: id, Done: true, Error: fmt.Sprintf("module %s: %v", m.name, err)}
+		close(ch)
+	}
+}
+
+// send sends a request to the module, registering ch to receive the
+// responses if it is not nil.
+func (m *externalModule) send(req moduleRequest, ch chan moduleResponse) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	if ch != nil {
+		m.calls[req.ID] = ch
+	}
+	if err := m.enc.Encode(req); err != nil {
+		delete(m.calls, req.ID)
+		return err
+	}
+	return nil
+}
+
+func (m *externalModule) newID() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.next++
+	return m.next
+}
+
+// call calls function fname of the module, writing the values it answers to
+// the output.
+func (m *externalModule) call(ev *Evaluator, fname string, args []Value) string {
+	id := m.newID()
+	ch := make(chan moduleResponse)
+	if err := m.send(moduleRequest{ID: id, Call: fname, Args: args}, ch); err != nil {
+		return fmt.Sprintf("module %s: %v", m.name, err)
+	}
+	out := ev.ports[1]
+	cancelled := false
+	msg := ""
+	// Keep receiving until the call is done, even after a failure, so that
+	// other calls are not blocked.
+	for r := range ch {
+		if r.Done {
+			if msg == "" {
+				msg = r.Error
+			}
+			break
+		}
+		if cancelled || msg != "" {
+			continue
+		}
+		dec := json.NewDecoder(bytes.NewReader(r.Value))
+		dec.UseNumber()
+		v, err := decodeJSON(dec)
+		if err != nil {
+			msg = fmt.Sprintf("module %s: bad value: %v", m.name, err)
+			continue
+		}
+		if !out.put(v) {
+			cancelled = true
+			m.send(moduleRequest{ID: id, Cancel: true}, nil)
+		}
+	}
+	return msg
+}
+
+func init() {
+	// Needed to avoid initialization loop
+	builtinFuncs["load-module"] = builtinFunc{loadModule, [2]StreamType{}}
+}
+
+// loadModule starts an external module, e.g.
+//
+// load-module db ~/bin/elvish-db --readonly
+//
+// Like with native modules, its functions can only be used in code compiled
+// after it has been loaded.
+func loadModule(ev *Evaluator, args []Value) string {
+	if len(args) < 2 {
+		return "args error"
+	}
+	argv := make([]string, len(args)-1)
+	for i, a := range args[1:] {
+		argv[i] = a.String()
+	}
+	if err := LoadExternalModule(args[0].String(), argv); err != nil {
+		return err.Error()
+	}
+	return ""
+}
@@ -0,0 +1,66 @@
+package eval
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// TestModuleHelper is not a real test, but the external module used by
+// TestExternalModule, run in a child process.
+func TestModuleHelper(t *testing.T) {
+	if os.Getenv("ELVISH_TEST_MODULE") != "1" {
+		return
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.Encode(map[string][]string{"functions": {"echo", "fail"}})
+	dec := json.NewDecoder(os.Stdin)
+	for {
+		var req struct {
+			ID   int               `json:"id"`
+			Call string            `json:"call"`
+			Args []json.RawMessage `json:"args"`
+		}
+		if dec.Decode(&req) != nil {
+			os.Exit(0)
+		}
+		done := map[string]interface{}{"id": req.ID, "done": true}
+		switch req.Call {
+		case "echo":
+			for _, arg := range req.Args {
+				enc.Encode(map[string]interface{}{"id": req.ID, "value": arg})
+			}
+		case "fail":
+			done["error"] = "failed"
+		}
+		enc.Encode(done)
+	}
+}
+
+func TestExternalModule(t *testing.T) {
+	os.Setenv("ELVISH_TEST_MODULE", "1")
+	defer os.Unsetenv("ELVISH_TEST_MODULE")
+	err := LoadExternalModule("test-ext", []string{os.Args[0], "-test.run=TestModuleHelper"})
+	if err != nil {
+		t.Fatalf("LoadExternalModule => error %v", err)
+	}
+	defer func() {
+		delete(builtinFuncs, "test-ext:echo")
+		delete(builtinFuncs, "test-ext:fail")
+		delete(modules.names, "test-ext")
+	}()
+
+	text := "test-ext:echo a [b [&c d]]"
+	if got, want := reprs(evalAndCollect(t, text)), []string{"a", "[b [&c d]]"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Eval(*, %q, *) outputs %v, want %v", text, got, want)
+	}
+	text = "test-ext:echo a b c | take 1"
+	if got, want := reprs(evalAndCollect(t, text)), []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Eval(*, %q, *) outputs %v, want %v", text, got, want)
+	}
+	text = "test-ext:fail"
+	if _, err := evalAndCollectErr(t, "set-option errexit on; "+text); err == nil {
+		t.Errorf("Eval(*, %q, *) => no error", text)
+	}
+}
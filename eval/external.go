@@ -0,0 +1,207 @@
+package eval
+
+// External commands.
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// externalCmd describes an invocation of an external command.
+type externalCmd struct {
+	path string            // Full path of the executable.
+	argv []string          // Argument vector; argv[0] need not be path.
+	env  map[string]string // Overrides of environment variables.
+}
+
+// startExternal starts an external command with the ports of ev, after
+// running $exec-hook on it, and returns its pid.
+func (ev *Evaluator) startExternal(c *externalCmd) (int, error) {
+	files := make([]uintptr, len(ev.ports))
+	for i, port := range ev.ports {
+		if port == nil || port.f == nil {
+			files[i] = FdNil
+		} else {
+			files[i] = port.f.Fd()
+		}
+	}
+
+	path, argv, err := ev.runExecHook(c.path, c.argv)
+	if err != nil {
+		return 0, err
+	}
+	if ev.inDryRun() {
+		ev.printDryRun(path, argv, c.env)
+		return 0, errDryRun
+	}
+	sys := syscall.SysProcAttr{}
+	attr := syscall.ProcAttr{Env: ev.env.exportWith(c.env), Files: files[:], Sys: &sys}
+	return syscall.ForkExec(path, argv, &attr)
+}
+
+var errNoCommand = errors.New("no command given")
+
+// errDryRun is returned by startExternal in dry-run mode, where the command
+// is printed instead of started.
+var errDryRun = errors.New("dry run")
+
+// SetDryRun sets whether the Evaluator is in dry-run mode, for debugging
+// scripts safely. In dry-run mode, external commands, including those of
+// spawn and exec, are not run; instead, each is printed to port 2 as
+//
+// + [-a argv0] [name=value...] path args...
+//
+// with the path found and the arguments expanded, after $exec-hook, which is
+// still called. The commands are taken to succeed, and everything else is
+// evaluated as usual. It is the same as setting $options[dry-run].
+func (ev *Evaluator) SetDryRun(dryRun bool) {
+	ev.options.Set("dry-run", boolValue(dryRun))
+}
+
+func (ev *Evaluator) inDryRun() bool {
+	return atomic.LoadInt32(&ev.options.dryRun) != 0
+}
+
+// printDryRun prints a command not run in dry-run mode.
+func (ev *Evaluator) printDryRun(path string, argv []string, env map[string]string) {
+	words := []string{"+"}
+	if len(argv) > 0 && argv[0] != path {
+		words = append(words, "-a", quote(argv[0]))
+	}
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		words = append(words, quote(name+"="+env[name]))
+	}
+	words = append(words, quote(path))
+	for i := 1; i < len(argv); i++ {
+		words = append(words, quote(argv[i]))
+	}
+	if p := ev.port(2); p != nil && p.f != nil {
+		fmt.Fprintln(p.f, strings.Join(words, " "))
+	}
+}
+
+// parseExternalArgs parses the arguments to the exec and spawn builtins,
+// which are of the form
+//
+// [-a argv0] [name=value...] command [args...]
+//
+// The command is searched in the search paths; argv[0] is its full path
+// unless overridden with -a, and each name=value overrides an environment
+// variable.
+func (ev *Evaluator) parseExternalArgs(args []Value) (*externalCmd, error) {
+	ss := make([]string, len(args))
+	for i, a := range args {
+		ss[i] = a.String()
+	}
+
+	var argv0 string
+	if len(ss) >= 2 && ss[0] == "-a" {
+		argv0 = ss[1]
+		ss = ss[2:]
+	}
+	c := &externalCmd{env: make(map[string]string)}
+	for len(ss) > 0 {
+		i := strings.IndexRune(ss[0], '=')
+		if i <= 0 {
+			break
+		}
+		c.env[ss[0][:i]] = ss[0][i+1:]
+		ss = ss[1:]
+	}
+	if len(ss) == 0 {
+		return nil, errNoCommand
+	}
+
+	path, err := ev.search(ss[0])
+	if err != nil {
+		return nil, err
+	}
+	c.path = path
+	c.argv = append([]string{path}, ss[1:]...)
+	if argv0 != "" {
+		c.argv[0] = argv0
+	}
+	return c, nil
+}
+
+// execFn replaces the shell process with an external command, e.g.
+//
+// exec -a login-shell TERM=dumb /bin/sh -l
+//
+// The ports of the Evaluator become the standard streams of the command.
+func execFn(ev *Evaluator, args []Value) string {
+	c, err := ev.parseExternalArgs(args)
+	if err != nil {
+		return err.Error()
+	}
+	path, argv, err := ev.runExecHook(c.path, c.argv)
+	if err != nil {
+		return err.Error()
+	}
+	if ev.inDryRun() {
+		ev.printDryRun(path, argv, c.env)
+		return ""
+	}
+	for fd := 0; fd < 3; fd++ {
+		p := ev.port(fd)
+		if p == nil || p.f == nil || int(p.f.Fd()) == fd {
+			continue
+		}
+		if err := syscall.Dup2(int(p.f.Fd()), fd); err != nil {
+			return err.Error()
+		}
+	}
+	// syscall.Exec only returns on failure.
+	return syscall.Exec(path, argv, ev.env.exportWith(c.env)).Error()
+}
+
+// spawn runs an external command like an ordinary form does, but takes the
+// same options as exec, e.g.
+//
+// spawn -a vi LC_ALL=C /usr/bin/vim file
+//
+// With -b before the other options, the command runs in the background;
+// its pid is put in $last-pid, and it can be waited for with wait.
+func spawn(ev *Evaluator, args []Value) string {
+	background := len(args) > 0 && args[0].String() == "-b"
+	if background {
+		args = args[1:]
+	}
+	c, err := ev.parseExternalArgs(args)
+	if err != nil {
+		return err.Error()
+	}
+	pid, err := ev.startExternal(c)
+	if err == errDryRun {
+		return ""
+	} else if err != nil {
+		return err.Error()
+	}
+	if background {
+		ev.procs.add(pid, c.argv)
+		ev.lastPid.Set(NewString(strconv.Itoa(pid)))
+		return ""
+	}
+	update := make(chan *StateUpdate)
+	exited := make(chan struct{})
+	go func() {
+		waitStateUpdate(pid, update)
+		close(exited)
+	}()
+	ev.killOnCancel(pid, exited)
+	msg := ""
+	for up := range update {
+		msg = up.Msg
+	}
+	return msg
+}
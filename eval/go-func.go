@@ -0,0 +1,202 @@
+package eval
+
+// Calling Go functions as commands. RegisterGoFunc wraps a Go function with
+// reflection, so that an API can be exposed with one call each, e.g.
+//
+//	eval.RegisterGoFunc("repeat", strings.Repeat)
+//
+// makes `repeat ab 3` output abab.
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+var (
+	valueType     = reflect.TypeOf((*Value)(nil)).Elem()
+	errorType     = reflect.TypeOf((*error)(nil)).Elem()
+	evaluatorType = reflect.TypeOf((*Evaluator)(nil))
+)
+
+// RegisterGoFunc registers a Go function as a builtin, like RegisterBuiltin.
+// The function may take an *Evaluator first, and then parameters of the
+// types below, the last of which may be variadic:
+//
+//	string, bool, the integer and floating-point types, Value
+//
+// Arguments are converted to them from their string forms, except for Value
+// parameters, which take the arguments as they are. The builtin fails if an
+// argument can't be converted or there is a wrong number of them.
+//
+// The function may return values of the same types, and of slices of them,
+// which are output as lists. A last return value of type error makes the
+// builtin fail when it is not nil, and is not output.
+func RegisterGoFunc(name string, f interface{}) error {
+	b, err := wrapGoFunc(name, f)
+	if err != nil {
+		return err
+	}
+	return RegisterBuiltin(name, b)
+}
+
+func wrapGoFunc(name string, f interface{}) (Builtin, error) {
+	fv := reflect.ValueOf(f)
+	ft := fv.Type()
+	if ft.Kind() != reflect.Func {
+		return Builtin{}, fmt.Errorf("%s: not a function, got %s", name, ft)
+	}
+
+	params := make([]reflect.Type, ft.NumIn())
+	for i := range params {
+		params[i] = ft.In(i)
+	}
+	takesEv := len(params) > 0 && params[0] == evaluatorType
+	if takesEv {
+		params = params[1:]
+	}
+	for i, p := range params {
+		if i == len(params)-1 && ft.IsVariadic() {
+			p = p.Elem()
+		}
+		if !convertible(p) {
+			return Builtin{}, fmt.Errorf("%s: unsupported parameter type %s", name, p)
+		}
+	}
+	nout := ft.NumOut()
+	returnsErr := nout > 0 && ft.Out(nout-1) == errorType
+	if returnsErr {
+		nout--
+	}
+	for i := 0; i < nout; i++ {
+		r := ft.Out(i)
+		if r.Kind() == reflect.Slice {
+			r = r.Elem()
+		}
+		if !convertible(r) {
+			return Builtin{}, fmt.Errorf("%s: unsupported return type %s", name, ft.Out(i))
+		}
+	}
+
+	spec := &ArgSpec{Min: len(params), Max: len(params)}
+	if ft.IsVariadic() {
+		spec.Min, spec.Max = len(params)-1, -1
+	}
+
+	call := func(ev *Evaluator, args []Value) string {
+		in := make([]reflect.Value, 0, len(args)+1)
+		if takesEv {
+			in = append(in, reflect.ValueOf(ev))
+		}
+		for i, a := range args {
+			var p reflect.Type
+			if ft.IsVariadic() && i >= len(params)-1 {
+				p = params[len(params)-1].Elem()
+			} else {
+				p = params[i]
+			}
+			v, err := fromValue(a, p)
+			if err != nil {
+				return fmt.Sprintf("argument %d of %s: %s", i+1, name, err)
+			}
+			in = append(in, v)
+		}
+
+		out := fv.Call(in)
+		if returnsErr {
+			if err, _ := out[nout].Interface().(error); err != nil {
+				return err.Error()
+			}
+		}
+		for _, r := range out[:nout] {
+			ev.Put(toValue(r))
+		}
+		return ""
+	}
+	return Builtin{Fn: call, Args: spec, Output: ValueOutput}, nil
+}
+
+// convertible returns whether values of a Go type can be converted from and
+// to Values.
+func convertible(t reflect.Type) bool {
+	if t == valueType {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+var errNotBool = errors.New("must be true or false")
+
+// fromValue converts a Value to a Go value of a convertible type.
+func fromValue(v Value, t reflect.Type) (reflect.Value, error) {
+	if t == valueType {
+		return reflect.ValueOf(&v).Elem(), nil
+	}
+	s := v.String()
+	rv := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.String:
+		rv.SetString(s)
+	case reflect.Bool:
+		if s != "true" && s != "false" {
+			return rv, errNotBool
+		}
+		rv.SetBool(s == "true")
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 0, t.Bits())
+		if err != nil {
+			return rv, fmt.Errorf("bad integer %s", v.Repr())
+		}
+		rv.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(s, 0, t.Bits())
+		if err != nil {
+			return rv, fmt.Errorf("bad unsigned integer %s", v.Repr())
+		}
+		rv.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, t.Bits())
+		if err != nil {
+			return rv, fmt.Errorf("bad number %s", v.Repr())
+		}
+		rv.SetFloat(f)
+	}
+	return rv, nil
+}
+
+// toValue converts a Go value of a convertible type, or a slice of them, to
+// a Value.
+func toValue(rv reflect.Value) Value {
+	if rv.Type() == valueType {
+		if rv.IsNil() {
+			return NewString("")
+		}
+		return rv.Interface().(Value)
+	}
+	switch rv.Kind() {
+	case reflect.Slice:
+		t := NewTable()
+		for i := 0; i < rv.Len(); i++ {
+			t.append(toValue(rv.Index(i)))
+		}
+		return t
+	case reflect.String:
+		return NewString(rv.String())
+	case reflect.Bool:
+		return boolValue(rv.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return NewString(strconv.FormatInt(rv.Int(), 10))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return NewString(strconv.FormatUint(rv.Uint(), 10))
+	default:
+		return NewString(strconv.FormatFloat(rv.Float(), 'g', -1, rv.Type().Bits()))
+	}
+}
@@ -0,0 +1,73 @@
+package eval
+
+// Checksum builtins. Without arguments, they output the hexadecimal digest of
+// their byte input as a string; with file names, they output a table for each
+// file instead, e.g.
+//
+// ~> print hello | hash:md5
+// ▶ 5d41402abc4b2a76b9719d911017c592
+// ~> hash:sha256 a.tar b.tar
+// ▶ [&file=a.tar &sha256=...]
+// ▶ [&file=b.tar &sha256=...]
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+)
+
+func init() {
+	// Needed to avoid initialization loop
+	builtinFuncs["hash:md5"] = builtinFunc{hasher("md5", md5.New), [2]StreamType{fdStream, chanStream}}
+	builtinFuncs["hash:sha1"] = builtinFunc{hasher("sha1", sha1.New), [2]StreamType{fdStream, chanStream}}
+	builtinFuncs["hash:sha256"] = builtinFunc{hasher("sha256", sha256.New), [2]StreamType{fdStream, chanStream}}
+}
+
+// hasher makes a checksum builtin with the hash made by newHash, whose name
+// is the key of the digest in the tables for files.
+func hasher(name string, newHash func() hash.Hash) builtinFuncImpl {
+	return func(ev *Evaluator, args []Value) string {
+		out := ev.ports[1]
+		if len(args) == 0 {
+			digest, err := digestOf(ev.ports[0].f, newHash())
+			if err != nil {
+				return err.Error()
+			}
+			out.put(NewString(digest))
+			return ""
+		}
+		for _, a := range args {
+			digest, err := digestOfFile(a.String(), newHash())
+			if err != nil {
+				return err.Error()
+			}
+			t := NewTable()
+			t.put(NewString("file"), a)
+			t.put(NewString(name), NewString(digest))
+			if !out.put(t) {
+				return ""
+			}
+		}
+		return ""
+	}
+}
+
+func digestOf(r io.Reader, h hash.Hash) (string, error) {
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func digestOfFile(name string, h hash.Hash) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return digestOf(f, h)
+}
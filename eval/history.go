@@ -0,0 +1,115 @@
+package eval
+
+// The history policies and builtins. What is kept in the history of command
+// lines is decided by options:
+//
+// options[history-ignore-space] = true # lines starting with a space are not kept
+// options[history-ignore-dups] = true  # lines same as the last one are not kept
+// options[history-max-size] = 10000    # older lines are pruned; 0 keeps all
+// options[history-shared] = true       # lines of other sessions show up as they are run
+//
+// Entries can also be deleted, e.g. after pasting a secret by accident:
+//
+// history:del "password=.*" # ▶ 2, the number of entries deleted
+// history:prune 1000        # keeps only the newest 1000 entries
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+)
+
+var errNoHistory = errors.New("history not available")
+
+// HistoryStore is where the history of command lines is kept, typically by
+// elvishd and the editor.
+type HistoryStore interface {
+	// Del deletes the entries matching pattern, and returns how many there
+	// were.
+	Del(pattern *regexp.Regexp) (int, error)
+	// Prune deletes all but the newest max entries, and returns how many
+	// were deleted.
+	Prune(max int) (int, error)
+}
+
+// SetHistoryStore sets the history used by the history builtins. It must be
+// called before any code is evaluated.
+func (ev *Evaluator) SetHistoryStore(s HistoryStore) {
+	ev.history = s
+}
+
+// HistoryPolicy is what the history options are set to.
+type HistoryPolicy struct {
+	IgnoreSpace bool
+	IgnoreDups  bool
+	MaxSize     int // 0 if there is no limit.
+	Shared      bool
+}
+
+// HistoryPolicy returns the current history policy.
+func (ev *Evaluator) HistoryPolicy() HistoryPolicy {
+	flag := func(name string) bool {
+		v, _ := ev.options.Get(name)
+		return v != nil && v.String() == "true"
+	}
+	var p HistoryPolicy
+	p.IgnoreSpace = flag("history-ignore-space")
+	p.IgnoreDups = flag("history-ignore-dups")
+	p.Shared = flag("history-shared")
+	if v, ok := ev.options.Get("history-max-size"); ok {
+		p.MaxSize, _ = strconv.Atoi(v.String())
+	}
+	return p
+}
+
+// Keeps returns whether a line is to be added to the history after last, the
+// newest entry, if any.
+func (p HistoryPolicy) Keeps(line, last string) bool {
+	switch {
+	case line == "":
+		return false
+	case p.IgnoreSpace && line[0] == ' ':
+		return false
+	case p.IgnoreDups && line == last:
+		return false
+	}
+	return true
+}
+
+func historyDel(ev *Evaluator, args []Value) string {
+	if len(args) != 1 {
+		return "args error"
+	}
+	if ev.history == nil {
+		return errNoHistory.Error()
+	}
+	pattern, err := regexp.Compile(args[0].String())
+	if err != nil {
+		return err.Error()
+	}
+	n, err := ev.history.Del(pattern)
+	if err != nil {
+		return err.Error()
+	}
+	ev.ports[1].ch <- NewString(strconv.Itoa(n))
+	return ""
+}
+
+func historyPrune(ev *Evaluator, args []Value) string {
+	if len(args) != 1 {
+		return "args error"
+	}
+	if ev.history == nil {
+		return errNoHistory.Error()
+	}
+	max, err := strconv.Atoi(args[0].String())
+	if err != nil || max < 0 {
+		return "bad number of entries " + args[0].Repr()
+	}
+	n, err := ev.history.Prune(max)
+	if err != nil {
+		return err.Error()
+	}
+	ev.ports[1].ch <- NewString(strconv.Itoa(n))
+	return ""
+}
@@ -0,0 +1,46 @@
+package eval
+
+// Read-only variables describing the elvish process and the host it runs on:
+//
+// $ppid          the pid of the parent process
+// $uid, $gid     the user and group ids, -1 on Windows
+// $platform      [&os linux &arch amd64 &hostname box]
+// $args          the arguments to the script being run, a list
+//
+// Like $pid, they are set when the Evaluator is created, and elvish code
+// can't assign to them.
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+	"syscall"
+)
+
+func defineHostVars(g map[string]*Var) {
+	id := func(i int) Value { return NewString(strconv.Itoa(i)) }
+	g["ppid"] = newReadOnlyVar("ppid", id(syscall.Getppid()))
+	g["uid"] = newReadOnlyVar("uid", id(syscall.Getuid()))
+	g["gid"] = newReadOnlyVar("gid", id(syscall.Getgid()))
+
+	platform := NewTable()
+	platform.put(NewString("os"), NewString(runtime.GOOS))
+	platform.put(NewString("arch"), NewString(runtime.GOARCH))
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = ""
+	}
+	platform.put(NewString("hostname"), NewString(hostname))
+	g["platform"] = newReadOnlyVar("platform", platform)
+
+	g["args"] = newReadOnlyVar("args", NewTable())
+}
+
+// SetArgs sets $args, the arguments to the script being run.
+func (ev *Evaluator) SetArgs(args []string) {
+	t := NewTable()
+	for _, a := range args {
+		t.append(NewString(a))
+	}
+	ev.scope.get("args").Set(t)
+}
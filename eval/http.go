@@ -0,0 +1,132 @@
+package eval
+
+// The http: builtins, for talking to HTTP servers without curl.
+//
+// http:get url [headers]
+// http:post url [headers] [body]
+//
+// Headers are a table, like [&Authorization "Bearer "$token]. The body of a
+// post is a string or bytes argument, or else the input, so that values can
+// be posted as JSON:
+//
+// put [&name elvish] | to-json | http:post $url [&Content-Type application/json]
+//
+// The input is not read when it is a terminal, so that a post without a body
+// fails instead of waiting for one to be typed; http:post $url "" posts an
+// empty body. Requests taking longer than httpTimeout fail.
+//
+// The response is output as a table of the status code, the headers, whose
+// values are joined with commas when repeated, and the body, e.g.
+//
+// [&status 200 &headers [&Content-Type application/json] &body "{...}\n"]
+//
+// A body that is not valid UTF-8 is bytes. Responses with error codes are
+// output too; only failing to talk to the server is an error. JSON responses
+// can be read with from-json:
+//
+// put (http:get $url)[body] | from-json
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const httpTimeout = 30 * time.Second
+
+var httpClient = &http.Client{Timeout: httpTimeout}
+
+func httpGetFn(ev *Evaluator, args []Value) string {
+	if len(args) != 1 && len(args) != 2 {
+		return "args error"
+	}
+	return ev.httpRequest("GET", args[0].String(), args[1:], nil)
+}
+
+func httpPostFn(ev *Evaluator, args []Value) string {
+	if len(args) == 0 {
+		return "args error"
+	}
+	url, args := args[0].String(), args[1:]
+	var body io.Reader
+	if n := len(args); n > 0 {
+		switch a := args[n-1].(type) {
+		case *String:
+			body = strings.NewReader(string(*a))
+			args = args[:n-1]
+		case *Bytes:
+			body = bytes.NewReader(*a)
+			args = args[:n-1]
+		}
+	}
+	if len(args) > 1 {
+		return "args error"
+	}
+	if body == nil {
+		in := ev.port(0)
+		if in == nil || in.f == nil || isTerminal(in.f) {
+			return "http:post needs a body argument or piped input"
+		}
+		body = in.f
+	}
+	return ev.httpRequest("POST", url, args, body)
+}
+
+// httpRequest makes a request with the headers in args, if any, and outputs
+// the response.
+func (ev *Evaluator) httpRequest(method, url string, args []Value, body io.Reader) string {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err.Error()
+	}
+	if len(args) == 1 {
+		headers, ok := args[0].(*Table)
+		if !ok || len(headers.List) > 0 {
+			return fmt.Sprintf("headers must be a table with only a dict part, got %s", args[0].Repr())
+		}
+		for _, k := range headers.Keys() {
+			req.Header.Set(k.String(), headers.Dict[k].String())
+		}
+	}
+	if ev.cancel != nil {
+		req = req.WithContext(ev.cancel.ctx)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		ev.checkCanceled()
+		return err.Error()
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		ev.checkCanceled()
+		return err.Error()
+	}
+
+	headers := NewTable()
+	var names []string
+	for name := range resp.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		headers.put(NewString(name), NewString(strings.Join(resp.Header[name], ", ")))
+	}
+	t := NewTable()
+	t.put(NewString("status"), NewString(strconv.Itoa(resp.StatusCode)))
+	t.put(NewString("headers"), headers)
+	if utf8.Valid(data) {
+		t.put(NewString("body"), NewString(string(data)))
+	} else {
+		t.put(NewString("body"), NewBytes(data))
+	}
+	ev.ports[1].ch <- t
+	return ""
+}
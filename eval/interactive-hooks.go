@@ -0,0 +1,60 @@
+package eval
+
+// Hooks run around each command read interactively, kept as lists of
+// closures in global variables, e.g.
+//
+// before-readline = [{ print "\033]0;"$pwd"\007" }]
+// after-command = [$@after-command {|c| if (> $c[duration] 10) { notify-send $c[src] } }]
+//
+// The closures of $before-readline are called without arguments before the
+// prompt of each command is shown, and those of $after-command are called
+// after each command with a table of what it was:
+//
+// [&src <text> &duration <seconds> &status <$status>]
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// BeforeReadline calls the closures in $before-readline.
+func (ev *Evaluator) BeforeReadline() {
+	ev.runHooks("before-readline")
+}
+
+// AfterCommand calls the closures in $after-command with the text of a
+// command that has just been evaluated and how long it took.
+func (ev *Evaluator) AfterCommand(text string, duration time.Duration) {
+	info := NewTable()
+	info.put(NewString("src"), NewString(text))
+	info.put(NewString("duration"), NewString(strconv.FormatFloat(duration.Seconds(), 'f', -1, 64)))
+	info.put(NewString("status"), ev.status.Get())
+	ev.runHooks("after-command", info)
+}
+
+// runHooks calls each closure in the list in the global variable name with
+// args, in order. Failed hooks and elements that are not closures are
+// reported on stderr and do not stop the rest.
+func (ev *Evaluator) runHooks(name string, args ...Value) {
+	v, ok := ev.scope.lookup(name)
+	if !ok {
+		return
+	}
+	t, ok := v.Get().(*Table)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "$%s must be a list of closures, got %s\n", name, v.Get().Repr())
+		return
+	}
+	for _, h := range t.List {
+		c, ok := h.(*Closure)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "%s hook must be a closure, got %s\n", name, h.Repr())
+			continue
+		}
+		if msg := ev.callClosure(c, hookArgs(name, c, args)); msg != "" {
+			fmt.Fprintf(os.Stderr, "%s hook: %s\n", name, msg)
+		}
+	}
+}
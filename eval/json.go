@@ -0,0 +1,207 @@
+package eval
+
+// JSON serialization of values.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Values are serialized to JSON by implementing json.Marshaler. A string
+// becomes a JSON string, a table with only a list part becomes an array, and
+// any other table becomes an object; so does an Env. Bytes become a base64
+// string. Since there is no JSON counterpart of a table with both list and
+// dict parts, of a closure, and of values standing for resources or for
+// synchronization, like files and mutexes, they cannot be serialized.
+var (
+	_ json.Marshaler = (*String)(nil)
+	_ json.Marshaler = (*Table)(nil)
+	_ json.Marshaler = (*Env)(nil)
+	_ json.Marshaler = (*Closure)(nil)
+	_ json.Marshaler = (*Bytes)(nil)
+	_ json.Marshaler = (*File)(nil)
+	_ json.Marshaler = (*Listener)(nil)
+	_ json.Marshaler = (*Chan)(nil)
+	_ json.Marshaler = (*Mutex)(nil)
+	_ json.Marshaler = (*Once)(nil)
+)
+
+var (
+	errMixedTable     = errors.New("cannot serialize table with both list and dict parts")
+	errJSONClosure    = errors.New("cannot serialize closure")
+	errUnserializable = errors.New("unserializable value")
+	errJSONNotValue   = errors.New("not a value")
+)
+
+func (s *String) MarshalJSON() ([]byte, error) {
+	return json.Marshal(string(*s))
+}
+
+func (t *Table) MarshalJSON() ([]byte, error) {
+	if len(t.Dict) == 0 {
+		if t.List == nil {
+			return []byte("[]"), nil
+		}
+		return json.Marshal(t.List)
+	}
+	if len(t.List) > 0 {
+		return nil, errMixedTable
+	}
+	// Written by hand rather than from a map, so that keys keep their order
+	buf := new(bytes.Buffer)
+	buf.WriteByte('{')
+	for i, k := range t.Keys() {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(k.String())
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(t.Dict[k])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func (e *Env) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.all())
+}
+
+func (c *Closure) MarshalJSON() ([]byte, error) {
+	return nil, errJSONClosure
+}
+
+func (f *File) MarshalJSON() ([]byte, error) {
+	return nil, errUnserializable
+}
+
+func (l *Listener) MarshalJSON() ([]byte, error) {
+	return nil, errUnserializable
+}
+
+func (c *Chan) MarshalJSON() ([]byte, error) {
+	return nil, errUnserializable
+}
+
+func (m *Mutex) MarshalJSON() ([]byte, error) {
+	return nil, errUnserializable
+}
+
+func (o *Once) MarshalJSON() ([]byte, error) {
+	return nil, errUnserializable
+}
+
+// decodeJSON decodes the next JSON value from dec, which must have UseNumber
+// set, into a Value. Numbers keep their original text, booleans become "true"
+// and "false", and null becomes an empty string. Keys of objects keep their
+// order. It returns io.EOF when there is no more input.
+func decodeJSON(dec *json.Decoder) (Value, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok := tok.(type) {
+	case string:
+		return NewString(tok), nil
+	case json.Number:
+		return NewString(tok.String()), nil
+	case bool:
+		return NewString(fmt.Sprint(tok)), nil
+	case nil:
+		return NewString(""), nil
+	case json.Delim:
+		t := NewTable()
+		for dec.More() {
+			if tok == '{' {
+				k, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				v, err := decodeJSON(dec)
+				if err != nil {
+					return nil, unexpectedEOF(err)
+				}
+				t.put(NewString(k.(string)), v)
+			} else {
+				v, err := decodeJSON(dec)
+				if err != nil {
+					return nil, unexpectedEOF(err)
+				}
+				t.append(v)
+			}
+		}
+		// Consume the closing delimiter
+		if _, err := dec.Token(); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		return t, nil
+	default:
+		return nil, errJSONNotValue
+	}
+}
+
+// unexpectedEOF turns io.EOF, which is only expected between values, into
+// io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// toJSON writes each value from the input channel to the output as JSON, one
+// value per line, e.g.
+//
+// put [&name elvish] | to-json | curl -d @- ...
+func toJSON(ev *Evaluator, args []Value) string {
+	if len(args) > 0 {
+		return "args error"
+	}
+	in := ev.ports[0].ch
+	enc := json.NewEncoder(ev.ports[1].f)
+
+	msg := ""
+	for v := range in {
+		if msg != "" {
+			// Keep draining the input so that upstream doesn't block.
+			continue
+		}
+		if err := enc.Encode(v); err != nil {
+			msg = err.Error()
+		}
+	}
+	return msg
+}
+
+// fromJSONFn reads a stream of JSON values from the input and writes the
+// corresponding values to the output channel, e.g.
+//
+// curl ... | from-json | each {|v| put $v[name]}
+func fromJSONFn(ev *Evaluator, args []Value) string {
+	if len(args) > 0 {
+		return "args error"
+	}
+	dec := json.NewDecoder(ev.ports[0].f)
+	dec.UseNumber()
+	out := ev.ports[1].ch
+
+	for {
+		value, err := decodeJSON(dec)
+		if err == io.EOF {
+			return ""
+		} else if err != nil {
+			return err.Error()
+		}
+		out <- value
+	}
+}
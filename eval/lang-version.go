@@ -0,0 +1,122 @@
+package eval
+
+// Versions of the language, i.e. its special forms and builtins. Code can
+// declare the version it was written for, e.g.
+//
+// shell:lang-version 1
+//
+// after which, until the end of the enclosing closure, or for the rest of the
+// session at the top level, commands removed in later versions can still be
+// used, and those added later are not special. Commands deprecated in the
+// version targeted still compile, with a warning at each use. Code that
+// declares no version targets the current one, which is
+// $buildinfo[lang-version].
+//
+// While the config API versions of api-version.go keep rc files working when
+// options and hooks change, language versions do the same for changes to the
+// language itself.
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/xiaq/elvish/parse"
+	"github.com/xiaq/elvish/util"
+)
+
+// currentLangVersion is the version of the language. It is bumped whenever a
+// command is added or removed in a way that changes the meaning of existing
+// code, and the change is then recorded below.
+var currentLangVersion = 1
+
+// langChange records that a command, which is a builtin special or function,
+// was added in version since, or removed in version until. A zero bound is
+// no bound.
+type langChange struct {
+	since, until int
+}
+
+// langChanges maps the names of commands to their changes.
+var langChanges = map[string]langChange{}
+
+// deprecation records that a command has been deprecated since a version, in
+// favor of another way of doing what it does.
+type deprecation struct {
+	since   int
+	instead string
+}
+
+// deprecations maps the names of deprecated commands.
+var deprecations = map[string]deprecation{}
+
+// langVersion returns the language version targeted by the code being
+// compiled.
+func (cp *Compiler) langVersion() int {
+	if v := cp.opts().langVersion; v != 0 {
+		return v
+	}
+	return currentLangVersion
+}
+
+// SetLangVersion sets the language version targeted by the code compiled from
+// now on, as if shell:lang-version were used at the top level.
+func (cp *Compiler) SetLangVersion(version int) error {
+	if version < 1 || version > currentLangVersion {
+		return fmt.Errorf("bad language version %d, must be from 1 to %d", version, currentLangVersion)
+	}
+	cp.options.langVersion = version
+	return nil
+}
+
+// inLangVersion returns whether a builtin is part of the language version
+// targeted by the code being compiled.
+func (cp *Compiler) inLangVersion(name string) bool {
+	c, ok := langChanges[name]
+	if !ok {
+		return true
+	}
+	v := cp.langVersion()
+	return v >= c.since && (c.until == 0 || v < c.until)
+}
+
+// checkDeprecated warns about the use of a command deprecated in the
+// language version targeted.
+func (cp *Compiler) checkDeprecated(name string, n parse.Node) {
+	if d, ok := deprecations[name]; ok && cp.langVersion() >= d.since {
+		cp.warnf(n, "%s is deprecated; %s", name, d.instead)
+	}
+}
+
+// warnf records a warning about the code being compiled, which still
+// compiles.
+func (cp *Compiler) warnf(n parse.Node, format string, args ...interface{}) {
+	cp.warnings = append(cp.warnings,
+		util.NewContextualError(cp.name, cp.text, int(n.Position()), format, args...))
+}
+
+// Warnings returns the warnings from the last compilation, like uses of
+// deprecated commands.
+func (cp *Compiler) Warnings() []*util.ContextualError {
+	return cp.warnings
+}
+
+// compileLangVersion compiles a shell:lang-version special form. Like
+// set-option, it takes effect when compiled, until the end of the enclosing
+// closure.
+func compileLangVersion(cp *Compiler, fn *parse.FormNode) strOp {
+	args := fn.Args.Nodes
+	if len(args) != 1 {
+		cp.errorf(fn, "shell:lang-version form must be `shell:lang-version version`")
+	}
+	version, err := strconv.Atoi(keyword(args[0]))
+	if err != nil || version < 1 {
+		cp.errorf(args[0], "bad language version")
+	}
+	if version > currentLangVersion {
+		cp.errorf(args[0], "language version %d is newer than that of this elvish, %d", version, currentLangVersion)
+	}
+	cp.opts().langVersion = version
+	return func(ev *Evaluator) string {
+		return ""
+	}
+}
@@ -0,0 +1,79 @@
+package eval
+
+// Recalling the output of the last chunk evaluated at the top level, like a
+// line typed interactively. When $options[last-output] is not 0, the stdout
+// of the chunk is kept in $last-output, so that it can be reused without
+// running the command again:
+//
+// options[last-output] = 65536
+// ls -l
+// echo $last-output | grep elv
+//
+// At most $options[last-output] bytes are kept; values are kept as the lines
+// they are written as. While the option is not 0, stdout passes through a
+// pipe, so like with TeeSessionLog, commands may notice that their output is
+// not a tty.
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// lastOutput is an io.Writer keeping what is written during the evaluation
+// of a chunk, up to a maximum size.
+type lastOutput struct {
+	mutex     sync.Mutex
+	teed      bool // Whether stdout is teed to it.
+	max       int
+	cur, last []byte
+}
+
+func (lo *lastOutput) Write(p []byte) (int, error) {
+	lo.mutex.Lock()
+	defer lo.mutex.Unlock()
+	if n := lo.max - len(lo.cur); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		lo.cur = append(lo.cur, p[:n]...)
+	}
+	return len(p), nil
+}
+
+// next makes the output kept so far the last output, and starts keeping that
+// of another chunk, at most max bytes of it.
+func (lo *lastOutput) next(max int) {
+	lo.mutex.Lock()
+	defer lo.mutex.Unlock()
+	lo.last, lo.cur, lo.max = lo.cur, nil, max
+}
+
+// variable returns $last-output.
+func (lo *lastOutput) variable() *Var {
+	v := newReadOnlyVar("last-output", nil)
+	v.get = func() Value {
+		lo.mutex.Lock()
+		defer lo.mutex.Unlock()
+		return NewString(string(lo.last))
+	}
+	return v
+}
+
+// startLastOutput is called before a chunk is evaluated at the top level.
+func (ev *Evaluator) startLastOutput() {
+	lo := ev.lastOutput
+	max := int(atomic.LoadInt32(&ev.options.lastOutput))
+	switch {
+	case max > 0 && !lo.teed:
+		if err := ev.teeOutput(1, lo); err != nil {
+			fmt.Fprintln(os.Stderr, "Cannot keep the last output:", err)
+		}
+		lo.teed = true
+	case max == 0 && lo.teed:
+		ev.unteeOutput(1, lo)
+		lo.teed = false
+	}
+	lo.next(max)
+}
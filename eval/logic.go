@@ -0,0 +1,137 @@
+package eval
+
+// The and, or, not and coalesce special forms.
+
+import "github.com/xiaq/elvish/parse"
+
+// The forms evaluate their arguments one at a time, from left to right, and
+// stop as soon as the result is known, so that later arguments, including
+// output captures in them, are not evaluated at all, e.g.
+//
+// and (fs:is-dir $d) (fs:exists $d/rc.elv)
+//
+// An argument that is a closure is called without arguments, and is true if
+// the last pipeline in it succeeds; the string false is false; any other
+// value is true. The result is output as true or false, and the forms
+// themselves always succeed.
+
+// truth evaluates an argument of a logical form.
+func (ev *Evaluator) truth(tn *parse.TermNode, op valuesOp) bool {
+	return ev.truthOf(ev.asSingleValue(tn, op.f(ev), "logical argument"))
+}
+
+// truthOf determines whether a value is true, calling it if it is a closure.
+func (ev *Evaluator) truthOf(v Value) bool {
+	if c, ok := v.(*Closure); ok {
+		msg, status := ev.callClosureStatus(c, nil)
+		// Closures have no exit value of their own, so the status of their
+		// last pipeline is used.
+		return msg == "" && statusOk(status)
+	}
+	s, ok := v.(*String)
+	return !ok || string(*s) != "false"
+}
+
+// compileCondition compiles an argument of a logical form with errexit off, so
+// that a pipeline failing in a closure used as a condition makes it false
+// instead of stopping the evaluation, like in the conditions of set -e of
+// POSIX shells.
+func (cp *Compiler) compileCondition(tn *parse.TermNode) valuesOp {
+	errexit := cp.opts().errexit
+	cp.opts().errexit = false
+	// Compiling a closure pushes scopes, which may move the options.
+	defer func() { cp.opts().errexit = errexit }()
+	return cp.compileTerm(tn)
+}
+
+func boolValue(b bool) Value {
+	if b {
+		return NewString("true")
+	}
+	return NewString("false")
+}
+
+// compileShortCircuit compiles an and or an or special form. The evaluation
+// stops at the first argument whose truth is stopAt, which is also the
+// result; if there is no such argument, the result is !stopAt.
+func compileShortCircuit(cp *Compiler, fn *parse.FormNode, stopAt bool) strOp {
+	args := fn.Args.Nodes
+	ops := make([]valuesOp, len(args))
+	for i, tn := range args {
+		ops[i] = cp.compileCondition(tn)
+	}
+	return func(ev *Evaluator) string {
+		result := !stopAt
+		for i, tn := range args {
+			if ev.truth(tn, ops[i]) == stopAt {
+				result = stopAt
+				break
+			}
+		}
+		ev.ports[1].ch <- boolValue(result)
+		return ""
+	}
+}
+
+// compileAnd compiles an and special form, which outputs true when all its
+// arguments are true, and true when there are none.
+func compileAnd(cp *Compiler, fn *parse.FormNode) strOp {
+	return compileShortCircuit(cp, fn, false)
+}
+
+// compileOr compiles an or special form, which outputs true when any of its
+// arguments is true, and false when there are none.
+func compileOr(cp *Compiler, fn *parse.FormNode) strOp {
+	return compileShortCircuit(cp, fn, true)
+}
+
+// compileNot compiles a not special form, which outputs the negation of its
+// only argument.
+func compileNot(cp *Compiler, fn *parse.FormNode) strOp {
+	args := fn.Args.Nodes
+	if len(args) != 1 {
+		cp.errorf(fn, "not form must be `not value`")
+	}
+	op := cp.compileCondition(args[0])
+	return func(ev *Evaluator) string {
+		ev.ports[1].ch <- boolValue(!ev.truth(args[0], op))
+		return ""
+	}
+}
+
+// compileCoalesce compiles a coalesce special form, which outputs the values
+// of the first argument that is not the empty string, e.g.
+//
+// coalesce $editor $visual vi
+//
+// Nothing is output if all the arguments are empty.
+func compileCoalesce(cp *Compiler, fn *parse.FormNode) strOp {
+	args := fn.Args.Nodes
+	ops := make([]valuesOp, len(args))
+	for i, tn := range args {
+		ops[i] = cp.compileTerm(tn)
+	}
+	return func(ev *Evaluator) string {
+		out := ev.ports[1].ch
+		for _, op := range ops {
+			vs := op.f(ev)
+			if isEmpty(vs) {
+				continue
+			}
+			for _, v := range vs {
+				out <- v
+			}
+			break
+		}
+		return ""
+	}
+}
+
+// isEmpty determines whether vs is nothing or a single empty string.
+func isEmpty(vs []Value) bool {
+	if len(vs) == 0 {
+		return true
+	}
+	s, ok := vs[0].(*String)
+	return len(vs) == 1 && ok && *s == ""
+}
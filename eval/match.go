@@ -0,0 +1,347 @@
+package eval
+
+// The match special form.
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+
+	"github.com/xiaq/elvish/parse"
+)
+
+// matchCase is one case of a match or case special form. For literal cases,
+// match is nil and the case is found by looking up the literal.
+type matchCase struct {
+	match func(ev *Evaluator, v Value) ([]Value, bool)
+	body  valuesOp
+}
+
+// matchTable dispatches a value to the first matching case. Literal cases are
+// looked up in a map, so that only the non-literal cases preceding it need to
+// be tried.
+type matchTable struct {
+	cases       []matchCase
+	literals    map[string]int
+	nonLiterals []int
+}
+
+func newMatchTable() *matchTable {
+	return &matchTable{literals: make(map[string]int)}
+}
+
+func (mt *matchTable) addLiteral(literal string, body valuesOp) {
+	if _, ok := mt.literals[literal]; !ok {
+		mt.literals[literal] = len(mt.cases)
+	}
+	mt.cases = append(mt.cases, matchCase{nil, body})
+}
+
+func (mt *matchTable) add(match func(*Evaluator, Value) ([]Value, bool), body valuesOp) {
+	mt.nonLiterals = append(mt.nonLiterals, len(mt.cases))
+	mt.cases = append(mt.cases, matchCase{match, body})
+}
+
+// run calls the body of the first case matching v with the variables bound by
+// the pattern, and returns its status. If no case matches, nothing is done.
+func (mt *matchTable) run(ev *Evaluator, v Value) string {
+	call := func(i int, args []Value) string {
+		c := mt.cases[i].body.f(ev)[0].(*Closure)
+		return ev.callClosure(c, args)
+	}
+
+	lit := len(mt.cases)
+	if s, ok := v.(*String); ok {
+		if i, ok := mt.literals[string(*s)]; ok {
+			lit = i
+		}
+	}
+	for _, i := range mt.nonLiterals {
+		if i > lit {
+			break
+		}
+		if args, ok := mt.cases[i].match(ev, v); ok {
+			return call(i, args)
+		}
+	}
+	if lit < len(mt.cases) {
+		return call(lit, nil)
+	}
+	return ""
+}
+
+// compileMatchBlock compiles the block of a match or case special form, which
+// consists of cases of the form `pattern... => { body }`. For each case,
+// compilePatterns is called with the patterns, and returns the names of the
+// variables bound by them.
+func (cp *Compiler) compileMatchBlock(block *parse.ClosureNode, compilePatterns func([]*parse.TermNode) (names []string, rest string, add func(valuesOp))) {
+	for _, pn := range block.Chunk.Nodes {
+		if len(pn.Nodes) != 1 {
+			cp.errorf(pn, "case must be `pattern => { body }`")
+		}
+		cn := pn.Nodes[0]
+		terms := append([]*parse.TermNode{cn.Command}, cn.Args.Nodes...)
+		n := len(terms)
+		if n < 3 || keyword(terms[n-2]) != "=>" ||
+			len(terms[n-1].Nodes) != 1 || terms[n-1].Nodes[0].Typ != parse.ClosureFactor {
+			cp.errorf(cn, "case must be `pattern => { body }`")
+		}
+		body := terms[n-1].Nodes[0].Node.(*parse.ClosureNode)
+		if body.ArgNames != nil && len(body.ArgNames.Nodes) > 0 {
+			cp.errorf(terms[n-1], "case body must not take arguments")
+		}
+
+		names, rest, add := compilePatterns(terms[:n-2])
+		bop, _, _ := cp.compileClosureBody(body, names, rest)
+		add(bop)
+	}
+}
+
+// compileMatch compiles a match special form:
+//
+//	match $v {
+//	    foo => { echo literal foo }
+//	    type:table => { echo a table }
+//	    {a @rest} => { echo list starting with $a }
+//	    [&name n] => { echo dict with name $n }
+//	    glob:*.go => { echo Go source }
+//	    re:`^(?P<major>[0-9]+)\.` => { echo major version $major }
+//	    _ => { echo anything else }
+//	}
+//
+// The first matching case is chosen, and its body is called with the
+// variables bound by the pattern.
+func compileMatch(cp *Compiler, fn *parse.FormNode) strOp {
+	args := fn.Args.Nodes
+	if len(args) != 2 || len(args[1].Nodes) != 1 || args[1].Nodes[0].Typ != parse.ClosureFactor {
+		cp.errorf(fn, "match form must be `match value { pattern => { body } ... }`")
+	}
+	vop := cp.compileTerm(args[0])
+	mt := newMatchTable()
+	cp.compileMatchBlock(args[1].Nodes[0].Node.(*parse.ClosureNode),
+		func(patterns []*parse.TermNode) ([]string, string, func(valuesOp)) {
+			if len(patterns) != 1 {
+				cp.errorf(patterns[1], "match case must have exactly one pattern")
+			}
+			match, names, rest, literal, isLiteral := cp.compileMatchPattern(patterns[0])
+			return names, rest, func(body valuesOp) {
+				if isLiteral {
+					mt.addLiteral(literal, body)
+				} else {
+					mt.add(match, body)
+				}
+			}
+		})
+
+	return func(ev *Evaluator) string {
+		return mt.run(ev, ev.asSingleValue(args[0], vop.f(ev), "match value"))
+	}
+}
+
+// compileCase compiles a case special form, which matches a string against
+// glob patterns like the case command of sh:
+//
+//	case (uname) {
+//	    Linux => { echo linux }
+//	    *BSD Darwin => { echo bsd }
+//	    * => { echo unknown }
+//	}
+//
+// A case may have several patterns. Patterns without metacharacters, and
+// quoted patterns, are matched literally.
+func compileCase(cp *Compiler, fn *parse.FormNode) strOp {
+	args := fn.Args.Nodes
+	if len(args) != 2 || len(args[1].Nodes) != 1 || args[1].Nodes[0].Typ != parse.ClosureFactor {
+		cp.errorf(fn, "case form must be `case value { pattern... => { body } ... }`")
+	}
+	vop := cp.compileTerm(args[0])
+	mt := newMatchTable()
+	cp.compileMatchBlock(args[1].Nodes[0].Node.(*parse.ClosureNode),
+		func(patterns []*parse.TermNode) ([]string, string, func(valuesOp)) {
+			var adds []func(valuesOp)
+			for _, tn := range patterns {
+				text, bare, ok := constantText(tn)
+				if !ok {
+					cp.errorf(tn, "pattern must be a string literal")
+				}
+				if !bare || !hasGlobMeta(text) {
+					adds = append(adds, func(body valuesOp) {
+						mt.addLiteral(text, body)
+					})
+					continue
+				}
+				m, err := compileGlob(text)
+				if err != nil {
+					cp.errorf(tn, "bad glob: %s", err)
+				}
+				adds = append(adds, func(body valuesOp) {
+					mt.add(func(ev *Evaluator, v Value) ([]Value, bool) {
+						s, ok := v.(*String)
+						return nil, ok && m(string(*s))
+					}, body)
+				})
+			}
+			return nil, "", func(body valuesOp) {
+				for _, add := range adds {
+					add(body)
+				}
+			}
+		})
+
+	return func(ev *Evaluator) string {
+		return mt.run(ev, ev.asSingleValue(args[0], vop.f(ev), "case value"))
+	}
+}
+
+// compileMatchPattern compiles the pattern of a match case. It returns the
+// function testing the pattern, and the names of the variables bound by it.
+// If the pattern is a literal, isLiteral is true and match is nil.
+func (cp *Compiler) compileMatchPattern(tn *parse.TermNode) (match func(*Evaluator, Value) ([]Value, bool), names []string, rest string, literal string, isLiteral bool) {
+	if isPattern(tn) {
+		p := cp.compilePattern(tn)
+		match = func(ev *Evaluator, v Value) ([]Value, bool) {
+			vs, rest, msg := ev.matchPattern(p, v)
+			if msg != "" {
+				return nil, false
+			}
+			return append(append([]Value{}, vs...), rest...), true
+		}
+		return match, p.names, p.rest, "", false
+	}
+
+	text, bare, ok := constantText(tn)
+	if !ok {
+		cp.errorf(tn, "pattern must be a string literal, list or dict pattern")
+	}
+	if !bare {
+		return nil, nil, "", text, true
+	}
+
+	switch {
+	case text == "_":
+		match = func(*Evaluator, Value) ([]Value, bool) {
+			return nil, true
+		}
+	case strings.HasPrefix(text, "type:"):
+		t := typenames[text[len("type:"):]]
+		if t == nil {
+			cp.errorf(tn, "unknown type %s", text[len("type:"):])
+		}
+		match = func(ev *Evaluator, v Value) ([]Value, bool) {
+			return nil, assignable(t, v.Type())
+		}
+	case strings.HasPrefix(text, "glob:"):
+		m, err := compileGlob(text[len("glob:"):])
+		if err != nil {
+			cp.errorf(tn, "bad glob: %s", err)
+		}
+		match = func(ev *Evaluator, v Value) ([]Value, bool) {
+			s, ok := v.(*String)
+			return nil, ok && m(string(*s))
+		}
+	case strings.HasPrefix(text, "re:"):
+		re, err := regexp.Compile(text[len("re:"):])
+		if err != nil {
+			cp.errorf(tn, "bad regexp: %s", err)
+		}
+		var groups []int
+		for i, name := range re.SubexpNames() {
+			if name != "" {
+				groups = append(groups, i)
+				names = append(names, name)
+			}
+		}
+		match = func(ev *Evaluator, v Value) ([]Value, bool) {
+			s, ok := v.(*String)
+			if !ok {
+				return nil, false
+			}
+			m := re.FindStringSubmatch(string(*s))
+			if m == nil {
+				return nil, false
+			}
+			vs := make([]Value, len(groups))
+			for i, g := range groups {
+				vs[i] = NewString(m[g])
+			}
+			return vs, true
+		}
+	default:
+		return nil, nil, "", text, true
+	}
+	return match, names, "", "", false
+}
+
+// constantText returns the text of a term consisting only of string literals,
+// or ok = false if it is not such a term. bare is true if the first literal is
+// a bare string, in which case the prefixes of match patterns are recognized.
+func constantText(tn *parse.TermNode) (text string, bare, ok bool) {
+	buf := new(bytes.Buffer)
+	for _, f := range tn.Nodes {
+		if f.Typ != parse.StringFactor {
+			return "", false, false
+		}
+		buf.WriteString(f.Node.(*parse.StringNode).Text)
+	}
+	return buf.String(), len(tn.Nodes) > 0 && isBareString(tn.Nodes[0]), true
+}
+
+// hasGlobMeta determines whether a glob pattern contains any metacharacter.
+func hasGlobMeta(glob string) bool {
+	return strings.ContainsAny(glob, "*?[")
+}
+
+// compileGlob compiles a glob pattern into a function matching strings
+// against it. The common forms `*suffix` and `prefix*` are matched with plain
+// string comparisons; other patterns are converted to regular expressions.
+// Unlike filename globbing, `*` and `?` also match `/`.
+func compileGlob(glob string) (func(string) bool, error) {
+	n := len(glob)
+	switch {
+	case !hasGlobMeta(glob):
+		return func(s string) bool { return s == glob }, nil
+	case glob[0] == '*' && !hasGlobMeta(glob[1:]):
+		suffix := glob[1:]
+		return func(s string) bool { return strings.HasSuffix(s, suffix) }, nil
+	case glob[n-1] == '*' && !hasGlobMeta(glob[:n-1]):
+		prefix := glob[:n-1]
+		return func(s string) bool { return strings.HasPrefix(s, prefix) }, nil
+	}
+	re, err := regexp.Compile(globToRegexp(glob))
+	if err != nil {
+		return nil, err
+	}
+	return re.MatchString, nil
+}
+
+// globToRegexp converts a glob pattern to an anchored regular expression.
+// The metacharacters are `*` for any string, `?` for any character and
+// `[...]` for a character class, negated when starting with `!`.
+func globToRegexp(glob string) string {
+	buf := new(bytes.Buffer)
+	buf.WriteRune('^')
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			buf.WriteString(".*")
+		case '?':
+			buf.WriteRune('.')
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end <= 0 {
+				buf.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			buf.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	buf.WriteRune('$')
+	return buf.String()
+}
@@ -0,0 +1,121 @@
+package eval
+
+// Numeric comparisons and the math: builtins.
+
+import (
+	"math"
+	"strconv"
+)
+
+// The comparisons <, <=, >, >= and == output whether each pair of adjacent
+// arguments compares as numbers, so that they can be chained, e.g.
+//
+// < 1 $x 10 # whether $x is between 1 and 10
+//
+// Unlike eq, == compares numbers, so that == 1 1.0 outputs true. != takes
+// exactly two arguments.
+
+func compareFn(cmp func(a, b float64) bool) builtinFuncImpl {
+	return func(ev *Evaluator, args []Value) string {
+		if len(args) < 2 {
+			return "args error"
+		}
+		nums, err := toFloats(args)
+		if err != nil {
+			return err.Error()
+		}
+		result := true
+		for i := 1; i < len(nums); i++ {
+			if !cmp(nums[i-1], nums[i]) {
+				result = false
+				break
+			}
+		}
+		ev.ports[1].ch <- boolValue(result)
+		return ""
+	}
+}
+
+var (
+	lt    = compareFn(func(a, b float64) bool { return a < b })
+	le    = compareFn(func(a, b float64) bool { return a <= b })
+	gt    = compareFn(func(a, b float64) bool { return a > b })
+	ge    = compareFn(func(a, b float64) bool { return a >= b })
+	numEq = compareFn(func(a, b float64) bool { return a == b })
+)
+
+func numNotEq(ev *Evaluator, args []Value) string {
+	if len(args) != 2 {
+		return "args error"
+	}
+	nums, err := toFloats(args)
+	if err != nil {
+		return err.Error()
+	}
+	ev.ports[1].ch <- boolValue(nums[0] != nums[1])
+	return ""
+}
+
+// outputNum outputs a number resulting from a math: builtin. Results that are
+// NaN or infinities, like that of math:sqrt -1, are errors, since no builtin
+// accepts them.
+func outputNum(ev *Evaluator, f float64) string {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "result is not a number"
+	}
+	ev.ports[1].ch <- NewString(strconv.FormatFloat(f, 'g', -1, 64))
+	return ""
+}
+
+// mathFn makes a math: builtin of a function of one number, like math:floor.
+func mathFn(f func(float64) float64) builtinFuncImpl {
+	return func(ev *Evaluator, args []Value) string {
+		if len(args) != 1 {
+			return "args error"
+		}
+		x, err := toFloat(args[0])
+		if err != nil {
+			return err.Error()
+		}
+		return outputNum(ev, f(x))
+	}
+}
+
+// mathFn2 makes a math: builtin of a function of two numbers, like math:pow.
+func mathFn2(f func(float64, float64) float64) builtinFuncImpl {
+	return func(ev *Evaluator, args []Value) string {
+		if len(args) != 2 {
+			return "args error"
+		}
+		nums, err := toFloats(args)
+		if err != nil {
+			return err.Error()
+		}
+		return outputNum(ev, f(nums[0], nums[1]))
+	}
+}
+
+// mathMin and mathMax output the smallest and largest of their arguments, of
+// which there must be at least one.
+func mathMin(ev *Evaluator, args []Value) string {
+	return mathFold(ev, args, math.Min)
+}
+
+func mathMax(ev *Evaluator, args []Value) string {
+	return mathFold(ev, args, math.Max)
+}
+
+func mathFold(ev *Evaluator, args []Value, f func(float64, float64) float64) string {
+	if len(args) == 0 {
+		return "not enough args"
+	}
+	nums, err := toFloats(args)
+	if err != nil {
+		return err.Error()
+	}
+	result := nums[0]
+	for _, x := range nums[1:] {
+		result = f(result, x)
+	}
+	return outputNum(ev, result)
+}
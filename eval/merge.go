@@ -0,0 +1,245 @@
+package eval
+
+// The merge and patch builtins.
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	errMergeArgs = errors.New("usage: merge [&deep] table...")
+	errPatchArgs = errors.New("usage: patch table operations")
+)
+
+// copyTable returns a shallow copy of t.
+func copyTable(t *Table) *Table {
+	nt := &Table{List: append([]Value(nil), t.List...), Dict: make(map[Value]Value, len(t.Dict))}
+	for _, k := range t.Keys() {
+		nt.put(k, t.Dict[k])
+	}
+	return nt
+}
+
+// mergeTables merges b into a copy of a. Keys of the dict part of b override
+// those of a, and the list part of b, if not empty, replaces that of a. When
+// deep is true, values under a key of both tables that are both tables are
+// merged recursively instead of overridden.
+func mergeTables(a, b *Table, deep bool) *Table {
+	t := copyTable(a)
+	if len(b.List) > 0 {
+		t.List = append([]Value(nil), b.List...)
+	}
+	for _, k := range b.Keys() {
+		v := b.Dict[k]
+		if old, ok := t.lookup(k.String()); ok && deep {
+			ot, ok1 := old.(*Table)
+			vt, ok2 := v.(*Table)
+			if ok1 && ok2 {
+				v = mergeTables(ot, vt, true)
+			}
+		}
+		t.put(k, v)
+	}
+	return t
+}
+
+// merge outputs the merge of tables, with later tables taking precedence,
+// e.g.
+//
+// merge &deep $defaults $overrides
+//
+// Without &deep, nested tables are replaced as a whole.
+func merge(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	deep, args := optionArg(args, "deep")
+	if err := checkOptionArgs(args); err != nil {
+		return err.Error()
+	}
+	if len(args) == 0 {
+		return errMergeArgs.Error()
+	}
+	t := NewTable()
+	for _, a := range args {
+		at, ok := a.(*Table)
+		if !ok {
+			return errMergeArgs.Error()
+		}
+		t = mergeTables(t, at, deep)
+	}
+	out <- t
+	return ""
+}
+
+// parsePointer parses a JSON pointer (RFC 6901) like /a/0/b into its
+// reference tokens.
+func parsePointer(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if s[0] != '/' {
+		return nil, fmt.Errorf("bad path %q: must start with /", s)
+	}
+	tokens := strings.Split(s[1:], "/")
+	for i, tok := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(tok, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// lookupPointer finds the value at the path in v.
+func lookupPointer(v Value, path []string) (Value, error) {
+	for _, tok := range path {
+		t, ok := v.(*Table)
+		if !ok {
+			return nil, fmt.Errorf("cannot index %s", v.Repr())
+		}
+		var err error
+		v, err = t.getIndex(NewString(tok))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// updatePointer calls f with a copy of the table containing the last element
+// of path, and returns a copy of v with the copy in place. Tables not on path
+// are shared with v. path must not be empty.
+func updatePointer(v Value, path []string, f func(t *Table, tok string) error) (Value, error) {
+	t, ok := v.(*Table)
+	if !ok {
+		return nil, fmt.Errorf("cannot index %s", v.Repr())
+	}
+	t = copyTable(t)
+	if len(path) == 1 {
+		return t, f(t, path[0])
+	}
+	idx := NewString(path[0])
+	child, err := t.getIndex(idx)
+	if err != nil {
+		return nil, err
+	}
+	child, err = updatePointer(child, path[1:], f)
+	if err != nil {
+		return nil, err
+	}
+	return t, t.setIndex(idx, child)
+}
+
+// applyPatchOp applies one operation of a JSON patch (RFC 6902), like
+// [&op add &path /a/b &value x], to v. The operations are add, remove,
+// replace and test. For the list part of tables, indices are used in paths,
+// and the index - in an add operation means appending.
+func applyPatchOp(v Value, op *Table) (Value, error) {
+	name, ok := op.lookup("op")
+	if !ok {
+		return nil, errors.New("patch operation without op")
+	}
+	p, ok := op.lookup("path")
+	if !ok {
+		return nil, errors.New("patch operation without path")
+	}
+	path, err := parsePointer(p.String())
+	if err != nil {
+		return nil, err
+	}
+	value, hasValue := op.lookup("value")
+
+	switch name.String() {
+	case "add", "replace", "test":
+		if !hasValue {
+			return nil, fmt.Errorf("%s operation without value", name.String())
+		}
+	case "remove":
+	default:
+		return nil, fmt.Errorf("unknown patch operation %s", name.String())
+	}
+
+	if name.String() == "test" {
+		old, err := lookupPointer(v, path)
+		if err != nil {
+			return nil, err
+		}
+		if old.Repr() != value.Repr() {
+			return nil, fmt.Errorf("test failed: %s is %s, not %s", p.String(), old.Repr(), value.Repr())
+		}
+		return v, nil
+	}
+	if len(path) == 0 {
+		if name.String() == "remove" {
+			return nil, errors.New("cannot remove the whole value")
+		}
+		return value, nil
+	}
+
+	return updatePointer(v, path, func(t *Table, tok string) error {
+		i, isIndex := listIndex(NewString(tok))
+		key, inDict := t.dictKey(NewString(tok))
+		switch name.String() {
+		case "add":
+			switch {
+			case tok == "-":
+				t.List = append(t.List, value)
+			case isIndex:
+				if i > len(t.List) {
+					return fmt.Errorf("index out of range: %s", tok)
+				}
+				t.List = append(t.List[:i], append([]Value{value}, t.List[i:]...)...)
+			default:
+				return t.setIndex(NewString(tok), value)
+			}
+		case "replace":
+			if !isIndex && !inDict {
+				return fmt.Errorf("no such key: %s", tok)
+			}
+			return t.setIndex(NewString(tok), value)
+		case "remove":
+			switch {
+			case isIndex:
+				if i >= len(t.List) {
+					return fmt.Errorf("index out of range: %s", tok)
+				}
+				t.List = append(t.List[:i], t.List[i+1:]...)
+			case inDict:
+				t.remove(key)
+			default:
+				return fmt.Errorf("no such key: %s", tok)
+			}
+		}
+		return nil
+	})
+}
+
+// patch outputs a table with a JSON patch applied, given as a list of
+// operations, e.g.
+//
+// patch $config [[&op replace &path /server/port &value 8080]]
+//
+// The table itself is not modified. Operations are applied in order, and
+// nothing is output if any of them fails.
+func patch(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	if len(args) != 2 {
+		return errPatchArgs.Error()
+	}
+	ops, ok := args[1].(*Table)
+	if !ok {
+		return errPatchArgs.Error()
+	}
+	v := args[0]
+	for i, op := range ops.List {
+		opt, ok := op.(*Table)
+		if !ok {
+			return fmt.Sprintf("patch operation %d is not a table", i)
+		}
+		var err error
+		v, err = applyPatchOp(v, opt)
+		if err != nil {
+			return fmt.Sprintf("patch operation %d: %s", i, err)
+		}
+	}
+	out <- v
+	return ""
+}
@@ -0,0 +1,48 @@
+package eval
+
+// Native modules, namespaces of builtin functions provided by Go code that is
+// linked into elvish or loaded as a plugin.
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// modules also guards the registry of builtins. Since load-module adds
+// builtins at run time, while code may be compiled or commands resolved in
+// the background, the registry is only read with the read lock held; see
+// lookupBuiltin.
+var modules = struct {
+	sync.RWMutex
+	names map[string]bool
+}{names: make(map[string]bool)}
+
+// RegisterModule adds the functions in fns as builtins in the namespace name,
+// so that fns["query"] is called as name:query. The functions output values,
+// and don't use their input. RegisterModule is typically called from the init
+// function of a package linked into elvish, or of a plugin; it must be called
+// before any code using the module is compiled.
+//
+// It is an error to register a namespace that already has builtins.
+func RegisterModule(name string, fns map[string]func(*Evaluator, []Value) string) error {
+	if name == "" || strings.ContainsAny(name, ": \t\n") {
+		return fmt.Errorf("bad module name %q", name)
+	}
+	modules.Lock()
+	defer modules.Unlock()
+	prefix := name + ":"
+	if modules.names[name] {
+		return fmt.Errorf("module %s already registered", name)
+	}
+	for fname := range builtinFuncs {
+		if strings.HasPrefix(fname, prefix) {
+			return fmt.Errorf("namespace %s is taken by builtins", name)
+		}
+	}
+	modules.names[name] = true
+	for fname, fn := range fns {
+		addBuiltin(prefix+fname, Builtin{Fn: fn, Output: ValueOutput})
+	}
+	return nil
+}
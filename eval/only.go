@@ -0,0 +1,75 @@
+package eval
+
+// The only-bytes and only-values builtins.
+
+import (
+	"io"
+	"io/ioutil"
+)
+
+// Both builtins take input of either kind, and output only one kind: the
+// input of the other kind is read and dropped. They make a pipeline mixing
+// external commands and builtins outputting values compile whichever way the
+// stages are put together, with what gets through made explicit, e.g.
+//
+// put (range 3 | only-bytes)
+//
+// outputs nothing, while
+//
+// put (echo a | only-bytes)
+//
+// outputs a.
+
+// discardInput reads the input of ev to the end and drops it.
+func discardInput(ev *Evaluator) error {
+	in := ev.ports[0]
+	switch {
+	case in == nil:
+	case in.f != nil:
+		_, err := io.Copy(ioutil.Discard, in.f)
+		return err
+	case in.ch != nil:
+		for range in.ch {
+		}
+	}
+	return nil
+}
+
+// onlyBytes passes bytes from its input to its output, and drops values.
+func onlyBytes(ev *Evaluator, args []Value) string {
+	if len(args) != 0 {
+		return "args error"
+	}
+	in := ev.ports[0]
+	if in == nil || in.f == nil {
+		if err := discardInput(ev); err != nil {
+			return err.Error()
+		}
+		return ""
+	}
+	if _, err := io.Copy(ev.ports[1].f, in.f); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// onlyValues passes values from its input to its output, and drops bytes.
+func onlyValues(ev *Evaluator, args []Value) string {
+	if len(args) != 0 {
+		return "args error"
+	}
+	in := ev.ports[0]
+	if in == nil || in.ch == nil {
+		if err := discardInput(ev); err != nil {
+			return err.Error()
+		}
+		return ""
+	}
+	out := ev.ports[1]
+	for v := range in.ch {
+		if !out.put(v) {
+			break
+		}
+	}
+	return ""
+}
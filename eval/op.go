@@ -1,10 +1,16 @@
 package eval
 
 import (
-	"fmt"
+	"bufio"
+	"bytes"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/xiaq/elvish/parse"
+	"github.com/xiaq/elvish/util"
 )
 
 // Definition of Op and friends and combinators.
@@ -12,10 +18,36 @@ import (
 // Op operates on an Evaluator.
 type Op func(*Evaluator)
 
-// valuesOp operates on an Evaluator and results in some values.
+// valuesOp operates on an Evaluator and results in some values. If constant
+// is true, f always results in the same values, and doesn't use the
+// Evaluator, so that it may be called at compile time with a nil Evaluator.
 type valuesOp struct {
-	ts []Type
-	f  func(*Evaluator) []Value
+	ts       []Type
+	f        func(*Evaluator) []Value
+	constant bool
+}
+
+// allConstant determines whether all of ops are constant.
+func allConstant(ops []valuesOp) bool {
+	for _, op := range ops {
+		if !op.constant {
+			return false
+		}
+	}
+	return true
+}
+
+// allStrings determines whether all the values of the constant ops are
+// Strings.
+func allStrings(ops []valuesOp) bool {
+	for _, op := range ops {
+		for _, v := range op.f(nil) {
+			if _, ok := v.(*String); !ok {
+				return false
+			}
+		}
+	}
+	return true
 }
 
 // portOp operates on an Evaluator and results in a port.
@@ -25,10 +57,21 @@ type portOp func(*Evaluator) *port
 // of StateUpdate's.
 type stateUpdatesOp func(*Evaluator) <-chan *StateUpdate
 
+// combineChunk combines the pipelines of a top-level chunk. The exit values
+// of each pipeline are put in $status and passed to the statusCb of the
+// Evaluator. The relays of the Evaluator are drained after each pipeline, so
+// that output relayed through different pipes, like the stdout and stderr
+// copied to the session log, keeps the order of the pipelines.
 func combineChunk(ops []valuesOp) Op {
 	return func(ev *Evaluator) {
 		for _, op := range ops {
 			s := op.f(ev)
+			ev.drainRelays()
+			if ev.status != nil {
+				t := NewTable()
+				t.append(s...)
+				ev.status.Set(t)
+			}
 			if ev.statusCb != nil {
 				ev.statusCb(s)
 			}
@@ -36,21 +79,41 @@ func combineChunk(ops []valuesOp) Op {
 	}
 }
 
-func combineClosure(ops []valuesOp, enclosed map[string]Type, bounds [2]StreamType) valuesOp {
-	op := combineChunk(ops)
-	// BUG(xiaq): Closure arguments is (again) not supported
-	ts := []Type{&ClosureType{bounds}}
+// combineBody combines the pipelines of the body of a closure. The exit
+// values of each pipeline are kept in ev.bodyStatus, and put in the $status
+// of the closure, if it has one; see closureEvaluator. The global $status is
+// left alone, since closures may run concurrently in the forms of a pipeline;
+// it is set when the pipeline ends.
+func combineBody(ops []valuesOp) Op {
+	return func(ev *Evaluator) {
+		for _, op := range ops {
+			ev.bodyStatus = op.f(ev)
+			if ev.status != nil {
+				t := NewTable()
+				t.append(ev.bodyStatus...)
+				ev.status.Set(t)
+			}
+		}
+	}
+}
+
+func combineClosure(argNames []string, restArg string, ops []valuesOp, enclosed map[string]Type, bounds [2]StreamType, apiVersion int) valuesOp {
+	op := combineBody(ops)
+	ts := []Type{ClosureType{bounds}}
 	f := func(ev *Evaluator) []Value {
-		enclosed := make(map[string]*Value, len(enclosed))
+		captured := make(map[string]*Var, len(enclosed))
 		for name := range enclosed {
-			enclosed[name] = ev.scope[name]
+			captured[name] = ev.scope.get(name)
 		}
-		return []Value{NewClosure(nil, op, enclosed, bounds)}
+		c := NewClosure(argNames, restArg, op, captured, bounds)
+		c.srcName, c.srcText = ev.name, ev.text
+		c.apiVersion = apiVersion
+		return []Value{c}
 	}
-	return valuesOp{ts, f}
+	return valuesOp{ts: ts, f: f}
 }
 
-func combinePipeline(n parse.Node, ops []stateUpdatesOp, bounds [2]StreamType, internals []StreamType) valuesOp {
+func combinePipeline(n *parse.PipelineNode, ops []stateUpdatesOp, bounds [2]StreamType, internals []StreamType) valuesOp {
 	ts := make([]Type, len(ops))
 	for i := 0; i < len(ops); i++ {
 		ts[i] = &StringType{}
@@ -60,21 +123,35 @@ func combinePipeline(n parse.Node, ops []stateUpdatesOp, bounds [2]StreamType, i
 		if !ev.ports[0].compatible(bounds[0]) {
 			ev.errorfNode(n, "pipeline input not satisfiable")
 		}
-		if !ev.ports[1].compatible(bounds[1]) {
+		out := ev.ports[1]
+		if !out.compatible(bounds[1]) && !out.adaptable(bounds[1]) {
 			ev.errorfNode(n, "pipeline output not satisfiable")
 		}
+		// Set up the Evaluators and pipes of all forms first, so that a
+		// failure to create a pipe doesn't leave any form running.
+		newEvs := make([]*Evaluator, len(ops))
+		started := false
+		defer func() {
+			if started {
+				return
+			}
+			for _, newEv := range newEvs {
+				if newEv != nil {
+					newEv.releasePorts()
+				}
+			}
+		}()
 		var nextIn *port
-		updates := make([]<-chan *StateUpdate, len(ops))
-		// For each form, create a dedicated Evaluator and run
-		for i, op := range ops {
-			newEv := ev.copy(fmt.Sprintf("<form op %v>", op), false)
+		for i := range ops {
+			newEv := ev.copy()
+			newEvs[i] = newEv
 			if i > 0 {
-				newEv.ports[0] = nextIn
+				newEv.setPort(0, nextIn)
 			}
 			if i < len(ops)-1 {
 				switch internals[i] {
 				case unusedStream:
-					newEv.ports[1] = nil
+					newEv.setPort(1, nil)
 					nextIn = nil
 				case fdStream:
 					// os.Pipe sets O_CLOEXEC, which is what we want.
@@ -82,61 +159,140 @@ func combinePipeline(n parse.Node, ops []stateUpdatesOp, bounds [2]StreamType, i
 					if e != nil {
 						ev.errorfNode(n, "failed to create pipe: %s", e)
 					}
-					newEv.ports[1] = &port{f: writer, shouldClose: true}
-					nextIn = &port{f: reader, shouldClose: true}
+					newEv.setPort(1, newFilePort(writer))
+					nextIn = newFilePort(reader)
 				case chanStream:
-					// TODO Buffered channel?
-					ch := make(chan Value)
-					// Only the writer closes the channel port
-					newEv.ports[1] = &port{ch: ch, shouldClose: true}
-					nextIn = &port{ch: ch}
+					w, r := newChanPipe()
+					newEv.setPort(1, w)
+					nextIn = r
+				case fdToChanStream, chanToFdStream:
+					w, r, e := adaptedPipe(internals[i])
+					if e != nil {
+						ev.errorfNode(n, "failed to create pipe: %s", e)
+					}
+					newEv.setPort(1, w)
+					nextIn = r
 				default:
 					panic("bad StreamType value")
 				}
 			}
-			updates[i] = op(newEv)
 		}
-		// Collect exit values
+		var adapted <-chan struct{}
+		if !out.compatible(bounds[1]) {
+			var e error
+			adapted, e = newEvs[len(ops)-1].adaptOutput(out, bounds[1])
+			if e != nil {
+				ev.errorfNode(n, "failed to create pipe: %s", e)
+			}
+		}
+		started = true
+
+		// Run each form in its own goroutine and collect exit values. The
+		// references of each Evaluator are released as soon as its form has
+		// started, so that a pipe is closed when its writer is done, and
+		// the neighbors of a form that fails to start still terminate.
 		exits := make([]Value, len(ops))
-		for i, update := range updates {
-			for up := range update {
-				exits[i] = NewString(up.Msg)
+		errs := make([]error, len(ops))
+		var wg sync.WaitGroup
+		wg.Add(len(ops))
+		for i, op := range ops {
+			go func(i int, op stateUpdatesOp, newEv *Evaluator) {
+				defer wg.Done()
+				if p := newEv.profiler; p != nil {
+					defer p.record(newEv.name, newEv.text, n.Nodes[i].Pos, time.Now())
+				}
+				if c := newEv.coverage; c != nil {
+					c.record(newEv.name, newEv.text, n.Nodes[i])
+				}
+				var update <-chan *StateUpdate
+				errs[i] = func() (err error) {
+					defer util.Recover(&err)
+					defer newEv.releasePorts()
+					// Panics in this goroutine don't reach Evaluator.eval.
+					defer newEv.recoverCrash()
+					update = op(newEv)
+					return nil
+				}()
+				if errs[i] != nil {
+					exits[i] = thrownStatus
+					return
+				}
+				for up := range update {
+					if up.Thrown {
+						exits[i] = thrownStatus
+					} else {
+						exits[i] = NewString(up.Msg)
+					}
+				}
+			}(i, op, newEvs[i])
+		}
+		wg.Wait()
+		if adapted != nil {
+			<-adapted
+		}
+		for _, err := range errs {
+			if err != nil {
+				util.Panic(err)
 			}
 		}
 		return exits
 	}
-	return valuesOp{ts, f}
+	return valuesOp{ts: ts, f: f}
 }
 
 func combineForm(n parse.Node, cmd valuesOp, tlist valuesOp, ports []portOp, a *formAnnotation) stateUpdatesOp {
 	return func(ev *Evaluator) <-chan *StateUpdate {
 		// XXX Currently it's guaranteed that cmd evaluates into a single
 		// Value.
+		ev.push(n)
+		defer ev.pop()
+		ev.checkCanceled()
+		if ev.debugger != nil {
+			ev.debugStop(n)
+		}
+
 		cmd := cmd.f(ev)[0]
 		cmdStr := cmd.String()
 		fm := &form{
 			name: cmdStr,
+			node: n,
+		}
+		if a.commandType == commandClosure {
+			fm.name = "<closure>"
 		}
 		if tlist.f != nil {
 			fm.args = tlist.f(ev)
 		}
+		if (a.xtrace || ev.tracing()) && a.commandType != commandBuiltinSpecial {
+			ev.printXtrace(fm, a.commandType == commandClosure)
+		}
 
 		switch a.commandType {
 		case commandBuiltinFunction:
+			ev.checkRestrictedFunc(n, cmdStr, fm.args)
 			fm.Command.Func = a.builtinFunc.fn
 		case commandBuiltinSpecial:
 			fm.Command.Special = a.specialOp
 		case commandDefinedFunction:
-			v, ok1 := ev.scope["fn-"+cmdStr]
-			fn, ok2 := (*v).(*Closure)
-			if !(ok1 && ok2) {
+			// The function may have been removed since the form was
+			// compiled, e.g. by shell:reload.
+			v, ok := ev.scope.lookup("fn-" + cmdStr)
+			if !ok {
+				ev.errorfNode(n, "function %s has been removed", cmdStr)
+			}
+			fn, ok := v.Get().(*Closure)
+			if !ok {
 				panic("Compiler bug")
 			}
 			fm.Command.Closure = fn
 		case commandClosure:
 			fm.Command.Closure = cmd.(*Closure)
 		case commandExternal:
+			ev.checkRestricted(n, cmdStr, runningExternals)
 			path, e := ev.search(cmdStr)
+			if e != nil {
+				path, e = ev.commandNotFound(cmdStr, fm.args, e)
+			}
 			if e != nil {
 				ev.errorfNode(n, "%s", e)
 			}
@@ -145,12 +301,11 @@ func combineForm(n parse.Node, cmd valuesOp, tlist valuesOp, ports []portOp, a *
 			panic("bad commandType value")
 		}
 
-		newEv := ev.copy(fmt.Sprintf("<form redir %v>", fm), true)
-		newEv.growPorts(len(ports))
-
+		newEv := ev.copy()
+		defer newEv.releasePorts()
 		for i, op := range ports {
 			if op != nil {
-				newEv.ports[i] = op(ev)
+				newEv.setPort(i, op(ev))
 			}
 		}
 
@@ -159,6 +314,10 @@ func combineForm(n parse.Node, cmd valuesOp, tlist valuesOp, ports []portOp, a *
 }
 
 func combineTermList(ops []valuesOp) valuesOp {
+	ops = fuseConstants(ops)
+	if len(ops) == 1 {
+		return ops[0]
+	}
 	ts := make([]Type, 0, len(ops))
 	for _, op := range ops {
 		ts = append(ts, op.ts...)
@@ -172,11 +331,59 @@ func combineTermList(ops []valuesOp) valuesOp {
 		}
 		return vs
 	}
-	return valuesOp{ts, f}
+	return valuesOp{ts: ts, f: f}
+}
+
+// fuseConstants replaces each run of consecutive constant ops with a single
+// op, so that a list of literal words is not assembled again at every run.
+func fuseConstants(ops []valuesOp) []valuesOp {
+	var fused []valuesOp
+	for i := 0; i < len(ops); {
+		if !ops[i].constant {
+			fused = append(fused, ops[i])
+			i++
+			continue
+		}
+		var vs []Value
+		for ; i < len(ops) && ops[i].constant; i++ {
+			vs = append(vs, ops[i].f(nil)...)
+		}
+		fused = append(fused, literalValue(vs...))
+	}
+	return fused
+}
+
+// combineInterpolation combines the parts of a double-quoted string with
+// interpolations into one string. Unlike in a term, a part evaluating to
+// several values contributes their string forms joined by spaces.
+func combineInterpolation(ops []valuesOp) valuesOp {
+	f := func(ev *Evaluator) []Value {
+		buf := new(bytes.Buffer)
+		for _, op := range ops {
+			for i, v := range op.f(ev) {
+				if i > 0 {
+					buf.WriteRune(' ')
+				}
+				buf.WriteString(v.String())
+			}
+		}
+		return []Value{NewString(buf.String())}
+	}
+	if allConstant(ops) {
+		return literalValue(f(nil)...)
+	}
+	return valuesOp{ts: []Type{StringType{}}, f: f}
 }
 
+// combineTerm combines the factors of a term by juxtaposition. If a factor
+// evaluates to one value, each value accumulated so far is careted with it,
+// so that a string followed by a string is concatenated, a table followed by
+// a string becomes the string form of the table concatenated with it, and a
+// table followed by a single-element list is indexed. If a factor evaluates
+// to several values, like a list {a b} or a splice $@li, the cartesian
+// product is formed instead. Use str:cat to always get one string.
 func combineTerm(ops []valuesOp) valuesOp {
-	ts := ops[0].ts
+	ts := append([]Type(nil), ops[0].ts...)
 	for _, op := range ops[1:] {
 		rs := op.ts
 		if len(rs) == 1 {
@@ -197,7 +404,9 @@ func combineTerm(ops []valuesOp) valuesOp {
 	}
 
 	f := func(ev *Evaluator) []Value {
-		vs := ops[0].f(ev)
+		// The values are replaced in place; copy them so that the slice of a
+		// literal, which is evaluated again by loops, is not modified.
+		vs := append([]Value(nil), ops[0].f(ev)...)
 		for _, op := range ops[1:] {
 			us := op.f(ev)
 			if len(us) == 1 {
@@ -218,7 +427,11 @@ func combineTerm(ops []valuesOp) valuesOp {
 		}
 		return vs
 	}
-	return valuesOp{ts, f}
+	if allConstant(ops) && allStrings(ops) {
+		// Careting Strings never fails, so the term can be evaluated now.
+		return literalValue(f(nil)...)
+	}
+	return valuesOp{ts: ts, f: f}
 }
 
 func literalValue(v ...Value) valuesOp {
@@ -229,23 +442,65 @@ func literalValue(v ...Value) valuesOp {
 	f := func(e *Evaluator) []Value {
 		return v
 	}
-	return valuesOp{ts, f}
+	return valuesOp{ts: ts, f: f, constant: true}
 }
 
 func makeString(text string) valuesOp {
 	return literalValue(NewString(text))
 }
 
-func makeVar(cp *Compiler, name string, fn *parse.FactorNode) valuesOp {
+func makeVar(cp *Compiler, name string, fn *parse.FactorNode, maybe bool) valuesOp {
 	ts := []Type{cp.resolveVar(name, fn)}
+	nounset := cp.opts().nounset
 	f := func(ev *Evaluator) []Value {
-		val, ok := ev.scope[name]
+		v, ok := ev.scope.lookup(name)
 		if !ok {
-			panic("Compiler bug")
+			ev.errorfNode(fn, "variable $%s has been removed", name)
+		}
+		val, set := v.getIfSet()
+		if !set && nounset {
+			if maybe {
+				return []Value{NewString("")}
+			}
+			ev.errorfNode(fn, "variable $%s is unset", name)
 		}
-		return []Value{*val}
+		return []Value{val}
 	}
-	return valuesOp{ts, f}
+	return valuesOp{ts: ts, f: f}
+}
+
+func makeSplice(cp *Compiler, name string, fn *parse.FactorNode, maybe bool) valuesOp {
+	t := cp.resolveVar(name, fn)
+	switch t.(type) {
+	case TableType, AnyType:
+	default:
+		cp.errorf(fn, "only tables can be spliced")
+	}
+	// XXX Wrong type; ts should be variadic
+	ts := []Type{}
+	nounset := cp.opts().nounset
+	f := func(ev *Evaluator) []Value {
+		v, ok := ev.scope.lookup(name)
+		if !ok {
+			ev.errorfNode(fn, "variable $%s has been removed", name)
+		}
+		val, set := v.getIfSet()
+		if !set && nounset {
+			if maybe {
+				return nil
+			}
+			ev.errorfNode(fn, "variable $%s is unset", name)
+		}
+		t, ok := val.(*Table)
+		if !ok {
+			ev.errorfNode(fn, "only tables can be spliced, got %s", val.Repr())
+		}
+		// Copy the list, since the result may be modified by combineTerm
+		vs := make([]Value, len(t.List))
+		copy(vs, t.List)
+		return vs
+	}
+	return valuesOp{ts: ts, f: f}
 }
 
 func combineTable(n parse.Node, list valuesOp, keys []valuesOp, values []valuesOp) valuesOp {
@@ -261,12 +516,12 @@ func combineTable(n parse.Node, list valuesOp, keys []valuesOp, values []valuesO
 				ev.errorfNode(n, "Number of keys doesn't match number of values: %d vs. %d", len(ks), len(vs))
 			}
 			for j, k := range ks {
-				t.Dict[k] = vs[j]
+				t.put(k, vs[j])
 			}
 		}
 		return []Value{t}
 	}
-	return valuesOp{ts, f}
+	return valuesOp{ts: ts, f: f}
 }
 
 func combineOutputCapture(op valuesOp, bounds [2]StreamType) valuesOp {
@@ -274,18 +529,94 @@ func combineOutputCapture(op valuesOp, bounds [2]StreamType) valuesOp {
 	ts := []Type{}
 	f := func(ev *Evaluator) []Value {
 		vs := []Value{}
-		newEv := ev.copy(fmt.Sprintf("<output capture %v>", op), true)
-		newEv.ports = make([]*port, len(ev.ports))
-		copy(newEv.ports, ev.ports)
-		ch := make(chan Value)
-		newEv.ports[1] = &port{ch: ch}
-		go func() {
-			for v := range ch {
-				vs = append(vs, v)
+		newEv := ev.copy()
+		done := make(chan bool)
+		max, ok := ev.maxValues(), true
+		if bounds[1] == fdStream {
+			// Byte output is captured line by line.
+			reader, writer, e := os.Pipe()
+			if e != nil {
+				newEv.releasePorts()
+				ev.errorf("failed to create pipe: %s", e)
 			}
+			newEv.setPort(1, newFilePort(writer))
+			go func() {
+				buf := bufio.NewReader(reader)
+				for {
+					line, err := buf.ReadString('\n')
+					if line != "" {
+						if max > 0 && len(vs) >= max {
+							ok = false
+							break
+						}
+						vs = append(vs, NewString(strings.TrimSuffix(line, "\n")))
+					}
+					if err != nil {
+						break
+					}
+				}
+				reader.Close()
+				done <- true
+			}()
+		} else {
+			w, collected := newCollector(max)
+			newEv.setPort(1, w)
+			go func() {
+				var got []Value
+				got, ok = collected()
+				vs = append(vs, got...)
+				done <- true
+			}()
+		}
+		func() {
+			// The output port is closed when the last form writing to it
+			// is done, also when the capture fails.
+			defer func() { <-done }()
+			defer newEv.releasePorts()
+			op.f(newEv)
 		}()
-		op.f(newEv)
+		if !ok {
+			ev.errorf("%s", errTooManyValues)
+		}
 		return vs
 	}
-	return valuesOp{ts, f}
+	return valuesOp{ts: ts, f: f}
+}
+
+// combineProcessSubstitution returns an op for <(cmd), or >(cmd) if output is
+// true. The pipeline is run in the background with its output, or input, being
+// a pipe, and the op results in a /dev/fd path of the other end of the pipe,
+// which is added as a port of ev. The port number is the fd of the pipe in the
+// shell, so that the path works in both external commands and the shell,
+// e.g. as the target of a redirection.
+func combineProcessSubstitution(op valuesOp, output bool) valuesOp {
+	f := func(ev *Evaluator) []Value {
+		reader, writer, e := os.Pipe()
+		if e != nil {
+			ev.errorf("failed to create pipe: %s", e)
+		}
+		newEv := ev.copy()
+		mine := reader
+		if output {
+			mine = writer
+			newEv.setPort(0, newFilePort(reader))
+		} else {
+			newEv.setPort(1, newFilePort(writer))
+		}
+		fd := int(mine.Fd())
+		ev.setPort(fd, newFilePort(mine))
+		go func() {
+			err := func() (err error) {
+				defer util.Recover(&err)
+				defer newEv.releasePorts()
+				op.f(newEv)
+				return nil
+			}()
+			if err != nil {
+				printError(err)
+			}
+		}()
+		return []Value{NewString("/dev/fd/" + strconv.Itoa(fd))}
+	}
+	return valuesOp{ts: []Type{&StringType{}}, f: f}
 }
@@ -0,0 +1,86 @@
+package eval
+
+// Options of builtins, like the &deep of merge &deep $a $b. An option written
+// as &name is a value of its own, so that a builtin can tell it from a string
+// argument that only looks like one, like that of merge "&deep" $a. Its string
+// form is &name, which is what external commands get.
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type OptionArgType struct {
+}
+
+func (ot OptionArgType) Default() Value {
+	return NewOptionArg("")
+}
+
+func (ot OptionArgType) Caret(t Type) Type {
+	return StringType{}
+}
+
+// OptionArg is an option of a builtin written as &name.
+type OptionArg struct {
+	name string
+}
+
+func NewOptionArg(name string) *OptionArg {
+	return &OptionArg{name}
+}
+
+func (o *OptionArg) Type() Type {
+	return OptionArgType{}
+}
+
+func (o *OptionArg) Repr() string {
+	return "&" + o.name
+}
+
+func (o *OptionArg) String() string {
+	return "&" + o.name
+}
+
+// Caret concatenates the string forms, like that of String.
+func (o *OptionArg) Caret(ev *Evaluator, v Value) Value {
+	return NewString(o.String() + v.String())
+}
+
+func (o *OptionArg) Eq(v Value) bool {
+	o2, ok := v.(*OptionArg)
+	return ok && o.name == o2.name
+}
+
+func (o *OptionArg) Hash() uint32 {
+	return hashString(o.String())
+}
+
+// MarshalJSON serializes an OptionArg to its string form.
+func (o *OptionArg) MarshalJSON() ([]byte, error) {
+	return json.Marshal(o.String())
+}
+
+// optionArg determines whether the first of args is the option name, and
+// returns the arguments after it if it is.
+func optionArg(args []Value, name string) (bool, []Value) {
+	if len(args) > 0 {
+		if o, ok := args[0].(*OptionArg); ok && o.name == name {
+			return true, args[1:]
+		}
+	}
+	return false, args
+}
+
+// checkOptionArgs returns an error if any of args is an option. Builtins call
+// it with the arguments left after taking out the options they know with
+// optionArg, so that an unknown option, like the &all of fs:remove &all x, is
+// not taken for a string.
+func checkOptionArgs(args []Value) error {
+	for _, a := range args {
+		if o, ok := a.(*OptionArg); ok {
+			return fmt.Errorf("unknown option %s", o.Repr())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package eval
+
+// The registry of the options of an Evaluator, like $options[xtrace], that
+// change what it does when code runs. Unlike the shell options of set-option,
+// which change how code is compiled, they can be read and set at any time:
+//
+// options[xtrace] = true
+// echo $options[path-cache]
+// options[max-depth] = 100
+//
+// Each option has a type that the values assigned to it are checked against,
+// and code embedding the Evaluator can be notified of its changes with
+// Options.Watch.
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// OptionType is the type of the values of an option.
+type OptionType int
+
+// OptionType constants.
+const (
+	// BoolOption is the type of options that are true or false.
+	BoolOption OptionType = iota
+	// StringOption is the type of options whose values are strings.
+	StringOption
+	// IntOption is the type of options whose values are non-negative
+	// integers.
+	IntOption
+)
+
+type optionSpec struct {
+	typ      OptionType
+	watchers []func(Value)
+}
+
+// check checks a value assigned to an option of the type.
+func (spec *optionSpec) check(v Value) error {
+	s, ok := v.(*String)
+	if !ok {
+		return fmt.Errorf("must be a string, got %s", v.Repr())
+	}
+	if spec.typ == BoolOption && *s != "true" && *s != "false" {
+		return fmt.Errorf("must be true or false, got %s", v.Repr())
+	}
+	if spec.typ == IntOption {
+		if n, err := strconv.ParseInt(string(*s), 10, 32); err != nil || n < 0 {
+			return fmt.Errorf("must be a non-negative integer, got %s", v.Repr())
+		}
+	}
+	return nil
+}
+
+// Options is the registry of the options of an Evaluator, which are the
+// elements of the $options table.
+type Options struct {
+	mutex sync.Mutex
+	specs map[string]*optionSpec
+	v     *Var // The global $options.
+
+	// Options checked for each command are also kept here, to avoid looking
+	// them up each time.
+	xtrace, dryRun, pathCache int32
+	// Limits on resources used by code, which are no limits when 0.
+	maxDepth, maxValues int32
+	// How many bytes of output are kept in $last-output.
+	lastOutput int32
+	// paths caches where commands searched for have been found.
+	paths map[string]string
+}
+
+func newOptions() *Options {
+	o := &Options{specs: make(map[string]*optionSpec), v: newVar(NewTable())}
+	o.v.validate = o.validate
+	o.v.changed = o.notify
+	return o
+}
+
+// defineOptions defines the builtin options.
+func (ev *Evaluator) defineOptions() {
+	o := ev.options
+	flag := func(name string, p *int32) {
+		o.Define(name, BoolOption, boolValue(false))
+		o.Watch(name, func(v Value) {
+			var on int32
+			if v.String() == "true" {
+				on = 1
+			}
+			atomic.StoreInt32(p, on)
+		})
+	}
+	flag("xtrace", &o.xtrace)
+	flag("dry-run", &o.dryRun)
+	flag("path-cache", &o.pathCache)
+	o.Watch("path-cache", func(Value) {
+		o.mutex.Lock()
+		defer o.mutex.Unlock()
+		o.paths = nil
+	})
+	// A closure calling itself with no end would otherwise use up memory
+	// with goroutines, and an output capture of an endless stream with
+	// values.
+	limit := func(name string, p *int32, initial int32) {
+		o.Define(name, IntOption, NewString(strconv.Itoa(int(initial))))
+		atomic.StoreInt32(p, initial)
+		o.Watch(name, func(v Value) {
+			n, _ := strconv.ParseInt(v.String(), 10, 32)
+			atomic.StoreInt32(p, int32(n))
+		})
+	}
+	limit("max-depth", &o.maxDepth, 1000)
+	limit("max-values", &o.maxValues, 10000000)
+	limit("last-output", &o.lastOutput, 0)
+	// See history.go.
+	o.Define("history-ignore-space", BoolOption, boolValue(false))
+	o.Define("history-ignore-dups", BoolOption, boolValue(false))
+	o.Define("history-max-size", IntOption, NewString("0"))
+	o.Define("history-shared", BoolOption, boolValue(false))
+	// options[strict] turns on the options of the strict group of set-option
+	// that are off, and turns off again only those, so that one turned on
+	// with set-option stays on.
+	o.Define("strict", BoolOption, boolValue(false))
+	var strictOn []string
+	o.Watch("strict", func(v Value) {
+		if v.String() == "true" {
+			for _, name := range optionGroups["strict"] {
+				if !ev.Compiler.Option(name) {
+					ev.Compiler.SetOption(name, true)
+					strictOn = append(strictOn, name)
+				}
+			}
+			return
+		}
+		for _, name := range strictOn {
+			ev.Compiler.SetOption(name, false)
+		}
+		strictOn = nil
+	})
+}
+
+// Options returns the registry of the options of the Evaluator.
+func (ev *Evaluator) Options() *Options {
+	return ev.options
+}
+
+// Define adds an option with a type and an initial value. It is an error to
+// define an option twice.
+func (o *Options) Define(name string, typ OptionType, value Value) error {
+	spec := &optionSpec{typ: typ}
+	if err := spec.check(value); err != nil {
+		return fmt.Errorf("bad value for option %s: %s", name, err)
+	}
+	o.mutex.Lock()
+	if _, ok := o.specs[name]; ok {
+		o.mutex.Unlock()
+		return fmt.Errorf("option %s already defined", name)
+	}
+	o.specs[name] = spec
+	o.mutex.Unlock()
+	o.v.Update(func(old Value) Value {
+		t := copyTable(old.(*Table))
+		t.put(NewString(name), value)
+		return t
+	})
+	return nil
+}
+
+// Watch makes f be called with the new value of an option whenever it
+// changes. f is called in the goroutine that changes the option, after the
+// change.
+func (o *Options) Watch(name string, f func(Value)) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	spec, ok := o.specs[name]
+	if !ok {
+		return fmt.Errorf("unknown option %s", name)
+	}
+	spec.watchers = append(spec.watchers, f)
+	return nil
+}
+
+// Get returns the value of an option.
+func (o *Options) Get(name string) (Value, bool) {
+	return o.v.Get().(*Table).lookup(name)
+}
+
+// Set sets an option, as if assigned to from elvish code.
+func (o *Options) Set(name string, v Value) error {
+	return o.v.assign(func(old Value) Value {
+		t := copyTable(old.(*Table))
+		t.put(NewString(name), v)
+		return t
+	})
+}
+
+// validate checks a table assigned to $options. Options left out keep their
+// values, and every element must be a defined option with a value of its
+// type.
+func (o *Options) validate(old, new Value) (Value, error) {
+	t, ok := new.(*Table)
+	if !ok || len(t.List) > 0 {
+		return nil, fmt.Errorf("options must be a table of names and values, got %s", new.Repr())
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	result := copyTable(old.(*Table))
+	for _, k := range t.Keys() {
+		name := k.String()
+		spec, ok := o.specs[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown option %s", name)
+		}
+		if err := spec.check(t.Dict[k]); err != nil {
+			return nil, fmt.Errorf("bad value for option %s: %s", name, err)
+		}
+		result.put(NewString(name), t.Dict[k])
+	}
+	return result, nil
+}
+
+// notify calls the watchers of the options changed by an assignment to
+// $options, in the order of their names.
+func (o *Options) notify(old, new Value) {
+	oldt, newt := old.(*Table), new.(*Table)
+	var changed []string
+	for _, k := range newt.Keys() {
+		name := k.String()
+		if v, ok := oldt.lookup(name); !ok || !v.Eq(newt.Dict[k]) {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	for _, name := range changed {
+		o.mutex.Lock()
+		watchers := make([]func(Value), len(o.specs[name].watchers))
+		copy(watchers, o.specs[name].watchers)
+		o.mutex.Unlock()
+		v, _ := newt.lookup(name)
+		for _, f := range watchers {
+			f(v)
+		}
+	}
+}
+
+// cachedPath returns where a command has been found before if path-cache is
+// on and it is still executable there.
+func (o *Options) cachedPath(exe string) (string, bool) {
+	if atomic.LoadInt32(&o.pathCache) == 0 {
+		return "", false
+	}
+	o.mutex.Lock()
+	full, ok := o.paths[exe]
+	o.mutex.Unlock()
+	if !ok || !isExecutable(full) {
+		return "", false
+	}
+	return full, true
+}
+
+// cachePath records where a command has been found if path-cache is on.
+func (o *Options) cachePath(exe, full string) {
+	if atomic.LoadInt32(&o.pathCache) == 0 {
+		return
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.paths == nil {
+		o.paths = make(map[string]string)
+	}
+	o.paths[exe] = full
+}
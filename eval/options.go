@@ -0,0 +1,173 @@
+package eval
+
+// Shell options.
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/xiaq/elvish/parse"
+)
+
+// shellOptions are options that change how code is compiled. They are set
+// with the set-option special form, and are in effect until the end of the
+// enclosing closure, or for the rest of the session when set at the top
+// level. Options that change what is done at run time are in $options
+// instead; see option-registry.go.
+type shellOptions struct {
+	// noclobber makes > refuse to open an existing regular file; >| still
+	// does.
+	noclobber bool
+	// errexit makes a failing pipeline stop the evaluation with an error.
+	errexit bool
+	// pipefail makes a pipeline fail if any of its forms fails, instead of
+	// only when its last form does.
+	pipefail bool
+	// xtrace makes each command be printed with its arguments to port 2
+	// before it is run, like with Evaluator.SetXtrace.
+	xtrace bool
+	// nounset makes using a variable declared without a value an error until
+	// the variable is set, unless it is used like $x?.
+	nounset bool
+	// langVersion is the language version targeted, set with
+	// shell:lang-version; 0 is the current one. See lang-version.go.
+	langVersion int
+}
+
+var optionNames = map[string]func(*shellOptions) *bool{
+	"noclobber": func(o *shellOptions) *bool { return &o.noclobber },
+	"errexit":   func(o *shellOptions) *bool { return &o.errexit },
+	"pipefail":  func(o *shellOptions) *bool { return &o.pipefail },
+	"xtrace":    func(o *shellOptions) *bool { return &o.xtrace },
+	"nounset":   func(o *shellOptions) *bool { return &o.nounset },
+}
+
+// optionGroups are names that stand for several options. strict is like set
+// -eu -o pipefail of POSIX shells.
+var optionGroups = map[string][]string{
+	"strict": {"errexit", "pipefail", "nounset"},
+}
+
+// setOption sets the option with a name, or the options of a group, in o. It
+// returns false if there is no such option or group.
+func setOption(o *shellOptions, name string, on bool) bool {
+	if group, ok := optionGroups[name]; ok {
+		for _, name := range group {
+			*optionNames[name](o) = on
+		}
+		return true
+	}
+	option, ok := optionNames[name]
+	if !ok {
+		return false
+	}
+	*option(o) = on
+	return true
+}
+
+// SetOption sets a shell option, or the options of a group like strict, for
+// the code compiled from now on, as if set-option were used at the top level.
+func (cp *Compiler) SetOption(name string, on bool) error {
+	if !setOption(&cp.options, name, on) {
+		return fmt.Errorf("unknown option %s", name)
+	}
+	return nil
+}
+
+// Option returns whether a shell option is on for the code compiled from now
+// on. It is false for unknown options and groups.
+func (cp *Compiler) Option(name string) bool {
+	option, ok := optionNames[name]
+	return ok && *option(&cp.options)
+}
+
+// opts returns the options in effect on the current scope.
+func (cp *Compiler) opts() *shellOptions {
+	return &cp.optionStack[len(cp.optionStack)-1]
+}
+
+// compileSetOption compiles a set-option special form, e.g.
+//
+// set-option errexit on
+// set-option noclobber pipefail off
+// set-option strict on
+//
+// It takes effect when compiled, so it has nothing to do when evaluated.
+func compileSetOption(cp *Compiler, fn *parse.FormNode) strOp {
+	args := fn.Args.Nodes
+	if len(args) < 2 {
+		cp.errorf(fn, "set-option form must be `set-option name... on|off`")
+	}
+	var on bool
+	switch keyword(args[len(args)-1]) {
+	case "on":
+		on = true
+	case "off":
+	default:
+		cp.errorf(args[len(args)-1], "must be on or off")
+	}
+	for _, tn := range args[:len(args)-1] {
+		if !setOption(cp.opts(), cp.currentName(optionRenames, keyword(tn)), on) {
+			cp.errorf(tn, "unknown option")
+		}
+	}
+	return func(ev *Evaluator) string {
+		return ""
+	}
+}
+
+// noclobber determines whether a redirection must not overwrite existing
+// files, which is when it is a > redirection and noclobber is on.
+func (cp *Compiler) noclobber(r *parse.FilenameRedir) bool {
+	return cp.opts().noclobber && !r.Clobber && r.Flag&os.O_WRONLY != 0 && r.Flag&os.O_APPEND == 0
+}
+
+// openNoclobber opens a file for a > redirection when noclobber is on. Like
+// POSIX shells, it only refuses existing regular files, so that files like
+// /dev/null can still be written to. A file that doesn't exist is created
+// with O_EXCL, in case it is created in the meantime.
+func openNoclobber(name string, flag int, perm os.FileMode) (*os.File, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return os.OpenFile(name, flag|os.O_EXCL, perm)
+	}
+	if fi.Mode().IsRegular() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EEXIST}
+	}
+	return os.OpenFile(name, flag, perm)
+}
+
+// pipelineFailed determines whether a pipeline with the given statuses has
+// failed.
+func pipelineFailed(statuses []Value, pipefail bool) bool {
+	if len(statuses) == 0 {
+		return false
+	}
+	if pipefail {
+		return !statusOk(statuses)
+	}
+	return !statusOk(statuses[len(statuses)-1:])
+}
+
+// withErrexit makes a compiled pipeline stop the evaluation when it fails and
+// errexit is on.
+func (cp *Compiler) withErrexit(pn *parse.PipelineNode, op valuesOp) valuesOp {
+	o := *cp.opts()
+	if !o.errexit {
+		return op
+	}
+	f := func(ev *Evaluator) []Value {
+		s := op.f(ev)
+		if pipelineFailed(s, o.pipefail) {
+			reprs := make([]string, len(s))
+			for i, v := range s {
+				reprs[i] = v.Repr()
+			}
+			ev.errorfNode(pn, "pipeline failed with status %s", strings.Join(reprs, " "))
+		}
+		return s
+	}
+	return valuesOp{ts: op.ts, f: f}
+}
@@ -0,0 +1,92 @@
+package eval
+
+// The run-parallel builtin, which runs closures concurrently and waits for
+// all of them, e.g.
+//
+// run-parallel { make -C a } { make -C b } { put (fetch-something) }
+//
+// Each closure runs in its own copy of the Evaluator, holding its own ports.
+// The values each closure outputs are kept apart and output in the order of
+// the closures once all of them have finished, so that they are not
+// interleaved; byte output is written as it comes. When some closures fail,
+// the rest still run to the end, and run-parallel fails with all the errors.
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// parallelError is the error of run-parallel when some of its closures fail.
+type parallelError struct {
+	// The errors of the closures, nil for those that have succeeded.
+	errs []error
+}
+
+func (pe *parallelError) Error() string {
+	var buf bytes.Buffer
+	failed := 0
+	for _, err := range pe.errs {
+		if err != nil {
+			failed++
+		}
+	}
+	fmt.Fprintf(&buf, "%d of %d closures failed", failed, len(pe.errs))
+	for i, err := range pe.errs {
+		if err != nil {
+			fmt.Fprintf(&buf, "\n  closure %d: %s", i+1, err)
+		}
+	}
+	return buf.String()
+}
+
+func runParallel(ev *Evaluator, args []Value) string {
+	closures := make([]*Closure, len(args))
+	for i, a := range args {
+		c, ok := a.(*Closure)
+		if !ok {
+			return fmt.Sprintf("run-parallel argument must be a closure, got %s", a.Repr())
+		}
+		closures[i] = c
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(closures))
+	outputs := make([][]Value, len(closures))
+	for i, c := range closures {
+		newEv := ev.copy()
+		w, collected := newCollector(ev.maxValues())
+		newEv.setPort(1, w)
+		wg.Add(1)
+		go func(i int, c *Closure) {
+			defer wg.Done()
+			err := func() error {
+				defer newEv.releasePorts()
+				return newEv.runClosure(c, nil)
+			}()
+			values, ok := collected()
+			if err == nil && !ok {
+				err = errTooManyValues
+			}
+			outputs[i], errs[i] = values, err
+		}(i, c)
+	}
+	wg.Wait()
+	ev.checkCanceled()
+
+	out := ev.ports[1]
+output:
+	for _, values := range outputs {
+		for _, v := range values {
+			if !out.put(v) {
+				break output
+			}
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			return (&parallelError{errs}).Error()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,214 @@
+package eval
+
+// The path: and fs: builtins.
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+var (
+	errTempFileArgs = errors.New("usage: fs:temp-file [dir [pattern]]")
+	errMkdirArgs    = errors.New("usage: fs:mkdir [&parents] dir...")
+	errRemoveArgs   = errors.New("usage: fs:remove [&recursive] path...")
+)
+
+// pathConverter makes a builtin outputting each argument converted with f.
+func pathConverter(f func(string) (string, error)) builtinFuncImpl {
+	return func(ev *Evaluator, args []Value) string {
+		out := ev.ports[1].ch
+		for _, a := range args {
+			s, err := f(a.String())
+			if err != nil {
+				return err.Error()
+			}
+			out <- NewString(s)
+		}
+		return ""
+	}
+}
+
+// pathPredicate makes a builtin outputting true or false for each argument,
+// depending on f.
+func pathPredicate(f func(string) bool) builtinFuncImpl {
+	return func(ev *Evaluator, args []Value) string {
+		out := ev.ports[1].ch
+		for _, a := range args {
+			s := "false"
+			if f(a.String()) {
+				s = "true"
+			}
+			out <- NewString(s)
+		}
+		return ""
+	}
+}
+
+func noError(f func(string) string) func(string) (string, error) {
+	return func(s string) (string, error) {
+		return f(s), nil
+	}
+}
+
+var (
+	pathDir   = pathConverter(noError(filepath.Dir))
+	pathBase  = pathConverter(noError(filepath.Base))
+	pathExt   = pathConverter(noError(filepath.Ext))
+	pathClean = pathConverter(noError(filepath.Clean))
+	pathAbs   = pathConverter(filepath.Abs)
+
+	fsExists = pathPredicate(func(name string) bool {
+		_, err := os.Lstat(name)
+		return err == nil
+	})
+	fsIsDir = pathPredicate(func(name string) bool {
+		fi, err := os.Stat(name)
+		return err == nil && fi.IsDir()
+	})
+)
+
+// pathJoin outputs its arguments joined into a single path, e.g.
+//
+// path:join ~ .elvish rc.elv
+func pathJoin(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	elems := make([]string, len(args))
+	for i, a := range args {
+		elems[i] = a.String()
+	}
+	out <- NewString(filepath.Join(elems...))
+	return ""
+}
+
+// fsList outputs a table for each file in the given directories, or the
+// working directory without arguments, e.g.
+//
+// fs:list /var/log | sort-by {|f| put $f[size]}
+//
+// [&name syslog &path /var/log/syslog &size 18231 &mode -rw-r----- &mtime 1709296200]
+//
+// where &mtime is in seconds since the Unix epoch. Files that are not
+// directories are listed themselves, like ls does. Symbolic links are not
+// followed.
+func fsList(ev *Evaluator, args []Value) string {
+	out := ev.ports[1]
+	dirs := []string{"."}
+	if len(args) > 0 {
+		dirs = make([]string, len(args))
+		for i, a := range args {
+			dirs[i] = a.String()
+		}
+	}
+	for _, dir := range dirs {
+		fi, err := os.Lstat(dir)
+		if err != nil {
+			return err.Error()
+		}
+		var t []Value
+		if fi.IsDir() {
+			infos, err := ioutil.ReadDir(dir)
+			if err != nil {
+				return err.Error()
+			}
+			for _, info := range infos {
+				t = append(t, fileTable(filepath.Join(dir, info.Name()), info))
+			}
+		} else {
+			t = append(t, fileTable(dir, fi))
+		}
+		for _, v := range t {
+			if !out.put(v) {
+				return ""
+			}
+		}
+	}
+	return ""
+}
+
+// fileTable returns the table describing a file for fs:list.
+func fileTable(path string, fi os.FileInfo) *Table {
+	t := NewTable()
+	t.put(NewString("name"), NewString(fi.Name()))
+	t.put(NewString("path"), NewString(path))
+	t.put(NewString("size"), NewString(strconv.FormatInt(fi.Size(), 10)))
+	t.put(NewString("mode"), NewString(fi.Mode().String()))
+	t.put(NewString("mtime"), NewString(strconv.FormatInt(fi.ModTime().Unix(), 10)))
+	return t
+}
+
+// fsTempFile creates a new file in a directory, which defaults to that for
+// temporary files, and outputs it as a File opened for writing and reading.
+// A * in the pattern is replaced with a random string, e.g.
+//
+// fs:temp-file /tmp elvish-*.log
+func fsTempFile(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	dir, pattern := "", "elvish-*"
+	switch len(args) {
+	case 2:
+		pattern = args[1].String()
+		fallthrough
+	case 1:
+		dir = args[0].String()
+	case 0:
+	default:
+		return errTempFileArgs.Error()
+	}
+	f, err := ioutil.TempFile(dir, pattern)
+	if err != nil {
+		return err.Error()
+	}
+	out <- NewFile(f, f.Name())
+	return ""
+}
+
+// fsMkdir creates directories. With &parents, missing parent directories are
+// created too, and existing directories are not an error.
+func fsMkdir(ev *Evaluator, args []Value) string {
+	parents, args := optionArg(args, "parents")
+	if err := checkOptionArgs(args); err != nil {
+		return err.Error()
+	}
+	if len(args) == 0 {
+		return errMkdirArgs.Error()
+	}
+	for _, a := range args {
+		var err error
+		if parents {
+			err = os.MkdirAll(a.String(), 0777)
+		} else {
+			err = os.Mkdir(a.String(), 0777)
+		}
+		if err != nil {
+			return err.Error()
+		}
+	}
+	return ""
+}
+
+// fsRemove removes files and empty directories. With &recursive, directories
+// are removed along with everything in them.
+func fsRemove(ev *Evaluator, args []Value) string {
+	recursive, args := optionArg(args, "recursive")
+	if err := checkOptionArgs(args); err != nil {
+		return err.Error()
+	}
+	if len(args) == 0 {
+		return errRemoveArgs.Error()
+	}
+	for _, a := range args {
+		var err error
+		if recursive {
+			err = os.RemoveAll(a.String())
+		} else {
+			err = os.Remove(a.String())
+		}
+		if err != nil {
+			return err.Error()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,178 @@
+package eval
+
+// Ports and their lifecycle.
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"sync/atomic"
+)
+
+// A port conveys data stream. It may be a Unix fd (wrapped by os.File), where
+// f is not nil, or a channel, where ch is not nil. When both are nil, the port
+// is closed and may not be used.
+//
+// A port may be owned, in which case refs is shared by all Evaluators using
+// it. Each Evaluator holds one reference to each of its ports, acquired by
+// copy or setPort and given up by releasePorts, and the underlying file or
+// channel is closed exactly once, when the last reference is released. Ports
+// that are not owned, like the standard streams, have a nil refs and are
+// never closed.
+//
+// The two ports of a channel pipe share done, which is closed when the
+// reader has gone away, so that a writer producing values lazily can stop
+// early instead of producing values no one reads.
+type port struct {
+	f    *os.File
+	ch   chan Value
+	done chan struct{}
+	refs *portRefs
+}
+
+type portRefs struct {
+	n     int32
+	close func()
+}
+
+// newFilePort returns an owned port for f, which is closed when the port is no
+// longer referenced.
+func newFilePort(f *os.File) *port {
+	atomic.AddInt32(&liveCounts.ports, 1)
+	return &port{f: f, refs: &portRefs{1, func() { f.Close() }}}
+}
+
+// newValueFilePort returns an owned port for the fd of a File. The File keeps
+// owning the fd, and the port keeps the File from being garbage collected,
+// which would close the fd under whoever is using it, until it is no longer
+// referenced.
+func newValueFilePort(f *File) *port {
+	atomic.AddInt32(&liveCounts.ports, 1)
+	return &port{f: f.f, refs: &portRefs{1, func() { runtime.KeepAlive(f) }}}
+}
+
+// newChanWriterPort returns an owned port for writing to ch, which is closed
+// when the port is no longer referenced.
+func newChanWriterPort(ch chan Value) *port {
+	atomic.AddInt32(&liveCounts.ports, 1)
+	return &port{ch: ch, refs: &portRefs{1, func() { close(ch) }}}
+}
+
+// chanPipeSize is the number of values buffered in the channels of ports. The
+// buffer lets a writer run ahead of its reader instead of handing over each
+// value, so that neither is held up while the other is busy with something
+// else, like a byte pipe on the other side of a stream adapter.
+const chanPipeSize = 64
+
+// newChanPipe returns owned ports for writing to and reading from a new
+// channel. When the reader port is no longer referenced, done is closed and
+// the rest of the channel is drained, so that the writer never blocks on a
+// reader that has gone away, and may learn about it through put.
+func newChanPipe() (w, r *port) {
+	ch := make(chan Value, chanPipeSize)
+	done := make(chan struct{})
+	w = newChanWriterPort(ch)
+	w.done = done
+	atomic.AddInt32(&liveCounts.ports, 1)
+	r = &port{ch: ch, done: done, refs: &portRefs{1, func() {
+		close(done)
+		go func() {
+			for range ch {
+			}
+		}()
+	}}}
+	return w, r
+}
+
+// errTooManyValues is the error of a capture with more values than
+// $options[max-values].
+var errTooManyValues = errors.New("output capture exceeds $options[max-values]")
+
+// newCollector returns an owned port for writing values to, which are
+// collected in the background as they are written, so that the writer never
+// waits for whoever wants them. The returned function waits until the port is
+// no longer referenced, and returns the values. If there are to be more than
+// max values, with max > 0, collecting stops as if the reader had gone away,
+// and the function returns false.
+func newCollector(max int) (*port, func() ([]Value, bool)) {
+	w, r := newChanPipe()
+	var vs []Value
+	ok := true
+	done := make(chan struct{})
+	go func() {
+		for v := range r.ch {
+			if max > 0 && len(vs) >= max {
+				ok = false
+				break
+			}
+			vs = append(vs, v)
+		}
+		r.release()
+		close(done)
+	}()
+	return w, func() ([]Value, bool) {
+		<-done
+		return vs, ok
+	}
+}
+
+// maxValues returns the most values a capture may collect; see
+// newCollector.
+func (ev *Evaluator) maxValues() int {
+	return int(atomic.LoadInt32(&ev.options.maxValues))
+}
+
+// put sends v to the channel of p, unless the reader has gone away, in which
+// case it returns false without sending.
+func (p *port) put(v Value) bool {
+	select {
+	case <-p.done:
+		return false
+	default:
+	}
+	select {
+	case p.ch <- v:
+		return true
+	case <-p.done:
+		return false
+	}
+}
+
+// retain acquires a reference to p.
+func (p *port) retain() {
+	if p != nil && p.refs != nil {
+		atomic.AddInt32(&p.refs.n, 1)
+	}
+}
+
+// release gives up a reference to p, closing it if it was the last one.
+func (p *port) release() {
+	if p == nil || p.refs == nil {
+		return
+	}
+	switch n := atomic.AddInt32(&p.refs.n, -1); {
+	case n == 0:
+		atomic.AddInt32(&liveCounts.ports, -1)
+		p.refs.close()
+	case n < 0:
+		panic("port released more times than retained")
+	}
+}
+
+// setPort replaces the i-th port of ev with p, releasing the old one. The
+// reference to p held by the caller is transferred to ev.
+func (ev *Evaluator) setPort(i int, p *port) {
+	ev.growPorts(i + 1)
+	old := ev.ports[i]
+	ev.ports[i] = p
+	old.release()
+}
+
+// releasePorts releases all ports of ev. It must be called exactly once for
+// each Evaluator created by copy, after which its ports may no longer be used.
+func (ev *Evaluator) releasePorts() {
+	atomic.AddInt32(&liveCounts.evaluators, -1)
+	for _, p := range ev.ports {
+		p.release()
+	}
+}
@@ -0,0 +1,174 @@
+package eval
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xiaq/elvish/parse"
+)
+
+func countFds(t *testing.T) int {
+	fis, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("cannot count open file descriptors:", err)
+	}
+	return len(fis)
+}
+
+var portLeakTests = []string{
+	"cat /dev/null | cat | cat",
+	"cat /dev/null | cat | nonexistent-command",
+	"nonexistent-command | cat",
+	"cat /dev/null >/nonexistent/file",
+	"put (cat /dev/null | nonexistent-command)",
+	"put a b | each {|x| put $x} | println",
+	"put a b | each {|x| var $y string = $x}",
+}
+
+func TestPortsDoNotLeak(t *testing.T) {
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	countFds(t)
+	for _, text := range portLeakTests {
+		n, err := parse.Parse("<port leak test>", text)
+		if err != nil {
+			t.Fatalf("Parse(*, %q) => error %v", text, err)
+		}
+		before := countFds(t)
+		ev.Eval("<port leak test>", text, n)
+		if after := countFds(t); after != before {
+			t.Errorf("Eval(*, %q, *) leaks %d file descriptors", text, after-before)
+		}
+	}
+}
+
+var earlyStopTests = []string{
+	"range 1e9 | take 2",
+	"range 1e9 | first",
+	"range 1e9 | drop 1 | take 1 | count",
+}
+
+func TestEarlyStopDoesNotLeak(t *testing.T) {
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	for _, text := range earlyStopTests {
+		n, err := parse.Parse("<early stop test>", text)
+		if err != nil {
+			t.Fatalf("Parse(*, %q) => error %v", text, err)
+		}
+		ports := atomic.LoadInt32(&liveCounts.ports)
+		evaluators := atomic.LoadInt32(&liveCounts.evaluators)
+		ev.ports[1] = &port{f: ev.ports[1].f, ch: make(chan Value, 10)}
+		ev.Eval("<early stop test>", text, n)
+		if d := atomic.LoadInt32(&liveCounts.ports) - ports; d != 0 {
+			t.Errorf("Eval(*, %q, *) leaks %d ports", text, d)
+		}
+		if d := atomic.LoadInt32(&liveCounts.evaluators) - evaluators; d != 0 {
+			t.Errorf("Eval(*, %q, *) leaks %d Evaluators", text, d)
+		}
+	}
+}
+
+func TestPortRelease(t *testing.T) {
+	ch := make(chan Value)
+	p := newChanWriterPort(ch)
+	p.retain()
+	p.release()
+	select {
+	case <-ch:
+		t.Errorf("port closed while still referenced")
+	default:
+	}
+	p.release()
+	if _, ok := <-ch; ok {
+		t.Errorf("port not closed after last release")
+	}
+}
+
+func TestForward(t *testing.T) {
+	in := make(chan Value)
+	w, r := newChanPipe()
+	result := make(chan bool)
+	go func() { result <- forward(in, w) }()
+
+	// The writer of in runs ahead of a reader of out that is not reading.
+	n := chanPipeSize + forwardQueueSize
+	for i := 0; i < n; i++ {
+		select {
+		case in <- NewString(strconv.Itoa(i)):
+		case <-time.After(5 * time.Second):
+			t.Fatalf("forward blocks the writer after %d values", i)
+		}
+	}
+	for i := 0; i < n; i++ {
+		if v := <-r.ch; v.String() != strconv.Itoa(i) {
+			t.Fatalf("forward passes %v as value #%d", v, i)
+		}
+	}
+	close(in)
+	if ok := <-result; !ok {
+		t.Errorf("forward => false after in is closed, want true")
+	}
+
+	in = make(chan Value)
+	go func() { result <- forward(in, w) }()
+	in <- NewString("x")
+	r.release()
+	select {
+	case ok := <-result:
+		if ok {
+			t.Errorf("forward => true after the reader goes away, want false")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("forward does not return after the reader goes away")
+	}
+	w.release()
+}
+
+// Pipelines mixing byte and value streams, with enough data to fill the
+// buffers of both, and how many values or lines they output.
+var loadTests = []struct {
+	text string
+	want int
+}{
+	{"range 100000 | cat | count", 100000},
+	{"range 100000 | to-lines | from-lines | to-lines | count", 100000},
+	{"put (range 100000 | to-lines) | count", 100000},
+	{"range 20000 | each {|x| echo $x} | each {|l| put $l} | count", 20000},
+	{"range 100000 | cat | take 3 | count", 3},
+	{"range 1e9 | to-lines | from-lines | take 2 | count", 2},
+}
+
+func TestMixedPipelinesUnderLoad(t *testing.T) {
+	ev := NewEvaluator()
+	ev.statusCb = nil
+	for _, tt := range loadTests {
+		n, err := parse.Parse("<load test>", tt.text)
+		if err != nil {
+			t.Fatalf("Parse(*, %q) => error %v", tt.text, err)
+		}
+		ch := make(chan Value, 1)
+		devnull, _ := os.Open(os.DevNull)
+		ev.ports[1] = &port{f: devnull, ch: ch}
+		done := make(chan struct{})
+		go func() {
+			ev.Eval("<load test>", tt.text, n)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(30 * time.Second):
+			t.Fatalf("Eval(*, %q, *) deadlocks", tt.text)
+		}
+		devnull.Close()
+		close(ch)
+		got := <-ch
+		if got == nil || got.String() != strconv.Itoa(tt.want) {
+			t.Errorf("Eval(*, %q, *) outputs %v, want %d", tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package eval
+
+// The proc:list builtin, which outputs a table for each process running on
+// the system, e.g.
+//
+// proc:list | sort-by &reverse {|p| put $p[rss]} | take 5
+//
+// [&pid 1234 &ppid 1 &name sshd &cmd "/usr/sbin/sshd -D" &rss 7340032]
+//
+// where &rss is the resident set size in bytes, and &cmd is the command line
+// with its arguments joined by spaces, or the name in brackets for processes
+// without one, like kernel threads. The processes are read from /proc, so
+// proc:list is only available on systems that have it, like Linux.
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// procRoot is where the processes are read from.
+var procRoot = "/proc"
+
+var (
+	errNoProcFS    = errors.New("proc:list needs /proc, which is not available on this system")
+	errBadProcStat = errors.New("bad stat file")
+)
+
+// procInfo is what proc:list tells about a process.
+type procInfo struct {
+	pid, ppid int
+	name, cmd string
+	rss       int64
+}
+
+func (p *procInfo) table() *Table {
+	t := NewTable()
+	t.put(NewString("pid"), NewString(strconv.Itoa(p.pid)))
+	t.put(NewString("ppid"), NewString(strconv.Itoa(p.ppid)))
+	t.put(NewString("name"), NewString(p.name))
+	t.put(NewString("cmd"), NewString(p.cmd))
+	t.put(NewString("rss"), NewString(strconv.FormatInt(p.rss, 10)))
+	return t
+}
+
+// readProc reads the process with the given pid from procRoot.
+func readProc(pid int) (*procInfo, error) {
+	dir := filepath.Join(procRoot, strconv.Itoa(pid))
+	stat, err := ioutil.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return nil, err
+	}
+	// The name is in parentheses and may contain anything, including spaces
+	// and parentheses, so the fields after it are found from the last ")".
+	s := string(stat)
+	lparen, rparen := strings.IndexByte(s, '('), strings.LastIndexByte(s, ')')
+	if lparen < 0 || rparen < lparen {
+		return nil, errBadProcStat
+	}
+	// The fields after the name, starting from the state; the ppid is the
+	// 2nd and the rss, in pages, the 22nd.
+	fields := strings.Fields(s[rparen+1:])
+	if len(fields) < 22 {
+		return nil, errBadProcStat
+	}
+	p := &procInfo{pid: pid, name: s[lparen+1 : rparen]}
+	if p.ppid, err = strconv.Atoi(fields[1]); err != nil {
+		return nil, errBadProcStat
+	}
+	pages, err := strconv.ParseInt(fields[21], 10, 64)
+	if err != nil {
+		return nil, errBadProcStat
+	}
+	p.rss = pages * int64(os.Getpagesize())
+
+	cmdline, err := ioutil.ReadFile(filepath.Join(dir, "cmdline"))
+	if err != nil {
+		return nil, err
+	}
+	p.cmd = strings.Join(strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00"), " ")
+	if p.cmd == "" {
+		p.cmd = "[" + p.name + "]"
+	}
+	return p, nil
+}
+
+// procList outputs a table for each process, in ascending order of pids.
+// Processes that exit while being read are left out.
+func procList(ev *Evaluator, args []Value) string {
+	if len(args) != 0 {
+		return "args error"
+	}
+	infos, err := ioutil.ReadDir(procRoot)
+	if os.IsNotExist(err) {
+		return errNoProcFS.Error()
+	} else if err != nil {
+		return err.Error()
+	}
+	var pids []int
+	for _, info := range infos {
+		if pid, err := strconv.Atoi(info.Name()); err == nil && info.IsDir() {
+			pids = append(pids, pid)
+		}
+	}
+	if len(pids) == 0 {
+		return errNoProcFS.Error()
+	}
+	sort.Ints(pids)
+	out := ev.ports[1]
+	for _, pid := range pids {
+		p, err := readProc(pid)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err.Error()
+		}
+		if !out.put(p.table()) {
+			break
+		}
+	}
+	return ""
+}
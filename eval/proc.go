@@ -0,0 +1,214 @@
+package eval
+
+// Background external commands and the wait and kill builtins.
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// proc is an external command running in the background. status is set when
+// it terminates, after which done is closed.
+type proc struct {
+	pid    int
+	argv   []string
+	done   chan struct{}
+	status string
+}
+
+// procTable tracks the background commands of an Evaluator and all its
+// copies until they are waited for.
+type procTable struct {
+	mutex sync.Mutex
+	procs map[int]*proc
+}
+
+func newProcTable() *procTable {
+	return &procTable{procs: make(map[int]*proc)}
+}
+
+// add tracks the command with the given pid, collecting its status in the
+// background.
+func (pt *procTable) add(pid int, argv []string) {
+	p := &proc{pid: pid, argv: argv, done: make(chan struct{})}
+	pt.mutex.Lock()
+	pt.procs[pid] = p
+	pt.mutex.Unlock()
+
+	update := make(chan *StateUpdate)
+	go waitStateUpdate(pid, update)
+	go func() {
+		for up := range update {
+			p.status = up.Msg
+		}
+		close(p.done)
+	}()
+}
+
+// pids returns the pids of all tracked commands, in ascending order.
+func (pt *procTable) pids() []int {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+	pids := make([]int, 0, len(pt.procs))
+	for pid := range pt.procs {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	return pids
+}
+
+// wait waits for the command with the given pid, stops tracking it and
+// returns its status.
+func (pt *procTable) wait(pid int) (string, error) {
+	pt.mutex.Lock()
+	p, ok := pt.procs[pid]
+	pt.mutex.Unlock()
+	if !ok {
+		return "", fmt.Errorf("no such background command: %d", pid)
+	}
+	<-p.done
+	pt.mutex.Lock()
+	delete(pt.procs, pid)
+	pt.mutex.Unlock()
+	return p.status, nil
+}
+
+// procsFn outputs a table [&pid 123 &argv [...]] for each background command
+// that has not been waited for, e.g.
+//
+// spawn -b sleep 10; procs
+func procsFn(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	if len(args) > 0 {
+		return "args error"
+	}
+	pt := ev.procs
+	pids := pt.pids()
+	var tables []Value
+	pt.mutex.Lock()
+	for _, pid := range pids {
+		p, ok := pt.procs[pid]
+		if !ok {
+			continue
+		}
+		t := NewTable()
+		t.put(NewString("pid"), NewString(strconv.Itoa(p.pid)))
+		argv := NewTable()
+		for _, a := range p.argv {
+			argv.append(NewString(a))
+		}
+		t.put(NewString("argv"), argv)
+		tables = append(tables, t)
+	}
+	pt.mutex.Unlock()
+	for _, t := range tables {
+		out <- t
+	}
+	return ""
+}
+
+// waitFn waits for background commands started with spawn -b, given by their
+// pids, or all of them without arguments. It outputs a list of their
+// statuses, in the order of the pids, e.g.
+//
+// spawn -b make; spawn -b make test; wait
+func waitFn(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	var pids []int
+	if len(args) == 0 {
+		pids = ev.procs.pids()
+	}
+	for _, a := range args {
+		pid, err := strconv.Atoi(strings.TrimSpace(a.String()))
+		if err != nil {
+			return fmt.Sprintf("bad pid: %s", a.Repr())
+		}
+		pids = append(pids, pid)
+	}
+	statuses := NewTable()
+	for _, pid := range pids {
+		status, err := ev.procs.wait(pid)
+		if err != nil {
+			return err.Error()
+		}
+		statuses.append(NewString(status))
+	}
+	out <- statuses
+	return ""
+}
+
+// signals maps the names of signals, without the SIG prefix, to them.
+var signals = map[string]syscall.Signal{
+	"HUP": syscall.SIGHUP, "INT": syscall.SIGINT, "QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL, "TERM": syscall.SIGTERM, "ALRM": syscall.SIGALRM,
+	"USR1": syscall.SIGUSR1, "USR2": syscall.SIGUSR2, "PIPE": syscall.SIGPIPE,
+	"CHLD": syscall.SIGCHLD, "STOP": syscall.SIGSTOP, "CONT": syscall.SIGCONT,
+	"TSTP": syscall.SIGTSTP, "WINCH": syscall.SIGWINCH,
+}
+
+// parseSignal parses a signal given by its name, with or without the SIG
+// prefix and in any case, or its number.
+func parseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+		return syscall.Signal(n), nil
+	}
+	name := strings.TrimPrefix(strings.ToUpper(s), "SIG")
+	if sig, ok := signals[name]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("bad signal: %s", s)
+}
+
+// pidOf returns the pid given by v, either as a number or as a table with a
+// pid key like those from procs.
+func pidOf(v Value) (int, error) {
+	s := v
+	if t, ok := v.(*Table); ok {
+		s, ok = t.lookup("pid")
+		if !ok {
+			return 0, fmt.Errorf("bad pid: %s", v.Repr())
+		}
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(s.String()))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("bad pid: %s", v.Repr())
+	}
+	return pid, nil
+}
+
+// killFn sends a signal, TERM unless given as the first argument like -INT,
+// -SIGINT or -9, to processes given by their pids or the tables of procs,
+// e.g.
+//
+// spawn -b sleep 10; kill -HUP $last-pid
+// procs | each {|p| kill $p }
+func killFn(ev *Evaluator, args []Value) string {
+	sig := syscall.SIGTERM
+	if len(args) > 0 {
+		if s := args[0].String(); strings.HasPrefix(s, "-") {
+			var err error
+			sig, err = parseSignal(s[1:])
+			if err != nil {
+				return err.Error()
+			}
+			args = args[1:]
+		}
+	}
+	if len(args) == 0 {
+		return "args error"
+	}
+	for _, a := range args {
+		pid, err := pidOf(a)
+		if err != nil {
+			return err.Error()
+		}
+		if err := syscall.Kill(pid, sig); err != nil {
+			return fmt.Sprintf("kill %d: %s", pid, err)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,136 @@
+package eval
+
+// Profiling elvish code. While profiling, the Evaluator records how many times
+// each form is run and how long it takes, from when it starts until it
+// terminates, so the time of a form includes the time of the forms it calls.
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xiaq/elvish/parse"
+	"github.com/xiaq/elvish/util"
+)
+
+// ProfileEntry is what has been recorded for a form.
+type ProfileEntry struct {
+	// Name is the name of the code the form is in, like in error messages.
+	Name string
+	// Line and Col are where the form starts, counted from 1.
+	Line, Col int
+	// Source is the line the form starts on.
+	Source string
+	Count  int
+	Time   time.Duration
+}
+
+type profileKey struct {
+	name string
+	pos  parse.Pos
+}
+
+type profileCounter struct {
+	text  string
+	count int
+	time  time.Duration
+}
+
+type profiler struct {
+	mutex    sync.Mutex
+	w        io.Writer
+	counters map[profileKey]*profileCounter
+}
+
+// StartProfile starts profiling the code evaluated from now on. The report is
+// written to w when StopProfile is called, or when Exit is.
+func (ev *Evaluator) StartProfile(w io.Writer) {
+	ev.profiler = &profiler{w: w, counters: make(map[profileKey]*profileCounter)}
+}
+
+// StopProfile stops profiling and writes the report, unless it has been
+// written already.
+func (ev *Evaluator) StopProfile() {
+	p := ev.profiler
+	if p == nil {
+		return
+	}
+	ev.profiler = nil
+	p.mutex.Lock()
+	w := p.w
+	p.w = nil
+	p.mutex.Unlock()
+	if w != nil {
+		WriteProfile(w, p.entries())
+	}
+}
+
+// record adds a run of the form at pos, which started at start.
+func (p *profiler) record(name, text string, pos parse.Pos, start time.Time) {
+	d := time.Since(start)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	key := profileKey{name, pos}
+	c, ok := p.counters[key]
+	if !ok {
+		c = &profileCounter{text: text}
+		p.counters[key] = c
+	}
+	c.count++
+	c.time += d
+}
+
+// entries returns the entries of the forms recorded, the slowest first.
+func (p *profiler) entries() []ProfileEntry {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	entries := make([]ProfileEntry, 0, len(p.counters))
+	for key, c := range p.counters {
+		lineno, colno, line := util.FindContext(c.text, int(key.pos))
+		entries = append(entries, ProfileEntry{key.name, lineno + 1, colno + 1, line, c.count, c.time})
+	}
+	sort.Sort(profileEntries(entries))
+	return entries
+}
+
+type profileEntries []ProfileEntry
+
+func (es profileEntries) Len() int      { return len(es) }
+func (es profileEntries) Swap(i, j int) { es[i], es[j] = es[j], es[i] }
+func (es profileEntries) Less(i, j int) bool {
+	a, b := es[i], es[j]
+	if a.Time != b.Time {
+		return a.Time > b.Time
+	}
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	if a.Line != b.Line {
+		return a.Line < b.Line
+	}
+	return a.Col < b.Col
+}
+
+// WriteProfile writes a report of entries, with a line for each form giving
+// its time, count and location, followed by the source line it starts on.
+func WriteProfile(w io.Writer, entries []ProfileEntry) {
+	fmt.Fprintf(w, "%10s %6s  %s\n", "time", "count", "location")
+	for _, e := range entries {
+		source := strings.TrimSpace(e.Source)
+		fmt.Fprintf(w, "%10s %6d  %s:%d:%d  %s\n",
+			roundDuration(e.Time), e.Count, e.Name, e.Line, e.Col, source)
+	}
+}
+
+// roundDuration rounds d to 4 significant digits, which is enough to compare
+// the times of forms.
+func roundDuration(d time.Duration) time.Duration {
+	unit := time.Duration(1)
+	for d/unit >= 10000 {
+		unit *= 10
+	}
+	return (d + unit/2) / unit * unit
+}
@@ -0,0 +1,218 @@
+package eval
+
+// Prompts and other hooks defined by elvish closures, whose output is shown
+// by the editor.
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// PromptFunc returns a function that calls the closure in the global variable
+// name, like $prompt or $rprompt, and concatenates the string forms of the
+// values it outputs. The output may contain SGR escape sequences for styling.
+// fallback is used instead when the variable does not hold a closure with a
+// body, or when it cannot be called.
+func (ev *Evaluator) PromptFunc(name string, fallback func() string) func() string {
+	return func() string {
+		return ev.renderPrompt(name, fallback)
+	}
+}
+
+func (ev *Evaluator) renderPrompt(name string, fallback func() string) string {
+	p, ok := ev.scope.lookup(name)
+	if !ok {
+		return fallback()
+	}
+	c, ok := p.Get().(*Closure)
+	if !ok || c.Op == nil {
+		return fallback()
+	}
+
+	values, msg := ev.captureClosure(c, hookArgs(name, c, nil))
+	if msg != "" {
+		return fallback()
+	}
+	buf := new(bytes.Buffer)
+	for _, v := range values {
+		buf.WriteString(v.String())
+	}
+	return buf.String()
+}
+
+// PromptTimeout is how long an AsyncPrompt may take to render before it is
+// canceled, keeping the prompt rendered before.
+var PromptTimeout = 5 * time.Second
+
+// AsyncPrompt renders a prompt like PromptFunc, but in the background with a
+// copy of the Evaluator, so that a slow prompt, like one showing the status
+// of a git repository, never holds up reading a line:
+//
+//	prompt := ev.AsyncPromptFunc("prompt", fallback)
+//	prompt.OnUpdate(ed.Redraw)
+//	prompt.Refresh()
+//	prompt.Wait(time.Now().Add(50 * time.Millisecond))
+//	ed.ReadLine(prompt.Get, rprompt.Get)
+//
+// Until a new prompt has been rendered, the last one is shown.
+type AsyncPrompt struct {
+	ev       *Evaluator
+	name     string
+	fallback func() string
+
+	mutex    sync.Mutex
+	current  string
+	gen      int                // Incremented each time rendering starts.
+	cancel   context.CancelFunc // Cancels the rendering in progress.
+	done     chan struct{}      // Closed when the rendering in progress ends.
+	onUpdate func()
+}
+
+// AsyncPromptFunc returns an AsyncPrompt for the closure in the global
+// variable name, with fallback like PromptFunc. Until the prompt has been
+// rendered, it is the fallback.
+func (ev *Evaluator) AsyncPromptFunc(name string, fallback func() string) *AsyncPrompt {
+	done := make(chan struct{})
+	close(done)
+	return &AsyncPrompt{ev: ev, name: name, fallback: fallback, current: fallback(), done: done}
+}
+
+// OnUpdate sets a function called from another goroutine when a newly
+// rendered prompt differs from the one before.
+func (p *AsyncPrompt) OnUpdate(f func()) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.onUpdate = f
+}
+
+// Get returns the prompt rendered last.
+func (p *AsyncPrompt) Get() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.current
+}
+
+// Refresh starts rendering the prompt again in the background, canceling the
+// rendering in progress, if any.
+func (p *AsyncPrompt) Refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), PromptTimeout)
+	done := make(chan struct{})
+	p.mutex.Lock()
+	if p.cancel != nil {
+		p.cancel()
+	}
+	p.gen++
+	gen := p.gen
+	p.cancel, p.done = cancel, done
+	p.mutex.Unlock()
+
+	go func() {
+		defer close(done)
+		defer cancel()
+		newEv := p.ev.copy()
+		defer newEv.releasePorts()
+		var s string
+		err := newEv.withCancelState(ctx, func() error {
+			s = newEv.renderPrompt(p.name, p.fallback)
+			return nil
+		})
+		if err != nil || ctx.Err() != nil {
+			// Canceled or timed out; the last prompt stays.
+			return
+		}
+		p.mutex.Lock()
+		if gen != p.gen {
+			p.mutex.Unlock()
+			return
+		}
+		changed := s != p.current
+		p.current, p.cancel = s, nil
+		onUpdate := p.onUpdate
+		p.mutex.Unlock()
+		if changed && onUpdate != nil {
+			onUpdate()
+		}
+	}()
+}
+
+// Cancel cancels the rendering in progress, if any, and waits until it ends,
+// so that it doesn't run alongside code evaluated afterwards. The last prompt
+// stays.
+func (p *AsyncPrompt) Cancel() {
+	p.mutex.Lock()
+	if p.cancel != nil {
+		p.cancel()
+		p.cancel = nil
+	}
+	p.gen++
+	done := p.done
+	p.mutex.Unlock()
+	<-done
+}
+
+// Wait waits until the rendering in progress ends, but not past deadline. It
+// returns whether the rendering has ended.
+func (p *AsyncPrompt) Wait(deadline time.Time) bool {
+	p.mutex.Lock()
+	done := p.done
+	p.mutex.Unlock()
+	select {
+	case <-done:
+		return true
+	case <-time.After(time.Until(deadline)):
+		return false
+	}
+}
+
+// HookOutput calls the closure in the global variable name without arguments,
+// like $motd-hook, and returns what it outputs, instead of letting it write to
+// the terminal: the string forms of the values it outputs, one per line,
+// followed by what it writes to its standard output. It also returns the exit
+// value of the closure. Nothing is output if the variable does not hold a
+// closure with a body.
+func (ev *Evaluator) HookOutput(name string) (string, string) {
+	p, ok := ev.scope.lookup(name)
+	if !ok {
+		return "", ""
+	}
+	c, ok := p.Get().(*Closure)
+	if !ok || c.Op == nil {
+		return "", ""
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return "", err.Error()
+	}
+	var written []byte
+	readDone := make(chan bool)
+	go func() {
+		written, _ = ioutil.ReadAll(r)
+		r.Close()
+		readDone <- true
+	}()
+	buf := new(bytes.Buffer)
+	ch := make(chan Value, chanPipeSize)
+	outputDone := make(chan bool)
+	go func() {
+		for v := range ch {
+			buf.WriteString(v.String() + "\n")
+		}
+		outputDone <- true
+	}()
+
+	newEv := ev.copy()
+	newEv.setPort(1, &port{f: w, ch: ch})
+	msg := newEv.callClosure(c, hookArgs(name, c, nil))
+	newEv.releasePorts()
+	close(ch)
+	w.Close()
+	<-outputDone
+	<-readDone
+	buf.Write(written)
+	return buf.String(), msg
+}
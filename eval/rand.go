@@ -0,0 +1,89 @@
+package eval
+
+// Random numbers and UUIDs.
+
+import (
+	crand "crypto/rand"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// randState is the source of rand and randint, shared by all Evaluators. It is
+// seeded with the time, unless a script calls rand-seed to get reproducible
+// numbers.
+var randState = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// randFn outputs a random number in [0, 1).
+func randFn(ev *Evaluator, args []Value) string {
+	if len(args) != 0 {
+		return "args error"
+	}
+	randState.Lock()
+	f := randState.Float64()
+	randState.Unlock()
+	ev.ports[1].ch <- NewString(strconv.FormatFloat(f, 'g', -1, 64))
+	return ""
+}
+
+// randint outputs a random integer in [low, high), e.g.
+//
+// randint 1 7 # a die roll
+func randint(ev *Evaluator, args []Value) string {
+	if len(args) != 2 {
+		return "args error"
+	}
+	low, err := strconv.ParseInt(args[0].String(), 10, 64)
+	if err != nil {
+		return fmt.Sprintf("bad integer %s", args[0].Repr())
+	}
+	high, err := strconv.ParseInt(args[1].String(), 10, 64)
+	if err != nil {
+		return fmt.Sprintf("bad integer %s", args[1].Repr())
+	}
+	if high <= low {
+		return "high must be larger than low"
+	}
+	randState.Lock()
+	n := low + randState.Int63n(high-low)
+	randState.Unlock()
+	ev.ports[1].ch <- NewString(strconv.FormatInt(n, 10))
+	return ""
+}
+
+// randSeed seeds the source of rand and randint, so that the numbers that
+// follow are the same each time.
+func randSeed(ev *Evaluator, args []Value) string {
+	if len(args) != 1 {
+		return "args error"
+	}
+	seed, err := strconv.ParseInt(args[0].String(), 10, 64)
+	if err != nil {
+		return fmt.Sprintf("bad integer %s", args[0].Repr())
+	}
+	randState.Lock()
+	randState.Seed(seed)
+	randState.Unlock()
+	return ""
+}
+
+// uuid outputs a random (version 4) UUID. UUIDs don't come from the source
+// of rand, so they are unique even after rand-seed.
+func uuid(ev *Evaluator, args []Value) string {
+	if len(args) != 0 {
+		return "args error"
+	}
+	var b [16]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return err.Error()
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	ev.ports[1].ch <- NewString(fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]))
+	return ""
+}
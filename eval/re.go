@@ -0,0 +1,174 @@
+package eval
+
+// The re: builtins.
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"unicode/utf8"
+)
+
+// compileRegexp compiles the pattern given as an argument.
+func compileRegexp(v Value) (*regexp.Regexp, string) {
+	re, err := regexp.Compile(v.String())
+	if err != nil {
+		return nil, "bad regexp: " + err.Error()
+	}
+	return re, ""
+}
+
+// reMatch outputs true or false, depending on whether a string contains a
+// match of a regexp, e.g.
+//
+// re:match `^[0-9]+$` $x
+func reMatch(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	if len(args) != 2 {
+		return "args error"
+	}
+	re, msg := compileRegexp(args[0])
+	if re == nil {
+		return msg
+	}
+	s := "false"
+	if re.MatchString(args[1].String()) {
+		s = "true"
+	}
+	out <- NewString(s)
+	return ""
+}
+
+// reMatchTable describes a match of re in s, whose submatch indices in bytes
+// are loc, as a table
+//
+// [&text a=1 &start 0 &end 3 &groups [[&text a &start 0 &end 1] ...]]
+//
+// Offsets are counted in runes, like those of str:index. The groups list
+// has one entry for each parenthesized subexpression, and named ones are also
+// in its dict part. Groups that did not participate in the match have an
+// empty text and offsets of -1.
+func reMatchTable(re *regexp.Regexp, s string, loc []int) *Table {
+	span := func(i, j int) *Table {
+		t := NewTable()
+		text, start, end := "", -1, -1
+		if i >= 0 {
+			text = s[i:j]
+			start = utf8.RuneCountInString(s[:i])
+			end = start + utf8.RuneCountInString(text)
+		}
+		t.put(NewString("text"), NewString(text))
+		t.put(NewString("start"), NewString(strconv.Itoa(start)))
+		t.put(NewString("end"), NewString(strconv.Itoa(end)))
+		return t
+	}
+	m := span(loc[0], loc[1])
+	groups := NewTable()
+	for i, name := range re.SubexpNames()[1:] {
+		g := span(loc[2*i+2], loc[2*i+3])
+		groups.append(g)
+		if name != "" {
+			groups.put(NewString(name), g)
+		}
+	}
+	m.put(NewString("groups"), groups)
+	return m
+}
+
+// reFindAll outputs a table for each non-overlapping match of a regexp in a
+// string, as described by reMatchTable, e.g.
+//
+// re:find-all `(?P<key>\w+)=(\w+)` `a=1 b=2`
+//
+// At most n matches are found if n is given.
+func reFindAll(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	if len(args) != 2 && len(args) != 3 {
+		return "args error"
+	}
+	re, msg := compileRegexp(args[0])
+	if re == nil {
+		return msg
+	}
+	n := -1
+	if len(args) == 3 {
+		var err error
+		n, err = strconv.Atoi(args[2].String())
+		if err != nil || n < 0 {
+			return "match count must be a non-negative integer"
+		}
+	}
+	s := args[1].String()
+	for _, loc := range re.FindAllStringSubmatchIndex(s, n) {
+		out <- reMatchTable(re, s, loc)
+	}
+	return ""
+}
+
+// reReplace outputs a string with all matches of a regexp replaced. The
+// replacement is either a string, in which $1 and ${name} stand for groups,
+// or a closure, which is called with the table of each match (see
+// reMatchTable) and whose outputs are concatenated, e.g.
+//
+// re:replace `[0-9]+` {|m| + $m[text] 1} `a1 b2`
+func reReplace(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	if len(args) != 3 {
+		return "args error"
+	}
+	re, msg := compileRegexp(args[0])
+	if re == nil {
+		return msg
+	}
+	s := args[2].String()
+	c, ok := args[1].(*Closure)
+	if !ok {
+		out <- NewString(re.ReplaceAllString(s, args[1].String()))
+		return ""
+	}
+	buf := new(bytes.Buffer)
+	last := 0
+	for _, loc := range re.FindAllStringSubmatchIndex(s, -1) {
+		buf.WriteString(s[last:loc[0]])
+		values, msg := ev.captureClosure(c, []Value{reMatchTable(re, s, loc)})
+		if msg != "" {
+			return msg
+		}
+		for _, v := range values {
+			buf.WriteString(v.String())
+		}
+		last = loc[1]
+	}
+	buf.WriteString(s[last:])
+	out <- NewString(buf.String())
+	return ""
+}
+
+// reSplit outputs a list of the parts of a string separated by matches of a
+// regexp, at most n parts if n is given, e.g.
+//
+// re:split `\s*,\s*` `a, b ,c`
+func reSplit(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	if len(args) != 2 && len(args) != 3 {
+		return "args error"
+	}
+	re, msg := compileRegexp(args[0])
+	if re == nil {
+		return msg
+	}
+	n := -1
+	if len(args) == 3 {
+		var err error
+		n, err = strconv.Atoi(args[2].String())
+		if err != nil || n < 0 {
+			return "part count must be a non-negative integer"
+		}
+	}
+	t := NewTable()
+	for _, part := range re.Split(args[1].String(), n) {
+		t.append(NewString(part))
+	}
+	out <- t
+	return ""
+}
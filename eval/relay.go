@@ -0,0 +1,217 @@
+package eval
+
+// Relaying command output through pipes.
+
+import (
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/xiaq/elvish/sys"
+)
+
+const (
+	relayBufferSize    = 32 * 1024
+	relayWriteSize     = 4 * 1024
+	relayDrainMaxDelay = time.Second
+)
+
+// relay copies what is written to a pipe to dst and to its tees, like a
+// sessionLogWriter. It reads into a buffer of a fixed size and writes to dst
+// a small chunk at a time, so that a command writing megabytes of output
+// neither makes elvish buffer all of it nor blocks on a single huge write.
+type relay struct {
+	r   *os.File
+	rfd int // The file descriptor of r, got before the relay starts.
+	fd  int // The port of the Evaluator whose output is relayed.
+	dst io.Writer
+	// The port replaced by the pipe, for teeOutput to restore.
+	orig  *port
+	mutex sync.Mutex
+	tees  []io.Writer
+	// Whether data may have been read and not yet written. The relay only
+	// reads while busy, so when it is not busy, what is left in the pipe is
+	// all that has not been relayed.
+	busy bool
+	done bool // Whether the pipe has been read to its end.
+	// Closed and replaced whenever the relay stops being busy.
+	progress chan struct{}
+}
+
+func newRelay(r *os.File, fd int, dst io.Writer, tees ...io.Writer) *relay {
+	// Fd puts r in blocking mode, so it is called here once instead of by
+	// the goroutines that use the relay.
+	return &relay{r: r, rfd: int(r.Fd()), fd: fd, dst: dst, tees: tees,
+		progress: make(chan struct{})}
+}
+
+// addTee makes w also get what is relayed from now on.
+func (rl *relay) addTee(w io.Writer) {
+	rl.mutex.Lock()
+	rl.tees = append(rl.tees, w)
+	rl.mutex.Unlock()
+}
+
+// removeTee stops w from getting what is relayed, and returns how many tees
+// are left.
+func (rl *relay) removeTee(w io.Writer) int {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	tees := rl.tees[:0:0]
+	for _, t := range rl.tees {
+		if t != w {
+			tees = append(tees, t)
+		}
+	}
+	rl.tees = tees
+	return len(tees)
+}
+
+func (rl *relay) setBusy(busy bool) {
+	rl.mutex.Lock()
+	rl.busy = busy
+	if !busy {
+		close(rl.progress)
+		rl.progress = make(chan struct{})
+	}
+	rl.mutex.Unlock()
+}
+
+func (rl *relay) run() {
+	defer func() {
+		rl.mutex.Lock()
+		rl.done = true
+		rl.mutex.Unlock()
+		rl.setBusy(false)
+	}()
+	buf := make([]byte, relayBufferSize)
+	for {
+		// Wait until the pipe is readable before becoming busy, so that
+		// the read below doesn't block while the relay is busy.
+		if _, err := readable(rl.rfd, nil); err != nil {
+			return
+		}
+		rl.setBusy(true)
+		n, err := rl.r.Read(buf)
+		if n > 0 {
+			for i := 0; i < n; i += relayWriteSize {
+				j := i + relayWriteSize
+				if j > n {
+					j = n
+				}
+				rl.dst.Write(buf[i:j])
+			}
+			rl.mutex.Lock()
+			tees := rl.tees
+			rl.mutex.Unlock()
+			for _, w := range tees {
+				w.Write(buf[:n])
+			}
+		}
+		if err != nil {
+			return
+		}
+		rl.setBusy(false)
+	}
+}
+
+// caughtUp reports whether everything written to the pipe so far has been
+// relayed. If not, it also returns a channel that is closed when the relay
+// has made progress.
+func (rl *relay) caughtUp() (bool, <-chan struct{}) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	if rl.done {
+		return true, nil
+	}
+	if !rl.busy {
+		if ok, err := readable(rl.rfd, &syscall.Timeval{}); err != nil || !ok {
+			return true, nil
+		}
+	}
+	return false, rl.progress
+}
+
+// readable waits until fd is readable, or until the timeout if it is not
+// nil, and reports whether fd is readable.
+func readable(fd int, timeout *syscall.Timeval) (bool, error) {
+	for {
+		fs := sys.NewFdSet(fd)
+		_, err := sys.Select(fd+1, fs, nil, nil, timeout)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		return fs.IsSet(fd), nil
+	}
+}
+
+// teeOutput makes what is written to port fd of ev also be written to w,
+// making the port pass through a relay if it doesn't already.
+func (ev *Evaluator) teeOutput(fd int, w io.Writer) error {
+	for _, rl := range ev.relays {
+		if rl.fd == fd {
+			rl.addTee(w)
+			return nil
+		}
+	}
+	dst := ev.ports[fd].f
+	if dst == nil {
+		return nil
+	}
+	r, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	rl := newRelay(r, fd, dst, w)
+	rl.orig = ev.ports[fd]
+	go rl.run()
+	ev.relays = append(ev.relays, rl)
+	ev.ports[fd] = newFilePort(pw)
+	return nil
+}
+
+// unteeOutput undoes teeOutput. Once nothing is teed from port fd of ev, the
+// port is written to directly again, and the relay ends after the commands
+// still writing to the pipe are done.
+func (ev *Evaluator) unteeOutput(fd int, w io.Writer) {
+	for i, rl := range ev.relays {
+		if rl.fd != fd {
+			continue
+		}
+		if rl.removeTee(w) > 0 {
+			return
+		}
+		ev.ports[fd].release()
+		ev.ports[fd] = rl.orig
+		ev.relays = append(ev.relays[:i:i], ev.relays[i+1:]...)
+		return
+	}
+}
+
+// drainRelays waits until the relays of ev have caught up with the output
+// written so far, so that the editor doesn't draw the prompt in the middle
+// of it. Since commands in the background may keep writing, it gives up after
+// relayDrainMaxDelay.
+func (ev *Evaluator) drainRelays() {
+	if len(ev.relays) == 0 {
+		return
+	}
+	deadline := time.After(relayDrainMaxDelay)
+	for _, rl := range ev.relays {
+		for {
+			ok, progress := rl.caughtUp()
+			if ok {
+				break
+			}
+			select {
+			case <-progress:
+			case <-deadline:
+				return
+			}
+		}
+	}
+}
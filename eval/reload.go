@@ -0,0 +1,205 @@
+package eval
+
+// The rc files and shell:reload, which evaluates them again in the running
+// session.
+//
+// The variables and functions an rc file defines are remembered when it is
+// loaded. When the rc files are reloaded, definitions that the rc files no
+// longer make are removed, instead of lingering from the previous load, and
+// definitions that have been changed in the session since the last load are
+// kept and reported as conflicts, instead of being overwritten.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/xiaq/elvish/parse"
+)
+
+type rcState struct {
+	paths []string
+	// The values left by the last load of the names the rc files defined.
+	defs map[string]Value
+	// The values before the first load of the builtin variables, like
+	// $prompt, that are restored when the rc files no longer set them.
+	initial map[string]Value
+	hook    func()
+	loading bool
+}
+
+// SetReloadHook sets a function to be called before shell:reload evaluates
+// the rc files again, e.g. to reset key bindings.
+func (ev *Evaluator) SetReloadHook(f func()) {
+	ev.rc.hook = f
+}
+
+// SourceRC evaluates the rc file at path, and remembers it and the definitions
+// it makes for shell:reload. The file is remembered even if it doesn't exist
+// yet.
+func (ev *Evaluator) SourceRC(path string) error {
+	ev.rc.loading = true
+	defer func() { ev.rc.loading = false }()
+	if ev.rc.defs == nil {
+		ev.rc.defs = make(map[string]Value)
+		ev.rc.initial = ev.snapshot()
+	}
+	ev.rc.paths = append(ev.rc.paths, path)
+	before := ev.snapshot()
+	err := ev.Source(path)
+	for name, v := range ev.defsSince(before) {
+		ev.rc.defs[name] = v
+	}
+	return err
+}
+
+func (ev *Evaluator) snapshot() map[string]Value {
+	vars := ev.scope.all()
+	values := make(map[string]Value, len(vars))
+	for name, v := range vars {
+		values[name] = v.Get()
+	}
+	return values
+}
+
+// defsSince returns the variables created or set since the snapshot before
+// was taken, with their values. Variables maintained by the shell, like
+// $status and those backed by Go code, are not definitions.
+func (ev *Evaluator) defsSince(before map[string]Value) map[string]Value {
+	defs := make(map[string]Value)
+	for name, v := range ev.scope.all() {
+		if v == ev.status || v == ev.pwd || v == ev.lastPid || v.get != nil {
+			continue
+		}
+		if old, ok := before[name]; !ok || old != v.Get() {
+			defs[name] = v.Get()
+		}
+	}
+	return defs
+}
+
+// Source evaluates the file at path.
+func (ev *Evaluator) Source(path string) error {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !utf8.Valid(bytes) {
+		return fmt.Errorf("source %v is not valid UTF-8", path)
+	}
+	src := string(bytes)
+	n, err := parse.Parse(path, src)
+	if err != nil {
+		return err
+	}
+	return ev.Eval(path, src, n)
+}
+
+// sameDef determines whether two values of a definition are the same.
+// Closures are only equal to themselves, and are always considered the same.
+func sameDef(a, b Value) bool {
+	_, ok1 := a.(*Closure)
+	_, ok2 := b.(*Closure)
+	if ok1 && ok2 {
+		return true
+	}
+	return a.Eq(b)
+}
+
+func defName(name string) string {
+	if strings.HasPrefix(name, "fn-") {
+		return "fn " + name[3:]
+	}
+	return "$" + name
+}
+
+func init() {
+	// Needed to avoid initialization loop
+	builtinFuncs["shell:reload"] = builtinFunc{reload, [2]StreamType{0, fdStream}}
+}
+
+// reload implements shell:reload, which evaluates the rc files again and
+// prints what has changed, e.g.
+//
+// added $editor
+// updated $paths
+// removed fn ll
+// conflict: kept $prompt, which has been changed since the rc files were loaded
+//
+// Errors in the rc files are printed, and the reload goes on with the next
+// file. Changes to functions are applied but not reported, since functions
+// can't be compared.
+func reload(ev *Evaluator, args []Value) string {
+	if len(args) != 0 {
+		return "args error"
+	}
+	rc := ev.rc
+	if rc.loading {
+		return "shell:reload called while loading the rc files"
+	}
+	rc.loading = true
+	defer func() { rc.loading = false }()
+	if rc.hook != nil {
+		rc.hook()
+	}
+
+	// Definitions changed in the session since the last load.
+	changed := make(map[string]Value)
+	for name, v := range rc.defs {
+		if current, ok := ev.scope.lookup(name); ok && current.Get() != v {
+			changed[name] = current.Get()
+		}
+	}
+
+	before := ev.snapshot()
+	for _, path := range rc.paths {
+		err := ev.Source(path)
+		if err != nil && !os.IsNotExist(err) {
+			printError(err)
+		}
+	}
+	defs := ev.defsSince(before)
+
+	var report []string
+	for name, v := range defs {
+		old, existed := rc.defs[name]
+		if current, ok := changed[name]; ok {
+			ev.scope.get(name).Set(current)
+			report = append(report, fmt.Sprintf("conflict: kept %s, which has been changed since the rc files were loaded", defName(name)))
+		} else if !existed {
+			report = append(report, "added "+defName(name))
+		} else if !sameDef(old, v) {
+			report = append(report, "updated "+defName(name))
+		}
+	}
+	for name := range rc.defs {
+		if _, ok := defs[name]; ok {
+			continue
+		}
+		if _, ok := changed[name]; ok {
+			report = append(report, fmt.Sprintf("conflict: kept %s, which is no longer defined by the rc files but has been changed", defName(name)))
+			delete(rc.defs, name)
+			continue
+		}
+		if initial, ok := rc.initial[name]; ok {
+			ev.scope.get(name).Set(initial)
+		} else {
+			ev.scope.remove(name)
+		}
+		report = append(report, "removed "+defName(name))
+		delete(rc.defs, name)
+	}
+	for name, v := range defs {
+		rc.defs[name] = v
+	}
+
+	sort.Strings(report)
+	out := ev.ports[1].f
+	for _, line := range report {
+		fmt.Fprintln(out, line)
+	}
+	return ""
+}
@@ -0,0 +1,371 @@
+package eval
+
+// Values owning OS resources, and their release.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/xiaq/elvish/util"
+)
+
+var errAlreadyClosed = errors.New("already closed")
+
+// resource is an OS resource owned by a Value. It is released either with
+// the close builtin, or by a finalizer when the Value is garbage collected
+// without being closed, so that abandoning a Value doesn't leak the
+// resource forever.
+type resource struct {
+	mutex  sync.Mutex
+	closer io.Closer
+	closed bool
+}
+
+func (r *resource) close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return errAlreadyClosed
+	}
+	r.closed = true
+	return r.closer.Close()
+}
+
+func (r *resource) isClosed() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.closed
+}
+
+// Closer is a Value owning an OS resource.
+type Closer interface {
+	Value
+	Close() error
+}
+
+// setFinalizer arranges for the resource of v to be released when v is
+// garbage collected.
+func setFinalizer(v Closer) {
+	runtime.SetFinalizer(v, func(v Closer) {
+		v.Close()
+	})
+}
+
+type FileType struct {
+}
+
+// Default returns a File that is already closed.
+func (ft FileType) Default() Value {
+	return &File{resource: resource{closed: true}}
+}
+
+func (ft FileType) Caret(t Type) Type {
+	return AnyType{}
+}
+
+// File is an open file, which may also be one end of a pipe or a socket. It
+// can be redirected to, e.g. echo hello >$f.
+type File struct {
+	resource
+	f    *os.File
+	name string
+}
+
+// NewFile returns a File owning f.
+func NewFile(f *os.File, name string) *File {
+	file := &File{resource{closer: f}, f, name}
+	setFinalizer(file)
+	return file
+}
+
+func (f *File) Type() Type {
+	return FileType{}
+}
+
+func (f *File) Repr() string {
+	if f.isClosed() {
+		return fmt.Sprintf("<File %s (closed)>", quote(f.name))
+	}
+	return fmt.Sprintf("<File %s (fd %d)>", quote(f.name), f.f.Fd())
+}
+
+func (f *File) String() string {
+	return f.Repr()
+}
+
+func (f *File) Caret(ev *Evaluator, v Value) Value {
+	ev.errorf("File cannot be careted")
+	return nil
+}
+
+// Eq determines whether two values are the same File.
+func (f *File) Eq(v Value) bool {
+	return f == v
+}
+
+func (f *File) Hash() uint32 {
+	return hashPointer(f)
+}
+
+func (f *File) Close() error {
+	return f.close()
+}
+
+var fopenFlags = map[string]int{
+	"r":  os.O_RDONLY,
+	"w":  os.O_WRONLY | os.O_CREATE | os.O_TRUNC,
+	"a":  os.O_WRONLY | os.O_CREATE | os.O_APPEND,
+	"rw": os.O_RDWR | os.O_CREATE,
+}
+
+// fopen outputs an open File, e.g.
+//
+// fopen /tmp/log a
+//
+// The mode is one of r (the default), w, a and rw. It is also available as
+// open, which shadows the open command of macOS and some Linux desktops; that
+// can still be run with spawn open or by its full path.
+func fopen(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	mode := "r"
+	switch len(args) {
+	case 1:
+	case 2:
+		mode = args[1].String()
+	default:
+		return "args error"
+	}
+	flag, ok := fopenFlags[mode]
+	if !ok {
+		return fmt.Sprintf("bad mode: %s", mode)
+	}
+	name := args[0].String()
+	f, err := os.OpenFile(name, flag, 0644)
+	if err != nil {
+		return err.Error()
+	}
+	out <- NewFile(f, name)
+	return ""
+}
+
+// pipe outputs a table [&read $r &write $w] of the two ends of a new pipe.
+func pipe(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	if len(args) > 0 {
+		return "args error"
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err.Error()
+	}
+	t := NewTable()
+	t.put(NewString("read"), NewFile(r, "pipe read end"))
+	t.put(NewString("write"), NewFile(w, "pipe write end"))
+	out <- t
+	return ""
+}
+
+// netDial outputs a File for a new connection, e.g.
+//
+// net:dial tcp localhost:8080
+// net:dial unix /tmp/sock
+func netDial(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	if len(args) != 2 {
+		return "args error"
+	}
+	network, addr := args[0].String(), args[1].String()
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return err.Error()
+	}
+	f, err := connFile(conn, network+":"+addr)
+	if err != nil {
+		return err.Error()
+	}
+	out <- f
+	return ""
+}
+
+// connFile returns a File for a connection, which it closes. The File is
+// made from a duplicate of the fd, so that it can be redirected to like any
+// other File.
+func connFile(conn net.Conn, name string) (*File, error) {
+	defer conn.Close()
+	fc, ok := conn.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("network %s not supported", conn.LocalAddr().Network())
+	}
+	f, err := fc.File()
+	if err != nil {
+		return nil, err
+	}
+	return NewFile(f, name), nil
+}
+
+type ListenerType struct {
+}
+
+// Default returns a Listener that is already closed.
+func (lt ListenerType) Default() Value {
+	return &Listener{resource: resource{closed: true}}
+}
+
+func (lt ListenerType) Caret(t Type) Type {
+	return AnyType{}
+}
+
+// Listener is a socket listening for connections, which are accepted with
+// net:accept.
+type Listener struct {
+	resource
+	l    net.Listener
+	name string
+}
+
+// NewListener returns a Listener owning l.
+func NewListener(l net.Listener) *Listener {
+	addr := l.Addr()
+	listener := &Listener{resource{closer: l}, l, addr.Network() + ":" + addr.String()}
+	setFinalizer(listener)
+	return listener
+}
+
+func (l *Listener) Type() Type {
+	return ListenerType{}
+}
+
+func (l *Listener) Repr() string {
+	if l.isClosed() {
+		return fmt.Sprintf("<Listener %s (closed)>", quote(l.name))
+	}
+	return fmt.Sprintf("<Listener %s>", quote(l.name))
+}
+
+func (l *Listener) String() string {
+	return l.Repr()
+}
+
+func (l *Listener) Caret(ev *Evaluator, v Value) Value {
+	ev.errorf("Listener cannot be careted")
+	return nil
+}
+
+// Eq determines whether two values are the same Listener.
+func (l *Listener) Eq(v Value) bool {
+	return l == v
+}
+
+func (l *Listener) Hash() uint32 {
+	return hashPointer(l)
+}
+
+func (l *Listener) Close() error {
+	return l.close()
+}
+
+// netListen outputs a Listener on an address, e.g.
+//
+// net:listen tcp localhost:8080
+// net:listen unix /tmp/sock
+//
+// The file of a Unix socket is removed when the Listener is closed.
+func netListen(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	if len(args) != 2 {
+		return "args error"
+	}
+	l, err := net.Listen(args[0].String(), args[1].String())
+	if err != nil {
+		return err.Error()
+	}
+	out <- NewListener(l)
+	return ""
+}
+
+// acceptPollInterval is how often net:accept checks whether the evaluation
+// has been canceled while waiting for a connection.
+const acceptPollInterval = 100 * time.Millisecond
+
+// netAccept waits for a connection to a Listener and outputs a File for it,
+// e.g.
+//
+// var $l listener; l = (net:listen tcp localhost:8080)
+// var $c file; c = (net:accept $l); read-line < $c; echo hello > $c
+func netAccept(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	if len(args) != 1 {
+		return "args error"
+	}
+	l, ok := args[0].(*Listener)
+	if !ok {
+		return fmt.Sprintf("not a listener: %s", args[0].Repr())
+	}
+	if l.isClosed() {
+		return fmt.Sprintf("listener %s closed", quote(l.name))
+	}
+	dl, canPoll := l.l.(interface {
+		SetDeadline(time.Time) error
+	})
+	for {
+		if canPoll && ev.cancel != nil {
+			dl.SetDeadline(time.Now().Add(acceptPollInterval))
+		}
+		conn, err := l.l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				ev.checkCanceled()
+				continue
+			}
+			return err.Error()
+		}
+		if canPoll {
+			dl.SetDeadline(time.Time{})
+		}
+		f, err := connFile(conn, l.name+" from "+conn.RemoteAddr().String())
+		if err != nil {
+			return err.Error()
+		}
+		out <- f
+		return ""
+	}
+}
+
+// daemonSocket outputs the path of the Unix socket of elvishd, the daemon
+// keeping the shared state of elvish processes, e.g.
+//
+// net:dial unix (shell:daemon-socket)
+func daemonSocket(ev *Evaluator, args []Value) string {
+	if len(args) != 0 {
+		return "args error"
+	}
+	name, err := util.SocketName()
+	if err != nil {
+		return err.Error()
+	}
+	ev.ports[1].ch <- NewString(name)
+	return ""
+}
+
+// closeFn releases the resources of its arguments deterministically, instead
+// of waiting for them to be garbage collected.
+func closeFn(ev *Evaluator, args []Value) string {
+	for _, a := range args {
+		c, ok := a.(Closer)
+		if !ok {
+			return fmt.Sprintf("cannot close %s", a.Repr())
+		}
+		if err := c.Close(); err != nil {
+			return err.Error()
+		}
+	}
+	return ""
+}
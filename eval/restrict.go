@@ -0,0 +1,119 @@
+package eval
+
+// Restricted mode, for evaluating code that is not trusted, like the prompt
+// of a shared config or the hooks of a plugin manifest.
+
+import (
+	"os"
+
+	"github.com/xiaq/elvish/parse"
+)
+
+// What restricted mode does not allow, used in error messages.
+const (
+	runningExternals = "running external commands"
+	writingFiles     = "writing files"
+	usingNetwork     = "using the network"
+	controllingShell = "controlling the shell process"
+	signalling       = "sending signals to processes"
+)
+
+// restrictedFuncs maps the builtins that restricted mode keeps from being
+// called to a function returning what a call with some arguments would do
+// that is not allowed, or "" if the call is allowed.
+var restrictedFuncs = map[string]func([]Value) string{
+	"exec":               always(runningExternals),
+	"spawn":              always(runningExternals),
+	"load-module":        always(runningExternals),
+	"fopen":              fopenRestricted,
+	"open":               fopenRestricted,
+	"fs:temp-file":       always(writingFiles),
+	"fs:mkdir":           always(writingFiles),
+	"fs:remove":          always(writingFiles),
+	"store:set":          always(writingFiles),
+	"store:del":          always(writingFiles),
+	"shell:self-upgrade": always(writingFiles),
+	"history:del":        always(writingFiles),
+	"history:prune":      always(writingFiles),
+	"net:dial":           always(usingNetwork),
+	"net:listen":         always(usingNetwork),
+	"net:accept":         always(usingNetwork),
+	"http:get":           always(usingNetwork),
+	"http:post":          always(usingNetwork),
+	"epm:install":        always(usingNetwork),
+	"epm:upgrade":        always(usingNetwork),
+	"epm:remove":         always(writingFiles),
+	"runtime:pprof":      always(usingNetwork),
+	"shell:check-update": always(usingNetwork),
+	"exit":               always(controllingShell),
+	"at-exit":            always(controllingShell),
+	"cd":                 always(controllingShell),
+	"pushd":              always(controllingShell),
+	"popd":               always(controllingShell),
+	"umask":              settingWith(1),
+	"ulimit":             settingWith(2),
+	"kill":               always(signalling),
+}
+
+func always(what string) func([]Value) string {
+	return func([]Value) string { return what }
+}
+
+// settingWith returns a function for builtins that output some state of the
+// shell process when called with fewer than n arguments, and set it
+// otherwise.
+func settingWith(n int) func([]Value) string {
+	return func(args []Value) string {
+		if len(args) >= n {
+			return controllingShell
+		}
+		return ""
+	}
+}
+
+func fopenRestricted(args []Value) string {
+	if len(args) == 2 && writesFile(fopenFlags[args[1].String()]) {
+		return writingFiles
+	}
+	return ""
+}
+
+// NewRestrictedEvaluator creates a new Evaluator in restricted mode. Code
+// evaluated in restricted mode cannot run external commands, write files,
+// use the network, control the shell process or send signals, whether directly, by
+// redirecting to a file, or through builtins like fopen, fs:remove, http:get,
+// exit, cd, umask and kill; doing so throws a
+// ContextualError at the offending form. Everything else, including reading
+// files and calling closures, is allowed. The mode cannot be left by the
+// code evaluated.
+func NewRestrictedEvaluator() *Evaluator {
+	ev := NewEvaluator()
+	ev.restricted = true
+	return ev
+}
+
+// checkRestricted throws an error about n, or the node being evaluated if n
+// is nil, if the Evaluator is in restricted mode and name does what, unless
+// what is "".
+func (ev *Evaluator) checkRestricted(n parse.Node, name, what string) {
+	if !ev.restricted || what == "" {
+		return
+	}
+	if n == nil {
+		ev.errorf("%s: %s is not allowed in restricted mode", name, what)
+	}
+	ev.errorfNode(n, "%s: %s is not allowed in restricted mode", name, what)
+}
+
+// checkRestrictedFunc is like checkRestricted, for a call of the builtin
+// function name with args.
+func (ev *Evaluator) checkRestrictedFunc(n parse.Node, name string, args []Value) {
+	if f, ok := restrictedFuncs[name]; ok && ev.restricted {
+		ev.checkRestricted(n, name, f(args))
+	}
+}
+
+// writesFile returns whether a file opened with flag may be written to.
+func writesFile(flag int) bool {
+	return flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0
+}
@@ -0,0 +1,137 @@
+package eval
+
+// Builtins for the resource controls of the shell process, which are
+// inherited by the commands it runs and so can't be changed by external
+// commands.
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"syscall"
+)
+
+// umask outputs the file mode creation mask as an octal string, like 0022,
+// or sets it, e.g.
+//
+// umask 077
+func umask(ev *Evaluator, args []Value) string {
+	switch len(args) {
+	case 0:
+		mask := syscall.Umask(0)
+		syscall.Umask(mask)
+		ev.ports[1].ch <- NewString(fmt.Sprintf("%04o", mask))
+	case 1:
+		mask, err := strconv.ParseUint(args[0].String(), 8, 32)
+		if err != nil || mask > 0777 {
+			return fmt.Sprintf("bad umask %s", args[0].Repr())
+		}
+		syscall.Umask(int(mask))
+	default:
+		return "args error"
+	}
+	return ""
+}
+
+// rlimits maps the names of resources to their numbers.
+var rlimits = map[string]int{
+	"as":     syscall.RLIMIT_AS,
+	"core":   syscall.RLIMIT_CORE,
+	"cpu":    syscall.RLIMIT_CPU,
+	"data":   syscall.RLIMIT_DATA,
+	"fsize":  syscall.RLIMIT_FSIZE,
+	"nofile": syscall.RLIMIT_NOFILE,
+	"stack":  syscall.RLIMIT_STACK,
+}
+
+// rlimInfinity is RLIM_INFINITY, which the syscall package defines as -1.
+const rlimInfinity = ^uint64(0)
+
+func limitValue(n uint64) Value {
+	if n == rlimInfinity {
+		return NewString("unlimited")
+	}
+	return NewString(strconv.FormatUint(n, 10))
+}
+
+func parseLimit(v Value) (uint64, error) {
+	if v.String() == "unlimited" {
+		return rlimInfinity, nil
+	}
+	n, err := strconv.ParseUint(v.String(), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad limit %s", v.Repr())
+	}
+	return n, nil
+}
+
+func limitTable(lim *syscall.Rlimit) *Table {
+	t := NewTable()
+	t.put(NewString("soft"), limitValue(lim.Cur))
+	t.put(NewString("hard"), limitValue(lim.Max))
+	return t
+}
+
+// ulimit outputs or sets resource limits. Limits are tables of the soft and
+// hard limits, which are numbers or unlimited, e.g.
+//
+// ulimit # [&as [&soft unlimited &hard unlimited] &core ...]
+// ulimit nofile # [&soft 1024 &hard 4096]
+// ulimit nofile 2048 # Sets the soft limit
+// ulimit nofile [&soft 2048 &hard 2048]
+//
+// The resources are as, core, cpu, data, fsize, nofile and stack.
+func ulimit(ev *Evaluator, args []Value) string {
+	if len(args) == 0 {
+		names := make([]string, 0, len(rlimits))
+		for name := range rlimits {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		t := NewTable()
+		for _, name := range names {
+			var lim syscall.Rlimit
+			if err := syscall.Getrlimit(rlimits[name], &lim); err != nil {
+				return err.Error()
+			}
+			t.put(NewString(name), limitTable(&lim))
+		}
+		ev.ports[1].ch <- t
+		return ""
+	} else if len(args) > 2 {
+		return "args error"
+	}
+
+	resource, ok := rlimits[args[0].String()]
+	if !ok {
+		return fmt.Sprintf("unknown resource %s", args[0].Repr())
+	}
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(resource, &lim); err != nil {
+		return err.Error()
+	}
+	if len(args) == 1 {
+		ev.ports[1].ch <- limitTable(&lim)
+		return ""
+	}
+
+	var err error
+	if t, ok := args[1].(*Table); ok {
+		if soft, ok := t.lookup("soft"); ok {
+			if lim.Cur, err = parseLimit(soft); err != nil {
+				return err.Error()
+			}
+		}
+		if hard, ok := t.lookup("hard"); ok {
+			if lim.Max, err = parseLimit(hard); err != nil {
+				return err.Error()
+			}
+		}
+	} else if lim.Cur, err = parseLimit(args[1]); err != nil {
+		return err.Error()
+	}
+	if err := syscall.Setrlimit(resource, &lim); err != nil {
+		return err.Error()
+	}
+	return ""
+}
@@ -0,0 +1,153 @@
+package eval
+
+// Runtime introspection, for diagnosing leaks in long-lived sessions.
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// liveCounts counts Evaluators created by copy that have not released their
+// ports, owned ports that are not yet closed, and external commands that are
+// being waited for.
+var liveCounts struct {
+	evaluators, ports, jobs int32
+}
+
+// pprofState is the HTTP server of runtime:pprof.
+var pprofState struct {
+	mutex    sync.Mutex
+	listener net.Listener
+}
+
+func countTable(pairs ...interface{}) *Table {
+	t := NewTable()
+	for i := 0; i < len(pairs); i += 2 {
+		var s string
+		switch n := pairs[i+1].(type) {
+		case int:
+			s = strconv.Itoa(n)
+		case int32:
+			s = strconv.FormatInt(int64(n), 10)
+		case uint32:
+			s = strconv.FormatUint(uint64(n), 10)
+		case uint64:
+			s = strconv.FormatUint(n, 10)
+		}
+		t.put(NewString(pairs[i].(string)), NewString(s))
+	}
+	return t
+}
+
+// runtimeStats outputs a table of the numbers of goroutines, live Evaluators,
+// open ports and running external commands, e.g.
+// [&goroutines 12 &evaluators 3 &ports 2 &jobs 1].
+func runtimeStats(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	if len(args) > 0 {
+		return "args error"
+	}
+	out <- countTable(
+		"goroutines", runtime.NumGoroutine(),
+		"evaluators", atomic.LoadInt32(&liveCounts.evaluators),
+		"ports", atomic.LoadInt32(&liveCounts.ports),
+		"jobs", atomic.LoadInt32(&liveCounts.jobs))
+	return ""
+}
+
+// runtimeMem outputs a table of memory statistics, in bytes where applicable.
+func runtimeMem(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	if len(args) > 0 {
+		return "args error"
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	out <- countTable(
+		"alloc", ms.Alloc,
+		"total-alloc", ms.TotalAlloc,
+		"sys", ms.Sys,
+		"heap-objects", ms.HeapObjects,
+		"num-gc", ms.NumGC)
+	return ""
+}
+
+// pprofHandler serves the profiles of runtime/pprof under /debug/pprof/ like
+// net/http/pprof does, which is not used since it registers its handlers on
+// http.DefaultServeMux for the whole process. /debug/pprof/profile takes a
+// CPU profile for ?seconds=N, 30 by default; other profiles are looked up by
+// name and take ?debug=N.
+func pprofHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/debug/pprof/")
+	if name == "profile" {
+		seconds, err := strconv.Atoi(r.FormValue("seconds"))
+		if err != nil || seconds <= 0 {
+			seconds = 30
+		}
+		if err := pprof.StartCPUProfile(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		time.Sleep(time.Duration(seconds) * time.Second)
+		pprof.StopCPUProfile()
+		return
+	}
+	if name == "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, p := range pprof.Profiles() {
+			fmt.Fprintf(w, "%s %d\n", p.Name(), p.Count())
+		}
+		return
+	}
+	p := pprof.Lookup(name)
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+	debug, _ := strconv.Atoi(r.FormValue("debug"))
+	if debug > 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	p.WriteTo(w, debug)
+}
+
+// runtimePprof starts or stops serving the profiles of runtime/pprof, e.g.
+//
+// runtime:pprof localhost:6060
+// runtime:pprof off
+func runtimePprof(ev *Evaluator, args []Value) string {
+	if len(args) != 1 {
+		return "args error"
+	}
+	pprofState.mutex.Lock()
+	defer pprofState.mutex.Unlock()
+	addr := args[0].String()
+	if addr == "off" {
+		if pprofState.listener == nil {
+			return "pprof is not being served"
+		}
+		pprofState.listener.Close()
+		pprofState.listener = nil
+		return ""
+	}
+	if pprofState.listener != nil {
+		return fmt.Sprintf("pprof is already served on %s", pprofState.listener.Addr())
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err.Error()
+	}
+	pprofState.listener = l
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprofHandler)
+	go http.Serve(l, mux)
+	return ""
+}
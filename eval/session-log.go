@@ -0,0 +1,139 @@
+package eval
+
+// Session log.
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionLogBackups    = 3
+	sessionLogTimeFormat = "2006-01-02 15:04:05"
+	sessionLogMaxLine    = 4096
+)
+
+// sessionLog is a log file which receives a timestamped copy of everything
+// written to stdout and stderr, and is rotated when it grows beyond maxSize.
+type sessionLog struct {
+	mutex   sync.Mutex
+	path    string
+	maxSize int64
+	f       *os.File
+	size    int64
+}
+
+func openSessionLog(path string, maxSize int64) (*sessionLog, error) {
+	l := &sessionLog{path: path, maxSize: maxSize}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *sessionLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f = f
+	l.size = fi.Size()
+	return nil
+}
+
+// rotate renames path to path.1, path.1 to path.2 and so on, discarding the
+// oldest backup, and starts a new log file. It must be called with mutex held.
+func (l *sessionLog) rotate() {
+	l.f.Close()
+	for i := sessionLogBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	os.Rename(l.path, l.path+".1")
+	if err := l.open(); err != nil {
+		l.f = nil
+	}
+}
+
+// writeLine writes one line to the log, prefixed with the current time and
+// tag. Errors are ignored, so that a broken log never disrupts the terminal.
+func (l *sessionLog) writeLine(tag, line string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.f == nil {
+		return
+	}
+	if l.maxSize > 0 && l.size >= l.maxSize {
+		l.rotate()
+		if l.f == nil {
+			return
+		}
+	}
+	n, _ := fmt.Fprintf(l.f, "%s %s %s\n", time.Now().Format(sessionLogTimeFormat), tag, line)
+	l.size += int64(n)
+}
+
+// mark writes a command boundary to the log.
+func (l *sessionLog) mark(name, text string) {
+	l.writeLine("---", name+" "+strings.Replace(text, "\n", "\\n", -1))
+}
+
+// sessionLogWriter is an io.Writer that splits what is written into lines
+// and writes them to a sessionLog.
+type sessionLogWriter struct {
+	log     *sessionLog
+	tag     string
+	partial []byte
+}
+
+// Write writes the complete lines in p to the log. Lines longer than
+// sessionLogMaxLine are split, so that output without newlines doesn't make
+// the partial line grow without bound.
+func (w *sessionLogWriter) Write(p []byte) (int, error) {
+	buf := append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i == -1 {
+			if len(buf) < sessionLogMaxLine {
+				break
+			}
+			w.log.writeLine(w.tag, string(buf[:sessionLogMaxLine]))
+			buf = buf[sessionLogMaxLine:]
+			continue
+		}
+		w.log.writeLine(w.tag, string(buf[:i]))
+		buf = buf[i+1:]
+	}
+	w.partial = append(w.partial[:0], buf...)
+	return len(p), nil
+}
+
+// TeeSessionLog makes the stdout and stderr of ev pass through pipes, so
+// that everything written to them is also copied to the session log file at
+// path, one timestamped line at a time and with a boundary line before each
+// evaluated chunk. The log is rotated when it grows beyond maxSize bytes; a
+// non-positive maxSize disables rotation.
+//
+// Since commands no longer write to the terminal directly, they may detect
+// that their output is not a tty and change behavior.
+func (ev *Evaluator) TeeSessionLog(path string, maxSize int64) error {
+	l, err := openSessionLog(path, maxSize)
+	if err != nil {
+		return err
+	}
+	for i, tag := range []string{"out", "err"} {
+		if err := ev.teeOutput(i+1, &sessionLogWriter{log: l, tag: tag}); err != nil {
+			return err
+		}
+	}
+	ev.sessionLog = l
+	return nil
+}
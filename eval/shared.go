@@ -0,0 +1,128 @@
+package eval
+
+// Shared variables, whose names start with shared:, have the same value in all
+// running elvish processes, e.g.
+//
+// var $shared:project string = elvish
+//
+// makes $shared:project elvish everywhere. The values are synchronized between
+// top-level chunks: changes made by other processes are applied before a
+// chunk is compiled, and changes made by a chunk are published after it is
+// evaluated; when two processes set a variable, the later write wins. Values
+// are kept as JSON, so variables holding values that to-json doesn't accept
+// are not shared.
+//
+// Every value in the store becomes a variable, so one declared by another
+// process, or set with elvishd directly, is defined as $shared:name before the
+// next chunk. A value from another process that is not of the type of the
+// variable as declared here, like a table for a string variable, is ignored,
+// and so is one for a read-only variable; the variable keeps its value.
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+)
+
+const sharedPrefix = "shared:"
+
+// SharedStore keeps the values of shared variables for all elvish processes,
+// typically in elvishd. Names don't have the shared: prefix, and values are
+// JSON.
+type SharedStore interface {
+	SetShared(name, value string) error
+}
+
+type sharedState struct {
+	mutex sync.Mutex
+	store SharedStore
+	// The values of shared variables as last synchronized.
+	synced map[string]string
+	// Values set by other processes that are yet to be applied.
+	pending map[string]string
+}
+
+// SetSharedStore sets the store where the values of shared variables are
+// published. Without one, shared variables are normal variables.
+func (ev *Evaluator) SetSharedStore(s SharedStore) {
+	ev.shared.mutex.Lock()
+	defer ev.shared.mutex.Unlock()
+	ev.shared.store = s
+}
+
+// UpdateShared records that the shared variable name has been set to value,
+// as JSON. The change is applied before the next top-level chunk is compiled.
+// It is safe to call UpdateShared from another goroutine.
+func (ev *Evaluator) UpdateShared(name, value string) {
+	ev.shared.mutex.Lock()
+	defer ev.shared.mutex.Unlock()
+	if ev.shared.pending == nil {
+		ev.shared.pending = make(map[string]string)
+	}
+	ev.shared.pending[name] = value
+}
+
+// pullShared applies the pending changes to shared variables, creating the
+// variables that don't exist yet. Values that the variables can't hold are
+// dropped.
+func (ev *Evaluator) pullShared() {
+	s := ev.shared
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for name, value := range s.pending {
+		dec := json.NewDecoder(strings.NewReader(value))
+		dec.UseNumber()
+		v, err := decodeJSON(dec)
+		if err != nil {
+			continue
+		}
+		if p, ok := ev.scope.lookup(sharedPrefix + name); ok {
+			if !assignable(p.valueType(), v.Type()) {
+				continue
+			}
+			if err := p.assign(func(Value) Value { return v }); err != nil {
+				continue
+			}
+		} else {
+			ev.scope.define(sharedPrefix+name, newVar(v))
+		}
+		s.synced[name] = value
+	}
+	s.pending = nil
+}
+
+// pushShared publishes the shared variables that have changed since they
+// were last synchronized.
+func (ev *Evaluator) pushShared() {
+	s := ev.shared
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.store == nil {
+		return
+	}
+	for name := range s.synced {
+		if _, ok := ev.scope.lookup(sharedPrefix + name); !ok {
+			delete(s.synced, name)
+		}
+	}
+	for fullname, p := range ev.scope.all() {
+		if !strings.HasPrefix(fullname, sharedPrefix) {
+			continue
+		}
+		name := fullname[len(sharedPrefix):]
+		b, err := json.Marshal(p.Get())
+		if err != nil {
+			continue
+		}
+		value := string(b)
+		if old, ok := s.synced[name]; ok && old == value {
+			continue
+		}
+		if s.store.SetShared(name, value) != nil {
+			continue
+		}
+		s.synced[name] = value
+		// This write is newer than any pending one.
+		delete(s.pending, name)
+	}
+}
@@ -0,0 +1,340 @@
+package eval
+
+// The sort, order, sort-by and keys builtins.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	errSortArgs   = errors.New("usage: sort [&locale] [&version]")
+	errOrderArgs  = errors.New("usage: order [&reverse] [less-than]")
+	errSortByArgs = errors.New("usage: sort-by [&reverse] key")
+)
+
+// collationLocale returns the locale used for collation, determined from the
+// environment variables LC_ALL, LC_COLLATE and LANG like setlocale(3) does.
+func collationLocale() string {
+	for _, name := range []string{"LC_ALL", "LC_COLLATE", "LANG"} {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return "C"
+}
+
+// localeLess compares strings in a way close to the collation of most
+// locales: letters are compared ignoring case and punctuation is ignored,
+// with ties broken by comparing the strings bytewise.
+func localeLess(a, b string) bool {
+	ka, kb := collationKey(a), collationKey(b)
+	if ka != kb {
+		return ka < kb
+	}
+	return a < b
+}
+
+func collationKey(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		if unicode.IsSpace(r) {
+			return ' '
+		}
+		return -1
+	}, s)
+}
+
+// versionCompare compares strings like sort -V does: runs of digits are
+// compared by their numeric values and the rest is compared by key. It
+// returns -1, 0 or 1.
+func versionCompare(a, b string, key func(string) string) int {
+	for a != "" && b != "" {
+		da, db := isDigitAt(a), isDigitAt(b)
+		var pa, pb string
+		if da && db {
+			pa, a = splitRun(a, true)
+			pb, b = splitRun(b, true)
+			// Compare numerically by ignoring leading zeroes, then by length
+			na, nb := strings.TrimLeft(pa, "0"), strings.TrimLeft(pb, "0")
+			if len(na) != len(nb) {
+				return cmpInt(len(na), len(nb))
+			}
+			if na != nb {
+				return cmpString(na, nb)
+			}
+			continue
+		}
+		pa, a = splitRun(a, false)
+		pb, b = splitRun(b, false)
+		if len(pa) == 0 || len(pb) == 0 {
+			// One side is a number and the other is not; numbers first
+			return cmpInt(len(pa), len(pb))
+		}
+		if c := cmpString(key(pa), key(pb)); c != 0 {
+			return c
+		}
+	}
+	return cmpInt(len(a), len(b))
+}
+
+func isDigitAt(s string) bool {
+	return s != "" && '0' <= s[0] && s[0] <= '9'
+}
+
+// splitRun splits s after its leading run of digits, or of non-digits.
+func splitRun(s string, digits bool) (string, string) {
+	i := 0
+	for i < len(s) {
+		if isDigitAt(s[i:]) != digits {
+			break
+		}
+		_, w := utf8.DecodeRuneInString(s[i:])
+		i += w
+	}
+	return s[:i], s[i:]
+}
+
+func cmpInt(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func cmpString(a, b string) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func bytewiseLess(a, b string) bool {
+	return a < b
+}
+
+func identity(s string) string {
+	return s
+}
+
+// sortLess returns the comparison sort uses with the given options.
+func sortLess(locale, version bool) func(a, b string) bool {
+	less, key := bytewiseLess, identity
+	if locale {
+		switch l := collationLocale(); {
+		case l == "C" || l == "POSIX" || strings.HasPrefix(l, "C."):
+		default:
+			less, key = localeLess, collationKey
+		}
+	}
+	if version {
+		textLess := less
+		less = func(a, b string) bool {
+			if c := versionCompare(a, b, key); c != 0 {
+				return c < 0
+			}
+			return textLess(a, b)
+		}
+	}
+	return less
+}
+
+// sortFn outputs the values from the input sorted by their string forms,
+// e.g.
+//
+// put (ls) | sort &locale &version
+//
+// By default strings are compared bytewise, so that the result doesn't
+// depend on the environment. With &locale, they are compared following the
+// collation locale unless it is C or POSIX; with &version, runs of digits are
+// compared by their numeric values, so that file2 comes before file10.
+func sortFn(ev *Evaluator, args []Value) string {
+	in := ev.ports[0].ch
+	out := ev.ports[1].ch
+	locale, version := false, false
+	for len(args) > 0 {
+		var ok bool
+		if ok, args = optionArg(args, "locale"); ok {
+			locale = true
+		} else if ok, args = optionArg(args, "version"); ok {
+			version = true
+		} else {
+			// Drain the input so that upstream doesn't block.
+			for range in {
+			}
+			if err := checkOptionArgs(args[:1]); err != nil {
+				return err.Error()
+			}
+			return errSortArgs.Error()
+		}
+	}
+	less := sortLess(locale, version)
+
+	var values []Value
+	for v := range in {
+		values = append(values, v)
+	}
+	sort.SliceStable(values, func(i, j int) bool {
+		return less(values[i].String(), values[j].String())
+	})
+	for _, v := range values {
+		out <- v
+	}
+	return ""
+}
+
+// compareValues compares two values numerically if both are numbers, or else
+// by their String.
+func compareValues(a, b Value) int {
+	fa, errA := toFloat(a)
+	fb, errB := toFloat(b)
+	if errA == nil && errB == nil {
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	}
+	return cmpString(a.String(), b.String())
+}
+
+// orderArgs parses the arguments of order and sort-by, which are an optional
+// &reverse and a closure. The closure is required when needClosure is true.
+// When the arguments are wrong, the error is usage unless there is an unknown
+// option.
+func orderArgs(args []Value, needClosure bool, usage error) (reverse bool, c *Closure, err error) {
+	reverse, args = optionArg(args, "reverse")
+	if err := checkOptionArgs(args); err != nil {
+		return false, nil, err
+	}
+	switch len(args) {
+	case 0:
+		if !needClosure {
+			return reverse, nil, nil
+		}
+	case 1:
+		if c, ok := args[0].(*Closure); ok {
+			return reverse, c, nil
+		}
+	}
+	return false, nil, usage
+}
+
+// order sorts the values from its input. Two values are compared as numbers
+// when both are numbers and as strings otherwise, unless a closure is given,
+// which is called with two values and outputs true when the first is less
+// than the second, e.g.
+//
+// put $a $b $c | order {|a b| < $a[size] $b[size]}
+func order(ev *Evaluator, args []Value) string {
+	in := ev.ports[0].ch
+	out := ev.ports[1].ch
+	reverse, c, err := orderArgs(args, false, errOrderArgs)
+	var values []Value
+	for v := range in {
+		values = append(values, v)
+	}
+	if err != nil {
+		return err.Error()
+	}
+	// The first failure of the closure stops further calls
+	msg := ""
+	sort.SliceStable(values, func(i, j int) bool {
+		a, b := values[i], values[j]
+		if reverse {
+			a, b = b, a
+		}
+		if c == nil {
+			return compareValues(a, b) < 0
+		}
+		if msg != "" {
+			return false
+		}
+		var vs []Value
+		vs, msg = ev.captureClosure(c, []Value{a, b})
+		return len(vs) == 1 && vs[0].String() == "true"
+	})
+	if msg != "" {
+		return msg
+	}
+	for _, v := range values {
+		out <- v
+	}
+	return ""
+}
+
+// sortBy sorts the values from its input by a key, which a closure outputs
+// for each value and which is compared like the values of order, e.g.
+//
+// from-json < users.json | sort-by {|u| put $u[age]}
+func sortBy(ev *Evaluator, args []Value) string {
+	in := ev.ports[0].ch
+	out := ev.ports[1].ch
+	reverse, c, err := orderArgs(args, true, errSortByArgs)
+	var values []Value
+	for v := range in {
+		values = append(values, v)
+	}
+	if err != nil {
+		return err.Error()
+	}
+	// Compute each key only once, and sort a permutation of values by them
+	keys := make([]Value, len(values))
+	for i, v := range values {
+		vs, msg := ev.captureClosure(c, []Value{v})
+		if msg != "" {
+			return msg
+		}
+		if len(vs) != 1 {
+			return fmt.Sprintf("key of %s must be a single value, got %d", v.Repr(), len(vs))
+		}
+		keys[i] = vs[0]
+	}
+	perm := make([]int, len(values))
+	for i := range perm {
+		perm[i] = i
+	}
+	sort.SliceStable(perm, func(i, j int) bool {
+		a, b := keys[perm[i]], keys[perm[j]]
+		if reverse {
+			a, b = b, a
+		}
+		return compareValues(a, b) < 0
+	})
+	for _, i := range perm {
+		out <- values[i]
+	}
+	return ""
+}
+
+// keys outputs the keys of the dict part of a table, in the order they were
+// added.
+func keys(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	if len(args) != 1 {
+		return "args error"
+	}
+	t, ok := args[0].(*Table)
+	if !ok {
+		return "args error"
+	}
+	for _, k := range t.Keys() {
+		out <- k
+	}
+	return ""
+}
@@ -0,0 +1,150 @@
+package eval
+
+// shell:stats, which summarizes how the shell has been used. The data comes
+// from the history and directory visits kept on this machine, and never
+// leaves it.
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/xiaq/elvish/parse"
+)
+
+// Usage is the data shell:stats summarizes.
+type Usage struct {
+	Commands []CommandUsage
+	Dirs     []DirUsage
+}
+
+// CommandUsage is a command line in the history, with how long it took to
+// run, or 0 if that is not known.
+type CommandUsage struct {
+	Line     string
+	Duration time.Duration
+}
+
+// DirUsage is a visited directory.
+type DirUsage struct {
+	Path   string
+	Visits int64
+}
+
+const defaultStatsTop = 10
+
+// SetUsageSource sets the function that provides the data for shell:stats.
+func (ev *Evaluator) SetUsageSource(f func() (*Usage, error)) {
+	ev.usage = f
+}
+
+// commandNames returns the names of the commands run in a command line, e.g.
+// git and less for git log | less. Commands that are not plain strings, like
+// those in variables, are left out.
+func commandNames(line string) []string {
+	n, err := parse.Parse("<stats>", line)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, pn := range n.Nodes {
+		for _, fn := range pn.Nodes {
+			if fn.Command == nil || len(fn.Command.Nodes) != 1 {
+				continue
+			}
+			if sn, ok := fn.Command.Nodes[0].Node.(*parse.StringNode); ok {
+				names = append(names, sn.Text)
+			}
+		}
+	}
+	return names
+}
+
+// stats outputs a summary of the history and directory visits as a table:
+// the number of command lines, the average time they took to run in seconds,
+// or unknown, and the most used commands and the most visited directories,
+// ten of each unless another number is given, e.g. shell:stats 3 outputs
+// something like
+//
+// [&lines 1234 &average-duration 0.412000
+// &commands [[&name git &count 321] [&name ls &count 120] [&name cd &count 97]]
+// &dirs [[&path /home/me/src &visits 87] ...]]
+func stats(ev *Evaluator, args []Value) string {
+	top := defaultStatsTop
+	switch len(args) {
+	case 0:
+	case 1:
+		n, err := strconv.Atoi(args[0].String())
+		if err != nil || n < 0 {
+			return "bad number " + args[0].Repr()
+		}
+		top = n
+	default:
+		return "args error"
+	}
+	if ev.usage == nil {
+		return "no history to summarize"
+	}
+	usage, err := ev.usage()
+	if err != nil {
+		return err.Error()
+	}
+
+	counts := make(map[string]int)
+	var total time.Duration
+	timed := 0
+	for _, c := range usage.Commands {
+		for _, name := range commandNames(c.Line) {
+			counts[name]++
+		}
+		if c.Duration > 0 {
+			total += c.Duration
+			timed++
+		}
+	}
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if counts[names[i]] != counts[names[j]] {
+			return counts[names[i]] > counts[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	if len(names) > top {
+		names = names[:top]
+	}
+	commands := NewTable()
+	for _, name := range names {
+		t := NewTable()
+		t.put(NewString("name"), NewString(name))
+		t.put(NewString("count"), NewString(strconv.Itoa(counts[name])))
+		commands.append(t)
+	}
+
+	dirUsages := append([]DirUsage(nil), usage.Dirs...)
+	sort.SliceStable(dirUsages, func(i, j int) bool { return dirUsages[i].Visits > dirUsages[j].Visits })
+	if len(dirUsages) > top {
+		dirUsages = dirUsages[:top]
+	}
+	dirs := NewTable()
+	for _, d := range dirUsages {
+		t := NewTable()
+		t.put(NewString("path"), NewString(d.Path))
+		t.put(NewString("visits"), NewString(strconv.FormatInt(d.Visits, 10)))
+		dirs.append(t)
+	}
+
+	result := NewTable()
+	result.put(NewString("lines"), NewString(strconv.Itoa(len(usage.Commands))))
+	if timed > 0 {
+		result.put(NewString("average-duration"), seconds(total/time.Duration(timed)))
+	} else {
+		result.put(NewString("average-duration"), NewString("unknown"))
+	}
+	result.put(NewString("commands"), commands)
+	result.put(NewString("dirs"), dirs)
+	ev.ports[1].ch <- result
+	return ""
+}
@@ -0,0 +1,91 @@
+package eval
+
+// The store builtins, for scripts to keep state across sessions, e.g.
+//
+// store:set last-backup (date +%s)
+// store:get last-backup 0
+//
+// Values are kept as JSON, so any value that to-json accepts can be stored.
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+var errNoStore = errors.New("store not available")
+
+// Store is a persistent key-value store shared by elvish processes, typically
+// kept by elvishd. Get reports whether the key exists.
+type Store interface {
+	Get(key string) (string, bool, error)
+	Set(key, value string) error
+	Del(key string) error
+}
+
+// SetStore sets the store used by the store builtins. It must be called before
+// any code is evaluated.
+func (ev *Evaluator) SetStore(s Store) {
+	ev.store = s
+}
+
+// storeGet outputs the value stored with a key. If there is none, the second
+// argument is output if given; otherwise it is an error.
+func storeGet(ev *Evaluator, args []Value) string {
+	if len(args) != 1 && len(args) != 2 {
+		return "args error"
+	}
+	if ev.store == nil {
+		return errNoStore.Error()
+	}
+	s, ok, err := ev.store.Get(args[0].String())
+	if err != nil {
+		return err.Error()
+	}
+	out := ev.ports[1].ch
+	if !ok {
+		if len(args) == 1 {
+			return "no such key"
+		}
+		out <- args[1]
+		return ""
+	}
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	v, err := decodeJSON(dec)
+	if err != nil {
+		return err.Error()
+	}
+	out <- v
+	return ""
+}
+
+func storeSet(ev *Evaluator, args []Value) string {
+	if len(args) != 2 {
+		return "args error"
+	}
+	if ev.store == nil {
+		return errNoStore.Error()
+	}
+	b, err := json.Marshal(args[1])
+	if err != nil {
+		return err.Error()
+	}
+	if err := ev.store.Set(args[0].String(), string(b)); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func storeDel(ev *Evaluator, args []Value) string {
+	if len(args) != 1 {
+		return "args error"
+	}
+	if ev.store == nil {
+		return errNoStore.Error()
+	}
+	if err := ev.store.Del(args[0].String()); err != nil {
+		return err.Error()
+	}
+	return ""
+}
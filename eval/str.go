@@ -0,0 +1,210 @@
+package eval
+
+// The str: builtins. Those that work on a string, or a list of strings, take
+// it as their first argument, followed by what they do with it, like the
+// separator of str:split and str:join.
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var errPadArgs = errors.New("usage: str:pad [&left] string width [char]")
+
+// strCat outputs the concatenation of the string forms of its arguments.
+// Unlike juxtaposition, which forms a cartesian product of lists and indexes
+// tables, it always outputs a single string.
+func strCat(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	buf := new(bytes.Buffer)
+	for _, a := range args {
+		buf.WriteString(a.String())
+	}
+	out <- NewString(buf.String())
+	return ""
+}
+
+// strRepeat outputs a string repeated a number of times, e.g.
+//
+// str:repeat - 80
+func strRepeat(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	if len(args) != 2 {
+		return "args error"
+	}
+	n, err := strconv.Atoi(args[1].String())
+	if err != nil || n < 0 {
+		return "repeat count must be a non-negative integer"
+	}
+	out <- NewString(strings.Repeat(args[0].String(), n))
+	return ""
+}
+
+// strSplit outputs a list of the parts of a string separated by a separator,
+// e.g.
+//
+// str:split a,b,c ,
+//
+// An empty separator splits the string into runes.
+func strSplit(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	if len(args) != 2 {
+		return "args error"
+	}
+	t := NewTable()
+	for _, part := range strings.Split(args[0].String(), args[1].String()) {
+		t.append(NewString(part))
+	}
+	out <- t
+	return ""
+}
+
+// strJoin outputs the string forms of the elements of a list, joined with a
+// separator, e.g.
+//
+// str:join [a b c] ,
+func strJoin(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	if len(args) != 2 {
+		return "args error"
+	}
+	t, ok := args[0].(*Table)
+	if !ok {
+		return "args error"
+	}
+	parts := make([]string, len(t.List))
+	for i, v := range t.List {
+		parts[i] = v.String()
+	}
+	out <- NewString(strings.Join(parts, args[1].String()))
+	return ""
+}
+
+// strTrim outputs a string with leading and trailing whitespace removed, or
+// any of the given characters, e.g.
+//
+// str:trim $line
+// str:trim /a/b/ /
+func strTrim(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	switch len(args) {
+	case 1:
+		out <- NewString(strings.TrimSpace(args[0].String()))
+	case 2:
+		out <- NewString(strings.Trim(args[0].String(), args[1].String()))
+	default:
+		return "args error"
+	}
+	return ""
+}
+
+// strReplace outputs a string with occurrences of old replaced by new, all of
+// them unless a count is given, e.g.
+//
+// str:replace $version . - 1
+func strReplace(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	if len(args) != 3 && len(args) != 4 {
+		return "args error"
+	}
+	n := -1
+	if len(args) == 4 {
+		var err error
+		n, err = strconv.Atoi(args[3].String())
+		if err != nil || n < 0 {
+			return "replace count must be a non-negative integer"
+		}
+	}
+	out <- NewString(strings.Replace(args[0].String(), args[1].String(), args[2].String(), n))
+	return ""
+}
+
+// strContains outputs true or false, depending on whether a string contains
+// a substring.
+func strContains(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	if len(args) != 2 {
+		return "args error"
+	}
+	s := "false"
+	if strings.Contains(args[0].String(), args[1].String()) {
+		s = "true"
+	}
+	out <- NewString(s)
+	return ""
+}
+
+// strIndex outputs the index of the first occurrence of a substring in a
+// string, counted in runes, or -1 if there is none.
+func strIndex(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	if len(args) != 2 {
+		return "args error"
+	}
+	s := args[0].String()
+	i := strings.Index(s, args[1].String())
+	if i > 0 {
+		i = utf8.RuneCountInString(s[:i])
+	}
+	out <- NewString(strconv.Itoa(i))
+	return ""
+}
+
+// strCaseConverter makes a builtin outputting each argument converted with f.
+func strCaseConverter(f func(string) string) builtinFuncImpl {
+	return func(ev *Evaluator, args []Value) string {
+		out := ev.ports[1].ch
+		for _, a := range args {
+			out <- NewString(f(a.String()))
+		}
+		return ""
+	}
+}
+
+var (
+	strToUpper = strCaseConverter(strings.ToUpper)
+	strToLower = strCaseConverter(strings.ToLower)
+)
+
+// strPad outputs a string padded to a width, counted in runes, with a
+// character, which defaults to a space. The padding goes on the right unless
+// &left is given, e.g.
+//
+// str:pad &left 42 5 0
+//
+// Strings already as wide are output unchanged.
+func strPad(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	left, args := optionArg(args, "left")
+	if err := checkOptionArgs(args); err != nil {
+		return err.Error()
+	}
+	if len(args) != 2 && len(args) != 3 {
+		return errPadArgs.Error()
+	}
+	width, err := strconv.Atoi(args[1].String())
+	if err != nil || width < 0 {
+		return "width must be a non-negative integer"
+	}
+	pad := " "
+	if len(args) == 3 {
+		pad = args[2].String()
+		if utf8.RuneCountInString(pad) != 1 {
+			return "padding must be a single character"
+		}
+	}
+	s := args[0].String()
+	if n := utf8.RuneCountInString(s); n < width {
+		padding := strings.Repeat(pad, width-n)
+		if left {
+			s = padding + s
+		} else {
+			s += padding
+		}
+	}
+	out <- NewString(s)
+	return ""
+}
@@ -0,0 +1,179 @@
+package eval
+
+// Adapters between byte and value streams. Where the bytes written by a form
+// are read by a form expecting values, like in
+//
+// cat /etc/passwd | each {|l| put $l }
+//
+// they are split into lines as they are written, and each line is read as a
+// string, without the newline. The other way round, values are written as
+// their string forms, each followed by a newline. The same is done between
+// the last form of a pipeline and an output port of the other kind, e.g. at
+// the top level of a script, whose output is a file.
+//
+// Each adapter runs two goroutines: one reading or writing bytes, and one
+// forwarding values with a select loop, which keeps taking values from one
+// side while the other is not ready, and stops as soon as either side goes
+// away.
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+)
+
+// linesToValues reads lines from r and puts them to out as strings, until r
+// ends or the reader of out goes away.
+func linesToValues(r io.Reader, out *port) {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" && !out.put(NewString(strings.TrimSuffix(line, "\n"))) {
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// valuesToLines writes the string forms of the values from in to w, each
+// followed by a newline, until in is closed or w fails.
+func valuesToLines(in chan Value, w io.Writer) {
+	for v := range in {
+		if _, err := io.WriteString(w, v.String()+"\n"); err != nil {
+			return
+		}
+	}
+}
+
+// forwardQueueSize is the number of values a forwarder holds while the side
+// it forwards to is not ready.
+const forwardQueueSize = 1024
+
+// forward passes the values from in to out in order, until in is closed and
+// all of them have been passed, or the reader of out goes away. While out is
+// not ready, it goes on taking values from in and holds up to
+// forwardQueueSize of them, so that the writer of in is not held up by a slow
+// reader of out. It reports whether all of the values have been passed.
+func forward(in <-chan Value, out *port) bool {
+	var queue []Value
+	for in != nil || len(queue) > 0 {
+		var recv <-chan Value
+		if len(queue) < forwardQueueSize {
+			recv = in
+		}
+		var send chan Value
+		var head Value
+		if len(queue) > 0 {
+			send, head = out.ch, queue[0]
+		}
+		select {
+		case v, ok := <-recv:
+			if !ok {
+				in = nil
+				continue
+			}
+			queue = append(queue, v)
+		case send <- head:
+			queue[0] = nil
+			queue = queue[1:]
+		case <-out.done:
+			return false
+		}
+	}
+	return true
+}
+
+// linesToPort converts the lines read from r to values for out, and calls
+// finish once it is done with both. r is closed by then.
+func linesToPort(r *os.File, out *port, finish func()) {
+	lines := make(chan Value, chanPipeSize)
+	stop := make(chan struct{})
+	go func() {
+		linesToValues(r, &port{ch: lines, done: stop})
+		r.Close()
+		close(lines)
+	}()
+	go func() {
+		forward(lines, out)
+		close(stop)
+		// Wait for the reading goroutine to close r.
+		for range lines {
+		}
+		finish()
+	}()
+}
+
+// portToLines converts the values from in to lines written to w, and calls
+// finish once it is done with both.
+func portToLines(in *port, w io.Writer, finish func()) {
+	lines := make(chan Value, chanPipeSize)
+	stop := make(chan struct{})
+	go func() {
+		valuesToLines(lines, w)
+		close(stop)
+	}()
+	go func() {
+		forward(in.ch, &port{ch: lines, done: stop})
+		close(lines)
+		<-stop
+		finish()
+	}()
+}
+
+// adaptedPipe returns the ports of a pipe of type typ, fdToChanStream or
+// chanToFdStream, which converts what is written to it.
+func adaptedPipe(typ StreamType) (w, r *port, err error) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if typ == fdToChanStream {
+		cw, cr := newChanPipe()
+		linesToPort(reader, cw, cw.release)
+		return newFilePort(writer), cr, nil
+	}
+	cw, cr := newChanPipe()
+	portToLines(cr, writer, func() {
+		writer.Close()
+		cr.release()
+	})
+	return cw, newFilePort(reader), nil
+}
+
+// adaptable returns whether the output of a pipeline of type typ can be
+// converted for p, which is of the other kind.
+func (p *port) adaptable(typ StreamType) bool {
+	switch typ {
+	case fdStream:
+		return p != nil && p.ch != nil
+	case chanStream:
+		return p != nil && p.f != nil
+	}
+	return false
+}
+
+// adaptOutput replaces port 1 of ev, the Evaluator of the last form of a
+// pipeline, with one of type typ whose output is converted for out. The
+// returned channel is closed once all of the output has been converted.
+func (ev *Evaluator) adaptOutput(out *port, typ StreamType) (<-chan struct{}, error) {
+	done := make(chan struct{})
+	if typ == fdStream {
+		reader, writer, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		ev.setPort(1, newFilePort(writer))
+		linesToPort(reader, out, func() { close(done) })
+		return done, nil
+	}
+	w, r := newChanPipe()
+	ev.setPort(1, w)
+	portToLines(r, out.f, func() {
+		r.release()
+		close(done)
+	})
+	return done, nil
+}
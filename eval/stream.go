@@ -0,0 +1,162 @@
+package eval
+
+// Builtins consuming the value input. Those that don't need all of it stop
+// reading early; the rest of the input is then drained when the port is
+// released, and a producer writing with put stops too.
+
+import (
+	"errors"
+	"strconv"
+)
+
+var errEmptyInput = errors.New("empty input")
+
+// countArg parses the only argument of take and drop.
+func countArg(args []Value) (int, bool) {
+	if len(args) != 1 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(args[0].String())
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// take outputs the first n values of its input, and stops reading it. With
+// &exactly, it throws if the input has fewer values.
+func take(ev *Evaluator, args []Value) string {
+	exactly, args := optionArg(args, "exactly")
+	if err := checkOptionArgs(args); err != nil {
+		return err.Error()
+	}
+	n, ok := countArg(args)
+	if !ok {
+		return "args error"
+	}
+	in := ev.ports[0].ch
+	out := ev.ports[1]
+	for i := 0; i < n; i++ {
+		v, ok := <-in
+		if !ok {
+			if exactly {
+				ev.errorf("expect %d values, got %d", n, i)
+			}
+			break
+		}
+		if !out.put(v) {
+			break
+		}
+	}
+	return ""
+}
+
+// one passes through its input, throwing if it is not exactly one value, so
+// that a capture expecting a single value fails loudly, e.g.
+//
+// vim (put *.go | one)
+func one(ev *Evaluator, args []Value) string {
+	if len(args) != 0 {
+		return "args error"
+	}
+	var vs []Value
+	for v := range ev.ports[0].ch {
+		vs = append(vs, v)
+	}
+	if len(vs) != 1 {
+		ev.errorf("expect exactly one value, got %d", len(vs))
+	}
+	ev.ports[1].ch <- vs[0]
+	return ""
+}
+
+// drop outputs its input without the first n values.
+func drop(ev *Evaluator, args []Value) string {
+	n, ok := countArg(args)
+	if !ok {
+		return "args error"
+	}
+	in := ev.ports[0].ch
+	out := ev.ports[1]
+	i := 0
+	for v := range in {
+		if i < n {
+			i++
+		} else if !out.put(v) {
+			break
+		}
+	}
+	return ""
+}
+
+// all outputs the elements of the list part of a table, e.g.
+//
+// all [a b c] | each {|x| echo $x}
+//
+// Without arguments, it passes its input through.
+func all(ev *Evaluator, args []Value) string {
+	var vs []Value
+	switch len(args) {
+	case 0:
+		if ev.ports[0] == nil || ev.ports[0].ch == nil {
+			return "no value input"
+		}
+		out := ev.ports[1]
+		for v := range ev.ports[0].ch {
+			if !out.put(v) {
+				break
+			}
+		}
+		return ""
+	case 1:
+		t, ok := args[0].(*Table)
+		if !ok {
+			return "args error"
+		}
+		vs = t.List
+	default:
+		return "args error"
+	}
+	return put(ev, vs)
+}
+
+// count outputs the number of values in its input.
+func count(ev *Evaluator, args []Value) string {
+	if len(args) != 0 {
+		return "args error"
+	}
+	n := 0
+	for range ev.ports[0].ch {
+		n++
+	}
+	ev.ports[1].ch <- NewString(strconv.Itoa(n))
+	return ""
+}
+
+// first outputs the first value of its input, and stops reading it.
+func first(ev *Evaluator, args []Value) string {
+	if len(args) != 0 {
+		return "args error"
+	}
+	v, ok := <-ev.ports[0].ch
+	if !ok {
+		return errEmptyInput.Error()
+	}
+	ev.ports[1].ch <- v
+	return ""
+}
+
+// last outputs the last value of its input.
+func last(ev *Evaluator, args []Value) string {
+	if len(args) != 0 {
+		return "args error"
+	}
+	var v Value
+	for v = range ev.ports[0].ch {
+	}
+	if v == nil {
+		return errEmptyInput.Error()
+	}
+	ev.ports[1].ch <- v
+	return ""
+}
@@ -0,0 +1,421 @@
+package eval
+
+// Values for coordinating code running concurrently, like closures called by
+// peach and run-parallel: channels, mutexes and onces, e.g.
+//
+// var $c chan; c = (chan:make)
+// run-parallel { range 10 | each {|x| chan:send $c $x }; chan:close $c } { chan:recv-all $c }
+//
+// var $m mutex; m = (sync:mutex)
+// var $n string = 0
+// range 100 | peach {|x| sync:with-lock $m { n = (+ $n 1) } }
+//
+// var $o once; o = (sync:once)
+// range 3 | peach {|x| sync:do $o { echo only once } }
+//
+// Sending to and receiving from a channel wait for the other side, or for
+// room in the buffer, stopping if the evaluation is canceled. Values sent
+// before a channel is closed can still be received.
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+var errChanClosed = errors.New("channel closed")
+
+type ChanType struct {
+}
+
+// Default returns a new unbuffered Chan.
+func (ct ChanType) Default() Value {
+	return NewChan(0)
+}
+
+func (ct ChanType) Caret(t Type) Type {
+	return AnyType{}
+}
+
+// Chan is a channel of values, which may be buffered.
+type Chan struct {
+	ch        chan Value
+	done      chan struct{} // Closed when the Chan is.
+	closeOnce sync.Once
+}
+
+// NewChan returns a Chan buffering size values.
+func NewChan(size int) *Chan {
+	return &Chan{ch: make(chan Value, size), done: make(chan struct{})}
+}
+
+func (c *Chan) Type() Type {
+	return ChanType{}
+}
+
+func (c *Chan) Repr() string {
+	select {
+	case <-c.done:
+		return fmt.Sprintf("<Chan %p (closed)>", c)
+	default:
+	}
+	return fmt.Sprintf("<Chan %p (%d/%d)>", c, len(c.ch), cap(c.ch))
+}
+
+func (c *Chan) String() string {
+	return c.Repr()
+}
+
+func (c *Chan) Caret(ev *Evaluator, v Value) Value {
+	ev.errorf("Chan cannot be careted")
+	return nil
+}
+
+// Eq determines whether two values are the same Chan.
+func (c *Chan) Eq(v Value) bool {
+	return c == v
+}
+
+func (c *Chan) Hash() uint32 {
+	return hashPointer(c)
+}
+
+// Close closes the Chan. Sending to it fails afterwards, while the values
+// already sent can still be received.
+func (c *Chan) Close() error {
+	err := errAlreadyClosed
+	c.closeOnce.Do(func() {
+		close(c.done)
+		err = nil
+	})
+	return err
+}
+
+// send sends v, waiting until it is received or buffered, or the evaluation
+// of ev is canceled.
+func (c *Chan) send(ev *Evaluator, v Value) error {
+	select {
+	case <-c.done:
+		return errChanClosed
+	default:
+	}
+	select {
+	case c.ch <- v:
+		return nil
+	case <-c.done:
+		return errChanClosed
+	case <-cancelDone(ev):
+		ev.checkCanceled()
+		return errCanceled
+	}
+}
+
+// recv receives a value, waiting until one is sent, the Chan is closed or the
+// evaluation of ev is canceled.
+func (c *Chan) recv(ev *Evaluator) (Value, error) {
+	select {
+	case v := <-c.ch:
+		return v, nil
+	case <-c.done:
+		select {
+		case v := <-c.ch:
+			return v, nil
+		default:
+			return nil, errChanClosed
+		}
+	case <-cancelDone(ev):
+		ev.checkCanceled()
+		return nil, errCanceled
+	}
+}
+
+// cancelDone returns a channel that is closed when the evaluation of ev is
+// canceled, or nil if it can't be.
+func cancelDone(ev *Evaluator) <-chan struct{} {
+	if ev.cancel == nil {
+		return nil
+	}
+	return ev.cancel.ctx.Done()
+}
+
+func chanArg(v Value) (*Chan, error) {
+	c, ok := v.(*Chan)
+	if !ok {
+		return nil, fmt.Errorf("not a Chan: %s", v.Repr())
+	}
+	return c, nil
+}
+
+// chanMake outputs a new Chan, buffering the given number of values, or none
+// by default.
+func chanMake(ev *Evaluator, args []Value) string {
+	size := 0
+	switch len(args) {
+	case 0:
+	case 1:
+		n, err := strconv.Atoi(args[0].String())
+		if err != nil || n < 0 {
+			return fmt.Sprintf("bad buffer size %s", args[0].Repr())
+		}
+		size = n
+	default:
+		return "args error"
+	}
+	ev.ports[1].ch <- NewChan(size)
+	return ""
+}
+
+// chanSend sends values to a Chan, one by one.
+func chanSend(ev *Evaluator, args []Value) string {
+	if len(args) == 0 {
+		return "args error"
+	}
+	c, err := chanArg(args[0])
+	if err != nil {
+		return err.Error()
+	}
+	for _, v := range args[1:] {
+		if err := c.send(ev, v); err != nil {
+			return err.Error()
+		}
+	}
+	return ""
+}
+
+// chanRecv receives the given number of values from a Chan, or one by
+// default, and outputs them.
+func chanRecv(ev *Evaluator, args []Value) string {
+	n := 1
+	switch len(args) {
+	case 1:
+	case 2:
+		i, err := strconv.Atoi(args[1].String())
+		if err != nil || i < 0 {
+			return fmt.Sprintf("bad number of values %s", args[1].Repr())
+		}
+		n = i
+	default:
+		return "args error"
+	}
+	c, err := chanArg(args[0])
+	if err != nil {
+		return err.Error()
+	}
+	out := ev.ports[1]
+	for i := 0; i < n; i++ {
+		v, err := c.recv(ev)
+		if err != nil {
+			return err.Error()
+		}
+		if !out.put(v) {
+			break
+		}
+	}
+	return ""
+}
+
+// chanRecvAll receives values from a Chan and outputs them, until it is
+// closed.
+func chanRecvAll(ev *Evaluator, args []Value) string {
+	if len(args) != 1 {
+		return "args error"
+	}
+	c, err := chanArg(args[0])
+	if err != nil {
+		return err.Error()
+	}
+	out := ev.ports[1]
+	for {
+		v, err := c.recv(ev)
+		if err == errChanClosed {
+			return ""
+		} else if err != nil {
+			return err.Error()
+		}
+		if !out.put(v) {
+			return ""
+		}
+	}
+}
+
+func chanClose(ev *Evaluator, args []Value) string {
+	if len(args) != 1 {
+		return "args error"
+	}
+	c, err := chanArg(args[0])
+	if err != nil {
+		return err.Error()
+	}
+	if err := c.Close(); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+type MutexType struct {
+}
+
+// Default returns a new Mutex.
+func (mt MutexType) Default() Value {
+	return NewMutex()
+}
+
+func (mt MutexType) Caret(t Type) Type {
+	return AnyType{}
+}
+
+// Mutex is a lock held by one closure at a time, with sync:with-lock. It is
+// held while its channel has a value in it, so that waiting for it can be
+// canceled.
+type Mutex struct {
+	ch chan struct{}
+}
+
+// NewMutex returns a new Mutex, which is not held.
+func NewMutex() *Mutex {
+	return &Mutex{make(chan struct{}, 1)}
+}
+
+// lock waits until the Mutex is not held and takes it, or until the
+// evaluation of ev is canceled.
+func (m *Mutex) lock(ev *Evaluator) error {
+	select {
+	case m.ch <- struct{}{}:
+		return nil
+	case <-cancelDone(ev):
+		ev.checkCanceled()
+		return errCanceled
+	}
+}
+
+func (m *Mutex) unlock() {
+	<-m.ch
+}
+
+func (m *Mutex) Type() Type {
+	return MutexType{}
+}
+
+func (m *Mutex) Repr() string {
+	return fmt.Sprintf("<Mutex %p>", m)
+}
+
+func (m *Mutex) String() string {
+	return m.Repr()
+}
+
+func (m *Mutex) Caret(ev *Evaluator, v Value) Value {
+	ev.errorf("Mutex cannot be careted")
+	return nil
+}
+
+// Eq determines whether two values are the same Mutex.
+func (m *Mutex) Eq(v Value) bool {
+	return m == v
+}
+
+func (m *Mutex) Hash() uint32 {
+	return hashPointer(m)
+}
+
+type OnceType struct {
+}
+
+// Default returns a new Once.
+func (ot OnceType) Default() Value {
+	return &Once{}
+}
+
+func (ot OnceType) Caret(t Type) Type {
+	return AnyType{}
+}
+
+// Once runs only the first closure given to it with sync:do.
+type Once struct {
+	once sync.Once
+}
+
+func (o *Once) Type() Type {
+	return OnceType{}
+}
+
+func (o *Once) Repr() string {
+	return fmt.Sprintf("<Once %p>", o)
+}
+
+func (o *Once) String() string {
+	return o.Repr()
+}
+
+func (o *Once) Caret(ev *Evaluator, v Value) Value {
+	ev.errorf("Once cannot be careted")
+	return nil
+}
+
+// Eq determines whether two values are the same Once.
+func (o *Once) Eq(v Value) bool {
+	return o == v
+}
+
+func (o *Once) Hash() uint32 {
+	return hashPointer(o)
+}
+
+func syncMutex(ev *Evaluator, args []Value) string {
+	if len(args) != 0 {
+		return "args error"
+	}
+	ev.ports[1].ch <- NewMutex()
+	return ""
+}
+
+func syncOnce(ev *Evaluator, args []Value) string {
+	if len(args) != 0 {
+		return "args error"
+	}
+	ev.ports[1].ch <- &Once{}
+	return ""
+}
+
+// syncWithLock calls a closure holding a Mutex, which is released when the
+// closure returns. Waiting for the Mutex stops if the evaluation is canceled.
+func syncWithLock(ev *Evaluator, args []Value) string {
+	if len(args) != 2 {
+		return "args error"
+	}
+	m, ok := args[0].(*Mutex)
+	if !ok {
+		return fmt.Sprintf("not a Mutex: %s", args[0].Repr())
+	}
+	c, ok := args[1].(*Closure)
+	if !ok {
+		return fmt.Sprintf("not a closure: %s", args[1].Repr())
+	}
+	if err := m.lock(ev); err != nil {
+		return err.Error()
+	}
+	defer m.unlock()
+	return ev.callClosure(c, nil)
+}
+
+// syncDo calls a closure if no closure has been called with the Once before.
+// Calls with the Once while the first one runs wait for it to return.
+func syncDo(ev *Evaluator, args []Value) string {
+	if len(args) != 2 {
+		return "args error"
+	}
+	o, ok := args[0].(*Once)
+	if !ok {
+		return fmt.Sprintf("not a Once: %s", args[0].Repr())
+	}
+	c, ok := args[1].(*Closure)
+	if !ok {
+		return fmt.Sprintf("not a closure: %s", args[1].Repr())
+	}
+	msg := ""
+	o.once.Do(func() {
+		msg = ev.callClosure(c, nil)
+	})
+	return msg
+}
@@ -0,0 +1,65 @@
+package eval
+
+// The tee-var and tee-bytes builtins.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// setTeeVar puts v in the variable name, creating it in the current scope if
+// it doesn't exist. An existing variable must be of the type of v, whose name
+// is typ.
+func (ev *Evaluator) setTeeVar(name string, v Value, typ string) string {
+	p, ok := ev.scope.lookup(name)
+	if !ok {
+		ev.scope.define(name, newVar(v))
+		return ""
+	}
+	if !assignable(p.valueType(), v.Type()) {
+		return fmt.Sprintf("variable $%s is not of type %s", name, typ)
+	}
+	if err := p.assign(func(Value) Value { return v }); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// teeVar passes the values from its input to its output, and also puts them
+// in a variable as a list once the input ends, e.g.
+//
+// put *.go | tee-var files | each {|f| wc -l $f}
+//
+// so that an intermediate stage of a pipeline can be inspected afterwards
+// with $files, without running the earlier stages again.
+func teeVar(ev *Evaluator, args []Value) string {
+	if len(args) != 1 {
+		return "args error"
+	}
+	in := ev.ports[0].ch
+	out := ev.ports[1].ch
+	t := NewTable()
+	for v := range in {
+		t.append(v)
+		out <- v
+	}
+	return ev.setTeeVar(args[0].String(), t, "table")
+}
+
+// teeBytes is like teeVar, but for byte input and output, which it puts in the
+// variable as a Bytes.
+func teeBytes(ev *Evaluator, args []Value) string {
+	if len(args) != 1 {
+		return "args error"
+	}
+	var buf bytes.Buffer
+	_, err := io.Copy(io.MultiWriter(ev.ports[1].f, &buf), ev.ports[0].f)
+	if msg := ev.setTeeVar(args[0].String(), NewBytes(buf.Bytes()), "bytes"); msg != "" {
+		return msg
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
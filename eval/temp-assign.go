@@ -0,0 +1,171 @@
+package eval
+
+// Temporary assignments, written before the command of a form like in sh:
+//
+// LC_ALL=C sort file
+// x=(put foo) f
+//
+// If the name is that of a declared variable, the form gets a variable of
+// its own with that name, which must be given a value of the type of the
+// variable; otherwise the form gets a copy of the environment, which is also
+// its $env, with the variable set, and exported even if it has been
+// unexported. Either way,
+// nothing outside the form sees the value: not the other forms of the
+// pipeline, nor closures defined elsewhere and called by the form, which
+// keep seeing the variables they have captured. The external commands the
+// form runs, directly or through closures, get the environment of the form.
+//
+// Variables backed by the state of the shell, like $edit:styles, can't be
+// temporarily assigned, since giving the form a variable of its own would
+// not change that state.
+
+import "github.com/xiaq/elvish/parse"
+
+type tempAssignment struct {
+	name  string
+	env   bool // Whether name is an environment variable.
+	typ   Type // The type of the variable, if name is not an environment variable.
+	value valuesOp
+	node  *parse.TermNode
+}
+
+// isTempName determines whether a string can be the name in a temporary
+// assignment.
+func isTempName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !(r == '_' || r == '-' || '0' <= r && r <= '9' ||
+			'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// splitTempAssignment splits a term of the form name=value, where the part
+// up to = is bare, into name and the term of value.
+func splitTempAssignment(tn *parse.TermNode) (string, *parse.TermNode, bool) {
+	if len(tn.Nodes) == 0 || !isBareString(tn.Nodes[0]) {
+		return "", nil, false
+	}
+	sn := tn.Nodes[0].Node.(*parse.StringNode)
+	i := 0
+	for i < len(sn.Text) && sn.Text[i] != '=' {
+		i++
+	}
+	if i == len(sn.Text) || !isTempName(sn.Text[:i]) {
+		return "", nil, false
+	}
+	text := sn.Text[i+1:]
+	value := &parse.TermNode{Pos: tn.Pos, Nodes: tn.Nodes[1:]}
+	if text != "" || len(value.Nodes) == 0 {
+		f := &parse.FactorNode{Pos: tn.Nodes[0].Pos, Typ: parse.StringFactor,
+			Node: &parse.StringNode{Pos: sn.Pos + parse.Pos(i+1), Quoted: text, Text: text}}
+		value.Nodes = append([]*parse.FactorNode{f}, value.Nodes...)
+	}
+	return sn.Text[:i], value, true
+}
+
+// compileTempAssignments compiles the temporary assignments in front of a
+// form, returning them and the form without them. If there are none, or
+// nothing follows them, it returns nil and fn.
+func (cp *Compiler) compileTempAssignments(fn *parse.FormNode) ([]tempAssignment, *parse.FormNode) {
+	terms := append([]*parse.TermNode{fn.Command}, fn.Args.Nodes...)
+	var temps []tempAssignment
+	for len(terms) > 1 {
+		name, value, ok := splitTempAssignment(terms[0])
+		if !ok {
+			break
+		}
+		typ := cp.tryResolveVar(name)
+		op := cp.compileTerm(value)
+		if typ != nil {
+			cp.checkWritable(name, terms[0])
+			if len(op.ts) == 1 && !assignableValueType(typ, op.ts[0]) {
+				cp.errorf(terms[0], "type mismatch")
+			}
+		}
+		temps = append(temps, tempAssignment{name, typ == nil, typ, op, terms[0]})
+		terms = terms[1:]
+	}
+	if temps == nil {
+		return nil, fn
+	}
+	rest := *fn
+	rest.Command = terms[0]
+	rest.Args = &parse.TermListNode{Pos: fn.Args.Pos, Nodes: terms[1:]}
+	return temps, &rest
+}
+
+// assignableValueType determines whether a value of type t2 can be put in a
+// variable of type t1, where either may be AnyType when it is only known at
+// runtime.
+func assignableValueType(t1, t2 Type) bool {
+	_, any1 := t1.(AnyType)
+	_, any2 := t2.(AnyType)
+	return any1 || any2 || assignable(t1, t2)
+}
+
+// setTemps carries out temporary assignments on ev, which only runs the form
+// they are in front of, and returns a function undoing them.
+func (ev *Evaluator) setTemps(temps []tempAssignment) func() {
+	scope, env := ev.scope, ev.env
+	undo := func() {
+		ev.scope, ev.env = scope, env
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			undo()
+			panic(r)
+		}
+	}()
+	for _, t := range temps {
+		v := ev.asSingleValue(t.node, t.value.f(ev), "temporary assignment")
+		if t.env {
+			ev.env = ev.env.with(t.name, v.String())
+			ev.scope = ev.scope.withVar("env", newVar(ev.env))
+			continue
+		}
+		old := ev.scope.get(t.name)
+		if old.get != nil || old.changed != nil {
+			ev.errorfNode(t.node, "variable $%s can't be temporarily assigned", t.name)
+		}
+		if !assignableValueType(t.typ, v.Type()) {
+			ev.errorfNode(t.node, "type mismatch: $%s can't hold %s", t.name, v.Repr())
+		}
+		p := &Var{validate: old.validate}
+		if err := p.assign(func(Value) Value { return v }); err != nil {
+			ev.errorfNode(t.node, "%s", err)
+		}
+		ev.scope = ev.scope.withVar(t.name, p)
+	}
+	return undo
+}
+
+// withTempAssignments wraps the op of a form with temporary assignments,
+// which are undone when the form is done or fails to start.
+func withTempAssignments(temps []tempAssignment, op stateUpdatesOp) stateUpdatesOp {
+	return func(ev *Evaluator) <-chan *StateUpdate {
+		undo := ev.setTemps(temps)
+		started := false
+		defer func() {
+			if !started {
+				undo()
+			}
+		}()
+		update := op(ev)
+		started = true
+
+		out := make(chan *StateUpdate)
+		go func() {
+			defer close(out)
+			defer undo()
+			for up := range update {
+				out <- up
+			}
+		}()
+		return out
+	}
+}
@@ -0,0 +1,123 @@
+package eval
+
+// Builtins converting between byte input split by terminators and values,
+// e.g.
+//
+// find . -print0 | from-terminated "\000" | each {|f| put $f}
+// put a b | to-terminated "\000" | xargs -0 ls
+//
+// A record is read as soon as its terminator is, so that large inputs are
+// not buffered; a last record without a terminator is read too.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+func init() {
+	// Needed to avoid initialization loop
+	builtinFuncs["from-lines"] = builtinFunc{fromLines, [2]StreamType{fdStream, chanStream}}
+	builtinFuncs["from-terminated"] = builtinFunc{fromTerminated, [2]StreamType{fdStream, chanStream}}
+	builtinFuncs["to-lines"] = builtinFunc{toLines, [2]StreamType{0, fdStream}}
+	builtinFuncs["to-terminated"] = builtinFunc{toTerminated, [2]StreamType{0, fdStream}}
+}
+
+// terminator returns the terminator given as an argument, which must be a
+// single byte.
+func terminator(v Value) (byte, string) {
+	s := v.String()
+	if len(s) != 1 {
+		return 0, fmt.Sprintf("terminator must be a single byte, got %s", v.Repr())
+	}
+	return s[0], ""
+}
+
+// fromLines implements from-lines, which outputs each line of its input as a
+// string, without the newline.
+func fromLines(ev *Evaluator, args []Value) string {
+	if len(args) > 0 {
+		return "args error"
+	}
+	return readTerminated(ev, '\n')
+}
+
+// fromTerminated implements from-terminated, which is like from-lines with
+// another terminator.
+func fromTerminated(ev *Evaluator, args []Value) string {
+	if len(args) != 1 {
+		return "args error"
+	}
+	term, msg := terminator(args[0])
+	if msg != "" {
+		return msg
+	}
+	return readTerminated(ev, term)
+}
+
+func readTerminated(ev *Evaluator, term byte) string {
+	in := bufio.NewReader(ev.ports[0].f)
+	out := ev.ports[1]
+	for {
+		record, err := in.ReadString(term)
+		if record != "" {
+			record = strings.TrimSuffix(record, string(term))
+			if !out.put(NewString(record)) {
+				return ""
+			}
+		}
+		if err == io.EOF {
+			return ""
+		} else if err != nil {
+			return err.Error()
+		}
+	}
+}
+
+// toLines implements to-lines, which writes its arguments, or the values from
+// its input if there are none, each followed by a newline. Records are
+// written as they come, so that what reads them can start right away.
+func toLines(ev *Evaluator, args []Value) string {
+	return writeTerminated(ev, args, "\n")
+}
+
+// toTerminated implements to-terminated, which is like to-lines with another
+// terminator, given as the first argument.
+func toTerminated(ev *Evaluator, args []Value) string {
+	if len(args) < 1 {
+		return "args error"
+	}
+	term, msg := terminator(args[0])
+	if msg != "" {
+		return msg
+	}
+	return writeTerminated(ev, args[1:], string(term))
+}
+
+func writeTerminated(ev *Evaluator, args []Value, term string) string {
+	out := ev.ports[1].f
+	write := func(v Value) string {
+		if _, err := io.WriteString(out, v.String()+term); err != nil {
+			return err.Error()
+		}
+		return ""
+	}
+	msg := ""
+	if len(args) > 0 {
+		for _, a := range args {
+			if msg = write(a); msg != "" {
+				break
+			}
+		}
+	} else if in := ev.ports[0]; in != nil && in.ch != nil {
+		for v := range in.ch {
+			// The rest of a channel pipe is drained when it is released,
+			// so upstream doesn't block, and learns that no one reads on.
+			if msg = write(v); msg != "" {
+				break
+			}
+		}
+	}
+	return msg
+}
@@ -0,0 +1,69 @@
+package eval
+
+// Tilde and named directory expansion.
+
+import (
+	"os/user"
+	"strings"
+
+	"github.com/xiaq/elvish/parse"
+)
+
+// compileTilde compiles a bare string starting with a tilde, which is
+// expanded when evaluated. The tilde and the name following it, up to the
+// first slash, are replaced by the named directory or the home directory of
+// the user with that name; a tilde without a name stands for the home
+// directory of the current user.
+func compileTilde(text string, fn *parse.FactorNode) valuesOp {
+	f := func(ev *Evaluator) []Value {
+		dir, err := ev.expandTilde(text)
+		if err != nil {
+			ev.errorfNode(fn, "%s", err)
+		}
+		return []Value{NewString(dir)}
+	}
+	return valuesOp{ts: []Type{StringType{}}, f: f}
+}
+
+func (ev *Evaluator) expandTilde(text string) (string, error) {
+	name, rest := text[1:], ""
+	if i := strings.IndexRune(name, '/'); i != -1 {
+		name, rest = name[:i], name[i:]
+	}
+	if name == "" {
+		if home, _ := ev.env.get("HOME"); home != "" {
+			return home + rest, nil
+		}
+		u, err := user.Current()
+		if err != nil {
+			return "", err
+		}
+		return u.HomeDir + rest, nil
+	}
+	if dir, ok := ev.NamedDirs()[name]; ok {
+		return dir + rest, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return u.HomeDir + rest, nil
+}
+
+// NamedDirs returns the named directories, which are the string entries of
+// the dict part of the global $named-dirs. A named directory abbreviates a
+// path; e.g. after named-dirs[src] = /usr/src, ~src/linux stands for
+// /usr/src/linux.
+func (ev *Evaluator) NamedDirs() map[string]string {
+	dirs := make(map[string]string)
+	t, ok := ev.namedDirs.Get().(*Table)
+	if !ok {
+		return dirs
+	}
+	for k, v := range t.Dict {
+		if v, ok := v.(*String); ok {
+			dirs[k.String()] = string(*v)
+		}
+	}
+	return dirs
+}
@@ -0,0 +1,120 @@
+package eval
+
+// The sleep builtin and the time special form.
+
+import (
+	"fmt"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/xiaq/elvish/parse"
+)
+
+// parseDuration parses a duration like 1.5s or 200ms, where a plain number is
+// in seconds.
+func parseDuration(s string) (time.Duration, error) {
+	d, err := parseSignedDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("negative duration %q", s)
+	}
+	return d, nil
+}
+
+// parseSignedDuration is like parseDuration, but also accepts negative
+// durations like -1h.
+func parseSignedDuration(s string) (time.Duration, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		s = strconv.FormatFloat(f, 'f', -1, 64) + "s"
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("bad duration %q", s)
+	}
+	return d, nil
+}
+
+// sleep pauses for a duration, e.g.
+//
+// sleep 1.5s; sleep 200ms; sleep 2
+func sleep(ev *Evaluator, args []Value) string {
+	if len(args) != 1 {
+		return "args error"
+	}
+	d, err := parseDuration(args[0].String())
+	if err != nil {
+		return err.Error()
+	}
+	if ev.cancel == nil {
+		time.Sleep(d)
+		return ""
+	}
+	select {
+	case <-time.After(d):
+	case <-ev.cancel.ctx.Done():
+		ev.checkCanceled()
+	}
+	return ""
+}
+
+// seconds formats a duration as a number of seconds, to the microsecond.
+func seconds(d time.Duration) Value {
+	return NewString(strconv.FormatFloat(d.Seconds(), 'f', 6, 64))
+}
+
+// cpuTimes returns the user and system time used by the shell and the
+// external commands it has waited for.
+func cpuTimes() (user, sys time.Duration) {
+	for _, who := range []int{syscall.RUSAGE_SELF, syscall.RUSAGE_CHILDREN} {
+		var ru syscall.Rusage
+		if syscall.Getrusage(who, &ru) == nil {
+			user += time.Duration(ru.Utime.Nano())
+			sys += time.Duration(ru.Stime.Nano())
+		}
+	}
+	return
+}
+
+// compileTime compiles a time special form, which calls a closure without
+// arguments and reports how long it took, as a table of seconds, e.g.
+//
+// time { make } # [&wall 3.141593 &user 2.718282 &sys 0.577216]
+//
+// The closure's output is not touched. The report is output as a value if
+// there is a channel to output to, and printed otherwise. User and system
+// times include those of the rest of the shell while the closure runs. The
+// exit value of the form is that of the closure.
+func compileTime(cp *Compiler, fn *parse.FormNode) strOp {
+	args := fn.Args.Nodes
+	if len(args) != 1 {
+		cp.errorf(fn, "time form must be `time closure`")
+	}
+	op := cp.compileTerm(args[0])
+	return func(ev *Evaluator) string {
+		v := ev.asSingleValue(args[0], op.f(ev), "argument of time")
+		c, ok := v.(*Closure)
+		if !ok {
+			ev.errorfNode(args[0], "time argument must be a closure, got %s", v.Repr())
+		}
+
+		start := time.Now()
+		user, sys := cpuTimes()
+		msg := ev.callClosure(c, nil)
+		wall := time.Since(start)
+		endUser, endSys := cpuTimes()
+
+		report := NewTable()
+		report.put(NewString("wall"), seconds(wall))
+		report.put(NewString("user"), seconds(endUser-user))
+		report.put(NewString("sys"), seconds(endSys-sys))
+		if out := ev.ports[1]; out != nil && out.ch != nil {
+			out.ch <- report
+		} else if out != nil && out.f != nil {
+			fmt.Fprintln(out.f, report.Repr())
+		}
+		return msg
+	}
+}
@@ -0,0 +1,229 @@
+package eval
+
+// The test: builtins, for scripts and modules to carry their own tests, e.g.
+//
+// test:group str {
+//     test:case pad { test:assert-eq (str:pad a 3) `a  ` }
+//     test:case contains { test:assert (str:contains abc b) }
+// }
+// test:run
+//
+// test:case only registers a test, and test:run runs the tests registered,
+// in the order they were registered in. The assertions of a test that fail
+// are reported with where they are; a test goes on after a failed assertion,
+// and fails if any of its assertions did or if it throws an error. Outside of
+// tests, a failed assertion throws an error.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/xiaq/elvish/util"
+)
+
+type testState struct {
+	mutex   sync.Mutex
+	groups  []string    // Names of the groups being defined.
+	cases   []*testCase // Registered tests not run yet.
+	running *testCase
+}
+
+type testCase struct {
+	name     string
+	body     *Closure
+	failures []error
+}
+
+func init() {
+	// Needed to avoid initialization loop
+	builtinFuncs["test:assert"] = builtinFunc{testAssert, [2]StreamType{}}
+	builtinFuncs["test:assert-eq"] = builtinFunc{testAssertEq, [2]StreamType{}}
+	builtinFuncs["test:group"] = builtinFunc{testGroup, [2]StreamType{}}
+	builtinFuncs["test:case"] = builtinFunc{testCaseFn, [2]StreamType{}}
+	builtinFuncs["test:run"] = builtinFunc{testRun, [2]StreamType{0, fdStream}}
+}
+
+// fail reports a failed assertion with the position of the form being
+// evaluated. It is recorded for the test running, if there is one, and
+// thrown otherwise.
+func (ev *Evaluator) fail(format string, args ...interface{}) string {
+	var err error
+	if n := len(ev.nodes); n > 0 {
+		err = ev.contextualError(ev.nodes[n-1], format, args...)
+	} else {
+		err = fmt.Errorf(format, args...)
+	}
+	ev.tests.mutex.Lock()
+	running := ev.tests.running
+	if running != nil {
+		running.failures = append(running.failures, err)
+	}
+	ev.tests.mutex.Unlock()
+	if running == nil {
+		util.Panic(err)
+	}
+	return "assertion failed"
+}
+
+// testAssert implements test:assert, which fails if its first argument is not
+// true, as in the logical forms, e.g.
+//
+// test:assert (fs:is-dir /tmp) `/tmp is missing`
+func testAssert(ev *Evaluator, args []Value) string {
+	if len(args) != 1 && len(args) != 2 {
+		return "args error"
+	}
+	if ev.truthOf(args[0]) {
+		return ""
+	}
+	if len(args) == 2 {
+		return ev.fail("assertion failed: %s", args[1].String())
+	}
+	return ev.fail("assertion failed")
+}
+
+// testAssertEq implements test:assert-eq, which fails if its first two
+// arguments, the actual and the wanted value, are not equal, e.g.
+//
+// test:assert-eq (path:base /a/b) b
+func testAssertEq(ev *Evaluator, args []Value) string {
+	if len(args) != 2 && len(args) != 3 {
+		return "args error"
+	}
+	if args[0].Eq(args[1]) {
+		return ""
+	}
+	msg := fmt.Sprintf("got %s, want %s", args[0].Repr(), args[1].Repr())
+	if len(args) == 3 {
+		msg = args[2].String() + ": " + msg
+	}
+	return ev.fail("assertion failed: %s", msg)
+}
+
+// testGroup implements test:group, which calls a closure, prefixing the names
+// of the tests it registers with the name of the group and a slash.
+func testGroup(ev *Evaluator, args []Value) string {
+	if len(args) != 2 {
+		return "args error"
+	}
+	c, ok := args[1].(*Closure)
+	if !ok {
+		return fmt.Sprintf("test:group body must be a closure, got %s", args[1].Repr())
+	}
+	ts := ev.tests
+	ts.mutex.Lock()
+	ts.groups = append(ts.groups, args[0].String())
+	ts.mutex.Unlock()
+	defer func() {
+		ts.mutex.Lock()
+		ts.groups = ts.groups[:len(ts.groups)-1]
+		ts.mutex.Unlock()
+	}()
+	return ev.callClosure(c, nil)
+}
+
+// testCaseFn implements test:case, which registers a test with a name and a
+// closure.
+func testCaseFn(ev *Evaluator, args []Value) string {
+	if len(args) != 2 {
+		return "args error"
+	}
+	c, ok := args[1].(*Closure)
+	if !ok {
+		return fmt.Sprintf("test:case body must be a closure, got %s", args[1].Repr())
+	}
+	ts := ev.tests
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	name := strings.Join(append(append([]string(nil), ts.groups...), args[0].String()), "/")
+	ts.cases = append(ts.cases, &testCase{name: name, body: c})
+	return ""
+}
+
+// testRun implements test:run, which runs the tests registered, or those with
+// names starting with one of its arguments, and reports the failed ones, e.g.
+//
+// test:run str/
+//
+// The tests run are removed from the registered ones. It fails if any test
+// fails.
+func testRun(ev *Evaluator, args []Value) string {
+	ts := ev.tests
+	ts.mutex.Lock()
+	var run, kept []*testCase
+	for _, tc := range ts.cases {
+		if testSelected(tc.name, args) {
+			run = append(run, tc)
+		} else {
+			kept = append(kept, tc)
+		}
+	}
+	ts.cases = kept
+	ts.mutex.Unlock()
+
+	out := ev.ports[1].f
+	failed := 0
+	for _, tc := range run {
+		ev.runTest(tc)
+		if len(tc.failures) == 0 {
+			continue
+		}
+		failed++
+		fmt.Fprintf(out, "--- FAIL: %s\n", tc.name)
+		for _, err := range tc.failures {
+			if ce, ok := err.(*util.ContextualError); ok {
+				fmt.Fprint(out, ce.Pprint())
+			} else {
+				fmt.Fprintln(out, err)
+			}
+		}
+	}
+	if failed > 0 {
+		msg := strconv.Itoa(failed) + " of " + strconv.Itoa(len(run)) + " tests failed"
+		fmt.Fprintln(out, "FAIL:", msg)
+		return msg
+	}
+	fmt.Fprintf(out, "PASS: %d tests\n", len(run))
+	return ""
+}
+
+func testSelected(name string, prefixes []Value) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, p := range prefixes {
+		if strings.HasPrefix(name, p.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+// runTest runs the body of a test, recording the error it throws as a failure
+// along with the failed assertions.
+func (ev *Evaluator) runTest(tc *testCase) {
+	ev.tests.mutex.Lock()
+	ev.tests.running = tc
+	ev.tests.mutex.Unlock()
+	defer func() {
+		ev.tests.mutex.Lock()
+		ev.tests.running = nil
+		ev.tests.mutex.Unlock()
+	}()
+
+	c := tc.body
+	newEv := ev.copy()
+	defer newEv.releasePorts()
+	newEv.scope = newVarScope(nil)
+	for name, v := range c.Enclosed {
+		newEv.scope.define(name, v)
+	}
+	newEv.statusCb = nil
+	if err := newEv.eval(c.srcName, c.srcText, c.Op); err != nil {
+		ev.tests.mutex.Lock()
+		tc.failures = append(tc.failures, err)
+		ev.tests.mutex.Unlock()
+	}
+}
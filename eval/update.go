@@ -0,0 +1,263 @@
+package eval
+
+// Checking for new releases and upgrading the elvish binary, for installations
+// outside package managers.
+//
+// The update endpoint, UpdateURL, serves a JSON description of the latest
+// release, e.g.
+//
+// {"version": "0.2", "binaries": {"linux-amd64": {
+//     "url": "https://example.com/elvish-0.2-linux-amd64",
+//     "sha256": "<hex>", "signature": "<hex>"}}}
+//
+// A downloaded binary must match its SHA-256 checksum, and the signature must
+// be an Ed25519 signature of its manifest, made with the private key
+// corresponding to the public key of the build, UpdateKey. The manifest names
+// the version and the platform along with the checksum (see
+// releaseManifest), so that whoever controls the endpoint can't pass off an
+// older release as the latest, or a binary for another platform. Only
+// versions newer than the running one are installed. Builds without a key can
+// check for updates, but not upgrade themselves.
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The update endpoint and the hex-encoded Ed25519 public key that releases are
+// signed with, set with the -X flag of the linker like Version. Without an
+// endpoint, the update builtins fail and interactive sessions don't check for
+// updates.
+var (
+	UpdateURL = ""
+	UpdateKey = ""
+)
+
+var errNoUpdateKey = errors.New("this build of elvish has no update key to verify releases with; upgrade it the way it was installed")
+
+const updateTimeout = 30 * time.Second
+
+type release struct {
+	Version  string
+	Binaries map[string]releaseBinary
+}
+
+type releaseBinary struct {
+	URL       string `json:"url"`
+	SHA256    string `json:"sha256"`
+	Signature string `json:"signature"`
+}
+
+var updateClient = &http.Client{Timeout: updateTimeout}
+
+func httpGet(url string) ([]byte, error) {
+	resp, err := updateClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func fetchRelease() (*release, error) {
+	if UpdateURL == "" {
+		return nil, errors.New("this build of elvish has no update endpoint")
+	}
+	body, err := httpGet(UpdateURL)
+	if err != nil {
+		return nil, err
+	}
+	r := new(release)
+	if err := json.Unmarshal(body, r); err != nil {
+		return nil, fmt.Errorf("bad release description: %v", err)
+	}
+	return r, nil
+}
+
+// newerVersion determines whether version a is newer than version b. Versions
+// are compared by their dot-separated numbers, like 0.10 > 0.9; a version
+// that doesn't start with a number, like a development build's unknown,
+// is older than any other.
+func newerVersion(a, b string) bool {
+	na, nb := versionNumbers(a), versionNumbers(b)
+	for i := 0; i < len(na) && i < len(nb); i++ {
+		if na[i] != nb[i] {
+			return na[i] > nb[i]
+		}
+	}
+	return len(na) > len(nb)
+}
+
+func versionNumbers(v string) []int {
+	var ns []int
+	for _, part := range strings.Split(strings.TrimPrefix(v, "v"), ".") {
+		end := 0
+		for end < len(part) && '0' <= part[end] && part[end] <= '9' {
+			end++
+		}
+		n, err := strconv.Atoi(part[:end])
+		if err != nil {
+			break
+		}
+		ns = append(ns, n)
+		if end < len(part) {
+			// A suffix like -3-gabcdef from git describe.
+			break
+		}
+	}
+	return ns
+}
+
+// CheckUpdate returns the latest version of elvish, and whether it is newer
+// than the running one.
+func CheckUpdate() (string, bool, error) {
+	r, err := fetchRelease()
+	if err != nil {
+		return "", false, err
+	}
+	return r.Version, newerVersion(r.Version, Version), nil
+}
+
+// releaseManifest returns what is signed for the binary of a release for a
+// platform, like linux-amd64, with a hex-encoded SHA-256 checksum.
+func releaseManifest(version, platform, sha256 string) []byte {
+	return []byte(fmt.Sprintf("elvish release\nversion %s\nplatform %s\nsha256 %s\n", version, platform, sha256))
+}
+
+// download downloads the binary of a release for a platform, and verifies its
+// checksum and the signature of its manifest.
+func download(version, platform string, b releaseBinary) ([]byte, error) {
+	if UpdateKey == "" {
+		return nil, errNoUpdateKey
+	}
+	key, err := hex.DecodeString(UpdateKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("this build of elvish has a bad update key")
+	}
+	data, err := httpGet(b.URL)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	wanted, err := hex.DecodeString(b.SHA256)
+	if err != nil || !bytes.Equal(sum[:], wanted) {
+		return nil, errors.New("checksum mismatch")
+	}
+	manifest := releaseManifest(version, platform, hex.EncodeToString(sum[:]))
+	sig, err := hex.DecodeString(b.Signature)
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(key), manifest, sig) {
+		return nil, errors.New("bad signature")
+	}
+	return data, nil
+}
+
+// replaceFile replaces the file at path with data, keeping its mode. The data
+// is written to a temporary file next to it, which is then renamed, so that
+// the file is never partly written.
+func replaceFile(path string, data []byte) error {
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".elvish-upgrade")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(info.Mode())
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// upgrade replaces the binary at path with the latest release, if it is
+// newer, returning the version of the release.
+func upgrade(path string) (string, bool, error) {
+	r, err := fetchRelease()
+	if err != nil {
+		return "", false, err
+	}
+	if !newerVersion(r.Version, Version) {
+		return r.Version, false, nil
+	}
+	platform := runtime.GOOS + "-" + runtime.GOARCH
+	b, ok := r.Binaries[platform]
+	if !ok {
+		return "", false, fmt.Errorf("elvish %s has no binary for %s", r.Version, platform)
+	}
+	data, err := download(r.Version, platform, b)
+	if err != nil {
+		return "", false, err
+	}
+	return r.Version, true, replaceFile(path, data)
+}
+
+// checkUpdate outputs the running and the latest version of elvish, and
+// whether the latest one is newer, e.g.
+//
+// shell:check-update # [&current 0.1 &latest 0.2 &newer true]
+func checkUpdate(ev *Evaluator, args []Value) string {
+	if len(args) != 0 {
+		return "args error"
+	}
+	latest, newer, err := CheckUpdate()
+	if err != nil {
+		return err.Error()
+	}
+	t := NewTable()
+	t.put(NewString("current"), NewString(Version))
+	t.put(NewString("latest"), NewString(latest))
+	t.put(NewString("newer"), boolValue(newer))
+	ev.ports[1].ch <- t
+	return ""
+}
+
+// selfUpgrade replaces the running elvish binary with the latest release. The
+// new binary is used by elvish processes started afterwards.
+func selfUpgrade(ev *Evaluator, args []Value) string {
+	if len(args) != 0 {
+		return "args error"
+	}
+	path, err := os.Executable()
+	if err != nil {
+		return err.Error()
+	}
+	version, upgraded, err := upgrade(path)
+	if err != nil {
+		return err.Error()
+	}
+	out := ev.ports[1].f
+	if upgraded {
+		fmt.Fprintf(out, "Upgraded to elvish %s\n", version)
+	} else {
+		fmt.Fprintf(out, "elvish %s is the latest\n", Version)
+	}
+	return ""
+}
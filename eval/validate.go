@@ -0,0 +1,280 @@
+package eval
+
+// The validate builtin.
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var errValidateArgs = errors.New("usage: validate schema value")
+
+// validationError is an error found by validate, at the JSON pointer path in
+// the value.
+type validationError struct {
+	path, message string
+}
+
+// validator validates values against a schema, collecting errors.
+type validator struct {
+	errors []validationError
+}
+
+func (vd *validator) errorf(path, format string, args ...interface{}) {
+	if path == "" {
+		path = "/"
+	}
+	vd.errors = append(vd.errors, validationError{path, fmt.Sprintf(format, args...)})
+}
+
+// schemaNumber looks up a numeric keyword of a schema.
+func schemaNumber(schema *Table, name string) (float64, bool, error) {
+	v, ok := schema.lookup(name)
+	if !ok {
+		return 0, false, nil
+	}
+	f, err := strconv.ParseFloat(v.String(), 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("bad %s in schema: %s", name, v.Repr())
+	}
+	return f, true, nil
+}
+
+// checkType checks whether v is of a JSON Schema type. Since elvish has only
+// strings and tables, numbers, integers and booleans are strings of the
+// corresponding form, arrays are tables without a dict part and objects are
+// tables without a list part.
+func checkType(typ string, v Value) (bool, error) {
+	switch typ {
+	case "string":
+		_, ok := v.(*String)
+		return ok, nil
+	case "number":
+		_, err := strconv.ParseFloat(v.String(), 64)
+		_, ok := v.(*String)
+		return ok && err == nil, nil
+	case "integer":
+		_, err := strconv.ParseInt(v.String(), 10, 64)
+		_, ok := v.(*String)
+		return ok && err == nil, nil
+	case "boolean":
+		s, ok := v.(*String)
+		return ok && (*s == "true" || *s == "false"), nil
+	case "array":
+		t, ok := v.(*Table)
+		return ok && len(t.Dict) == 0, nil
+	case "object":
+		t, ok := v.(*Table)
+		return ok && len(t.List) == 0, nil
+	}
+	return false, fmt.Errorf("unknown type in schema: %s", typ)
+}
+
+// validate validates v, at path, against a schema. It supports the keywords
+// type (a type or a list of types), enum, minLength, maxLength, pattern,
+// minimum, maximum, items, minItems, maxItems, properties, required and
+// additionalProperties (only as false) of JSON Schema. An error in the schema
+// itself is returned.
+func (vd *validator) validate(schema *Table, v Value, path string) error {
+	if typ, ok := schema.lookup("type"); ok {
+		types := []Value{typ}
+		if t, ok := typ.(*Table); ok {
+			types = t.List
+		}
+		matched := false
+		names := make([]string, len(types))
+		for i, t := range types {
+			names[i] = t.String()
+			ok, err := checkType(t.String(), v)
+			if err != nil {
+				return err
+			}
+			matched = matched || ok
+		}
+		if !matched {
+			vd.errorf(path, "expect %s, got %s", strings.Join(names, " or "), v.Repr())
+			return nil
+		}
+	}
+
+	if enum, ok := schema.lookup("enum"); ok {
+		t, ok := enum.(*Table)
+		if !ok {
+			return fmt.Errorf("bad enum in schema: %s", enum.Repr())
+		}
+		found := false
+		for _, e := range t.List {
+			if e.Repr() == v.Repr() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			vd.errorf(path, "%s is not one of %s", v.Repr(), enum.Repr())
+		}
+	}
+
+	switch v := v.(type) {
+	case *String:
+		return vd.validateString(schema, string(*v), path)
+	case *Table:
+		return vd.validateTable(schema, v, path)
+	}
+	return nil
+}
+
+func (vd *validator) validateString(schema *Table, s string, path string) error {
+	n := float64(len([]rune(s)))
+	if min, ok, err := schemaNumber(schema, "minLength"); err != nil {
+		return err
+	} else if ok && n < min {
+		vd.errorf(path, "%s is shorter than %g", quote(s), min)
+	}
+	if max, ok, err := schemaNumber(schema, "maxLength"); err != nil {
+		return err
+	} else if ok && n > max {
+		vd.errorf(path, "%s is longer than %g", quote(s), max)
+	}
+	if p, ok := schema.lookup("pattern"); ok {
+		re, err := regexp.Compile(p.String())
+		if err != nil {
+			return fmt.Errorf("bad pattern in schema: %s", err)
+		}
+		if !re.MatchString(s) {
+			vd.errorf(path, "%s does not match pattern %s", quote(s), quote(p.String()))
+		}
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		if min, ok, err := schemaNumber(schema, "minimum"); err != nil {
+			return err
+		} else if ok && f < min {
+			vd.errorf(path, "%s is less than %g", s, min)
+		}
+		if max, ok, err := schemaNumber(schema, "maximum"); err != nil {
+			return err
+		} else if ok && f > max {
+			vd.errorf(path, "%s is greater than %g", s, max)
+		}
+	}
+	return nil
+}
+
+func (vd *validator) validateTable(schema *Table, t *Table, path string) error {
+	n := float64(len(t.List))
+	if min, ok, err := schemaNumber(schema, "minItems"); err != nil {
+		return err
+	} else if ok && n < min {
+		vd.errorf(path, "has %d items, fewer than %g", len(t.List), min)
+	}
+	if max, ok, err := schemaNumber(schema, "maxItems"); err != nil {
+		return err
+	} else if ok && n > max {
+		vd.errorf(path, "has %d items, more than %g", len(t.List), max)
+	}
+	if items, ok := schema.lookup("items"); ok {
+		s, ok := items.(*Table)
+		if !ok {
+			return fmt.Errorf("bad items in schema: %s", items.Repr())
+		}
+		for i, elem := range t.List {
+			if err := vd.validate(s, elem, path+"/"+strconv.Itoa(i)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if required, ok := schema.lookup("required"); ok {
+		r, ok := required.(*Table)
+		if !ok {
+			return fmt.Errorf("bad required in schema: %s", required.Repr())
+		}
+		for _, name := range r.List {
+			if _, ok := t.lookup(name.String()); !ok {
+				vd.errorf(path, "missing required key %s", name.Repr())
+			}
+		}
+	}
+
+	var props *Table
+	if p, ok := schema.lookup("properties"); ok {
+		props, ok = p.(*Table)
+		if !ok {
+			return fmt.Errorf("bad properties in schema: %s", p.Repr())
+		}
+	}
+	additional := true
+	if a, ok := schema.lookup("additionalProperties"); ok {
+		additional = a.String() != "false"
+	}
+	if props == nil && additional {
+		return nil
+	}
+
+	// Validate keys in a stable order, so that errors are reported in the
+	// same order every time.
+	keys := make([]string, 0, len(t.Dict))
+	values := make(map[string]Value, len(t.Dict))
+	for k, v := range t.Dict {
+		keys = append(keys, k.String())
+		values[k.String()] = v
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var s Value
+		ok := false
+		if props != nil {
+			s, ok = props.lookup(k)
+		}
+		if !ok {
+			if !additional {
+				vd.errorf(path, "unexpected key %s", quote(k))
+			}
+			continue
+		}
+		st, isTable := s.(*Table)
+		if !isTable {
+			return fmt.Errorf("bad schema for property %s: %s", quote(k), s.Repr())
+		}
+		p := path + "/" + strings.Replace(strings.Replace(k, "~", "~0", -1), "/", "~1", -1)
+		if err := vd.validate(st, values[k], p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateFn validates a value against a schema, which is a table following
+// a subset of JSON Schema, e.g.
+//
+// validate [&type object &required [name] &properties [&name [&type string]]] $v
+//
+// Each error is output as a table [&path /a/0 &message ...], and validate
+// fails if there are any.
+func validateFn(ev *Evaluator, args []Value) string {
+	out := ev.ports[1].ch
+	if len(args) != 2 {
+		return errValidateArgs.Error()
+	}
+	schema, ok := args[0].(*Table)
+	if !ok {
+		return errValidateArgs.Error()
+	}
+	vd := &validator{}
+	if err := vd.validate(schema, args[1], ""); err != nil {
+		return err.Error()
+	}
+	for _, e := range vd.errors {
+		t := NewTable()
+		t.put(NewString("path"), NewString(e.path))
+		t.put(NewString("message"), NewString(e.message))
+		out <- t
+	}
+	if len(vd.errors) > 0 {
+		return "validation failed"
+	}
+	return ""
+}
@@ -3,9 +3,13 @@ package eval
 import (
 	"bytes"
 	"fmt"
+	"hash/fnv"
 	"os"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"unicode"
 	"unicode/utf8"
 
@@ -68,7 +72,7 @@ type ClosureType struct {
 }
 
 func (st ClosureType) Default() Value {
-	return NewClosure([]string{}, nil, map[string]*Value{}, st.Bounds)
+	return NewClosure([]string{}, "", nil, map[string]*Var{}, st.Bounds)
 }
 
 func (ct ClosureType) Caret(t Type) Type {
@@ -76,11 +80,28 @@ func (ct ClosureType) Caret(t Type) Type {
 	return AnyType{}
 }
 
+// assignable determines whether a value of type t2 can be assigned to a
+// variable of type t1. Closure types are assignable to each other regardless
+// of their bounds.
+func assignable(t1, t2 Type) bool {
+	if _, ok := t1.(ClosureType); ok {
+		_, ok := t2.(ClosureType)
+		return ok
+	}
+	return t1 == t2
+}
+
 var typenames = map[string]Type{
-	"string":  StringType{},
-	"table":   TableType{},
-	"env":     EnvType{},
-	"closure": ClosureType{[2]StreamType{}},
+	"string":   StringType{},
+	"table":    TableType{},
+	"env":      EnvType{},
+	"closure":  ClosureType{[2]StreamType{}},
+	"bytes":    BytesType{},
+	"file":     FileType{},
+	"listener": ListenerType{},
+	"chan":     ChanType{},
+	"mutex":    MutexType{},
+	"once":     OnceType{},
 }
 
 // Value is the runtime representation of an elvish value.
@@ -89,10 +110,22 @@ type Value interface {
 	Repr() string
 	String() string
 	Caret(ev *Evaluator, v Value) Value
+	// Eq determines whether the value is equal to another value.
+	Eq(v Value) bool
+	// Hash returns a hash of the value, which is the same for equal values,
+	// so that all values can be keys of the dict part of a Table.
+	Hash() uint32
 }
 
-func valuePtr(v Value) *Value {
-	return &v
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// hashPointer hashes a value that is only equal to itself.
+func hashPointer(v Value) uint32 {
+	return uint32(reflect.ValueOf(v).Pointer())
 }
 
 // String is a string.
@@ -162,10 +195,29 @@ func (s *String) Caret(ev *Evaluator, v Value) Value {
 	return NewString(string(*s) + v.String())
 }
 
-// Table is a list-dict hybrid.
+func (s *String) Eq(v Value) bool {
+	s2, ok := v.(*String)
+	return ok && *s == *s2
+}
+
+func (s *String) Hash() uint32 {
+	return hashString(string(*s))
+}
+
+// Table is a list-dict hybrid. The keys of the dict part keep the order in
+// which they were added with put, which is also the order they are shown and
+// iterated in.
+//
+// Tables are values, and are not changed once made available to elvish code:
+// assigning to an element puts a changed copy in the variable, so that tables
+// can be shared by variables, closures and goroutines freely. As a result,
+// keys may be any values, including tables.
 type Table struct {
 	List []Value
 	Dict map[Value]Value
+	keys []Value
+	// Keys added with put, by their Hash.
+	index map[uint32][]Value
 }
 
 func (t *Table) Type() Type {
@@ -184,8 +236,8 @@ func (t *Table) Repr() string {
 		fmt.Fprint(buf, sep, v.Repr())
 		sep = " "
 	}
-	for k, v := range t.Dict {
-		fmt.Fprint(buf, sep, "&", k.Repr(), " ", v.Repr())
+	for _, k := range t.Keys() {
+		fmt.Fprint(buf, sep, "&", k.Repr(), " ", t.Dict[k].Repr())
 		sep = " "
 	}
 	buf.WriteRune(']')
@@ -204,30 +256,196 @@ func (t *Table) Caret(ev *Evaluator, v Value) Value {
 		if len(v.List) != 1 || len(v.Dict) != 0 {
 			ev.errorf("subscription must be single-element list")
 		}
-		sub, ok := v.List[0].(*String)
-		if !ok {
-			ev.errorf("subscription must be single-element string list")
-		}
-		// Need stricter notion of list indices
-		// TODO Handle invalid index
-		idx, err := strconv.ParseUint(sub.String(), 10, 0)
-		if err == nil {
-			return t.List[idx]
+		elem, err := t.getIndex(v.List[0])
+		if err != nil {
+			ev.errorf("%s", err)
 		}
-		return t.Dict[sub]
+		return elem
 	default:
 		ev.errorf("Table can only be careted with String or Table")
 		return nil
 	}
 }
 
+// Eq compares Tables deeply: their list parts must have equal elements in the
+// same order, and their dict parts equal values for equal keys, in any order.
+func (t *Table) Eq(v Value) bool {
+	t2, ok := v.(*Table)
+	if !ok || len(t.List) != len(t2.List) || len(t.Dict) != len(t2.Dict) {
+		return false
+	}
+	for i, e := range t.List {
+		if !e.Eq(t2.List[i]) {
+			return false
+		}
+	}
+	for k, e := range t.Dict {
+		k2, ok := t2.dictKey(k)
+		if !ok || !e.Eq(t2.Dict[k2]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Hash combines the hashes of the elements of the list part in order, and
+// those of the pairs of the dict part in any order.
+func (t *Table) Hash() uint32 {
+	var h, dh uint32
+	for _, e := range t.List {
+		h = h*31 + e.Hash()
+	}
+	for k, e := range t.Dict {
+		dh += k.Hash()*31 ^ e.Hash()
+	}
+	return h ^ dh*1000003
+}
+
 func (t *Table) append(vs ...Value) {
 	t.List = append(t.List, vs...)
 }
 
-// Env provides access to environment variables.
+// put sets the value of a key in the dict part. A new key goes after the
+// existing ones, while an existing key equal to k keeps its place.
+func (t *Table) put(k, v Value) {
+	if key, ok := t.dictKey(k); ok {
+		t.Dict[key] = v
+		return
+	}
+	t.Dict[k] = v
+	t.keys = append(t.keys, k)
+	if t.index == nil {
+		t.index = make(map[uint32][]Value)
+	}
+	h := k.Hash()
+	t.index[h] = append(t.index[h], k)
+}
+
+// remove removes the key equal to k from the dict part, if there is one.
+func (t *Table) remove(k Value) {
+	key, ok := t.dictKey(k)
+	if !ok {
+		return
+	}
+	delete(t.Dict, key)
+	for i, tk := range t.keys {
+		if tk == key {
+			t.keys = append(t.keys[:i:i], t.keys[i+1:]...)
+			break
+		}
+	}
+	h := key.Hash()
+	for i, tk := range t.index[h] {
+		if tk == key {
+			t.index[h] = append(t.index[h][:i:i], t.index[h][i+1:]...)
+			break
+		}
+	}
+}
+
+// Keys returns the keys of the dict part in the order they were added. Keys
+// set on Dict directly rather than with put come last, sorted by their
+// String.
+func (t *Table) Keys() []Value {
+	keys := make([]Value, 0, len(t.Dict))
+	seen := make(map[Value]bool, len(t.Dict))
+	for _, k := range t.keys {
+		if _, ok := t.Dict[k]; ok && !seen[k] {
+			keys = append(keys, k)
+			seen[k] = true
+		}
+	}
+	if len(keys) == len(t.Dict) {
+		return keys
+	}
+	var rest []Value
+	for k := range t.Dict {
+		if !seen[k] {
+			rest = append(rest, k)
+		}
+	}
+	sort.Slice(rest, func(i, j int) bool { return rest[i].String() < rest[j].String() })
+	return append(keys, rest...)
+}
+
+// listIndex parses idx as an index into the list part. It returns false if idx
+// is not a list index, in which case it is a key into the dict part.
+func listIndex(idx Value) (int, bool) {
+	// Need stricter notion of list indices
+	i, err := strconv.ParseUint(idx.String(), 10, 0)
+	return int(i), err == nil
+}
+
+// dictKey finds the key in the dict part that is equal to k.
+func (t *Table) dictKey(k Value) (Value, bool) {
+	if _, ok := t.Dict[k]; ok {
+		return k, true
+	}
+	for _, key := range t.index[k.Hash()] {
+		if _, ok := t.Dict[key]; ok && key.Eq(k) {
+			return key, true
+		}
+	}
+	if len(t.keys) == len(t.Dict) {
+		return nil, false
+	}
+	// Keys set on Dict directly are not in the index.
+	for key := range t.Dict {
+		if key.Eq(k) {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// lookup returns the value of a string key in the dict part.
+func (t *Table) lookup(name string) (Value, bool) {
+	key, ok := t.dictKey(NewString(name))
+	if !ok {
+		return nil, false
+	}
+	return t.Dict[key], true
+}
+
+// getIndex returns the element with the given index. If idx is a
+// non-negative integer, it indexes the list part; otherwise it is looked up
+// in the dict part.
+func (t *Table) getIndex(idx Value) (Value, error) {
+	if i, ok := listIndex(idx); ok {
+		if i >= len(t.List) {
+			return nil, fmt.Errorf("index out of range: %s", idx.Repr())
+		}
+		return t.List[i], nil
+	}
+	if key, ok := t.dictKey(idx); ok {
+		return t.Dict[key], nil
+	}
+	return nil, fmt.Errorf("no such key: %s", idx.Repr())
+}
+
+// setIndex sets the element with the given index, interpreted as in getIndex.
+// New keys may be added to the dict part, but the list part is never
+// extended.
+func (t *Table) setIndex(idx Value, v Value) error {
+	if i, ok := listIndex(idx); ok {
+		if i >= len(t.List) {
+			return fmt.Errorf("index out of range: %s", idx.Repr())
+		}
+		t.List[i] = v
+		return nil
+	}
+	t.put(idx, v)
+	return nil
+}
+
+// Env provides access to environment variables. It is shared by the forms
+// running concurrently, so its maps are guarded by mutex.
 type Env struct {
-	m map[string]string
+	mutex sync.RWMutex
+	m     map[string]string
+	// Names of the variables in m that are not passed to external commands;
+	// see export.go.
+	local map[string]bool
 }
 
 func (e *Env) Type() Type {
@@ -239,6 +457,8 @@ func NewEnv() *Env {
 }
 
 func (e *Env) fill() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
 	if e.m != nil {
 		return
 	}
@@ -251,21 +471,80 @@ func (e *Env) fill() {
 	}
 }
 
+// get returns the value of a variable, and whether it exists.
+func (e *Env) get(name string) (string, bool) {
+	e.fill()
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	value, ok := e.m[name]
+	return value, ok
+}
+
+// set sets a variable, keeping whether it is exported.
+func (e *Env) set(name, value string) {
+	e.fill()
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.m[name] = value
+}
+
+// all returns a copy of the variables.
+func (e *Env) all() map[string]string {
+	e.fill()
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	m := make(map[string]string, len(e.m))
+	for k, v := range e.m {
+		m[k] = v
+	}
+	return m
+}
+
+// with returns a copy of e with a variable set and exported.
+func (e *Env) with(name, value string) *Env {
+	e.fill()
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	e2 := &Env{m: make(map[string]string, len(e.m)+1), local: make(map[string]bool, len(e.local))}
+	for k, v := range e.m {
+		e2.m[k] = v
+	}
+	for k := range e.local {
+		e2.local[k] = true
+	}
+	e2.m[name] = value
+	delete(e2.local, name)
+	return e2
+}
+
+// Export returns the variables passed to external commands, in the form
+// "key=value".
 func (e *Env) Export() []string {
+	return e.exportWith(nil)
+}
+
+// exportWith is like Export, but the values in overrides take precedence.
+func (e *Env) exportWith(overrides map[string]string) []string {
 	e.fill()
-	s := make([]string, 0, len(e.m))
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	s := make([]string, 0, len(e.m)+len(overrides))
 	for k, v := range e.m {
+		if _, ok := overrides[k]; !ok && !e.local[k] {
+			s = append(s, fmt.Sprintf("%s=%s", k, v))
+		}
+	}
+	for k, v := range overrides {
 		s = append(s, fmt.Sprintf("%s=%s", k, v))
 	}
 	return s
 }
 
 func (e *Env) Repr() string {
-	e.fill()
 	buf := new(bytes.Buffer)
 	buf.WriteRune('[')
 	sep := ""
-	for k, v := range e.m {
+	for k, v := range e.all() {
 		fmt.Fprint(buf, sep, "&", quote(k), " ", quote(v))
 		sep = " "
 	}
@@ -274,12 +553,39 @@ func (e *Env) Repr() string {
 }
 
 func (e *Env) String() string {
-	e.fill()
 	return e.Repr()
 }
 
+func (e *Env) Eq(v Value) bool {
+	e2, ok := v.(*Env)
+	if !ok {
+		return false
+	}
+	if e == e2 {
+		return true
+	}
+	m, m2 := e.all(), e2.all()
+	if len(m) != len(m2) {
+		return false
+	}
+	for k, s := range m {
+		if s2, ok := m2[k]; !ok || s != s2 {
+			return false
+		}
+	}
+	return true
+}
+
+// Hash combines the hashes of the variables in any order.
+func (e *Env) Hash() uint32 {
+	var h uint32
+	for k, s := range e.all() {
+		h += hashString(k + "=" + s)
+	}
+	return h
+}
+
 func (e *Env) Caret(ev *Evaluator, v Value) Value {
-	e.fill()
 	switch v := v.(type) {
 	case *Table:
 		if len(v.List) != 1 || len(v.Dict) != 0 {
@@ -290,7 +596,8 @@ func (e *Env) Caret(ev *Evaluator, v Value) Value {
 			ev.errorf("subscription must be single-element string list")
 		}
 		// TODO Handle invalid index
-		return NewString(e.m[sub.String()])
+		value, _ := e.get(sub.String())
+		return NewString(value)
 	default:
 		ev.errorf("Env can only be careted with Table")
 		return nil
@@ -300,17 +607,24 @@ func (e *Env) Caret(ev *Evaluator, v Value) Value {
 // Closure is a closure.
 type Closure struct {
 	ArgNames []string
+	RestArg  string // Name of the rest argument; empty if there is none
 	Op       Op
-	Enclosed map[string]*Value
+	Enclosed map[string]*Var
 	Bounds   [2]StreamType
+	// Name and text of the source the closure was defined in, used to
+	// report errors.
+	srcName, srcText string
+	// API version of the code the closure was compiled from, used to call
+	// it as a hook; 0 if not compiled from elvish code.
+	apiVersion int
 }
 
 func (c *Closure) Type() Type {
 	return ClosureType{c.Bounds}
 }
 
-func NewClosure(a []string, op Op, e map[string]*Value, b [2]StreamType) *Closure {
-	return &Closure{a, op, e, b}
+func NewClosure(a []string, r string, op Op, e map[string]*Var, b [2]StreamType) *Closure {
+	return &Closure{ArgNames: a, RestArg: r, Op: op, Enclosed: e, Bounds: b}
 }
 
 func (c *Closure) Repr() string {
@@ -321,6 +635,16 @@ func (c *Closure) String() string {
 	return c.Repr()
 }
 
+// Eq determines whether two values are the same closure. Closures made by
+// evaluating the same code are not equal, since the code can't be compared.
+func (c *Closure) Eq(v Value) bool {
+	return c == v
+}
+
+func (c *Closure) Hash() uint32 {
+	return hashPointer(c)
+}
+
 func (c *Closure) Caret(ev *Evaluator, v Value) Value {
 	ev.errorf("Closure doesn't support careting")
 	return nil
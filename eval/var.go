@@ -0,0 +1,299 @@
+package eval
+
+// Variables and scopes.
+//
+// The forms of a pipeline run in their own goroutines, and closures and
+// background jobs keep using the variables they capture, so variables are
+// shared between goroutines. A Var is a box for a value that is read and
+// written atomically, and a varScope is a map from names to Vars that is safe
+// for concurrent use. Copies of an Evaluator for the forms of a pipeline share
+// its scope, so that:
+//
+// - A form sees assignments made by other forms of the same pipeline as soon
+//   as they are made, but nothing is guaranteed about when, relative to what
+//   the form does, the other forms make them. Tables are values, so a form
+//   never sees a table half changed.
+//
+// - Variables declared by a form are visible to the other forms once
+//   declared, and to the code after the pipeline.
+//
+// - After the pipeline, all assignments of its forms have been made. When
+//   several forms assign to the same variable, the last assignment to run
+//   wins. An assignment to an element of a table updates the variable in one
+//   step, so assignments to elements made concurrently are all kept.
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Var is a variable.
+type Var struct {
+	mutex sync.RWMutex
+	value Value
+	// unset is true for a variable declared without a value, until it is
+	// set. Its value is then the default of its type.
+	unset bool
+	// validate, if not nil, checks each value assigned to the variable by
+	// elvish code against the old one, and returns the value to store or an
+	// error rejecting it.
+	validate func(old, new Value) (Value, error)
+	// changed, if not nil, is called with the old and the new value after
+	// each assignment by elvish code.
+	changed func(old, new Value)
+	// readOnly is true for variables that elvish code can't assign to, like
+	// $pid and those declared with const. Assignments are rejected by
+	// validate, and also by the compiler when it can tell.
+	readOnly bool
+	// get, if not nil, is called for the value instead of reading value, for
+	// variables backed by the state of Go code, like that of the line editor.
+	get func() Value
+	// owned is the set of tables in value that were made by assignments to
+	// elements, and can't be held by anything else, so that further
+	// assignments to elements can change them in place. Reading the variable
+	// lets its tables escape; reads counts the reads, and owned is only valid
+	// while it equals ownedAt.
+	owned   map[*Table]bool
+	ownedAt uint64
+	reads   uint64
+}
+
+func newVar(v Value) *Var {
+	return &Var{value: v}
+}
+
+// newReadOnlyVar returns a variable that elvish code can't assign to, but Go
+// code can set.
+func newReadOnlyVar(name string, v Value) *Var {
+	return &Var{value: v, readOnly: true, validate: func(Value, Value) (Value, error) {
+		return nil, fmt.Errorf("variable $%s is read-only", name)
+	}}
+}
+
+func newUnsetVar(v Value) *Var {
+	return &Var{value: v, unset: true}
+}
+
+// AddVariable defines a global variable backed by Go code. Reading it calls
+// get, and assigning to it calls set, which can reject the value by returning
+// an error. If set is nil, the variable is read-only. Like builtins, it must
+// be added before any code using it is compiled.
+func (ev *Evaluator) AddVariable(name string, get func() Value, set func(Value) error) {
+	v := &Var{get: get, readOnly: set == nil}
+	v.validate = func(_, new Value) (Value, error) {
+		if set == nil {
+			return nil, fmt.Errorf("variable $%s is read-only", name)
+		}
+		return new, set(new)
+	}
+	ev.scope.define(name, v)
+}
+
+// Get returns the value of the variable.
+func (v *Var) Get() Value {
+	if v.get != nil {
+		return v.get()
+	}
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	atomic.AddUint64(&v.reads, 1)
+	return v.value
+}
+
+// valueType returns the type of the value of the variable. Unlike Get, it
+// doesn't count as a read, since the value itself doesn't escape.
+func (v *Var) valueType() Type {
+	if v.get != nil {
+		return v.get().Type()
+	}
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	return v.value.Type()
+}
+
+// getIfSet returns the value of the variable, and whether it has been set.
+func (v *Var) getIfSet() (Value, bool) {
+	if v.get != nil {
+		return v.get(), true
+	}
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	atomic.AddUint64(&v.reads, 1)
+	return v.value, !v.unset
+}
+
+// Set sets the value of the variable.
+func (v *Var) Set(value Value) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.value = value
+	v.unset = false
+	v.owned = nil
+}
+
+// Update sets the variable to the result of f applied to its value. No other
+// goroutine can get or set the variable while f runs, so that when several
+// goroutines update elements of the same table, none of the updates is lost.
+func (v *Var) Update(f func(Value) Value) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.value = f(v.value)
+	v.unset = false
+	v.owned = nil
+}
+
+// assign is like Update, but for assignments made by elvish code, which are
+// checked with validate and reported to changed.
+func (v *Var) assign(f func(Value) Value) error {
+	return v.assignElement(func(old Value, _ func(*Table) *Table) Value {
+		return f(old)
+	})
+}
+
+// assignElement is like assign, but for assignments to elements of a table in
+// the variable, which copy the tables on the path to the element. Instead of
+// copying a table t itself, f calls own(t), which returns t if the variable
+// owns it, and otherwise a copy, which the variable then owns. A table
+// assigned to a variable in full, or one the variable has been read since, is
+// not owned; neither are those of variables with a validate or changed
+// function, which may keep the values they are given.
+func (v *Var) assignElement(f func(old Value, own func(*Table) *Table) Value) error {
+	old, value, err := v.updateValidated(f)
+	if err != nil {
+		return err
+	}
+	if v.changed != nil {
+		v.changed(old, value)
+	}
+	return nil
+}
+
+func (v *Var) updateValidated(f func(Value, func(*Table) *Table) Value) (old, value Value, err error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	old = v.value
+	if v.get != nil {
+		old = v.get()
+	}
+	reads := atomic.LoadUint64(&v.reads)
+	if reads != v.ownedAt {
+		v.owned = nil
+	}
+	// Tables made by own in this call, and whether it has been called at all.
+	var owned map[*Table]bool
+	ownCalled := false
+	own := func(t *Table) *Table {
+		ownCalled = true
+		if owned[t] || v.owned[t] {
+			return t
+		}
+		t = copyTable(t)
+		if owned == nil {
+			owned = make(map[*Table]bool)
+		}
+		owned[t] = true
+		return t
+	}
+	value = f(old, own)
+	if v.validate != nil {
+		value, err = v.validate(old, value)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	v.value = value
+	v.unset = false
+	if !ownCalled || v.get != nil || v.validate != nil || v.changed != nil {
+		v.owned = nil
+		return old, value, nil
+	}
+	if v.owned == nil {
+		v.owned = owned
+	} else {
+		for t := range owned {
+			v.owned[t] = true
+		}
+	}
+	v.ownedAt = reads
+	return old, value, nil
+}
+
+// varScope maps the names of the variables in a scope to the variables.
+type varScope struct {
+	mutex sync.RWMutex
+	vars  map[string]*Var
+	// outer, if not nil, is the scope the variables not in vars are looked
+	// up in, and new variables are defined in; see withVar.
+	outer *varScope
+}
+
+func newVarScope(vars map[string]*Var) *varScope {
+	if vars == nil {
+		vars = make(map[string]*Var)
+	}
+	return &varScope{vars: vars}
+}
+
+// withVar returns a scope where name is the variable v, and which is
+// otherwise s: all other variables are looked up in s, and variables
+// declared in it are declared in s. It gives a form a variable of its own
+// without hiding the rest of s.
+func (s *varScope) withVar(name string, v *Var) *varScope {
+	return &varScope{vars: map[string]*Var{name: v}, outer: s}
+}
+
+// lookup finds the variable with a name.
+func (s *varScope) lookup(name string) (*Var, bool) {
+	s.mutex.RLock()
+	v, ok := s.vars[name]
+	s.mutex.RUnlock()
+	if !ok && s.outer != nil {
+		return s.outer.lookup(name)
+	}
+	return v, ok
+}
+
+// get returns the variable with a name, which the compiler has made sure
+// exists.
+func (s *varScope) get(name string) *Var {
+	v, _ := s.lookup(name)
+	return v
+}
+
+// define adds a variable, replacing any with the same name.
+func (s *varScope) define(name string, v *Var) {
+	if s.outer != nil {
+		s.remove(name)
+		s.outer.define(name, v)
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.vars[name] = v
+}
+
+// remove removes the variable with a name, if there is one.
+func (s *varScope) remove(name string) {
+	s.mutex.Lock()
+	delete(s.vars, name)
+	s.mutex.Unlock()
+	if s.outer != nil {
+		s.outer.remove(name)
+	}
+}
+
+// all returns a copy of the map from names to variables, which may be
+// iterated over while the scope changes.
+func (s *varScope) all() map[string]*Var {
+	vars := make(map[string]*Var)
+	if s.outer != nil {
+		vars = s.outer.all()
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for name, v := range s.vars {
+		vars[name] = v
+	}
+	return vars
+}
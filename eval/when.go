@@ -0,0 +1,85 @@
+package eval
+
+// The when builtin, for parts of rc files that only apply to some machines.
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// hostFacts are the facts that the conditions of when are checked against.
+// They are looked up once, when when is first used.
+var hostFacts struct {
+	once  sync.Once
+	facts map[string]string
+}
+
+func getHostFacts() map[string]string {
+	hostFacts.once.Do(func() {
+		facts := map[string]string{
+			"os":   runtime.GOOS,
+			"arch": runtime.GOARCH,
+		}
+		if host, err := os.Hostname(); err == nil {
+			facts["host"] = host
+		}
+		if u, err := user.Current(); err == nil {
+			facts["user"] = u.Username
+		}
+		hostFacts.facts = facts
+	})
+	return hostFacts.facts
+}
+
+// when calls a closure if all of the conditions before it hold, e.g.
+//
+// when &os=linux &host=work-laptop { paths = [$@paths /opt/bin] }
+// when &os=linux,freebsd { ls-flags = --color }
+//
+// A condition &name=values holds if the fact name is one of the
+// comma-separated values. The facts are os and arch, as known to Go, host and
+// user. Like in any closure, variables and functions defined in the closure
+// are local to it, so it should set variables defined outside.
+func when(ev *Evaluator, args []Value) string {
+	if len(args) == 0 {
+		return "args error"
+	}
+	c, ok := args[len(args)-1].(*Closure)
+	if !ok {
+		return fmt.Sprintf("when body must be a closure, got %s", args[len(args)-1].Repr())
+	}
+	facts := getHostFacts()
+	holds := true
+	for _, a := range args[:len(args)-1] {
+		s := a.String()
+		i := strings.IndexRune(s, '=')
+		if !strings.HasPrefix(s, "&") || i < 0 {
+			return fmt.Sprintf("bad condition %s, must be &name=values", a.Repr())
+		}
+		name, values := s[1:i], s[i+1:]
+		fact, ok := facts[name]
+		if !ok && name != "host" && name != "user" {
+			return fmt.Sprintf("unknown fact %s", name)
+		}
+		if !ok || !hasItem(strings.Split(values, ","), fact) {
+			holds = false
+		}
+	}
+	if !holds {
+		return ""
+	}
+	return ev.callClosure(c, nil)
+}
+
+func hasItem(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+package eval
+
+// Tracing commands, like set -x of POSIX shells.
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// SetXtrace sets whether each command is printed to port 2 before it is run,
+// like with the xtrace option, but for all code evaluated from now on. It is
+// the same as setting $options[xtrace].
+func (ev *Evaluator) SetXtrace(xtrace bool) {
+	ev.options.Set("xtrace", boolValue(xtrace))
+}
+
+func (ev *Evaluator) tracing() bool {
+	return atomic.LoadInt32(&ev.options.xtrace) != 0
+}
+
+// printXtrace prints a form about to be run, with its arguments expanded, as
+//
+// + command args...
+//
+// indented with two spaces for each form it is nested in, like the form of an
+// output capture in its arguments or of a closure it calls. Special forms are
+// not printed. A command that is a closure is printed as <closure>.
+func (ev *Evaluator) printXtrace(fm *form, isClosure bool) {
+	p := ev.port(2)
+	if p == nil || p.f == nil {
+		return
+	}
+	words := []string{"+", fm.name}
+	if !isClosure {
+		words[1] = quote(fm.name)
+	}
+	for _, a := range fm.args {
+		words = append(words, a.Repr())
+	}
+	depth := len(ev.nodes) - 1
+	fmt.Fprintln(p.f, strings.Repeat("  ", depth)+strings.Join(words, " "))
+}
@@ -0,0 +1,279 @@
+// Package format formats elvish source in the canonical style.
+//
+// Each pipeline is put on a line of its own, indented with one tab for each
+// enclosing closure, and words, forms and redirections are separated by
+// single spaces, e.g.
+//
+//	fn f {|x|
+//		put $x | each { echo $0 } >[2]/dev/null
+//	}
+//
+// Closures spanning several lines in the source, or containing more than one
+// pipeline, are written on several lines; other closures are kept on one line.
+// Comments are kept, either on their own lines or after code, as in the
+// source. Line breaks after the pipes of a pipeline and single blank lines
+// between pipelines are kept as well. String literals, lists and here-document
+// bodies are written as they are.
+package format
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/xiaq/elvish/parse"
+)
+
+// Source formats text. Syntax errors are returned as from parse.Parse.
+func Source(name, text string) (string, error) {
+	n, err := parse.Parse(name, text)
+	if err != nil {
+		return "", err
+	}
+	return Chunk(text, n), nil
+}
+
+// Chunk formats the root chunk n, parsed from text.
+func Chunk(text string, n *parse.ChunkNode) string {
+	f := &formatter{text: text, comments: n.Comments, lineStart: true}
+	f.chunk(n, parse.Pos(len(text)))
+	return f.buf.String()
+}
+
+type formatter struct {
+	text     string
+	comments []*parse.Comment // Comments not written yet.
+	buf      bytes.Buffer
+	indent   int
+	// Whether nothing has been written on the current line.
+	lineStart bool
+	// Whether a blank line may be kept before the next line, which is false
+	// at the beginning of a chunk.
+	blankOK bool
+	// Bodies of here-documents to write after the current line.
+	heredocs []string
+}
+
+func (f *formatter) write(s string) {
+	if s == "" {
+		return
+	}
+	if f.lineStart {
+		f.buf.WriteString(strings.Repeat("\t", f.indent))
+		f.lineStart = false
+	}
+	f.buf.WriteString(s)
+}
+
+func (f *formatter) newline() {
+	f.buf.WriteString("\n")
+	for _, body := range f.heredocs {
+		f.buf.WriteString(body)
+		if !strings.HasSuffix(body, "\n") {
+			f.buf.WriteString("\n")
+		}
+	}
+	f.heredocs = nil
+	f.lineStart = true
+}
+
+// endLine ends the current line, unless nothing has been written on it.
+func (f *formatter) endLine() {
+	if !f.lineStart {
+		f.newline()
+	}
+}
+
+// blankLineBefore writes a blank line if there is one before pos in the
+// source.
+func (f *formatter) blankLineBefore(pos parse.Pos) {
+	if !f.blankOK {
+		return
+	}
+	i := f.skipSpaceBack(int(pos))
+	if i < 0 || f.text[i] != '\n' {
+		return
+	}
+	i = f.skipSpaceBack(i)
+	if i >= 0 && f.text[i] == '\n' {
+		f.buf.WriteString("\n")
+	}
+}
+
+// lineBrokenBefore determines whether pos is preceded by a newline in the
+// source, apart from spaces.
+func (f *formatter) lineBrokenBefore(pos parse.Pos) bool {
+	i := f.skipSpaceBack(int(pos))
+	return i >= 0 && f.text[i] == '\n'
+}
+
+// skipSpaceBack returns the index of the first byte before i that is not a
+// space or a tab, or -1 if there is no such byte.
+func (f *formatter) skipSpaceBack(i int) int {
+	i--
+	for i >= 0 && (f.text[i] == ' ' || f.text[i] == '\t') {
+		i--
+	}
+	return i
+}
+
+// commentsBefore writes the comments before pos. A comment following code on
+// the same line in the source is written after what has been written on the
+// current line; other comments are written on lines of their own.
+func (f *formatter) commentsBefore(pos parse.Pos) {
+	for len(f.comments) > 0 && f.comments[0].Pos < pos {
+		c := f.comments[0]
+		f.comments = f.comments[1:]
+		text := strings.TrimRight(c.Text, " \t")
+		if !f.lineStart && !f.lineBrokenBefore(c.Pos) {
+			f.write(" " + text)
+		} else {
+			f.endLine()
+			f.blankLineBefore(c.Pos)
+			f.write(text)
+		}
+		f.newline()
+		f.blankOK = true
+	}
+}
+
+// chunk writes the pipelines of a chunk, and the comments before end.
+func (f *formatter) chunk(cn *parse.ChunkNode, end parse.Pos) {
+	f.blankOK = false
+	for _, pn := range cn.Nodes {
+		f.commentsBefore(pn.Pos)
+		f.endLine()
+		f.blankLineBefore(pn.Pos)
+		f.pipeline(pn)
+		f.blankOK = true
+	}
+	f.commentsBefore(end)
+	f.endLine()
+}
+
+func (f *formatter) pipeline(pn *parse.PipelineNode) {
+	indent := f.indent
+	for i, fn := range pn.Nodes {
+		if i > 0 {
+			if f.lineBrokenBefore(fn.Pos) {
+				f.write(" |")
+				f.commentsBefore(fn.Pos)
+				f.endLine()
+				f.indent = indent + 1
+			} else {
+				f.write(" | ")
+			}
+		}
+		f.form(fn)
+	}
+	f.indent = indent
+}
+
+func (f *formatter) form(fn *parse.FormNode) {
+	f.term(fn.Command)
+	for _, tn := range fn.Args.Nodes {
+		f.write(" ")
+		f.term(tn)
+	}
+	for _, r := range fn.Redirs {
+		f.write(" " + r.Leader())
+		switch r := r.(type) {
+		case *parse.FilenameRedir:
+			f.term(r.Filename)
+		case *parse.HereRedir:
+			if r.Body != "" {
+				f.heredocs = append(f.heredocs, r.Body)
+			} else {
+				f.term(r.Text)
+			}
+		}
+	}
+	if fn.StatusRedir != "" {
+		f.write(" ?>$" + fn.StatusRedir)
+	}
+}
+
+func (f *formatter) term(tn *parse.TermNode) {
+	for i, fn := range tn.Nodes {
+		if i > 0 && strings.Contains(f.text[tn.Nodes[i-1].End:fn.Pos], "^") {
+			f.write("^")
+		}
+		f.factor(fn)
+	}
+}
+
+var captureOpeners = map[parse.FactorType]string{
+	parse.OutputCaptureFactor:      "(",
+	parse.StatusCaptureFactor:      "?(",
+	parse.InputSubstitutionFactor:  "<(",
+	parse.OutputSubstitutionFactor: ">(",
+}
+
+func (f *formatter) factor(fn *parse.FactorNode) {
+	switch fn.Typ {
+	case parse.StringFactor, parse.OptionFactor:
+		f.write(fn.Node.(*parse.StringNode).Quoted)
+	case parse.VariableFactor, parse.SpliceFactor:
+		f.write("$" + fn.Node.(*parse.StringNode).Quoted)
+	case parse.TableFactor:
+		f.table(fn.Node.(*parse.TableNode))
+	case parse.ClosureFactor:
+		f.closure(fn)
+	case parse.OutputCaptureFactor, parse.StatusCaptureFactor,
+		parse.InputSubstitutionFactor, parse.OutputSubstitutionFactor:
+		f.write(captureOpeners[fn.Typ])
+		f.pipeline(fn.Node.(*parse.PipelineNode))
+		f.write(")")
+	default:
+		// Lists, whose alternatives have been split by the parser, and
+		// interpolated strings.
+		f.write(f.text[fn.Pos:fn.End])
+	}
+}
+
+func (f *formatter) table(tn *parse.TableNode) {
+	f.write("[")
+	for i, item := range tn.List {
+		if i > 0 {
+			f.write(" ")
+		}
+		f.term(item)
+	}
+	for i, pair := range tn.Dict {
+		if i > 0 || len(tn.List) > 0 {
+			f.write(" ")
+		}
+		f.write("&")
+		f.term(pair.Key)
+		f.write(" ")
+		f.term(pair.Value)
+	}
+	f.write("]")
+}
+
+func (f *formatter) closure(fn *parse.FactorNode) {
+	cn := fn.Node.(*parse.ClosureNode)
+	f.write("{")
+	if cn.ArgNames != nil && len(cn.ArgNames.Nodes) > 0 {
+		f.write("|")
+		for i, tn := range cn.ArgNames.Nodes {
+			if i > 0 {
+				f.write(" ")
+			}
+			f.term(tn)
+		}
+		f.write("|")
+	}
+	pipelines := cn.Chunk.Nodes
+	if !strings.ContainsRune(f.text[fn.Pos:fn.End], '\n') && len(pipelines) <= 1 {
+		if len(pipelines) == 1 {
+			f.write(" ")
+			f.pipeline(pipelines[0])
+		}
+		f.write(" }")
+		return
+	}
+	f.indent++
+	f.chunk(cn.Chunk, fn.End-1)
+	f.indent--
+	f.write("}")
+}
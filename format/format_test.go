@@ -0,0 +1,47 @@
+package format
+
+import "testing"
+
+var formatTests = []struct {
+	in, out string
+}{
+	{"", ""},
+	{"ls   -l  a;ls", "ls -l a\nls\n"},
+	{"put a^$x ^\n  b", "put a^$x b\n"},
+	{"echo >[2]/dev/null   >> log ?>$s", "echo >[2]/dev/null >>log ?>$s\n"},
+	{"put [a  b &k  [c]] {a,b} \"$x  y\" `p  q`", "put [a b &k [c]] {a,b} \"$x  y\" `p  q`\n"},
+	{"put (put  a|put b) ?(false)", "put (put a | put b) ?(false)\n"},
+	{"merge  &deep $a", "merge &deep $a\n"},
+	// Closures.
+	{"each {|x|  put $x}", "each {|x| put $x }\n"},
+	{"each {|| put $x}", "each { put $x }\n"},
+	{"f { }", "f { }\n"},
+	{"fn f {  put a;put b }", "fn f {\n\tput a\n\tput b\n}\n"},
+	{"fn f {|a|\n  put a\n    each { put\n  }\n}", "fn f {|a|\n\tput a\n\teach {\n\t\tput\n\t}\n}\n"},
+	// Pipelines broken after pipes.
+	{"put a |\n  each { put } |  sort", "put a |\n\teach { put } | sort\n"},
+	// Comments and blank lines.
+	{"# a\n\n\n\nput a # b  \n# c\nput c\n\n# d", "# a\n\nput a # b\n# c\nput c\n\n# d\n"},
+	{"fn f { # a\n  put a\n  # b\n}\nput c", "fn f { # a\n\tput a\n\t# b\n}\nput c\n"},
+	{"put a | # a\n  put b", "put a | # a\n\tput b\n"},
+	{"put a ^ # a\n  b", "put a b # a\n"},
+	// Here-documents.
+	{"cat <<EOF | sort\n  a $x\nEOF\nput b", "cat <<EOF | sort\n  a $x\nEOF\nput b\n"},
+	{"cat <<<  $x", "cat <<<$x\n"},
+}
+
+func TestSource(t *testing.T) {
+	for _, tt := range formatTests {
+		out, err := Source("<format test>", tt.in)
+		if out != tt.out || err != nil {
+			t.Errorf("Source(*, %q) => (%q, %v), want (%q, nil)", tt.in, out, err, tt.out)
+			continue
+		}
+		if again, _ := Source("<format test>", out); again != out {
+			t.Errorf("Source(*, %q) => %q, formatted again as %q", tt.in, out, again)
+		}
+	}
+	if _, err := Source("<format test>", "put {"); err == nil {
+		t.Errorf("Source(*, %q) => no error", "put {")
+	}
+}
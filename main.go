@@ -3,28 +3,68 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/binary"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/signal"
 	"os/user"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 	"unicode/utf8"
 
 	"github.com/xiaq/elvish/edit"
 	"github.com/xiaq/elvish/eval"
+	"github.com/xiaq/elvish/format"
 	"github.com/xiaq/elvish/parse"
+	"github.com/xiaq/elvish/service"
 	"github.com/xiaq/elvish/util"
 )
 
 const (
-	sigchSize = 32
+	sigchSize         = 32
+	sessionLogMaxSize = 1 << 20
+	rcFileName        = ".elvishrc"
+	pluginDirName     = ".elvish-plugins"
+	// Prompt for the continuation lines of incomplete input.
+	continuationPrompt = "> "
+	// How long rendering the prompts is waited for before reading a line,
+	// so that fast prompts are not drawn twice.
+	promptWait = 50 * time.Millisecond
 )
 
+// loadHomePlugins loads the plugins in the plugin directory under the home
+// directory. It must be called before any code is evaluated, so that the
+// builtins of the plugins are known to the compiler.
+func loadHomePlugins() {
+	if user, err := user.Current(); err == nil {
+		loadPlugins(user.HomeDir + "/" + pluginDirName)
+	}
+}
+
+// interact runs an interactive session. If scriptName is not empty, the script
+// is evaluated after the rc file, and the session starts with the scope it
+// leaves. Unless checkUpdate is false, a newer release of elvish is announced
+// above the prompt.
 // TODO(xiaq): Currently only the editor deals with signals.
-func interact() {
+func interact(scriptName string, checkUpdate bool) {
+	loadHomePlugins()
 	ev := eval.NewEvaluator()
 	cmdNum := 0
 
+	// Tee the output of commands to $ELVISH_SESSION_LOG if set.
+	if path := os.Getenv("ELVISH_SESSION_LOG"); path != "" {
+		err := ev.TeeSessionLog(path, sessionLogMaxSize)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Cannot open session log:", err)
+		}
+	}
+
 	username := "???"
 	user, err := user.Current()
 	if err == nil {
@@ -38,44 +78,428 @@ func interact() {
 
 	sigch := make(chan os.Signal, sigchSize)
 	signal.Notify(sigch)
+	exitOnHangup(ev)
 
 	ed := edit.NewEditor(os.Stdin, ev, sigch)
+	ev.SetFeature("editor", true)
+	if checkUpdate && eval.UpdateURL != "" {
+		go func() {
+			latest, newer, err := eval.CheckUpdate()
+			if err == nil && newer {
+				msg := fmt.Sprintf("elvish %s is available", latest)
+				if eval.UpdateKey != "" {
+					msg += "; upgrade with shell:self-upgrade"
+				}
+				ed.Notify(msg)
+			}
+		}()
+	}
+
+	// Share history and directory visits with other elvish processes through
+	// elvishd, if it can be reached.
+	client, err := service.Connect()
+	connected := err == nil
+	history := &sessionHistory{ed: ed, session: newSessionID()}
+	ev.SetHistoryStore(history)
+	if !connected {
+		// Without elvishd installed, history is simply not shared.
+		if err != service.DaemonNotFound {
+			fmt.Fprintln(os.Stderr, "Cannot connect to elvishd:", err)
+		}
+	} else {
+		defer client.Close()
+		ev.SetFeature("daemon", true)
+		var entries []service.HistoryEntry
+		if err := client.History(0, &entries); err != nil {
+			fmt.Fprintln(os.Stderr, "Cannot load history:", err)
+		}
+		lines := make([]string, len(entries))
+		for i, e := range entries {
+			lines[i] = e.Line
+		}
+		ed.LoadHistory(lines)
+		history.client = &client
+		if len(entries) > 0 {
+			history.lastSeq = entries[len(entries)-1].Seq
+		}
+		ev.SetChdirHook(func(dir string) {
+			if err := client.AddDirVisit(dir, &struct{}{}); err != nil {
+				fmt.Fprintln(os.Stderr, "Cannot record directory visit:", err)
+			}
+		})
+		// Visited directories can be jumped to with cd and the location mode.
+		matchDirs := func(pattern string) []string {
+			var visits []service.DirVisit
+			if err := client.DirVisits(struct{}{}, &visits); err != nil {
+				return nil
+			}
+			return service.MatchDirs(visits, pattern, time.Now())
+		}
+		ev.SetDirMatcher(matchDirs)
+		ed.SetDirMatcher(matchDirs)
+		ev.SetUsageSource(func() (*eval.Usage, error) {
+			return loadUsage(client)
+		})
+		ds := &daemonStore{client: &client}
+		ev.SetStore(ds)
+		ev.SetSharedStore(ds)
+		shareVars(ev, client)
+	}
+
+	for _, err := range ev.LoadPackages() {
+		printSourceError(err, false)
+	}
+	if user != nil {
+		printSourceError(ev.SourceRC(user.HomeDir+"/"+rcFileName), true)
+	}
+	// Keys bound in the rc file are bound again by shell:reload.
+	ev.SetReloadHook(ed.ResetKeys)
+	if scriptName != "" {
+		// Errors are only printed, so that what the script has done so far
+		// can be examined.
+		printSourceError(ev.Source(scriptName), false)
+	}
+
+	// $prompt and $rprompt are rendered in the background before each read,
+	// so that they can run slow commands without holding up typing. Prompts
+	// that take longer than promptWait are drawn again when they are ready,
+	// and the last ones are shown until then.
+	prompt := ev.AsyncPromptFunc("prompt", func() string {
+		return util.Getwd() + "> "
+	})
+	rprompt := ev.AsyncPromptFunc("rprompt", func() string {
+		return rpromptStr
+	})
+	prompt.OnUpdate(ed.Redraw)
+	rprompt.OnUpdate(ed.Redraw)
 
 	for {
 		cmdNum++
 		name := fmt.Sprintf("<tty %d>", cmdNum)
 
-		prompt := func() string {
-			return util.Getwd() + "> "
+		ev.BeforeReadline()
+		if ev.HistoryPolicy().Shared {
+			history.sync()
 		}
-		rprompt := func() string {
-			return rpromptStr
+		prompt.Refresh()
+		rprompt.Refresh()
+		deadline := time.Now().Add(promptWait)
+		prompt.Wait(deadline)
+		rprompt.Wait(deadline)
+		if cmdNum == 1 {
+			// $motd-hook runs in the background once the first prompt
+			// has been drawn, and its output is shown above the prompt.
+			ed.OnNextPrompt(func() {
+				ev.Go(func(ev *eval.Evaluator) {
+					out, msg := ev.HookOutput("motd-hook")
+					if msg != "" {
+						out += "motd-hook: " + msg
+					}
+					if out != "" {
+						ed.Notify(out)
+					}
+				})
+			})
 		}
-
-		lr := ed.ReadLine(prompt, rprompt)
+		lr := ed.ReadLine(prompt.Get, rprompt.Get)
+		// Prompts still rendering are not needed any more, and must not
+		// run alongside the command.
+		prompt.Cancel()
+		rprompt.Cancel()
 
 		if lr.EOF {
+			ev.RunExitHooks()
 			break
 		} else if lr.Err != nil {
 			fmt.Println("Editor error:", lr.Err)
 			fmt.Println("My pid is", os.Getpid())
 		}
 
-		n, pe := parse.Parse(name, lr.Line)
-		if pe != nil {
-			fmt.Print(pe.(*util.ContextualError).Pprint())
-			continue
+		// Input that ends too early, like with an open brace or a trailing
+		// pipe, is continued on the next lines. An EOF gives up and shows
+		// the error.
+		text := lr.Line
+		for {
+			if _, err := parse.Parse(name, text); !parse.IsIncomplete(err) {
+				break
+			}
+			lr = ed.ReadLine(
+				func() string { return continuationPrompt },
+				func() string { return "" })
+			if lr.EOF || lr.Err != nil {
+				break
+			}
+			text += "\n" + lr.Line
 		}
 
-		ee := ev.Eval(name, lr.Line, n)
-		if ee != nil {
-			fmt.Print(ee.(*util.ContextualError).Pprint())
-			continue
+		var seq int64
+		if connected && text != "" {
+			if e := history.add(text, ev.HistoryPolicy(), &seq); e != nil {
+				fmt.Fprintln(os.Stderr, "Cannot save history:", e)
+			}
+		}
+
+		// Commands are often run again, and are then neither parsed nor
+		// compiled again.
+		start := time.Now()
+		if err := ev.EvalText(name, text); err != nil {
+			fmt.Print(err.(*util.ContextualError).Pprint())
+		}
+		duration := time.Since(start)
+		if seq != 0 {
+			d := &service.HistoryDuration{Seq: seq, Nanoseconds: int64(duration)}
+			if err := client.SetHistoryDuration(d, &struct{}{}); err != nil {
+				fmt.Fprintln(os.Stderr, "Cannot save command duration:", err)
+			}
+		}
+		ev.AfterCommand(text, duration)
+	}
+}
+
+// exitOnHangup makes elvish call the at-exit hooks and exit when the terminal
+// is hung up. The hooks may run while a command is being evaluated, which is
+// going to be cut short anyway.
+func exitOnHangup(ev *eval.Evaluator) {
+	hupch := make(chan os.Signal, 1)
+	signal.Notify(hupch, syscall.SIGHUP)
+	go func() {
+		<-hupch
+		ev.Exit(128 + int(syscall.SIGHUP))
+	}()
+}
+
+// loadUsage loads the history and directory visits from elvishd for shell:stats.
+func loadUsage(client service.Client) (*eval.Usage, error) {
+	var entries []service.HistoryEntry
+	if err := client.History(0, &entries); err != nil {
+		return nil, err
+	}
+	var durations []service.HistoryDuration
+	if err := client.HistoryDurations(struct{}{}, &durations); err != nil {
+		return nil, err
+	}
+	var visits []service.DirVisit
+	if err := client.DirVisits(struct{}{}, &visits); err != nil {
+		return nil, err
+	}
+	bySeq := make(map[int64]time.Duration, len(durations))
+	for _, d := range durations {
+		bySeq[d.Seq] = time.Duration(d.Nanoseconds)
+	}
+	u := &eval.Usage{}
+	for _, e := range entries {
+		u.Commands = append(u.Commands, eval.CommandUsage{Line: e.Line, Duration: bySeq[e.Seq]})
+	}
+	for _, v := range visits {
+		u.Dirs = append(u.Dirs, eval.DirUsage{Path: v.Path, Visits: v.Visits})
+	}
+	return u, nil
+}
+
+// sessionHistory is the history of the editor and, when connected, elvishd,
+// for the history builtins.
+type sessionHistory struct {
+	ed      *edit.Editor
+	client  *service.Client
+	session int64
+	// The sequence number of the newest entry of elvishd known to the editor,
+	// not counting those added by this session.
+	lastSeq int64
+}
+
+// newSessionID returns a random ID for the history entries added by this
+// session. Unlike the pid, it is not reused by later sessions, which would
+// then take the entries of an old session for their own.
+func newSessionID() int64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return time.Now().UnixNano()
+	}
+	return int64(binary.LittleEndian.Uint64(b[:]) >> 1)
+}
+
+// add adds a command line to elvishd, following the history policy.
+func (h *sessionHistory) add(line string, p eval.HistoryPolicy, seq *int64) error {
+	return h.client.AddHistory(&service.HistoryAddition{
+		Line: line, Session: h.session,
+		IgnoreSpace: p.IgnoreSpace, IgnoreDups: p.IgnoreDups, MaxSize: int64(p.MaxSize),
+	}, seq)
+}
+
+// sync adds the entries added by other sessions since the last sync to the
+// editor.
+func (h *sessionHistory) sync() {
+	if h.client == nil {
+		return
+	}
+	var entries []service.HistoryEntry
+	q := &service.HistoryQuery{From: h.lastSeq + 1, Except: h.session}
+	if err := h.client.OthersHistory(q, &entries); err != nil || len(entries) == 0 {
+		return
+	}
+	lines := make([]string, len(entries))
+	for i, e := range entries {
+		lines[i] = e.Line
+	}
+	h.ed.AddHistory(lines)
+	h.lastSeq = entries[len(entries)-1].Seq
+}
+
+func (h *sessionHistory) Del(pattern *regexp.Regexp) (int, error) {
+	n := h.ed.DelHistory(pattern)
+	if h.client != nil {
+		var deleted int64
+		if err := h.client.DelHistory(pattern.String(), &deleted); err != nil {
+			return n, err
+		}
+		// The entries of elvishd not loaded by the editor count too.
+		if int(deleted) > n {
+			n = int(deleted)
 		}
 	}
+	return n, nil
 }
 
-func script(name string) {
+func (h *sessionHistory) Prune(max int) (int, error) {
+	n := h.ed.PruneHistory(max)
+	if h.client != nil {
+		var deleted int64
+		if err := h.client.PruneHistory(int64(max), &deleted); err != nil {
+			return n, err
+		}
+		if int(deleted) > n {
+			n = int(deleted)
+		}
+	}
+	return n, nil
+}
+
+// daemonStore is the store of elvishd, for the store builtins. Scripts
+// connect to elvishd only when they first use the store.
+type daemonStore struct {
+	mutex  sync.Mutex
+	client *service.Client
+}
+
+func (s *daemonStore) connect() (service.Client, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.client == nil {
+		c, err := service.Connect()
+		if err != nil {
+			return c, err
+		}
+		s.client = &c
+	}
+	return *s.client, nil
+}
+
+func (s *daemonStore) Get(key string) (string, bool, error) {
+	c, err := s.connect()
+	if err != nil {
+		return "", false, err
+	}
+	var value string
+	err = c.GetStore(key, &value)
+	if err == service.StoreKeyNotFound {
+		return "", false, nil
+	}
+	return value, err == nil, err
+}
+
+func (s *daemonStore) Set(key, value string) error {
+	c, err := s.connect()
+	if err != nil {
+		return err
+	}
+	return c.SetStore(&service.StoreEntry{Key: key, Value: value}, &struct{}{})
+}
+
+func (s *daemonStore) Del(key string) error {
+	c, err := s.connect()
+	if err != nil {
+		return err
+	}
+	return c.DelStore(key, &struct{}{})
+}
+
+// Shared variables are universal variables of elvishd.
+func (s *daemonStore) SetShared(name, value string) error {
+	c, err := s.connect()
+	if err != nil {
+		return err
+	}
+	return c.SetUniVar(&service.UniVar{Name: name, Value: value}, &struct{}{})
+}
+
+// shareVars loads the shared variables from elvishd, and keeps picking up the
+// changes other elvish processes make to them until the client is closed.
+func shareVars(ev *eval.Evaluator, client service.Client) {
+	var seq int64
+	if err := client.LastEventSeq(struct{}{}, &seq); err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot load shared variables:", err)
+		return
+	}
+	var vars []service.UniVar
+	if err := client.UniVars(struct{}{}, &vars); err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot load shared variables:", err)
+		return
+	}
+	for _, v := range vars {
+		ev.UpdateShared(v.Name, v.Value)
+	}
+	go func() {
+		for {
+			var events []service.Event
+			if err := client.WaitEvents(seq, &events); err != nil {
+				return
+			}
+			for _, e := range events {
+				seq = e.Seq
+				if e.Kind != service.UniVarChanged {
+					continue
+				}
+				var value string
+				if client.GetUniVar(e.Name, &value) == nil {
+					ev.UpdateShared(e.Name, value)
+				}
+			}
+		}
+	}()
+}
+
+// printSourceError prints an error from evaluating a file, like the rc file,
+// which is evaluated after the editor is created, so that it can use the
+// editor builtins like le:bind. A nonexistent file is fine if it is optional.
+func printSourceError(err error, optional bool) {
+	if err == nil || optional && os.IsNotExist(err) {
+		return
+	}
+	if ce, ok := err.(*util.ContextualError); ok {
+		fmt.Print(ce.Pprint())
+	} else {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// scriptMode holds the options for running a script.
+type scriptMode struct {
+	// profile makes a report of where the time goes be written to stderr at
+	// the end.
+	profile bool
+	// coverage makes a listing of the script, with how many times each line
+	// has run, be written to stderr at the end.
+	coverage bool
+	// dryRun makes external commands be printed instead of run.
+	dryRun bool
+	// xtrace makes each command be printed to stderr before it is run.
+	xtrace bool
+	// strict makes the script be compiled like with set-option strict on.
+	strict bool
+}
+
+// script evaluates the script at name.
+func script(name string, args []string, mode scriptMode) {
 	file, err := os.Open(name)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -92,7 +516,10 @@ func script(name string) {
 	}
 	src := string(bytes)
 
+	loadHomePlugins()
 	ev := eval.NewEvaluator()
+	ev.SetStore(&daemonStore{})
+	ev.SetArgs(args)
 
 	n, pe := parse.Parse(name, src)
 	if pe != nil {
@@ -100,26 +527,110 @@ func script(name string) {
 		os.Exit(1)
 	}
 
+	exitOnHangup(ev)
+	ev.SetDryRun(mode.dryRun)
+	ev.SetXtrace(mode.xtrace)
+	if mode.strict {
+		ev.Compiler.SetOption("strict", true)
+	}
+	if mode.profile {
+		ev.StartProfile(os.Stderr)
+	}
+	if mode.coverage {
+		ev.StartCoverage(os.Stderr)
+	}
 	ee := ev.Eval(name, src, n)
 	if ee != nil {
 		fmt.Print(ee.(*util.ContextualError).Pprint())
-		os.Exit(1)
+		ev.Exit(1)
 	}
+	ev.RunExitHooks()
+	ev.StopProfile()
+	ev.StopCoverage()
+}
+
+// formatSources prints the scripts at paths, or the one read from stdin if
+// there are none, in the canonical format.
+func formatSources(paths []string) {
+	if len(paths) == 0 {
+		paths = []string{"/dev/stdin"}
+	}
+	status := 0
+	for _, path := range paths {
+		bytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			continue
+		}
+		out, err := format.Source(path, string(bytes))
+		if err != nil {
+			if ce, ok := err.(*util.ContextualError); ok {
+				fmt.Fprint(os.Stderr, ce.Pprint())
+			} else {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			status = 1
+			continue
+		}
+		fmt.Print(out)
+	}
+	os.Exit(status)
 }
 
 var usage = `Usage:
-    elvish
-    elvish <script>
+    elvish [-no-update-check]
+    elvish <script> [<arg>...]
+    elvish [-no-update-check] -i <script>
+    elvish -profile <script> [<arg>...]
+    elvish -coverage <script> [<arg>...]
+    elvish -dry-run <script> [<arg>...]
+    elvish -x <script> [<arg>...]
+    elvish -strict <script> [<arg>...]
+    elvish -fmt [<script>...]
+    elvish -version
 `
 
+func printVersion() {
+	fmt.Printf("elvish %s (commit %s, built %s with %s)\n",
+		eval.Version, eval.Commit, eval.BuildDate, runtime.Version())
+}
+
 func main() {
-	switch len(os.Args) {
-	case 1:
-		interact()
-	case 2:
-		script(os.Args[1])
+	args := os.Args[1:]
+	checkUpdate := true
+	if len(args) > 0 && (args[0] == "-no-update-check" || args[0] == "--no-update-check") {
+		checkUpdate = false
+		args = args[1:]
+	}
+	if len(args) > 0 && args[0] == "-fmt" {
+		formatSources(args[1:])
+	}
+	if len(args) == 0 {
+		interact("", checkUpdate)
+		return
+	}
+	// Arguments after the script are its, and are in $args.
+	modes := map[string]scriptMode{
+		"-profile":  {profile: true},
+		"-coverage": {coverage: true},
+		"-dry-run":  {dryRun: true},
+		"-x":        {xtrace: true},
+		"-strict":   {strict: true},
+	}
+	mode, isMode := modes[args[0]]
+	switch {
+	case len(args) == 1 && args[0] == "-version":
+		printVersion()
+	case len(args) == 2 && args[0] == "-i":
+		// Run the script, then a session in its scope.
+		interact(args[1], checkUpdate)
+	case len(args) >= 2 && isMode:
+		script(args[1], args[2:], mode)
+	case !strings.HasPrefix(args[0], "-"):
+		script(args[0], args[1:], scriptMode{})
 	default:
-		fmt.Fprintf(os.Stderr, usage)
+		fmt.Fprint(os.Stderr, usage)
 		os.Exit(1)
 	}
 }
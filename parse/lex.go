@@ -49,10 +49,13 @@ const (
 	ItemBare              // a bare string literal
 	ItemSingleQuoted      // a single-quoted string literal
 	ItemDoubleQuoted      // a double-quoted string literal
+	ItemRawQuoted         // a triple-quoted raw string literal
 	ItemRedirLeader       // IO redirection leader
 	ItemStatusRedirLeader // status redirection leader, "?>"
 	ItemPipe              // pipeline connector, '|'
 	ItemQuestionLParen    // question + left paren "?("
+	ItemLessLParen        // less-than + left paren "<("
+	ItemGreaterLParen     // greater-than + left paren ">("
 	ItemLParen            // left paren '('
 	ItemRParen            // right paren ')'
 	ItemLBracket          // left bracket '['
@@ -63,6 +66,7 @@ const (
 	ItemCaret             // caret sign '^'
 	ItemSemicolon         // semicolon ';'
 	ItemAmpersand         // ampersand '&'
+	ItemHeredoc           // body of a here-document, with the terminator line
 	ItemTypeCount
 )
 
@@ -75,10 +79,13 @@ var ItemTypeNames = []string{
 	"ItemBare",
 	"ItemSingleQuoted",
 	"ItemDoubleQuoted",
+	"ItemRawQuoted",
 	"ItemRedirLeader",
 	"ItemStatusRedirLeader",
 	"ItemPipe",
 	"ItemQuestionLParen",
+	"ItemLessLParen",
+	"ItemGreaterLParen",
 	"ItemLParen",
 	"ItemRParen",
 	"ItemLBracket",
@@ -89,6 +96,7 @@ var ItemTypeNames = []string{
 	"ItemCaret",
 	"ItemSemicolon",
 	"ItemAmpersand",
+	"ItemHeredoc",
 }
 
 func init() {
@@ -128,6 +136,13 @@ type Lexer struct {
 	width   Pos       // width of last rune read from input
 	lastPos Pos       // position of most recent Item returned by NextItem
 	items   chan Item // channel of scanned items
+	// Here-documents started on the current line, whose bodies follow it.
+	heredocs []heredoc
+}
+
+type heredoc struct {
+	delim string
+	strip bool // Whether leading tabs are stripped, like with <<-EOF
 }
 
 // next returns the next rune in the input.
@@ -197,9 +212,24 @@ func (l *Lexer) Chan() chan Item {
 
 // Lex creates a new scanner for the input string.
 func Lex(name, input string) *Lexer {
+	return lexFrom(name, input, 0)
+}
+
+// LexEmbedded creates a new scanner for input[start:end], a snippet of elvish
+// in a larger document. The positions of items are offsets in input.
+func LexEmbedded(name, input string, start, end int) *Lexer {
+	return lexFrom(name, input[:end], Pos(start))
+}
+
+// lexFrom creates a new scanner for the input string that starts at the
+// given position. It is used for parsing command interpolations in
+// double-quoted strings.
+func lexFrom(name, input string, pos Pos) *Lexer {
 	l := &Lexer{
 		name:  name,
 		input: input,
+		pos:   pos,
+		start: pos,
 		items: make(chan Item),
 	}
 	go l.run()
@@ -229,6 +259,9 @@ func lexAny(l *Lexer) stateFn {
 	var r rune
 	switch r = l.next(); r {
 	case eof:
+		if len(l.heredocs) > 0 {
+			lexHeredocBodies(l)
+		}
 		l.emit(ItemEOF, ItemTerminated)
 		return nil
 	case '>', '<':
@@ -237,9 +270,16 @@ func lexAny(l *Lexer) stateFn {
 	case '`':
 		return lexSingleQuoted
 	case '"':
+		if strings.HasPrefix(l.input[l.pos:], `""`) {
+			l.pos += 2
+			return lexRawQuoted
+		}
 		return lexDoubleQuoted
 	case '\n':
 		l.emit(ItemEndOfLine, ItemTerminated)
+		if len(l.heredocs) > 0 {
+			return lexHeredocBodies
+		}
 		return lexAnyOrComment
 	case '?':
 		// TODO
@@ -258,13 +298,42 @@ func lexAny(l *Lexer) stateFn {
 	if isSpace(r) {
 		return lexSpace
 	}
+	if r == '^' && continuesLine(l) {
+		l.emit(ItemSpace, ItemAmbiguious)
+		return lexAnyOrComment
+	}
 	if it, ok := singleRuneToken[r]; ok {
 		l.emit(it, ItemTerminated)
+		if it == ItemPipe || it == ItemSemicolon {
+			// Like after a newline, a comment may start right after a pipe or
+			// semicolon.
+			return lexAnyOrComment
+		}
 		return lexAny
 	}
 	return lexBare
 }
 
+// continuesLine determines whether a caret that has just been seen is a line
+// continuation, i.e. it is followed by optional spaces and comment and then a
+// newline. If it is, the spaces, comment and newline are consumed.
+func continuesLine(l *Lexer) bool {
+	i := int(l.pos)
+	for i < len(l.input) && isSpace(rune(l.input[i])) {
+		i++
+	}
+	if i < len(l.input) && l.input[i] == '#' {
+		for i < len(l.input) && l.input[i] != '\n' {
+			i++
+		}
+	}
+	if i == len(l.input) || l.input[i] != '\n' {
+		return false
+	}
+	l.pos = Pos(i + 1)
+	return true
+}
+
 // lexAnyOrComment like lexAny, but allows comments.
 func lexAnyOrComment(l *Lexer) stateFn {
 	if l.peek() == '#' {
@@ -299,14 +368,30 @@ func lexSpace(l *Lexer) stateFn {
 }
 
 // lexRedirLeader scans an IO redirection leader.
-// It is started by one of < <> > >> >? and may be followed immediately by a
+// It is started by one of < <> > >> >| >? and may be followed immediately by a
 // string surrounded by square brackets. The internal structure of the string
 // is not checked here.
 func lexRedirLeader(l *Lexer) stateFn {
 	switch r := l.next(); r {
 	case '<', '>':
+		if r == '<' && l.peek() == '<' {
+			l.next()
+			return lexHereLeader
+		}
+		if l.peek() == '(' {
+			// Process substitution.
+			l.next()
+			if r == '<' {
+				l.emit(ItemLessLParen, ItemTerminated)
+			} else {
+				l.emit(ItemGreaterLParen, ItemTerminated)
+			}
+			return lexAny
+		}
 		if l.peek() == '>' {
 			l.next()
+		} else if r == '>' && l.peek() == '|' {
+			l.next()
 		}
 	default:
 		panic("unreachable")
@@ -331,6 +416,87 @@ func lexRedirLeader(l *Lexer) stateFn {
 	return lexAny
 }
 
+// lexHereLeader scans the leader of a here-string, <<<, or of a
+// here-document, like <<EOF, <<-EOF or <<`EOF`, which includes the delimiter.
+// The leading << has been seen.
+func lexHereLeader(l *Lexer) stateFn {
+	if l.peek() == '<' {
+		l.next()
+		l.emit(ItemRedirLeader, ItemTerminated)
+		return lexAny
+	}
+	h := heredoc{}
+	if l.peek() == '-' {
+		l.next()
+		h.strip = true
+	}
+	for isSpace(l.peek()) {
+		l.next()
+	}
+	start := l.pos
+	switch q := l.peek(); q {
+	case '`', '"':
+		l.next()
+		start = l.pos
+		for {
+			r := l.next()
+			if r == q {
+				break
+			}
+			if r == eof || r == '\n' {
+				return l.errorf("unterminated here-document delimiter")
+			}
+		}
+		h.delim = l.input[start : l.pos-1]
+	default:
+		for isHeredocDelimRune(l.peek()) {
+			l.next()
+		}
+		h.delim = l.input[start:l.pos]
+	}
+	if h.delim == "" {
+		return l.errorf("expect here-document delimiter")
+	}
+	l.heredocs = append(l.heredocs, h)
+	l.emit(ItemRedirLeader, ItemTerminated)
+	return lexAny
+}
+
+func isHeredocDelimRune(r rune) bool {
+	return r == '_' || r == '-' || r == '.' ||
+		'0' <= r && r <= '9' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z'
+}
+
+// lexHeredocBodies scans the bodies of the here-documents started on the line
+// that has just ended, emitting one ItemHeredoc for each. A body runs up to
+// and including the line consisting of the delimiter only; if there is no
+// such line, the body is unterminated and runs to the end of input.
+func lexHeredocBodies(l *Lexer) stateFn {
+	for _, h := range l.heredocs {
+		end := ItemUnterminated
+		for int(l.pos) < len(l.input) {
+			rest := l.input[l.pos:]
+			line := rest
+			if i := strings.IndexByte(rest, '\n'); i != -1 {
+				line = rest[:i]
+				l.pos += Pos(i + 1)
+			} else {
+				l.pos += Pos(len(rest))
+			}
+			if h.strip {
+				line = strings.TrimLeft(line, "\t")
+			}
+			if line == h.delim {
+				end = ItemTerminated
+				break
+			}
+		}
+		l.emit(ItemHeredoc, end)
+	}
+	l.heredocs = nil
+	return lexAnyOrComment
+}
+
 // lexBare scans a bare string.
 // The first rune has already been seen.
 func lexBare(l *Lexer) stateFn {
@@ -388,12 +554,24 @@ loop:
 	return lexAny
 }
 
-// lexDoubleQuoted scans a double-quoted string.
+// lexDoubleQuoted scans a double-quoted string, which may contain command
+// interpolations like $(cmd) that in turn contain quoted strings and newlines.
 // The opening quote has already been seen.
 func lexDoubleQuoted(l *Lexer) stateFn {
 loop:
 	for {
 		switch l.next() {
+		case '$':
+			if l.peek() != '(' {
+				break
+			}
+			end, ok := skipCapture(l.input, int(l.pos)+1)
+			if !ok {
+				l.pos = Pos(len(l.input))
+				l.emit(ItemDoubleQuoted, ItemUnterminated)
+				return lexAny
+			}
+			l.pos = Pos(end)
 		case '\\':
 			if r := l.next(); r != eof && r != '\n' {
 				break
@@ -410,6 +588,77 @@ loop:
 	return lexAny
 }
 
+// skipCapture finds the end of a command interpolation in a double-quoted
+// string, skipping over nested parentheses and quoted strings. i is the
+// position right after the opening parenthesis. It returns the position after
+// the closing parenthesis, or false if the input ends before it.
+func skipCapture(s string, i int) (int, bool) {
+	depth := 1
+	for i < len(s) {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i + 1, true
+			}
+		case '`':
+			j := strings.IndexByte(s[i+1:], '`')
+			if j == -1 {
+				return 0, false
+			}
+			i += j + 1
+		case '"':
+			j, ok := skipDoubleQuoted(s, i+1)
+			if !ok {
+				return 0, false
+			}
+			i = j - 1
+		}
+		i++
+	}
+	return 0, false
+}
+
+// skipDoubleQuoted is like skipCapture, but finds the end of a double-quoted
+// string. i is the position right after the opening quote.
+func skipDoubleQuoted(s string, i int) (int, bool) {
+	for i < len(s) {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1, true
+		case '$':
+			if i+1 < len(s) && s[i+1] == '(' {
+				j, ok := skipCapture(s, i+2)
+				if !ok {
+					return 0, false
+				}
+				i = j - 1
+			}
+		}
+		i++
+	}
+	return 0, false
+}
+
+// lexRawQuoted scans a triple-quoted raw string, which may span multiple
+// lines and runs until the next `"""`.
+// The opening quotes have already been seen.
+func lexRawQuoted(l *Lexer) stateFn {
+	i := strings.Index(l.input[l.pos:], `"""`)
+	if i == -1 {
+		l.pos = Pos(len(l.input))
+		l.emit(ItemRawQuoted, ItemUnterminated)
+		return lexAny
+	}
+	l.pos += Pos(i + 3)
+	l.emit(ItemRawQuoted, ItemTerminated)
+	return lexAny
+}
+
 // isSpace reports whether r is a space character.
 func isSpace(r rune) bool {
 	return r == ' ' || r == '\t'
@@ -14,6 +14,18 @@ var lexTests = []struct {
 		{ItemSpace, 8, " ", ItemAmbiguious},
 		{ItemDoubleQuoted, 9, `"d\"e"`, ItemTerminated},
 	}},
+	// Interpolation
+	{"a \"$(b \")\" `)`)$c\"", []Item{
+		{ItemBare, 0, "a", ItemAmbiguious},
+		{ItemSpace, 1, " ", ItemAmbiguious},
+		{ItemDoubleQuoted, 2, "\"$(b \")\" `)`)$c\"", ItemTerminated},
+	}},
+	// Raw strings
+	{"a \"\"\"b\n\\\"c\"\"\"", []Item{
+		{ItemBare, 0, "a", ItemAmbiguious},
+		{ItemSpace, 1, " ", ItemAmbiguious},
+		{ItemRawQuoted, 2, "\"\"\"b\n\\\"c\"\"\"", ItemTerminated},
+	}},
 	// Comment
 	{"a #b\nc", []Item{
 		{ItemBare, 0, "a", ItemAmbiguious},
@@ -22,6 +34,45 @@ var lexTests = []struct {
 		{ItemEndOfLine, 4, "\n", ItemTerminated},
 		{ItemBare, 5, "c", ItemAmbiguious},
 	}},
+	{"a|#b\nc", []Item{
+		{ItemBare, 0, "a", ItemAmbiguious},
+		{ItemPipe, 1, "|", ItemTerminated},
+		{ItemSpace, 2, "#b", ItemAmbiguious},
+		{ItemEndOfLine, 4, "\n", ItemTerminated},
+		{ItemBare, 5, "c", ItemAmbiguious},
+	}},
+	// Here-documents
+	{"a <<-EOF x\n\tb\n\tEOF\nc", []Item{
+		{ItemBare, 0, "a", ItemAmbiguious},
+		{ItemSpace, 1, " ", ItemAmbiguious},
+		{ItemRedirLeader, 2, "<<-EOF", ItemTerminated},
+		{ItemSpace, 8, " ", ItemAmbiguious},
+		{ItemBare, 9, "x", ItemAmbiguious},
+		{ItemEndOfLine, 10, "\n", ItemTerminated},
+		{ItemHeredoc, 11, "\tb\n\tEOF\n", ItemTerminated},
+		{ItemBare, 19, "c", ItemAmbiguious},
+	}},
+	// Process substitution
+	{"a <(b) >c", []Item{
+		{ItemBare, 0, "a", ItemAmbiguious},
+		{ItemSpace, 1, " ", ItemAmbiguious},
+		{ItemLessLParen, 2, "<(", ItemTerminated},
+		{ItemBare, 4, "b", ItemAmbiguious},
+		{ItemRParen, 5, ")", ItemTerminated},
+		{ItemSpace, 6, " ", ItemAmbiguious},
+		{ItemRedirLeader, 7, ">", ItemAmbiguious},
+		{ItemBare, 8, "c", ItemAmbiguious},
+	}},
+	// Line continuation
+	{"a ^ #b\nc ^d", []Item{
+		{ItemBare, 0, "a", ItemAmbiguious},
+		{ItemSpace, 1, " ", ItemAmbiguious},
+		{ItemSpace, 2, "^ #b\n", ItemAmbiguious},
+		{ItemBare, 7, "c", ItemAmbiguious},
+		{ItemSpace, 8, " ", ItemAmbiguious},
+		{ItemCaret, 9, "^", ItemTerminated},
+		{ItemBare, 10, "d", ItemAmbiguious},
+	}},
 }
 
 func TestLex(t *testing.T) {
@@ -31,10 +31,13 @@ func (p Pos) Position() Pos {
 type ChunkNode struct {
 	Pos
 	Nodes []*PipelineNode
+	// Comments are the comments in the source, in order. They are only kept
+	// in the root chunk, for tools like the formatter.
+	Comments []*Comment
 }
 
 func newChunk(pos Pos, nodes ...*PipelineNode) *ChunkNode {
-	return &ChunkNode{pos, nodes}
+	return &ChunkNode{Pos: pos, Nodes: nodes}
 }
 
 func (l *ChunkNode) isNode() {}
@@ -111,6 +114,7 @@ type FactorNode struct {
 	Pos
 	Typ  FactorType
 	Node Node
+	End  Pos // byte position right after the factor
 }
 
 // FactorType determines the type of a FactorNode.
@@ -118,13 +122,18 @@ type FactorType int
 
 // FactorType constants.
 const (
-	StringFactor        FactorType = iota // string literal: a `a` a
-	VariableFactor                        // variable: $a
-	TableFactor                           // table: [a b c &k v]
-	ClosureFactor                         // closure: {|a| cmd}
-	ListFactor                            // list: {a b c}
-	OutputCaptureFactor                   // output capture: (cmd1|cmd2)
-	StatusCaptureFactor                   // status capture: ?(cmd1|cmd2)
+	StringFactor             FactorType = iota // string literal: a `a` a
+	VariableFactor                             // variable: $a
+	SpliceFactor                               // spliced variable: $@a
+	TableFactor                                // table: [a b c &k v]
+	ClosureFactor                              // closure: {|a| cmd}
+	ListFactor                                 // list: {a b c}
+	OutputCaptureFactor                        // output capture: (cmd1|cmd2)
+	StatusCaptureFactor                        // status capture: ?(cmd1|cmd2)
+	InterpolationFactor                        // interpolated string: "$a $(cmd)"
+	InputSubstitutionFactor                    // process substitution to read: <(cmd)
+	OutputSubstitutionFactor                   // process substitution to write: >(cmd)
+	OptionFactor                               // option: &name
 )
 
 func newFactor(pos Pos) *FactorNode {
@@ -186,3 +195,9 @@ func newString(pos Pos, orig, text string) *StringNode {
 }
 
 func (sn *StringNode) isNode() {}
+
+// Comment is a comment in the source.
+type Comment struct {
+	Pos
+	Text string // The comment, starting with '#', without the newline.
+}
@@ -9,7 +9,6 @@ package parse
 import (
 	"fmt"
 	"os"
-	"strconv"
 	"strings"
 
 	"github.com/xiaq/elvish/util"
@@ -21,23 +20,66 @@ type Parser struct {
 	completing bool       // Whether the parser is running in completing mode
 	Root       *ChunkNode // top-level root of the tree.
 	Ctx        *Context
-	text       string // text parsed to create the script (or its parent)
+	Errors     util.Errors // Errors found when running in tolerant mode.
+	text       string      // text parsed to create the script (or its parent)
+	tolerant   bool        // Whether the parser is running in tolerant mode
 	// Parsing only; cleared after parse.
 	lex       *Lexer
 	token     [3]Item // three-token lookahead for parser.
 	peekCount int
+	stopped   bool // Whether an unexpected token was met in tolerant mode.
+	stopPos   Pos
+	heredocs  []pendingHeredoc // Here-documents waiting for their bodies.
+	comments  []*Comment       // Comments seen so far.
+}
+
+type pendingHeredoc struct {
+	redir       *HereRedir
+	strip       bool
+	interpolate bool
 }
 
 // next returns the next token.
 func (p *Parser) next() Item {
+	if p.stopped {
+		return p.stopItem()
+	}
 	if p.peekCount > 0 {
 		p.peekCount--
 	} else {
-		p.token[0] = p.lex.NextItem()
+		p.token[0] = p.lexItem()
 	}
 	return p.token[p.peekCount]
 }
 
+// lexItem returns the next token from the lexer. The bodies of here-documents
+// are taken by the redirections waiting for them, and never seen by the rest
+// of the parser. Comments, which are lexed as spaces, are recorded.
+func (p *Parser) lexItem() Item {
+	for {
+		token := p.lex.NextItem()
+		if token.Typ == ItemSpace {
+			p.comment(token)
+		}
+		if token.Typ != ItemHeredoc {
+			return token
+		}
+		p.heredocBody(token)
+	}
+}
+
+// comment records the comment in a space token, if there is one. Besides
+// comments on their own, a line continuation may contain one, like in
+// "^ # comment\n".
+func (p *Parser) comment(token Item) {
+	i := strings.IndexByte(token.Val, '#')
+	if i == -1 {
+		return
+	}
+	text := strings.TrimRight(token.Val[i:], "\n")
+	p.comments = append(p.comments, &Comment{token.Pos + Pos(i), text})
+}
+
 // backup backs the input stream up one token.
 func (p *Parser) backup() {
 	p.peekCount++
@@ -60,11 +102,14 @@ func (p *Parser) backup3(t2, t1 Item) { // Reverse order: we're pushing back.
 
 // peek returns but does not consume the next token.
 func (p *Parser) peek() Item {
+	if p.stopped {
+		return p.stopItem()
+	}
 	if p.peekCount > 0 {
 		return p.token[p.peekCount-1]
 	}
 	p.peekCount = 1
-	p.token[0] = p.lex.NextItem()
+	p.token[0] = p.lexItem()
 	return p.token[0]
 }
 
@@ -100,10 +145,27 @@ func NewParser(name string) *Parser {
 	}
 }
 
-// errorf formats the error and terminates processing.
+// errorf formats the error and terminates processing. In tolerant mode, the
+// error is recorded and parsing goes on.
 func (p *Parser) errorf(pos int, format string, args ...interface{}) {
+	p.fail(util.NewContextualError(p.Name, p.text, pos, format, args...))
+}
+
+// incompletef is like errorf, but for errors caused by the input ending too
+// early.
+func (p *Parser) incompletef(pos int, format string, args ...interface{}) {
+	err := util.NewContextualError(p.Name, p.text, pos, format, args...)
+	err.Incomplete = true
+	p.fail(err)
+}
+
+func (p *Parser) fail(err *util.ContextualError) {
+	if p.tolerant {
+		p.Errors = append(p.Errors, err)
+		return
+	}
 	p.Root = nil
-	util.Panic(util.NewContextualError(p.Name, p.text, pos, format, args...))
+	util.Panic(err)
 }
 
 // expect consumes the next token and guarantees it has the required type.
@@ -124,13 +186,38 @@ func (p *Parser) expectOneOf(expected1, expected2 ItemType, context string) Item
 	return token
 }
 
-// unexpected complains about the token and terminates processing.
+// unexpected complains about the token and terminates processing. In
+// tolerant mode, the rest of the input is treated as if it were not there, so
+// that all pending constructs end where the token is.
 func (p *Parser) unexpected(token Item, context string) {
-	p.errorf(int(token.Pos), "unexpected %s in %s", token, context)
+	if p.stopped {
+		// Caused by an earlier unexpected token.
+		return
+	}
+	if token.Typ == ItemEOF {
+		p.incompletef(int(token.Pos), "unexpected %s in %s", token, context)
+	} else {
+		p.errorf(int(token.Pos), "unexpected %s in %s", token, context)
+	}
+	p.stopped = true
+	p.stopPos = token.Pos
 }
 
-// stopParse terminates parsing.
+// stopItem returns the EOF token seen in place of the rest of the input after
+// an unexpected token in tolerant mode.
+func (p *Parser) stopItem() Item {
+	return Item{ItemEOF, p.stopPos, "", ItemTerminated}
+}
+
+// stopParse terminates parsing. The rest of the tokens are drained, so that
+// the lexer can finish.
 func (p *Parser) stopParse() {
+	if p.lex != nil {
+		go func(items chan Item) {
+			for range items {
+			}
+		}(p.lex.items)
+	}
 	p.lex = nil
 }
 
@@ -162,17 +249,30 @@ func (p *Parser) recoverCtx() {
 // Parse parses the script to construct a representation of the script for
 // execution.
 func (p *Parser) Parse(text string, completing bool) (err error) {
+	return p.ParseEmbedded(text, 0, len(text), completing)
+}
+
+// ParseEmbedded is like Parse, but parses only text[start:end], a snippet of
+// elvish embedded in a larger document, like a fenced block in Markdown. All
+// positions, in the tree and in errors, are offsets in the whole text.
+func (p *Parser) ParseEmbedded(text string, start, end int, completing bool) (err error) {
 	defer util.Recover(&err)
 	defer p.recoverCtx()
 	defer p.stopParse()
 
 	p.completing = completing
-	p.text = text
-	p.lex = Lex(p.Name, text)
+	p.text = text[:end]
+	p.lex = LexEmbedded(p.Name, text, start, end)
 	p.peekCount = 0
+	p.Errors = nil
+	p.stopped = false
+	p.heredocs = nil
+	p.comments = nil
 
-	p.Ctx = &Context{CommandContext, nil, newTermList(0), newTerm(0), &FactorNode{Node: newString(0, "", "")}}
+	pos := Pos(start)
+	p.Ctx = &Context{CommandContext, nil, newTermList(pos), newTerm(pos), &FactorNode{Node: newString(pos, "", "")}}
 	p.Root = p.parse()
+	p.Root.Comments = p.comments
 
 	return nil
 }
@@ -188,6 +288,45 @@ func Parse(name, text string) (*ChunkNode, error) {
 	return p.Root, nil
 }
 
+// ParseTolerant parses the script in tolerant mode, in which syntax errors
+// don't stop the parsing. It returns a possibly partial tree, along with all
+// the errors found, with nil meaning that the script is well-formed. It is
+// used by the editor to make sense of incomplete input, like that with an
+// unterminated string or an open brace.
+func ParseTolerant(name, text string) (*ChunkNode, util.Errors) {
+	p := NewParser(name)
+	p.tolerant = true
+	err := p.Parse(text, false)
+	if err != nil {
+		// Not really reachable, since errors are not panicked in tolerant
+		// mode.
+		return nil, util.Errors{err}
+	}
+	return p.Root, p.Errors
+}
+
+// ParseEmbedded parses the snippet text[start:end] in tolerant mode, like
+// ParseTolerant. Positions are offsets in text, which util.FindContext turns
+// into line and column numbers.
+func ParseEmbedded(name, text string, start, end int) (*ChunkNode, util.Errors) {
+	p := NewParser(name)
+	p.tolerant = true
+	err := p.ParseEmbedded(text, start, end, false)
+	if err != nil {
+		return nil, util.Errors{err}
+	}
+	return p.Root, p.Errors
+}
+
+// IsIncomplete determines whether err is a parse error caused by the input
+// ending too early, like with an open brace, a trailing pipe or an
+// unterminated string, as opposed to invalid input. More input may make such
+// a script valid.
+func IsIncomplete(err error) bool {
+	ce, ok := err.(*util.ContextualError)
+	return ok && ce.Incomplete
+}
+
 // Complete is a shorthand for constructing a Paser, call Parse and take out
 // its Ctx.
 func Complete(name, text string) (*Context, error) {
@@ -199,6 +338,17 @@ func Complete(name, text string) (*Context, error) {
 	return p.Ctx, nil
 }
 
+// CompleteEmbedded is like Complete, for the snippet text[start:end] with
+// the cursor at end.
+func CompleteEmbedded(name, text string, start, end int) (*Context, error) {
+	p := NewParser(name)
+	err := p.ParseEmbedded(text, start, end, true)
+	if err != nil {
+		return nil, err
+	}
+	return p.Ctx, nil
+}
+
 // parse parses a chunk and ensures there are no trailing tokens
 func (p *Parser) parse() *ChunkNode {
 	chunk := p.chunk()
@@ -220,7 +370,8 @@ loop:
 		case ItemSemicolon, ItemEndOfLine:
 			p.next()
 			continue loop
-		case ItemEOF:
+		case ItemEOF, ItemRBrace:
+			// A closing brace on a line of its own ends a closure.
 			break loop
 		default:
 		}
@@ -237,7 +388,8 @@ loop:
 	return chunk
 }
 
-// Pipeline = Form { "|" Form }
+// Pipeline = Form { "|" { space | "\n" } Form }
+// A pipe at the end of a line continues the pipeline on the next line.
 func (p *Parser) pipeline() *PipelineNode {
 	pipe := newPipeline(p.peek().Pos)
 	for {
@@ -246,6 +398,9 @@ func (p *Parser) pipeline() *PipelineNode {
 			break
 		}
 		p.next()
+		for p.peekNonSpace().Typ == ItemEndOfLine {
+			p.next()
+		}
 	}
 	return pipe
 }
@@ -254,15 +409,21 @@ func (p *Parser) pipeline() *PipelineNode {
 func (p *Parser) form() *FormNode {
 	fm := newForm(p.peekNonSpace().Pos)
 	p.Ctx.Typ = CommandContext
-	fm.Command = p.term()
+	if isComparison(p.peekNonSpace()) {
+		fm.Command = p.comparison()
+	} else {
+		fm.Command = p.term()
+	}
 	p.Ctx.CommandTerm = fm.Command
 	p.Ctx.Typ = ArgContext
 	fm.Args = p.termList()
 loop:
 	for {
-		switch p.peekNonSpace().Typ {
+		switch token := p.peekNonSpace(); token.Typ {
 		case ItemRedirLeader:
-			fm.Redirs = append(fm.Redirs, p.redir())
+			r := p.redir()
+			r.setLeader(token.Val)
+			fm.Redirs = append(fm.Redirs, r)
 		case ItemStatusRedirLeader:
 			fm.StatusRedir = p.statusRedir()
 		default:
@@ -284,7 +445,7 @@ loop:
 		case t == ItemEOF:
 			pos := p.peek().Pos
 			p.Ctx.PrevFactors = newTerm(pos)
-			p.Ctx.ThisFactor = &FactorNode{pos, StringFactor, newString(pos, "", "")}
+			p.Ctx.ThisFactor = &FactorNode{pos, StringFactor, newString(pos, "", ""), pos}
 			p.foundCtx()
 			fallthrough
 		default:
@@ -314,27 +475,77 @@ loop:
 	return term
 }
 
+// isComparison determines whether a token at the start of a form is the
+// command <, <=, > or >=, rather than a redirection leader.
+func isComparison(token Item) bool {
+	return token.Typ == ItemRedirLeader && token.End == ItemAmbiguious &&
+		(token.Val == "<" || token.Val == ">")
+}
+
+// comparison parses the command of a form that is a comparison, which is
+// lexed as a redirection leader, possibly followed by a bare "=".
+func (p *Parser) comparison() *TermNode {
+	token := p.next()
+	term := newTerm(token.Pos)
+	p.Ctx.PrevFactors = term
+	fn := newFactor(token.Pos)
+	p.Ctx.ThisFactor = fn
+	text := token.Val
+	if next := p.peek(); next.Typ == ItemBare && next.Val == "=" {
+		p.next()
+		text += "="
+	}
+	fn.Typ = StringFactor
+	fn.Node = newString(token.Pos, text, text)
+	fn.End = token.Pos + Pos(len(text))
+	term.append(fn)
+	if p.peek().Typ == ItemEOF {
+		p.foundCtx()
+	}
+	return term
+}
+
 func unquote(token Item) (string, error) {
 	switch token.Typ {
 	case ItemBare:
 		return token.Val, nil
 	case ItemSingleQuoted:
+		if token.End == ItemUnterminated {
+			return strings.Replace(token.Val[1:], "``", "`", -1),
+				fmt.Errorf("unterminated string")
+		}
 		return strings.Replace(token.Val[1:len(token.Val)-1], "``", "`", -1),
 			nil
 	case ItemDoubleQuoted:
-		return strconv.Unquote(token.Val)
+		return unquoteDouble(token.Val)
+	case ItemRawQuoted:
+		if len(token.Val) < 6 || !strings.HasSuffix(token.Val, `"""`) {
+			return "", fmt.Errorf("unterminated raw string")
+		}
+		text := token.Val[3 : len(token.Val)-3]
+		if strings.HasPrefix(text, "\n") {
+			return dedent(text[1:]), nil
+		}
+		return text, nil
 	default:
 		return "", fmt.Errorf("bad token type (%s)", token.Typ)
 	}
 }
 
+// endsEarly determines whether a token is unterminated because the input
+// ends, rather than because of a newline in a double-quoted string.
+func (p *Parser) endsEarly(token Item) bool {
+	return token.End == ItemUnterminated && int(token.Pos)+len(token.Val) == len(p.text)
+}
+
 // startsFactor determines whether a token of type p can start a Factor.
 // Frequently used for lookahead, since a Term or TermList always starts with
 // a Factor.
 func startsFactor(p ItemType) bool {
 	switch p {
-	case ItemBare, ItemSingleQuoted, ItemDoubleQuoted,
-		ItemLParen, ItemQuestionLParen, ItemLBracket, ItemLBrace,
+	case ItemBare, ItemSingleQuoted, ItemDoubleQuoted, ItemRawQuoted,
+		ItemLParen, ItemQuestionLParen, ItemLessLParen, ItemGreaterLParen,
+		ItemLBracket, ItemLBrace,
 		ItemDollar, ItemAmpersand:
 		return true
 	default:
@@ -343,14 +554,20 @@ func startsFactor(p ItemType) bool {
 }
 
 // Factor = '$' bare
-//        = ( bare | single-quoted | double-quoted | Table )
+//        = '$@' bare
+//        = ( bare | single-quoted | double-quoted | raw-quoted | Table )
 //        = '{' TermList '}'
 //        = Closure
 //        = '(' Pipeline ')'
+//        = ( '<(' | '>(' ) Pipeline ')'
+//        = '"' { string | '$' bare | '${' bare '}' | '$(' Pipeline ')' } '"'
+//        = '&' bare
 // Closure and flat list are distinguished by the first token after the
 // opening brace. If startsFactor(token), it is considered a flat list.
 // This implies that whitespaces after opening brace always introduce a
 // closure: {echo} is a flat list, { echo } and {|| echo} are closures.
+// An option word like &deep is a string starting with the ampersand; outside
+// of table literals, it is used to pass options to builtins.
 func (p *Parser) factor() (fn *FactorNode) {
 	fn = newFactor(p.peek().Pos)
 	p.Ctx.ThisFactor = fn
@@ -361,17 +578,48 @@ func (p *Parser) factor() (fn *FactorNode) {
 			p.unexpected(token, "factor of variable")
 		}
 		fn.Typ = VariableFactor
-		fn.Node = newString(token.Pos, token.Val, token.Val)
+		fn.End = token.Pos + Pos(len(token.Val))
+		name := token.Val
+		if strings.HasPrefix(name, "@") {
+			fn.Typ = SpliceFactor
+			name = name[1:]
+			if name == "" {
+				p.errorf(int(token.Pos), "expect variable name after $@")
+			}
+		}
+		fn.Node = newString(token.Pos, token.Val, name)
 		if p.peek().Typ == ItemEOF {
 			p.foundCtx()
 		}
 		return
-	case ItemBare, ItemSingleQuoted, ItemDoubleQuoted:
+	case ItemBare, ItemSingleQuoted, ItemDoubleQuoted, ItemRawQuoted:
+		fn.End = token.Pos + Pos(len(token.Val))
+		if token.Typ == ItemDoubleQuoted && hasInterpolation(token.Val) {
+			if p.endsEarly(token) {
+				p.incompletef(int(token.Pos), "unterminated string")
+			} else if token.End == ItemUnterminated {
+				p.errorf(int(token.Pos), "unterminated string")
+			}
+			fn.Typ = InterpolationFactor
+			fn.Node = p.interpolation(token)
+			if p.peek().Typ == ItemEOF {
+				p.foundCtx()
+			}
+			return
+		}
 		text, err := unquote(token)
 		if err != nil {
 			// BUG(xiaq): When completing, unterminated quoted string results
 			// in errors
-			p.errorf(int(token.Pos), "%s", err)
+			pos := int(token.Pos)
+			if ee, ok := err.(*escapeError); ok {
+				pos += ee.offset
+			}
+			if p.endsEarly(token) {
+				p.incompletef(pos, "%s", err)
+			} else {
+				p.errorf(pos, "%s", err)
+			}
 		}
 		fn.Typ = StringFactor
 		fn.Node = newString(token.Pos, token.Val, text)
@@ -379,42 +627,65 @@ func (p *Parser) factor() (fn *FactorNode) {
 			p.foundCtx()
 		}
 		return
+	case ItemAmpersand:
+		name := p.next()
+		if name.Typ != ItemBare {
+			p.unexpected(name, "option word")
+		}
+		fn.Typ = OptionFactor
+		fn.Node = newString(token.Pos, token.Val+name.Val, name.Val)
+		fn.End = name.Pos + Pos(len(name.Val))
+		return
 	case ItemLBracket:
 		fn.Typ = TableFactor
-		fn.Node = p.table()
+		fn.Node, fn.End = p.table()
 		return
 	case ItemLBrace:
 		if startsFactor(p.peek().Typ) {
 			fn.Typ = ListFactor
-			fn.Node = p.termList()
-			if token := p.next(); token.Typ != ItemRBrace {
+			fn.Node = splitAlternatives(p.termList())
+			token := p.next()
+			if token.Typ != ItemRBrace {
 				p.unexpected(token, "factor of item list")
 			}
+			fn.End = token.Pos + Pos(len(token.Val))
 		} else {
 			fn.Typ = ClosureFactor
-			fn.Node = p.closure()
+			fn.Node, fn.End = p.closure()
 		}
 		return
-	case ItemLParen, ItemQuestionLParen:
-		if token.Typ == ItemLParen {
+	case ItemLParen, ItemQuestionLParen, ItemLessLParen, ItemGreaterLParen:
+		switch token.Typ {
+		case ItemLParen:
 			fn.Typ = OutputCaptureFactor
-		} else {
+		case ItemQuestionLParen:
 			fn.Typ = StatusCaptureFactor
+		case ItemLessLParen:
+			fn.Typ = InputSubstitutionFactor
+		case ItemGreaterLParen:
+			fn.Typ = OutputSubstitutionFactor
 		}
 		fn.Node = p.pipeline()
-		if token := p.next(); token.Typ != ItemRParen {
+		token := p.next()
+		if token.Typ != ItemRParen {
 			p.unexpected(token, "factor of pipeline capture")
 		}
+		fn.End = token.Pos + Pos(len(token.Val))
 		return
 	default:
 		p.unexpected(token, "factor")
-		return nil
+		// Only reached in tolerant mode.
+		fn.Typ = StringFactor
+		fn.Node = newString(token.Pos, "", "")
+		fn.End = token.Pos
+		return
 	}
 }
 
-// closure parses a closure literal. The opening brace has been seen.
+// closure parses a closure literal. The opening brace has been seen. It also
+// returns the position right after the closing brace.
 // Closure  = '{' [ space ] [ '|' TermList '|' [ space ] ] Chunk '}'
-func (p *Parser) closure() (tn *ClosureNode) {
+func (p *Parser) closure() (tn *ClosureNode, end Pos) {
 	tn = newClosure(p.peek().Pos)
 	if p.peekNonSpace().Typ == ItemPipe {
 		p.next()
@@ -424,15 +695,163 @@ func (p *Parser) closure() (tn *ClosureNode) {
 		}
 	}
 	tn.Chunk = p.chunk()
-	if token := p.nextNonSpace(); token.Typ != ItemRBrace {
+	token := p.nextNonSpace()
+	if token.Typ != ItemRBrace {
 		p.unexpected(token, "end of closure")
 	}
-	return
+	return tn, token.Pos + Pos(len(token.Val))
+}
+
+// hasInterpolation determines whether a double-quoted string contains any
+// unescaped dollar sign that starts an interpolation.
+func hasInterpolation(quoted string) bool {
+	for i := 0; i < len(quoted); i++ {
+		switch quoted[i] {
+		case '\\':
+			i++
+		case '$':
+			if interpolates(quoted, i) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// interpolates determines whether the dollar sign at s[i] starts an
+// interpolation, which it does when followed by a parenthesis, a brace or the
+// start of a variable name. Other dollar signs, like that of "cost $5", are
+// kept as they are.
+func interpolates(s string, i int) bool {
+	if i+1 >= len(s) {
+		return false
+	}
+	r := s[i+1]
+	return r == '(' || r == '{' || r == '_' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z'
+}
+
+// isVariableNameRune determines whether r may appear in the name of a
+// variable interpolated into a double-quoted string without braces.
+func isVariableNameRune(r byte) bool {
+	return r == '_' || r == '-' || r == ':' ||
+		'0' <= r && r <= '9' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z'
+}
+
+// interpolation parses a double-quoted string containing interpolations into
+// a term, whose factors are the literal parts, variables like $a or ${a}, and
+// output captures like $(cmd). Dollar signs that don't start any of them are
+// part of the literal parts.
+func (p *Parser) interpolation(token Item) *TermNode {
+	val := token.Val
+	term := newTerm(token.Pos)
+	segStart := 1
+	flush := func(end int) {
+		if end == segStart {
+			return
+		}
+		seg := val[segStart:end]
+		text, err := unquoteDouble(`"` + seg + `"`)
+		if err != nil {
+			pos := int(token.Pos) + segStart - 1
+			if ee, ok := err.(*escapeError); ok {
+				pos += ee.offset
+			}
+			p.errorf(pos, "%s", err)
+		}
+		pos := token.Pos + Pos(segStart)
+		term.append(&FactorNode{pos, StringFactor, newString(pos, seg, text), pos + Pos(len(seg))})
+	}
+
+	for i := 1; i < len(val)-1; i++ {
+		switch val[i] {
+		case '\\':
+			i++
+			continue
+		case '$':
+			if !interpolates(val, i) {
+				continue
+			}
+		default:
+			continue
+		}
+		flush(i)
+		pos := token.Pos + Pos(i)
+		switch {
+		case val[i+1] == '(':
+			end, ok := skipCapture(val, i+2)
+			if !ok {
+				p.errorf(int(pos), "unterminated $(")
+				return term
+			}
+			sub := &Parser{Name: p.Name, text: p.text, Ctx: &Context{}, tolerant: p.tolerant}
+			sub.lex = lexFrom(p.Name, p.text[:int(token.Pos)+end-1], pos+2)
+			pn := sub.pipeline()
+			if token := sub.peekNonSpace(); token.Typ != ItemEOF {
+				sub.unexpected(token, "command interpolation")
+			}
+			sub.stopParse()
+			p.Errors = append(p.Errors, sub.Errors...)
+			term.append(&FactorNode{pos, OutputCaptureFactor, pn, token.Pos + Pos(end)})
+			i = end - 1
+		case val[i+1] == '{':
+			end := strings.IndexByte(val[i:], '}')
+			if end == -1 {
+				p.errorf(int(pos), "unterminated ${")
+				return term
+			}
+			name := val[i+2 : i+end]
+			if name == "" {
+				p.errorf(int(pos), "expect variable name after ${")
+			}
+			term.append(&FactorNode{pos, VariableFactor, newString(pos+2, name, name), pos + Pos(end+1)})
+			i += end
+		default:
+			j := i + 1
+			for j < len(val)-1 && isVariableNameRune(val[j]) {
+				j++
+			}
+			name := val[i+1 : j]
+			term.append(&FactorNode{pos, VariableFactor, newString(pos+1, name, name), token.Pos + Pos(j)})
+			i = j - 1
+		}
+		segStart = i + 1
+	}
+	flush(len(val) - 1)
+	return term
 }
 
-// table parses a table literal. The opening bracket has been seen.
+// splitAlternatives splits the terms of a list at the commas in bare strings,
+// so that a list like {a,b{c,d}} becomes {a b{c d}} and, since lists are
+// expanded in compound words, file.{go,c} becomes file.go file.c.
+func splitAlternatives(list *TermListNode) *TermListNode {
+	newList := newTermList(list.Pos)
+	for _, tn := range list.Nodes {
+		term := newTerm(tn.Pos)
+		for _, fn := range tn.Nodes {
+			sn, _ := fn.Node.(*StringNode)
+			if fn.Typ != StringFactor || sn.Quoted != sn.Text || !strings.ContainsRune(sn.Text, ',') {
+				term.append(fn)
+				continue
+			}
+			pos := sn.Pos
+			for i, alt := range strings.Split(sn.Text, ",") {
+				if i > 0 {
+					newList.append(term)
+					term = newTerm(pos)
+				}
+				term.append(&FactorNode{pos, StringFactor, newString(pos, alt, alt), pos + Pos(len(alt))})
+				pos += Pos(len(alt) + 1)
+			}
+		}
+		newList.append(term)
+	}
+	return newList
+}
+
+// table parses a table literal. The opening bracket has been seen. It also
+// returns the position right after the closing bracket.
 // Table = '[' { [ space ] ( '& 'Term [ space ] Term | Term ) [ space ] } ']'
-func (p *Parser) table() (tn *TableNode) {
+func (p *Parser) table() (tn *TableNode, end Pos) {
 	tn = newTable(p.peek().Pos)
 
 	for {
@@ -449,9 +868,10 @@ func (p *Parser) table() (tn *TableNode) {
 			p.backup()
 			tn.appendToList(p.term())
 		} else if token.Typ == ItemRBracket {
-			return
+			return tn, token.Pos + 1
 		} else {
 			p.unexpected(token, "table literal")
+			return tn, token.Pos
 		}
 	}
 }
@@ -485,6 +905,9 @@ func (p *Parser) statusRedir() string {
 // optional, but sometimes required depending on the redir-leader.
 func (p *Parser) redir() Redir {
 	leader := p.next()
+	if strings.HasPrefix(leader.Val, "<<") {
+		return p.hereRedir(leader)
+	}
 
 	// Partition the redirection leader into direction and qualifier parts.
 	// For example, if leader.Val == ">>[1=2]", dir == ">>" and qual == "1=2".
@@ -499,8 +922,9 @@ func (p *Parser) redir() Redir {
 
 	// Determine the flag and default (new) fd from the direction.
 	var (
-		fd   uintptr
-		flag int
+		fd      uintptr
+		flag    int
+		clobber bool
 	)
 
 	switch dir {
@@ -513,6 +937,10 @@ func (p *Parser) redir() Redir {
 	case ">":
 		flag = os.O_WRONLY | os.O_CREATE
 		fd = 1
+	case ">|":
+		flag = os.O_WRONLY | os.O_CREATE
+		fd = 1
+		clobber = true
 	case ">>":
 		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
 		fd = 1
@@ -557,5 +985,89 @@ func (p *Parser) redir() Redir {
 	p.peekNonSpace()
 	p.Ctx.Typ = RedirFilenameContext
 	p.Ctx.PrevTerms = nil
-	return newFilenameRedir(leader.Pos, fd, flag, p.term())
+	return newFilenameRedir(leader.Pos, fd, flag, p.term(), clobber)
+}
+
+// hereRedir parses a here-string or a here-document redirection. The body of
+// a here-document comes later, after the end of the line.
+// HereRedir = "<<<" [ space ] Term
+//           = "<<" [ "-" ] [ space ] delimiter
+func (p *Parser) hereRedir(leader Item) Redir {
+	if leader.Val == "<<<" {
+		p.peekNonSpace()
+		return newHereRedir(leader.Pos, p.term(), true)
+	}
+	spec := leader.Val[2:]
+	h := pendingHeredoc{interpolate: true}
+	if strings.HasPrefix(spec, "-") {
+		h.strip = true
+		spec = spec[1:]
+	}
+	spec = strings.TrimLeft(spec, " \t")
+	if spec[0] == '`' || spec[0] == '"' {
+		// A quoted delimiter turns off interpolation, like in sh.
+		h.interpolate = false
+	}
+	h.redir = newHereRedir(leader.Pos, newTerm(leader.Pos), false)
+	p.heredocs = append(p.heredocs, h)
+	return h.redir
+}
+
+// heredocBody gives the body of a here-document to the first redirection
+// waiting for it. Leading tabs are stripped first when asked to. Unless the
+// delimiter is quoted, each line is then interpolated like a double-quoted
+// string.
+func (p *Parser) heredocBody(token Item) {
+	if len(p.heredocs) == 0 {
+		p.errorf(int(token.Pos), "unexpected here-document")
+		return
+	}
+	h := p.heredocs[0]
+	p.heredocs = p.heredocs[1:]
+	h.redir.Body = token.Val
+
+	body := token.Val
+	if token.End == ItemUnterminated {
+		p.incompletef(int(token.Pos), "unterminated here-document")
+	} else {
+		// Drop the terminator line.
+		body = strings.TrimSuffix(body, "\n")
+		body = body[:strings.LastIndexByte(body, '\n')+1]
+	}
+
+	text := h.redir.Text
+	var literal []string
+	for start := 0; start < len(body); {
+		end := len(body)
+		if i := strings.IndexByte(body[start:], '\n'); i != -1 {
+			end = start + i + 1
+		}
+		line := body[start:end]
+		pos := token.Pos + Pos(start)
+		if h.strip {
+			trimmed := strings.TrimLeft(line, "\t")
+			pos += Pos(len(line) - len(trimmed))
+			line = trimmed
+		}
+		start = end
+		if !h.interpolate {
+			literal = append(literal, line)
+			continue
+		}
+		content := strings.TrimSuffix(line, "\n")
+		// Only the positions inside the quotes need to match the text.
+		quoted := Item{ItemDoubleQuoted, pos - 1, `"` + content + `"`, ItemTerminated}
+		text.Nodes = append(text.Nodes, p.interpolation(quoted).Nodes...)
+		if len(content) < len(line) {
+			nl := pos + Pos(len(content))
+			text.append(&FactorNode{nl, StringFactor, newString(nl, "\n", "\n"), nl + 1})
+		}
+	}
+	if !h.interpolate {
+		s := strings.Join(literal, "")
+		text.append(&FactorNode{token.Pos, StringFactor, newString(token.Pos, s, s), token.Pos + Pos(len(token.Val))})
+	} else {
+		// Make the body a single value, like a double-quoted string.
+		h.redir.Text = newTerm(token.Pos, &FactorNode{token.Pos, InterpolationFactor, text, token.Pos + Pos(len(token.Val))})
+	}
 }
@@ -3,6 +3,7 @@ package parse
 import (
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/xiaq/elvish/util"
@@ -18,8 +19,28 @@ var parseTests = []struct {
 			0, &FormNode{ // form
 				0, newTerm( // term
 					0, &FactorNode{ // factor
-						0, StringFactor, newString(0, "ls", "ls")}),
+						0, StringFactor, newString(0, "ls", "ls"), 2}),
 				newTermList(2), nil, ""}))},
+	{"ls $@a", newChunk( // chunk
+		0, newPipeline( // pipeline
+			0, &FormNode{ // form
+				0, newTerm( // term
+					0, &FactorNode{ // factor
+						0, StringFactor, newString(0, "ls", "ls"), 2}),
+				newTermList(3, newTerm( // term list
+					3, &FactorNode{ // factor
+						3, SpliceFactor, newString(4, "@a", "a"), 6})),
+				nil, ""}))},
+	{"<= 1", newChunk( // chunk
+		0, newPipeline( // pipeline
+			0, &FormNode{ // form
+				0, newTerm( // term
+					0, &FactorNode{ // factor
+						0, StringFactor, newString(0, "<=", "<="), 2}),
+				newTermList(2, newTerm( // term list
+					3, &FactorNode{ // factor
+						3, StringFactor, newString(3, "1", "1"), 4})),
+				nil, ""}))},
 }
 
 func TestParse(t *testing.T) {
@@ -38,29 +59,29 @@ var completeTests = []struct {
 	{"", &Context{
 		CommandContext, nil,
 		newTermList(0), newTerm(0),
-		&FactorNode{0, StringFactor, newString(0, "", "")}}},
+		&FactorNode{0, StringFactor, newString(0, "", ""), 0}}},
 	{"l", &Context{
 		CommandContext, nil,
 		newTermList(0), newTerm(0),
-		&FactorNode{0, StringFactor, newString(0, "l", "l")}}},
+		&FactorNode{0, StringFactor, newString(0, "l", "l"), 1}}},
 	{"ls ", &Context{
 		ArgContext,
-		newTerm(0, &FactorNode{0, StringFactor, newString(0, "ls", "ls")}),
+		newTerm(0, &FactorNode{0, StringFactor, newString(0, "ls", "ls"), 2}),
 		newTermList(3),
 		newTerm(3),
-		&FactorNode{3, StringFactor, newString(3, "", "")}}},
+		&FactorNode{3, StringFactor, newString(3, "", ""), 3}}},
 	{"ls a", &Context{
 		ArgContext,
-		newTerm(0, &FactorNode{0, StringFactor, newString(0, "ls", "ls")}),
+		newTerm(0, &FactorNode{0, StringFactor, newString(0, "ls", "ls"), 2}),
 		newTermList(3),
 		newTerm(3),
-		&FactorNode{3, StringFactor, newString(3, "a", "a")}}},
+		&FactorNode{3, StringFactor, newString(3, "a", "a"), 4}}},
 	{"ls $a", &Context{
 		ArgContext,
-		newTerm(0, &FactorNode{0, StringFactor, newString(0, "ls", "ls")}),
+		newTerm(0, &FactorNode{0, StringFactor, newString(0, "ls", "ls"), 2}),
 		newTermList(3),
 		newTerm(3),
-		&FactorNode{3, VariableFactor, newString(4, "a", "a")}}},
+		&FactorNode{3, VariableFactor, newString(4, "a", "a"), 5}}},
 }
 
 func TestComplete(t *testing.T) {
@@ -71,3 +92,102 @@ func TestComplete(t *testing.T) {
 		}
 	}
 }
+
+var tolerantTests = []struct {
+	in     string
+	wanted Node
+	errors string
+}{
+	{"ls `a", newChunk( // chunk
+		0, newPipeline( // pipeline
+			0, &FormNode{ // form
+				0, newTerm( // term
+					0, &FactorNode{ // factor
+						0, StringFactor, newString(0, "ls", "ls"), 2}),
+				newTermList(3, newTerm( // term list
+					3, &FactorNode{ // factor
+						3, StringFactor, newString(3, "`a", "a"), 5})),
+				nil, ""})),
+		"<test 0>:0:3 unterminated string"},
+	{"ls {", newChunk( // chunk
+		0, newPipeline( // pipeline
+			0, &FormNode{ // form
+				0, newTerm( // term
+					0, &FactorNode{ // factor
+						0, StringFactor, newString(0, "ls", "ls"), 2}),
+				newTermList(3, newTerm( // term list
+					3, &FactorNode{ // factor
+						3, ClosureFactor, &ClosureNode{Pos: 4, Chunk: newChunk(4)}, 4})),
+				nil, ""})),
+		"<test 1>:0:4 unexpected eof in end of closure"},
+	{"ls ) a", newChunk( // chunk
+		0, newPipeline( // pipeline
+			0, &FormNode{ // form
+				0, newTerm( // term
+					0, &FactorNode{ // factor
+						0, StringFactor, newString(0, "ls", "ls"), 2}),
+				newTermList(3), nil, ""})),
+		"<test 2>:0:3 unexpected \")\" in end of script"},
+}
+
+func TestParseTolerant(t *testing.T) {
+	for i, tt := range tolerantTests {
+		out, errs := ParseTolerant(fmt.Sprintf("<test %d>", i), tt.in)
+		if !reflect.DeepEqual(out, tt.wanted) || errs.Error() != tt.errors {
+			t.Errorf("ParseTolerant(*, %q) =>\n(%s, %q), want\n(%s, %q) (up to DeepEqual)", tt.in, util.DeepPrint(out), errs, util.DeepPrint(tt.wanted), tt.errors)
+		}
+	}
+	// Errors that don't stop the parsing are all reported.
+	_, errs := ParseTolerant("<test>", `echo "${" >[x]f; ls [a`)
+	if len(errs) != 3 {
+		t.Errorf("ParseTolerant found %d errors, want 3: %v", len(errs), errs)
+	}
+}
+
+func TestParseEmbedded(t *testing.T) {
+	doc := "Example:\n```elvish\necho $x\nls [a\n```\n"
+	start := strings.Index(doc, "echo")
+	end := strings.LastIndex(doc, "```")
+	out, errs := ParseEmbedded("<doc>", doc, start, end)
+	if out == nil || len(out.Nodes) != 2 {
+		t.Fatalf("ParseEmbedded(*, %q, %d, %d) => %s", doc, start, end, util.DeepPrint(out))
+	}
+	arg := out.Nodes[0].Nodes[0].Args.Nodes[0]
+	if want := Pos(strings.Index(doc, "$x")); arg.Pos != want {
+		t.Errorf("argument at %d, want %d", arg.Pos, want)
+	}
+	if got, want := errs.Error(), `<doc>:3:5 unexpected "\n" in table literal`; got != want {
+		t.Errorf("ParseEmbedded(*, %q, %d, %d) => errors %q, want %q", doc, start, end, got, want)
+	}
+
+	ctx, err := CompleteEmbedded("<doc>", doc, start, start+len("echo $x\nls"))
+	if err != nil {
+		t.Fatalf("CompleteEmbedded => error %v", err)
+	}
+	if want := Pos(strings.Index(doc, "ls")); ctx.Typ != CommandContext || ctx.ThisFactor.Pos != want {
+		t.Errorf("CompleteEmbedded => context %d at %d, want command context at %d", ctx.Typ, ctx.ThisFactor.Pos, want)
+	}
+}
+
+var incompleteTests = []struct {
+	in         string
+	incomplete bool
+}{
+	{"ls {", true},
+	{"ls |", true},
+	{"ls |\n", true},
+	{"echo `a", true},
+	{`echo "a$x`, true},
+	{"echo \"a\nb\"", false},
+	{"ls }", false},
+	{"ls {\nput a\n}", false},
+}
+
+func TestIsIncomplete(t *testing.T) {
+	for _, tt := range incompleteTests {
+		_, err := Parse("<test>", tt.in)
+		if IsIncomplete(err) != tt.incomplete {
+			t.Errorf("Parse(*, %q) => error %v, want incomplete = %v", tt.in, err, tt.incomplete)
+		}
+	}
+}
@@ -5,19 +5,31 @@ package parse
 type Redir interface {
 	Node
 	Fd() uintptr
+	// Leader returns the source of the redirection leader, like >>[2].
+	Leader() string
 	// ensure only structs in this package can satisfy this interface
 	unexported()
+	setLeader(string)
 }
 
 type redir struct {
 	Pos
-	fd uintptr
+	fd     uintptr
+	leader string
 }
 
 func (r *redir) Fd() uintptr {
 	return r.fd
 }
 
+func (r *redir) Leader() string {
+	return r.leader
+}
+
+func (r *redir) setLeader(leader string) {
+	r.leader = leader
+}
+
 func (r *redir) unexported() {
 }
 
@@ -30,7 +42,7 @@ type FdRedir struct {
 // NewFdRedir creates a new FdRedir. Public since we need to turn FilenameRedir
 // -> FdRedir when evaluating commands.
 func NewFdRedir(pos Pos, fd, oldFd uintptr) *FdRedir {
-	return &FdRedir{redir{pos, fd}, oldFd}
+	return &FdRedir{redir{pos, fd, ""}, oldFd}
 }
 
 func (fr *FdRedir) isNode() {}
@@ -41,7 +53,7 @@ type CloseRedir struct {
 }
 
 func newCloseRedir(pos Pos, fd uintptr) *CloseRedir {
-	return &CloseRedir{redir{pos, fd}}
+	return &CloseRedir{redir{pos, fd, ""}}
 }
 
 func (cr *CloseRedir) isNode() {}
@@ -51,10 +63,28 @@ type FilenameRedir struct {
 	redir
 	Flag     int
 	Filename *TermNode
+	Clobber  bool // Whether the file is to be overwritten regardless, like >|a.txt
 }
 
-func newFilenameRedir(pos Pos, fd uintptr, flag int, filename *TermNode) *FilenameRedir {
-	return &FilenameRedir{redir{pos, fd}, flag, filename}
+func newFilenameRedir(pos Pos, fd uintptr, flag int, filename *TermNode, clobber bool) *FilenameRedir {
+	return &FilenameRedir{redir{pos, fd, ""}, flag, filename, clobber}
 }
 
 func (fr *FilenameRedir) isNode() {}
+
+// HereRedir represents feeding text to fd 0, from a here-document like <<EOF
+// or a here-string like <<<$x.
+type HereRedir struct {
+	redir
+	Text    *TermNode
+	Newline bool // Whether a newline is to be added, for here-strings
+	// Body is the source of the body of a here-document, with the terminator
+	// line. It is empty for a here-string.
+	Body string
+}
+
+func newHereRedir(pos Pos, text *TermNode, newline bool) *HereRedir {
+	return &HereRedir{redir{pos, 0, ""}, text, newline, ""}
+}
+
+func (hr *HereRedir) isNode() {}
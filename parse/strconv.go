@@ -1,7 +1,11 @@
 package parse
 
 import (
+	"fmt"
 	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 // Atou is basically shorthand for strconv.ParseUint(s, 10, 0) but returns the
@@ -10,3 +14,151 @@ func Atou(s string) (uintptr, error) {
 	u, err := strconv.ParseUint(s, 10, 0)
 	return uintptr(u), err
 }
+
+// dedent implements the indented form of raw strings, which start with a
+// newline right after the opening quotes. It removes the whitespace prefix
+// common to all non-blank lines, and turns the last line into an empty one if
+// it consists only of whitespace, so that
+//
+//	"""
+//	    a
+//	      b
+//	    """
+//
+// is "a\n  b\n".
+func dedent(s string) string {
+	lines := strings.Split(s, "\n")
+	prefix := ""
+	first := true
+	for _, line := range lines {
+		if strings.TrimLeft(line, " \t") == "" {
+			continue
+		}
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if first {
+			prefix, first = indent, false
+			continue
+		}
+		for !strings.HasPrefix(indent, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	for i, line := range lines {
+		if strings.TrimLeft(line, " \t") == "" {
+			lines[i] = ""
+		} else {
+			lines[i] = line[len(prefix):]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// escapeError is an error caused by a bad escape sequence in a double-quoted
+// string. offset is the position of the backslash within the literal.
+type escapeError struct {
+	offset int
+	msg    string
+}
+
+func (e *escapeError) Error() string {
+	return e.msg
+}
+
+var simpleEscapes = map[byte]byte{
+	'a': '\a', 'b': '\b', 'e': '\x1b', 'f': '\f', 'n': '\n', 'r': '\r',
+	't': '\t', 'v': '\v', '\\': '\\', '"': '"', '$': '$',
+}
+
+// unquoteDouble unquotes a double-quoted string literal, including the
+// quotes. Apart from the simple escapes like \n, \t and \$, it supports \xNN for
+// a byte, \NNN for a byte in octal, and \uNNNN, \UNNNNNNNN and \u{N...} for
+// a Unicode codepoint.
+func unquoteDouble(s string) (string, error) {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return "", &escapeError{0, "unterminated string"}
+	}
+	buf := make([]byte, 0, len(s)-2)
+	for i := 1; i < len(s)-1; i++ {
+		if s[i] != '\\' {
+			buf = append(buf, s[i])
+			continue
+		}
+		start := i
+		bad := func(format string, args ...interface{}) error {
+			return &escapeError{start, fmt.Sprintf(format, args...)}
+		}
+		// hex parses n hex digits after the escape letter.
+		hex := func(n int) (uint64, error) {
+			if i+1+n > len(s)-1 {
+				return 0, bad("escape sequence %s too short", s[start:len(s)-1])
+			}
+			x, err := strconv.ParseUint(s[i+1:i+1+n], 16, 32)
+			if err != nil {
+				return 0, bad("bad escape sequence %s", s[start:i+1+n])
+			}
+			i += n
+			return x, nil
+		}
+
+		i++
+		if i == len(s)-1 {
+			return "", bad("unterminated escape sequence")
+		}
+		c := s[i]
+		if r, ok := simpleEscapes[c]; ok {
+			buf = append(buf, r)
+			continue
+		}
+		switch {
+		case c == 'x':
+			x, err := hex(2)
+			if err != nil {
+				return "", err
+			}
+			buf = append(buf, byte(x))
+		case '0' <= c && c <= '7':
+			if i+3 > len(s)-1 {
+				return "", bad("escape sequence %s too short", s[start:len(s)-1])
+			}
+			x, err := strconv.ParseUint(s[i:i+3], 8, 8)
+			if err != nil {
+				return "", bad("bad escape sequence %s", s[start:i+3])
+			}
+			i += 2
+			buf = append(buf, byte(x))
+		case c == 'u' || c == 'U':
+			var x uint64
+			var err error
+			if c == 'u' && s[i+1] == '{' {
+				end := strings.IndexByte(s[i:len(s)-1], '}')
+				if end == -1 {
+					return "", bad("unterminated escape sequence %s", s[start:len(s)-1])
+				}
+				digits := s[i+2 : i+end]
+				if len(digits) == 0 || len(digits) > 6 {
+					return "", bad("bad escape sequence %s", s[start:i+end+1])
+				}
+				x, err = strconv.ParseUint(digits, 16, 32)
+				if err != nil {
+					return "", bad("bad escape sequence %s", s[start:i+end+1])
+				}
+				i += end
+			} else if c == 'u' {
+				x, err = hex(4)
+			} else {
+				x, err = hex(8)
+			}
+			if err != nil {
+				return "", err
+			}
+			if x > unicode.MaxRune || (0xd800 <= x && x < 0xe000) {
+				return "", bad("invalid codepoint in %s", s[start:i+1])
+			}
+			var enc [utf8.UTFMax]byte
+			buf = append(buf, enc[:utf8.EncodeRune(enc[:], rune(x))]...)
+		default:
+			return "", bad("unknown escape sequence \\%c", c)
+		}
+	}
+	return string(buf), nil
+}
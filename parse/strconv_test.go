@@ -47,3 +47,57 @@ func TestAtouError(t *testing.T) {
 		}
 	}
 }
+
+var dedentTests = []struct {
+	in     string
+	wanted string
+}{
+	{"a\nb", "a\nb"},
+	{"    a\n      b\n    ", "a\n  b\n"},
+	{"\ta\n\n\t\tb", "a\n\n\tb"},
+	{"  a\n b", " a\nb"},
+}
+
+func TestDedent(t *testing.T) {
+	for _, tt := range dedentTests {
+		if out := dedent(tt.in); out != tt.wanted {
+			t.Errorf("dedent(%q) => %q, want %q", tt.in, out, tt.wanted)
+		}
+	}
+}
+
+var unquoteDoubleTests = []struct {
+	in     string
+	wanted string
+}{
+	{`"a\tb\n"`, "a\tb\n"},
+	{`"\e[31m\x41\101"`, "\x1b[31mAA"},
+	{`"é\U0001F600\u{1F600}\u{41}"`, "é😀😀A"},
+	{`"\xff"`, "\xff"},
+}
+
+var unquoteDoubleErrorTests = []struct {
+	in     string
+	offset int
+}{
+	{`"ab\q"`, 3},
+	{`"\x4"`, 1},
+	{`"a\u{110000}"`, 2},
+	{`"a\u{41"`, 2},
+	{`"\ud800"`, 1},
+}
+
+func TestUnquoteDouble(t *testing.T) {
+	for _, tt := range unquoteDoubleTests {
+		out, err := unquoteDouble(tt.in)
+		if out != tt.wanted || err != nil {
+			t.Errorf("unquoteDouble(%q) => (%q, %v), want (%q, nil)", tt.in, out, err, tt.wanted)
+		}
+	}
+	for _, tt := range unquoteDoubleErrorTests {
+		_, err := unquoteDouble(tt.in)
+		if ee, ok := err.(*escapeError); !ok || ee.offset != tt.offset {
+			t.Errorf("unquoteDouble(%q) => error %v, want error at %d", tt.in, err, tt.offset)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+// +build cgo
+// +build linux darwin freebsd
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"plugin"
+)
+
+// loadPlugins opens each Go plugin (*.so) in dir. A plugin adds its builtins
+// by calling eval.RegisterModule from its init function, which is run when
+// the plugin is opened.
+func loadPlugins(dir string) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.so"))
+	if err != nil {
+		return
+	}
+	for _, path := range paths {
+		if _, err := plugin.Open(path); err != nil {
+			fmt.Fprintln(os.Stderr, "Cannot load plugin:", err)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+// +build !cgo !linux,!darwin,!freebsd
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// loadPlugins complains about plugins in dir, since Go plugins are not
+// supported in this build. Modules can still be linked into elvish, and
+// register themselves with eval.RegisterModule.
+func loadPlugins(dir string) {
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.so"))
+	if len(paths) > 0 {
+		fmt.Fprintln(os.Stderr, "Plugins are not supported in this build, not loading", dir)
+	}
+}
@@ -0,0 +1,68 @@
+package service
+
+import (
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Frecency returns a score of a directory combining how often and how
+// recently it was visited, like z does: the number of visits is weighted by
+// the time since the last visit.
+func Frecency(v DirVisit, now time.Time) float64 {
+	age := now.Sub(time.Unix(v.LastVisit, 0))
+	weight := 0.25
+	switch {
+	case age < time.Hour:
+		weight = 4
+	case age < 24*time.Hour:
+		weight = 2
+	case age < 7*24*time.Hour:
+		weight = 0.5
+	}
+	return float64(v.Visits) * weight
+}
+
+// matchDir reports whether all words of the pattern appear in path in order.
+// A word without upper case letters matches case-insensitively.
+func matchDir(path string, words []string) bool {
+	lower := strings.ToLower(path)
+	for _, word := range words {
+		p := path
+		if strings.IndexFunc(word, unicode.IsUpper) == -1 {
+			p = lower
+		}
+		i := strings.Index(p, word)
+		if i == -1 {
+			return false
+		}
+		path, lower = path[i+len(word):], lower[i+len(word):]
+	}
+	return true
+}
+
+// MatchDirs returns the paths of visited directories matching the pattern,
+// which consists of space-separated words, with the highest frecency first.
+// An empty pattern matches all directories.
+func MatchDirs(visits []DirVisit, pattern string, now time.Time) []string {
+	words := strings.Fields(pattern)
+	var matched []DirVisit
+	for _, v := range visits {
+		if matchDir(v.Path, words) {
+			matched = append(matched, v)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		fi, fj := Frecency(matched[i], now), Frecency(matched[j], now)
+		if fi != fj {
+			return fi > fj
+		}
+		return matched[i].Path < matched[j].Path
+	})
+	paths := make([]string, len(matched))
+	for i, v := range matched {
+		paths[i] = v.Path
+	}
+	return paths
+}
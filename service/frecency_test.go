@@ -0,0 +1,37 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+var now = time.Unix(1000000, 0)
+
+var visits = []DirVisit{
+	{"/home/me/src/elvish", 10, now.Unix() - 30*24*3600}, // 2.5
+	{"/home/me/src/go", 3, now.Unix() - 60},              // 12
+	{"/home/me/Documents", 2, now.Unix() - 3600*3},       // 4
+	{"/tmp", 1, now.Unix() - 10},                         // 4
+}
+
+var matchDirsTests = []struct {
+	pattern string
+	wanted  []string
+}{
+	{"", []string{"/home/me/src/go", "/home/me/Documents", "/tmp", "/home/me/src/elvish"}},
+	{"src", []string{"/home/me/src/go", "/home/me/src/elvish"}},
+	{"me elv", []string{"/home/me/src/elvish"}},
+	{"elv me", []string{}},
+	{"doc", []string{"/home/me/Documents"}},
+	{"Doc", []string{"/home/me/Documents"}},
+	{"DOC", []string{}},
+}
+
+func TestMatchDirs(t *testing.T) {
+	for _, tt := range matchDirsTests {
+		if out := MatchDirs(visits, tt.pattern, now); !reflect.DeepEqual(out, tt.wanted) {
+			t.Errorf("MatchDirs(visits, %q, now) => %v, want %v", tt.pattern, out, tt.wanted)
+		}
+	}
+}
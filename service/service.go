@@ -1,25 +1,82 @@
 // Package service implements server and client for the elvishd service.
+//
+// Clients talk to elvishd over a Unix socket with JSON-RPC 1.0 as implemented
+// by net/rpc/jsonrpc, which is a line protocol: each request and each
+// response is a JSON object on a line of its own, like
+//
+// {"method":"Elvishd.AddDirVisit","params":["/tmp"],"id":1}
+// {"id":1,"result":{},"error":null}
+//
+// so that elvishd can also be used from other programs.
 package service
 
 import (
 	"errors"
+	"io"
+	"math"
 	"net"
 	"net/rpc"
+	"net/rpc/jsonrpc"
+	"regexp"
+	"sync"
+	"time"
 
 	"github.com/coopernurse/gorp"
 )
 
 const (
-	Version = "0"
+	Version = "7"
+)
+
+// Kinds of events.
+const (
+	UniVarChanged = "univar-changed"
+)
+
+const (
+	// maxEvents is the number of recent events kept for WaitEvents.
+	maxEvents = 1024
+	// waitEventsTimeout is how long WaitEvents waits for an event, so that
+	// the requests of clients that have gone away don't pile up.
+	waitEventsTimeout = time.Minute
+)
+
+// Limits of the store. Keys and values are counted in bytes.
+const (
+	MaxStoreKey   = 256
+	MaxStoreValue = 64 << 10
+	MaxStoreTotal = 1 << 20
 )
 
 var (
-	VersionMismatch = errors.New("version mismatch")
-	UniVarNotFound  = errors.New("universal variable not found")
+	VersionMismatch    = errors.New("version mismatch")
+	UniVarNotFound     = errors.New("universal variable not found")
+	StoreKeyNotFound   = errors.New("store key not found")
+	BadStoreKey        = errors.New("bad store key")
+	StoreQuotaExceeded = errors.New("store quota exceeded")
+	DaemonNotFound     = errors.New("elvishd not found")
 )
 
+// Elvishd owns the database. Since requests from different connections are
+// served concurrently, all database accesses are serialized with mutex.
 type Elvishd struct {
+	mutex sync.Mutex
 	dbmap *gorp.DbMap
+	// The event bus, also protected by mutex. changed is closed and replaced
+	// whenever an event is published.
+	events  []Event
+	lastSeq int64
+	changed chan struct{}
+	// Serves the connections passed to ServeConn.
+	server *rpc.Server
+}
+
+// Event notifies clients of a change, like a universal variable being set.
+// Seq increases with each event.
+type Event struct {
+	Seq  int64
+	Kind string
+	Name string
 }
 
 type UniVar struct {
@@ -27,20 +84,128 @@ type UniVar struct {
 	Value string // TODO(xiaq): support arbitrary elvish value
 }
 
-// Serve starts the RPC server on listener. Serve blocks.
-func Serve(listener net.Listener, dbmap *gorp.DbMap) error {
+// HistoryEntry is a command line in the history. Seq increases with each
+// entry added, from whichever elvish process.
+type HistoryEntry struct {
+	Seq  int64
+	Line string
+}
+
+// HistoryAddition is a command line to add to the history, by the elvish
+// session with the ID Session, with the policies that decide whether it is
+// added and how many entries are kept. A MaxSize of 0 means no limit.
+type HistoryAddition struct {
+	Line        string
+	Session     int64
+	IgnoreSpace bool
+	IgnoreDups  bool
+	MaxSize     int64
+}
+
+// HistorySession records which session added the command line with sequence
+// number Seq, so that sessions can see the entries added by others as they
+// come.
+type HistorySession struct {
+	Seq     int64
+	Session int64
+}
+
+// HistoryQuery asks for the history entries whose sequence numbers are not
+// smaller than From, and that were not added by the session Except.
+type HistoryQuery struct {
+	From   int64
+	Except int64
+}
+
+// HistoryDuration records how long the command line with sequence number Seq
+// took to run. It is kept apart from the history, since it is only known
+// after the command line has been added.
+type HistoryDuration struct {
+	Seq         int64
+	Nanoseconds int64
+}
+
+// DirVisit records how many times a directory has been visited, and when it
+// was last visited, in seconds since the Unix epoch.
+type DirVisit struct {
+	Path      string
+	Visits    int64
+	LastVisit int64
+}
+
+// StoreEntry is a key-value pair kept for scripts. The store is separate from
+// the universal variables, so that scripts can't clobber them.
+type StoreEntry struct {
+	Key   string
+	Value string
+}
+
+// NewElvishd creates an Elvishd with the database of dbmap, creating the
+// tables it needs.
+func NewElvishd(dbmap *gorp.DbMap) (*Elvishd, error) {
 	dbmap.AddTable(UniVar{}).SetKeys(false, "Name")
+	dbmap.AddTableWithName(HistoryEntry{}, "history").SetKeys(true, "Seq")
+	dbmap.AddTableWithName(HistoryDuration{}, "history_duration").SetKeys(false, "Seq")
+	dbmap.AddTableWithName(HistorySession{}, "history_session").SetKeys(false, "Seq")
+	dbmap.AddTableWithName(DirVisit{}, "dir_visit").SetKeys(false, "Path")
+	dbmap.AddTableWithName(StoreEntry{}, "store").SetKeys(false, "Key")
 	err := dbmap.CreateTablesIfNotExists()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	err = migrate(dbmap)
+	if err != nil {
+		return nil, err
 	}
+	e := &Elvishd{dbmap: dbmap, changed: make(chan struct{}), server: rpc.NewServer()}
+	e.server.Register(e)
+	return e, nil
+}
+
+// addedColumns are the columns added to tables after they were first
+// created, with their SQL types. CreateTablesIfNotExists leaves existing
+// tables as they are, so migrate adds them to databases that lack them.
+var addedColumns = []struct{ table, column, typ string }{
+	{"dir_visit", "LastVisit", "integer not null default 0"},
+}
 
-	server := &Elvishd{dbmap}
-	rpc.Register(server)
-	rpc.Accept(listener)
+// migrate brings the tables of an existing database up to date.
+func migrate(dbmap *gorp.DbMap) error {
+	for _, c := range addedColumns {
+		_, err := dbmap.Exec("select " + c.column + " from " + c.table + " limit 0")
+		if err == nil {
+			continue
+		}
+		_, err = dbmap.Exec("alter table " + c.table + " add column " + c.column + " " + c.typ)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// Serve starts the RPC server on listener. Serve blocks until listener fails
+// to accept a connection.
+func Serve(listener net.Listener, dbmap *gorp.DbMap) error {
+	e, err := NewElvishd(dbmap)
+	if err != nil {
+		return err
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go e.ServeConn(conn)
+	}
+}
+
+// ServeConn serves the requests of a client on conn until the client hangs
+// up.
+func (e *Elvishd) ServeConn(conn io.ReadWriteCloser) {
+	e.server.ServeCodec(jsonrpc.NewServerCodec(conn))
+}
+
 // Version replies with a string that identify the RPC version.
 func (e *Elvishd) Version(arg struct{}, reply *string) error {
 	*reply = Version
@@ -58,6 +223,8 @@ func (e *Elvishd) Echo(arg string, reply *string) error {
 // arg. If the named variable does not exist or there is a database error, an
 // error is returned instead.
 func (e *Elvishd) GetUniVar(arg string, reply *string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
 	univar, err := e.dbmap.Get(UniVar{}, arg)
 	if err != nil {
 		return err
@@ -70,18 +237,355 @@ func (e *Elvishd) GetUniVar(arg string, reply *string) error {
 }
 
 // SetUniVar sets the universal variable to the given value. It is created if
-// nonexistent. If there is a database error, an error is returned.
+// nonexistent. If there is a database error, an error is returned. Clients
+// waiting for events are notified.
 func (e *Elvishd) SetUniVar(arg *UniVar, reply *struct{}) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
 	current, err := e.dbmap.Get(UniVar{}, arg.Name)
 	if err != nil {
 		return err
 	}
 	if current == nil {
-		return e.dbmap.Insert(arg)
+		err = e.dbmap.Insert(arg)
 	} else {
 		_, err = e.dbmap.Update(arg)
+	}
+	if err != nil {
+		return err
+	}
+	e.publish(UniVarChanged, arg.Name)
+	return nil
+}
+
+// UniVars replies with all universal variables.
+func (e *Elvishd) UniVars(arg struct{}, reply *[]UniVar) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	rows, err := e.dbmap.Select(UniVar{}, "select * from UniVar order by Name")
+	if err != nil {
+		return err
+	}
+	vars := make([]UniVar, len(rows))
+	for i, row := range rows {
+		vars[i] = *row.(*UniVar)
+	}
+	*reply = vars
+	return nil
+}
+
+// publish adds an event to the bus. It must be called with mutex held.
+func (e *Elvishd) publish(kind, name string) {
+	e.lastSeq++
+	e.events = append(e.events, Event{e.lastSeq, kind, name})
+	if len(e.events) > maxEvents {
+		e.events = e.events[len(e.events)-maxEvents:]
+	}
+	close(e.changed)
+	e.changed = make(chan struct{})
+}
+
+// LastEventSeq replies with the sequence number of the last event, from which
+// a client can start waiting for events.
+func (e *Elvishd) LastEventSeq(arg struct{}, reply *int64) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	*reply = e.lastSeq
+	return nil
+}
+
+// WaitEvents replies with the recent events whose sequence numbers are larger
+// than arg, oldest first. If there are none, it waits for one, and replies
+// with no events if none comes in a while.
+func (e *Elvishd) WaitEvents(arg int64, reply *[]Event) error {
+	e.mutex.Lock()
+	if e.lastSeq <= arg {
+		changed := e.changed
+		e.mutex.Unlock()
+		select {
+		case <-changed:
+		case <-time.After(waitEventsTimeout):
+		}
+		e.mutex.Lock()
+	}
+	defer e.mutex.Unlock()
+	var events []Event
+	for _, ev := range e.events {
+		if ev.Seq > arg {
+			events = append(events, ev)
+		}
+	}
+	*reply = events
+	return nil
+}
+
+// AddHistory adds a command line to the history and replies with its
+// sequence number, or 0 if the policies leave it out. When the history grows
+// larger than MaxSize, the oldest entries are pruned.
+func (e *Elvishd) AddHistory(arg *HistoryAddition, reply *int64) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	*reply = 0
+	if arg.Line == "" || arg.IgnoreSpace && arg.Line[0] == ' ' {
+		return nil
+	}
+	if arg.IgnoreDups {
+		last, err := e.dbmap.SelectStr("select Line from history order by Seq desc limit 1")
+		if err != nil {
+			return err
+		}
+		if last == arg.Line {
+			return nil
+		}
+	}
+	entry := &HistoryEntry{Line: arg.Line}
+	if err := e.dbmap.Insert(entry); err != nil {
+		return err
+	}
+	if err := e.dbmap.Insert(&HistorySession{entry.Seq, arg.Session}); err != nil {
+		return err
+	}
+	if arg.MaxSize > 0 {
+		if _, err := e.pruneHistory(arg.MaxSize); err != nil {
+			return err
+		}
+	}
+	*reply = entry.Seq
+	return nil
+}
+
+// OthersHistory replies with the history entries matching the query, oldest
+// first. Entries added before sessions were recorded are counted as those of
+// others.
+func (e *Elvishd) OthersHistory(arg *HistoryQuery, reply *[]HistoryEntry) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	rows, err := e.dbmap.Select(HistoryEntry{},
+		"select history.* from history left join history_session using (Seq) "+
+			"where Seq >= ? and (Session is null or Session != ?) order by Seq",
+		arg.From, arg.Except)
+	if err != nil {
+		return err
+	}
+	entries := make([]HistoryEntry, len(rows))
+	for i, row := range rows {
+		entries[i] = *row.(*HistoryEntry)
+	}
+	*reply = entries
+	return nil
+}
+
+// DelHistory deletes the history entries matching the regular expression arg,
+// and replies with how many there were.
+func (e *Elvishd) DelHistory(arg string, reply *int64) error {
+	pattern, err := regexp.Compile(arg)
+	if err != nil {
+		return err
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	rows, err := e.dbmap.Select(HistoryEntry{}, "select * from history")
+	if err != nil {
+		return err
+	}
+	*reply = 0
+	for _, row := range rows {
+		entry := row.(*HistoryEntry)
+		if !pattern.MatchString(entry.Line) {
+			continue
+		}
+		for _, table := range historyTables {
+			if _, err := e.dbmap.Exec("delete from "+table+" where Seq = ?", entry.Seq); err != nil {
+				return err
+			}
+		}
+		*reply++
+	}
+	return nil
+}
+
+// PruneHistory deletes all but the newest arg history entries, and replies
+// with how many were deleted.
+func (e *Elvishd) PruneHistory(arg int64, reply *int64) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	n, err := e.pruneHistory(arg)
+	*reply = n
+	return err
+}
+
+// historyTables are the tables with rows for history entries, keyed by Seq.
+var historyTables = []string{"history", "history_duration", "history_session"}
+
+// pruneHistory deletes all but the newest max history entries, and returns
+// how many were deleted. It must be called with mutex held.
+func (e *Elvishd) pruneHistory(max int64) (int64, error) {
+	// Entries older than the oldest one kept are deleted, which are all of
+	// them when none are kept.
+	oldest := int64(math.MaxInt64)
+	if max > 0 {
+		var err error
+		oldest, err = e.dbmap.SelectInt(
+			"select coalesce(min(Seq), 0) from (select Seq from history order by Seq desc limit ?)", max)
+		if err != nil {
+			return 0, err
+		}
+	}
+	var deleted int64
+	for _, table := range historyTables {
+		result, err := e.dbmap.Exec("delete from "+table+" where Seq < ?", oldest)
+		if err != nil {
+			return deleted, err
+		}
+		if table == "history" {
+			deleted, _ = result.RowsAffected()
+		}
+	}
+	return deleted, nil
+}
+
+// History replies with all history entries whose sequence numbers are not
+// smaller than arg, oldest first.
+func (e *Elvishd) History(arg int64, reply *[]HistoryEntry) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	rows, err := e.dbmap.Select(HistoryEntry{},
+		"select * from history where Seq >= ? order by Seq", arg)
+	if err != nil {
 		return err
 	}
+	entries := make([]HistoryEntry, len(rows))
+	for i, row := range rows {
+		entries[i] = *row.(*HistoryEntry)
+	}
+	*reply = entries
+	return nil
+}
+
+// SetHistoryDuration records how long a command line in the history took to
+// run.
+func (e *Elvishd) SetHistoryDuration(arg *HistoryDuration, reply *struct{}) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	current, err := e.dbmap.Get(HistoryDuration{}, arg.Seq)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return e.dbmap.Insert(arg)
+	}
+	_, err = e.dbmap.Update(arg)
+	return err
+}
+
+// HistoryDurations replies with the durations of all command lines whose
+// durations are known, oldest first.
+func (e *Elvishd) HistoryDurations(arg struct{}, reply *[]HistoryDuration) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	rows, err := e.dbmap.Select(HistoryDuration{},
+		"select * from history_duration order by Seq")
+	if err != nil {
+		return err
+	}
+	durations := make([]HistoryDuration, len(rows))
+	for i, row := range rows {
+		durations[i] = *row.(*HistoryDuration)
+	}
+	*reply = durations
+	return nil
+}
+
+// AddDirVisit records a visit to the directory arg.
+func (e *Elvishd) AddDirVisit(arg string, reply *struct{}) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	current, err := e.dbmap.Get(DirVisit{}, arg)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	if current == nil {
+		return e.dbmap.Insert(&DirVisit{arg, 1, now})
+	}
+	visit := current.(*DirVisit)
+	visit.Visits++
+	visit.LastVisit = now
+	_, err = e.dbmap.Update(visit)
+	return err
+}
+
+// DirVisits replies with all visited directories, the most visited first.
+// See MatchDirs for ranking them by frecency.
+func (e *Elvishd) DirVisits(arg struct{}, reply *[]DirVisit) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	rows, err := e.dbmap.Select(DirVisit{},
+		"select * from dir_visit order by Visits desc, Path")
+	if err != nil {
+		return err
+	}
+	visits := make([]DirVisit, len(rows))
+	for i, row := range rows {
+		visits[i] = *row.(*DirVisit)
+	}
+	*reply = visits
+	return nil
+}
+
+// GetStore replies with the value of the store entry with the key arg.
+func (e *Elvishd) GetStore(arg string, reply *string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	entry, err := e.dbmap.Get(StoreEntry{}, arg)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return StoreKeyNotFound
+	}
+	*reply = entry.(*StoreEntry).Value
+	return nil
+}
+
+// SetStore sets a store entry, creating it if nonexistent. It fails if the
+// key is empty or too long, or if the value would make the entry or the whole
+// store too large.
+func (e *Elvishd) SetStore(arg *StoreEntry, reply *struct{}) error {
+	if arg.Key == "" || len(arg.Key) > MaxStoreKey {
+		return BadStoreKey
+	}
+	if len(arg.Value) > MaxStoreValue {
+		return StoreQuotaExceeded
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	others, err := e.dbmap.SelectInt(
+		"select coalesce(sum(length(cast(Key as blob)) + length(cast(Value as blob))), 0) from store where Key != ?",
+		arg.Key)
+	if err != nil {
+		return err
+	}
+	if others+int64(len(arg.Key)+len(arg.Value)) > MaxStoreTotal {
+		return StoreQuotaExceeded
+	}
+	current, err := e.dbmap.Get(StoreEntry{}, arg.Key)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return e.dbmap.Insert(arg)
+	}
+	_, err = e.dbmap.Update(arg)
+	return err
+}
+
+// DelStore deletes the store entry with the key arg, if it exists.
+func (e *Elvishd) DelStore(arg string, reply *struct{}) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	_, err := e.dbmap.Delete(&StoreEntry{Key: arg})
+	return err
 }
 
 // Client wraps rpc.Client with type-safe wrappers.
@@ -91,19 +595,31 @@ type Client struct {
 
 // Dial establishes RPC connection and check for version mismatch.
 func Dial(network, address string) (Client, error) {
-	rc, err := rpc.Dial(network, address)
+	conn, err := net.Dial(network, address)
 	if err != nil {
 		return Client{}, err
 	}
-	c := Client{rc}
+	return NewClient(conn)
+}
+
+// NewClient makes a Client talking to elvishd over conn, checking for
+// version mismatch.
+func NewClient(conn io.ReadWriteCloser) (Client, error) {
+	c := Client{jsonrpc.NewClient(conn)}
 	var version string
 	c.Version(struct{}{}, &version)
 	if version != Version {
+		c.Close()
 		return Client{}, VersionMismatch
 	}
 	return c, nil
 }
 
+// Close closes the RPC connection.
+func (c Client) Close() error {
+	return c.rc.Close()
+}
+
 func (c Client) Version(arg struct{}, reply *string) error {
 	return c.rc.Call("Elvishd.Version", arg, reply)
 }
@@ -112,10 +628,82 @@ func (c Client) Echo(arg string, reply *string) error {
 	return c.rc.Call("Elvishd.Echo", arg, reply)
 }
 
+// GetUniVar returns UniVarNotFound itself when the variable doesn't exist,
+// like GetStore.
 func (c Client) GetUniVar(arg string, reply *string) error {
-	return c.rc.Call("Elvishd.GetUniVar", arg, reply)
+	err := c.rc.Call("Elvishd.GetUniVar", arg, reply)
+	if err != nil && err.Error() == UniVarNotFound.Error() {
+		return UniVarNotFound
+	}
+	return err
 }
 
 func (c Client) SetUniVar(arg *UniVar, reply *struct{}) error {
 	return c.rc.Call("Elvishd.SetUniVar", arg, reply)
 }
+
+func (c Client) UniVars(arg struct{}, reply *[]UniVar) error {
+	return c.rc.Call("Elvishd.UniVars", arg, reply)
+}
+
+func (c Client) LastEventSeq(arg struct{}, reply *int64) error {
+	return c.rc.Call("Elvishd.LastEventSeq", arg, reply)
+}
+
+func (c Client) WaitEvents(arg int64, reply *[]Event) error {
+	return c.rc.Call("Elvishd.WaitEvents", arg, reply)
+}
+
+func (c Client) AddHistory(arg *HistoryAddition, reply *int64) error {
+	return c.rc.Call("Elvishd.AddHistory", arg, reply)
+}
+
+func (c Client) OthersHistory(arg *HistoryQuery, reply *[]HistoryEntry) error {
+	return c.rc.Call("Elvishd.OthersHistory", arg, reply)
+}
+
+func (c Client) DelHistory(arg string, reply *int64) error {
+	return c.rc.Call("Elvishd.DelHistory", arg, reply)
+}
+
+func (c Client) PruneHistory(arg int64, reply *int64) error {
+	return c.rc.Call("Elvishd.PruneHistory", arg, reply)
+}
+
+func (c Client) History(arg int64, reply *[]HistoryEntry) error {
+	return c.rc.Call("Elvishd.History", arg, reply)
+}
+
+func (c Client) SetHistoryDuration(arg *HistoryDuration, reply *struct{}) error {
+	return c.rc.Call("Elvishd.SetHistoryDuration", arg, reply)
+}
+
+func (c Client) HistoryDurations(arg struct{}, reply *[]HistoryDuration) error {
+	return c.rc.Call("Elvishd.HistoryDurations", arg, reply)
+}
+
+func (c Client) AddDirVisit(arg string, reply *struct{}) error {
+	return c.rc.Call("Elvishd.AddDirVisit", arg, reply)
+}
+
+func (c Client) DirVisits(arg struct{}, reply *[]DirVisit) error {
+	return c.rc.Call("Elvishd.DirVisits", arg, reply)
+}
+
+// GetStore returns StoreKeyNotFound itself when the key doesn't exist, rather
+// than an error with the same message.
+func (c Client) GetStore(arg string, reply *string) error {
+	err := c.rc.Call("Elvishd.GetStore", arg, reply)
+	if err != nil && err.Error() == StoreKeyNotFound.Error() {
+		return StoreKeyNotFound
+	}
+	return err
+}
+
+func (c Client) SetStore(arg *StoreEntry, reply *struct{}) error {
+	return c.rc.Call("Elvishd.SetStore", arg, reply)
+}
+
+func (c Client) DelStore(arg string, reply *struct{}) error {
+	return c.rc.Call("Elvishd.DelStore", arg, reply)
+}
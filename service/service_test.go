@@ -0,0 +1,284 @@
+package service
+
+import (
+	"bufio"
+	"database/sql"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/coopernurse/gorp"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newTestElvishd returns an Elvishd with a new database, and a function
+// that cleans up.
+func newTestElvishd(t *testing.T) (*Elvishd, func()) {
+	dir, err := ioutil.TempDir("", "elvishd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", dir+"/elvishd.db")
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+	e, err := NewElvishd(&gorp.DbMap{Db: db, Dialect: gorp.SqliteDialect{}})
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return e, cleanup
+}
+
+// newTestClient returns a Client connected to a new Elvishd, and a function
+// that cleans up.
+func newTestClient(t *testing.T) (Client, func()) {
+	e, cleanup := newTestElvishd(t)
+	serverConn, clientConn := net.Pipe()
+	go e.ServeConn(serverConn)
+	c, err := NewClient(clientConn)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return c, func() {
+		c.Close()
+		cleanup()
+	}
+}
+
+func historyLines(t *testing.T, c Client, from int64) []string {
+	var entries []HistoryEntry
+	if err := c.History(from, &entries); err != nil {
+		t.Fatalf("History(%d) => %v", from, err)
+	}
+	lines := make([]string, len(entries))
+	for i, e := range entries {
+		lines[i] = e.Line
+	}
+	return lines
+}
+
+func TestHistory(t *testing.T) {
+	c, cleanup := newTestClient(t)
+	defer cleanup()
+
+	var seqs []int64
+	for _, add := range []HistoryAddition{
+		{Line: "echo a"},
+		{Line: "echo a", IgnoreDups: true},
+		{Line: " secret", IgnoreSpace: true},
+		{Line: "echo b"},
+		{Line: "echo c", MaxSize: 2},
+	} {
+		var seq int64
+		if err := c.AddHistory(&add, &seq); err != nil {
+			t.Fatalf("AddHistory(%q) => %v", add.Line, err)
+		}
+		seqs = append(seqs, seq)
+	}
+	if seqs[1] != 0 || seqs[2] != 0 {
+		t.Errorf("AddHistory of a duplicate and a line with a space => %v, want 0s", seqs[1:3])
+	}
+	if lines, want := historyLines(t, c, 0), []string{"echo b", "echo c"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("history is %q, want %q", lines, want)
+	}
+	if lines, want := historyLines(t, c, seqs[4]), []string{"echo c"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("history from %d is %q, want %q", seqs[4], lines, want)
+	}
+
+	d := &HistoryDuration{Seq: seqs[4], Nanoseconds: 42}
+	if err := c.SetHistoryDuration(d, &struct{}{}); err != nil {
+		t.Fatalf("SetHistoryDuration => %v", err)
+	}
+	var durations []HistoryDuration
+	if err := c.HistoryDurations(struct{}{}, &durations); err != nil {
+		t.Fatalf("HistoryDurations => %v", err)
+	}
+	if want := []HistoryDuration{*d}; !reflect.DeepEqual(durations, want) {
+		t.Errorf("durations are %v, want %v", durations, want)
+	}
+}
+
+func TestSharedHistory(t *testing.T) {
+	c, cleanup := newTestClient(t)
+	defer cleanup()
+
+	for _, add := range []HistoryAddition{
+		{Line: "echo 1", Session: 1},
+		{Line: "echo 2", Session: 2},
+		{Line: "rm -rf x", Session: 1},
+		{Line: "echo 3", Session: 2},
+	} {
+		var seq int64
+		if err := c.AddHistory(&add, &seq); err != nil {
+			t.Fatalf("AddHistory(%q) => %v", add.Line, err)
+		}
+	}
+	var entries []HistoryEntry
+	if err := c.OthersHistory(&HistoryQuery{From: 0, Except: 1}, &entries); err != nil {
+		t.Fatalf("OthersHistory => %v", err)
+	}
+	if len(entries) != 2 || entries[0].Line != "echo 2" || entries[1].Line != "echo 3" {
+		t.Errorf("history of others than session 1 is %v, want echo 2 and echo 3", entries)
+	}
+	if err := c.OthersHistory(&HistoryQuery{From: entries[1].Seq, Except: 1}, &entries); err != nil {
+		t.Fatalf("OthersHistory => %v", err)
+	}
+	if len(entries) != 1 || entries[0].Line != "echo 3" {
+		t.Errorf("newer history of others than session 1 is %v, want echo 3", entries)
+	}
+
+	var n int64
+	if err := c.DelHistory("^rm ", &n); err != nil || n != 1 {
+		t.Errorf("DelHistory(^rm ) => (%d, %v), want 1", n, err)
+	}
+	if err := c.DelHistory("(", &n); err == nil {
+		t.Errorf("DelHistory of a bad pattern => success, want failure")
+	}
+	if err := c.PruneHistory(2, &n); err != nil || n != 1 {
+		t.Errorf("PruneHistory(2) => (%d, %v), want 1", n, err)
+	}
+	if lines, want := historyLines(t, c, 0), []string{"echo 2", "echo 3"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("history is %q, want %q", lines, want)
+	}
+	if err := c.PruneHistory(0, &n); err != nil || n != 2 {
+		t.Errorf("PruneHistory(0) => (%d, %v), want 2", n, err)
+	}
+	if lines := historyLines(t, c, 0); len(lines) != 0 {
+		t.Errorf("history after pruning all is %q, want none", lines)
+	}
+}
+
+func TestDirVisits(t *testing.T) {
+	c, cleanup := newTestClient(t)
+	defer cleanup()
+
+	for _, dir := range []string{"/a", "/b", "/b"} {
+		if err := c.AddDirVisit(dir, &struct{}{}); err != nil {
+			t.Fatalf("AddDirVisit(%q) => %v", dir, err)
+		}
+	}
+	var visits []DirVisit
+	if err := c.DirVisits(struct{}{}, &visits); err != nil {
+		t.Fatalf("DirVisits => %v", err)
+	}
+	if len(visits) != 2 || visits[0].Path != "/b" || visits[0].Visits != 2 ||
+		visits[1].Path != "/a" || visits[1].Visits != 1 {
+		t.Errorf("visits are %v, want /b twice and /a once", visits)
+	}
+}
+
+func TestMigrateDirVisits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elvishd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := sql.Open("sqlite3", dir+"/elvishd.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// The table as created before LastVisit was added.
+	_, err = db.Exec(`create table dir_visit (Path varchar(255) not null primary key, Visits integer)`)
+	if err == nil {
+		_, err = db.Exec(`insert into dir_visit values ("/a", 3)`)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewElvishd(&gorp.DbMap{Db: db, Dialect: gorp.SqliteDialect{}})
+	if err != nil {
+		t.Fatalf("NewElvishd on an old database => %v", err)
+	}
+	if err := e.AddDirVisit("/a", &struct{}{}); err != nil {
+		t.Fatalf("AddDirVisit on an old database => %v", err)
+	}
+	var visits []DirVisit
+	if err := e.DirVisits(struct{}{}, &visits); err != nil {
+		t.Fatalf("DirVisits => %v", err)
+	}
+	if len(visits) != 1 || visits[0].Visits != 4 || visits[0].LastVisit == 0 {
+		t.Errorf("visits are %v, want /a visited 4 times, last just now", visits)
+	}
+}
+
+func TestStore(t *testing.T) {
+	c, cleanup := newTestClient(t)
+	defer cleanup()
+
+	var value string
+	if err := c.GetStore("k", &value); err != StoreKeyNotFound {
+		t.Errorf("GetStore of a missing key => %v, want StoreKeyNotFound", err)
+	}
+	if err := c.SetStore(&StoreEntry{"k", "v"}, &struct{}{}); err != nil {
+		t.Fatalf("SetStore => %v", err)
+	}
+	if err := c.GetStore("k", &value); err != nil || value != "v" {
+		t.Errorf("GetStore => (%q, %v), want v", value, err)
+	}
+	big := strings.Repeat("x", MaxStoreValue+1)
+	if err := c.SetStore(&StoreEntry{"big", big}, &struct{}{}); err == nil {
+		t.Errorf("SetStore of a value too large => success, want failure")
+	}
+	if err := c.DelStore("k", &struct{}{}); err != nil {
+		t.Fatalf("DelStore => %v", err)
+	}
+	if err := c.GetStore("k", &value); err != StoreKeyNotFound {
+		t.Errorf("GetStore of a deleted key => %v, want StoreKeyNotFound", err)
+	}
+}
+
+func TestUniVars(t *testing.T) {
+	c, cleanup := newTestClient(t)
+	defer cleanup()
+
+	var seq int64
+	if err := c.LastEventSeq(struct{}{}, &seq); err != nil {
+		t.Fatalf("LastEventSeq => %v", err)
+	}
+	if err := c.SetUniVar(&UniVar{"x", "1"}, &struct{}{}); err != nil {
+		t.Fatalf("SetUniVar => %v", err)
+	}
+	var value string
+	if err := c.GetUniVar("x", &value); err != nil || value != "1" {
+		t.Errorf("GetUniVar => (%q, %v), want 1", value, err)
+	}
+	if err := c.GetUniVar("y", &value); err != UniVarNotFound {
+		t.Errorf("GetUniVar of a missing variable => %v, want UniVarNotFound", err)
+	}
+	var events []Event
+	if err := c.WaitEvents(seq, &events); err != nil {
+		t.Fatalf("WaitEvents => %v", err)
+	}
+	if len(events) != 1 || events[0].Kind != UniVarChanged || events[0].Name != "x" {
+		t.Errorf("events are %v, want one change of x", events)
+	}
+}
+
+func TestLineProtocol(t *testing.T) {
+	e, cleanup := newTestElvishd(t)
+	defer cleanup()
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go e.ServeConn(serverConn)
+
+	go clientConn.Write([]byte(`{"method":"Elvishd.Echo","params":["hi"],"id":7}` + "\n"))
+	line, err := bufio.NewReader(clientConn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"id":7,"result":"hi","error":null}` + "\n"; line != want {
+		t.Errorf("reply to Echo is %q, want %q", line, want)
+	}
+}
@@ -0,0 +1,74 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/xiaq/elvish/util"
+)
+
+const (
+	daemonName         = "elvishd"
+	spawnWaitInterval  = 10 * time.Millisecond
+	spawnWaitMaxPeriod = 2 * time.Second
+)
+
+var errSpawnTimeout = errors.New("timed out waiting for elvishd to start")
+
+// Connect connects to the elvishd serving the current user, spawning one if
+// none is running. If none is running and elvishd is not installed, it fails
+// with DaemonNotFound.
+func Connect() (Client, error) {
+	addr, err := util.SocketName()
+	if err != nil {
+		return Client{}, err
+	}
+	c, err := Dial("unix", addr)
+	if err == nil || err == VersionMismatch {
+		return c, err
+	}
+
+	if err := spawn(); err != nil {
+		return Client{}, err
+	}
+	for waited := time.Duration(0); waited < spawnWaitMaxPeriod; waited += spawnWaitInterval {
+		time.Sleep(spawnWaitInterval)
+		c, err = Dial("unix", addr)
+		if err == nil || err == VersionMismatch {
+			return c, err
+		}
+	}
+	return Client{}, errSpawnTimeout
+}
+
+// spawn starts elvishd in the background, in its own session so that it
+// outlives the terminal. elvishd is looked up next to the running executable
+// first, and then in $PATH.
+func spawn() error {
+	path := ""
+	if exe, err := os.Executable(); err == nil {
+		candidate := filepath.Join(filepath.Dir(exe), daemonName)
+		if _, err := os.Stat(candidate); err == nil {
+			path = candidate
+		}
+	}
+	if path == "" {
+		var err error
+		path, err = exec.LookPath(daemonName)
+		if err != nil {
+			return DaemonNotFound
+		}
+	}
+	cmd := exec.Command(path)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// Don't leave a zombie if elvishd exits before we do.
+	go cmd.Wait()
+	return nil
+}
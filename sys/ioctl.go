@@ -0,0 +1,11 @@
+package sys
+
+import "syscall"
+
+func Ioctl(fd int, req int, arg uintptr) error {
+	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(req), arg)
+	if e != 0 {
+		return e
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+package sys
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// Available returns the number of bytes that can be read from fd, which may
+// be a pipe or a terminal, without blocking.
+func Available(fd int) (int, error) {
+	var n int32
+	err := Ioctl(fd, syscall.TIOCINQ, uintptr(unsafe.Pointer(&n)))
+	return int(n), err
+}
@@ -0,0 +1,13 @@
+// +build !linux
+
+package sys
+
+import "errors"
+
+var errAvailableUnsupported = errors.New("Available is not supported on this system")
+
+// Available returns the number of bytes that can be read from fd without
+// blocking. It is only supported on Linux; elsewhere it always fails.
+func Available(fd int) (int, error) {
+	return 0, errAvailableUnsupported
+}
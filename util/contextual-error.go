@@ -3,6 +3,7 @@ package util
 import (
 	"bytes"
 	"fmt"
+	"regexp"
 	"strings"
 )
 
@@ -12,23 +13,76 @@ type ContextualError struct {
 	colno  int
 	line   string
 	msg    string
+	// Pos is the byte offset of the error in the text.
+	Pos int
+	// Callers are the contexts the code containing the error was called
+	// from, outermost first. Pprint shows them as a traceback.
+	Callers []*ContextualError
+	// Incomplete is set on a parse error caused by the input ending too
+	// early, which more input may fix.
+	Incomplete bool
 }
 
 func NewContextualError(name string, text string, pos int, format string, args ...interface{}) *ContextualError {
 	lineno, colno, line := FindContext(text, pos)
-	return &ContextualError{name, lineno, colno, line, fmt.Sprintf(format, args...)}
+	return &ContextualError{name, lineno, colno, line, fmt.Sprintf(format, args...), pos, nil, false}
+}
+
+// Message returns the message of the error, without the position.
+func (e *ContextualError) Message() string {
+	return e.msg
 }
 
 func (e *ContextualError) Error() string {
 	return fmt.Sprintf("%s:%d:%d %s", e.name, e.lineno, e.colno, e.msg)
 }
 
+// maxCallers is the most callers Pprint shows in full; of a longer
+// traceback, like that of a runaway recursion, only both ends are shown.
+const maxCallers = 20
+
+// Pprint pretty-prints the error with its context, in color unless the
+// terminal is dumb.
 func (e *ContextualError) Pprint() string {
 	buf := new(bytes.Buffer)
+	if len(e.Callers) > 0 {
+		fmt.Fprintf(buf, "Traceback (most recent call last):\n")
+		for i, c := range e.Callers {
+			if n := len(e.Callers); n > maxCallers && i >= maxCallers/2 && i < n-maxCallers/2 {
+				if i == maxCallers/2 {
+					fmt.Fprintf(buf, "... %d more calls ...\n", n-maxCallers)
+				}
+				continue
+			}
+			c.pprint(buf, "\033[36m", "note: ")
+		}
+	}
+	e.pprint(buf, "\033[31m", "error: ")
+	return stripSGRIfDumb(buf.String())
+}
+
+// PprintWarning is like Pprint, but labels the error as a warning, for
+// problems that don't stop the code from running.
+func (e *ContextualError) PprintWarning() string {
+	buf := new(bytes.Buffer)
+	e.pprint(buf, "\033[33m", "warning: ")
+	return stripSGRIfDumb(buf.String())
+}
+
+func stripSGRIfDumb(s string) string {
+	if IsDumbTerm() {
+		return sgrPattern.ReplaceAllString(s, "")
+	}
+	return s
+}
+
+var sgrPattern = regexp.MustCompile("\033\\[[0-9;]*m")
+
+func (e *ContextualError) pprint(buf *bytes.Buffer, color, label string) {
 	// Position info
 	fmt.Fprintf(buf, "\033[1m%s:%d:%d: ", e.name, e.lineno+1, e.colno+1)
-	// "error:"
-	fmt.Fprintf(buf, "\033[31merror: ")
+	// Label, e.g. "error:"
+	fmt.Fprintf(buf, "%s%s", color, label)
 	// Message
 	fmt.Fprintf(buf, "\033[m\033[1m%s\033[m\n", e.msg)
 	// Context: line
@@ -37,5 +91,4 @@ func (e *ContextualError) Pprint() string {
 	// Context: arrow
 	// TODO Handle multi-width characters
 	fmt.Fprintf(buf, "%s\033[32;1m^\033[m\n", strings.Repeat(" ", e.colno))
-	return buf.String()
 }
@@ -0,0 +1,28 @@
+package util
+
+import "strings"
+
+// Errors is a list of errors, which is itself an error.
+type Errors []error
+
+func (es Errors) Error() string {
+	msgs := make([]string, len(es))
+	for i, e := range es {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Pprint pretty-prints all the errors. Errors that are *ContextualError's are
+// shown with their contexts.
+func (es Errors) Pprint() string {
+	var b []string
+	for _, e := range es {
+		if ce, ok := e.(*ContextualError); ok {
+			b = append(b, ce.Pprint())
+		} else {
+			b = append(b, e.Error()+"\n")
+		}
+	}
+	return strings.Join(b, "")
+}
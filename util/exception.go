@@ -12,6 +12,13 @@ func Panic(err error) {
 	panic(exception{err})
 }
 
+// IsException returns whether r, a value recovered from a panic, was thrown
+// by Panic.
+func IsException(r interface{}) bool {
+	_, ok := r.(exception)
+	return ok
+}
+
 // Recover tries to catch an error thrown by Panic and stop the panic. If the
 // panic is not caused by Panic, the panic is not stopped.
 func Recover(perr *error) {
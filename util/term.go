@@ -0,0 +1,12 @@
+package util
+
+import "os"
+
+// IsDumbTerm determines whether the terminal, as described by the
+// environment, cannot handle escape sequences, which is when $TERM is "dumb".
+// This covers the shell mode of Emacs, which sets $TERM to "dumb"; terminal
+// emulators inside Emacs, like M-x term and vterm, set $TERM to what they
+// emulate.
+func IsDumbTerm() bool {
+	return os.Getenv("TERM") == "dumb"
+}
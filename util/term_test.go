@@ -0,0 +1,30 @@
+package util
+
+import (
+	"os"
+	"testing"
+)
+
+var isDumbTermTests = []struct {
+	term, insideEmacs string
+	out               bool
+}{
+	{"dumb", "", true},
+	{"dumb", "25.1,comint", true},
+	{"eterm-color", "25.1,term:0.96", false},
+	{"xterm-256color", "vterm", false},
+	{"", "", false},
+}
+
+func TestIsDumbTerm(t *testing.T) {
+	term, insideEmacs := os.Getenv("TERM"), os.Getenv("INSIDE_EMACS")
+	defer os.Setenv("TERM", term)
+	defer os.Setenv("INSIDE_EMACS", insideEmacs)
+	for _, tt := range isDumbTermTests {
+		os.Setenv("TERM", tt.term)
+		os.Setenv("INSIDE_EMACS", tt.insideEmacs)
+		if o := IsDumbTerm(); o != tt.out {
+			t.Errorf("IsDumbTerm() with TERM=%q INSIDE_EMACS=%q => %v, want %v", tt.term, tt.insideEmacs, o, tt.out)
+		}
+	}
+}